@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultAgentLogLines is how many of the agent's own recent log lines are
+// kept unless AGENT_LOG_LINES says otherwise
+const defaultAgentLogLines = 500
+
+// AgentLog holds the agent's most recent log lines, for agent-logs and
+// failure diagnostics. It's nil if AGENT_LOG_LINES is 0.
+var AgentLog = newLogTail(defaultAgentLogLines)
+
+// logEntry is a single line of the agent's log
+type logEntry struct {
+	time  time.Time
+	level slog.Level
+	line  string
+}
+
+// logTail is an io.Writer which keeps the last n lines written to it. The log
+// package writes one entry per call, so entries don't need reassembling, and
+// every line of a multi-line entry gets the entry's level.
+type logTail struct {
+	m       sync.Mutex
+	n       int
+	entries []logEntry
+}
+
+func newLogTail(n int) *logTail {
+	return &logTail{n: n}
+}
+
+// entryLevel returns the level slog's default handler wrote into a log line,
+// i.e., the word after the date and time. Lines written by the log package
+// directly have no level, and are treated as info.
+func entryLevel(line string) slog.Level {
+	var fields = strings.SplitN(line, " ", 4)
+	if len(fields) < 3 {
+		return slog.LevelInfo
+	}
+	var level slog.Level
+	var err = level.UnmarshalText([]byte(fields[2]))
+	if err != nil {
+		return slog.LevelInfo
+	}
+	return level
+}
+
+func (t *logTail) Write(p []byte) (int, error) {
+	var now = time.Now()
+	var lines = strings.Split(strings.TrimRight(string(p), "\n"), "\n")
+	var level = entryLevel(lines[0])
+
+	t.m.Lock()
+	defer t.m.Unlock()
+	for _, line := range lines {
+		t.entries = append(t.entries, logEntry{time: now, level: level, line: line})
+	}
+	if len(t.entries) > t.n {
+		t.entries = append([]logEntry(nil), t.entries[len(t.entries)-t.n:]...)
+	}
+	return len(p), nil
+}
+
+// Entries returns the kept entries logged at or after since with at least the
+// given level, oldest first, with secrets redacted
+func (t *logTail) Entries(since time.Time, level slog.Level) []logEntry {
+	t.m.Lock()
+	defer t.m.Unlock()
+	var list []logEntry
+	for _, e := range t.entries {
+		if e.time.Before(since) || e.level < level {
+			continue
+		}
+		e.line, _ = Redactor.Redact(e.line)
+		list = append(list, e)
+	}
+	return list
+}
+
+// Lines returns every kept line, oldest first, with secrets redacted
+func (t *logTail) Lines() []string {
+	var entries = t.Entries(time.Time{}, slog.LevelDebug)
+	var lines = make([]string, len(entries))
+	for i, e := range entries {
+		lines[i] = e.line
+	}
+	return lines
+}
+
+// parseSince reads --since's value: a duration back from now, or a time in
+// RFC 3339 format
+func parseSince(val string, now time.Time) (time.Time, error) {
+	var d, err = time.ParseDuration(val)
+	if err == nil {
+		if d < 0 {
+			return time.Time{}, fmt.Errorf("%q must not be negative", val)
+		}
+		return now.Add(-d), nil
+	}
+	var t time.Time
+	t, err = time.Parse(time.RFC3339, val)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither a duration (e.g., 15m) nor an RFC 3339 time", val)
+	}
+	return t, nil
+}
+
+// parseAgentLogsArgs reads agent-logs' options. Without any, every kept line
+// is returned.
+func parseAgentLogsArgs(args []string, now time.Time) (since time.Time, level slog.Level, err error) {
+	level = slog.LevelDebug
+	for i := 0; i < len(args); i++ {
+		var opt = args[i]
+		if opt != "--since" && opt != "--level" {
+			return since, level, fmt.Errorf("%q is not a valid option", opt)
+		}
+		if i+1 >= len(args) {
+			return since, level, fmt.Errorf("%s requires a value", opt)
+		}
+		i++
+		if opt == "--since" {
+			since, err = parseSince(args[i], now)
+			if err != nil {
+				return since, level, err
+			}
+			continue
+		}
+		if level.UnmarshalText([]byte(args[i])) != nil {
+			return since, level, fmt.Errorf("%q is not a valid level (use debug, info, warn, or error)", args[i])
+		}
+	}
+	return since, level, nil
+}
+
+func agentLogs(r *request) response {
+	if AgentLog == nil {
+		return respond(StatusError, "The agent's log isn't being kept (AGENT_LOG_LINES is 0)", nil)
+	}
+	var since, level, err = parseAgentLogsArgs(r.args, time.Now())
+	if err != nil {
+		return respond(StatusError, fmt.Sprintf("Invalid %q arguments", r.command), H{"error": err.Error()})
+	}
+
+	var list = []H{}
+	for _, e := range AgentLog.Entries(since, level) {
+		list = append(list, H{"time": e.time, "level": e.level.String(), "line": e.line})
+	}
+	return respond(StatusSuccess, "", H{"entries": list, "count": len(list)})
+}
+
+func init() {
+	register("agent-logs", agentLogs)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestEntryLevel(t *testing.T) {
+	var tests = map[string]slog.Level{
+		"2024/05/01 10:00:00 INFO Job complete id=1":  slog.LevelInfo,
+		"2024/05/01 10:00:00 WARN Solr is slow":       slog.LevelWarn,
+		"2024/05/01 10:00:00 ERROR Unable to connect": slog.LevelError,
+		"2024/05/01 10:00:00 DEBUG+2 Detail":          slog.LevelDebug + 2,
+		"2024/05/01 10:00:00 Listening on :2222":      slog.LevelInfo,
+		"panic":                                       slog.LevelInfo,
+	}
+	for line, expected := range tests {
+		var got = entryLevel(line)
+		if got != expected {
+			t.Errorf("Expected %q to be %s, got %s", line, expected, got)
+		}
+	}
+}
+
+func TestParseAgentLogsArgs(t *testing.T) {
+	var now = time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	var tests = map[string]struct {
+		args        []string
+		since       time.Time
+		level       slog.Level
+		expectError bool
+	}{
+		"none":        {level: slog.LevelDebug},
+		"duration":    {args: []string{"--since", "15m"}, since: now.Add(-15 * time.Minute), level: slog.LevelDebug},
+		"time":        {args: []string{"--since", "2024-04-30T08:00:00Z"}, since: time.Date(2024, 4, 30, 8, 0, 0, 0, time.UTC), level: slog.LevelDebug},
+		"level":       {args: []string{"--level", "warn"}, level: slog.LevelWarn},
+		"both":        {args: []string{"--level", "ERROR", "--since", "1h"}, since: now.Add(-time.Hour), level: slog.LevelError},
+		"negative":    {args: []string{"--since", "-5m"}, expectError: true},
+		"bad since":   {args: []string{"--since", "yesterday"}, expectError: true},
+		"bad level":   {args: []string{"--level", "loud"}, expectError: true},
+		"no value":    {args: []string{"--level"}, expectError: true},
+		"bad option":  {args: []string{"--tail"}, expectError: true},
+		"bare string": {args: []string{"error"}, expectError: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var since, level, err = parseAgentLogsArgs(tc.args, now)
+			if tc.expectError {
+				if err == nil {
+					t.Fatalf("Expected an error, got %s / %s", since, level)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if !since.Equal(tc.since) || level != tc.level {
+				t.Fatalf("Expected %s / %s, got %s / %s", tc.since, tc.level, since, level)
+			}
+		})
+	}
+}
+
+func TestAgentLogs(t *testing.T) {
+	var origLog = AgentLog
+	defer func() { AgentLog = origLog }()
+
+	AgentLog = newLogTail(3)
+	fmt.Fprintf(AgentLog, "2024/05/01 10:00:00 INFO dropped\n")
+	fmt.Fprintf(AgentLog, "2024/05/01 10:00:01 INFO Job complete id=1\n")
+	fmt.Fprintf(AgentLog, "2024/05/01 10:00:02 ERROR Job failed id=2\ntraceback line\n")
+
+	var resp = agentLogs(&request{command: "agent-logs"})
+	var entries = resp.data["entries"].([]H)
+	if resp.status != StatusSuccess || len(entries) != 3 || entries[0]["line"] != "2024/05/01 10:00:01 INFO Job complete id=1" {
+		t.Fatalf("Expected the last three lines, got %#v", resp)
+	}
+
+	resp = agentLogs(&request{command: "agent-logs", args: []string{"--level", "error"}})
+	entries = resp.data["entries"].([]H)
+	if len(entries) != 2 || entries[1]["line"] != "traceback line" || entries[1]["level"] != "ERROR" {
+		t.Fatalf("Expected the error entry's two lines, got %#v", entries)
+	}
+
+	resp = agentLogs(&request{command: "agent-logs", args: []string{"--since", time.Now().Add(time.Minute).Format(time.RFC3339)}})
+	if resp.data["count"] != 0 {
+		t.Fatalf("Expected nothing logged in the future, got %#v", resp.data)
+	}
+
+	AgentLog = nil
+	resp = agentLogs(&request{command: "agent-logs"})
+	if resp.status != StatusError {
+		t.Fatalf("Expected an error when the log isn't kept, got %#v", resp)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+
+	"github.com/open-oni/oni-agent/internal/batchxml"
+	"github.com/spf13/afero"
+)
+
+// agentFS is the filesystem the agent's own file handling goes through:
+// batch validation, host keys, and title MARC written for ONI. It's the real
+// filesystem except in tests, which can swap in an afero.MemMapFs. Anything
+// ONI or another program reads must still end up on disk, so only tests that
+// don't run those programs should replace it.
+var agentFS afero.Fs = afero.NewOsFs()
+
+// readBatchXML is batchxml.Read, but reads through agentFS
+func readBatchXML(batchPath string) (*batchxml.Batch, error) {
+	var data, err = afero.ReadFile(agentFS, batchxml.XMLPath(batchPath))
+	if err != nil {
+		return nil, fmt.Errorf("reading file: %w", err)
+	}
+
+	var b *batchxml.Batch
+	b, err = batchxml.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("processing xml: %w", err)
+	}
+	return b, nil
+}
+
+// maxLinkHops is how many symlinks resolveLink follows before it gives up,
+// as Linux does
+const maxLinkHops = 40
+
+// lstat is agentFS's Lstat where it has one, and Stat where it doesn't
+func lstat(path string) (fs.FileInfo, error) {
+	if l, ok := agentFS.(afero.Lstater); ok {
+		var info, _, err = l.LstatIfPossible(path)
+		return info, err
+	}
+	return agentFS.Stat(path)
+}
+
+// resolveLink returns what the symlink at path finally points to, reading
+// links through agentFS. Only the links themselves are followed; any links
+// among the target's parent directories are left as they are.
+func resolveLink(path string) (string, error) {
+	var r, ok = agentFS.(afero.LinkReader)
+	if !ok {
+		return "", fmt.Errorf("%s: symlinks aren't supported here", path)
+	}
+	for range maxLinkHops {
+		var target, err = r.ReadlinkIfPossible(path)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		path = filepath.Clean(target)
+
+		var info fs.FileInfo
+		info, err = lstat(path)
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("%s: too many levels of symlinks", path)
+}
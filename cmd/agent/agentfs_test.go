@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/open-oni/oni-agent/internal/batchxml"
+	"github.com/spf13/afero"
+)
+
+func TestAgentFSInMemory(t *testing.T) {
+	var origFS = agentFS
+	defer func() { agentFS = origFS }()
+	agentFS = afero.NewMemMapFs()
+
+	var dir = "/batches/batch_oru_mem_ver01"
+	var b = &batchxml.Batch{Name: "batch_oru_mem_ver01", Awardee: "oru", Issues: []*batchxml.Issue{
+		{LCCN: "sn83025138", IssueDate: "1902-11-22", EditionOrder: "01", Filepath: "sn83025138/1902112201.xml"},
+	}}
+	var data, err = b.Marshal()
+	if err == nil {
+		err = afero.WriteFile(agentFS, batchxml.XMLPath(dir), data, 0644)
+	}
+	if err != nil {
+		t.Fatalf("Unable to write test batch: %s", err)
+	}
+
+	err = validateBatch(dir)
+	if err == nil {
+		t.Fatalf("Expected a missing issue file to fail validation")
+	}
+	err = afero.WriteFile(agentFS, b.Issues[0].Path(dir), []byte("<mets/>"), 0644)
+	if err != nil {
+		t.Fatalf("Unable to write issue file: %s", err)
+	}
+	err = validateBatch(dir)
+	if err != nil {
+		t.Fatalf("Expected batch to be valid, got %s", err)
+	}
+
+	// Host keys are generated into, and read back from, the same filesystem
+	var first, second []hostKey
+	first, err = readHostKeys([]string{"/keys/host_ed25519"}, keyTypeED25519, hostKeyPassphrase{})
+	if err == nil {
+		second, err = readHostKeys([]string{"/keys/host_ed25519"}, keyTypeED25519, hostKeyPassphrase{})
+	}
+	if err != nil {
+		t.Fatalf("Unable to generate and re-read host key: %s", err)
+	}
+	if string(first[0].signer.PublicKey().Marshal()) != string(second[0].signer.PublicKey().Marshal()) {
+		t.Errorf("Re-reading the key gave a different key")
+	}
+	var ok bool
+	ok, err = afero.Exists(agentFS, "/keys/host_ed25519.pub")
+	if !ok || err != nil {
+		t.Errorf("Expected public key file in memory: %v, %v", ok, err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+	"unicode/utf8"
+
+	"github.com/open-oni/oni-agent/internal/artifact"
+)
+
+func listArtifacts(r *request) response {
+	if Artifacts == nil {
+		return respond(StatusError, "Artifact storage is not enabled", nil)
+	}
+
+	var list, err = Artifacts.List()
+	if err != nil {
+		r.logError("Unable to list artifacts", "error", err)
+		return respond(StatusError, "Unable to list artifacts", H{"error": err.Error()})
+	}
+
+	var out = make([]H, len(list))
+	for i, a := range list {
+		out[i] = H{"name": a.Name, "size": a.Size, "modified": a.Modified}
+		artifactURL(r, out[i], a.Name)
+	}
+	return respond(StatusSuccess, "", H{"artifacts": out})
+}
+
+// artifactURL adds a direct download URL to the artifact's data if the store
+// can provide one. Failures are logged but not fatal, since the client can
+// always fall back to get-artifact.
+func artifactURL(r *request, data H, name string) {
+	var u, err = Artifacts.URL(name, ArtifactURLExpiry)
+	if err != nil {
+		r.logError("Unable to generate artifact URL", "name", name, "error", err)
+		return
+	}
+	if u != "" {
+		data["url"] = u
+		data["url_expires"] = time.Now().Add(ArtifactURLExpiry).UTC()
+	}
+}
+
+// getArtifact returns an artifact's contents. JSON artifacts (like reports)
+// are embedded as-is so clients don't have to decode them twice, other text
+// is sent as a string, and anything else is base64-encoded.
+func getArtifact(r *request, name string) response {
+	if Artifacts == nil {
+		return respond(StatusError, "Artifact storage is not enabled", nil)
+	}
+
+	var f, err = Artifacts.Get(name)
+	if errors.Is(err, artifact.ErrInvalidName) {
+		return respond(StatusError, fmt.Sprintf("%q is not a valid artifact name", name), nil)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return respond(StatusError, "Artifact not found", H{"artifact": H{"name": name}})
+	}
+	if err != nil {
+		r.logError("Unable to open artifact", "name", name, "error", err)
+		return respond(StatusError, "Unable to read artifact", H{"error": err.Error()})
+	}
+	defer f.Close()
+
+	var data []byte
+	data, err = io.ReadAll(f)
+	if err != nil {
+		r.logError("Unable to read artifact", "name", name, "error", err)
+		return respond(StatusError, "Unable to read artifact", H{"error": err.Error()})
+	}
+
+	var out = H{"name": name}
+	artifactURL(r, out, name)
+	switch {
+	case json.Valid(data):
+		out["encoding"], out["content"] = "json", json.RawMessage(data)
+	case utf8.Valid(data):
+		out["encoding"], out["content"] = "text", string(data)
+	default:
+		out["encoding"], out["content"] = "base64", data
+	}
+	return respond(StatusSuccess, "", H{"artifact": out})
+}
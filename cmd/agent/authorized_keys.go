@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	gliderssh "github.com/gliderlabs/ssh"
+	"golang.org/x/crypto/ssh"
+)
+
+// AuthorizedKeysFile is the optional authorized_keys-style file listing the
+// only public keys which may connect over SSH
+var AuthorizedKeysFile string
+
+// AuthorizedKeys holds the keys read from AuthorizedKeysFile. When it's
+// empty, SSH clients aren't authenticated at all.
+var AuthorizedKeys []authorizedKey
+
+// permitCommandsOption is the authorized_keys option which limits a key to
+// a list of commands
+const permitCommandsOption = "permit-commands"
+
+// ignoredKeyOptions are OpenSSH options which restrict things the agent
+// never offers anyway, so they're accepted and have no effect
+var ignoredKeyOptions = map[string]bool{
+	"no-agent-forwarding": true,
+	"no-port-forwarding":  true,
+	"no-pty":              true,
+	"no-user-rc":          true,
+	"no-X11-forwarding":   true,
+	"restrict":            true,
+}
+
+// authorizedKey is one client key which may connect
+type authorizedKey struct {
+	key     ssh.PublicKey
+	comment string
+
+	// commands are the commands the key may run; nil means any
+	commands map[string]bool
+}
+
+// readAuthorizedKeys parses an authorized_keys-style file. Blank lines and
+// comments are skipped, and the only option with any effect is
+// permit-commands="cmd1,cmd2,...". Options the agent can't honor, like
+// from= or command=, are refused rather than silently ignored.
+func readAuthorizedKeys(fname string) ([]authorizedKey, error) {
+	var data, err = os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []authorizedKey
+	var line int
+	for _, text := range bytes.Split(data, []byte("\n")) {
+		line++
+		text = bytes.TrimSpace(text)
+		if len(text) == 0 || text[0] == '#' {
+			continue
+		}
+
+		var k authorizedKey
+		var options []string
+		k.key, k.comment, options, _, err = ssh.ParseAuthorizedKey(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", fname, line, err)
+		}
+		for _, opt := range options {
+			err = k.applyOption(opt)
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: %w", fname, line, err)
+			}
+		}
+		keys = append(keys, k)
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s has no keys", fname)
+	}
+	return keys, nil
+}
+
+// applyOption handles a single authorized_keys option for the key
+func (k *authorizedKey) applyOption(opt string) error {
+	var name, val, hasVal = strings.Cut(opt, "=")
+	if ignoredKeyOptions[name] && !hasVal {
+		return nil
+	}
+	if name != permitCommandsOption || !hasVal {
+		return fmt.Errorf("option %q is not supported (only %s and %s)", opt, permitCommandsOption, strings.Join(sortedKeys(ignoredKeyOptions), ", "))
+	}
+
+	val = strings.Trim(val, `"`)
+	var list = splitList(val)
+	if len(list) == 0 {
+		return fmt.Errorf("%s must list at least one command", permitCommandsOption)
+	}
+	if k.commands == nil {
+		k.commands = make(map[string]bool)
+	}
+	for _, name := range list {
+		if commands[name] == nil {
+			return fmt.Errorf("%s: %q is not a valid command name", permitCommandsOption, name)
+		}
+		if !roleOffers(AgentRole, name) {
+			return fmt.Errorf("%s: %q is not available to a %q agent", permitCommandsOption, name, AgentRole)
+		}
+		k.commands[name] = true
+	}
+	return nil
+}
+
+// keyFingerprintExtension is the SSH permissions extension which holds the
+// fingerprint of the authorized key a client authenticated with
+const keyFingerprintExtension = "key-fingerprint@oni-agent"
+
+// findAuthorizedKey returns the authorized entry for key, or nil if it isn't
+// authorized
+func findAuthorizedKey(key ssh.PublicKey) *authorizedKey {
+	if key == nil {
+		return nil
+	}
+	return findAuthorizedFingerprint(ssh.FingerprintSHA256(key))
+}
+
+// findAuthorizedFingerprint returns the authorized entry whose key has the
+// given SHA256 fingerprint, or nil if there isn't one
+func findAuthorizedFingerprint(fingerprint string) *authorizedKey {
+	if fingerprint == "" {
+		return nil
+	}
+	for i := range AuthorizedKeys {
+		if ssh.FingerprintSHA256(AuthorizedKeys[i].key) == fingerprint {
+			return &AuthorizedKeys[i]
+		}
+	}
+	return nil
+}
+
+// checkPublicKey is the SSH server's PublicKeyHandler when
+// BA_AUTHORIZED_KEYS is set. Clients may offer several keys before signing
+// with one; the SSH library calls this again for the key a client signs with
+// if it wasn't the last one offered, so the fingerprint left in the
+// connection's permissions is always the key which authenticated. Refusing a
+// key clears it, so an earlier key's grant never carries over.
+func checkPublicKey(ctx gliderssh.Context, key gliderssh.PublicKey) bool {
+	var perms = ctx.Permissions()
+	delete(perms.Extensions, keyFingerprintExtension)
+	var k = findAuthorizedKey(key)
+	if k == nil {
+		slog.Warn("Refused unknown SSH key", "audit", true, "user", ctx.User(), "source", ctx.RemoteAddr(),
+			"fingerprint", ssh.FingerprintSHA256(key))
+		return false
+	}
+	if perms.Extensions == nil {
+		perms.Extensions = make(map[string]string)
+	}
+	perms.Extensions[keyFingerprintExtension] = ssh.FingerprintSHA256(key)
+	return true
+}
+
+// keyFingerprint returns the fingerprint of the authorized key the session
+// authenticated with, or "" if keys aren't checked
+func (s session) keyFingerprint() string {
+	var perms = s.Permissions()
+	if perms.Permissions == nil {
+		return ""
+	}
+	return perms.Extensions[keyFingerprintExtension]
+}
+
+// keyCommands returns the commands the key with the given fingerprint may
+// run, or nil if it may run any of them (including when keys aren't checked
+// at all). A key which isn't authorized may run nothing, though the SSH
+// server shouldn't have let it connect in the first place.
+func keyCommands(fingerprint string) map[string]bool {
+	if len(AuthorizedKeys) == 0 {
+		return nil
+	}
+	var k = findAuthorizedFingerprint(fingerprint)
+	if k == nil {
+		return map[string]bool{}
+	}
+	return k.commands
+}
+
+// keyClient identifies a session by its key's fingerprint for rate limiting,
+// or returns "" if it didn't authenticate with one
+func keyClient(fingerprint string) string {
+	if fingerprint == "" {
+		return ""
+	}
+	return "key:" + fingerprint
+}
+
+// keyComment returns the comment of the authorized key the session connected
+// with, to say who connected in the logs
+func (s session) keyComment() string {
+	var k = findAuthorizedFingerprint(s.keyFingerprint())
+	if k == nil {
+		return ""
+	}
+	return k.comment
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	gliderssh "github.com/gliderlabs/ssh"
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestKey returns a new public key in authorized_keys format, without the
+// trailing newline
+func newTestKey(t *testing.T) (ssh.PublicKey, string) {
+	t.Helper()
+	var pub, _, err = ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %s", err)
+	}
+	var key ssh.PublicKey
+	key, err = ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("Unable to convert key: %s", err)
+	}
+	return key, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+func TestReadAuthorizedKeys(t *testing.T) {
+	var nca, ncaLine = newTestKey(t)
+	var monitor, monitorLine = newTestKey(t)
+	var stranger, _ = newTestKey(t)
+
+	var fname = filepath.Join(t.TempDir(), "authorized_keys")
+	var data = strings.Join([]string{
+		"# NCA can do anything",
+		ncaLine + " nca@example.org",
+		"",
+		`restrict,permit-commands="version,list-jobs" ` + monitorLine + " monitoring",
+	}, "\n")
+	var err = os.WriteFile(fname, []byte(data), 0600)
+	if err != nil {
+		t.Fatalf("Unable to write keys: %s", err)
+	}
+
+	var origKeys = AuthorizedKeys
+	defer func() { AuthorizedKeys = origKeys }()
+	AuthorizedKeys, err = readAuthorizedKeys(fname)
+	if err != nil {
+		t.Fatalf("Unable to read keys: %s", err)
+	}
+	if len(AuthorizedKeys) != 2 || AuthorizedKeys[1].comment != "monitoring" {
+		t.Fatalf("Unexpected keys: %#v", AuthorizedKeys)
+	}
+
+	if keyCommands(ssh.FingerprintSHA256(nca)) != nil {
+		t.Errorf("Expected the NCA key to be unrestricted, got %v", keyCommands(ssh.FingerprintSHA256(nca)))
+	}
+	var diff = cmp.Diff(map[string]bool{"version": true, "list-jobs": true}, keyCommands(ssh.FingerprintSHA256(monitor)))
+	if diff != "" {
+		t.Errorf("Unexpected commands for the monitoring key: %s", diff)
+	}
+	if findAuthorizedKey(stranger) != nil {
+		t.Errorf("An unlisted key must not be authorized")
+	}
+	if got := keyCommands(ssh.FingerprintSHA256(stranger)); got == nil || len(got) != 0 {
+		t.Errorf("An unlisted key must not be allowed any commands, got %v", got)
+	}
+}
+
+// keyContext is just enough of an SSH connection's context for
+// checkPublicKey
+type keyContext struct {
+	gliderssh.Context
+	perms *gliderssh.Permissions
+}
+
+func (c keyContext) Permissions() *gliderssh.Permissions { return c.perms }
+func (c keyContext) User() string                        { return "nca" }
+func (c keyContext) RemoteAddr() net.Addr                { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+
+func TestCheckPublicKey(t *testing.T) {
+	var monitor, _ = newTestKey(t)
+	var stranger, _ = newTestKey(t)
+	var origKeys = AuthorizedKeys
+	defer func() { AuthorizedKeys = origKeys }()
+	AuthorizedKeys = []authorizedKey{{key: monitor, comment: "monitoring"}}
+
+	var ctx = keyContext{perms: &gliderssh.Permissions{Permissions: &ssh.Permissions{}}}
+	if !checkPublicKey(ctx, monitor) {
+		t.Fatalf("Expected the monitoring key to be accepted")
+	}
+	var got = ctx.perms.Extensions[keyFingerprintExtension]
+	if got != ssh.FingerprintSHA256(monitor) {
+		t.Fatalf("Expected the accepted key's fingerprint to be recorded, got %q", got)
+	}
+
+	// Offering an unknown key afterward must not leave the earlier key's
+	// grant behind
+	if checkPublicKey(ctx, stranger) {
+		t.Fatalf("Expected an unlisted key to be refused")
+	}
+	got = ctx.perms.Extensions[keyFingerprintExtension]
+	if got != "" {
+		t.Fatalf("Expected a refused key to clear the fingerprint, got %q", got)
+	}
+}
+
+func TestReadAuthorizedKeysErrors(t *testing.T) {
+	var _, line = newTestKey(t)
+	var origRole = AgentRole
+	defer func() { AgentRole = origRole }()
+
+	var tests = map[string]struct {
+		data     string
+		role     string
+		expected string
+	}{
+		"empty":           {data: "# nobody\n", expected: "has no keys"},
+		"garbage":         {data: "not a key\n", expected: "line 1"},
+		"from option":     {data: `from="10.0.0.0/8" ` + line, expected: `option "from=\"10.0.0.0/8\"" is not supported`},
+		"forced command":  {data: `command="version" ` + line, expected: "is not supported"},
+		"unknown command": {data: `permit-commands="version,nope" ` + line, expected: `"nope" is not a valid command name`},
+		"no commands":     {data: `permit-commands="" ` + line, expected: "must list at least one command"},
+		"role command":    {data: `permit-commands="version,purge-batch" ` + line, role: roleVerify, expected: `"purge-batch" is not available to a "verify" agent`},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			AgentRole = roleFull
+			if tc.role != "" {
+				AgentRole = tc.role
+			}
+			var fname = filepath.Join(t.TempDir(), "authorized_keys")
+			var err = os.WriteFile(fname, []byte(tc.data), 0600)
+			if err != nil {
+				t.Fatalf("Unable to write keys: %s", err)
+			}
+			_, err = readAuthorizedKeys(fname)
+			if err == nil || !strings.Contains(err.Error(), tc.expected) {
+				t.Errorf("Expected an error containing %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestKeyCommandsRefused(t *testing.T) {
+	var resp = dispatch(&request{command: "version", keyCommands: map[string]bool{"list-jobs": true}})
+	if resp.status != StatusError || !strings.Contains(resp.message, "not permitted for this key") {
+		t.Fatalf("Expected the command to be refused for the key, got %q", resp.message)
+	}
+	resp = dispatch(&request{command: "version", keyCommands: map[string]bool{"version": true}})
+	if resp.status != StatusSuccess {
+		t.Fatalf("Expected a permitted command to run, got %q", resp.message)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// authorityRow is one awardee from a sync-awardees payload
+type authorityRow struct {
+	Code string
+	Name string
+}
+
+// Actions sync-awardees can take (or report) for a row
+const (
+	syncUnchanged = "unchanged"
+	syncCreated   = "created"
+	syncRenamed   = "renamed"
+	syncMismatch  = "name differs"
+	syncFailed    = "failed"
+)
+
+// awardeeSyncResult is what happened to a single awardee
+type awardeeSyncResult struct {
+	Code         string `json:"org_code"`
+	Name         string `json:"name"`
+	Action       string `json:"action"`
+	PreviousName string `json:"previous_name,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// parseAwardeeAuthority reads a MARC org code authority: either a JSON object
+// mapping org codes to names, or CSV rows of org code and name, optionally
+// with an "org_code,name" header. Rows are returned sorted by org code.
+func parseAwardeeAuthority(payload []byte) ([]authorityRow, error) {
+	payload = bytes.TrimSpace(payload)
+	if len(payload) == 0 {
+		return nil, errors.New("no awardees given")
+	}
+
+	var rows []authorityRow
+	if payload[0] == '{' {
+		var m map[string]string
+		var err = json.Unmarshal(payload, &m)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+		for code, name := range m {
+			rows = append(rows, authorityRow{Code: code, Name: name})
+		}
+	} else {
+		var cr = csv.NewReader(bytes.NewReader(payload))
+		cr.FieldsPerRecord = 2
+		cr.TrimLeadingSpace = true
+		for line := 1; ; line++ {
+			var rec, err = cr.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid CSV: %w", err)
+			}
+			if line == 1 && strings.EqualFold(rec[0], "org_code") && strings.EqualFold(rec[1], "name") {
+				continue
+			}
+			rows = append(rows, authorityRow{Code: rec[0], Name: rec[1]})
+		}
+	}
+
+	var seen = make(map[string]string)
+	for i, row := range rows {
+		row.Code, row.Name = strings.TrimSpace(row.Code), strings.TrimSpace(row.Name)
+		if row.Code == "" || row.Name == "" {
+			return nil, fmt.Errorf("every awardee needs an org code and a name (got %q, %q)", row.Code, row.Name)
+		}
+		var prev, dupe = seen[row.Code]
+		if dupe && prev != row.Name {
+			return nil, fmt.Errorf("org code %q is given twice, as %q and %q", row.Code, prev, row.Name)
+		}
+		seen[row.Code] = row.Name
+		rows[i] = row
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("no awardees given")
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].Code < rows[j].Code })
+	return dedupeAuthority(rows), nil
+}
+
+// dedupeAuthority drops repeated rows from a sorted list. Conflicting repeats
+// have already been refused, so only exact copies are left to drop.
+func dedupeAuthority(rows []authorityRow) []authorityRow {
+	var out = rows[:0]
+	for i, row := range rows {
+		if i > 0 && row.Code == rows[i-1].Code {
+			continue
+		}
+		out = append(out, row)
+	}
+	return out
+}
+
+// planAwardeeSync compares the authority with the existing awardees (org code
+// to name) and decides what should happen to each row. A differing name is
+// only renamed if fixNames is set; otherwise it's reported and left alone.
+func planAwardeeSync(rows []authorityRow, existing map[string]string, fixNames bool) []awardeeSyncResult {
+	var results = make([]awardeeSyncResult, 0, len(rows))
+	for _, row := range rows {
+		var res = awardeeSyncResult{Code: row.Code, Name: row.Name}
+		var name, ok = existing[row.Code]
+		switch {
+		case !ok:
+			res.Action = syncCreated
+		case name == row.Name:
+			res.Action = syncUnchanged
+		case fixNames:
+			res.Action, res.PreviousName = syncRenamed, name
+		default:
+			res.Action, res.PreviousName = syncMismatch, name
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+// existingAwardees returns every awardee's name, keyed by org code
+func existingAwardees() (map[string]string, error) {
+	var rows, err = dbPool.Query(ONIDB.AwardeeNames)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var existing = make(map[string]string)
+	for rows.Next() {
+		var code, name string
+		err = rows.Scan(&code, &name)
+		if err != nil {
+			return nil, err
+		}
+		existing[code] = name
+	}
+	return existing, rows.Err()
+}
+
+// applyAwardeeSync creates or renames the awardee for a planned result,
+// changing its action to syncFailed if the database refuses
+func applyAwardeeSync(res *awardeeSyncResult) {
+	var query, args = ONIDB.CreateAwardee, []any{res.Code, res.Name}
+	if res.Action == syncRenamed {
+		query, args = ONIDB.RenameAwardee, []any{res.Name, res.Code}
+	}
+
+	var result, err = dbPool.Exec(query, args...)
+	var n int64
+	if err == nil {
+		n, err = result.RowsAffected()
+	}
+	if err == nil && n != 1 {
+		err = fmt.Errorf("expected to change 1 row, changed %d", n)
+	}
+	if err != nil {
+		res.Action, res.Error = syncFailed, err.Error()
+		return
+	}
+
+	awardeeLookups.set(res.Code, true)
+	var details = H{"name": res.Name}
+	if res.PreviousName != "" {
+		details["previous_name"] = res.PreviousName
+	}
+	Changes.add(changeAwardee, res.Action, res.Code, details)
+}
+
+func syncAwardees(r *request, fixNames, dryRun bool) response {
+	var payload, err = r.payload()
+	if err != nil {
+		return respond(StatusError, "Unable to read awardee authority", payloadErrorData(err))
+	}
+
+	var rows []authorityRow
+	rows, err = parseAwardeeAuthority(payload)
+	if err != nil {
+		return respond(StatusError, "Invalid awardee authority", H{"error": err.Error()})
+	}
+
+	var existing map[string]string
+	existing, err = existingAwardees()
+	if err != nil {
+		return respond(StatusError, "Unable to read awardees from database", H{"error": err.Error()})
+	}
+
+	var results = planAwardeeSync(rows, existing, fixNames)
+	if !dryRun {
+		for i := range results {
+			if results[i].Action == syncCreated || results[i].Action == syncRenamed {
+				applyAwardeeSync(&results[i])
+			}
+		}
+	}
+
+	var counts = map[string]int{}
+	for _, res := range results {
+		counts[res.Action]++
+	}
+	var data = H{"results": results, "counts": counts, "dry_run": dryRun}
+	if dryRun {
+		return respond(StatusSuccess, "Dry run: no awardees were changed", data)
+	}
+
+	r.logInfo("Synced awardees", "created", counts[syncCreated], "renamed", counts[syncRenamed], "failed", counts[syncFailed])
+	if counts[syncFailed] > 0 {
+		return respond(StatusError, fmt.Sprintf("%d of %d awardees could not be synced", counts[syncFailed], len(results)), data)
+	}
+	return respond(StatusSuccess, "Awardees synced", data)
+}
+
+func init() {
+	register("sync-awardees", func(r *request) response {
+		var fixNames, dryRun bool
+		for _, arg := range r.args {
+			switch arg {
+			case "--fix-names":
+				fixNames = true
+			case "--dry-run":
+				dryRun = true
+			default:
+				return respond(StatusError, fmt.Sprintf("%q is not a valid option for %q", arg, r.command), nil)
+			}
+		}
+		return syncAwardees(r, fixNames, dryRun)
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseAwardeeAuthority(t *testing.T) {
+	var want = []authorityRow{{"oru", "University of Oregon"}, {"wa", "Washington State Library"}}
+	var tests = map[string]string{
+		"json":         `{"wa": "Washington State Library", "oru": " University of Oregon "}`,
+		"csv":          "wa,Washington State Library\noru,University of Oregon\n",
+		"csv header":   "org_code,name\r\nwa,Washington State Library\r\noru,University of Oregon\r\n",
+		"quoted csv":   "oru,\"University of Oregon\"\nwa,  Washington State Library",
+		"exact repeat": "oru,University of Oregon\nwa,Washington State Library\noru,University of Oregon",
+	}
+	for name, payload := range tests {
+		var got, err = parseAwardeeAuthority([]byte(payload))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err)
+			continue
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("%s: unexpected rows (-want +got):\n%s", name, diff)
+		}
+	}
+
+	for _, payload := range []string{
+		"",
+		"org_code,name\n",
+		`{"oru": 1}`,
+		"oru\n",
+		"oru,University of Oregon,extra\n",
+		"oru,\n",
+		"oru,University of Oregon\noru,Oregon University\n",
+	} {
+		var _, err = parseAwardeeAuthority([]byte(payload))
+		if err == nil {
+			t.Errorf("Expected %q to be refused", payload)
+		}
+	}
+}
+
+func TestPlanAwardeeSync(t *testing.T) {
+	var rows = []authorityRow{{"hu", "Hogwarts University"}, {"oru", "University of Oregon"}, {"wa", "Washington State Library"}}
+	var existing = map[string]string{"oru": "University of Oregon", "wa": "Washington State Lib.", "zz": "Not in the authority"}
+
+	var got = planAwardeeSync(rows, existing, false)
+	var want = []awardeeSyncResult{
+		{Code: "hu", Name: "Hogwarts University", Action: syncCreated},
+		{Code: "oru", Name: "University of Oregon", Action: syncUnchanged},
+		{Code: "wa", Name: "Washington State Library", Action: syncMismatch, PreviousName: "Washington State Lib."},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Unexpected plan (-want +got):\n%s", diff)
+	}
+
+	got = planAwardeeSync(rows, existing, true)
+	want[2].Action = syncRenamed
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Unexpected plan with --fix-names (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+func ensureAwardee(code string, name string) response {
+	// Loads for a batch usually start with the same ensure-awardee call, so
+	// knowing it exists is cached briefly
+	var exists, ok = awardeeLookups.get(code)
+	if ok && exists {
+		return respond(StatusSuccess, "Awardee already exists", nil)
+	}
+
+	var rows, err = dbPool.Query(ONIDB.AwardeeExists, code)
+	if err != nil {
+		return respond(StatusError, "Unable to query database", H{"error": err.Error()})
+	}
+	defer rows.Close()
+
+	// What does it mean if there's no error reported, but no count returned?
+	if !rows.Next() {
+		return respond(StatusError, "Unable to count awardees in database", H{"error": "no rows returned by SQL COUNT()"})
+	}
+
+	var count int
+	err = rows.Scan(&count)
+	if err != nil {
+		return respond(StatusError, "Unable to count awardees in database", H{"error": err.Error()})
+	}
+
+	// We really only care that there's at least one row. If there are dupes,
+	// that's out of scope to deal with, and technically not an error in terms of
+	// what we need.
+	if count > 0 {
+		awardeeLookups.set(code, true)
+		return respond(StatusSuccess, "Awardee already exists", nil)
+	}
+
+	// No rows, no error: if a name was given, create the awardee, otherwise abort
+	if name == "" {
+		return respond(StatusError, "Unable to create awardee", H{"error": "awardee name must be given to auto-create awardees", "org_code": code, "name": name})
+	}
+
+	var result sql.Result
+	result, err = dbPool.Exec(ONIDB.CreateAwardee, code, name)
+	if err != nil {
+		return respond(StatusError, "Unable to create awardee", H{"error": err.Error(), "org_code": code, "name": name})
+	}
+	var n int64
+	n, err = result.RowsAffected()
+	if err != nil {
+		return respond(StatusError, "Unable to read result of INSERT", H{"error": err.Error(), "org_code": code, "name": name})
+	}
+	if n != 1 {
+		return respond(StatusError, "Unable to create awardee", H{"error": "No rows created", "org_code": code, "name": name})
+	}
+
+	awardeeLookups.set(code, true)
+	Changes.add(changeAwardee, "created", code, H{"name": name})
+	return respond(StatusSuccess, "Awardee created", nil)
+}
+
+// awardeeBatches returns the names of all batches which reference the given
+// awardee. Titles don't reference awardees directly; they're tied to one only
+// through their issues' batches, so batches are all we need to check.
+func awardeeBatches(q interface {
+	Query(string, ...any) (*sql.Rows, error)
+}, code string) ([]string, error) {
+	var rows, err = q.Query(ONIDB.AwardeeBatches, code)
+	if err != nil {
+		return nil, fmt.Errorf("querying batches: %w", err)
+	}
+	defer rows.Close()
+
+	var names = []string{}
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, fmt.Errorf("reading batch name: %w", err)
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+func deleteAwardee(r *request, code string, dryRun bool) response {
+	var name string
+	var err = dbPool.QueryRow(ONIDB.AwardeeName, code).Scan(&name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return respond(StatusSuccess, "Awardee does not exist", H{"org_code": code})
+	}
+	if err != nil {
+		return respond(StatusError, "Unable to query database", H{"error": err.Error(), "org_code": code})
+	}
+
+	var batches []string
+	batches, err = awardeeBatches(dbPool, code)
+	if err != nil {
+		return respond(StatusError, "Unable to check awardee references", H{"error": err.Error(), "org_code": code})
+	}
+
+	var data = H{"awardee": H{"org_code": code, "name": name}, "references": H{"batches": batches}}
+	if len(batches) > 0 {
+		return respond(StatusError, "Awardee is referenced by one or more batches and cannot be deleted", data)
+	}
+	if dryRun {
+		return respond(StatusSuccess, "Dry run: awardee has no references and would be deleted", data)
+	}
+
+	// Re-check inside a transaction so a batch loaded between our check and the
+	// delete can't be orphaned
+	var tx *sql.Tx
+	tx, err = dbPool.Begin()
+	if err != nil {
+		return respond(StatusError, "Unable to start transaction", H{"error": err.Error(), "org_code": code})
+	}
+	defer tx.Rollback()
+
+	batches, err = awardeeBatches(tx, code)
+	if err != nil {
+		return respond(StatusError, "Unable to check awardee references", H{"error": err.Error(), "org_code": code})
+	}
+	if len(batches) > 0 {
+		data["references"] = H{"batches": batches}
+		return respond(StatusError, "Awardee is referenced by one or more batches and cannot be deleted", data)
+	}
+
+	var result sql.Result
+	result, err = tx.Exec(ONIDB.DeleteAwardee, code)
+	if err != nil {
+		return respond(StatusError, "Unable to delete awardee", H{"error": err.Error(), "org_code": code})
+	}
+	var n int64
+	n, err = result.RowsAffected()
+	if err != nil {
+		return respond(StatusError, "Unable to read result of DELETE", H{"error": err.Error(), "org_code": code})
+	}
+	if n != 1 {
+		return respond(StatusError, "Unable to delete awardee", H{"error": fmt.Sprintf("expected to delete 1 row, deleted %d", n), "org_code": code})
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return respond(StatusError, "Unable to commit awardee deletion", H{"error": err.Error(), "org_code": code})
+	}
+
+	awardeeLookups.forget(code)
+	r.logInfo("Awardee deleted", "org_code", code, "name", name)
+	Changes.add(changeAwardee, "deleted", code, H{"name": name})
+	return respond(StatusSuccess, "Awardee deleted", data)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"unicode/utf8"
+
+	"github.com/spf13/afero"
+)
+
+// byteOrderMarks are the UTF-8 and UTF-16 BOMs some vendors' tools put at
+// the start of XML files. ONI's ingest doesn't cope with them, and since it
+// only reads each issue's XML when it gets to that issue, a single one can
+// break a load partway through.
+var byteOrderMarks = [][]byte{
+	{0xEF, 0xBB, 0xBF},
+	{0xFE, 0xFF},
+	{0xFF, 0xFE},
+}
+
+// checkXMLBOM returns an error if the file starts with a byte order mark
+func checkXMLBOM(fp string) error {
+	var f, err = agentFS.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var start = make([]byte, 3)
+	var n int
+	n, err = io.ReadFull(f, start)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	for _, bom := range byteOrderMarks {
+		if bytes.HasPrefix(start[:n], bom) {
+			return fmt.Errorf("%s starts with a byte order mark", fp)
+		}
+	}
+	return nil
+}
+
+// checkFileNames returns an error if any name under dir isn't valid UTF-8,
+// e.g., Latin-1 names from a vendor's Windows tools, which ONI can't store.
+// All of them are counted so the error says how big the problem is, but only
+// the first is named.
+func checkFileNames(dir string) error {
+	var bad int
+	var first string
+	var err = afero.Walk(agentFS, dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !utf8.ValidString(info.Name()) {
+			bad++
+			if first == "" {
+				first, _ = filepath.Rel(dir, p)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("checking file names: %w", err)
+	}
+	if bad > 0 {
+		return fmt.Errorf("%d file name(s) aren't valid UTF-8, e.g., %q", bad, first)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/open-oni/oni-agent/internal/batchxml"
+	"github.com/spf13/afero"
+)
+
+func TestValidateBatchEncoding(t *testing.T) {
+	var origFS = agentFS
+	defer func() { agentFS = origFS }()
+
+	var dir = "/batches/batch_oru_enc_ver01"
+	var b = &batchxml.Batch{Name: "batch_oru_enc_ver01", Awardee: "oru", Issues: []*batchxml.Issue{
+		{LCCN: "sn83025138", IssueDate: "1902-11-22", EditionOrder: "01", Filepath: "sn83025138/1902112201.xml"},
+	}}
+	var batchXML, _ = b.Marshal()
+	var bom = "\xEF\xBB\xBF"
+
+	var tests = map[string]struct {
+		batchXML string
+		issueXML string
+		extra    string
+		expected string
+	}{
+		"clean":          {batchXML: string(batchXML), issueXML: "<mets/>"},
+		"BOM batch.xml":  {batchXML: bom + string(batchXML), issueXML: "<mets/>", expected: "batch.xml starts with a byte order mark"},
+		"BOM issue":      {batchXML: string(batchXML), issueXML: bom + "<mets/>", expected: "1902112201.xml starts with a byte order mark"},
+		"UTF-16 issue":   {batchXML: string(batchXML), issueXML: "\xFF\xFE<\x00", expected: "starts with a byte order mark"},
+		"Latin-1 name":   {batchXML: string(batchXML), issueXML: "<mets/>", extra: "sn83025138/caf\xe9.jp2", expected: `1 file name(s) aren't valid UTF-8, e.g., "sn83025138/caf\xe9.jp2"`},
+		"short issue":    {batchXML: string(batchXML), issueXML: "<"},
+		"UTF-8 filename": {batchXML: string(batchXML), issueXML: "<mets/>", extra: "sn83025138/café.jp2"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			agentFS = afero.NewMemMapFs()
+			afero.WriteFile(agentFS, batchxml.XMLPath(dir), []byte(tc.batchXML), 0644)
+			afero.WriteFile(agentFS, b.Issues[0].Path(dir), []byte(tc.issueXML), 0644)
+			if tc.extra != "" {
+				afero.WriteFile(agentFS, batchxml.DataDir(dir)+"/"+tc.extra, nil, 0644)
+			}
+
+			var err = validateBatch(dir)
+			if tc.expected == "" {
+				if err != nil {
+					t.Fatalf("Expected batch to be valid, got %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.expected) {
+				t.Fatalf("Expected error containing %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/open-oni/oni-agent/internal/batchname"
+)
+
+// familyBatch is one batch in a family report: either a version of the
+// family itself or a batch the agent derived from one
+type familyBatch struct {
+	Name    string   `json:"name"`
+	Version int      `json:"version"`
+	Path    string   `json:"path,omitempty"`
+	Loaded  bool     `json:"loaded"`
+	Lineage *lineage `json:"lineage,omitempty"`
+}
+
+// likeEscaper escapes LIKE wildcards, which batch names are full of
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (dbLookups) loadedFamilyBatches(ctx context.Context, family string) ([]string, error) {
+	var rows, err = dbPool.QueryContext(ctx, ONIDB.BatchesLike, likeEscaper.Replace(family)+`\_%`)
+	if err != nil {
+		return nil, fmt.Errorf("querying database: %w", err)
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, fmt.Errorf("reading batch names from database: %w", err)
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// familyDirs finds every batch directory on disk whose name starts with the
+// family name, keyed by batch name. Where BATCH_PATH_TEMPLATE would put a
+// batch takes precedence over the flat BATCH_SOURCE layout, as in findBatch.
+func familyDirs(family string) map[string]string {
+	var patterns []string
+	if BatchPathTemplate != "" {
+		patterns = append(patterns, templatePath(family+"_*", "*"))
+	}
+	patterns = append(patterns, filepath.Join(BatchSource, family+"_*"))
+
+	var dirs = make(map[string]string)
+	for _, pattern := range patterns {
+		var matches, _ = filepath.Glob(pattern)
+		for _, dir := range matches {
+			var name = filepath.Base(dir)
+			if dirs[name] == "" && hasBatchXML(dir) {
+				dirs[name] = dir
+			}
+		}
+	}
+	return dirs
+}
+
+// batchFamily gathers every known version of a family, from disk and ONI's
+// database, plus any batches the agent derived from those versions. A
+// derived batch is only recognized by its lineage marker, so derived batches
+// which are loaded but no longer on disk aren't reported: their names alone
+// can't be told apart from an unrelated family which happens to share a
+// prefix (e.g., "batch_oru_bravo_two").
+func batchFamily(ctx context.Context, family batchname.Name) (versions, derived []familyBatch, err error) {
+	var loadedNames []string
+	loadedNames, err = lookups.loadedFamilyBatches(ctx, family.Family())
+	if err != nil {
+		return nil, nil, err
+	}
+	var loaded = make(map[string]bool)
+	for _, name := range loadedNames {
+		loaded[name] = true
+	}
+
+	var dirs = familyDirs(family.Family())
+	var names = make(map[string]bool)
+	for name := range dirs {
+		names[name] = true
+	}
+	for name := range loaded {
+		names[name] = true
+	}
+
+	versions, derived = []familyBatch{}, []familyBatch{}
+	for name := range names {
+		var n, err = batchname.Parse(name)
+		if err != nil {
+			continue
+		}
+
+		var b = familyBatch{Name: name, Version: n.Version, Path: dirs[name], Loaded: loaded[name]}
+		if b.Path != "" {
+			b.Lineage, err = readLineage(b.Path)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+
+		if n.Family() == family.Family() {
+			versions = append(versions, b)
+			continue
+		}
+		if b.Lineage == nil {
+			continue
+		}
+		for _, p := range append([]string{b.Lineage.Parent}, b.Lineage.Sources...) {
+			var parent, _ = batchname.Parse(p)
+			if parent.Family() == family.Family() {
+				derived = append(derived, b)
+				break
+			}
+		}
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	sort.Slice(derived, func(i, j int) bool { return derived[i].Name < derived[j].Name })
+	return versions, derived, nil
+}
+
+func getFamilyLineage(r *request, family batchname.Name) response {
+	var versions, derived, err = batchFamily(r.ctx, family)
+	if err != nil {
+		r.logError("Unable to read batch family", "family", family.Family(), "error", err)
+		return respond(StatusError, "Unable to read batch family", H{"error": err.Error()})
+	}
+
+	var loaded = []string{}
+	for _, list := range [][]familyBatch{versions, derived} {
+		for _, b := range list {
+			if b.Loaded {
+				loaded = append(loaded, b.Name)
+			}
+		}
+	}
+
+	var msg string
+	if len(versions) == 0 && len(derived) == 0 {
+		msg = "No batches found"
+	}
+	return respond(StatusSuccess, msg, H{
+		"family":   family.Family(),
+		"awardee":  family.Awardee,
+		"versions": versions,
+		"derived":  derived,
+		"loaded":   loaded,
+	})
+}
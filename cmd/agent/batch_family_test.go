@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetFamilyLineage(t *testing.T) {
+	var origSource, origTemplate = BatchSource, BatchPathTemplate
+	t.Cleanup(func() { BatchSource, BatchPathTemplate = origSource, origTemplate })
+
+	BatchSource = t.TempDir()
+	BatchPathTemplate = ""
+	useLookups(t, fakeLookups{familyBatches: func(family string) ([]string, error) {
+		if family != "batch_oru_bravo" {
+			t.Fatalf("Unexpected family %q", family)
+		}
+		return []string{"batch_oru_bravo_ver01", "batch_oru_bravo_ver03", "batch_oru_bravo_two_ver01"}, nil
+	}})
+
+	writeBatch(t, filepath.Join(BatchSource, "batch_oru_bravo_ver01"), testBatch{awardee: "oru"})
+	writeBatch(t, filepath.Join(BatchSource, "batch_oru_bravo_ver02"), testBatch{awardee: "oru"})
+	writeBatch(t, filepath.Join(BatchSource, "batch_oru_bravo_two_ver01"), testBatch{awardee: "oru"})
+	var partial = filepath.Join(BatchSource, "batch_oru_bravo_partial_19020101_end_ver02")
+	var err = createDerivedDir(partial, lineage{Parent: "batch_oru_bravo_ver02", Kind: derivedPartial, From: "1902-01-01"})
+	if err != nil {
+		t.Fatalf("Unable to create derived batch: %s", err)
+	}
+	writeBatch(t, partial, testBatch{awardee: "oru"})
+
+	var r = &request{ctx: context.Background(), command: "batch-lineage"}
+	var resp = getBatchLineage(r, "batch_oru_bravo")
+	if resp.status != StatusSuccess {
+		t.Fatalf("Expected success, got %#v", resp)
+	}
+
+	var versions = resp.data["versions"].([]familyBatch)
+	if len(versions) != 3 {
+		t.Fatalf("Expected versions 1-3, got %#v", versions)
+	}
+	for i, expected := range []struct {
+		onDisk, loaded bool
+	}{{true, true}, {true, false}, {false, true}} {
+		var v = versions[i]
+		if v.Version != i+1 || (v.Path != "") != expected.onDisk || v.Loaded != expected.loaded {
+			t.Errorf("Unexpected version %d: %#v", i+1, v)
+		}
+	}
+
+	var derived = resp.data["derived"].([]familyBatch)
+	if len(derived) != 1 || derived[0].Lineage == nil || derived[0].Lineage.Parent != "batch_oru_bravo_ver02" {
+		t.Fatalf("Expected only the partial batch to be derived, got %#v", derived)
+	}
+
+	var loaded = resp.data["loaded"].([]string)
+	if len(loaded) != 2 || loaded[0] != "batch_oru_bravo_ver01" || loaded[1] != "batch_oru_bravo_ver03" {
+		t.Fatalf("Expected versions 1 and 3 to be loaded, got %v", loaded)
+	}
+
+	resp = getBatchLineage(r, "bravo")
+	if resp.status != StatusError {
+		t.Fatalf("Expected an invalid name to be rejected, got %#v", resp)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+// batchManifestName is the checksum manifest kept at the top of a batch. It
+// uses sha256sum's format, so `sha256sum -c` can check it too.
+const batchManifestName = "manifest-sha256.txt"
+
+// manifestCheck is the result of checking a batch against its manifest
+type manifestCheck struct {
+	Files    int      `json:"files"`
+	Missing  []string `json:"missing"`
+	Changed  []string `json:"changed"`
+	Unlisted []string `json:"unlisted"`
+}
+
+// ok returns true if the batch matches its manifest exactly
+func (c *manifestCheck) ok() bool {
+	return len(c.Missing) == 0 && len(c.Changed) == 0 && len(c.Unlisted) == 0
+}
+
+// hashFile returns the hex-encoded SHA256 sum of the file's contents
+func hashFile(fname string) (string, error) {
+	var f, err = os.Open(fname)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var h = sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", fmt.Errorf("reading %s: %w", fname, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// manifestFiles lists every file a batch's manifest covers, as slash-separated
+// paths relative to the batch, sorted. The manifest itself and the agent's
+// derived-batch marker aren't part of the batch's content, so they're left
+// out.
+func manifestFiles(dir string) ([]string, error) {
+	var files []string
+	var err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		var rel, _ = filepath.Rel(dir, path)
+		rel = filepath.ToSlash(rel)
+		if rel == batchManifestName || rel == derivedMarker {
+			return nil
+		}
+		files = append(files, rel)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// writeBatchManifest checksums every file in the batch and writes the
+// manifest, replacing any existing one
+func writeBatchManifest(ctx context.Context, dir string) (int, error) {
+	var files, err = manifestFiles(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var b strings.Builder
+	for _, rel := range files {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		var sum string
+		sum, err = hashFile(filepath.Join(dir, filepath.FromSlash(rel)))
+		if err != nil {
+			return 0, err
+		}
+		fmt.Fprintf(&b, "%s  %s\n", sum, rel)
+	}
+
+	var fname = filepath.Join(dir, batchManifestName)
+	err = os.WriteFile(fname+".tmp", []byte(b.String()), 0644)
+	if err == nil {
+		err = os.Rename(fname+".tmp", fname)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("writing %s: %w", batchManifestName, err)
+	}
+	return len(files), nil
+}
+
+// readBatchManifest returns the checksums in a batch's manifest, keyed by
+// relative path. A batch with no manifest returns an error satisfying
+// errors.Is(err, fs.ErrNotExist).
+func readBatchManifest(dir string) (map[string]string, error) {
+	var f, err = os.Open(filepath.Join(dir, batchManifestName))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var sums = make(map[string]string)
+	var s = bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		var sum, rel, ok = strings.Cut(s.Text(), "  ")
+		if !ok || len(sum) != sha256.Size*2 || rel == "" {
+			return nil, fmt.Errorf("%s line %d is not a valid checksum line", batchManifestName, n)
+		}
+		sums[rel] = sum
+	}
+	return sums, s.Err()
+}
+
+// checkBatchManifest compares a batch's files to its manifest
+func checkBatchManifest(ctx context.Context, dir string) (*manifestCheck, error) {
+	var sums, err = readBatchManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	files, err = manifestFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var c = &manifestCheck{Files: len(sums), Missing: []string{}, Changed: []string{}, Unlisted: []string{}}
+	var present = make(map[string]bool, len(files))
+	for _, rel := range files {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		present[rel] = true
+		var want, listed = sums[rel]
+		if !listed {
+			c.Unlisted = append(c.Unlisted, rel)
+			continue
+		}
+		var got string
+		got, err = hashFile(filepath.Join(dir, filepath.FromSlash(rel)))
+		if err != nil {
+			return nil, err
+		}
+		if got != want {
+			c.Changed = append(c.Changed, rel)
+		}
+	}
+	for rel := range sums {
+		if !present[rel] {
+			c.Missing = append(c.Missing, rel)
+		}
+	}
+	sort.Strings(c.Missing)
+	return c, nil
+}
+
+// logManifestCheck writes a manifest check's problems to the job's log,
+// returning an error if there were any
+func logManifestCheck(j *queue.Job, c *manifestCheck) error {
+	for _, rel := range c.Missing {
+		j.Warnf("Missing: %s", rel)
+	}
+	for _, rel := range c.Changed {
+		j.Warnf("Checksum mismatch: %s", rel)
+	}
+	for _, rel := range c.Unlisted {
+		j.Warnf("Not in manifest: %s", rel)
+	}
+	if !c.ok() {
+		return fmt.Errorf("batch doesn't match its manifest: %d missing, %d changed, %d not listed", len(c.Missing), len(c.Changed), len(c.Unlisted))
+	}
+	j.Logf("All %d files match the manifest", c.Files)
+	return nil
+}
+
+// runVerifyBatch returns the verify-batch job. With write set, the manifest
+// is (re)written instead of checked.
+func runVerifyBatch(dir string, write bool) queue.RunFunc {
+	return func(ctx context.Context, j *queue.Job) error {
+		if write {
+			var n, err = writeBatchManifest(ctx, dir)
+			if err != nil {
+				return err
+			}
+			j.Logf("Wrote %s for %d files", batchManifestName, n)
+			return nil
+		}
+
+		j.Logf("Checking %s against %s", dir, batchManifestName)
+		var c, err = checkBatchManifest(ctx, dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("batch has no %s; use --write-manifest to create one", batchManifestName)
+		}
+		if err != nil {
+			return err
+		}
+		return logManifestCheck(j, c)
+	}
+}
+
+func verifyBatch(name string, write bool) response {
+	if !batchNameRegexp.MatchString(name) {
+		return respond(StatusError, fmt.Sprintf("%q is not a valid batch name", name), nil)
+	}
+	var dir, err = findBatch(name)
+	if err != nil {
+		return respond(StatusError, fmt.Sprintf("%q cannot be verified", name), H{"error": err.Error()})
+	}
+	if !hasBatchXML(dir) {
+		return respond(StatusError, fmt.Sprintf("%q cannot be verified", name), H{"error": fmt.Sprintf("no batch found at %s", dir)})
+	}
+
+	var jobName = "Verify batch " + name
+	if write {
+		jobName = "Write manifest for " + name
+	}
+	var id = JobRunner.QueueFunc(jobName, runVerifyBatch(dir, write))
+	return respond(StatusSuccess, "Job added to queue", H{"job": H{"id": id}})
+}
+
+func init() {
+	register("verify-batch", func(r *request) response {
+		var args, write = r.args, false
+		if len(args) == 2 && args[1] == "--write-manifest" {
+			args, write = args[:1], true
+		}
+		if len(args) != 1 {
+			return respond(StatusError, fmt.Sprintf("%q requires exactly one batch name, optionally followed by --write-manifest", r.command), nil)
+		}
+		if write && AgentRole == roleVerify {
+			return respond(StatusError, "--write-manifest is not available on a verification-only agent", nil)
+		}
+		return verifyBatch(args[0], write)
+	})
+}
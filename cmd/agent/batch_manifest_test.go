@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+func TestBatchManifest(t *testing.T) {
+	var dir = t.TempDir()
+	var files = map[string]string{
+		"data/batch.xml":       "<batch/>",
+		"data/1902112901.xml":  "<issue/>",
+		"data/0001.jp2":        "jp2",
+		derivedMarker:          "{}",
+		"data/sub/notes.txt":   "notes",
+		"data/sub/removed.txt": "gone soon",
+	}
+	for name, content := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	}
+
+	var ctx = context.Background()
+	var n, err = writeBatchManifest(ctx, dir)
+	if err != nil {
+		t.Fatalf("Unable to write manifest: %s", err)
+	}
+	if n != 5 {
+		t.Fatalf("Expected 5 files in the manifest (not the marker), got %d", n)
+	}
+	var c *manifestCheck
+	c, err = checkBatchManifest(ctx, dir)
+	if err != nil || !c.ok() {
+		t.Fatalf("Expected a fresh manifest to match, got %#v, %v", c, err)
+	}
+
+	os.WriteFile(filepath.Join(dir, "data", "0001.jp2"), []byte("truncat"), 0644)
+	os.Remove(filepath.Join(dir, "data", "sub", "removed.txt"))
+	os.WriteFile(filepath.Join(dir, "data", "extra.xml"), []byte("<extra/>"), 0644)
+	os.WriteFile(filepath.Join(dir, derivedMarker), []byte(`{"kind":"mirror"}`), 0644)
+	c, err = checkBatchManifest(ctx, dir)
+	if err != nil {
+		t.Fatalf("Unable to check manifest: %s", err)
+	}
+	var expected = &manifestCheck{
+		Files:    5,
+		Missing:  []string{"data/sub/removed.txt"},
+		Changed:  []string{"data/0001.jp2"},
+		Unlisted: []string{"data/extra.xml"},
+	}
+	if diff := cmp.Diff(expected, c); diff != "" {
+		t.Errorf("Unexpected manifest check: %s", diff)
+	}
+
+	os.WriteFile(filepath.Join(dir, batchManifestName), []byte("not a checksum\n"), 0644)
+	_, err = checkBatchManifest(ctx, dir)
+	if err == nil {
+		t.Error("Expected a malformed manifest to be an error")
+	}
+}
+
+func TestCheckMirroredFiles(t *testing.T) {
+	var dir = t.TempDir()
+	os.WriteFile(filepath.Join(dir, "batch.xml"), []byte("<batch/>"), 0644)
+
+	var q = queue.New(queue.CommandRunner{})
+	var run = func() (*queue.Job, error) {
+		var j = q.NewFuncJob("test", func(ctx context.Context, j *queue.Job) error { return checkMirroredFiles(ctx, j, dir) })
+		return j, j.Run(context.Background())
+	}
+
+	// No manifest from the peer: one gets written
+	var j, err = run()
+	if err != nil {
+		t.Fatalf("Expected a batch without a manifest to pass, got %s", err)
+	}
+	if !strings.Contains(strings.Join(j.StdoutValues(), "\n"), "wrote one for 1 files") {
+		t.Errorf("Expected the manifest to be written, got %q", j.StdoutValues())
+	}
+
+	// Now the copy is checked against it
+	os.WriteFile(filepath.Join(dir, "batch.xml"), []byte("<batch>"), 0644)
+	j, err = run()
+	if err == nil || !strings.Contains(err.Error(), "1 changed") {
+		t.Fatalf("Expected a corrupt copy to fail, got %v", err)
+	}
+	if !strings.Contains(strings.Join(j.Stderr(), "\n"), "Checksum mismatch: batch.xml") {
+		t.Errorf("Expected the mismatch to be logged, got %q", j.Stderr())
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/open-oni/oni-agent/internal/batchxml"
+)
+
+// Placeholders allowed in BATCH_PATH_TEMPLATE
+const (
+	awardeePlaceholder = "{awardee}"
+	namePlaceholder    = "{name}"
+)
+
+var placeholderRegexp = regexp.MustCompile(`\{[^}]*\}`)
+
+// validatePathTemplate makes sure a batch path template is relative, only
+// uses known placeholders, and ends with the batch name. Requiring the name
+// last means derived batches can always go next to their parent batch.
+func validatePathTemplate(tmpl string) error {
+	var p = filepath.ToSlash(filepath.Clean(filepath.FromSlash(tmpl)))
+	if filepath.IsAbs(tmpl) || p == ".." || strings.HasPrefix(p, "../") || strings.Contains(p, "/../") {
+		return errors.New("must be a path relative to BATCH_SOURCE")
+	}
+	for _, ph := range placeholderRegexp.FindAllString(tmpl, -1) {
+		if ph != awardeePlaceholder && ph != namePlaceholder {
+			return fmt.Errorf("unknown placeholder %q (only %s and %s are allowed)", ph, awardeePlaceholder, namePlaceholder)
+		}
+	}
+	if strings.Count(tmpl, namePlaceholder) != 1 || path.Base(p) != namePlaceholder {
+		return fmt.Errorf("must end with %s, and use it only once", namePlaceholder)
+	}
+	return nil
+}
+
+// batchNameAwardeeRegexp pulls the awardee's org code out of a batch name
+var batchNameAwardeeRegexp = regexp.MustCompile(`^batch_([[:alnum:]]+)_`)
+
+// templatePath returns where the template says a batch with the given name
+// and awardee lives
+func templatePath(name, awardee string) string {
+	var p = strings.NewReplacer(awardeePlaceholder, awardee, namePlaceholder, name).Replace(BatchPathTemplate)
+	return filepath.Join(BatchSource, filepath.FromSlash(p))
+}
+
+func (dbLookups) loadedBatchAwardee(name string) (string, error) {
+	var rows, err = dbPool.Query(ONIDB.BatchAwardee, name)
+	if err != nil {
+		return "", fmt.Errorf("querying database: %w", err)
+	}
+	defer rows.Close()
+
+	var awardee string
+	if rows.Next() {
+		err = rows.Scan(&awardee)
+		if err != nil {
+			return "", fmt.Errorf("reading batch awardee from database: %w", err)
+		}
+	}
+	return awardee, rows.Err()
+}
+
+// hasBatchXML returns true if dir looks like a batch
+func hasBatchXML(dir string) bool {
+	var info, err = os.Stat(batchxml.XMLPath(dir))
+	return err == nil && info.Mode().IsRegular()
+}
+
+// findBatch returns the directory holding the named batch. Without a
+// BATCH_PATH_TEMPLATE, that's simply BATCH_SOURCE/<name>. With one, the
+// awardee is taken from ONI's database (for loaded batches) or the batch
+// name; failing that, every directory the template could match is checked
+// for a batch.xml whose awardee puts it there. Flat lookup is always the last
+// resort, so existing batches keep working when a template is introduced.
+//
+// If the batch can't be found, the path it's most likely to be at is
+// returned, so callers' "not found" errors point somewhere sensible.
+func findBatch(name string) (string, error) {
+	var flat = filepath.Join(BatchSource, name)
+	if BatchPathTemplate == "" {
+		return flat, nil
+	}
+	if !strings.Contains(BatchPathTemplate, awardeePlaceholder) {
+		var dir = templatePath(name, "")
+		if !hasBatchXML(dir) && hasBatchXML(flat) {
+			return flat, nil
+		}
+		return dir, nil
+	}
+
+	var awardees []string
+	var dbAwardee, err = lookups.loadedBatchAwardee(name)
+	if err != nil {
+		return "", err
+	}
+	if dbAwardee != "" {
+		awardees = append(awardees, dbAwardee)
+	}
+	if m := batchNameAwardeeRegexp.FindStringSubmatch(name); m != nil && m[1] != dbAwardee {
+		awardees = append(awardees, m[1])
+	}
+
+	for _, a := range awardees {
+		var dir = templatePath(name, a)
+		if hasBatchXML(dir) {
+			return dir, nil
+		}
+	}
+
+	var matches, _ = filepath.Glob(templatePath(name, "*"))
+	for _, dir := range matches {
+		var b, err = batchxml.Read(dir)
+		if err == nil && templatePath(name, b.Awardee) == dir {
+			return dir, nil
+		}
+	}
+
+	if hasBatchXML(flat) || len(awardees) == 0 {
+		return flat, nil
+	}
+	return templatePath(name, awardees[0]), nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestValidatePathTemplate(t *testing.T) {
+	var tests = map[string]bool{
+		"{name}":                    true,
+		"{awardee}/{name}":          true,
+		"incoming/{awardee}/{name}": true,
+		"{awardee}_{name}":          false,
+		"{name}/{awardee}":          false,
+		"{name}/{name}":             false,
+		"{awardee}/{title}/{name}":  false,
+		"../{name}":                 false,
+		"/mnt/{name}":               false,
+		"{awardee}":                 false,
+	}
+	for tmpl, valid := range tests {
+		var err = validatePathTemplate(tmpl)
+		if valid && err != nil {
+			t.Errorf("Expected %q to be valid, got %s", tmpl, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("Expected %q to be invalid", tmpl)
+		}
+	}
+}
+
+func TestFindBatch(t *testing.T) {
+	var origSource, origTemplate = BatchSource, BatchPathTemplate
+	t.Cleanup(func() { BatchSource, BatchPathTemplate = origSource, origTemplate })
+
+	BatchSource = t.TempDir()
+	BatchPathTemplate = "{awardee}/{name}"
+	useLookups(t, fakeLookups{batchAwardee: func(name string) (string, error) {
+		if name == "batch_oru_loaded_ver01" {
+			return "orbis", nil
+		}
+		return "", nil
+	}})
+
+	writeBatch(t, filepath.Join(BatchSource, "oru", "batch_oru_byname_ver01"), testBatch{awardee: "oru"})
+	writeBatch(t, filepath.Join(BatchSource, "orbis", "batch_oru_loaded_ver01"), testBatch{awardee: "orbis"})
+	writeBatch(t, filepath.Join(BatchSource, "mt", "batch_mthi_byxml_ver01"), testBatch{awardee: "mt"})
+	writeBatch(t, filepath.Join(BatchSource, "batch_oru_flat_ver01"), testBatch{awardee: "oru"})
+
+	var tests = map[string]string{
+		"batch_oru_byname_ver01":  "oru/batch_oru_byname_ver01",
+		"batch_oru_loaded_ver01":  "orbis/batch_oru_loaded_ver01",
+		"batch_mthi_byxml_ver01":  "mt/batch_mthi_byxml_ver01",
+		"batch_oru_flat_ver01":    "batch_oru_flat_ver01",
+		"batch_oru_missing_ver01": "oru/batch_oru_missing_ver01",
+	}
+	for name, expected := range tests {
+		var got, err = findBatch(name)
+		if err != nil {
+			t.Errorf("Unable to find %q: %s", name, err)
+			continue
+		}
+		if got != filepath.Join(BatchSource, expected) {
+			t.Errorf("Expected %q to be found at %q, got %q", name, expected, got)
+		}
+	}
+
+	BatchPathTemplate = ""
+	var got, _ = findBatch("batch_oru_byname_ver01")
+	if got != filepath.Join(BatchSource, "batch_oru_byname_ver01") {
+		t.Errorf("Expected flat lookup without a template, got %q", got)
+	}
+}
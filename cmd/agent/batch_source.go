@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/open-oni/oni-agent/internal/batchxml"
+)
+
+// sourceSampleSize is how many batches' XML files checkBatchSource tries to
+// read. Reading all of them would be slow on large network mounts, and a
+// permissions problem almost always affects every batch anyway.
+const sourceSampleSize = 20
+
+// maxSourceProblems caps how many unreadable paths a report lists
+const maxSourceProblems = 10
+
+// sourceReport is the result of sampling BATCH_SOURCE
+type sourceReport struct {
+	Path       string    `json:"path"`
+	Checked    time.Time `json:"checked"`
+	Readable   bool      `json:"readable"`
+	Batches    int       `json:"batches"`
+	Sampled    int       `json:"sampled"`
+	Unreadable []string  `json:"unreadable,omitempty"`
+	Warnings   []string  `json:"warnings,omitempty"`
+}
+
+func (r *sourceReport) warn(format string, args ...any) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// checkBatchSource makes sure BATCH_SOURCE can be read, counts the batch-like
+// directories in it (following BATCH_PATH_TEMPLATE if set), and tries to
+// read a sample of their batch XML files. Problems are reported as warnings
+// rather than errors: an empty source may be perfectly normal on a new
+// install, and the agent can still do plenty without it.
+func checkBatchSource() sourceReport {
+	var r = sourceReport{Path: BatchSource, Checked: time.Now()}
+
+	var _, err = os.ReadDir(BatchSource)
+	if err != nil {
+		r.warn("BATCH_SOURCE cannot be read: %s", err)
+		return r
+	}
+	r.Readable = true
+
+	var pattern = filepath.Join(BatchSource, "*")
+	if BatchPathTemplate != "" {
+		pattern = templatePath("*", "*")
+	}
+	var matches []string
+	matches, err = filepath.Glob(pattern)
+	if err != nil {
+		r.warn("Unable to search BATCH_SOURCE: %s", err)
+		return r
+	}
+
+	var batches []string
+	for _, m := range matches {
+		if !batchNameRegexp.MatchString(filepath.Base(m)) {
+			continue
+		}
+		var info, err = os.Stat(m)
+		if err == nil && info.IsDir() {
+			batches = append(batches, m)
+		}
+	}
+	r.Batches = len(batches)
+	if r.Batches == 0 {
+		if BatchPathTemplate != "" {
+			r.warn("No batch directories found in BATCH_SOURCE using BATCH_PATH_TEMPLATE %q; is the right volume mounted?", BatchPathTemplate)
+		} else {
+			r.warn("No batch directories found in BATCH_SOURCE; is the right volume mounted?")
+		}
+		return r
+	}
+
+	// Spread the sample across the whole list so one bad awardee directory
+	// near the start doesn't hide (or exaggerate) a problem
+	var step = max(1, len(batches)/sourceSampleSize)
+	for i := 0; i < len(batches) && r.Sampled < sourceSampleSize; i += step {
+		r.Sampled++
+		var err = readable(batchxml.XMLPath(batches[i]))
+		if err != nil && len(r.Unreadable) < maxSourceProblems {
+			r.Unreadable = append(r.Unreadable, fmt.Sprintf("%s: %s", batches[i], err))
+		}
+	}
+	if len(r.Unreadable) > 0 {
+		r.warn("%d of %d sampled batches have an unreadable batch.xml; check permissions and mounts", len(r.Unreadable), r.Sampled)
+	}
+	return r
+}
+
+// readable returns an error if the file can't be opened and read
+func readable(fname string) error {
+	var f, err = os.Open(fname)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return errors.New("missing")
+		}
+		return err
+	}
+	defer f.Close()
+
+	var b = make([]byte, 1)
+	_, err = f.Read(b)
+	return err
+}
+
+// logBatchSource checks BATCH_SOURCE at startup so a bad mount is obvious in
+// the logs right away instead of when a load fails hours later
+func logBatchSource() {
+	var r = checkBatchSource()
+	for _, w := range r.Warnings {
+		slog.Warn("BATCH_SOURCE problem", "warning", w)
+	}
+	for _, u := range r.Unreadable {
+		slog.Warn("Unreadable batch in BATCH_SOURCE", "batch", u)
+	}
+	if len(r.Warnings) == 0 {
+		slog.Info("Checked BATCH_SOURCE", "batches", r.Batches, "sampled", r.Sampled)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckBatchSource(t *testing.T) {
+	var origSource, origTemplate = BatchSource, BatchPathTemplate
+	t.Cleanup(func() { BatchSource, BatchPathTemplate = origSource, origTemplate })
+
+	BatchSource = filepath.Join(t.TempDir(), "missing")
+	BatchPathTemplate = ""
+	var r = checkBatchSource()
+	if r.Readable || len(r.Warnings) != 1 {
+		t.Fatalf("Expected a missing source to be unreadable, got %#v", r)
+	}
+
+	BatchSource = t.TempDir()
+	r = checkBatchSource()
+	if !r.Readable || r.Batches != 0 || len(r.Warnings) != 1 || !strings.Contains(r.Warnings[0], "No batch directories") {
+		t.Fatalf("Expected a warning about an empty source, got %#v", r)
+	}
+
+	writeBatch(t, filepath.Join(BatchSource, "batch_oru_good_ver01"), testBatch{awardee: "oru"})
+	os.MkdirAll(filepath.Join(BatchSource, "batch_oru_nobatchxml_ver01"), 0755)
+	os.MkdirAll(filepath.Join(BatchSource, "not-a-batch"), 0755)
+	r = checkBatchSource()
+	if r.Batches != 2 || r.Sampled != 2 || len(r.Unreadable) != 1 || len(r.Warnings) != 1 {
+		t.Fatalf("Expected one unreadable batch out of two, got %#v", r)
+	}
+	if !strings.Contains(r.Unreadable[0], "batch_oru_nobatchxml_ver01") {
+		t.Fatalf("Expected the batch without batch.xml to be reported, got %q", r.Unreadable)
+	}
+
+	// With a template, batches are only found where it puts them
+	BatchPathTemplate = "{awardee}/{name}"
+	r = checkBatchSource()
+	if r.Batches != 0 {
+		t.Fatalf("Expected no batches at the template's depth, got %#v", r)
+	}
+	writeBatch(t, filepath.Join(BatchSource, "mt", "batch_mthi_nested_ver01"), testBatch{awardee: "mt"})
+	r = checkBatchSource()
+	if r.Batches != 1 || len(r.Warnings) != 0 {
+		t.Fatalf("Expected one healthy nested batch, got %#v", r)
+	}
+}
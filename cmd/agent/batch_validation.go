@@ -2,31 +2,31 @@
 
 import (
 	"database/sql"
-	"encoding/xml"
 	"fmt"
-	"os"
-	"path/filepath"
-)
-
-// issue describes a single "issue" element in a batch XML file
-type issue struct {
-	LCCN         string `xml:"lccn,attr"`
-	IssueDate    string `xml:"issueDate,attr"`
-	EditionOrder string `xml:"editionOrder,attr"`
-	Filepath     string `xml:",innerxml"`
-}
 
-// batch describes the data we care about which lives in a batch.xml file
-type batch struct {
-	Name   string   `xml:"name,attr"`
-	Issues []*issue `xml:"issue"`
-}
+	"github.com/open-oni/oni-agent/internal/batchxml"
+)
 
 // checkBatch just does a very brief DB check to see if a batch by the given
-// name already exists
+// name already exists. Answers are cached briefly, since NCA tends to retry
+// the same load or purge several times in a row.
 func checkBatch(name string) (exists bool, err error) {
+	var ok bool
+	exists, ok = batchLookups.get(name)
+	if ok {
+		return exists, nil
+	}
+	exists, err = queryBatchExists(name)
+	if err == nil {
+		batchLookups.set(name, exists)
+	}
+	return exists, err
+}
+
+// queryBatchExists is checkBatch without the cache
+func queryBatchExists(name string) (exists bool, err error) {
 	var rows *sql.Rows
-	rows, err = dbPool.Query("SELECT COUNT(*) FROM core_batch WHERE name = ?", name)
+	rows, err = dbPool.Query(ONIDB.BatchExists, name)
 	if err != nil {
 		return false, fmt.Errorf("querying database: %w", err)
 	}
@@ -46,38 +46,50 @@ func checkBatch(name string) (exists bool, err error) {
 	return count > 0, nil
 }
 
-// validateBatch checks that the path exists, that there's a manifest file, and
-// that the paths to the issues' files exist. We don't try to do further
-// validations to ensure things like the JP2s are valid or anything as this
-// needs to be a fairly quick check.
-//
-// Note that we only check for the batch.xml, not batch_1.xml: NCA doesn't do
-// the DVV stuff chronam batches had, and validates XML doesn't give us
-// anything that isn't in the main file anyway.
+// validateBatch checks that the path exists, that there's a manifest file,
+// that the paths to the issues' files exist, and that nothing has the
+// encoding problems which break ONI partway through a load: XML files
+// starting with a byte order mark, or file names which aren't UTF-8. We don't
+// try to do further validations to ensure things like the JP2s are valid or
+// anything as this needs to be a fairly quick check.
 func validateBatch(batchPath string) error {
-	batchPath = filepath.Join(batchPath, "data")
-	var xmlfile = filepath.Join(batchPath, "batch.xml")
-	var data, err = os.ReadFile(xmlfile)
+	var _, err = validateBatchIssues(batchPath)
+	return err
+}
+
+// validateBatchIssues does the work of validateBatch, returning the parsed
+// batch.xml
+func validateBatchIssues(batchPath string) (*batchxml.Batch, error) {
+	var b, err = readBatchXML(batchPath)
 	if err != nil {
-		return fmt.Errorf("reading file: %w", err)
+		return nil, err
 	}
-
-	var b batch
-	err = xml.Unmarshal(data, &b)
+	err = checkXMLBOM(batchxml.XMLPath(batchPath))
 	if err != nil {
-		return fmt.Errorf("processing xml: %w", err)
+		return nil, err
 	}
 
 	for _, i := range b.Issues {
-		var fp = filepath.Join(batchPath, i.Filepath)
-		var info, err = os.Stat(fp)
+		if i.RelPath().Escapes() {
+			return nil, fmt.Errorf("issue file %s is outside the batch's data directory", i.Filepath)
+		}
+		var fp = i.Path(batchPath)
+		var info, err = agentFS.Stat(fp)
 		if err != nil {
-			return fmt.Errorf("checking issue file %s: %w", fp, err)
+			return nil, fmt.Errorf("checking issue file %s: %w", fp, err)
 		}
 		if !info.Mode().IsRegular() {
-			return fmt.Errorf("checking issue file %s: not a regular file", fp)
+			return nil, fmt.Errorf("checking issue file %s: not a regular file", fp)
+		}
+		err = checkXMLBOM(fp)
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	return nil
+	err = checkFileNames(batchxml.DataDir(batchPath))
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
 }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/open-oni/oni-agent/internal/batchxml"
+)
+
+func loadBatch(name string) response {
+	// ONI currently succeeds if a batch is already loaded and we try to load it
+	// again, but this could change, so we explicitly ensure success here
+	var exists, err = checkBatch(name)
+	if err != nil {
+		return respond(StatusError, fmt.Sprintf("%q cannot be loaded", name), H{"error": err.Error()})
+	}
+	if exists {
+		return respondNoJob()
+	}
+
+	// Loads are often retried, and validating a huge batch is slow, so a
+	// recent successful validation is trusted
+	var batchPath string
+	var v batchValidation
+	batchPath, err = findBatch(name)
+	if err == nil {
+		v, err = validateBatchCached(batchPath, false)
+	}
+	if err != nil {
+		return respond(StatusError, fmt.Sprintf("%q cannot be loaded", name), H{"error": err.Error()})
+	}
+
+	var resp = queueLoadBatch("Load batch", batchPath, v.Contents)
+	if resp.status == StatusSuccess {
+		resp.data["batch"] = v.Batch
+	}
+	return resp
+}
+
+// queueLoadBatch queues the load job for a batch which has already been
+// validated. If the batch references LCCNs which have no issues in ONI yet,
+// a follow-up job is queued to reindex just those titles once the load
+// succeeds, so search facets pick up the new titles. If Solr verification is
+// enabled, a verification job is queued to run after the load as well, and
+// if artifact storage is, an ingest report is made once the load (and
+// verification) succeeds.
+//
+// contents is the batch's contents fingerprint from when it was validated;
+// the load fails to start if the batch no longer matches it.
+func queueLoadBatch(jobName, batchPath, contents string) response {
+	// Find the new LCCNs first: once the batch is loaded they won't be new
+	var b, err = batchxml.Read(batchPath)
+	if err != nil {
+		return respond(StatusError, fmt.Sprintf("%q cannot be loaded", filepath.Base(batchPath)), H{"error": err.Error()})
+	}
+	var lccns []string
+	lccns, err = newLCCNs(batchLCCNs(b))
+	if err != nil {
+		return respond(StatusError, fmt.Sprintf("%q cannot be loaded", filepath.Base(batchPath)), H{"error": err.Error()})
+	}
+
+	var resp = queueCheckedLoad(jobName, batchPath, contents)
+	if resp.status != StatusSuccess {
+		return resp
+	}
+	var loadID = resp.data["job"].(H)["id"].(int64)
+
+	if len(lccns) > 0 {
+		var reindex = H{"lccns": lccns}
+		err = checkONICommand(reindexTitlesCommand)
+		if err != nil {
+			reindex["warning"] = fmt.Sprintf("New titles will not be reindexed: %s", err)
+		} else {
+			var args = append([]string{reindexTitlesCommand}, lccns...)
+			reindex["job"] = H{"id": JobRunner.QueueJobAfter("Reindex new titles", args, loadID)}
+		}
+		resp.data["reindex"] = reindex
+	}
+
+	var name = filepath.Base(batchPath)
+	var lastID = loadID
+	if Solr != nil {
+		lastID = JobRunner.QueueFuncAfter("Verify Solr for "+name, runSolrVerify(name, SolrVerify), loadID)
+		resp.data["verify"] = H{"job": H{"id": lastID}}
+	}
+	if Artifacts != nil {
+		var id = JobRunner.QueueFuncAfter("Ingest report for "+name, runIngestReport(name), lastID)
+		resp.data["report"] = H{"job": H{"id": id}}
+	}
+	return resp
+}
+
+func purgeBatch(r *request, name string, force bool) response {
+	// ONI will fail if you try to purge a batch which doesn't exist, but we want
+	// to return success for idempotence of NCA jobs
+	var exists, err = checkBatch(name)
+	if err != nil {
+		return respond(StatusError, fmt.Sprintf("%q cannot be purged", name), H{"error": err.Error()})
+	}
+	if !exists {
+		return respondNoJob()
+	}
+	var checks, refusal, ok = checkPurgeSafeguards(r, name, force)
+	if !ok {
+		return refusal
+	}
+	var resp = queueJob("Purge batch", "purge_batch", []string{name})
+	if checks != nil && resp.status == StatusSuccess {
+		resp.data["safeguards"] = checks
+		if checks.Snapshot != "" {
+			JobRunner.GetJob(resp.data["job"].(H)["id"].(int64)).AddArtifact(checks.Snapshot)
+		}
+	}
+	if end := blackoutEnd(BlackoutWindows, time.Now()); resp.status == StatusSuccess && !end.IsZero() {
+		resp.data["warning"] = fmt.Sprintf("A blackout window is open; the purge won't start until it closes at %s", end.Format(time.RFC3339))
+	}
+	return resp
+}
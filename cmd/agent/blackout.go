@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/open-oni/oni-agent/internal/cronspec"
+)
+
+// blackoutWindow is a span of time, starting whenever its schedule matches,
+// during which destructive jobs may not start
+type blackoutWindow struct {
+	raw    string
+	spec   *cronspec.Spec
+	length time.Duration
+}
+
+// maxBlackoutLength caps a single window. Longer blackouts can be built from
+// back-to-back windows.
+const maxBlackoutLength = 7 * 24 * time.Hour
+
+// BlackoutWindows holds the windows from BLACKOUT_WINDOWS
+var BlackoutWindows []blackoutWindow
+
+// destructiveJobCommands are the ONI commands blackout windows hold back
+var destructiveJobCommands = map[string]bool{
+	"purge_batch": true,
+}
+
+// parseBlackoutWindows reads a semicolon-separated list of windows, each a
+// five-field cron schedule for when the window opens followed by how long it
+// lasts, e.g., "0 8 * * 1-5 10h" for 8am to 6pm on weekdays
+func parseBlackoutWindows(val string) ([]blackoutWindow, error) {
+	var windows []blackoutWindow
+	for _, item := range strings.Split(val, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		var fields = strings.Fields(item)
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("%q must be a five-field cron schedule followed by a duration", item)
+		}
+		var spec, err = cronspec.Parse(strings.Join(fields[:5], " "))
+		if err != nil {
+			return nil, err
+		}
+		var length time.Duration
+		length, err = time.ParseDuration(fields[5])
+		if err != nil || length < time.Minute || length > maxBlackoutLength {
+			return nil, fmt.Errorf("%q: %q must be a duration from 1m to %s", item, fields[5], maxBlackoutLength)
+		}
+		windows = append(windows, blackoutWindow{raw: item, spec: spec, length: length})
+	}
+	return windows, nil
+}
+
+// blackoutEnd returns when the latest-ending window open at now closes, or
+// the zero time if none are open. Windows open on the minute their schedule
+// matches, in the agent's local time.
+func blackoutEnd(windows []blackoutWindow, now time.Time) time.Time {
+	var end time.Time
+	var minute = now.Truncate(time.Minute)
+	for _, w := range windows {
+		for t := minute; now.Sub(t) < w.length; t = t.Add(-time.Minute) {
+			if w.spec.Match(t) {
+				var e = t.Add(w.length)
+				if e.After(end) {
+					end = e
+				}
+				break
+			}
+		}
+	}
+	return end
+}
+
+// deferDestructiveJobs is the queue's DeferFunc: destructive ONI commands
+// wait out any open blackout window, and everything else runs as usual
+func deferDestructiveJobs(_ int64, args []string, now time.Time) time.Time {
+	if len(args) == 0 || !destructiveJobCommands[args[0]] {
+		return time.Time{}
+	}
+	return blackoutEnd(BlackoutWindows, now)
+}
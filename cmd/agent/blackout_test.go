@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBlackoutEnd(t *testing.T) {
+	// Weekdays 8am to 6pm, and all of December 24th and 25th
+	var windows, err = parseBlackoutWindows("0 8 * * 1-5 10h; 0 0 24 12 * 48h;")
+	if err != nil {
+		t.Fatalf("Unable to parse windows: %s", err)
+	}
+
+	// June 3, 2024 was a Monday
+	var at = func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2024, month, day, hour, minute, 30, 0, time.Local)
+	}
+	var tests = map[string]struct {
+		now  time.Time
+		want time.Time
+	}{
+		"before hours":   {now: at(6, 3, 7, 59)},
+		"opening minute": {now: at(6, 3, 8, 0), want: at(6, 3, 18, 0).Truncate(time.Minute)},
+		"mid-afternoon":  {now: at(6, 3, 15, 45), want: at(6, 3, 18, 0).Truncate(time.Minute)},
+		"closed":         {now: at(6, 3, 18, 0)},
+		"weekend":        {now: at(6, 8, 12, 0)},
+		"holiday":        {now: at(12, 25, 3, 0), want: at(12, 26, 0, 0).Truncate(time.Minute)},
+
+		// On a weekday holiday, the window closing last wins
+		"holiday weekday": {now: at(12, 24, 9, 0), want: at(12, 26, 0, 0).Truncate(time.Minute)},
+	}
+	for name, tc := range tests {
+		var got = blackoutEnd(windows, tc.now)
+		if !got.Equal(tc.want) {
+			t.Errorf("%s: expected %s, got %s", name, tc.want, got)
+		}
+	}
+
+	var orig = BlackoutWindows
+	defer func() { BlackoutWindows = orig }()
+	BlackoutWindows = windows
+	if !deferDestructiveJobs(1, []string{"load_batch", "/mnt/batch"}, at(6, 3, 9, 0)).IsZero() {
+		t.Errorf("Expected a load to be allowed during a blackout")
+	}
+	if !deferDestructiveJobs(1, nil, at(6, 3, 9, 0)).IsZero() {
+		t.Errorf("Expected an in-process job to be allowed during a blackout")
+	}
+	if deferDestructiveJobs(1, []string{"purge_batch", "batch_foo"}, at(6, 3, 9, 0)).IsZero() {
+		t.Errorf("Expected a purge to be deferred during a blackout")
+	}
+}
+
+func TestParseBlackoutWindowsErrors(t *testing.T) {
+	for _, val := range []string{
+		"0 8 * * 1-5",
+		"0 8 * * 1-5 10h extra",
+		"0 25 * * * 1h",
+		"0 8 * * * forever",
+		"0 8 * * * 30s",
+		"0 8 * * * 200h",
+	} {
+		var _, err = parseBlackoutWindows(val)
+		if err == nil {
+			t.Errorf("Expected %q to be refused", val)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/anmitsu/go-shlex"
+)
+
+// maxBulkCommands is the most commands a single "batch" request may run
+const maxBulkCommands = 500
+
+// errNoBulkPayload is returned to commands run within "batch" which ask for a
+// payload: the batch's payload is the command list, so there's nothing left
+// to give them
+var errNoBulkPayload = errors.New("payloads are not available to commands run via batch")
+
+// bulkLine is a single command line from a bulk request's payload
+type bulkLine struct {
+	line int
+	args []string
+}
+
+// parseBulkCommands splits a bulk payload into its commands. Each line is
+// split into words the same way SSH command lines are, so quoting works as
+// it does for individual commands. Blank lines and lines starting with "#"
+// are skipped.
+func parseBulkCommands(payload []byte) ([]bulkLine, error) {
+	var cmds []bulkLine
+	for i, line := range strings.Split(string(payload), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var args, err = shlex.Split(line, true)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		cmds = append(cmds, bulkLine{line: i + 1, args: args})
+	}
+
+	if len(cmds) == 0 {
+		return nil, errors.New("no commands given")
+	}
+	if len(cmds) > maxBulkCommands {
+		return nil, fmt.Errorf("%d commands given; the maximum is %d", len(cmds), maxBulkCommands)
+	}
+	return cmds, nil
+}
+
+// runBulk reads newline-delimited commands from the request's payload and
+// dispatches each one in order, exactly as if it had been sent on its own.
+// Every command runs even if an earlier one fails unless stopOnError is set.
+func runBulk(r *request, stopOnError bool) response {
+	var payload, err = r.payload()
+	if err != nil {
+		return respond(StatusError, "Unable to read command list", payloadErrorData(err))
+	}
+	payload = bytes.ReplaceAll(payload, []byte("\r\n"), []byte("\n"))
+
+	var cmds []bulkLine
+	cmds, err = parseBulkCommands(payload)
+	if err != nil {
+		return respond(StatusError, "Invalid command list", H{"error": err.Error()})
+	}
+
+	var results = []H{}
+	var failed int
+	for _, c := range cmds {
+		if r.ctx.Err() != nil {
+			break
+		}
+
+		var resp response
+		if c.args[0] == r.command {
+			resp = respond(StatusError, fmt.Sprintf("%q cannot be nested", r.command), nil)
+		} else {
+			var sub = &request{
+				id:          r.id,
+				ctx:         r.ctx,
+				command:     c.args[0],
+				args:        c.args[1:],
+				user:        r.user,
+				source:      r.source,
+				client:      r.client,
+				payload:     func() ([]byte, error) { return nil, errNoBulkPayload },
+				keyCommands: r.keyCommands,
+				callback:    r.callback,
+			}
+			resp = dispatch(sub).collect()
+		}
+
+		var result = H{}
+		for k, v := range resp.data {
+			result[k] = v
+		}
+		result["line"] = c.line
+		result["command"] = c.args
+		result["status"] = resp.status
+		if resp.message != "" {
+			result["message"] = resp.message
+		}
+		results = append(results, result)
+
+		if resp.status != StatusSuccess {
+			failed++
+			if stopOnError {
+				break
+			}
+		}
+	}
+
+	var data = H{"results": results, "total": len(cmds), "run": len(results), "failed": failed}
+	if failed > 0 || len(results) < len(cmds) {
+		return respond(StatusError, fmt.Sprintf("%d of %d commands failed; %d not run", failed, len(cmds), len(cmds)-len(results)), data)
+	}
+	return respond(StatusSuccess, fmt.Sprintf("All %d commands succeeded", len(cmds)), data)
+}
+
+func init() {
+	register("batch", func(r *request) response {
+		var stopOnError bool
+		for _, arg := range r.args {
+			if arg != "--stop-on-error" {
+				return respond(StatusError, fmt.Sprintf("%q is not a valid option for %q", arg, r.command), nil)
+			}
+			stopOnError = true
+		}
+		return runBulk(r, stopOnError)
+	})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestParseBulkCommands(t *testing.T) {
+	var cmds, err = parseBulkCommands([]byte("# comment\n\nversion\nensure-awardee foo 'Foo University'\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(cmds) != 2 {
+		t.Fatalf("Expected 2 commands, got %#v", cmds)
+	}
+	if cmds[1].line != 4 || len(cmds[1].args) != 3 || cmds[1].args[2] != "Foo University" {
+		t.Fatalf("Expected quoted args to be kept together on line 4, got %#v", cmds[1])
+	}
+
+	for name, input := range map[string]string{
+		"empty":       "\n# nothing\n",
+		"bad quoting": "ensure-awardee foo 'Foo University\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			var _, err = parseBulkCommands([]byte(input))
+			if err == nil {
+				t.Fatalf("Expected an error for %q", input)
+			}
+		})
+	}
+}
+
+func TestRunBulk(t *testing.T) {
+	var newRequest = func(payload string) *request {
+		return &request{
+			ctx:     context.Background(),
+			command: "batch",
+			payload: func() ([]byte, error) { return []byte(payload), nil },
+		}
+	}
+
+	var resp = runBulk(newRequest("version\r\nversion\n"), false)
+	if resp.status != StatusSuccess || len(resp.data["results"].([]H)) != 2 {
+		t.Fatalf("Expected two successful results, got %#v", resp)
+	}
+
+	resp = runBulk(newRequest("version\nbogus\nbatch\nversion\n"), false)
+	var results = resp.data["results"].([]H)
+	if resp.status != StatusError || resp.data["failed"] != 2 || len(results) != 4 {
+		t.Fatalf("Expected two failures out of four, got %#v", resp)
+	}
+	if results[1]["line"] != 2 || results[1]["status"] != StatusError {
+		t.Fatalf("Expected line 2 to fail, got %#v", results[1])
+	}
+
+	resp = runBulk(newRequest("version\nbogus\nversion\n"), true)
+	if resp.data["run"] != 2 {
+		t.Fatalf("Expected stop-on-error to skip the last command, got %#v", resp)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+// Kinds of change recorded in the journal
+const (
+	changeJob     = "job"
+	changeBatch   = "batch"
+	changeAwardee = "awardee"
+)
+
+// maxChanges is how many changes the journal keeps. Clients catching up from
+// before the oldest one have to fall back to a full resync.
+const maxChanges = 10000
+
+// change is a single entry in the change journal
+type change struct {
+	Seq    int64     `json:"seq"`
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"`
+	Action string    `json:"action"`
+
+	// Subject is what changed: a job id, batch name, or awardee code
+	Subject any `json:"subject"`
+
+	// Detail holds anything else worth knowing, e.g., a job's name
+	Detail H `json:"detail,omitempty"`
+}
+
+// changeJournal is an in-memory, bounded log of state changes, so clients
+// like NCA can catch up after downtime without replaying every job's status
+type changeJournal struct {
+	m       sync.Mutex
+	seq     int64
+	started time.Time
+	dropped time.Time
+	list    []change
+}
+
+// Changes records job state transitions, batch events, and awardee changes
+var Changes = newChangeJournal()
+
+func newChangeJournal() *changeJournal {
+	return &changeJournal{started: time.Now()}
+}
+
+func (cj *changeJournal) add(kind, action string, subject any, detail H) {
+	cj.m.Lock()
+	defer cj.m.Unlock()
+	cj.seq++
+	cj.list = append(cj.list, change{Seq: cj.seq, Time: time.Now(), Kind: kind, Action: action, Subject: subject, Detail: detail})
+	if len(cj.list) > maxChanges {
+		var drop = len(cj.list) - maxChanges
+		cj.dropped = cj.list[drop-1].Time
+		cj.list = append([]change(nil), cj.list[drop:]...)
+	}
+}
+
+// since returns every change after t, oldest first, and the journal's
+// current time for the client's next call. complete is false if changes from
+// after t may have been lost: they're from before the agent started, or have
+// been pushed out of the journal.
+func (cj *changeJournal) since(t time.Time) (list []change, now time.Time, complete bool) {
+	cj.m.Lock()
+	defer cj.m.Unlock()
+	now = time.Now()
+	list = []change{}
+	for _, c := range cj.list {
+		if c.Time.After(t) {
+			list = append(list, c)
+		}
+	}
+	complete = !t.Before(cj.started) && !t.Before(cj.dropped)
+	return list, now, complete
+}
+
+// batchJobActions maps the ONI commands whose success changes a batch to what
+// the change is
+var batchJobActions = map[string]string{
+	"load_batch":  "loaded",
+	"purge_batch": "purged",
+}
+
+// recordJobChange records a job's state transition. A successful load or
+// purge job is also recorded as a batch change.
+func recordJobChange(j *queue.Job) {
+	var st = j.Status()
+	Changes.add(changeJob, string(st), j.ID(), H{"name": j.Name()})
+
+	var args = j.Args()
+	if st != queue.StatusSuccessful || len(args) < 2 {
+		return
+	}
+	var action = batchJobActions[args[0]]
+	if action != "" {
+		Changes.add(changeBatch, action, filepath.Base(args[1]), H{"job": j.ID()})
+	}
+}
+
+// recordJobProgress records a job's progress event, so clients following the
+// change journal see a long job's progress without polling its status
+func recordJobProgress(j *queue.Job, e queue.ProgressEvent) {
+	Changes.add(changeJob, "progress", j.ID(), H{"name": j.Name(), "progress": e})
+}
+
+func getChanges(r *request) response {
+	if len(r.args) != 2 || r.args[0] != "--since" {
+		return respond(StatusError, fmt.Sprintf("%q requires --since <RFC 3339 time>", r.command), nil)
+	}
+	var t, err = time.Parse(time.RFC3339, r.args[1])
+	if err != nil {
+		return respond(StatusError, fmt.Sprintf("%q is not an RFC 3339 time", r.args[1]), H{"error": err.Error()})
+	}
+
+	var list, now, complete = Changes.since(t)
+	var data = H{"changes": list, "complete": complete, "now": now}
+	if !complete {
+		data["warning"] = "Some changes since the given time may be missing (the agent restarted, or they're too old); do a full resync"
+	}
+	return respond(StatusSuccess, "", data)
+}
+
+func init() {
+	register("changes", getChanges)
+}
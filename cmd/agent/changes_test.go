@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+func TestChangeJournal(t *testing.T) {
+	var before = time.Now().Add(-time.Second)
+	var cj = newChangeJournal()
+	cj.add(changeAwardee, "created", "oru", nil)
+	var mid = time.Now()
+	time.Sleep(time.Millisecond)
+	cj.add(changeBatch, "frozen", "batch_oru_foo_ver01", nil)
+
+	var list, now, complete = cj.since(mid)
+	if len(list) != 1 || list[0].Subject != "batch_oru_foo_ver01" || !complete || now.Before(list[0].Time) {
+		t.Fatalf("Expected just the batch change, complete, got %#v (complete: %v, now: %s)", list, complete, now)
+	}
+	list, _, complete = cj.since(before)
+	if len(list) != 2 || complete {
+		t.Fatalf("Expected both changes, flagged incomplete since it's from before the journal started, got %#v (complete: %v)", list, complete)
+	}
+
+	var start = time.Now()
+	for i := 0; i < maxChanges+5; i++ {
+		cj.add(changeJob, "pending", int64(i), nil)
+	}
+	list, _, complete = cj.since(start)
+	if len(list) != maxChanges || complete || list[0].Seq != 8 {
+		t.Fatalf("Expected the oldest changes to be dropped and flagged, got %d changes starting at %d (complete: %v)", len(list), list[0].Seq, complete)
+	}
+}
+
+func TestRecordJobChange(t *testing.T) {
+	var origChanges = Changes
+	defer func() { Changes = origChanges }()
+	Changes = newChangeJournal()
+
+	var q = queue.New(queue.CommandRunner{Path: "/bin/true"})
+	q.SetHooks(queueHooks())
+	var id = q.QueueJob("Load batch", []string{"load_batch", "/mnt/batches/batch_oru_foo_ver01"})
+	var err = q.GetJob(id).Run(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	var list, _, _ = Changes.since(time.Time{})
+	var expected = []struct{ kind, action string }{
+		{changeJob, "pending"}, {changeJob, "started"}, {changeJob, "successful"}, {changeBatch, "loaded"},
+	}
+	if len(list) != len(expected) {
+		t.Fatalf("Expected %d changes, got %#v", len(expected), list)
+	}
+	for i, e := range expected {
+		if list[i].Kind != e.kind || list[i].Action != e.action {
+			t.Errorf("Expected change %d to be %s %s, got %s %s", i, e.kind, e.action, list[i].Kind, list[i].Action)
+		}
+	}
+	if list[3].Subject != "batch_oru_foo_ver01" {
+		t.Errorf("Expected the batch change to name the batch, got %v", list[3].Subject)
+	}
+
+	var resp = getChanges(&request{command: "changes", args: []string{"--since", "yesterday"}})
+	if resp.status != StatusError {
+		t.Fatalf("Expected an invalid time to be rejected, got %#v", resp)
+	}
+	resp = getChanges(&request{command: "changes", args: []string{"--since", time.Now().Add(-time.Hour).Format(time.RFC3339)}})
+	if resp.status != StatusSuccess || resp.data["complete"] != false || len(resp.data["changes"].([]change)) != 4 {
+		t.Fatalf("Expected all four changes, flagged incomplete, got %#v", resp.data)
+	}
+}
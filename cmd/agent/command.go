@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Status is a string type the handler's "status" JSON may return
+type Status string
+
+// All possible statuses
+const (
+	StatusError   Status = "error"
+	StatusSuccess Status = "success"
+)
+
+// H is a simple type alias for more easily building JSON responses
+type H map[string]any
+
+// request holds everything a command handler needs to know about a single
+// client command, independent of how the command arrived (SSH, gRPC, etc.)
+type request struct {
+	id      int64
+	ctx     context.Context
+	command string
+	args    []string
+
+	// user identifies who sent the request: the SSH user, or the gRPC client
+	// certificate's common name
+	user string
+
+	// source is the client's IP address, if the transport knows it
+	source netip.Addr
+
+	// client is what the transport authenticated the client with, if
+	// anything: the fingerprint of its SSH key, or its gRPC client
+	// certificate. Unlike an SSH user, the client can't just pick it.
+	client string
+
+	// keyCommands are the only commands the client's SSH key may run, if
+	// BA_AUTHORIZED_KEYS limits it; nil means any
+	keyCommands map[string]bool
+
+	// callback is where the client asked to be told the outcome of the job
+	// its command queues, if anywhere
+	callback string
+
+	// payload returns any extra data the client sent along with the command,
+	// such as MARC XML for load-title. Each transport decides how that data is
+	// delivered; commands which don't need a payload never call this.
+	payload func() ([]byte, error)
+
+	// nested is set for requests run on behalf of another request, such as a
+	// redeemed token's command
+	nested bool
+
+	// token is the ID of the token a request is being run with. The token
+	// stands in for the user's and key's permission to run the command, which
+	// was checked when it was issued.
+	token string
+}
+
+func (r *request) logInfo(msg string, args ...any) {
+	var combined = append([]any{"sessionID", r.id}, args...)
+	slog.Info(msg, combined...)
+}
+
+func (r *request) logError(msg string, args ...any) {
+	var combined = append([]any{"sessionID", r.id}, args...)
+	slog.Error(msg, combined...)
+}
+
+// response is what every command handler returns: transports are responsible
+// for getting it to the client
+type response struct {
+	status  Status
+	message string
+	data    H
+
+	// stream, if set, produces a list of results as the response is sent;
+	// see respondStream
+	stream *streamBody
+}
+
+// respond builds a response from its parts
+func respond(st Status, msg string, data H) response {
+	return response{status: st, message: msg, data: data}
+}
+
+// JSON returns the response in the form clients receive it: the handler's
+// data with status, session, and message keys added
+func (r response) JSON(sessionID int64) ([]byte, error) {
+	var data = H{}
+	for k, v := range r.data {
+		data[k] = v
+	}
+	data["status"] = r.status
+	data["session"] = H{"id": sessionID}
+	if r.message != "" {
+		data["message"] = r.message
+	}
+	return json.Marshal(data)
+}
+
+// handlerFunc is the signature every command must implement
+type handlerFunc func(r *request) response
+
+// commands is the registry of every command the agent understands. All
+// transports dispatch through this so they share the same validation and
+// business logic.
+var commands = make(map[string]handlerFunc)
+
+// register adds a command to the registry, panicking on duplicate names since
+// that's always a programming error
+func register(name string, h handlerFunc) {
+	if _, exists := commands[name]; exists {
+		panic(fmt.Sprintf("command %q registered twice", name))
+	}
+	commands[name] = h
+}
+
+// commandNames returns the sorted list of registered commands
+func commandNames() []string {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// dispatch runs the request's command through the middleware chain
+func dispatch(r *request) response {
+	var h, ok = commands[r.command]
+	if !ok {
+		return respond(StatusError, fmt.Sprintf("%q is not a valid command name", r.command), nil)
+	}
+	return chain(h)(r)
+}
+
+func init() {
+	register("version", func(_ *request) response {
+		return getVersion()
+	})
+
+	register("load-title", func(r *request) response {
+		var a, err = parseLoadTitleArgs(r.args)
+		if err != nil {
+			return respond(StatusError, fmt.Sprintf("Invalid %q arguments", r.command), H{"error": err.Error()})
+		}
+		return loadTitle(r, a)
+	})
+
+	register("list-jobs", listJobs)
+
+	register("job-status", func(r *request) response {
+		switch {
+		case len(r.args) == 1:
+			return getJobStatus(r, r.args[0])
+		case len(r.args) == 3 && r.args[1] == "--wait":
+			var secs, err = strconv.Atoi(r.args[2])
+			if err != nil || secs < 1 || secs > maxStatusWait {
+				return respond(StatusError, fmt.Sprintf("--wait requires a number of seconds from 1 to %d", maxStatusWait), nil)
+			}
+			return waitJobStatus(r, r.args[0], time.Duration(secs)*time.Second)
+		default:
+			return respond(StatusError, "You must supply a job ID, optionally followed by --wait <seconds>", nil)
+		}
+	})
+
+	register("job-logs", func(r *request) response {
+		if len(r.args) < 1 {
+			return respond(StatusError, "You must supply a job ID, optionally followed by --level <level> or --errors [--context <lines>], --source <name>, --since <time>, and --structured", nil)
+		}
+		var f, err = parseLogFilter(r.args[1:])
+		if err != nil {
+			return respond(StatusError, err.Error(), nil)
+		}
+		return getJobLogs(r.args[0], f)
+	})
+
+	register("annotate-job", func(r *request) response {
+		if len(r.args) < 2 {
+			return respond(StatusError, "You must supply a job ID and the note's text", nil)
+		}
+		return annotateJob(r, r.args[0], strings.Join(r.args[1:], " "))
+	})
+
+	register("cancel-job", func(r *request) response {
+		if len(r.args) < 1 {
+			return respond(StatusError, "You must supply a job ID, optionally followed by a reason", nil)
+		}
+		return cancelJob(r, r.args[0], strings.Join(r.args[1:], " "))
+	})
+
+	register("archived-jobs", func(r *request) response {
+		if len(r.args) > 1 {
+			return respond(StatusError, fmt.Sprintf("%q takes at most one argument: the earliest queue time (RFC 3339) to report", r.command), nil)
+		}
+		var since string
+		if len(r.args) == 1 {
+			since = r.args[0]
+		}
+		return listArchivedJobs(r, since)
+	})
+
+	register("archived-job", func(r *request) response {
+		if len(r.args) != 1 {
+			return respond(StatusError, "You must supply a job ID", nil)
+		}
+		return getArchivedJob(r, r.args[0])
+	})
+
+	register("load-batch", func(r *request) response {
+		var name, dr, err = parseLoadBatchArgs(r.args)
+		if err != nil {
+			return respond(StatusError, fmt.Sprintf("Invalid arguments for %q: %s", r.command, err), nil)
+		}
+		if dr != (dateRange{}) {
+			return loadPartialBatch(name, dr)
+		}
+		return loadBatch(name)
+	})
+
+	register("purge-batch", func(r *request) response {
+		var args []string
+		var override, force bool
+		for _, arg := range r.args {
+			switch arg {
+			case overrideFreezeFlag:
+				override = true
+			case purgeForceFlag:
+				force = true
+			default:
+				args = append(args, arg)
+			}
+		}
+		if len(args) != 1 {
+			return respond(StatusError, fmt.Sprintf("%q requires exactly one batch name, optionally followed by %s and/or %s", r.command, overrideFreezeFlag, purgeForceFlag), nil)
+		}
+		if resp, ok := checkFrozen(r, args[0], override); !ok {
+			return resp
+		}
+		return purgeBatch(r, args[0], force)
+	})
+
+	register("ensure-awardee", func(r *request) response {
+		var args = r.args
+		if len(args) < 1 || len(args) > 2 {
+			return respond(StatusError, fmt.Sprintf("%q requires one or two args: MARC org code and awardee name. Name is required if the awardee is to be auto-created.", r.command), nil)
+		}
+
+		if len(args) == 1 {
+			args = []string{args[0], ""}
+		}
+		return ensureAwardee(args[0], args[1])
+	})
+
+	register("delete-awardee", func(r *request) response {
+		var code string
+		var dryRun bool
+		for _, arg := range r.args {
+			switch {
+			case arg == "--dry-run":
+				dryRun = true
+			case code == "":
+				code = arg
+			default:
+				return respond(StatusError, fmt.Sprintf("%q requires exactly one MARC org code, optionally with --dry-run", r.command), nil)
+			}
+		}
+		if code == "" {
+			return respond(StatusError, fmt.Sprintf("%q requires exactly one MARC org code, optionally with --dry-run", r.command), nil)
+		}
+		return deleteAwardee(r, code, dryRun)
+	})
+
+	register("list-artifacts", func(r *request) response {
+		return listArtifacts(r)
+	})
+
+	register("get-artifact", func(r *request) response {
+		if len(r.args) != 1 {
+			return respond(StatusError, "You must supply an artifact name", nil)
+		}
+		return getArtifact(r, r.args[0])
+	})
+
+	register("reconcile", func(_ *request) response {
+		return reconcile()
+	})
+
+	register("report-duplicate-titles", func(_ *request) response {
+		return reportDuplicateTitles()
+	})
+
+	register("metrics", func(_ *request) response {
+		return getMetrics()
+	})
+
+	register("health", func(_ *request) response {
+		return getHealth()
+	})
+
+	register("host-key-info", func(_ *request) response {
+		return getHostKeyInfo()
+	})
+
+	register("load-issue", func(r *request) response {
+		if len(r.args) != 2 {
+			return respond(StatusError, fmt.Sprintf("%q requires a parent batch name and an issue directory relative to the batch source", r.command), nil)
+		}
+		return loadIssue(r.args[0], r.args[1])
+	})
+
+	register("issue-key", func(r *request) response {
+		if len(r.args) != 1 {
+			return respond(StatusError, fmt.Sprintf("%q requires exactly one issue key", r.command), nil)
+		}
+		return convertIssueKey(r.args[0])
+	})
+
+	register("batch-lineage", func(r *request) response {
+		if len(r.args) != 1 {
+			return respond(StatusError, fmt.Sprintf("%q requires exactly one batch or family name", r.command), nil)
+		}
+		return getBatchLineage(r, r.args[0])
+	})
+
+	register("check-jp2", func(r *request) response {
+		if len(r.args) != 1 {
+			return respond(StatusError, fmt.Sprintf("%q requires exactly one batch name", r.command), nil)
+		}
+		return checkBatchJP2s(r.args[0])
+	})
+}
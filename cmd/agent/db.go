@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/open-oni/oni-agent/internal/latency"
+)
+
+// Defaults for DB_QUERY_TIMEOUT, DB_REPORT_TIMEOUT, and DB_SLOW_QUERY_MS
+const (
+	defaultQueryTimeout   = time.Second * 30
+	defaultReportTimeout  = time.Minute * 10
+	defaultSlowQueryLimit = time.Second
+)
+
+// timedDB wraps the database pool so every query gets a timeout and has its
+// latency recorded. Anything which isn't a query (Close, SetMaxIdleConns,
+// etc.) goes straight to the embedded sql.DB.
+type timedDB struct {
+	*sql.DB
+	timeout time.Duration
+	stats   *latency.Tracker
+
+	// reportTimeout replaces timeout for ReportQueryContext's site-wide
+	// aggregates, which can take far longer than any other query on a large
+	// install
+	reportTimeout time.Duration
+
+	// readOnly refuses Exec and Begin, for verification-only agents and the
+	// read replica
+	readOnly bool
+}
+
+func newTimedDB(db *sql.DB, timeout, slow time.Duration) *timedDB {
+	return &timedDB{DB: db, timeout: timeout, reportTimeout: defaultReportTimeout, stats: latency.NewTracker(slow)}
+}
+
+// queryContext returns a context which expires after the given timeout.
+//
+// For Query and Begin, the context has to outlive the call: canceling it
+// closes the returned rows or rolls back the transaction. So instead of the
+// caller canceling it, it's canceled once the timeout elapses, which is
+// exactly what we want anyway: nobody should be holding rows (or a
+// transaction) open longer than the query timeout.
+func (db *timedDB) queryContext(parent context.Context, timeout time.Duration) context.Context {
+	var ctx, cancel = context.WithTimeout(parent, timeout)
+	time.AfterFunc(timeout, cancel)
+	return ctx
+}
+
+// observe records how long a query took, logging it if it was slow
+func (db *timedDB) observe(query string, start time.Time, err error) {
+	var d = time.Since(start)
+	query = strings.Join(strings.Fields(query), " ")
+	if db.stats.Observe(query, d, err != nil) {
+		slog.Warn("Slow database query", "query", query, "duration", d, "error", err)
+	}
+}
+
+// Query runs a query with the default timeout
+func (db *timedDB) Query(query string, args ...any) (*sql.Rows, error) {
+	return db.QueryContext(context.Background(), query, args...)
+}
+
+// QueryContext runs a query, giving up if ctx is canceled or the query
+// timeout elapses, whichever comes first
+func (db *timedDB) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	var start = time.Now()
+	var rows, err = db.DB.QueryContext(db.queryContext(ctx, db.timeout), query, args...)
+	db.observe(query, start, err)
+	return rows, err
+}
+
+// ReportQueryContext is QueryContext for an aggregate over the whole site,
+// such as reconcile's per-batch counts, which gets the report timeout instead
+// of the query timeout
+func (db *timedDB) ReportQueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	var start = time.Now()
+	var rows, err = db.DB.QueryContext(db.queryContext(ctx, db.reportTimeout), query, args...)
+	db.observe(query, start, err)
+	return rows, err
+}
+
+// QueryRow runs a query expected to return at most one row
+func (db *timedDB) QueryRow(query string, args ...any) *sql.Row {
+	var start = time.Now()
+	var row = db.DB.QueryRowContext(db.queryContext(context.Background(), db.timeout), query, args...)
+	db.observe(query, start, row.Err())
+	return row
+}
+
+// Exec runs a statement that doesn't return rows
+func (db *timedDB) Exec(query string, args ...any) (sql.Result, error) {
+	if db.readOnly {
+		return nil, errReadOnlyDB
+	}
+	var ctx, cancel = context.WithTimeout(context.Background(), db.timeout)
+	defer cancel()
+
+	var start = time.Now()
+	var result, err = db.DB.ExecContext(ctx, query, args...)
+	db.observe(query, start, err)
+	return result, err
+}
+
+// Begin starts a transaction. The query timeout applies to the transaction as
+// a whole: it's rolled back if it isn't committed in time.
+func (db *timedDB) Begin() (*sql.Tx, error) {
+	if db.readOnly {
+		return nil, errReadOnlyDB
+	}
+	var start = time.Now()
+	var tx, err = db.DB.BeginTx(db.queryContext(context.Background(), db.timeout), nil)
+	db.observe("BEGIN", start, err)
+	return tx, err
+}
+
+// reportingDB returns the pool heavy read-only queries should use: the
+// replica if DB_CONNECTION_RO is set, otherwise the primary. Anything whose
+// results feed a write (checking whether a batch is loaded before loading it,
+// etc.) must use dbPool instead, since a replica may lag behind.
+func reportingDB() *timedDB {
+	if dbReplica != nil {
+		return dbReplica
+	}
+	return dbPool
+}
+
+// dbHealth pings the database and reports whether it's reachable, along with
+// aggregate query latency stats
+func dbHealth(db *timedDB) (H, bool) {
+	var ctx, cancel = context.WithTimeout(context.Background(), db.timeout)
+	defer cancel()
+
+	var start = time.Now()
+	var err = db.PingContext(ctx)
+	var out = H{
+		"reachable": err == nil,
+		"ping_ms":   float64(time.Since(start).Microseconds()) / 1000,
+		"queries":   db.stats.Total(),
+	}
+	if err != nil {
+		out["error"] = err.Error()
+	}
+	return out, err == nil
+}
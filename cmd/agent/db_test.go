@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestReportingDB(t *testing.T) {
+	var origPrimary, origReplica = dbPool, dbReplica
+	t.Cleanup(func() { dbPool, dbReplica = origPrimary, origReplica })
+
+	dbPool = newTimedDB(nil, defaultQueryTimeout, defaultSlowQueryLimit)
+	dbReplica = nil
+	if reportingDB() != dbPool {
+		t.Fatal("Expected reports to use the primary without a replica")
+	}
+
+	dbReplica = newTimedDB(nil, defaultQueryTimeout, defaultSlowQueryLimit)
+	if reportingDB() != dbReplica {
+		t.Fatal("Expected reports to use the replica when one is configured")
+	}
+}
+
+func TestQueryContextTimeout(t *testing.T) {
+	var db = newTimedDB(nil, defaultQueryTimeout, defaultSlowQueryLimit)
+	if db.reportTimeout != defaultReportTimeout {
+		t.Fatalf("Expected report timeout %s, got %s", defaultReportTimeout, db.reportTimeout)
+	}
+
+	for name, timeout := range map[string]time.Duration{"query": db.timeout, "report": db.reportTimeout} {
+		var deadline, ok = db.queryContext(context.Background(), timeout).Deadline()
+		if !ok {
+			t.Fatalf("%s: expected a deadline", name)
+		}
+		var left = time.Until(deadline)
+		if left > timeout || left < timeout-time.Second {
+			t.Errorf("%s: expected a deadline about %s away, got %s", name, timeout, left)
+		}
+	}
+}
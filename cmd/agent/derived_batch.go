@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/open-oni/oni-agent/internal/batchname"
+	"github.com/open-oni/oni-agent/internal/batchxml"
+)
+
+// derivedMarker is written into every batch directory the agent builds (e.g.,
+// partial batches, single-issue batches, and merged batches). It records where the batch came
+// from, and tells us the directory is safe to rebuild: we never want to touch
+// a directory we didn't create.
+const derivedMarker = ".oni-agent-derived"
+
+// lineage describes how a derived batch was built
+type lineage struct {
+	Parent  string    `json:"parent"`
+	Kind    string    `json:"kind"`
+	Created time.Time `json:"created"`
+	From    string    `json:"from,omitempty"`
+	To      string    `json:"to,omitempty"`
+	Issue   string    `json:"issue,omitempty"`
+	Peer    string    `json:"peer,omitempty"`
+
+	// Sources lists both batches a merged batch was built from; Parent is
+	// the first of them
+	Sources []string `json:"sources,omitempty"`
+}
+
+// Kinds of derived batches
+const (
+	derivedPartial = "partial"
+	derivedIssue   = "issue"
+	derivedMirror  = "mirror"
+	derivedMerge   = "merge"
+)
+
+// readLineage returns the lineage of the batch in dir, or nil if the batch
+// wasn't built by the agent
+func readLineage(dir string) (*lineage, error) {
+	var data, err = os.ReadFile(filepath.Join(dir, derivedMarker))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading lineage: %w", err)
+	}
+
+	var l lineage
+	err = json.Unmarshal(data, &l)
+	if err != nil {
+		return nil, fmt.Errorf("reading lineage: %w", err)
+	}
+	return &l, nil
+}
+
+// createDerivedDir sets up dir for a new derived batch, writing its lineage.
+// If dir already exists it's replaced, but only if it's a derived batch.
+func createDerivedDir(dir string, l lineage) error {
+	var _, err = os.Stat(dir)
+	if err == nil {
+		_, err = os.Stat(filepath.Join(dir, derivedMarker))
+		if err != nil {
+			return fmt.Errorf("%s already exists and was not created by the agent", dir)
+		}
+		err = os.RemoveAll(dir)
+		if err != nil {
+			return fmt.Errorf("removing previous derived batch: %w", err)
+		}
+	}
+
+	l.Created = time.Now()
+	var data []byte
+	data, err = json.MarshalIndent(l, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(dir, 0755)
+	}
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, derivedMarker), append(data, '\n'), 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("creating derived batch: %w", err)
+	}
+	return nil
+}
+
+// linkIssueDir symlinks an issue directory into a derived batch's data dir at
+// the given relative path
+func linkIssueDir(dataDir string, rel batchxml.RelPath, issueDir string) error {
+	var link = rel.Join(dataDir)
+	var abs, err = filepath.Abs(issueDir)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(link), 0755)
+	}
+	if err == nil {
+		err = os.Symlink(abs, link)
+	}
+	if err != nil {
+		return fmt.Errorf("linking issue directory %q: %w", rel, err)
+	}
+	return nil
+}
+
+// getBatchLineage reports how a single batch was derived, or, given a family
+// name (a batch name without its version), the lineage of the whole family
+func getBatchLineage(r *request, name string) response {
+	if !batchNameRegexp.MatchString(name) {
+		var family, err = batchname.ParseFamily(name)
+		if err != nil {
+			return respond(StatusError, fmt.Sprintf("%q is not a valid batch or family name", name), nil)
+		}
+		return getFamilyLineage(r, family)
+	}
+
+	var dir, err = findBatch(name)
+	var l *lineage
+	if err == nil {
+		l, err = readLineage(dir)
+	}
+	if err != nil {
+		r.logError("Unable to read batch lineage", "batch", name, "error", err)
+		return respond(StatusError, "Unable to read batch lineage", H{"error": err.Error()})
+	}
+	if l == nil {
+		return respond(StatusSuccess, "Not a derived batch", H{"batch": H{"name": name, "derived": false}})
+	}
+	return respond(StatusSuccess, "", H{"batch": H{"name": name, "derived": true, "lineage": l}})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+// Sections of a failure diagnostics bundle
+const (
+	diagJob      = "job"
+	diagHealth   = "health"
+	diagDisk     = "disk"
+	diagAgentLog = "agent_log"
+)
+
+var diagSections = []string{diagJob, diagHealth, diagDisk, diagAgentLog}
+
+// FailureDiagnostics lists the sections captured into a diagnostics artifact
+// whenever a job fails. It's empty (disabled) unless FAILURE_DIAGNOSTICS is
+// set.
+var FailureDiagnostics = map[string]bool{}
+
+// parseFailureDiagnostics reads the FAILURE_DIAGNOSTICS setting: "all", or a
+// comma-separated list of sections
+func parseFailureDiagnostics(val string) (map[string]bool, error) {
+	var sections = map[string]bool{}
+	for _, s := range splitList(val) {
+		if s == "all" {
+			for _, s := range diagSections {
+				sections[s] = true
+			}
+			continue
+		}
+		var valid bool
+		for _, known := range diagSections {
+			valid = valid || s == known
+		}
+		if !valid {
+			return nil, fmt.Errorf("unknown section %q (use all, or any of %s)", s, strings.Join(diagSections, ", "))
+		}
+		sections[s] = true
+	}
+	return sections, nil
+}
+
+// diskUsage is the space available on the filesystem holding a path
+type diskUsage struct {
+	Path        string  `json:"path"`
+	TotalBytes  uint64  `json:"total_bytes,omitempty"`
+	FreeBytes   uint64  `json:"free_bytes,omitempty"`
+	UsedPercent float64 `json:"used_percent,omitempty"`
+	Error       string  `json:"error,omitempty"`
+}
+
+func getDiskUsage(path string) diskUsage {
+	var du = diskUsage{Path: path}
+	var st syscall.Statfs_t
+	var err = syscall.Statfs(path, &st)
+	if err != nil {
+		du.Error = err.Error()
+		return du
+	}
+	du.TotalBytes = st.Blocks * uint64(st.Bsize)
+	du.FreeBytes = st.Bavail * uint64(st.Bsize)
+	if du.TotalBytes > 0 {
+		du.UsedPercent = float64(du.TotalBytes-du.FreeBytes) / float64(du.TotalBytes) * 100
+	}
+	return du
+}
+
+// diagnosticsPaths are the directories whose disk usage matters to jobs
+func diagnosticsPaths() []string {
+	var paths []string
+	for _, p := range []string{BatchSource, ONILocation, StateDir, ArtifactDir, JobArchiveDir, WorkDir} {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// diagnosticsBundle is the artifact written for a failed job
+type diagnosticsBundle struct {
+	Generated time.Time     `json:"generated"`
+	Job       *queue.Record `json:"job,omitempty"`
+	Health    H             `json:"health,omitempty"`
+	Disk      []diskUsage   `json:"disk,omitempty"`
+	AgentLog  []string      `json:"agent_log,omitempty"`
+}
+
+// collectDiagnostics builds the configured sections of a failed job's
+// diagnostics bundle
+func collectDiagnostics(j *queue.Job, sections map[string]bool) diagnosticsBundle {
+	var b = diagnosticsBundle{Generated: time.Now()}
+	if sections[diagJob] {
+		var rec = j.Record()
+		b.Job = &rec
+	}
+	if sections[diagHealth] {
+		var health = getHealth()
+		b.Health = H{"status": health.status, "message": health.message, "data": health.data}
+	}
+	if sections[diagDisk] {
+		for _, p := range diagnosticsPaths() {
+			b.Disk = append(b.Disk, getDiskUsage(p))
+		}
+	}
+	if sections[diagAgentLog] {
+		b.AgentLog = AgentLog.Lines()
+	}
+	return b
+}
+
+// saveDiagnostics stores a failed job's diagnostics bundle as an artifact
+// and attaches it to the job
+func saveDiagnostics(j *queue.Job) {
+	var b = collectDiagnostics(j, FailureDiagnostics)
+	var data, err = json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		slog.Error("Unable to encode failure diagnostics", "job", j.ID(), "error", err)
+		return
+	}
+
+	var name = fmt.Sprintf("diagnostics-job-%d-%s.json", j.ID(), b.Generated.Format("20060102T150405"))
+	err = Artifacts.Put(name, bytes.NewReader(data))
+	if err != nil {
+		slog.Error("Unable to store failure diagnostics", "job", j.ID(), "error", err)
+		return
+	}
+	j.AddArtifact(name)
+	slog.Info("Stored failure diagnostics", "job", j.ID(), "artifact", name)
+}
+
+// diagnoseFailure saves diagnostics for a finished job if it failed. It's
+// called from the event bus's background subscriber, since collecting
+// diagnostics means checking the database and the queue, which the queue's
+// hooks mustn't do directly.
+func diagnoseFailure(j *queue.Job) {
+	var st = j.Status()
+	if st != queue.StatusFailed && st != queue.StatusFailStart {
+		return
+	}
+	saveDiagnostics(j)
+}
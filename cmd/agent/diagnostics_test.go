@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"testing"
+
+	"github.com/open-oni/oni-agent/internal/artifact"
+	"github.com/open-oni/oni-agent/pkg/logstream"
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+func TestParseFailureDiagnostics(t *testing.T) {
+	var got, err = parseFailureDiagnostics("all")
+	if err != nil || len(got) != len(diagSections) {
+		t.Fatalf("Expected every section for %q, got %v, %v", "all", got, err)
+	}
+	got, err = parseFailureDiagnostics("job, disk")
+	if err != nil || len(got) != 2 || !got[diagJob] || !got[diagDisk] {
+		t.Fatalf("Expected job and disk, got %v, %v", got, err)
+	}
+	got, err = parseFailureDiagnostics("")
+	if err != nil || len(got) != 0 {
+		t.Fatalf("Expected diagnostics to be disabled, got %v, %v", got, err)
+	}
+	_, err = parseFailureDiagnostics("job,settings")
+	if err == nil {
+		t.Fatal("Expected an unknown section to be rejected")
+	}
+}
+
+func TestLogTail(t *testing.T) {
+	var origRedactor = Redactor
+	defer func() { Redactor = origRedactor }()
+	Redactor = logstream.NewRedactor(regexp.MustCompile(`hunter2`))
+
+	var lt = newLogTail(3)
+	for i := 1; i <= 4; i++ {
+		fmt.Fprintf(lt, "line %d\n", i)
+	}
+	fmt.Fprintf(lt, "password=hunter2\n")
+
+	var got = lt.Lines()
+	if len(got) != 3 || got[0] != "line 3" || got[2] != "password="+logstream.RedactedText {
+		t.Fatalf("Expected the last three lines, redacted, got %q", got)
+	}
+}
+
+func TestSaveDiagnostics(t *testing.T) {
+	var origArtifacts, origSections, origSource = Artifacts, FailureDiagnostics, BatchSource
+	defer func() { Artifacts, FailureDiagnostics, BatchSource = origArtifacts, origSections, origSource }()
+
+	var store, err = artifact.NewDir(t.TempDir())
+	if err != nil {
+		t.Fatalf("Unable to create artifact store: %s", err)
+	}
+	Artifacts = store
+	BatchSource = t.TempDir()
+	FailureDiagnostics = map[string]bool{diagJob: true, diagDisk: true}
+
+	var q = queue.New(queue.CommandRunner{Path: "/bin/false"})
+	var j = q.NewFuncJob("doomed", func(_ context.Context, j *queue.Job) error {
+		j.Warnf("disk full")
+		return errors.New("no space left on device")
+	})
+	_ = j.Run(context.Background())
+
+	saveDiagnostics(j)
+	var names = j.Artifacts()
+	if len(names) != 1 {
+		t.Fatalf("Expected one diagnostics artifact, got %v", names)
+	}
+
+	var f io.ReadCloser
+	f, err = Artifacts.Get(names[0])
+	if err != nil {
+		t.Fatalf("Unable to read artifact: %s", err)
+	}
+	defer f.Close()
+	var b diagnosticsBundle
+	err = json.NewDecoder(f).Decode(&b)
+	if err != nil {
+		t.Fatalf("Unable to decode artifact: %s", err)
+	}
+	if b.Job == nil || b.Job.Error != "no space left on device" || len(b.Job.Stderr) != 1 {
+		t.Fatalf("Expected the failed job's record and logs, got %#v", b.Job)
+	}
+	if len(b.Disk) != 1 || b.Disk[0].Path != BatchSource || b.Disk[0].TotalBytes == 0 {
+		t.Fatalf("Expected BATCH_SOURCE disk usage, got %#v", b.Disk)
+	}
+	if b.Health != nil || b.AgentLog != nil {
+		t.Fatalf("Expected only the configured sections, got %#v", b)
+	}
+}
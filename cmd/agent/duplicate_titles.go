@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+// titleSummary is what the duplicate title report knows about a title
+type titleSummary struct {
+	LCCN      string `json:"lccn"`
+	Name      string `json:"name"`
+	ISSN      string `json:"issn,omitempty"`
+	Place     string `json:"place_of_publication,omitempty"`
+	StartYear string `json:"start_year,omitempty"`
+	EndYear   string `json:"end_year,omitempty"`
+	Issues    int    `json:"issues"`
+}
+
+// Reasons titles can be grouped as possible duplicates
+const (
+	dupLCCN = "lccn"
+	dupISSN = "issn"
+	dupName = "name"
+)
+
+// duplicateGroup is a set of titles which look like the same title, with a
+// suggested merge. Suggestions are only that: nothing is changed in ONI.
+type duplicateGroup struct {
+	Reason string         `json:"reason"`
+	Key    string         `json:"key"`
+	Titles []titleSummary `json:"titles"`
+
+	// Keep is the suggested title to merge the others into: the one with the
+	// most issues, since moving the fewest issues is the least disruptive
+	Keep  string   `json:"keep"`
+	Merge []string `json:"merge"`
+}
+
+// duplicateReport is the artifact a report-duplicate-titles job produces
+type duplicateReport struct {
+	Generated time.Time        `json:"generated"`
+	Titles    int              `json:"titles"`
+	Groups    []duplicateGroup `json:"groups"`
+}
+
+var lccnSpaceRegexp = regexp.MustCompile(`\s+`)
+
+// normalizeLCCN applies the Library of Congress LCCN normalization rules:
+// remove spaces, and if there's a hyphen, drop it and left-pad the part after
+// it with zeroes to six digits. This catches "sn 96-88442" and "sn96088442"
+// being loaded as different titles.
+func normalizeLCCN(lccn string) string {
+	var n = strings.ToLower(lccnSpaceRegexp.ReplaceAllString(lccn, ""))
+	if i := strings.Index(n, "/"); i >= 0 {
+		n = n[:i]
+	}
+	if prefix, serial, ok := strings.Cut(n, "-"); ok {
+		if len(serial) < 6 {
+			serial = strings.Repeat("0", 6-len(serial)) + serial
+		}
+		n = prefix + serial
+	}
+	return n
+}
+
+// normalizeISSN returns the ISSN as NNNN-NNNC, or an empty string if it
+// doesn't look like an ISSN
+func normalizeISSN(issn string) string {
+	var digits []rune
+	for _, r := range strings.ToUpper(issn) {
+		if unicode.IsDigit(r) || r == 'X' {
+			digits = append(digits, r)
+		}
+	}
+	if len(digits) != 8 {
+		return ""
+	}
+	return string(digits[:4]) + "-" + string(digits[4:])
+}
+
+var (
+	bracketRegexp = regexp.MustCompile(`\[[^\]]*\]`)
+	articleRegexp = regexp.MustCompile(`^(the|a|an) `)
+)
+
+// normalizeName reduces a title name or place to a form where trivial
+// differences (case, punctuation, "[volume]", a leading article) disappear
+func normalizeName(name string) string {
+	name = bracketRegexp.ReplaceAllString(strings.ToLower(name), " ")
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return ' '
+	}, name)
+	return articleRegexp.ReplaceAllString(strings.Join(strings.Fields(name), " "), "")
+}
+
+// findDuplicateTitles groups titles which share a normalized LCCN, an ISSN,
+// or a normalized name and place of publication. Names alone aren't enough:
+// plenty of different papers were called "The Daily Journal".
+func findDuplicateTitles(titles []titleSummary) []duplicateGroup {
+	var groups = []duplicateGroup{}
+	var add = func(reason string, key func(t titleSummary) string) {
+		var byKey = make(map[string][]titleSummary)
+		for _, t := range titles {
+			var k = key(t)
+			if k != "" {
+				byKey[k] = append(byKey[k], t)
+			}
+		}
+		var keys []string
+		for k, list := range byKey {
+			if len(list) > 1 {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			groups = append(groups, newDuplicateGroup(reason, k, byKey[k]))
+		}
+	}
+
+	add(dupLCCN, func(t titleSummary) string { return normalizeLCCN(t.LCCN) })
+	add(dupISSN, func(t titleSummary) string { return normalizeISSN(t.ISSN) })
+	add(dupName, func(t titleSummary) string {
+		var name = normalizeName(t.Name)
+		if name == "" {
+			return ""
+		}
+		return name + " / " + normalizeName(t.Place)
+	})
+	return groups
+}
+
+// newDuplicateGroup builds a group, choosing the title with the most issues
+// (then the lowest LCCN) as the one to keep
+func newDuplicateGroup(reason, key string, titles []titleSummary) duplicateGroup {
+	sort.Slice(titles, func(i, j int) bool {
+		if titles[i].Issues != titles[j].Issues {
+			return titles[i].Issues > titles[j].Issues
+		}
+		return titles[i].LCCN < titles[j].LCCN
+	})
+
+	var g = duplicateGroup{Reason: reason, Key: key, Titles: titles, Keep: titles[0].LCCN}
+	for _, t := range titles[1:] {
+		g.Merge = append(g.Merge, t.LCCN)
+	}
+	return g
+}
+
+// loadTitleSummaries reads every title from ONI
+func loadTitleSummaries(ctx context.Context) ([]titleSummary, error) {
+	var rows, err = reportingDB().QueryContext(ctx, ONIDB.TitleSummaries)
+	if err != nil {
+		return nil, fmt.Errorf("querying database: %w", err)
+	}
+	defer rows.Close()
+
+	var titles []titleSummary
+	for rows.Next() {
+		var t titleSummary
+		err = rows.Scan(&t.LCCN, &t.Name, &t.ISSN, &t.Place, &t.StartYear, &t.EndYear, &t.Issues)
+		if err != nil {
+			return nil, fmt.Errorf("reading titles from database: %w", err)
+		}
+		titles = append(titles, t)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("reading titles from database: %w", err)
+	}
+	return titles, nil
+}
+
+// runDuplicateTitles is the report-duplicate-titles job
+func runDuplicateTitles(ctx context.Context, j *queue.Job) error {
+	var titles, err = loadTitleSummaries(ctx)
+	if err != nil {
+		return err
+	}
+	j.Logf("Checking %d titles for duplicates", len(titles))
+
+	var report = duplicateReport{Generated: time.Now(), Titles: len(titles), Groups: findDuplicateTitles(titles)}
+	for _, g := range report.Groups {
+		j.Warnf("Possible duplicates by %s (%s): keep %s, merge %s", g.Reason, g.Key, g.Keep, strings.Join(g.Merge, ", "))
+	}
+	j.Logf("Found %d groups of possible duplicates", len(report.Groups))
+
+	var data []byte
+	data, err = json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding report: %w", err)
+	}
+
+	var name = fmt.Sprintf("duplicate-titles-%s.json", report.Generated.UTC().Format("20060102T150405"))
+	err = Artifacts.Put(name, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("storing report: %w", err)
+	}
+	j.AddArtifact(name)
+	j.Logf("Report stored as artifact %q", name)
+
+	return nil
+}
+
+func reportDuplicateTitles() response {
+	if Artifacts == nil {
+		return respond(StatusError, "Artifact storage is not enabled", nil)
+	}
+
+	var id = JobRunner.QueueFunc("Report duplicate titles", runDuplicateTitles)
+	return respond(StatusSuccess, "Job added to queue", H{"job": H{"id": id}})
+}
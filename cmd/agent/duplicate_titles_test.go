@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNormalizers(t *testing.T) {
+	var tests = []struct {
+		fn       func(string) string
+		input    string
+		expected string
+	}{
+		{normalizeLCCN, "sn 96-88442", "sn96088442"},
+		{normalizeLCCN, "sn96088442", "sn96088442"},
+		{normalizeLCCN, "  SN85042 /r88", "sn85042"},
+		{normalizeISSN, "1234-567x", "1234-567X"},
+		{normalizeISSN, "12345678", "1234-5678"},
+		{normalizeISSN, "n/a", ""},
+		{normalizeName, "The Morning Oregonian. [volume]", "morning oregonian"},
+		{normalizeName, "Morning  oregonian!", "morning oregonian"},
+		{normalizeName, "Portland, Or.", "portland or"},
+	}
+	for _, tc := range tests {
+		var got = tc.fn(tc.input)
+		if got != tc.expected {
+			t.Errorf("Expected %q to normalize to %q, got %q", tc.input, tc.expected, got)
+		}
+	}
+}
+
+func TestFindDuplicateTitles(t *testing.T) {
+	var titles = []titleSummary{
+		{LCCN: "sn96088442", Name: "The Morning Oregonian. [volume]", Place: "Portland, Or.", Issues: 10},
+		{LCCN: "sn 96-88442", Name: "Oregonian", Place: "Portland, Or.", Issues: 0},
+		{LCCN: "sn00000001", Name: "Morning Oregonian", Place: "Portland, Or", ISSN: "1234-5678", Issues: 50},
+		{LCCN: "sn00000002", Name: "The Daily Journal", Place: "Salem, Or.", ISSN: "12345678"},
+		{LCCN: "sn00000003", Name: "The Daily Journal", Place: "Eugene, Or."},
+	}
+
+	var groups = findDuplicateTitles(titles)
+	type summary struct {
+		Reason, Key, Keep string
+		Merge             []string
+	}
+	var got []summary
+	for _, g := range groups {
+		got = append(got, summary{g.Reason, g.Key, g.Keep, g.Merge})
+	}
+	var expected = []summary{
+		{dupLCCN, "sn96088442", "sn96088442", []string{"sn 96-88442"}},
+		{dupISSN, "1234-5678", "sn00000001", []string{"sn00000002"}},
+		{dupName, "morning oregonian / portland or", "sn00000001", []string{"sn96088442"}},
+	}
+	var diff = cmp.Diff(expected, got)
+	if diff != "" {
+		t.Fatal(diff)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/open-oni/oni-agent/internal/batchname"
+	"github.com/open-oni/oni-agent/proto/agentpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// PeerAgents maps the names of other environments (e.g., "staging") to the
+// gRPC address of the agent running there, e.g., "staging.example.org:8443"
+var PeerAgents = make(map[string]string)
+
+// peerTLSConfig holds the client certificate and CA used to talk to peers
+type peerTLSConfig struct {
+	certFile string
+	keyFile  string
+	caFile   string
+}
+
+// PeerTLS is set from PEER_CERT_FILE, PEER_KEY_FILE, and PEER_CA_FILE
+var PeerTLS peerTLSConfig
+
+// peerTimeout caps how long a single call to a peer may take
+var peerTimeout = 30 * time.Second
+
+// listedBatch is one loaded batch as list-batches reports it. Family and
+// version are left out of batches whose names aren't NDNP-style. Created is
+// as ONI's database stores it, without a time zone.
+type listedBatch struct {
+	Name    string `json:"name"`
+	Created string `json:"created,omitempty"`
+	Family  string `json:"family,omitempty"`
+	Version int    `json:"version,omitempty"`
+	Issues  int    `json:"issues"`
+	Pages   int    `json:"pages"`
+}
+
+// versionDifference is a batch family loaded in both environments, but not at
+// the same versions
+type versionDifference struct {
+	Family string `json:"family"`
+	Local  []int  `json:"local"`
+	Peer   []int  `json:"peer"`
+}
+
+// environmentComparison is what compare-environments reports
+type environmentComparison struct {
+	Peer              string              `json:"peer"`
+	Matched           int                 `json:"matched"`
+	LocalOnly         []listedBatch       `json:"local_only"`
+	PeerOnly          []listedBatch       `json:"peer_only"`
+	DifferentVersions []versionDifference `json:"different_versions"`
+	LocalBatches      int                 `json:"local_batches"`
+	PeerBatches       int                 `json:"peer_batches"`
+}
+
+// parsePeerAgents reads PEER_AGENTS: a comma-separated list of name=host:port
+// pairs
+func parsePeerAgents(val string) (map[string]string, error) {
+	var peers = make(map[string]string)
+	for _, item := range splitList(val) {
+		var name, addr, ok = strings.Cut(item, "=")
+		name, addr = strings.TrimSpace(name), strings.TrimSpace(addr)
+		if !ok || name == "" || addr == "" {
+			return nil, fmt.Errorf("%q must be in the form name=host:port", item)
+		}
+		var _, _, err = net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", item, err)
+		}
+		if peers[name] != "" {
+			return nil, fmt.Errorf("peer %q is listed more than once", name)
+		}
+		peers[name] = addr
+	}
+	return peers, nil
+}
+
+// tlsConfig builds a TLS config which presents our client certificate and
+// trusts only peers whose certificates are signed by the configured CA
+func (c peerTLSConfig) tlsConfig() (*tls.Config, error) {
+	var cert, err = tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading peer client certificate: %w", err)
+	}
+
+	var ca []byte
+	ca, err = os.ReadFile(c.caFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading peer CA file: %w", err)
+	}
+	var pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("peer CA file contains no valid certificates")
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// listBatches returns every loaded batch, sorted by name
+func listBatches(ctx context.Context) ([]listedBatch, error) {
+	var rows, err = reportingDB().QueryContext(ctx, ONIDB.BatchList)
+	if err != nil {
+		return nil, fmt.Errorf("querying database: %w", err)
+	}
+	defer rows.Close()
+
+	var list = []listedBatch{}
+	for rows.Next() {
+		var b listedBatch
+		err = rows.Scan(&b.Name, &b.Created, &b.Issues, &b.Pages)
+		if err != nil {
+			return nil, fmt.Errorf("reading batches from database: %w", err)
+		}
+		if n, err := batchname.Parse(b.Name); err == nil {
+			b.Family, b.Version = n.Family(), n.Version
+		}
+		list = append(list, b)
+	}
+	return list, rows.Err()
+}
+
+// peerListBatches runs list-batches over gRPC on the peer agent at addr,
+// using PeerTLS, and returns the batches it reports
+var peerListBatches = func(ctx context.Context, addr string) ([]listedBatch, error) {
+	var tc, err = PeerTLS.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	var conn *grpc.ClientConn
+	conn, err = grpc.NewClient(addr, grpc.WithTransportCredentials(credentials.NewTLS(tc)))
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", addr, err)
+	}
+	defer conn.Close()
+
+	var ctx2, cancel = context.WithTimeout(ctx, peerTimeout)
+	defer cancel()
+	var resp *agentpb.CommandResponse
+	resp, err = agentpb.NewAgentClient(conn).Run(ctx2, &agentpb.CommandRequest{Command: "list-batches"})
+	if err != nil {
+		return nil, fmt.Errorf("running list-batches on %s: %w", addr, err)
+	}
+	if resp.GetStatus() != string(StatusSuccess) {
+		return nil, fmt.Errorf("list-batches on %s failed: %s", addr, resp.GetMessage())
+	}
+
+	var data struct {
+		Batches []listedBatch `json:"batches"`
+	}
+	err = json.Unmarshal([]byte(resp.GetJson()), &data)
+	if err != nil {
+		return nil, fmt.Errorf("reading list-batches response from %s: %w", addr, err)
+	}
+	return data.Batches, nil
+}
+
+// compareEnvironments sorts out which batches are loaded in only one of two
+// environments. A batch missing from one side whose family is there at
+// another version is also reported under DifferentVersions, so a peer that's
+// simply a version behind is easy to spot.
+func compareEnvironments(peer string, local, remote []listedBatch) environmentComparison {
+	var c = environmentComparison{
+		Peer:              peer,
+		LocalOnly:         []listedBatch{},
+		PeerOnly:          []listedBatch{},
+		DifferentVersions: []versionDifference{},
+		LocalBatches:      len(local),
+		PeerBatches:       len(remote),
+	}
+
+	var localNames, remoteNames = make(map[string]bool), make(map[string]bool)
+	var localVersions, remoteVersions = make(map[string][]int), make(map[string][]int)
+	for _, b := range local {
+		localNames[b.Name] = true
+		if b.Family != "" {
+			localVersions[b.Family] = append(localVersions[b.Family], b.Version)
+		}
+	}
+	for _, b := range remote {
+		remoteNames[b.Name] = true
+		if b.Family != "" {
+			remoteVersions[b.Family] = append(remoteVersions[b.Family], b.Version)
+		}
+	}
+
+	var families = make(map[string]bool)
+	for _, b := range local {
+		if remoteNames[b.Name] {
+			c.Matched++
+			continue
+		}
+		c.LocalOnly = append(c.LocalOnly, b)
+		families[b.Family] = true
+	}
+	for _, b := range remote {
+		if !localNames[b.Name] {
+			c.PeerOnly = append(c.PeerOnly, b)
+			families[b.Family] = true
+		}
+	}
+
+	for family := range families {
+		if family == "" || localVersions[family] == nil || remoteVersions[family] == nil {
+			continue
+		}
+		sort.Ints(localVersions[family])
+		sort.Ints(remoteVersions[family])
+		c.DifferentVersions = append(c.DifferentVersions, versionDifference{
+			Family: family,
+			Local:  localVersions[family],
+			Peer:   remoteVersions[family],
+		})
+	}
+	sort.Slice(c.DifferentVersions, func(i, j int) bool {
+		return c.DifferentVersions[i].Family < c.DifferentVersions[j].Family
+	})
+	return c
+}
+
+func getCompareEnvironments(r *request, peer string) response {
+	var addr = PeerAgents[peer]
+	if addr == "" {
+		return respond(StatusError, fmt.Sprintf("%q is not a known peer agent", peer), nil)
+	}
+
+	var local, err = listBatches(r.ctx)
+	if err != nil {
+		return respond(StatusError, "Unable to list local batches", H{"error": err.Error()})
+	}
+	var remote []listedBatch
+	remote, err = peerListBatches(r.ctx, addr)
+	if err != nil {
+		return respond(StatusError, fmt.Sprintf("Unable to list batches on %q", peer), H{"error": err.Error()})
+	}
+
+	var c = compareEnvironments(peer, local, remote)
+	var data = H{"comparison": c}
+	if len(c.LocalOnly) == 0 && len(c.PeerOnly) == 0 {
+		return respond(StatusSuccess, fmt.Sprintf("Both environments have the same %d batches", c.Matched), data)
+	}
+	return respond(StatusSuccess, fmt.Sprintf("%d batches are only loaded here, %d only on %q", len(c.LocalOnly), len(c.PeerOnly), peer), data)
+}
+
+func init() {
+	register("list-batches", func(r *request) response {
+		if len(r.args) != 0 {
+			return respond(StatusError, fmt.Sprintf("%q takes no arguments", r.command), nil)
+		}
+		var list, err = listBatches(r.ctx)
+		if err != nil {
+			return respond(StatusError, "Unable to list batches", H{"error": err.Error()})
+		}
+		return respond(StatusSuccess, "", H{"batches": list})
+	})
+
+	register("compare-environments", func(r *request) response {
+		if len(r.args) != 1 {
+			return respond(StatusError, fmt.Sprintf("%q requires exactly one peer name", r.command), nil)
+		}
+		return getCompareEnvironments(r, r.args[0])
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParsePeerAgents(t *testing.T) {
+	var peers, err = parsePeerAgents("staging=staging.example.org:2223, qa = 10.0.0.5:2223")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var diff = cmp.Diff(map[string]string{"staging": "staging.example.org:2223", "qa": "10.0.0.5:2223"}, peers)
+	if diff != "" {
+		t.Fatal(diff)
+	}
+
+	for _, bad := range []string{"staging", "=foo:1", "staging=staging.example.org", "a=x:1,a=y:2"} {
+		_, err = parsePeerAgents(bad)
+		if err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+}
+
+func TestCompareEnvironments(t *testing.T) {
+	var batch = func(name, family string, version int) listedBatch {
+		return listedBatch{Name: name, Created: "2024-06-03 14:22:10", Family: family, Version: version, Issues: 10, Pages: 80}
+	}
+	var local = []listedBatch{
+		batch("batch_oru_alpha_ver01", "batch_oru_alpha", 1),
+		batch("batch_oru_bravo_ver01", "batch_oru_bravo", 1),
+		batch("batch_oru_charlie_ver01", "batch_oru_charlie", 1),
+		batch("oddly_named", "", 0),
+	}
+	var remote = []listedBatch{
+		batch("batch_oru_alpha_ver01", "batch_oru_alpha", 1),
+		batch("batch_oru_bravo_ver02", "batch_oru_bravo", 2),
+		batch("batch_oru_delta_ver01", "batch_oru_delta", 1),
+		batch("batch_oru_delta_ver02", "batch_oru_delta", 2),
+	}
+
+	var got = compareEnvironments("staging", local, remote)
+	var want = environmentComparison{
+		Peer:    "staging",
+		Matched: 1,
+		LocalOnly: []listedBatch{
+			batch("batch_oru_bravo_ver01", "batch_oru_bravo", 1),
+			batch("batch_oru_charlie_ver01", "batch_oru_charlie", 1),
+			batch("oddly_named", "", 0),
+		},
+		PeerOnly: []listedBatch{
+			batch("batch_oru_bravo_ver02", "batch_oru_bravo", 2),
+			batch("batch_oru_delta_ver01", "batch_oru_delta", 1),
+			batch("batch_oru_delta_ver02", "batch_oru_delta", 2),
+		},
+		DifferentVersions: []versionDifference{{Family: "batch_oru_bravo", Local: []int{1}, Peer: []int{2}}},
+		LocalBatches:      4,
+		PeerBatches:       4,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Unexpected comparison (-want +got):\n%s", diff)
+	}
+
+	var err = checkResponse("compare-environments", respond(StatusSuccess, "", H{"comparison": got}))
+	if err != nil {
+		t.Errorf("Comparison doesn't match its schema: %s", err)
+	}
+
+	got = compareEnvironments("staging", local[:1], remote[:1])
+	if got.Matched != 1 || len(got.LocalOnly) != 0 || len(got.PeerOnly) != 0 || len(got.DifferentVersions) != 0 {
+		t.Errorf("Expected identical environments to match, got %#v", got)
+	}
+}
+
+func TestCompareEnvironmentsUnknownPeer(t *testing.T) {
+	var orig = PeerAgents
+	defer func() { PeerAgents = orig }()
+	PeerAgents = map[string]string{"staging": "staging.example.org:2223"}
+
+	var resp = getCompareEnvironments(&request{ctx: context.Background()}, "prod")
+	if resp.status != StatusError {
+		t.Fatalf("Expected an unknown peer to be refused, got %#v", resp)
+	}
+}
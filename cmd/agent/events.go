@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log/slog"
+
+	"github.com/open-oni/oni-agent/internal/eventbus"
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+// Topics the queue's hooks publish. Every event's data is the job, except
+// job.progress, whose data is a jobProgress.
+const (
+	topicJobQueued   = "job.queued"
+	topicJobStarted  = "job.started"
+	topicJobFinished = "job.finished"
+	topicJobStalled  = "job.stalled"
+	topicJobProgress = "job.progress"
+)
+
+// jobProgress is the data published with a job.progress event
+type jobProgress struct {
+	job   *queue.Job
+	event queue.ProgressEvent
+}
+
+// Events is the agent's event bus: the queue publishes every job lifecycle
+// event to it, and everything which cares about jobs subscribes rather than
+// being wired into the queue's hooks
+var Events = newEventBus()
+
+// newEventBus returns a bus with the subscribers which must always be kept
+// up to date: the change journal, lookup cache, and loads' expected batch
+// contents. These are updated synchronously, so they're never behind what
+// job-status reports. Partial batches are cleaned up synchronously too, so a
+// retried partial load can't have its new batch removed from under it.
+func newEventBus() *eventbus.Bus {
+	var b = eventbus.New()
+	b.SubscribeSync("changes", func(e eventbus.Event) {
+		if e.Topic == topicJobProgress {
+			var p = e.Data.(jobProgress)
+			recordJobProgress(p.job, p.event)
+			return
+		}
+		recordJobChange(e.Data.(*queue.Job))
+	}, topicJobQueued, topicJobStarted, topicJobFinished, topicJobProgress)
+	b.SubscribeSync("lookup_cache", func(e eventbus.Event) {
+		forgetJobLookups(e.Data.(*queue.Job))
+	}, topicJobFinished)
+	b.SubscribeSync("load_contents", func(e eventbus.Event) {
+		forgetLoadContents(e.Data.(*queue.Job))
+	}, topicJobFinished)
+	b.SubscribeSync("partial_batches", func(e eventbus.Event) {
+		cleanUpPartialBatch(e.Data.(*queue.Job))
+	}, topicJobFinished)
+	return b
+}
+
+// subscribeBackground adds the subscribers which run in the background,
+// where they can't hold up the queue, once the agent's settings are known.
+// Job counts go to stats.
+func subscribeBackground(b *eventbus.Bus, stats *jobCounter) {
+	if len(FailureDiagnostics) > 0 {
+		b.Subscribe("diagnostics", func(e eventbus.Event) {
+			diagnoseFailure(e.Data.(*queue.Job))
+		}, topicJobFinished)
+	}
+	if WebhookURL != "" || len(CallbackHosts) > 0 {
+		b.Subscribe("webhooks", func(e eventbus.Event) {
+			notifyJobFinished(e.Data.(*queue.Job))
+		}, topicJobFinished)
+	}
+	b.Subscribe("metrics", func(e eventbus.Event) {
+		stats.observe(e.Topic, e.Data.(*queue.Job))
+	}, topicJobFinished, topicJobStalled)
+
+	// Commands are audited as they're run, but a job can also be canceled by
+	// its timeout or a shutdown, which no command asked for
+	b.Subscribe("audit", func(e eventbus.Event) {
+		var j = e.Data.(*queue.Job)
+		if j.Status() == queue.StatusCanceled {
+			slog.Warn("Job canceled", "audit", true, "job", j.ID(), "name", j.Name(), "reason", j.Error())
+		}
+	}, topicJobFinished)
+}
+
+// queueHooks returns the queue's hooks, which publish to Events
+func queueHooks() queue.Hooks {
+	var publish = func(topic string) func(*queue.Job) {
+		return func(j *queue.Job) { Events.Publish(topic, j) }
+	}
+	return queue.Hooks{
+		Queued:   publish(topicJobQueued),
+		Started:  publish(topicJobStarted),
+		Finished: publish(topicJobFinished),
+		Stalled:  publish(topicJobStalled),
+		Progress: func(j *queue.Job, e queue.ProgressEvent) {
+			Events.Publish(topicJobProgress, jobProgress{job: j, event: e})
+		},
+	}
+}
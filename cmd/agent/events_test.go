@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+func TestQueueEvents(t *testing.T) {
+	var origEvents, origStats, origChanges = Events, JobStats, Changes
+	defer func() { Events, JobStats, Changes = origEvents, origStats, origChanges }()
+	JobStats, Changes = &jobCounter{finished: make(map[queue.JobStatus]int64)}, newChangeJournal()
+	Events = newEventBus()
+	subscribeBackground(Events, JobStats)
+
+	var q = queue.New(queue.CommandRunner{Path: "/bin/false"})
+	q.SetHooks(queueHooks())
+	q.NewJob("doomed", []string{"load_titles", "/tmp/marc"}).Run(context.Background())
+	q.NewFuncJob("fine", func(_ context.Context, j *queue.Job) error {
+		j.AddProgress(queue.ProgressEvent{Done: 1, Total: 1, Message: "Record 1 of 1"})
+		return nil
+	}).Run(context.Background())
+
+	// Closing the bus waits for the background subscribers to catch up
+	Events.Close()
+	var summary = JobStats.summary()
+	var finished = summary["finished"].(map[queue.JobStatus]int64)
+	if finished[queue.StatusFailed] != 1 || finished[queue.StatusSuccessful] != 1 {
+		t.Errorf("Expected one failed and one successful job, got %v", finished)
+	}
+
+	var stats = Events.Stats()
+	if stats["changes"].Delivered != 5 || stats["metrics"].Delivered != 2 || stats["metrics"].Pending != 0 {
+		t.Errorf("Unexpected subscriber stats: %#v", stats)
+	}
+	var err = checkResponse("metrics", respond(StatusSuccess, "", H{"commands": H{}, "db": H{}, "jobs": summary, "events": stats}))
+	if err != nil {
+		t.Errorf("Metrics don't match their schema: %s", err)
+	}
+}
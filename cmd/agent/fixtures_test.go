@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/open-oni/oni-agent/internal/batchxml"
+)
+
+// fakeLookups stands in for ONI's database. Each lookup left nil finds
+// nothing.
+type fakeLookups struct {
+	batchAwardee  func(name string) (string, error)
+	familyBatches func(family string) ([]string, error)
+	titleBatches  func(lccn string) ([]string, error)
+	issues        func(lccn string) ([]titleIssue, error)
+	pages         func(name string) ([]snapshotPage, error)
+}
+
+// useLookups has commands use f in place of the database until the test ends
+func useLookups(t *testing.T, f fakeLookups) {
+	var orig = lookups
+	t.Cleanup(func() { lookups = orig })
+	lookups = f
+}
+
+func (f fakeLookups) loadedBatchAwardee(name string) (string, error) {
+	if f.batchAwardee == nil {
+		return "", nil
+	}
+	return f.batchAwardee(name)
+}
+
+func (f fakeLookups) loadedFamilyBatches(_ context.Context, family string) ([]string, error) {
+	if f.familyBatches == nil {
+		return nil, nil
+	}
+	return f.familyBatches(family)
+}
+
+func (f fakeLookups) loadedTitleBatches(_ context.Context, lccn string) ([]string, error) {
+	if f.titleBatches == nil {
+		return nil, nil
+	}
+	return f.titleBatches(lccn)
+}
+
+func (f fakeLookups) titleIssues(_ context.Context, lccn string) ([]titleIssue, error) {
+	if f.issues == nil {
+		return nil, nil
+	}
+	return f.issues(lccn)
+}
+
+func (f fakeLookups) snapshotPages(_ context.Context, name string) ([]snapshotPage, error) {
+	if f.pages == nil {
+		return nil, nil
+	}
+	return f.pages(name)
+}
+
+// testBatch describes a batch for writeBatch to put on disk. The awardee
+// defaults to "oru" and the award year to "2024".
+type testBatch struct {
+	awardee string
+	year    string
+	issues  []testIssue
+}
+
+// testIssue is one issue of a testBatch. Its METS file is named for the date
+// and edition, e.g., sn83025138/1902112201/1902112201.xml, and holds an empty
+// METS document unless files says otherwise. files holds any other files in
+// the issue's directory, by name.
+type testIssue struct {
+	lccn    string
+	date    string
+	edition string
+	files   map[string]string
+}
+
+// issuesOn returns an issue of sn00000001 for each date. Dates are first
+// editions unless they end in an edition, e.g., "1902-02-01_02".
+func issuesOn(dates ...string) []testIssue {
+	var list []testIssue
+	for _, d := range dates {
+		var day, ed, ok = strings.Cut(d, "_")
+		if !ok {
+			ed = "01"
+		}
+		list = append(list, testIssue{lccn: "sn00000001", date: day, edition: ed})
+	}
+	return list
+}
+
+// writeBatch is the one way tests put a batch on disk: it writes b's
+// batch.xml and issue files into dir, returning the batch as written
+func writeBatch(t *testing.T, dir string, b testBatch) *batchxml.Batch {
+	t.Helper()
+	if b.awardee == "" {
+		b.awardee = "oru"
+	}
+	if b.year == "" {
+		b.year = "2024"
+	}
+
+	var batch = &batchxml.Batch{Name: filepath.Base(dir), Awardee: b.awardee, AwardYear: b.year}
+	var err = os.MkdirAll(batchxml.DataDir(dir), 0755)
+	for _, ti := range b.issues {
+		var de = strings.ReplaceAll(ti.date, "-", "") + ti.edition
+		var i = &batchxml.Issue{LCCN: ti.lccn, IssueDate: ti.date, EditionOrder: ti.edition, Filepath: ti.lccn + "/" + de + "/" + de + ".xml"}
+		batch.Issues = append(batch.Issues, i)
+
+		var files = map[string]string{de + ".xml": "<mets/>"}
+		for name, content := range ti.files {
+			files[name] = content
+		}
+		if err == nil {
+			err = os.MkdirAll(i.Dir(dir), 0755)
+		}
+		for name, content := range files {
+			if err == nil {
+				err = os.WriteFile(filepath.Join(i.Dir(dir), name), []byte(content), 0644)
+			}
+		}
+	}
+
+	var data []byte
+	if err == nil {
+		data, err = batch.Marshal()
+	}
+	if err == nil {
+		err = os.WriteFile(batchxml.XMLPath(dir), data, 0644)
+	}
+	if err != nil {
+		t.Fatalf("Unable to write test batch %s: %s", dir, err)
+	}
+	return batch
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// frozenStateFile is the state file listing frozen batches
+const frozenStateFile = "frozen_batches.json"
+
+// overrideFreezeFlag lets an admin purge a frozen batch anyway
+const overrideFreezeFlag = "--override-freeze"
+
+// freezeRecord says who froze a batch, when, and why
+type freezeRecord struct {
+	FrozenBy string    `json:"frozen_by"`
+	Frozen   time.Time `json:"frozen"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// freezeMu serializes reads and writes of the frozen batch list
+var freezeMu sync.Mutex
+
+// readFrozenBatches returns every frozen batch keyed by name. Without a state
+// dir nothing can be frozen, so the list is always empty.
+func readFrozenBatches() (map[string]*freezeRecord, error) {
+	var frozen = make(map[string]*freezeRecord)
+	if State == nil {
+		return frozen, nil
+	}
+	var _, err = State.Read(frozenStateFile, &frozen)
+	return frozen, err
+}
+
+// batchFrozen returns the freeze record for a batch, or nil if it isn't
+// frozen
+func batchFrozen(name string) (*freezeRecord, error) {
+	freezeMu.Lock()
+	defer freezeMu.Unlock()
+	var frozen, err = readFrozenBatches()
+	if err != nil {
+		return nil, fmt.Errorf("reading frozen batches: %w", err)
+	}
+	return frozen[name], nil
+}
+
+// setBatchFrozen adds or removes a batch's freeze marker. It returns the
+// previous record, if any.
+func setBatchFrozen(name string, rec *freezeRecord) (*freezeRecord, error) {
+	freezeMu.Lock()
+	defer freezeMu.Unlock()
+	var frozen, err = readFrozenBatches()
+	if err != nil {
+		return nil, err
+	}
+	var prev = frozen[name]
+	if rec == nil {
+		delete(frozen, name)
+	} else {
+		frozen[name] = rec
+	}
+	return prev, State.Write(frozenStateFile, frozen)
+}
+
+func freezeBatch(r *request, name, reason string) response {
+	if State == nil {
+		return respond(StatusError, "Freezing batches requires STATE_DIR to be configured", nil)
+	}
+	if !batchNameRegexp.MatchString(name) {
+		return respond(StatusError, fmt.Sprintf("%q is not a valid batch name", name), nil)
+	}
+
+	var rec = &freezeRecord{FrozenBy: r.user, Frozen: time.Now(), Reason: reason}
+	var prev, err = setBatchFrozen(name, rec)
+	if err != nil {
+		r.logError("Unable to freeze batch", "batch", name, "error", err)
+		return respond(StatusError, fmt.Sprintf("%q cannot be frozen", name), H{"error": err.Error()})
+	}
+	r.logInfo("Batch frozen", "batch", name, "user", r.user, "reason", reason)
+	Changes.add(changeBatch, "frozen", name, H{"user": r.user, "reason": reason})
+	var msg = "Batch frozen: it cannot be purged until it's unfrozen"
+	if prev != nil {
+		msg = "Batch was already frozen; the freeze has been updated"
+	}
+	return respond(StatusSuccess, msg, H{"batch": name, "freeze": rec})
+}
+
+func unfreezeBatch(r *request, name string) response {
+	if State == nil {
+		return respond(StatusError, "Freezing batches requires STATE_DIR to be configured", nil)
+	}
+	var prev, err = setBatchFrozen(name, nil)
+	if err != nil {
+		r.logError("Unable to unfreeze batch", "batch", name, "error", err)
+		return respond(StatusError, fmt.Sprintf("%q cannot be unfrozen", name), H{"error": err.Error()})
+	}
+	if prev == nil {
+		return respond(StatusSuccess, "Batch was not frozen", H{"batch": name})
+	}
+	r.logInfo("Batch unfrozen", "batch", name, "user", r.user, "frozenBy", prev.FrozenBy)
+	Changes.add(changeBatch, "unfrozen", name, H{"user": r.user})
+	return respond(StatusSuccess, "Batch unfrozen", H{"batch": name, "previous_freeze": prev})
+}
+
+func listFrozenBatches() response {
+	freezeMu.Lock()
+	var frozen, err = readFrozenBatches()
+	freezeMu.Unlock()
+	if err != nil {
+		return respond(StatusError, "Unable to read frozen batches", H{"error": err.Error()})
+	}
+
+	var list = []H{}
+	for name, rec := range frozen {
+		list = append(list, H{"name": name, "frozen_by": rec.FrozenBy, "frozen": rec.Frozen, "reason": rec.Reason})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i]["name"].(string) < list[j]["name"].(string) })
+	return respond(StatusSuccess, "", H{"batches": list})
+}
+
+// checkFrozen refuses to go on with a destructive command on a frozen batch,
+// unless an admin explicitly overrides the freeze. ok is false when resp
+// should be returned instead.
+func checkFrozen(r *request, name string, override bool) (resp response, ok bool) {
+	var rec, err = batchFrozen(name)
+	if err != nil {
+		return respond(StatusError, fmt.Sprintf("%q cannot be purged", name), H{"error": err.Error()}), false
+	}
+	if rec == nil {
+		return resp, true
+	}
+	if !override {
+		return respond(StatusError, fmt.Sprintf("%q is frozen and cannot be purged", name), H{"freeze": rec}), false
+	}
+	if !AdminUsers[r.user] {
+		return respond(StatusError, fmt.Sprintf("%s requires the admin capability", overrideFreezeFlag), H{"freeze": rec}), false
+	}
+	slog.Warn("Batch freeze overridden", "audit", true, "sessionID", r.id, "user", r.user, "command", r.command, "batch", name, "frozenBy", rec.FrozenBy)
+	return resp, true
+}
+
+func init() {
+	register("freeze-batch", func(r *request) response {
+		if len(r.args) < 1 {
+			return respond(StatusError, fmt.Sprintf("%q requires a batch name, optionally followed by a reason", r.command), nil)
+		}
+		return freezeBatch(r, r.args[0], strings.Join(r.args[1:], " "))
+	})
+	register("unfreeze-batch", func(r *request) response {
+		if len(r.args) != 1 {
+			return respond(StatusError, fmt.Sprintf("%q requires exactly one batch name", r.command), nil)
+		}
+		return unfreezeBatch(r, r.args[0])
+	})
+	register("frozen-batches", func(_ *request) response {
+		return listFrozenBatches()
+	})
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/open-oni/oni-agent/internal/state"
+)
+
+func TestFreezeBatch(t *testing.T) {
+	var err error
+	State, err = state.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Unable to open state dir: %s", err)
+	}
+	var origAdmins = AdminUsers
+	defer func() { State, AdminUsers = nil, origAdmins }()
+	AdminUsers = map[string]bool{"ops": true}
+
+	const name = "batch_oru_legal_ver01"
+	var resp = dispatch(&request{command: "freeze-batch", args: []string{name, "court", "order"}, user: "nca"})
+	if resp.status != StatusSuccess || resp.data["freeze"].(*freezeRecord).Reason != "court order" {
+		t.Fatalf("Expected the batch to be frozen, got %#v", resp)
+	}
+
+	resp = dispatch(&request{command: "purge-batch", args: []string{name}, user: "ops"})
+	if resp.status != StatusError || !strings.Contains(resp.message, "frozen") {
+		t.Fatalf("Expected the purge to be refused, got %#v", resp)
+	}
+	resp = dispatch(&request{command: "purge-batch", args: []string{name, overrideFreezeFlag}, user: "nca"})
+	if resp.status != StatusError || !strings.Contains(resp.message, "admin") {
+		t.Fatalf("Expected a non-admin override to be refused, got %#v", resp)
+	}
+	if _, ok := checkFrozen(&request{command: "purge-batch", user: "ops"}, name, true); !ok {
+		t.Fatal("Expected an admin to be able to override the freeze")
+	}
+	if _, ok := checkFrozen(&request{command: "purge-batch", user: "nca"}, "batch_oru_other_ver01", false); !ok {
+		t.Fatal("Expected an unfrozen batch to be purgeable")
+	}
+
+	resp = listFrozenBatches()
+	if list := resp.data["batches"].([]H); len(list) != 1 || list[0]["name"] != name || list[0]["frozen_by"] != "nca" {
+		t.Fatalf("Expected one frozen batch, got %#v", resp)
+	}
+
+	resp = dispatch(&request{command: "unfreeze-batch", args: []string{name}, user: "nca"})
+	if resp.status != StatusError {
+		t.Fatalf("Expected a non-admin unfreeze to be refused, got %#v", resp)
+	}
+	resp = dispatch(&request{command: "unfreeze-batch", args: []string{name}, user: "ops"})
+	if resp.status != StatusSuccess || resp.data["previous_freeze"] == nil {
+		t.Fatalf("Expected the batch to be unfrozen, got %#v", resp)
+	}
+	if rec, _ := batchFrozen(name); rec != nil {
+		t.Fatalf("Expected no freeze, got %#v", rec)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/open-oni/oni-agent/pkg/queue"
+	"github.com/open-oni/oni-agent/proto/agentpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	_ "google.golang.org/grpc/encoding/gzip" // lets clients request gzipped responses
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcServer exposes the command registry over gRPC
+type grpcServer struct {
+	agentpb.UnimplementedAgentServer
+}
+
+// Run implements agentpb.AgentServer by dispatching to the same command
+// registry the SSH server uses
+func (g *grpcServer) Run(ctx context.Context, in *agentpb.CommandRequest) (*agentpb.CommandResponse, error) {
+	var r = grpcRequest(ctx, in.GetCommand(), in.GetArgs())
+	r.payload = func() ([]byte, error) { return in.GetPayload(), nil }
+	if r.command == "" {
+		return nil, status.Error(codes.InvalidArgument, "no command specified")
+	}
+	var err error
+	r.callback, err = grpcCallback(ctx)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// Run is a unary RPC, so streamed results are sent as a single document
+	var resp = dispatch(r).collect()
+	var b []byte
+	b, err = resp.JSON(r.id)
+	if err != nil {
+		r.logError("Cannot marshal response", "error", err, "data", resp.data)
+		return nil, status.Error(codes.Internal, "unable to marshal response")
+	}
+
+	return &agentpb.CommandResponse{Status: string(resp.status), Message: resp.message, Json: string(b)}, nil
+}
+
+// grpcRequest builds the request for a gRPC call from its peer: the user is
+// the client certificate's common name
+func grpcRequest(ctx context.Context, command string, args []string) *request {
+	var source = "unknown"
+	var r = &request{id: sessionID.Add(1), ctx: ctx, command: command, args: args}
+	if p, ok := peer.FromContext(ctx); ok {
+		source = p.Addr.String()
+		r.user = grpcUser(p)
+		r.source = sourceAddr(p.Addr)
+		if r.user != "" {
+			r.client = "cert:" + r.user
+		}
+	}
+	r.logInfo("gRPC request received", "source", source, "command", r.command, "args", r.args)
+	return r
+}
+
+// grpcCallbackKey is the request metadata gRPC clients use for what SSH
+// clients send with --callback
+const grpcCallbackKey = "callback-url"
+
+// grpcCallback returns the callback URL in the request's metadata, if any
+func grpcCallback(ctx context.Context) (string, error) {
+	var md, _ = metadata.FromIncomingContext(ctx)
+	var list = md.Get(grpcCallbackKey)
+	if len(list) == 0 {
+		return "", nil
+	}
+	if len(list) > 1 {
+		return "", fmt.Errorf("%s may only be given once", grpcCallbackKey)
+	}
+	var err = validateCallback(list[0])
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", grpcCallbackKey, err)
+	}
+	return list[0], nil
+}
+
+// grpcUser returns the common name from the peer's verified client
+// certificate, if there is one
+func grpcUser(p *peer.Peer) string {
+	var info, ok = p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return info.State.VerifiedChains[0][0].Subject.CommonName
+}
+
+// FollowJobLogs implements agentpb.AgentServer, polling the job for new
+// output until it finishes. Finding the job goes through the middleware as a
+// job-logs request, so the same users, addresses, and rate limit apply.
+func (g *grpcServer) FollowJobLogs(in *agentpb.FollowJobLogsRequest, stream grpc.ServerStreamingServer[agentpb.LogLine]) error {
+	var r = grpcRequest(stream.Context(), "job-logs", []string{strconv.FormatInt(in.GetJobId(), 10)})
+	var j *queue.Job
+	var looked, found bool
+	var resp = chain(func(r *request) response {
+		var resp response
+		looked = true
+		j, resp, found = getJob(r.args[0])
+		if found {
+			// The middleware sees what job-logs itself would have returned
+			return getJobLogs(r.args[0], logFilter{})
+		}
+		return resp
+	})(r)
+	switch {
+	case found:
+	case looked:
+		return status.Error(codes.NotFound, resp.message)
+	case resp.data["retry_after_seconds"] != nil:
+		return status.Error(codes.ResourceExhausted, resp.message)
+	default:
+		return status.Error(codes.PermissionDenied, resp.message)
+	}
+
+	var send = func(name string, lines []string) error {
+		for _, line := range lines {
+			var err = stream.Send(&agentpb.LogLine{Stream: name, Line: line})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var nOut, nErr int
+	for {
+		// Check for completion before reading so we never miss the final lines
+		var finished = j.Finished()
+		var out, errs []string
+		if finished {
+			out, errs = j.Stdout(), j.Stderr()
+			if nOut < len(out) {
+				out = out[nOut:]
+			} else {
+				out = nil
+			}
+			if nErr < len(errs) {
+				errs = errs[nErr:]
+			} else {
+				errs = nil
+			}
+		} else {
+			out, errs = j.StdoutSince(nOut), j.StderrSince(nErr)
+		}
+
+		var err = send("stdout", out)
+		if err == nil {
+			err = send("stderr", errs)
+		}
+		if err != nil {
+			return err
+		}
+		nOut += len(out)
+		nErr += len(errs)
+
+		if finished {
+			return nil
+		}
+
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// grpcConfig holds the settings needed to serve gRPC with mutual TLS
+type grpcConfig struct {
+	bind     string
+	certFile string
+	keyFile  string
+	caFile   string
+}
+
+// tlsConfig builds a TLS config which requires client certificates signed by
+// the configured CA
+func (c grpcConfig) tlsConfig() (*tls.Config, error) {
+	var cert, err = tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading server certificate: %w", err)
+	}
+
+	var ca []byte
+	ca, err = os.ReadFile(c.caFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading client CA file: %w", err)
+	}
+	var pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("client CA file contains no valid certificates")
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// serveGRPC starts the gRPC server, returning it so the caller can stop it on
+// shutdown. Serving happens in the background.
+func serveGRPC(c grpcConfig) (*grpc.Server, error) {
+	var tc, err = c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	var l net.Listener
+	l, err = net.Listen("tcp", c.bind)
+	if err != nil {
+		return nil, fmt.Errorf("listening on %q: %w", c.bind, err)
+	}
+
+	var srv = grpc.NewServer(grpc.Creds(credentials.NewTLS(tc)))
+	agentpb.RegisterAgentServer(srv, &grpcServer{})
+	go func() {
+		var err = srv.Serve(l)
+		if err != nil {
+			slog.Error("gRPC server stopped", "error", err)
+		}
+	}()
+
+	return srv, nil
+}
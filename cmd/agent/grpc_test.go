@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/open-oni/oni-agent/internal/version"
+	"github.com/open-oni/oni-agent/pkg/queue"
+	"github.com/open-oni/oni-agent/proto/agentpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func getGRPCClient(t *testing.T) agentpb.AgentClient {
+	var l = bufconn.Listen(1 << 20)
+	var srv = grpc.NewServer()
+	agentpb.RegisterAgentServer(srv, &grpcServer{})
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+
+	var dialer = func(context.Context, string) (net.Conn, error) { return l.Dial() }
+	var conn, err = grpc.NewClient("passthrough:///bufnet", grpc.WithContextDialer(dialer), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Unable to create gRPC client: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return agentpb.NewAgentClient(conn)
+}
+
+func TestGRPCRun(t *testing.T) {
+	var c = getGRPCClient(t)
+
+	var resp, err = c.Run(context.Background(), &agentpb.CommandRequest{Command: "version"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if resp.Status != string(StatusSuccess) {
+		t.Fatalf("Expected success, got %q", resp.Status)
+	}
+
+	var data map[string]any
+	err = json.Unmarshal([]byte(resp.Json), &data)
+	if err != nil {
+		t.Fatalf("Invalid JSON %q: %s", resp.Json, err)
+	}
+	if data["version"] != version.Version {
+		t.Errorf("Expected version %q, got %#v", version.Version, data["version"])
+	}
+
+	resp, err = c.Run(context.Background(), &agentpb.CommandRequest{Command: "not-a-command"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if resp.Status != string(StatusError) {
+		t.Fatalf("Expected error status for invalid command, got %q", resp.Status)
+	}
+}
+
+func TestGRPCFollowJobLogs(t *testing.T) {
+	var c = getGRPCClient(t)
+	JobRunner = queue.New(queue.CommandRunner{Path: "/bin/false"})
+	var j = JobRunner.NewFuncJob("logger", func(_ context.Context, j *queue.Job) error {
+		j.Logf("hello")
+		return nil
+	})
+	var err = j.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Unable to run job: %s", err)
+	}
+
+	var follow = func() ([]*agentpb.LogLine, error) {
+		var stream, err = c.FollowJobLogs(context.Background(), &agentpb.FollowJobLogsRequest{JobId: j.ID()})
+		if err != nil {
+			return nil, err
+		}
+		var lines []*agentpb.LogLine
+		for {
+			var line, err = stream.Recv()
+			if err == io.EOF {
+				return lines, nil
+			}
+			if err != nil {
+				return lines, err
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	var lines []*agentpb.LogLine
+	lines, err = follow()
+	if err != nil || len(lines) != 1 || !strings.HasSuffix(lines[0].Line, "hello") {
+		t.Fatalf("Expected the job's log line, got %v (%v)", lines, err)
+	}
+
+	// Following logs is refused for users who couldn't run job-logs. The test
+	// client has no certificate, so its user is empty.
+	RestrictedUsers[""] = true
+	defer delete(RestrictedUsers, "")
+	lines, err = follow()
+	if status.Code(err) != codes.PermissionDenied || len(lines) != 0 {
+		t.Fatalf("Expected a restricted user to be refused, got %v (%v)", lines, err)
+	}
+}
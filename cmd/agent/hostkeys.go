@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/ssh"
+)
+
+// Key types the agent can generate
+const (
+	keyTypeED25519 = "ed25519"
+	keyTypeRSA     = "rsa"
+)
+
+// hostKey is a single ssh host key and the file it came from
+type hostKey struct {
+	file   string
+	signer ssh.Signer
+}
+
+// splitList splits a comma-separated env var, dropping empty items
+func splitList(val string) []string {
+	var list []string
+	for _, item := range strings.Split(val, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// hostKeyPassphrase is the passphrase for encrypted host keys, and where it
+// came from, so errors can say which setting to fix
+type hostKeyPassphrase struct {
+	value  []byte
+	source string
+}
+
+// hostKeyCredential is the systemd credential name the passphrase is read
+// from, e.g., via "LoadCredential=host-key-passphrase:/etc/oni-agent/pass"
+const hostKeyCredential = "host-key-passphrase"
+
+// readHostKeyPassphrase finds the host key passphrase: HOST_KEY_PASSPHRASE,
+// then the file named by HOST_KEY_PASSPHRASE_FILE, then the systemd
+// credential. A single trailing newline is dropped from files. It returns a
+// zero hostKeyPassphrase if none is configured.
+func readHostKeyPassphrase(env, file, credentialsDir string) (hostKeyPassphrase, error) {
+	if env != "" && file != "" {
+		return hostKeyPassphrase{}, errors.New("set only one of HOST_KEY_PASSPHRASE and HOST_KEY_PASSPHRASE_FILE")
+	}
+	if env != "" {
+		return hostKeyPassphrase{value: []byte(env), source: "HOST_KEY_PASSPHRASE"}, nil
+	}
+
+	var source = "HOST_KEY_PASSPHRASE_FILE"
+	if file == "" && credentialsDir != "" {
+		file = filepath.Join(credentialsDir, hostKeyCredential)
+		source = fmt.Sprintf("systemd credential %q", hostKeyCredential)
+		if _, err := agentFS.Stat(file); os.IsNotExist(err) {
+			return hostKeyPassphrase{}, nil
+		}
+	}
+	if file == "" {
+		return hostKeyPassphrase{}, nil
+	}
+
+	var data, err = afero.ReadFile(agentFS, file)
+	if err != nil {
+		return hostKeyPassphrase{}, fmt.Errorf("reading host key passphrase from %s: %w", source, err)
+	}
+	data = bytes.TrimSuffix(bytes.TrimSuffix(data, []byte("\n")), []byte("\r"))
+	if len(data) == 0 {
+		return hostKeyPassphrase{}, fmt.Errorf("host key passphrase from %s is empty", source)
+	}
+	return hostKeyPassphrase{value: data, source: source}, nil
+}
+
+// readHostKeys reads (or generates) every host key file. The ssh server only
+// presents one key per algorithm, so a rotation needs the old and new keys to
+// be of different types, e.g., an old RSA key alongside a new ed25519 key.
+// Encrypted keys are decrypted with pass, and if pass is set, generated keys
+// are encrypted with it.
+func readHostKeys(files []string, keyType string, pass hostKeyPassphrase) ([]hostKey, error) {
+	var keys []hostKey
+	var seen = make(map[string]string)
+	for _, fname := range files {
+		var signer, err = readKey(fname, keyType, pass)
+		if err != nil {
+			return nil, fmt.Errorf("host key file %q is invalid or cannot be read: %w", fname, err)
+		}
+
+		var algo = signer.PublicKey().Type()
+		if seen[algo] != "" {
+			return nil, fmt.Errorf("host key files %q and %q are both %s keys: only one key of each type can be presented", seen[algo], fname, algo)
+		}
+		seen[algo] = fname
+		keys = append(keys, hostKey{file: fname, signer: signer})
+	}
+	return keys, nil
+}
+
+func readKey(keyfile, keyType string, pass hostKeyPassphrase) (ssh.Signer, error) {
+	var data, err = afero.ReadFile(agentFS, keyfile)
+	if os.IsNotExist(err) {
+		slog.Warn("Host key file doesn't exist; creating it with a random key", "path", keyfile, "type", keyType, "encrypted", pass.value != nil)
+		return generateKey(keyfile, keyType, pass)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading file: %w", err)
+	}
+
+	var signer ssh.Signer
+	signer, err = ssh.ParsePrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		if err == nil && pass.value != nil {
+			slog.Warn("Host key file isn't encrypted, though a passphrase is configured", "path", keyfile)
+		}
+		return signer, err
+	}
+
+	if pass.value == nil {
+		return nil, fmt.Errorf("key is encrypted: set HOST_KEY_PASSPHRASE or HOST_KEY_PASSPHRASE_FILE, or pass a %q systemd credential", hostKeyCredential)
+	}
+	signer, err = ssh.ParsePrivateKeyWithPassphrase(data, pass.value)
+	if errors.Is(err, x509.IncorrectPasswordError) {
+		return nil, fmt.Errorf("the passphrase from %s doesn't decrypt this key", pass.source)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decrypting key with the passphrase from %s: %w", pass.source, err)
+	}
+	return signer, nil
+}
+
+func writeKeyFiles(priv, pub []byte, filename string) error {
+	var err = afero.WriteFile(agentFS, filename, priv, 0600)
+	if err != nil {
+		return fmt.Errorf("writing private key to %q: %w", filename, err)
+	}
+
+	filename += ".pub"
+	err = afero.WriteFile(agentFS, filename, pub, 0644)
+	if err != nil {
+		return fmt.Errorf("writing public key to %q: %w", filename, err)
+	}
+
+	return nil
+}
+
+func generateKey(filename, keyType string, pass hostKeyPassphrase) (ssh.Signer, error) {
+	var key crypto.Signer
+	var priv, pub []byte
+	var err error
+
+	switch keyType {
+	case keyTypeRSA:
+		var rsaKey *rsa.PrivateKey
+		rsaKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, fmt.Errorf("generating key: %w", err)
+		}
+		key = rsaKey
+		priv = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+		pub = pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey)})
+
+	case keyTypeED25519:
+		var edKey ed25519.PrivateKey
+		_, edKey, err = ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("generating key: %w", err)
+		}
+		key = edKey
+
+		var block *pem.Block
+		block, err = ssh.MarshalPrivateKey(edKey, "oni-agent host key")
+		if err != nil {
+			return nil, fmt.Errorf("encoding key: %w", err)
+		}
+		priv = pem.EncodeToMemory(block)
+
+	default:
+		return nil, fmt.Errorf("unknown key type %q", keyType)
+	}
+
+	// Encrypted keys of either type are written in OpenSSH's format, which
+	// is the one ssh-keygen can decrypt and re-encrypt
+	if pass.value != nil {
+		var block, err = ssh.MarshalPrivateKeyWithPassphrase(key, "oni-agent host key", pass.value)
+		if err != nil {
+			return nil, fmt.Errorf("encrypting key: %w", err)
+		}
+		priv = pem.EncodeToMemory(block)
+	}
+
+	var signer ssh.Signer
+	signer, err = ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// ed25519 public keys are written in authorized_keys / known_hosts format,
+	// which is what admins actually need to distribute
+	if pub == nil {
+		pub = ssh.MarshalAuthorizedKey(signer.PublicKey())
+	}
+
+	err = writeKeyFiles(priv, pub, filename)
+	if err != nil {
+		return nil, fmt.Errorf("writing key files: %w", err)
+	}
+
+	return signer, nil
+}
+
+// getHostKeyInfo returns the type and fingerprints of every host key, so
+// admins can verify what clients should see during a rotation
+func getHostKeyInfo() response {
+	var keys = []H{}
+	for _, k := range HostKeys {
+		var pub = k.signer.PublicKey()
+		keys = append(keys, H{
+			"file":               k.file,
+			"type":               pub.Type(),
+			"fingerprint_sha256": ssh.FingerprintSHA256(pub),
+			"fingerprint_md5":    ssh.FingerprintLegacyMD5(pub),
+			"public_key":         strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))),
+		})
+	}
+	return respond(StatusSuccess, "", H{"host_keys": keys})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReadHostKeys(t *testing.T) {
+	var dir = t.TempDir()
+	var rsaFile = filepath.Join(dir, "old_rsa")
+	var edFile = filepath.Join(dir, "new_ed25519")
+
+	// Files that don't exist are generated with the given type
+	var _, err = readHostKeys([]string{rsaFile}, keyTypeRSA, hostKeyPassphrase{})
+	if err != nil {
+		t.Fatalf("Unable to generate RSA key: %s", err)
+	}
+	var first []hostKey
+	first, err = readHostKeys([]string{rsaFile, edFile}, keyTypeED25519, hostKeyPassphrase{})
+	if err != nil {
+		t.Fatalf("Unable to read or generate keys: %s", err)
+	}
+
+	var types []string
+	for _, k := range first {
+		types = append(types, k.signer.PublicKey().Type())
+	}
+	if diff := cmp.Diff([]string{"ssh-rsa", "ssh-ed25519"}, types); diff != "" {
+		t.Fatalf("Unexpected key types: %s", diff)
+	}
+
+	// Reading again must give the same keys, not new ones
+	var second []hostKey
+	second, err = readHostKeys([]string{edFile}, keyTypeED25519, hostKeyPassphrase{})
+	if err != nil {
+		t.Fatalf("Unable to re-read key: %s", err)
+	}
+	if string(second[0].signer.PublicKey().Marshal()) != string(first[1].signer.PublicKey().Marshal()) {
+		t.Errorf("Re-reading the ed25519 key gave a different key")
+	}
+
+	// Two keys of the same type can't both be presented
+	_, err = readHostKeys([]string{edFile, filepath.Join(dir, "another_ed25519")}, keyTypeED25519, hostKeyPassphrase{})
+	if err == nil {
+		t.Errorf("Expected an error for two keys of the same type")
+	}
+}
+
+func TestEncryptedHostKeys(t *testing.T) {
+	var dir = t.TempDir()
+	var pass = hostKeyPassphrase{value: []byte("correct horse"), source: "HOST_KEY_PASSPHRASE"}
+
+	// Keys generated while a passphrase is set are encrypted with it
+	for _, keyType := range []string{keyTypeED25519, keyTypeRSA} {
+		var fname = filepath.Join(dir, keyType)
+		var keys, err = readHostKeys([]string{fname}, keyType, pass)
+		if err != nil {
+			t.Fatalf("Unable to generate encrypted %s key: %s", keyType, err)
+		}
+
+		_, err = readHostKeys([]string{fname}, keyType, hostKeyPassphrase{})
+		if err == nil || !strings.Contains(err.Error(), "HOST_KEY_PASSPHRASE") {
+			t.Errorf("Expected %s key without a passphrase to say how to give one, got %v", keyType, err)
+		}
+
+		var wrong = hostKeyPassphrase{value: []byte("wrong"), source: "HOST_KEY_PASSPHRASE_FILE"}
+		_, err = readHostKeys([]string{fname}, keyType, wrong)
+		if err == nil || !strings.Contains(err.Error(), "passphrase from HOST_KEY_PASSPHRASE_FILE doesn't decrypt") {
+			t.Errorf("Expected %s key with the wrong passphrase to name its source, got %v", keyType, err)
+		}
+
+		var again []hostKey
+		again, err = readHostKeys([]string{fname}, keyType, pass)
+		if err != nil {
+			t.Fatalf("Unable to decrypt %s key: %s", keyType, err)
+		}
+		if string(again[0].signer.PublicKey().Marshal()) != string(keys[0].signer.PublicKey().Marshal()) {
+			t.Errorf("Decrypting the %s key gave a different key", keyType)
+		}
+	}
+}
+
+func TestReadHostKeyPassphrase(t *testing.T) {
+	var dir = t.TempDir()
+	var file = filepath.Join(dir, "pass")
+	var creds = filepath.Join(dir, "creds")
+	var err = os.WriteFile(file, []byte("from file\n"), 0600)
+	if err == nil {
+		err = os.Mkdir(creds, 0700)
+	}
+	if err == nil {
+		err = os.WriteFile(filepath.Join(creds, hostKeyCredential), []byte("from systemd"), 0600)
+	}
+	if err != nil {
+		t.Fatalf("Unable to write passphrase files: %s", err)
+	}
+
+	var tests = map[string]struct {
+		env, file, creds string
+		want             string
+		hasError         bool
+	}{
+		"none":          {},
+		"env":           {env: "from env", creds: creds, want: "from env"},
+		"file":          {file: file, creds: creds, want: "from file"},
+		"credential":    {creds: creds, want: "from systemd"},
+		"no credential": {creds: dir},
+		"both":          {env: "x", file: file, hasError: true},
+		"missing file":  {file: filepath.Join(dir, "nope"), hasError: true},
+	}
+	for name, tc := range tests {
+		var got, err = readHostKeyPassphrase(tc.env, tc.file, tc.creds)
+		if tc.hasError {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %q", name, got.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err)
+			continue
+		}
+		if string(got.value) != tc.want {
+			t.Errorf("%s: expected %q, got %q", name, tc.want, got.value)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+// ingestIssue is one loaded issue in an ingest report
+type ingestIssue struct {
+	Date    string
+	Edition int
+	Pages   int
+}
+
+// path returns the issue's ONI URL path
+func (i ingestIssue) path(lccn string) string {
+	return fmt.Sprintf("/lccn/%s/%s/ed-%d/", lccn, i.Date, i.Edition)
+}
+
+// ingestTitle is a title with issues in the batch
+type ingestTitle struct {
+	LCCN   string
+	Name   string
+	Issues []ingestIssue
+}
+
+// ingestReport is what a partner is told about a batch once it's live
+type ingestReport struct {
+	Batch       string
+	Awardee     string
+	AwardeeName string
+	Generated   time.Time
+	Issues      int
+	Pages       int
+	First, Last string
+	Titles      []ingestTitle
+}
+
+// summarizeIngest groups a batch's pages into titles and issues, sorted by
+// LCCN and then date and edition, and works out the totals and date range
+func summarizeIngest(pages []solrPage) ingestReport {
+	var r = ingestReport{Pages: len(pages)}
+
+	// An issue is identified by any of its pages, minus the sequence
+	var counts = make(map[solrPage]int)
+	var titles = make(map[string]*ingestTitle)
+	for _, p := range pages {
+		var issue = solrPage{LCCN: p.LCCN, Date: p.Date, Edition: p.Edition}
+		if counts[issue] == 0 {
+			var t = titles[p.LCCN]
+			if t == nil {
+				t = &ingestTitle{LCCN: p.LCCN}
+				titles[p.LCCN] = t
+			}
+			t.Issues = append(t.Issues, ingestIssue{Date: p.Date, Edition: p.Edition})
+			r.Issues++
+		}
+		counts[issue]++
+
+		if r.First == "" || p.Date < r.First {
+			r.First = p.Date
+		}
+		if p.Date > r.Last {
+			r.Last = p.Date
+		}
+	}
+
+	for _, t := range titles {
+		for i := range t.Issues {
+			t.Issues[i].Pages = counts[solrPage{LCCN: t.LCCN, Date: t.Issues[i].Date, Edition: t.Issues[i].Edition}]
+		}
+		sort.Slice(t.Issues, func(i, j int) bool {
+			if t.Issues[i].Date != t.Issues[j].Date {
+				return t.Issues[i].Date < t.Issues[j].Date
+			}
+			return t.Issues[i].Edition < t.Issues[j].Edition
+		})
+		r.Titles = append(r.Titles, *t)
+	}
+	sort.Slice(r.Titles, func(i, j int) bool { return r.Titles[i].LCCN < r.Titles[j].LCCN })
+	return r
+}
+
+// text renders the report for people. Links are made absolute with baseURL,
+// which may be empty, in which case they're just paths on the ONI site.
+func (r ingestReport) text(baseURL string) string {
+	var base = strings.TrimSuffix(baseURL, "/")
+	var b strings.Builder
+	fmt.Fprintf(&b, "Ingest report for %s\n", r.Batch)
+	if r.AwardeeName != "" {
+		fmt.Fprintf(&b, "Awardee: %s (%s)\n", r.AwardeeName, r.Awardee)
+	} else {
+		fmt.Fprintf(&b, "Awardee: %s\n", r.Awardee)
+	}
+	fmt.Fprintf(&b, "Generated: %s\n\n", r.Generated.UTC().Format("2006-01-02 15:04 MST"))
+
+	fmt.Fprintf(&b, "This batch is now live on the site.\n\n")
+	fmt.Fprintf(&b, "Issues: %d\nPages: %d\nDates: %s to %s\n", r.Issues, r.Pages, r.First, r.Last)
+	fmt.Fprintf(&b, "Batch: %s/batches/%s/\n", base, r.Batch)
+
+	for _, t := range r.Titles {
+		var name = t.Name
+		if name == "" {
+			name = t.LCCN
+		}
+		fmt.Fprintf(&b, "\n%s (%s), %s to %s\n", name, t.LCCN, t.Issues[0].Date, t.Issues[len(t.Issues)-1].Date)
+		fmt.Fprintf(&b, "  %s/lccn/%s/\n", base, t.LCCN)
+		for _, i := range t.Issues {
+			fmt.Fprintf(&b, "  %s%s (%d pages)\n", base, i.path(t.LCCN), i.Pages)
+		}
+	}
+	return b.String()
+}
+
+// buildIngestReport reads what ONI now has for a loaded batch. It uses the
+// primary, since it runs right after the load.
+func buildIngestReport(ctx context.Context, name string) (ingestReport, error) {
+	var pages, err = batchPages(ctx, name)
+	if err != nil {
+		return ingestReport{}, err
+	}
+	if len(pages) == 0 {
+		return ingestReport{}, fmt.Errorf("ONI has no pages for %q", name)
+	}
+
+	var r = summarizeIngest(pages)
+	r.Batch = name
+	r.Generated = time.Now()
+	err = dbPool.QueryRowContext(ctx, ONIDB.BatchAwardee, name).Scan(&r.Awardee)
+	if err != nil {
+		return r, fmt.Errorf("querying database: %w", err)
+	}
+	err = dbPool.QueryRowContext(ctx, ONIDB.AwardeeName, r.Awardee).Scan(&r.AwardeeName)
+	if err != nil {
+		return r, fmt.Errorf("querying database: %w", err)
+	}
+	for i := range r.Titles {
+		var t, _, err = findTitle(r.Titles[i].LCCN)
+		if err != nil {
+			return r, err
+		}
+		r.Titles[i].Name = t.Name
+	}
+	return r, nil
+}
+
+// runIngestReport returns the job which stores a batch's ingest report as an
+// artifact and emails it to the awardee's recipients, if there are any
+func runIngestReport(name string) queue.RunFunc {
+	return func(ctx context.Context, j *queue.Job) error {
+		var r, err = buildIngestReport(ctx, name)
+		if err != nil {
+			return err
+		}
+		var text = r.text(ONIURL)
+
+		var artifact = fmt.Sprintf("ingest-report-%s-%s.txt", name, r.Generated.UTC().Format("20060102T150405"))
+		err = Artifacts.Put(artifact, strings.NewReader(text))
+		if err != nil {
+			return fmt.Errorf("storing report: %w", err)
+		}
+		j.AddArtifact(artifact)
+		j.Logf("Report stored as artifact %q", artifact)
+
+		var to = IngestReportRecipients[r.Awardee]
+		if len(to) == 0 {
+			return nil
+		}
+		err = sendMail(to, fmt.Sprintf("%s is now live", name), text)
+		if err != nil {
+			return fmt.Errorf("emailing report to %s: %w", strings.Join(to, ", "), err)
+		}
+		j.Logf("Report emailed to %s", strings.Join(to, ", "))
+		return nil
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSummarizeIngest(t *testing.T) {
+	var pages = []solrPage{
+		{LCCN: "sn2", Date: "1900-01-02", Edition: 1, Sequence: 1},
+		{LCCN: "sn1", Date: "1901-05-01", Edition: 1, Sequence: 1},
+		{LCCN: "sn1", Date: "1901-05-01", Edition: 1, Sequence: 2},
+		{LCCN: "sn1", Date: "1901-05-01", Edition: 2, Sequence: 1},
+		{LCCN: "sn1", Date: "1899-12-31", Edition: 1, Sequence: 1},
+	}
+
+	var expected = ingestReport{
+		Issues: 4,
+		Pages:  5,
+		First:  "1899-12-31",
+		Last:   "1901-05-01",
+		Titles: []ingestTitle{
+			{LCCN: "sn1", Issues: []ingestIssue{
+				{Date: "1899-12-31", Edition: 1, Pages: 1},
+				{Date: "1901-05-01", Edition: 1, Pages: 2},
+				{Date: "1901-05-01", Edition: 2, Pages: 1},
+			}},
+			{LCCN: "sn2", Issues: []ingestIssue{{Date: "1900-01-02", Edition: 1, Pages: 1}}},
+		},
+	}
+	var diff = cmp.Diff(expected, summarizeIngest(pages))
+	if diff != "" {
+		t.Errorf("Unexpected report: %s", diff)
+	}
+}
+
+func TestIngestReportText(t *testing.T) {
+	var r = summarizeIngest([]solrPage{
+		{LCCN: "sn1", Date: "1900-01-01", Edition: 1, Sequence: 1},
+		{LCCN: "sn1", Date: "1900-01-01", Edition: 1, Sequence: 2},
+	})
+	r.Batch = "batch_foo_ver01"
+	r.Awardee = "foo"
+	r.AwardeeName = "Foo University"
+	r.Titles[0].Name = "The Daily Bugle"
+	r.Generated = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	var text = r.text("https://news.example.org/")
+	for _, want := range []string{
+		"Awardee: Foo University (foo)",
+		"Issues: 1\nPages: 2\nDates: 1900-01-01 to 1900-01-01\n",
+		"Batch: https://news.example.org/batches/batch_foo_ver01/",
+		"The Daily Bugle (sn1), 1900-01-01 to 1900-01-01\n",
+		"  https://news.example.org/lccn/sn1/1900-01-01/ed-1/ (2 pages)",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Expected report to contain %q, got:\n%s", want, text)
+		}
+	}
+}
+
+func TestReadReportRecipients(t *testing.T) {
+	var dir = t.TempDir()
+	var write = func(data string) string {
+		var fname = filepath.Join(dir, "recipients.json")
+		var err = os.WriteFile(fname, []byte(data), 0600)
+		if err != nil {
+			t.Fatalf("Unable to write recipients: %s", err)
+		}
+		return fname
+	}
+
+	var got, err = readReportRecipients(write(`{"foo": ["Ann <ann@example.org>", "ops@example.org"]}`))
+	if err != nil {
+		t.Fatalf("Unable to read recipients: %s", err)
+	}
+	var diff = cmp.Diff(map[string][]string{"foo": {"Ann <ann@example.org>", "ops@example.org"}}, got)
+	if diff != "" {
+		t.Errorf("Unexpected recipients: %s", diff)
+	}
+
+	for _, bad := range []string{`{"foo": []}`, `{"foo": ["not an address"]}`, `["ann@example.org"]`} {
+		_, err = readReportRecipients(write(bad))
+		if err == nil {
+			t.Errorf("Expected an error for %s", bad)
+		}
+	}
+}
+
+func TestBuildMessage(t *testing.T) {
+	var msg = string(buildMessage("ONI <oni@example.org>", []string{"ann@example.org"}, "batch_foo_ver01 is now live",
+		"line one\nline two\n", time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)))
+	for _, want := range []string{
+		"From: ONI <oni@example.org>\r\n",
+		"To: ann@example.org\r\n",
+		"Subject: batch_foo_ver01 is now live\r\n",
+		"Content-Type: text/plain; charset=utf-8\r\n\r\nline one\r\nline two\r\n",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("Expected message to contain %q, got %q", want, msg)
+		}
+	}
+}
@@ -12,7 +12,8 @@
 
 // trapIntTerm catches interrupt and termination signals to let processes exit
 // more cleanly.  A second signal of either type will immediately end the
-// process, however.
+// process, however.  quit runs in its own goroutine, since a graceful
+// shutdown can take a while and the second signal has to be caught meanwhile.
 func trapIntTerm(quit func()) {
 	var sigInt = make(chan os.Signal, 1)
 	signal.Notify(sigInt, syscall.SIGINT)
@@ -26,7 +27,7 @@ func trapIntTerm(quit func()) {
 
 			slog.Info("Interrupt detected; attempting to clean up.  Another signal will immediately end the process.")
 			atomic.StoreInt32(&isDone, 1)
-			quit()
+			go quit()
 		}
 	}()
 }
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/open-oni/oni-agent/internal/batchxml"
+	"github.com/open-oni/oni-agent/internal/issuekey"
+)
+
+// findIssueMETS returns the path to the issue METS file in dir, along with
+// its parsed data. NDNP names the METS after its directory, so that's tried
+// first; otherwise every XML file is checked, since OCR files are XML too.
+func findIssueMETS(dir string) (string, *batchxml.METS, error) {
+	var candidates = []string{filepath.Join(dir, filepath.Base(dir)+".xml")}
+	var others, _ = filepath.Glob(filepath.Join(dir, "*.xml"))
+	sort.Strings(others)
+	candidates = append(candidates, others...)
+
+	for _, fname := range candidates {
+		var f, err = os.Open(fname)
+		if err != nil {
+			continue
+		}
+		var m *batchxml.METS
+		m, err = batchxml.ParseMETS(f)
+		f.Close()
+		if err == nil {
+			return fname, m, nil
+		}
+	}
+	return "", nil, fmt.Errorf("no issue METS file found in %s", dir)
+}
+
+// issueBatchName derives the name of a single-issue batch, e.g., issue
+// 1902-11-29 edition 1 of sn96088442 added to "batch_oru_foo_ver01" becomes
+// "batch_oru_foo_issue_sn96088442_1902112901_ver01"
+func issueBatchName(parent string, k issuekey.Key) (string, error) {
+	var pm = batchNameRegexp.FindStringSubmatch(parent)
+	if pm == nil {
+		return "", fmt.Errorf("%q is not a valid batch name (expected batch_<awardee>_<name>_verNN)", parent)
+	}
+	return fmt.Sprintf("%s_issue_%s_%s_%s", pm[1], k.LCCN, k.DateEdition(), pm[2]), nil
+}
+
+// convertIssueKey parses an issue key in either NCA or chronam form and
+// returns it in both
+func convertIssueKey(arg string) response {
+	var k, err = issuekey.Parse(arg)
+	if err != nil {
+		return respond(StatusError, "Invalid issue key", H{"error": err.Error()})
+	}
+	return respond(StatusSuccess, "", H{"issue_key": k, "lccn": k.LCCN, "issue_date": k.IssueDate(), "edition": k.Edition})
+}
+
+// resolveIssueDir turns the client-supplied issue directory, relative to
+// BATCH_SOURCE, into a full path, refusing anything outside BATCH_SOURCE
+func resolveIssueDir(arg string) (string, error) {
+	var rel = filepath.Clean(filepath.FromSlash(arg))
+	if filepath.IsAbs(rel) || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%q must be a directory relative to the batch source", arg)
+	}
+
+	var dir = filepath.Join(BatchSource, rel)
+	var info, err = os.Stat(dir)
+	if err != nil {
+		return "", fmt.Errorf("checking issue directory: %w", err)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%q is not a directory", arg)
+	}
+	return dir, nil
+}
+
+// buildIssueBatch writes a single-issue batch at dst for the issue in
+// issueDir, taking the awardee and award year from the parent batch. The
+// issue directory is symlinked rather than copied.
+func buildIssueBatch(parentPath, issueDir, dst string, m *batchxml.METS, metsFile string) error {
+	var parent, err = batchxml.Read(parentPath)
+	if err != nil {
+		return fmt.Errorf("reading parent batch: %w", err)
+	}
+
+	var rel = batchxml.NewRelPath(m.LCCN).Child(filepath.Base(issueDir))
+	var b = &batchxml.Batch{
+		Name:      batchNameRegexp.ReplaceAllString(filepath.Base(dst), "$1"),
+		Awardee:   parent.Awardee,
+		AwardYear: parent.AwardYear,
+		Issues: []*batchxml.Issue{{
+			LCCN:         m.LCCN,
+			IssueDate:    m.IssueDate,
+			EditionOrder: m.EditionOrder,
+			Filepath:     "./" + rel.Child(filepath.Base(metsFile)).String(),
+		}},
+	}
+
+	var data []byte
+	data, err = b.Marshal()
+	if err != nil {
+		return fmt.Errorf("generating batch XML: %w", err)
+	}
+
+	// The issue directory is recorded relative to the batch source, like the
+	// client gave it to us
+	var issueRel, _ = filepath.Rel(filepath.Dir(parentPath), issueDir)
+	err = createDerivedDir(dst, lineage{Parent: filepath.Base(parentPath), Kind: derivedIssue, Issue: filepath.ToSlash(issueRel)})
+	if err != nil {
+		return err
+	}
+
+	var dataDir = batchxml.DataDir(dst)
+	err = os.MkdirAll(dataDir, 0755)
+	if err == nil {
+		err = os.WriteFile(batchxml.XMLPath(dst), data, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("writing issue batch: %w", err)
+	}
+
+	return linkIssueDir(dataDir, rel, issueDir)
+}
+
+// loadIssue builds a single-issue batch from an issue directory and queues a
+// job to load it, so one late issue doesn't require a whole new batch
+// version
+func loadIssue(parent, issueArg string) response {
+	var issueDir, err = resolveIssueDir(issueArg)
+	if err != nil {
+		return respond(StatusError, "Issue cannot be loaded", H{"error": err.Error()})
+	}
+
+	var metsFile string
+	var m *batchxml.METS
+	metsFile, m, err = findIssueMETS(issueDir)
+	if err != nil {
+		return respond(StatusError, "Issue cannot be loaded", H{"error": err.Error()})
+	}
+	if m.LCCN == "" || m.IssueDate == "" {
+		return respond(StatusError, "Issue cannot be loaded", H{"error": "issue METS is missing its LCCN or issue date"})
+	}
+	var key issuekey.Key
+	key, err = issuekey.FromParts(m.LCCN, m.IssueDate, m.EditionOrder)
+	if err != nil {
+		return respond(StatusError, "Issue cannot be loaded", H{"error": fmt.Sprintf("issue METS has an invalid issue key: %s", err)})
+	}
+	m.EditionOrder = fmt.Sprintf("%02d", key.Edition)
+
+	var derived string
+	derived, err = issueBatchName(parent, key)
+	if err != nil {
+		return respond(StatusError, "Issue cannot be loaded", H{"error": err.Error()})
+	}
+
+	var exists bool
+	exists, err = checkBatch(derived)
+	if err != nil {
+		return respond(StatusError, fmt.Sprintf("%q cannot be loaded", derived), H{"error": err.Error()})
+	}
+	if exists {
+		return respondNoJob()
+	}
+
+	var parentPath string
+	parentPath, err = findBatch(parent)
+	if err != nil {
+		return respond(StatusError, fmt.Sprintf("%q cannot be loaded", derived), H{"error": err.Error()})
+	}
+
+	// As with partial batches, the issue batch lives next to its parent
+	var dst = filepath.Join(filepath.Dir(parentPath), derived)
+	err = buildIssueBatch(parentPath, issueDir, dst, m, metsFile)
+	var contents string
+	if err == nil {
+		contents, err = batchContents(dst)
+	}
+	if err == nil {
+		err = validateBatch(dst)
+	}
+	if err != nil {
+		return respond(StatusError, fmt.Sprintf("%q cannot be loaded", derived), H{"error": err.Error()})
+	}
+
+	var resp = queueLoadBatch(fmt.Sprintf("Load issue batch %s", derived), dst, contents)
+	if resp.status == StatusSuccess {
+		resp.data["batch"] = H{"name": derived, "parent": parent, "lccn": m.LCCN, "issue_date": m.IssueDate, "edition": m.EditionOrder, "issue_key": key}
+	}
+	return resp
+}
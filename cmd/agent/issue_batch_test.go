@@ -0,0 +1,81 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/open-oni/oni-agent/internal/batchxml"
+	"github.com/open-oni/oni-agent/internal/issuekey"
+)
+
+func TestBuildIssueBatch(t *testing.T) {
+	var issueDir = filepath.Join("testdata", "late-issues", "sn00000001", "19020401")
+	var metsFile, m, err = findIssueMETS(issueDir)
+	if err != nil {
+		t.Fatalf("Unable to find issue METS: %s", err)
+	}
+	m.EditionOrder = "02"
+
+	var key issuekey.Key
+	key, err = issuekey.FromParts(m.LCCN, m.IssueDate, m.EditionOrder)
+	if err != nil {
+		t.Fatalf("Unable to build issue key: %s", err)
+	}
+	var name string
+	name, err = issueBatchName("batch_oru_dated_ver01", key)
+	if err != nil {
+		t.Fatalf("Unable to derive batch name: %s", err)
+	}
+	var expected = "batch_oru_dated_issue_sn00000001_1902040102_ver01"
+	if name != expected {
+		t.Fatalf("Expected batch name %q, got %q", expected, name)
+	}
+
+	var dst = filepath.Join(t.TempDir(), name)
+	err = buildIssueBatch(filepath.Join("testdata", "dated"), issueDir, dst, m, metsFile)
+	if err != nil {
+		t.Fatalf("Unable to build issue batch: %s", err)
+	}
+	err = validateBatch(dst)
+	if err != nil {
+		t.Fatalf("Issue batch doesn't validate: %s", err)
+	}
+
+	var b *batchxml.Batch
+	b, err = batchxml.Read(dst)
+	if err != nil {
+		t.Fatalf("Unable to read issue batch: %s", err)
+	}
+	if b.Name != "batch_oru_dated_issue_sn00000001_1902040102" || b.Awardee != "oru" || len(b.Issues) != 1 {
+		t.Fatalf("Unexpected batch: %#v", b)
+	}
+	var i = b.Issues[0]
+	if i.LCCN != "sn00000001" || i.IssueDate != "1902-04-01" || i.EditionOrder != "02" {
+		t.Errorf("Unexpected issue: %#v", i)
+	}
+
+	var l *lineage
+	l, err = readLineage(dst)
+	if err != nil || l == nil {
+		t.Fatalf("Unable to read lineage (%v): %s", l, err)
+	}
+	if l.Parent != "dated" || l.Kind != derivedIssue || l.Issue != "late-issues/sn00000001/19020401" {
+		t.Errorf("Unexpected lineage: %#v", l)
+	}
+}
+
+func TestResolveIssueDir(t *testing.T) {
+	var orig = BatchSource
+	BatchSource = "testdata"
+	t.Cleanup(func() { BatchSource = orig })
+	for _, bad := range []string{"../testdata", "/etc", ".", "dated/data/batch.xml", "nope"} {
+		var _, err = resolveIssueDir(bad)
+		if err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+	var _, err = resolveIssueDir("late-issues/sn00000001/19020401")
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
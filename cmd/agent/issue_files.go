@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+
+	"github.com/open-oni/oni-agent/internal/batchxml"
+	"github.com/open-oni/oni-agent/internal/issuekey"
+)
+
+// issueFile is one file in an issue's inventory: on disk, in the issue's
+// METS, or both
+type issueFile struct {
+	Name         string `json:"name"`
+	Size         int64  `json:"size"`
+	Use          string `json:"use,omitempty"`
+	Checksum     string `json:"checksum,omitempty"`
+	ChecksumType string `json:"checksum_type,omitempty"`
+
+	// InMETS is false for files on disk the METS doesn't mention, other than
+	// the METS itself
+	InMETS bool `json:"in_mets"`
+
+	// Missing is true for files the METS references which aren't on disk
+	Missing bool `json:"missing,omitempty"`
+}
+
+// findBatchIssue returns the batch's issue with the given key, or nil
+func findBatchIssue(b *batchxml.Batch, key issuekey.Key) *batchxml.Issue {
+	for _, i := range b.Issues {
+		var k, err = issuekey.FromParts(i.LCCN, i.IssueDate, i.EditionOrder)
+		if err == nil && k.NCA() == key.NCA() {
+			return i
+		}
+	}
+	return nil
+}
+
+// issueInventory lists every file in the issue's directory and every file
+// its METS references, sorted by name
+func issueInventory(batchPath string, i *batchxml.Issue) ([]issueFile, error) {
+	var m, err = i.ReadMETS(batchPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading issue METS: %w", err)
+	}
+
+	// Derived batches symlink issue directories, and WalkDir won't descend
+	// into a symlinked root
+	var dir string
+	dir, err = filepath.EvalSymlinks(i.Dir(batchPath))
+	if err != nil {
+		return nil, fmt.Errorf("reading issue directory: %w", err)
+	}
+
+	var files = make(map[batchxml.RelPath]*issueFile)
+	var metsName = batchxml.NewRelPath(filepath.Base(i.Path(batchPath)))
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		var info, err2 = d.Info()
+		if err2 != nil {
+			return err2
+		}
+		var rel, _ = filepath.Rel(dir, path)
+		var p = batchxml.NewRelPath(filepath.ToSlash(rel))
+		files[p] = &issueFile{Name: p.String(), Size: info.Size()}
+		if p == metsName {
+			files[p].Use = "mets"
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading issue directory: %w", err)
+	}
+
+	for _, p := range m.Files {
+		var f = files[p]
+		if f == nil {
+			f = &issueFile{Name: p.String(), Missing: true}
+			files[p] = f
+		}
+		var detail = m.Details[p]
+		f.InMETS = true
+		f.Use, f.Checksum, f.ChecksumType = detail.Use, detail.Checksum, detail.ChecksumType
+	}
+
+	var list = make([]issueFile, 0, len(files))
+	for _, f := range files {
+		list = append(list, *f)
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].Name < list[b].Name })
+	return list, nil
+}
+
+// getIssueFiles reports the file inventory for one issue in a batch on disk,
+// so problems can be checked without shell access
+func getIssueFiles(r *request, name, keyArg string) response {
+	if !batchNameRegexp.MatchString(name) {
+		return respond(StatusError, fmt.Sprintf("%q is not a valid batch name", name), nil)
+	}
+	var key, err = issuekey.Parse(keyArg)
+	if err != nil {
+		return respond(StatusError, "Invalid issue key", H{"error": err.Error()})
+	}
+
+	var batchPath string
+	var b *batchxml.Batch
+	batchPath, err = findBatch(name)
+	if err == nil {
+		b, err = batchxml.Read(batchPath)
+	}
+	if err != nil {
+		return respond(StatusError, fmt.Sprintf("Unable to read batch %q", name), H{"error": err.Error()})
+	}
+	var i = findBatchIssue(b, key)
+	if i == nil {
+		return respond(StatusError, fmt.Sprintf("%q has no issue %s", name, key.NCA()), nil)
+	}
+
+	var files []issueFile
+	files, err = issueInventory(batchPath, i)
+	if err != nil {
+		r.logError("Unable to read issue files", "batch", name, "issue", key.NCA(), "error", err)
+		return respond(StatusError, fmt.Sprintf("Unable to read files for %s", key.NCA()), H{"error": err.Error()})
+	}
+
+	var missing, unreferenced int
+	for _, f := range files {
+		if f.Missing {
+			missing++
+		}
+		if !f.InMETS && f.Use != "mets" {
+			unreferenced++
+		}
+	}
+	var msg = ""
+	if missing > 0 {
+		msg = fmt.Sprintf("%d file(s) referenced by the issue METS are missing", missing)
+	}
+	return respond(StatusSuccess, msg, H{"batch": name, "issue_key": key, "files": files, "missing": missing, "unreferenced": unreferenced})
+}
+
+func init() {
+	register("issue-files", func(r *request) response {
+		if len(r.args) != 2 {
+			return respond(StatusError, fmt.Sprintf("%q requires a batch name and an issue key", r.command), nil)
+		}
+		return getIssueFiles(r, r.args[0], r.args[1])
+	})
+}
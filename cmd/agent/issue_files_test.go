@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/open-oni/oni-agent/internal/batchxml"
+)
+
+const issueFilesMETS = `<mets xmlns:xlink="http://www.w3.org/1999/xlink">
+  <fileSec>
+    <fileGrp ID="pageFileGrp1">
+      <file ID="serviceFile1" USE="service" CHECKSUM="abc123" CHECKSUMTYPE="MD5"><FLocat xlink:href="./0001.jp2"/></file>
+      <file ID="ocrFile1" USE="ocr"><FLocat xlink:href="./0001.xml"/></file>
+      <file ID="pdfFile1" USE="derivative"><FLocat xlink:href="./0001.pdf"/></file>
+    </fileGrp>
+  </fileSec>
+  <structMap><div TYPE="np:issue"><div TYPE="np:page"/></div></structMap>
+</mets>
+`
+
+func TestGetIssueFiles(t *testing.T) {
+	var origSource, origTemplate = BatchSource, BatchPathTemplate
+	defer func() { BatchSource, BatchPathTemplate = origSource, origTemplate }()
+	BatchSource, BatchPathTemplate = t.TempDir(), ""
+
+	var batchPath = filepath.Join(BatchSource, "batch_oru_files_ver01")
+	var issueDir = filepath.Join(batchxml.DataDir(batchPath), "sn96088442", "1902112901")
+	var b = &batchxml.Batch{Name: "batch_oru_files", Awardee: "oru", Issues: []*batchxml.Issue{
+		{LCCN: "sn96088442", IssueDate: "1902-11-29", EditionOrder: "01", Filepath: "./sn96088442/1902112901/1902112901.xml"},
+	}}
+	var data, err = b.Marshal()
+	if err == nil {
+		err = os.MkdirAll(issueDir, 0755)
+	}
+	if err == nil {
+		err = os.WriteFile(batchxml.XMLPath(batchPath), data, 0644)
+	}
+	var files = map[string]string{"1902112901.xml": issueFilesMETS, "0001.jp2": "jp2", "0001.xml": "<alto/>", "notes.txt": "stray"}
+	for name, content := range files {
+		if err == nil {
+			err = os.WriteFile(filepath.Join(issueDir, name), []byte(content), 0644)
+		}
+	}
+	if err != nil {
+		t.Fatalf("Unable to write test batch: %s", err)
+	}
+
+	// Either form of the issue key works
+	var resp = getIssueFiles(&request{}, "batch_oru_files_ver01", "sn96088442/1902112901")
+	if resp.status != StatusSuccess {
+		t.Fatalf("Unexpected error: %#v", resp)
+	}
+	var expected = []issueFile{
+		{Name: "0001.jp2", Size: 3, Use: "service", Checksum: "abc123", ChecksumType: "MD5", InMETS: true},
+		{Name: "0001.pdf", Use: "derivative", InMETS: true, Missing: true},
+		{Name: "0001.xml", Size: 7, Use: "ocr", InMETS: true},
+		{Name: "1902112901.xml", Size: int64(len(issueFilesMETS)), Use: "mets"},
+		{Name: "notes.txt", Size: 5},
+	}
+	if diff := cmp.Diff(expected, resp.data["files"]); diff != "" {
+		t.Errorf("Unexpected inventory: %s", diff)
+	}
+	if resp.data["missing"] != 1 || resp.data["unreferenced"] != 1 {
+		t.Errorf("Expected one missing and one unreferenced file, got %#v", resp.data)
+	}
+
+	resp = getIssueFiles(&request{}, "batch_oru_files_ver01", "sn96088442/1902-11-30_01")
+	if resp.status != StatusError {
+		t.Errorf("Expected an error for an issue not in the batch, got %#v", resp)
+	}
+}
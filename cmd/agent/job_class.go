@@ -0,0 +1,27 @@
+package main
+
+import "path/filepath"
+
+// batchClass is the concurrency class batch commands share while ONI's batch
+// lock is in use
+const batchClass = "batch"
+
+// jobClass is the queue's ClassFunc when BA_WORKERS lets jobs run side by
+// side. Batch commands are classed by batch name, so a batch is never loaded
+// or purged by two jobs at once. When ONI_LOCK_FILE is in use, though, the
+// lock only lets one batch command run at a time, so they all share a class
+// rather than failing to start. Other ONI commands are classed by command,
+// so, e.g., title loads run one at a time alongside batch loads. In-process
+// jobs are exclusive: many of them read or write what other jobs depend on.
+func jobClass(_ int64, args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	if !oniBatchCommands[args[0]] {
+		return args[0]
+	}
+	if ONILockFile != "" || len(args) < 2 {
+		return batchClass
+	}
+	return batchClass + ":" + filepath.Base(args[1])
+}
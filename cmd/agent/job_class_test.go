@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestJobClass(t *testing.T) {
+	var origLock = ONILockFile
+	defer func() { ONILockFile = origLock }()
+
+	var tests = map[string]struct {
+		args     []string
+		lockFile string
+		expected string
+	}{
+		"in-process":        {args: nil, expected: ""},
+		"title load":        {args: []string{"load_titles", "/tmp/titles"}, expected: "load_titles"},
+		"batch load":        {args: []string{"load_batch", "/mnt/batches/batch_foo_ver01"}, expected: "batch:batch_foo_ver01"},
+		"batch purge":       {args: []string{"purge_batch", "batch_foo_ver01"}, expected: "batch:batch_foo_ver01"},
+		"locked batch load": {args: []string{"load_batch", "/mnt/batches/batch_foo_ver01"}, lockFile: "/tmp/lock", expected: "batch"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			ONILockFile = tc.lockFile
+			var got = jobClass(1, tc.args)
+			if got != tc.expected {
+				t.Errorf("Expected class %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+// Placeholders allowed in job hook args
+const (
+	hookJobID   = "{job_id}"
+	hookCommand = "{command}"
+	hookArg     = "{arg}"
+	hookBatch   = "{batch}"
+	hookArgs    = "{args}"
+)
+
+// hookConfig is a single hook script and its templated args
+type hookConfig struct {
+	Script string   `json:"script"`
+	Args   []string `json:"args"`
+}
+
+// jobHooks are the hooks for one job type
+type jobHooks struct {
+	Pre  []hookConfig `json:"pre"`
+	Post []hookConfig `json:"post"`
+}
+
+// JobHooks maps ONI commands (e.g., "load_batch") to the hooks run around
+// jobs using them. Hook scripts have already been resolved to full paths
+// inside JobHookDir.
+var JobHooks map[string]jobHooks
+
+// readJobHooks reads and validates the hooks file. Every script must be an
+// executable inside hookDir, which acts as the allowlist: the hooks file can
+// only pick which of those scripts run, and with what args.
+func readJobHooks(fname, hookDir string) (map[string]jobHooks, error) {
+	if hookDir == "" {
+		return nil, errors.New("JOB_HOOK_DIR must be set to use job hooks")
+	}
+	var data, err = os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var hooks map[string]jobHooks
+	err = json.Unmarshal(data, &hooks)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", fname, err)
+	}
+
+	for command, jh := range hooks {
+		if command == "" {
+			return nil, errors.New("hooks must be keyed by an ONI command name")
+		}
+		for _, list := range [][]hookConfig{jh.Pre, jh.Post} {
+			for i := range list {
+				err = validateHook(&list[i], hookDir)
+				if err != nil {
+					return nil, fmt.Errorf("hook for %q: %w", command, err)
+				}
+			}
+		}
+	}
+	return hooks, nil
+}
+
+// validateHook checks the hook's args and resolves its script to a full path
+// in hookDir
+func validateHook(h *hookConfig, hookDir string) error {
+	var rel = filepath.Clean(filepath.FromSlash(h.Script))
+	if h.Script == "" || filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("script %q must be a path relative to JOB_HOOK_DIR", h.Script)
+	}
+	h.Script = filepath.Join(hookDir, rel)
+	var info, err = os.Stat(h.Script)
+	if err == nil && (info.IsDir() || info.Mode().Perm()&0111 == 0) {
+		err = errors.New("not an executable file")
+	}
+	if err != nil {
+		return fmt.Errorf("script %q: %w", h.Script, err)
+	}
+
+	for _, arg := range h.Args {
+		for _, ph := range placeholderRegexp.FindAllString(arg, -1) {
+			switch ph {
+			case hookJobID, hookCommand, hookArg, hookBatch:
+			case hookArgs:
+				if arg != hookArgs {
+					return fmt.Errorf("%s must be an arg on its own", hookArgs)
+				}
+			default:
+				return fmt.Errorf("unknown placeholder %q", ph)
+			}
+		}
+	}
+	return nil
+}
+
+// expand returns the hook as a queue step for the given job
+func (h hookConfig) expand(kind string, id int64, args []string) queue.Step {
+	var command, arg string
+	var rest []string
+	if len(args) > 0 {
+		command, rest = args[0], args[1:]
+	}
+	if len(rest) > 0 {
+		arg = rest[0]
+	}
+	var r = strings.NewReplacer(
+		hookJobID, strconv.FormatInt(id, 10),
+		hookCommand, command,
+		hookArg, arg,
+		hookBatch, filepath.Base(arg),
+	)
+
+	var s = queue.Step{Path: h.Script}
+	for _, a := range h.Args {
+		if a == hookArgs {
+			s.Args = append(s.Args, rest...)
+			continue
+		}
+		s.Args = append(s.Args, r.Replace(a))
+	}
+	s.Env = append(os.Environ(),
+		"ONI_AGENT_HOOK="+kind,
+		"ONI_AGENT_JOB_ID="+strconv.FormatInt(id, 10),
+		"ONI_AGENT_COMMAND="+command,
+	)
+	return s
+}
+
+// jobSteps is the queue's StepFunc: it turns the configured hooks for a
+// job's ONI command into steps
+func jobSteps(id int64, args []string) (pre, post []queue.Step) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+	var jh = JobHooks[args[0]]
+	for _, h := range jh.Pre {
+		pre = append(pre, h.expand("pre", id, args))
+	}
+	for _, h := range jh.Post {
+		post = append(post, h.expand("post", id, args))
+	}
+	return pre, post
+}
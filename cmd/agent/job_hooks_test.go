@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReadJobHooks(t *testing.T) {
+	var hookDir = t.TempDir()
+	os.WriteFile(filepath.Join(hookDir, "snapshot"), []byte("#!/bin/sh\n"), 0755)
+	os.WriteFile(filepath.Join(hookDir, "notexec"), []byte("#!/bin/sh\n"), 0644)
+
+	var write = func(content string) string {
+		var fname = filepath.Join(t.TempDir(), "hooks.json")
+		os.WriteFile(fname, []byte(content), 0644)
+		return fname
+	}
+
+	var tests = map[string]struct {
+		content string
+		errText string
+	}{
+		"valid":          {content: `{"purge_batch": {"pre": [{"script": "snapshot", "args": ["--label", "before-{batch}-{job_id}", "{args}"]}]}}`},
+		"escape":         {content: `{"purge_batch": {"pre": [{"script": "../snapshot"}]}}`, errText: "relative to JOB_HOOK_DIR"},
+		"absolute":       {content: `{"purge_batch": {"pre": [{"script": "/bin/sh"}]}}`, errText: "relative to JOB_HOOK_DIR"},
+		"not executable": {content: `{"load_batch": {"post": [{"script": "notexec"}]}}`, errText: "not an executable"},
+		"missing":        {content: `{"load_batch": {"post": [{"script": "nope"}]}}`, errText: "no such file"},
+		"bad template":   {content: `{"load_batch": {"post": [{"script": "snapshot", "args": ["{lccn}"]}]}}`, errText: "unknown placeholder"},
+		"embedded args":  {content: `{"load_batch": {"post": [{"script": "snapshot", "args": ["x={args}"]}]}}`, errText: "on its own"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var _, err = readJobHooks(write(tc.content), hookDir)
+			if tc.errText == "" && err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if tc.errText != "" && (err == nil || !strings.Contains(err.Error(), tc.errText)) {
+				t.Fatalf("Expected error containing %q, got %v", tc.errText, err)
+			}
+		})
+	}
+
+	var _, err = readJobHooks(write(`{}`), "")
+	if err == nil {
+		t.Fatal("Expected an error without a hook dir")
+	}
+}
+
+func TestJobSteps(t *testing.T) {
+	var orig = JobHooks
+	t.Cleanup(func() { JobHooks = orig })
+	JobHooks = map[string]jobHooks{
+		"purge_batch": {
+			Pre:  []hookConfig{{Script: "/hooks/snapshot", Args: []string{"before-{batch}-{job_id}"}}},
+			Post: []hookConfig{{Script: "/hooks/cdn", Args: []string{"{command}", "{args}"}}},
+		},
+	}
+
+	var pre, post = jobSteps(7, []string{"purge_batch", "batch_oru_foo_ver01"})
+	if len(pre) != 1 || len(post) != 1 {
+		t.Fatalf("Expected one pre and one post step, got %#v, %#v", pre, post)
+	}
+	var diff = cmp.Diff([]string{"before-batch_oru_foo_ver01-7"}, pre[0].Args)
+	if diff != "" {
+		t.Fatal(diff)
+	}
+	diff = cmp.Diff([]string{"purge_batch", "batch_oru_foo_ver01"}, post[0].Args)
+	if diff != "" {
+		t.Fatal(diff)
+	}
+	if !strings.Contains(strings.Join(pre[0].Env, "\n"), "ONI_AGENT_HOOK=pre") {
+		t.Fatal("Expected hook env vars to be set")
+	}
+
+	pre, post = jobSteps(8, []string{"load_batch", "/mnt/batch_oru_foo_ver01"})
+	if pre != nil || post != nil {
+		t.Fatalf("Expected no steps for a job type without hooks, got %#v, %#v", pre, post)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log/slog"
+	"strconv"
+	"sync"
+
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+// jobNotesStateFile is the state file holding the records of annotated jobs
+const jobNotesStateFile = "job_notes.json"
+
+// maxSavedJobNotes is how many annotated jobs' records are kept in
+// jobNotesStateFile; past that, the oldest are dropped
+const maxSavedJobNotes = 500
+
+// jobNotesMu serializes reads and writes of the saved job records
+var jobNotesMu sync.Mutex
+
+// readSavedJobNotes returns the saved records of annotated jobs, oldest
+// first. Without a state dir nothing is saved, so the list is always empty.
+func readSavedJobNotes() ([]queue.Record, error) {
+	var saved []queue.Record
+	if State == nil {
+		return saved, nil
+	}
+	var _, err = State.Read(jobNotesStateFile, &saved)
+	return saved, err
+}
+
+// saveJobNotes stores the annotated job's record, minus its logs, replacing
+// any copy saved by an earlier note. Jobs only live in memory, so this is
+// what lets job-status find a job's notes after the agent restarts.
+func saveJobNotes(j *queue.Job) error {
+	if State == nil {
+		return nil
+	}
+
+	jobNotesMu.Lock()
+	defer jobNotesMu.Unlock()
+	var saved, err = readSavedJobNotes()
+	if err != nil {
+		return err
+	}
+
+	var rec = j.Record()
+	rec.Stdout, rec.Stderr = nil, nil
+	var replaced bool
+	for i, r := range saved {
+		if r.ID == rec.ID && r.QueuedAt.Equal(rec.QueuedAt) {
+			saved[i], replaced = rec, true
+		}
+	}
+	if !replaced {
+		saved = append(saved, rec)
+	}
+	if len(saved) > maxSavedJobNotes {
+		saved = saved[len(saved)-maxSavedJobNotes:]
+	}
+	return State.Write(jobNotesStateFile, saved)
+}
+
+// savedJobNotes returns the newest saved record for the given job id, if
+// there is one. Job ids restart whenever the agent does, so a job still in
+// the queue always takes precedence over this.
+func savedJobNotes(arg string) (queue.Record, bool) {
+	var id, _ = strconv.ParseInt(arg, 10, 64)
+	if id <= 0 {
+		return queue.Record{}, false
+	}
+
+	jobNotesMu.Lock()
+	defer jobNotesMu.Unlock()
+	var saved, err = readSavedJobNotes()
+	if err != nil {
+		slog.Error("Unable to read saved job notes", "error", err)
+		return queue.Record{}, false
+	}
+	for i := len(saved) - 1; i >= 0; i-- {
+		if saved[i].ID == id {
+			return saved[i], true
+		}
+	}
+	return queue.Record{}, false
+}
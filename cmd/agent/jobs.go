@@ -0,0 +1,597 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/open-oni/oni-agent/pkg/logstream"
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+// listJobsArgs holds the options for list-jobs
+type listJobsArgs struct {
+	stream bool
+	sort   string
+	desc   bool
+}
+
+// jobSorts are the fields list-jobs can sort by, and how to compare them
+var jobSorts = map[string]func(a, b *queue.Job) int{
+	"id":     func(a, b *queue.Job) int { return cmp.Compare(a.ID(), b.ID()) },
+	"queued": func(a, b *queue.Job) int { return a.QueuedAt().Compare(b.QueuedAt()) },
+	"name":   func(a, b *queue.Job) int { return strings.Compare(a.Name(), b.Name()) },
+	"status": func(a, b *queue.Job) int { return strings.Compare(string(a.Status()), string(b.Status())) },
+}
+
+func parseListJobsArgs(args []string) (listJobsArgs, error) {
+	var a = listJobsArgs{sort: "queued"}
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--stream":
+			a.stream = true
+		case "--desc":
+			a.desc = true
+		case "--sort":
+			if i+1 >= len(args) {
+				return a, fmt.Errorf("--sort requires a field")
+			}
+			i++
+			a.sort = args[i]
+			if jobSorts[a.sort] == nil {
+				return a, fmt.Errorf("%q is not a valid sort field (use id, queued, name, or status)", a.sort)
+			}
+		default:
+			return a, fmt.Errorf("%q is not a valid option", args[i])
+		}
+	}
+	return a, nil
+}
+
+// sortJobs sorts list in place by the given field, falling back to job id so
+// the order is stable across calls
+func sortJobs(list []*queue.Job, field string, desc bool) {
+	var compare = jobSorts[field]
+	slices.SortStableFunc(list, func(a, b *queue.Job) int {
+		var c = cmp.Or(compare(a, b), cmp.Compare(a.ID(), b.ID()))
+		if desc {
+			return -c
+		}
+		return c
+	})
+}
+
+func jobSummary(j *queue.Job) H {
+	var data = H{"id": j.ID(), "name": j.Name(), "queued": j.QueuedAt(), "status": j.Status()}
+	if labels := j.Labels(); labels != nil {
+		data["labels"] = labels
+	}
+	if until := j.DeferredUntil(); !until.IsZero() {
+		data["deferred_until"] = until
+	}
+	addJobTimes(data, j)
+	return data
+}
+
+// addJobTimes adds when the job started and finished, and how long it spent
+// waiting in the queue and running, which a long backlog makes very
+// different things. Times which haven't happened yet are left out; a job
+// which is still waiting or running is measured up to now.
+func addJobTimes(data H, j *queue.Job) {
+	var now = time.Now()
+	var queued, started, completed = j.QueuedAt(), j.StartedAt(), j.CompletedAt()
+	if !started.IsZero() {
+		data["started"] = started
+	}
+	if !completed.IsZero() {
+		data["completed"] = completed
+	}
+
+	// Waiting ends when the job starts, or when it's given up on if it never
+	// could. Jobs run directly rather than queued never wait.
+	if !queued.IsZero() {
+		var end = cmp.Or(started, completed, now)
+		data["wait_seconds"] = end.Sub(queued).Seconds()
+	}
+	if !started.IsZero() {
+		data["run_seconds"] = cmp.Or(completed, now).Sub(started).Seconds()
+	}
+}
+
+func listJobs(r *request) response {
+	var a, err = parseListJobsArgs(r.args)
+	if err != nil {
+		return respond(StatusError, err.Error(), nil)
+	}
+
+	var list = JobRunner.AllJobs()
+	sortJobs(list, a.sort, a.desc)
+
+	// A long-running agent can have thousands of jobs, so streaming sends
+	// them one line at a time instead of as one document the client has to
+	// buffer in full
+	if a.stream {
+		return respondStream(StatusSuccess, "", nil, "jobs", func(emit func(any) error) error {
+			for _, j := range list {
+				var err = emit(jobSummary(j))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	var jobs = []H{}
+	for _, j := range list {
+		jobs = append(jobs, jobSummary(j))
+	}
+	return respond(StatusSuccess, "", H{"jobs": jobs})
+}
+
+// getJob looks up the job for the given id string. If the job can't be
+// found, ok is false and resp holds the response to send back.
+func getJob(arg string) (job *queue.Job, resp response, ok bool) {
+	var id, _ = strconv.ParseInt(arg, 10, 64)
+	if id == 0 {
+		return nil, respond(StatusError, fmt.Sprintf("%q is not a valid job id", arg), nil), false
+	}
+
+	// Allow fake jobs to get a response instead of an error so that automations
+	// that haven't accounted for "no job needed" responses don't fail
+	var noop = queue.NoOpJob()
+	if id == noop.ID() {
+		return noop, resp, true
+	}
+
+	var j = JobRunner.GetJob(id)
+	if j == nil {
+		return nil, respond(StatusError, "Job not found", H{"job": H{"id": id}}), false
+	}
+
+	return j, resp, true
+}
+
+func getJobStatus(r *request, arg string) response {
+	var j, resp, ok = getJob(arg)
+	if !ok {
+		if rec, found := savedJobNotes(arg); found {
+			return respond(StatusSuccess, "Unknown: this job is from before the agent restarted, and only its notes were saved.", H{"job": rec})
+		}
+		return resp
+	}
+
+	var jobdata = jobSummary(j)
+	if j.Environment() != "" {
+		jobdata["environment"] = j.Environment()
+	}
+	if len(j.Artifacts()) > 0 {
+		jobdata["artifacts"] = j.Artifacts()
+	}
+	if notes := j.Notes(); len(notes) > 0 {
+		jobdata["notes"] = notes
+	}
+	// Only the latest progress event is reported: a big load can have
+	// thousands, and the change journal has every one
+	if progress := j.Progress(); len(progress) > 0 {
+		jobdata["progress"] = progress[len(progress)-1]
+	}
+	var status = StatusSuccess
+	var message string
+
+	switch j.Status() {
+	case queue.StatusPending:
+		message = "Pending: this job is in the queue but hasn't been started yet."
+	case queue.StatusStarted:
+		message = "Started: this job is currently running."
+		jobdata["last_output"] = j.LastOutput()
+		if j.Stalled(JobStallThreshold) {
+			jobdata["stalled"] = true
+			message = "Started: this job is currently running, but hasn't produced any output recently and may be stuck."
+		}
+	case queue.StatusFailStart:
+		addJobError(jobdata, j)
+		message = "Invalid: this job was not able to start."
+	case queue.StatusSuccessful:
+		message = "Success: this job is complete."
+	case queue.StatusFailed:
+		addJobError(jobdata, j)
+		message = "Failed: this job started but returned a non-zero exit code."
+	case queue.StatusCanceled:
+		addJobError(jobdata, j)
+		message = "Canceled: this job was canceled before it could finish."
+	default:
+		r.logError("Invalid job status", "jobID", j.ID(), "jobStatus", j.Status())
+		status = StatusError
+		message = "Internal error: unknown job status"
+	}
+
+	var data = H{"job": jobdata}
+	if w := environmentWarning(j.Environment()); w != "" {
+		data["warning"] = w
+	}
+	return respond(status, message, data)
+}
+
+// addJobError reports why the job failed. Errors don't encode as JSON on
+// their own, so it's the message which is sent.
+func addJobError(data H, j *queue.Job) {
+	if err := j.Error(); err != nil {
+		data["error"] = err.Error()
+	}
+}
+
+// maxStatusWait is the longest a client may ask job-status to wait, in
+// seconds. It keeps well under the SSH server's five-minute session timeout.
+const maxStatusWait = 240
+
+// waitJobStatus blocks until the job finishes, the timeout elapses, or the
+// client goes away, and then reports the job's status like job-status does
+func waitJobStatus(r *request, arg string, timeout time.Duration) response {
+	var j, resp, ok = getJob(arg)
+	if !ok {
+		return resp
+	}
+
+	var timer = time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-j.Done():
+	case <-timer.C:
+	case <-r.ctx.Done():
+	}
+
+	return getJobStatus(r, arg)
+}
+
+// maxNoteLength is the longest note, in bytes, annotate-job accepts
+const maxNoteLength = 2000
+
+// annotateJob attaches an operator's note to a job. Notes are kept with the
+// job, so they're archived along with it, and the job's record is saved in
+// STATE_DIR so they survive a restart.
+func annotateJob(r *request, arg string, text string) response {
+	var j, resp, ok = getJob(arg)
+	if !ok {
+		return resp
+	}
+	if j.ID() == queue.NoOpJob().ID() {
+		return respond(StatusError, "No-op jobs cannot be annotated", nil)
+	}
+
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return respond(StatusError, "Note text must not be empty", nil)
+	}
+	if len(text) > maxNoteLength {
+		return respond(StatusError, fmt.Sprintf("Notes may be at most %d bytes", maxNoteLength), nil)
+	}
+
+	var author = r.user
+	if author == "" {
+		author = "unknown"
+	}
+	var n = j.AddNote(author, text)
+	r.logInfo("Job annotated", "jobID", j.ID(), "author", author)
+	var data = H{"job": H{"id": j.ID(), "notes": j.Notes()}, "note": n}
+	var err = saveJobNotes(j)
+	if err != nil {
+		r.logError("Unable to persist job notes", "jobID", j.ID(), "error", err)
+		data["warning"] = "unable to persist job notes; they will be lost on restart unless the job is archived first: " + err.Error()
+	}
+	return respond(StatusSuccess, "Note added", data)
+}
+
+// cancelWait is how long cancel-job waits for a running job to stop before
+// responding
+var cancelWait = 5 * time.Second
+
+// cancelJob cancels a pending or running job, recording who canceled it and
+// why as the job's error
+func cancelJob(r *request, arg string, text string) response {
+	var j, resp, ok = getJob(arg)
+	if !ok {
+		return resp
+	}
+	if j.ID() == queue.NoOpJob().ID() {
+		return respond(StatusError, "No-op jobs cannot be canceled", nil)
+	}
+
+	var author = r.user
+	if author == "" {
+		author = "unknown"
+	}
+	var reason = "by " + author
+	if text = strings.TrimSpace(text); text != "" {
+		reason += ": " + text
+	}
+	if !j.Cancel(reason) {
+		return respond(StatusError, "Job has already finished", H{"job": jobSummary(j)})
+	}
+	r.logInfo("Job canceled", "jobID", j.ID(), "reason", reason)
+
+	// A running job's process is killed along with its context, which
+	// shouldn't take long, so we give it a moment to report back
+	select {
+	case <-j.Done():
+	case <-time.After(cancelWait):
+		return respond(StatusSuccess, "Cancel requested: the job is still stopping", H{"job": jobSummary(j)})
+	}
+	return respond(StatusSuccess, "Job canceled", H{"job": jobSummary(j)})
+}
+
+// Limits on how many lines of context job-logs --errors may ask for
+const (
+	defaultErrorContext = 3
+	maxErrorContext     = 50
+)
+
+// logFilter says which of a job's log lines job-logs returns, and how. The
+// zero value returns everything as flat lists.
+type logFilter struct {
+	minLevel logstream.Level
+
+	// errors returns only error lines plus context lines around each
+	errors  bool
+	context int
+
+	// source and since, if set, keep only lines from that source, and lines
+	// logged at or after that time. They're applied before the level or
+	// errors filter, so error context comes from the same source.
+	source string
+	since  time.Time
+
+	// structured returns the lines as entries rather than flat lists
+	structured bool
+}
+
+// parseLogFilter reads job-logs' filter options: "--level <level>" or
+// "--errors [--context <lines>]", plus any of "--source <name>",
+// "--since <RFC 3339 time>", and "--structured"
+func parseLogFilter(args []string) (logFilter, error) {
+	var f = logFilter{context: defaultErrorContext}
+	var sawLevel, sawContext bool
+	for len(args) > 0 {
+		var err error
+		switch {
+		case args[0] == "--errors":
+			f.errors = true
+			args = args[1:]
+		case args[0] == "--structured":
+			f.structured = true
+			args = args[1:]
+		case args[0] == "--level" && len(args) > 1:
+			sawLevel = true
+			f.minLevel, err = logstream.ParseLevel(args[1])
+			args = args[2:]
+		case args[0] == "--source" && len(args) > 1:
+			f.source = args[1]
+			args = args[2:]
+		case args[0] == "--since" && len(args) > 1:
+			f.since, err = time.Parse(time.RFC3339, args[1])
+			if err != nil {
+				err = fmt.Errorf("--since requires an RFC 3339 time, got %q", args[1])
+			}
+			args = args[2:]
+		case args[0] == "--context" && len(args) > 1:
+			sawContext = true
+			f.context, err = strconv.Atoi(args[1])
+			if err != nil || f.context < 0 || f.context > maxErrorContext {
+				err = fmt.Errorf("--context requires a number of lines from 0 to %d", maxErrorContext)
+			}
+			args = args[2:]
+		default:
+			err = fmt.Errorf("%q is not a valid option: use --level <level> or --errors [--context <lines>], --source <name>, --since <time>, or --structured", args[0])
+		}
+		if err != nil {
+			return f, err
+		}
+	}
+
+	if f.errors && sawLevel {
+		return f, fmt.Errorf("--level cannot be combined with --errors")
+	}
+	if sawContext && !f.errors {
+		return f, fmt.Errorf("--context requires --errors")
+	}
+	return f, nil
+}
+
+// active returns true if the filter removes anything
+func (f logFilter) active() bool {
+	return f.errors || f.minLevel > logstream.LevelInfo || f.source != "" || !f.since.IsZero()
+}
+
+// String describes the filter for clients
+func (f logFilter) String() string {
+	var parts []string
+	if f.source != "" {
+		parts = append(parts, fmt.Sprintf("source %q", f.source))
+	}
+	if !f.since.IsZero() {
+		parts = append(parts, "since "+f.since.Format(time.RFC3339))
+	}
+	switch {
+	case f.errors:
+		parts = append(parts, fmt.Sprintf("errors with %d lines of context", f.context))
+	case f.minLevel > logstream.LevelInfo || len(parts) == 0:
+		parts = append(parts, "level "+f.minLevel.String()+" and above")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// keep returns the lines the filter keeps
+func (f logFilter) keep(logs []logstream.Leveled) []logstream.Leveled {
+	if f.source != "" || !f.since.IsZero() {
+		var matched []logstream.Leveled
+		for _, l := range logs {
+			if (f.source == "" || l.Source == f.source) && !l.Timestamp.Before(f.since) {
+				matched = append(matched, l)
+			}
+		}
+		logs = matched
+	}
+	if f.errors {
+		return logstream.ErrorContext(logs, f.context)
+	}
+	return logstream.AtLeast(logs, f.minLevel)
+}
+
+// apply returns the timestamped lines the filter keeps
+func (f logFilter) apply(logs []logstream.Leveled) []string {
+	var out = []string{}
+	for _, l := range f.keep(logs) {
+		out = append(out, l.Line)
+	}
+	return out
+}
+
+// jobLogEntry is a structured log line for job-logs --structured
+type jobLogEntry struct {
+	Seq    int64     `json:"seq"`
+	Time   time.Time `json:"time"`
+	Stream string    `json:"stream"`
+	Source string    `json:"source"`
+	Level  string    `json:"level"`
+	Line   string    `json:"line"`
+}
+
+// entries returns the lines the filter keeps from both of a job's streams,
+// merged back into the order they were logged
+func (f logFilter) entries(stdout, stderr []logstream.Leveled) []jobLogEntry {
+	var out = []jobLogEntry{}
+	for _, s := range []struct {
+		name string
+		logs []logstream.Leveled
+	}{{"stdout", stdout}, {"stderr", stderr}} {
+		for _, l := range f.keep(s.logs) {
+			out = append(out, jobLogEntry{Seq: l.Seq, Time: l.Timestamp, Stream: s.name, Source: l.Source, Level: l.Level.String(), Line: l.Value})
+		}
+	}
+	slices.SortStableFunc(out, func(a, b jobLogEntry) int { return cmp.Compare(a.Seq, b.Seq) })
+	return out
+}
+
+// logSources returns every source in the job's logs, in the order each first
+// appears
+func logSources(stdout, stderr []logstream.Leveled) []string {
+	var logs = append(slices.Clip(stdout), stderr...)
+	slices.SortStableFunc(logs, func(a, b logstream.Leveled) int { return cmp.Compare(a.Seq, b.Seq) })
+
+	var seen = make(map[string]bool)
+	var list = []string{}
+	for _, l := range logs {
+		if l.Source != "" && !seen[l.Source] {
+			seen[l.Source] = true
+			list = append(list, l.Source)
+		}
+	}
+	return list
+}
+
+func getJobLogs(arg string, f logFilter) response {
+	var j, resp, ok = getJob(arg)
+	if !ok {
+		return resp
+	}
+
+	var stdout, stderr = j.StdoutLeveled(), j.StderrLeveled()
+	var job = H{
+		"id":         j.ID(),
+		"name":       j.Name(),
+		"queued":     j.QueuedAt(),
+		"status":     j.Status(),
+		"redactions": j.Redactions(),
+		"artifacts":  j.Artifacts(),
+		"notes":      j.Notes(),
+		"sources":    logSources(stdout, stderr),
+		"stdout":     j.Stdout(),
+		"stderr":     j.Stderr(),
+	}
+	if f.active() {
+		job["filter"] = f.String()
+		job["stdout"] = f.apply(stdout)
+		job["stderr"] = f.apply(stderr)
+	}
+	if f.structured {
+		delete(job, "stdout")
+		delete(job, "stderr")
+		job["entries"] = f.entries(stdout, stderr)
+	}
+	return respond(StatusSuccess, "", H{"job": job})
+}
+
+func listArchivedJobs(r *request, sinceArg string) response {
+	if JobArchive == nil {
+		return respond(StatusError, "Job archiving is not enabled", nil)
+	}
+
+	var since time.Time
+	if sinceArg != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339, sinceArg)
+		if err != nil {
+			return respond(StatusError, fmt.Sprintf("%q is not a valid RFC 3339 timestamp", sinceArg), nil)
+		}
+	}
+
+	var list, err = JobArchive.List(since)
+	if err != nil {
+		r.logError("Unable to read job archive", "error", err)
+		return respond(StatusError, "Unable to read job archive", H{"error": err.Error()})
+	}
+	return respondArchivedJobs(list)
+}
+
+func getArchivedJob(r *request, arg string) response {
+	if JobArchive == nil {
+		return respond(StatusError, "Job archiving is not enabled", nil)
+	}
+
+	var id, _ = strconv.ParseInt(arg, 10, 64)
+	if id <= 0 {
+		return respond(StatusError, fmt.Sprintf("%q is not a valid job id", arg), nil)
+	}
+
+	var list, err = JobArchive.Find(id)
+	if err != nil {
+		r.logError("Unable to read job archive", "error", err)
+		return respond(StatusError, "Unable to read job archive", H{"error": err.Error()})
+	}
+	if len(list) == 0 {
+		return respond(StatusError, "Job not found in archive", H{"job": H{"id": id}})
+	}
+	return respondArchivedJobs(list)
+}
+
+// respondArchivedJobs returns archived job records, warning if any of them
+// ran against a different ONI environment than the current one
+func respondArchivedJobs(list []queue.Record) response {
+	if list == nil {
+		list = []queue.Record{}
+	}
+	var data = H{"jobs": list}
+	if w := archivedEnvironmentWarning(list); w != "" {
+		data["warning"] = w
+	}
+	return respond(StatusSuccess, "", data)
+}
+
+func respondNoJob() response {
+	return respond(StatusSuccess, "No-op: job is redundant or already completed", H{"job": H{"id": queue.NoOpJob().ID()}})
+}
+
+func queueJob(name, command string, args []string) response {
+	var err = checkONICommand(command)
+	if err != nil {
+		return respond(StatusError, "Unable to queue job", H{"error": err.Error()})
+	}
+
+	var combined = append([]string{command}, args...)
+	var id = JobRunner.QueueJob(name, combined)
+
+	return respond(StatusSuccess, "Job added to queue", H{"job": H{"id": id}})
+}
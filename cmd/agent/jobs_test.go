@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/open-oni/oni-agent/internal/state"
+	"github.com/open-oni/oni-agent/pkg/logstream"
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+func TestWaitJobStatus(t *testing.T) {
+	JobRunner = queue.New(queue.CommandRunner{Path: "/bin/false"})
+	var release = make(chan struct{})
+	var j = JobRunner.NewFuncJob("blocker", func(context.Context, *queue.Job) error {
+		<-release
+		return nil
+	})
+	var err = j.Start(context.Background())
+	if err != nil {
+		t.Fatalf("Unable to start job: %s", err)
+	}
+	var id = strconv.FormatInt(j.ID(), 10)
+	var r = &request{ctx: context.Background()}
+
+	// Timing out should still return the job's current status
+	var resp = waitJobStatus(r, id, time.Millisecond*10)
+	if resp.status != StatusSuccess || resp.data["job"].(H)["status"] != queue.StatusStarted {
+		t.Fatalf("Expected a started job after timeout, got %#v", resp)
+	}
+
+	go func() {
+		close(release)
+		j.Wait()
+	}()
+	resp = waitJobStatus(r, id, time.Minute)
+	if resp.data["job"].(H)["status"] != queue.StatusSuccessful {
+		t.Fatalf("Expected a successful job, got %#v", resp)
+	}
+}
+
+func TestAnnotateJob(t *testing.T) {
+	JobRunner = queue.New(queue.CommandRunner{Path: "/bin/false"})
+	var id = strconv.FormatInt(JobRunner.QueueJob("fails", nil), 10)
+	var r = &request{ctx: context.Background(), user: "operator"}
+
+	var resp = annotateJob(r, id, "failed due to full disk; re-ran as job 99")
+	if resp.status != StatusSuccess {
+		t.Fatalf("Expected note to be added, got %#v", resp)
+	}
+
+	resp = getJobStatus(r, id)
+	var notes, _ = resp.data["job"].(H)["notes"].([]queue.Note)
+	if len(notes) != 1 || notes[0].Author != "operator" || notes[0].Text != "failed due to full disk; re-ran as job 99" {
+		t.Fatalf("Expected note in job status, got %#v", resp.data["job"])
+	}
+
+	for _, tc := range []struct{ id, text string }{{id, "  "}, {"-1", "hi"}, {"12345", "hi"}} {
+		resp = annotateJob(r, tc.id, tc.text)
+		if resp.status != StatusError {
+			t.Errorf("Expected annotating job %s with %q to fail, got %#v", tc.id, tc.text, resp)
+		}
+	}
+}
+
+func TestJobNotesSurviveRestart(t *testing.T) {
+	var origState = State
+	defer func() { State = origState }()
+	State, _ = state.Open(t.TempDir())
+
+	JobRunner = queue.New(queue.CommandRunner{Path: "/bin/false"})
+	var id = strconv.FormatInt(JobRunner.QueueJob("fails", nil), 10)
+	var r = &request{ctx: context.Background(), user: "operator"}
+	for _, text := range []string{"first", "second"} {
+		var resp = annotateJob(r, id, text)
+		if resp.status != StatusSuccess || resp.data["warning"] != nil {
+			t.Fatalf("Expected note %q to be added and saved, got %#v", text, resp)
+		}
+	}
+
+	// A new queue stands in for a restarted agent, which has forgotten the job
+	JobRunner = queue.New(queue.CommandRunner{Path: "/bin/false"})
+	var resp = getJobStatus(r, id)
+	var rec, _ = resp.data["job"].(queue.Record)
+	if resp.status != StatusSuccess || rec.Name != "fails" || len(rec.Notes) != 2 || rec.Notes[1].Text != "second" {
+		t.Fatalf("Expected the job's saved record with both notes, got %#v", resp)
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	JobRunner = queue.New(queue.CommandRunner{Path: "/bin/false"})
+	var r = &request{ctx: context.Background(), user: "operator"}
+
+	var running = JobRunner.NewFuncJob("slow", func(ctx context.Context, _ *queue.Job) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	var err = running.Start(context.Background())
+	if err != nil {
+		t.Fatalf("Unable to start job: %s", err)
+	}
+	go running.Wait()
+	var resp = cancelJob(r, strconv.FormatInt(running.ID(), 10), "wrong batch")
+	if resp.status != StatusSuccess || resp.data["job"].(H)["status"] != queue.StatusCanceled {
+		t.Fatalf("Expected running job to be canceled, got %#v", resp)
+	}
+	if got := running.Error(); got == nil || !strings.Contains(got.Error(), "by operator: wrong batch") {
+		t.Errorf("Expected the cancel reason in the job's error, got %v", got)
+	}
+
+	var pending = strconv.FormatInt(JobRunner.QueueJob("waiting", nil), 10)
+	resp = cancelJob(r, pending, "")
+	if resp.status != StatusSuccess || resp.data["job"].(H)["status"] != queue.StatusCanceled {
+		t.Fatalf("Expected pending job to be canceled, got %#v", resp)
+	}
+
+	resp = getJobStatus(r, pending)
+	if resp.data["job"].(H)["status"] != queue.StatusCanceled || !strings.HasPrefix(resp.message, "Canceled") {
+		t.Fatalf("Expected job status to report the cancel, got %#v", resp)
+	}
+
+	for _, id := range []string{pending, "-1", "12345"} {
+		resp = cancelJob(r, id, "")
+		if resp.status != StatusError {
+			t.Errorf("Expected canceling job %s to fail, got %#v", id, resp)
+		}
+	}
+}
+
+func TestParseLogFilter(t *testing.T) {
+	var tests = map[string]struct {
+		args     []string
+		expected logFilter
+		hasError bool
+	}{
+		"none":            {args: nil, expected: logFilter{context: defaultErrorContext}},
+		"level":           {args: []string{"--level", "warning"}, expected: logFilter{minLevel: logstream.LevelWarning, context: defaultErrorContext}},
+		"errors":          {args: []string{"--errors"}, expected: logFilter{errors: true, context: defaultErrorContext}},
+		"errors context":  {args: []string{"--errors", "--context", "10"}, expected: logFilter{errors: true, context: 10}},
+		"bad level":       {args: []string{"--level", "debug"}, hasError: true},
+		"level no value":  {args: []string{"--level"}, hasError: true},
+		"context alone":   {args: []string{"--context", "2"}, hasError: true},
+		"too much":        {args: []string{"--errors", "--context", "500"}, hasError: true},
+		"level and error": {args: []string{"--errors", "--level", "error"}, hasError: true},
+		"source since":    {args: []string{"--source", "load_batch", "--since", "2024-06-01T00:00:00Z", "--structured"}, expected: logFilter{source: "load_batch", since: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), structured: true, context: defaultErrorContext}},
+		"bad since":       {args: []string{"--since", "yesterday"}, hasError: true},
+		"source no value": {args: []string{"--source"}, hasError: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got, err = parseLogFilter(tc.args)
+			if tc.hasError {
+				if err == nil {
+					t.Fatalf("Expected an error, got %#v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if got != tc.expected {
+				t.Fatalf("Expected %#v, got %#v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestGetJobLogsFiltered(t *testing.T) {
+	JobRunner = queue.New(queue.CommandRunner{Path: "/bin/false"})
+	var j = JobRunner.NewFuncJob("noisy", func(_ context.Context, j *queue.Job) error {
+		j.Logf("one\ntwo\nWARNING three\nfour\nfive")
+		j.Warnf("Traceback (most recent call last):\n  File \"x.py\", line 1\nOSError: disk full")
+		return nil
+	})
+	var err = j.Start(context.Background())
+	if err != nil {
+		t.Fatalf("Unable to start job: %s", err)
+	}
+	j.Wait()
+	var id = strconv.FormatInt(j.ID(), 10)
+
+	var job = getJobLogs(id, logFilter{minLevel: logstream.LevelWarning}).data["job"].(H)
+	if len(job["stdout"].([]string)) != 1 || len(job["stderr"].([]string)) != 3 {
+		t.Fatalf("Expected one warning on stdout and a traceback on stderr, got %#v", job)
+	}
+
+	job = getJobLogs(id, logFilter{}).data["job"].(H)
+	if len(job["stdout"].([]string)) != 5 || job["filter"] != nil {
+		t.Fatalf("Expected unfiltered logs, got %#v", job)
+	}
+}
+
+func TestGetJobLogsStructured(t *testing.T) {
+	JobRunner = queue.New(queue.CommandRunner{Path: "/bin/echo"})
+	JobRunner.SetSteps(func(int64, []string) ([]queue.Step, []queue.Step) {
+		return nil, []queue.Step{{Path: "/bin/echo", Args: []string{"ERROR cdn purge failed"}}}
+	})
+	var j = JobRunner.NewJob("load", []string{"load_batch", "batch_foo"})
+	var err = j.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Unable to run job: %s", err)
+	}
+	j.Warnf("checking the batch")
+	var id = strconv.FormatInt(j.ID(), 10)
+
+	var job = getJobLogs(id, logFilter{structured: true}).data["job"].(H)
+	var diff = cmp.Diff([]string{"load_batch", queue.AgentSource, "echo"}, job["sources"])
+	if diff != "" {
+		t.Fatal(diff)
+	}
+	if job["stdout"] != nil {
+		t.Errorf("Expected no flat logs in a structured response, got %#v", job["stdout"])
+	}
+
+	type entry struct{ stream, source, level, line string }
+	var got []entry
+	for _, e := range job["entries"].([]jobLogEntry) {
+		got = append(got, entry{e.Stream, e.Source, e.Level, e.Line})
+	}
+	diff = cmp.Diff([]entry{
+		{"stdout", "load_batch", "info", "load_batch batch_foo"},
+		{"stdout", queue.AgentSource, "info", "Running post-job step: /bin/echo ERROR cdn purge failed"},
+		{"stdout", "echo", "error", "ERROR cdn purge failed"},
+		{"stderr", queue.AgentSource, "warning", "checking the batch"},
+	}, got, cmp.AllowUnexported(entry{}))
+	if diff != "" {
+		t.Fatal(diff)
+	}
+
+	// Filters apply to flat and structured logs alike
+	job = getJobLogs(id, logFilter{source: queue.AgentSource}).data["job"].(H)
+	if len(job["stdout"].([]string)) != 1 || len(job["stderr"].([]string)) != 1 || job["filter"] != `source "agent"` {
+		t.Fatalf("Expected only the agent's lines, got %#v", job)
+	}
+	job = getJobLogs(id, logFilter{source: "echo", minLevel: logstream.LevelError, structured: true}).data["job"].(H)
+	if len(job["entries"].([]jobLogEntry)) != 1 {
+		t.Fatalf("Expected the post step's error, got %#v", job["entries"])
+	}
+	job = getJobLogs(id, logFilter{since: time.Now().Add(time.Hour)}).data["job"].(H)
+	if len(job["stdout"].([]string)) != 0 || len(job["stderr"].([]string)) != 0 {
+		t.Fatalf("Expected nothing logged in the future, got %#v", job)
+	}
+}
+
+func TestListJobs(t *testing.T) {
+	JobRunner = queue.New(queue.CommandRunner{Path: "/bin/false"})
+	for _, name := range []string{"bravo", "alpha", "charlie"} {
+		JobRunner.NewFuncJob(name, func(context.Context, *queue.Job) error { return nil })
+	}
+
+	var names = func(resp response) []string {
+		var list []string
+		for _, j := range resp.collect().data["jobs"].([]any) {
+			list = append(list, j.(H)["name"].(string))
+		}
+		return list
+	}
+
+	var tests = map[string]struct {
+		args     []string
+		expected string
+	}{
+		"default":   {args: []string{"--stream"}, expected: "bravo alpha charlie"},
+		"name":      {args: []string{"--stream", "--sort", "name"}, expected: "alpha bravo charlie"},
+		"name desc": {args: []string{"--sort", "name", "--desc", "--stream"}, expected: "charlie bravo alpha"},
+		"id desc":   {args: []string{"--stream", "--desc", "--sort", "id"}, expected: "charlie alpha bravo"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var resp = listJobs(&request{args: tc.args})
+			if resp.stream == nil {
+				t.Fatalf("Expected a streaming response, got %#v", resp)
+			}
+			var got = strings.Join(names(resp), " ")
+			if got != tc.expected {
+				t.Fatalf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+
+	var resp = listJobs(&request{})
+	if resp.stream != nil || len(resp.data["jobs"].([]H)) != 3 {
+		t.Fatalf("Expected a plain list of three jobs, got %#v", resp)
+	}
+
+	for _, args := range [][]string{{"--sort"}, {"--sort", "size"}, {"--bogus"}} {
+		resp = listJobs(&request{args: args})
+		if resp.status != StatusError {
+			t.Errorf("Expected %q to be rejected, got %#v", args, resp)
+		}
+	}
+}
+
+func TestJobTimes(t *testing.T) {
+	JobRunner = queue.New(queue.CommandRunner{Path: "/bin/false"})
+	var release = make(chan struct{})
+	var id = JobRunner.QueueFunc("timed", func(context.Context, *queue.Job) error {
+		<-release
+		return nil
+	})
+	var j = JobRunner.GetJob(id)
+
+	// Pending: only waiting so far
+	var data = jobSummary(j)
+	if _, ok := data["wait_seconds"]; !ok || data["started"] != nil || data["run_seconds"] != nil {
+		t.Fatalf("Expected only a wait time for a pending job, got %#v", data)
+	}
+
+	time.Sleep(time.Millisecond * 20)
+	j.Start(context.Background())
+	close(release)
+	j.Wait()
+
+	data = jobSummary(j)
+	var wait, run = data["wait_seconds"].(float64), data["run_seconds"].(float64)
+	if wait < 0.02 || run < 0 || data["completed"] != j.CompletedAt() {
+		t.Fatalf("Unexpected times for a finished job: %#v", data)
+	}
+	var total = j.CompletedAt().Sub(j.QueuedAt()).Seconds()
+	if diff := total - wait - run; diff > 0.001 || diff < -0.001 {
+		t.Errorf("Expected wait (%f) and run (%f) to add up to %f", wait, run, total)
+	}
+
+	// A job which fails to start still has a completion time, but no run time
+	var failed = JobRunner.NewJob("bad", []string{"x"})
+	failed.Cancel("")
+	failed.Run(context.Background())
+	data = jobSummary(failed)
+	if data["completed"] == nil || data["run_seconds"] != nil || data["wait_seconds"] != nil {
+		t.Errorf("Unexpected times for a job which never started: %#v", data)
+	}
+}
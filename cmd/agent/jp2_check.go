@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/open-oni/oni-agent/internal/batchxml"
+	"github.com/open-oni/oni-agent/internal/jp2"
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+// jp2ValidatorTimeout is how long the external validator gets per file
+const jp2ValidatorTimeout = time.Minute * 5
+
+// jp2Result is the compliance report for a single JP2
+type jp2Result struct {
+	File      string    `json:"file"`
+	Compliant bool      `json:"compliant"`
+	Problems  []string  `json:"problems,omitempty"`
+	Info      *jp2.Info `json:"info,omitempty"`
+
+	// ValidatorOutput is whatever JP2_VALIDATOR printed, if it was run
+	ValidatorOutput string `json:"validator_output,omitempty"`
+}
+
+// jp2Report is the artifact a check-jp2 job produces
+type jp2Report struct {
+	Batch        string      `json:"batch"`
+	Profile      string      `json:"profile"`
+	Validator    string      `json:"validator,omitempty"`
+	Generated    time.Time   `json:"generated"`
+	Files        int         `json:"files"`
+	NonCompliant int         `json:"non_compliant"`
+	Results      []jp2Result `json:"results"`
+}
+
+// batchJP2s returns every JP2 referenced by the batch's issue METS files, in
+// batch order
+func batchJP2s(batchPath string) ([]string, error) {
+	var b, err = batchxml.Read(batchPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, i := range b.Issues {
+		var m, err = i.ReadMETS(batchPath)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", i.Filepath, err)
+		}
+		for _, f := range m.Files {
+			if strings.EqualFold(f.Ext(), ".jp2") {
+				files = append(files, f.Join(i.Dir(batchPath)))
+			}
+		}
+	}
+	return files, nil
+}
+
+// checkJP2 checks a single file's headers against the profile and, if a
+// validator is given, runs it too. Either one failing makes the file
+// non-compliant.
+func checkJP2(ctx context.Context, fname string, p jp2.Profile, validator string) jp2Result {
+	var r = jp2Result{File: fname}
+	var f, err = os.Open(fname)
+	if err == nil {
+		r.Info, err = jp2.Read(f)
+		f.Close()
+	}
+	if err != nil {
+		r.Problems = append(r.Problems, err.Error())
+	} else {
+		r.Problems = append(r.Problems, p.Check(r.Info)...)
+	}
+
+	if validator != "" {
+		var vctx, cancel = context.WithTimeout(ctx, jp2ValidatorTimeout)
+		var out []byte
+		out, err = exec.CommandContext(vctx, validator, fname).CombinedOutput()
+		cancel()
+		r.ValidatorOutput = string(bytes.TrimSpace(out))
+		if err != nil {
+			r.Problems = append(r.Problems, fmt.Sprintf("validator failed: %s", err))
+		}
+	}
+
+	r.Compliant = len(r.Problems) == 0
+	return r
+}
+
+// runJP2Check returns the check-jp2 job for the given batch
+func runJP2Check(name, batchPath string) queue.RunFunc {
+	return func(ctx context.Context, j *queue.Job) error {
+		var files, err = batchJP2s(batchPath)
+		if err != nil {
+			return err
+		}
+
+		var report = jp2Report{Batch: name, Profile: jp2.NDNP.Name, Validator: JP2Validator, Files: len(files), Results: []jp2Result{}}
+		j.Logf("Checking %d JP2s in %s against the %s profile", len(files), name, report.Profile)
+		for _, fname := range files {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			var r = checkJP2(ctx, fname, jp2.NDNP, JP2Validator)
+			if !r.Compliant {
+				report.NonCompliant++
+				j.Warnf("%s: %s", fname, strings.Join(r.Problems, "; "))
+			}
+			report.Results = append(report.Results, r)
+		}
+		report.Generated = time.Now()
+		j.Logf("%d of %d JP2s are compliant", report.Files-report.NonCompliant, report.Files)
+
+		var data []byte
+		data, err = json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return fmt.Errorf("encoding report: %w", err)
+		}
+		var artifactName = fmt.Sprintf("jp2-%s-%s.json", name, report.Generated.UTC().Format("20060102T150405"))
+		err = Artifacts.Put(artifactName, bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("storing report: %w", err)
+		}
+		j.AddArtifact(artifactName)
+		j.Logf("Report stored as artifact %q", artifactName)
+
+		if report.NonCompliant > 0 {
+			return fmt.Errorf("%d JP2s do not comply with the %s profile", report.NonCompliant, report.Profile)
+		}
+		return nil
+	}
+}
+
+func checkBatchJP2s(name string) response {
+	if Artifacts == nil {
+		return respond(StatusError, "Artifact storage is not enabled", nil)
+	}
+	if !batchNameRegexp.MatchString(name) {
+		return respond(StatusError, fmt.Sprintf("%q is not a valid batch name", name), nil)
+	}
+
+	var batchPath, err = findBatch(name)
+	if err == nil {
+		err = validateBatch(batchPath)
+	}
+	if err != nil {
+		return respond(StatusError, fmt.Sprintf("%q cannot be checked", name), H{"error": err.Error()})
+	}
+
+	var id = JobRunner.QueueFunc("Check JP2s for "+name, runJP2Check(name, batchPath))
+	return respond(StatusSuccess, "Job added to queue", H{"job": H{"id": id}})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sync"
+
+	"github.com/open-oni/oni-agent/pkg/queue"
+	"github.com/spf13/afero"
+)
+
+// errBatchChanged is returned when a load is stopped because its batch isn't
+// what was validated
+var errBatchChanged = errors.New("batch changed since validation")
+
+// batchContents summarizes every file in a batch by path, size, and
+// modification time. Unlike batchFingerprint it looks at every file, so it
+// sees an issue's files being edited, added, or removed; it's still only a
+// walk of the batch, not a read of its contents. Symlinks are followed, since
+// derived batches link to their issues' directories in the source batch. The
+// agent's own metadata files are left out, since writing them doesn't change
+// what ONI loads.
+func batchContents(batchPath string) (string, error) {
+	var h = sha256.New()
+	var n int
+	var add = func(rel string, info fs.FileInfo) {
+		if rel == derivedMarker || rel == batchManifestName {
+			return
+		}
+		n++
+		fmt.Fprintf(h, "%s\x00%d\x00%d\n", rel, info.Size(), info.ModTime().UnixNano())
+	}
+
+	// walk hashes everything under dir as if it were at relDir in the batch.
+	// seen holds the directories being walked, so a link to one of them is an
+	// error rather than a walk which never ends.
+	var seen = make(map[string]bool)
+	var walk func(dir, relDir string) error
+	walk = func(dir, relDir string) error {
+		return afero.Walk(agentFS, dir, func(path string, info fs.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			var rel, _ = filepath.Rel(dir, path)
+			rel = filepath.ToSlash(filepath.Join(relDir, rel))
+			if info.Mode()&fs.ModeSymlink == 0 {
+				if info.Mode().IsRegular() {
+					add(rel, info)
+				}
+				return nil
+			}
+
+			var target string
+			target, err = resolveLink(path)
+			if err == nil {
+				info, err = agentFS.Stat(target)
+			}
+			if err != nil {
+				return fmt.Errorf("following %s: %w", rel, err)
+			}
+			if info.Mode().IsRegular() {
+				add(rel, info)
+			}
+			if !info.IsDir() {
+				return nil
+			}
+			if seen[target] {
+				return fmt.Errorf("following %s: symlink loop", rel)
+			}
+			seen[target] = true
+			err = walk(target, rel)
+			delete(seen, target)
+			return err
+		})
+	}
+
+	var root = filepath.Clean(batchPath)
+	var info, err = lstat(root)
+	if err == nil && info.Mode()&fs.ModeSymlink != 0 {
+		root, err = resolveLink(root)
+	}
+	if err == nil {
+		seen[root] = true
+		err = walk(batchPath, "")
+	}
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d:%s", n, hex.EncodeToString(h.Sum(nil))), nil
+}
+
+// loadContents holds the contents fingerprint each queued load's batch had
+// when it was validated, keyed by the load's job id, so two loads of one
+// batch are each checked against their own validation
+var loadContents = struct {
+	sync.Mutex
+	m map[int64]string
+}{m: make(map[int64]string)}
+
+// queueCheckedLoad queues a load of the batch which only runs if the batch
+// still has the contents it was validated with. The job's id isn't known
+// until it's queued, so loadContents stays locked until it's recorded, and
+// the job's check waits for that if it runs first.
+func queueCheckedLoad(jobName, batchPath, contents string) response {
+	loadContents.Lock()
+	defer loadContents.Unlock()
+	var resp = queueJob(jobName, "load_batch", []string{batchPath})
+	if resp.status == StatusSuccess {
+		loadContents.m[resp.data["job"].(H)["id"].(int64)] = contents
+	}
+	return resp
+}
+
+// expectBatchContents records what a load's batch looked like when it was
+// validated
+func expectBatchContents(id int64, contents string) {
+	loadContents.Lock()
+	defer loadContents.Unlock()
+	loadContents.m[id] = contents
+}
+
+// isLoadBatch returns true if args are a load_batch command, returning the
+// batch's path
+func isLoadBatch(args []string) (string, bool) {
+	if len(args) != 2 || args[0] != "load_batch" {
+		return "", false
+	}
+	return filepath.Clean(args[1]), true
+}
+
+// forgetLoadContents is the load_contents subscriber's handler for finished
+// jobs
+func forgetLoadContents(j *queue.Job) {
+	loadContents.Lock()
+	defer loadContents.Unlock()
+	delete(loadContents.m, j.ID())
+}
+
+// checkLoadUnchanged is the queue's CheckFunc: a load_batch job fails to
+// start if its batch has changed since it was validated. Jobs for batches
+// with nothing recorded, and every other kind of job, are left alone.
+func checkLoadUnchanged(id int64, args []string) error {
+	var path, ok = isLoadBatch(args)
+	if !ok {
+		return nil
+	}
+	loadContents.Lock()
+	var want, found = loadContents.m[id]
+	loadContents.Unlock()
+	if !found {
+		return nil
+	}
+
+	var got, err = batchContents(path)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errBatchChanged, err)
+	}
+	if got != want {
+		return fmt.Errorf("%w: files in %s were added, removed, or modified after it was validated; run validate-batch with --revalidate and load it again", errBatchChanged, path)
+	}
+	return nil
+}
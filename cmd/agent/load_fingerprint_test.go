@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/open-oni/oni-agent/pkg/queue"
+	"github.com/spf13/afero"
+)
+
+func TestCheckLoadUnchanged(t *testing.T) {
+	var origTTL = ValidationCacheTTL
+	defer func() { ValidationCacheTTL = origTTL }()
+	ValidationCacheTTL = time.Hour
+
+	var dir = filepath.Join(t.TempDir(), "batch_oru_changed_ver01")
+	os.MkdirAll(filepath.Join(dir, "data", "sn83025138"), 0755)
+	os.WriteFile(filepath.Join(dir, "data", "batch.xml"), []byte(`<batch name="batch_oru_changed_ver01" awardee="oru" awardYear="2019"></batch>`), 0644)
+	var page = filepath.Join(dir, "data", "sn83025138", "0001.jp2")
+	os.WriteFile(page, []byte("jp2"), 0644)
+
+	var v, err = validateBatchCached(dir, false)
+	if err != nil {
+		t.Fatalf("Unable to validate batch: %s", err)
+	}
+	if v.Contents == "" {
+		t.Fatal("Expected validation to record the batch's contents")
+	}
+	var args = []string{"load_batch", dir}
+	var load = queue.New(queue.CommandRunner{Path: "/bin/false"}).NewJob("load", args)
+	defer forgetLoadContents(load)
+	expectBatchContents(load.ID(), v.Contents)
+
+	err = checkLoadUnchanged(load.ID(), args)
+	if err != nil {
+		t.Fatalf("Expected an unchanged batch to load, got %s", err)
+	}
+
+	// An edit deep in the batch is missed by the validation cache, so the
+	// load is what catches it
+	var later = time.Now().Add(time.Minute)
+	os.WriteFile(page, []byte("jp3"), 0644)
+	os.Chtimes(page, later, later)
+	v, _ = validateBatchCached(dir, false)
+	if !v.Cached {
+		t.Fatalf("Expected the cached validation, got %#v", v)
+	}
+	expectBatchContents(load.ID(), v.Contents)
+	err = checkLoadUnchanged(load.ID(), args)
+	if !errors.Is(err, errBatchChanged) {
+		t.Fatalf("Expected a changed batch to be refused, got %v", err)
+	}
+
+	// Revalidating picks up the change
+	v, _ = validateBatchCached(dir, true)
+	expectBatchContents(load.ID(), v.Contents)
+	err = checkLoadUnchanged(load.ID(), args)
+	if err != nil {
+		t.Fatalf("Expected a revalidated batch to load, got %s", err)
+	}
+
+	// The agent's own metadata doesn't count as a change
+	os.WriteFile(filepath.Join(dir, derivedMarker), []byte("{}"), 0644)
+	err = checkLoadUnchanged(load.ID(), args)
+	if err != nil {
+		t.Fatalf("Expected agent metadata to be ignored, got %s", err)
+	}
+
+	// Other jobs, and loads nothing was recorded for, aren't checked
+	for _, other := range [][]string{nil, {"purge_batch", dir}} {
+		err = checkLoadUnchanged(load.ID(), other)
+		if err != nil {
+			t.Errorf("Expected %q not to be checked, got %s", other, err)
+		}
+	}
+	os.WriteFile(page, []byte("jp4"), 0644)
+	err = checkLoadUnchanged(load.ID()+1, args)
+	if err != nil {
+		t.Errorf("Expected a load with no validation recorded not to be checked, got %s", err)
+	}
+}
+
+func TestBatchContentsFollowsLinks(t *testing.T) {
+	var src = filepath.Join(t.TempDir(), "batch_oru_source_ver01")
+	var issue = filepath.Join(src, "data", "sn83025138", "1910010101")
+	os.MkdirAll(issue, 0755)
+	var page = filepath.Join(issue, "0001.jp2")
+	os.WriteFile(page, []byte("jp2"), 0644)
+
+	// A derived batch has its own batch.xml, and links to the source batch's
+	// issue directories
+	var derived = filepath.Join(t.TempDir(), "batch_oru_derived_ver01")
+	os.MkdirAll(filepath.Join(derived, "data"), 0755)
+	os.WriteFile(filepath.Join(derived, "data", "batch.xml"), []byte("<batch/>"), 0644)
+	var err = linkIssueDir(filepath.Join(derived, "data"), "sn83025138/1910010101", issue)
+	if err != nil {
+		t.Fatalf("Unable to link issue: %s", err)
+	}
+
+	var before string
+	before, err = batchContents(derived)
+	if err != nil {
+		t.Fatalf("Unable to read batch contents: %s", err)
+	}
+	if !strings.HasPrefix(before, "2:") {
+		t.Fatalf("Expected the linked issue's page to be counted, got %q", before)
+	}
+
+	var args = []string{"load_batch", derived}
+	var load = queue.New(queue.CommandRunner{Path: "/bin/false"}).NewJob("load", args)
+	defer forgetLoadContents(load)
+	expectBatchContents(load.ID(), before)
+	var later = time.Now().Add(time.Minute)
+	os.WriteFile(page, []byte("jp3"), 0644)
+	os.Chtimes(page, later, later)
+	err = checkLoadUnchanged(load.ID(), args)
+	if !errors.Is(err, errBatchChanged) {
+		t.Fatalf("Expected an edit under a linked issue to be caught, got %v", err)
+	}
+
+	// A link back into the batch is an error, not an endless walk
+	os.Symlink(derived, filepath.Join(derived, "data", "loop"))
+	_, err = batchContents(derived)
+	if err == nil {
+		t.Fatal("Expected a symlink loop to be an error")
+	}
+}
+
+func TestLoadContentsPerJob(t *testing.T) {
+	var dir = t.TempDir()
+	os.WriteFile(filepath.Join(dir, "batch.xml"), []byte("<batch/>"), 0644)
+	var contents, err = batchContents(dir)
+	if err != nil {
+		t.Fatalf("Unable to read batch contents: %s", err)
+	}
+
+	// Two loads of one batch: the first was validated before an edit, the
+	// second after it, and each is checked against its own validation
+	var q = queue.New(queue.CommandRunner{Path: "/bin/false"})
+	var args = []string{"load_batch", dir}
+	var first, second = q.NewJob("load", args), q.NewJob("load", args)
+	expectBatchContents(first.ID(), "1:stale")
+	expectBatchContents(second.ID(), contents)
+	err = checkLoadUnchanged(first.ID(), args)
+	if !errors.Is(err, errBatchChanged) {
+		t.Fatalf("Expected the first load to be checked against its own validation, got %v", err)
+	}
+	err = checkLoadUnchanged(second.ID(), args)
+	if err != nil {
+		t.Fatalf("Expected the second load to match its validation, got %s", err)
+	}
+
+	// Finishing one load forgets only what was recorded for it
+	forgetLoadContents(first)
+	loadContents.Lock()
+	var _, firstKept = loadContents.m[first.ID()]
+	var _, secondKept = loadContents.m[second.ID()]
+	loadContents.Unlock()
+	if firstKept || !secondKept {
+		t.Fatalf("Expected only the first load to be forgotten, got %v and %v", firstKept, secondKept)
+	}
+	forgetLoadContents(second)
+}
+
+func TestBatchContentsMemFS(t *testing.T) {
+	var origFS = agentFS
+	defer func() { agentFS = origFS }()
+	agentFS = afero.NewMemMapFs()
+
+	var dir = "/batches/batch_oru_mem_ver01"
+	afero.WriteFile(agentFS, filepath.Join(dir, "data", "batch.xml"), []byte("<batch/>"), 0644)
+	afero.WriteFile(agentFS, filepath.Join(dir, "data", "sn83025138", "0001.jp2"), []byte("jp2"), 0644)
+	var got, err = batchContents(dir)
+	if err != nil {
+		t.Fatalf("Unable to read batch contents from memory: %s", err)
+	}
+	if !strings.HasPrefix(got, "2:") {
+		t.Fatalf("Expected both files to be counted, got %q", got)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+// LookupCacheTTL is how long a batch or awardee existence check is trusted.
+// It's short: it only has to absorb the bursts of retries NCA sends during
+// ingest, and the agent can't see changes made to ONI behind its back.
+var LookupCacheTTL = time.Second * 30
+
+// lookupCache remembers whether things exist in ONI's database
+type lookupCache struct {
+	m       sync.Mutex
+	entries map[string]lookupEntry
+	hits    int64
+	misses  int64
+}
+
+type lookupEntry struct {
+	exists bool
+	at     time.Time
+}
+
+func newLookupCache() *lookupCache {
+	return &lookupCache{entries: make(map[string]lookupEntry)}
+}
+
+// Caches for checkBatch and ensureAwardee
+var (
+	batchLookups   = newLookupCache()
+	awardeeLookups = newLookupCache()
+)
+
+// get returns whether key exists, if it's been looked up within
+// LookupCacheTTL
+func (c *lookupCache) get(key string) (exists, ok bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	var e, found = c.entries[key]
+	if !found || time.Since(e.at) >= LookupCacheTTL {
+		c.misses++
+		return false, false
+	}
+	c.hits++
+	return e.exists, true
+}
+
+// set records whether key exists
+func (c *lookupCache) set(key string, exists bool) {
+	if LookupCacheTTL <= 0 {
+		return
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.entries[key] = lookupEntry{exists: exists, at: time.Now()}
+
+	// Everything's short-lived, so expired entries are dropped whenever the
+	// cache gets big rather than on a timer
+	if len(c.entries) > 1000 {
+		for k, e := range c.entries {
+			if time.Since(e.at) >= LookupCacheTTL {
+				delete(c.entries, k)
+			}
+		}
+	}
+}
+
+// forget drops key, so the next lookup goes to the database
+func (c *lookupCache) forget(key string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	delete(c.entries, key)
+}
+
+// stats reports the cache's hit and miss counts for metrics
+func (c *lookupCache) stats() H {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return H{"hits": c.hits, "misses": c.misses, "entries": len(c.entries)}
+}
+
+// forgetJobLookups is called for every finished job: once a load or
+// purge job is done, whatever the outcome, the batch's cached existence may be
+// wrong. A failed job may still have changed something, so it's not just
+// successes.
+func forgetJobLookups(j *queue.Job) {
+	var args = j.Args()
+	if len(args) < 2 || batchJobActions[args[0]] == "" {
+		return
+	}
+	batchLookups.forget(filepath.Base(args[1]))
+}
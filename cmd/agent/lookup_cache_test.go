@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+func TestLookupCache(t *testing.T) {
+	var origTTL, origLookups = LookupCacheTTL, batchLookups
+	defer func() { LookupCacheTTL, batchLookups = origTTL, origLookups }()
+	LookupCacheTTL = time.Minute
+	batchLookups = newLookupCache()
+
+	var _, ok = batchLookups.get("batch_oru_foo_ver01")
+	if ok {
+		t.Fatalf("Expected an empty cache")
+	}
+
+	// checkBatch answers from the cache without touching the database
+	batchLookups.set("batch_oru_foo_ver01", true)
+	var exists, err = checkBatch("batch_oru_foo_ver01")
+	if err != nil || !exists {
+		t.Fatalf("Expected a cached answer, got %v, %v", exists, err)
+	}
+
+	// A finished load or purge job drops its batch, by path or name
+	var q = queue.New(queue.CommandRunner{Path: "/bin/false"})
+	q.SetHooks(queue.Hooks{Finished: forgetJobLookups})
+	batchLookups.set("batch_oru_bar_ver01", false)
+	q.NewJob("load", []string{"load_batch", "/mnt/batches/batch_oru_foo_ver01"}).Run(context.Background())
+	q.NewJob("other", []string{"load_titles", "batch_oru_bar_ver01"}).Run(context.Background())
+	if _, ok = batchLookups.get("batch_oru_foo_ver01"); ok {
+		t.Errorf("Expected the loaded batch to be forgotten")
+	}
+	if _, ok = batchLookups.get("batch_oru_bar_ver01"); !ok {
+		t.Errorf("Expected an unrelated job to leave the cache alone")
+	}
+	q.NewJob("purge", []string{"purge_batch", "batch_oru_bar_ver01"}).Run(context.Background())
+	if _, ok = batchLookups.get("batch_oru_bar_ver01"); ok {
+		t.Errorf("Expected the purged batch to be forgotten")
+	}
+
+	// Entries expire, and a zero TTL disables the cache
+	batchLookups.entries["old"] = lookupEntry{exists: true, at: time.Now().Add(-time.Hour)}
+	if _, ok = batchLookups.get("old"); ok {
+		t.Errorf("Expected an expired entry to be ignored")
+	}
+	LookupCacheTTL = 0
+	batchLookups.set("new", true)
+	if _, ok = batchLookups.get("new"); ok {
+		t.Errorf("Expected nothing to be cached with a zero TTL")
+	}
+
+	var stats = batchLookups.stats()
+	if stats["hits"] != int64(2) || stats["misses"] != int64(5) {
+		t.Errorf("Unexpected stats: %v", stats)
+	}
+}
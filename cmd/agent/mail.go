@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// smtpConfig is how the agent sends email, from the SMTP_* settings
+type smtpConfig struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+// SMTP holds the mail settings; email is disabled unless Addr is set
+var SMTP smtpConfig
+
+// IngestReportRecipients maps awardee org codes to the addresses their
+// ingest reports are emailed to, from INGEST_REPORT_RECIPIENTS
+var IngestReportRecipients map[string][]string
+
+// readReportRecipients reads and validates the recipients file, a JSON object
+// of awardee org codes to lists of addresses
+func readReportRecipients(fname string) (map[string][]string, error) {
+	var data, err = os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var recipients map[string][]string
+	err = json.Unmarshal(data, &recipients)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", fname, err)
+	}
+
+	for code, list := range recipients {
+		if code == "" || len(list) == 0 {
+			return nil, errors.New("recipients must be lists of addresses keyed by awardee org code")
+		}
+		for _, addr := range list {
+			var _, err = mail.ParseAddress(addr)
+			if err != nil {
+				return nil, fmt.Errorf("recipient for %q: %q is not a valid address", code, addr)
+			}
+		}
+	}
+	return recipients, nil
+}
+
+// buildMessage returns a plain-text email ready to send
+func buildMessage(from string, to []string, subject, body string, now time.Time) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// sendMail emails a plain-text message to every address in to, from
+// SMTP_FROM, through the configured SMTP server
+var sendMail = func(to []string, subject, body string) error {
+	if SMTP.Addr == "" {
+		return errors.New("email is not configured (SMTP_ADDR is not set)")
+	}
+
+	var auth smtp.Auth
+	if SMTP.Username != "" {
+		var host, _, _ = net.SplitHostPort(SMTP.Addr)
+		auth = smtp.PlainAuth("", SMTP.Username, SMTP.Password, host)
+	}
+	var from, err = mail.ParseAddress(SMTP.From)
+	if err != nil {
+		return fmt.Errorf("SMTP_FROM: %w", err)
+	}
+	var rcpt []string
+	for _, addr := range to {
+		var a, err = mail.ParseAddress(addr)
+		if err != nil {
+			return err
+		}
+		rcpt = append(rcpt, a.Address)
+	}
+	return smtp.SendMail(SMTP.Addr, auth, from.Address, rcpt, buildMessage(SMTP.From, to, subject, body, time.Now()))
+}
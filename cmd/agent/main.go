@@ -4,24 +4,37 @@
 
 import (
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
 	"database/sql"
-	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
+	"log"
 	"log/slog"
+	"net"
+	"net/mail"
+	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
 
 	gliderssh "github.com/gliderlabs/ssh"
 	_ "github.com/go-sql-driver/mysql"
-	"github.com/open-oni/oni-agent/internal/queue"
+	"github.com/open-oni/oni-agent/internal/artifact"
+	"github.com/open-oni/oni-agent/internal/jobarchive"
+	"github.com/open-oni/oni-agent/internal/latency"
+	"github.com/open-oni/oni-agent/internal/oni"
+	"github.com/open-oni/oni-agent/internal/onidb"
+	"github.com/open-oni/oni-agent/internal/solr"
+	"github.com/open-oni/oni-agent/internal/state"
 	"github.com/open-oni/oni-agent/internal/version"
-	"golang.org/x/crypto/ssh"
+	"github.com/open-oni/oni-agent/pkg/logstream"
+	"github.com/open-oni/oni-agent/pkg/queue"
+	"google.golang.org/grpc"
 )
 
 // BABind is the address and port to bind this process
@@ -34,25 +47,120 @@
 // BatchSource is where batches can be found, necessary for the "load" command
 var BatchSource string
 
-// HostKeyFile is the path to the ssh key
-var HostKeyFile string
+// BatchPathTemplate optionally describes how batches are laid out under
+// BatchSource, e.g., "{awardee}/{name}". If empty, batches are expected
+// directly inside BatchSource.
+var BatchPathTemplate string
 
-// HostKeySigner is used for the ssh key presented to clients
-var HostKeySigner ssh.Signer
+// HostKeyFiles are the paths to the ssh host keys
+var HostKeyFiles []string
+
+// HostKeyType is the type of key generated when a host key file doesn't exist
+var HostKeyType string
+
+// HostKeys are the ssh host keys presented to clients
+var HostKeys []hostKey
 
 // JobRunner manages all the details needed for keeping a list of pending
 // background jobs, providing status of existing jobs, etc.
 var JobRunner *queue.Queue
 
+// JobArchiveDir is an optional path where purged jobs are archived
+var JobArchiveDir string
+
+// JobArchive reads and writes archived jobs if JobArchiveDir or an S3
+// bucket is configured
+var JobArchive *jobarchive.Archive
+
+// jobArchivePrefix is added to ArtifactS3.Prefix for archived jobs' keys. It
+// keeps them out of list-artifacts, which only lists keys directly under the
+// artifact prefix.
+const jobArchivePrefix = "job-archive/"
+
+// JobRetention is how long finished jobs are kept in memory before being
+// purged (and archived if JobArchive is set). Zero means the queue's defaults
+// are used.
+var JobRetention time.Duration
+
+// JP2Validator is an optional external program check-jp2 runs on every JP2,
+// in addition to its own header checks
+var JP2Validator string
+
+// JobStallThreshold is how long a running job can go without producing any
+// output before it's reported as stalled; zero disables the check
+var JobStallThreshold = time.Hour * 2
+
+// JobTimeout is how long a job may run before it's canceled; zero means no
+// limit
+var JobTimeout time.Duration
+
+// Workers is how many jobs may run at once. Jobs which could interfere with
+// each other still run one at a time; see jobClass.
+var Workers = 1
+
+// ShutdownGrace is how long a running job gets to finish when the agent is
+// shutting down before it's canceled
+var ShutdownGrace = time.Second * 30
+
+// JobHooksFile is an optional JSON file configuring scripts to run before
+// and after jobs, by ONI command
+var JobHooksFile string
+
+// JobHookDir holds the only scripts job hooks may run
+var JobHookDir string
+
+// StateDir is an optional path where the agent keeps its own persistent state
+var StateDir string
+
+// State reads and writes persistent state files if StateDir is set
+var State *state.Dir
+
+// ArtifactDir is an optional path where jobs store reports and other files
+// for clients to retrieve
+var ArtifactDir string
+
+// ArtifactS3 holds the optional object storage settings for artifacts; if
+// ArtifactS3.Bucket is set, artifacts are stored there instead of ArtifactDir
+var ArtifactS3 artifact.S3Config
+
+// ArtifactURLExpiry is how long artifact URLs given to clients stay valid
+var ArtifactURLExpiry = time.Hour
+
+// Artifacts reads and writes job artifacts if ArtifactDir or an S3 bucket is
+// configured
+var Artifacts artifact.Store
+
+// Redactor scrubs secrets out of job logs
+var Redactor *logstream.Redactor
+
+// GRPC holds the optional gRPC server settings; if GRPC.bind is empty, gRPC
+// is disabled
+var GRPC grpcConfig
+
+// sessionID is the sequence used to give every client connection, regardless
+// of transport, a unique id for logging
+var sessionID atomic.Int64
+
 // dbPool is our single DB connection shared app-wide
-var dbPool *sql.DB
+var dbPool *timedDB
+
+// dbReplica is an optional read-only connection, e.g., to a MySQL replica,
+// for heavy reporting queries which shouldn't load the primary
+var dbReplica *timedDB
+
+// ONIDB is the detected schema of ONI's database, and holds all the queries
+// we run against it
+var ONIDB *onidb.Schema
+
+// CommandStats tracks how long each command takes to handle
+var CommandStats = latency.NewTracker(0)
 
 func getEnvironment() {
 	var errList []error
 	var err error
 
 	BABind = os.Getenv("BA_BIND")
-	if BABind == "" {
+	if BABind == "" && oneShot == nil {
 		errList = append(errList, errors.New("BA_BIND must be set"))
 	}
 
@@ -77,13 +185,50 @@ func getEnvironment() {
 	ONILocation = envDir("ONI_LOCATION")
 	BatchSource = envDir("BATCH_SOURCE")
 
-	HostKeyFile = os.Getenv("HOST_KEY_FILE")
-	if HostKeyFile == "" {
-		errList = append(errList, errors.New("HOST_KEY_FILE must be set"))
-	} else {
-		HostKeySigner, err = readKey(HostKeyFile)
+	ONILockFile = os.Getenv("ONI_LOCK_FILE")
+	switch ONILockFile {
+	case "":
+		ONILockFile = filepath.Join(ONILocation, defaultONILockName)
+	case "none":
+		ONILockFile = ""
+	}
+	BatchPathTemplate = os.Getenv("BATCH_PATH_TEMPLATE")
+	if BatchPathTemplate != "" {
+		err = validatePathTemplate(BatchPathTemplate)
+		if err != nil {
+			errList = append(errList, fmt.Errorf("BATCH_PATH_TEMPLATE is invalid: %w", err))
+		}
+	}
+
+	HostKeyType = os.Getenv("HOST_KEY_TYPE")
+	if HostKeyType == "" {
+		HostKeyType = keyTypeED25519
+	}
+	if HostKeyType != keyTypeED25519 && HostKeyType != keyTypeRSA {
+		errList = append(errList, fmt.Errorf("HOST_KEY_TYPE must be %q or %q", keyTypeED25519, keyTypeRSA))
+	}
+
+	HostKeyFiles = splitList(os.Getenv("HOST_KEY_FILES"))
+	if len(HostKeyFiles) == 0 && os.Getenv("HOST_KEY_FILE") != "" {
+		HostKeyFiles = []string{os.Getenv("HOST_KEY_FILE")}
+	}
+	// Jobs run ONI's commands with the agent's environment, so the
+	// passphrase can't be left in it for them to inherit
+	var passphrase = os.Getenv("HOST_KEY_PASSPHRASE")
+	os.Unsetenv("HOST_KEY_PASSPHRASE")
+	switch {
+	case oneShot != nil:
+		// One-shot runs don't serve SSH, so they have no use for host keys
+	case len(HostKeyFiles) == 0:
+		errList = append(errList, errors.New("HOST_KEY_FILES (or HOST_KEY_FILE) must be set"))
+	default:
+		var pass hostKeyPassphrase
+		pass, err = readHostKeyPassphrase(passphrase, os.Getenv("HOST_KEY_PASSPHRASE_FILE"), os.Getenv("CREDENTIALS_DIRECTORY"))
+		if err == nil {
+			HostKeys, err = readHostKeys(HostKeyFiles, HostKeyType, pass)
+		}
 		if err != nil {
-			errList = append(errList, fmt.Errorf("HOST_KEY_FILE is invalid or cannot be read: %w", err))
+			errList = append(errList, err)
 		}
 	}
 
@@ -91,131 +236,730 @@ func getEnvironment() {
 	if connect == "" {
 		errList = append(errList, errors.New(`DB_CONNECTION must be set (e.g., "user:pass@tcp(127.0.0.1:3306)/dbname")`))
 	} else {
-		dbPool, err = sql.Open("mysql", connect)
+		var db *sql.DB
+		db, err = sql.Open("mysql", connect)
 		if err != nil {
 			errList = append(errList, fmt.Errorf(`DB_CONNECTION is invalid: %w`, err))
 		}
+		dbPool = newTimedDB(db, defaultQueryTimeout, defaultSlowQueryLimit)
 	}
 
-	if len(errList) > 0 {
-		for _, err := range errList {
-			fmt.Fprintf(os.Stderr, " - %s\n", err)
+	var timeout = os.Getenv("DB_QUERY_TIMEOUT")
+	if timeout != "" && dbPool != nil {
+		var n, err = strconv.Atoi(timeout)
+		if err != nil || n < 1 {
+			errList = append(errList, errors.New("DB_QUERY_TIMEOUT must be a positive number of seconds"))
 		}
-		os.Exit(1)
+		dbPool.timeout = time.Second * time.Duration(n)
 	}
 
-	dbPool.SetConnMaxLifetime(0)
-	dbPool.SetMaxIdleConns(3)
-	dbPool.SetMaxOpenConns(3)
-}
+	var reportTimeout = os.Getenv("DB_REPORT_TIMEOUT")
+	if reportTimeout != "" && dbPool != nil {
+		var n, err = strconv.Atoi(reportTimeout)
+		if err != nil || n < 1 {
+			errList = append(errList, errors.New("DB_REPORT_TIMEOUT must be a positive number of seconds"))
+		}
+		dbPool.reportTimeout = time.Second * time.Duration(n)
+	}
+
+	var slow = os.Getenv("DB_SLOW_QUERY_MS")
+	if slow != "" && dbPool != nil {
+		var n, err = strconv.Atoi(slow)
+		if err != nil || n < 0 {
+			errList = append(errList, errors.New("DB_SLOW_QUERY_MS must be a number of milliseconds (0 disables the slow query log)"))
+		}
+		dbPool.stats = latency.NewTracker(time.Millisecond * time.Duration(n))
+	}
+
+	var roConnect = os.Getenv("DB_CONNECTION_RO")
+	if roConnect != "" && dbPool != nil {
+		var db, err = sql.Open("mysql", roConnect)
+		if err != nil {
+			errList = append(errList, fmt.Errorf(`DB_CONNECTION_RO is invalid: %w`, err))
+		} else {
+			// Nothing may write through the replica, even if its account could:
+			// a write there would fail, or worse, leave it out of step with the primary
+			dbReplica = newTimedDB(db, dbPool.timeout, dbPool.stats.Threshold())
+			dbReplica.reportTimeout = dbPool.reportTimeout
+			dbReplica.readOnly = true
+		}
+	}
+
+	var patterns []*regexp.Regexp
+	var redactFile = os.Getenv("REDACT_PATTERNS_FILE")
+	if redactFile != "" {
+		patterns, err = readRedactPatterns(redactFile)
+		if err != nil {
+			errList = append(errList, fmt.Errorf("REDACT_PATTERNS_FILE is invalid: %w", err))
+		}
+	}
+	Redactor = buildRedactor(patterns, connect)
+
+	var days = os.Getenv("JOB_RETENTION_DAYS")
+	if days != "" {
+		var n, err = strconv.Atoi(days)
+		if err != nil || n < 1 {
+			errList = append(errList, fmt.Errorf("JOB_RETENTION_DAYS must be a positive number of days"))
+		}
+		JobRetention = time.Hour * 24 * time.Duration(n)
+	}
+
+	var stall = os.Getenv("JOB_STALL_MINUTES")
+	if stall != "" {
+		var n, err = strconv.Atoi(stall)
+		if err != nil || n < 0 {
+			errList = append(errList, errors.New("JOB_STALL_MINUTES must be a number of minutes (0 disables stall detection)"))
+		}
+		JobStallThreshold = time.Minute * time.Duration(n)
+	}
+
+	var cacheTTL = os.Getenv("VALIDATION_CACHE_MINUTES")
+	if cacheTTL != "" {
+		var n, err = strconv.Atoi(cacheTTL)
+		if err != nil || n < 0 {
+			errList = append(errList, errors.New("VALIDATION_CACHE_MINUTES must be a number of minutes (0 disables the cache)"))
+		}
+		ValidationCacheTTL = time.Minute * time.Duration(n)
+	}
+
+	var lookupTTL = os.Getenv("LOOKUP_CACHE_SECONDS")
+	if lookupTTL != "" {
+		var n, err = strconv.Atoi(lookupTTL)
+		if err != nil || n < 0 {
+			errList = append(errList, errors.New("LOOKUP_CACHE_SECONDS must be a number of seconds (0 disables the cache)"))
+		}
+		LookupCacheTTL = time.Second * time.Duration(n)
+	}
+
+	var maxPayload = os.Getenv("MAX_PAYLOAD_MB")
+	if maxPayload != "" {
+		var n, err = strconv.Atoi(maxPayload)
+		if err != nil || n < 1 {
+			errList = append(errList, errors.New("MAX_PAYLOAD_MB must be a positive number of megabytes"))
+		}
+		MaxPayloadBytes = n << 20
+	}
+
+	var payloadTimeout = os.Getenv("PAYLOAD_TIMEOUT_SECONDS")
+	if payloadTimeout != "" {
+		var n, err = strconv.Atoi(payloadTimeout)
+		if err != nil || n < 0 {
+			errList = append(errList, errors.New("PAYLOAD_TIMEOUT_SECONDS must be a number of seconds (0 means no limit)"))
+		}
+		PayloadIdleTimeout = time.Second * time.Duration(n)
+	}
+
+	var rateLimit = os.Getenv("RATE_LIMIT_PER_MINUTE")
+	if rateLimit != "" {
+		var n, err = strconv.Atoi(rateLimit)
+		if err != nil || n < 0 {
+			errList = append(errList, errors.New("RATE_LIMIT_PER_MINUTE must be a number of commands (0 means no limit)"))
+		}
+		RateLimit = n
+	}
 
-func readKey(keyfile string) (ssh.Signer, error) {
-	var data, err = os.ReadFile(keyfile)
-	if os.IsNotExist(err) {
-		slog.Warn("HOST_KEY_FILE doesn't exist; creating it with a random key", "path", keyfile)
-		return generateKey(keyfile)
+	var jobTimeout = os.Getenv("JOB_TIMEOUT_MINUTES")
+	if jobTimeout != "" {
+		var n, err = strconv.Atoi(jobTimeout)
+		if err != nil || n < 0 {
+			errList = append(errList, errors.New("JOB_TIMEOUT_MINUTES must be a number of minutes (0 means no limit)"))
+		}
+		JobTimeout = time.Minute * time.Duration(n)
+	}
+
+	var workers = os.Getenv("BA_WORKERS")
+	if workers != "" {
+		var n, err = strconv.Atoi(workers)
+		if err != nil || n < 1 {
+			errList = append(errList, errors.New("BA_WORKERS must be a positive number of jobs"))
+		}
+		Workers = n
 	}
+
+	var grace = os.Getenv("SHUTDOWN_GRACE_SECONDS")
+	if grace != "" {
+		var n, err = strconv.Atoi(grace)
+		if err != nil || n < 0 {
+			errList = append(errList, errors.New("SHUTDOWN_GRACE_SECONDS must be a number of seconds"))
+		}
+		ShutdownGrace = time.Second * time.Duration(n)
+	}
+
+	BlackoutWindows, err = parseBlackoutWindows(os.Getenv("BLACKOUT_WINDOWS"))
 	if err != nil {
-		return nil, fmt.Errorf("reading file: %w", err)
+		errList = append(errList, fmt.Errorf("BLACKOUT_WINDOWS is invalid: %w", err))
 	}
 
-	return ssh.ParsePrivateKey(data)
-}
+	var maxLoad = os.Getenv("PACING_MAX_LOAD")
+	if maxLoad != "" {
+		var n, err = strconv.ParseFloat(maxLoad, 64)
+		if err != nil || n <= 0 {
+			errList = append(errList, errors.New("PACING_MAX_LOAD must be a positive load average"))
+		}
+		Pacing.MaxLoad = n
+		_, err = readLoadAverage()
+		if err != nil {
+			errList = append(errList, fmt.Errorf("PACING_MAX_LOAD requires a readable /proc/loadavg: %w", err))
+		}
+	}
+	Pacing.URL = os.Getenv("PACING_URL")
+	if Pacing.URL != "" {
+		var u, err = url.Parse(Pacing.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errList = append(errList, errors.New("PACING_URL must be an http or https URL"))
+		}
+	}
+	var maxResponse = os.Getenv("PACING_MAX_RESPONSE_MS")
+	if maxResponse != "" {
+		var n, err = strconv.Atoi(maxResponse)
+		if err != nil || n < 1 {
+			errList = append(errList, errors.New("PACING_MAX_RESPONSE_MS must be a positive number of milliseconds"))
+		}
+		Pacing.MaxResponse = time.Millisecond * time.Duration(n)
+	}
+	var pacingInterval = os.Getenv("PACING_INTERVAL_SECONDS")
+	if pacingInterval != "" {
+		var n, err = strconv.Atoi(pacingInterval)
+		if err != nil || n < 1 {
+			errList = append(errList, errors.New("PACING_INTERVAL_SECONDS must be a positive number of seconds"))
+		}
+		Pacing.Interval = time.Second * time.Duration(n)
+	}
 
-func writeKeyFiles(key *rsa.PrivateKey, filename string) error {
-	var priv = pem.EncodeToMemory(
-		&pem.Block{
-			Type:  "RSA PRIVATE KEY",
-			Bytes: x509.MarshalPKCS1PrivateKey(key),
-		},
-	)
+	JP2Validator = os.Getenv("JP2_VALIDATOR")
+	if JP2Validator != "" {
+		var info, err = os.Stat(JP2Validator)
+		if err == nil && (info.IsDir() || info.Mode().Perm()&0111 == 0) {
+			err = errors.New("not an executable file")
+		}
+		if err != nil {
+			errList = append(errList, fmt.Errorf("JP2_VALIDATOR is invalid: %w", err))
+		}
+	}
 
-	var pub = pem.EncodeToMemory(
-		&pem.Block{
-			Type:  "RSA PUBLIC KEY",
-			Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey),
-		},
-	)
+	var solrURL = os.Getenv("SOLR_URL")
+	if solrURL != "" {
+		Solr, err = solr.New(solrURL)
+		if err != nil {
+			errList = append(errList, fmt.Errorf("SOLR_URL is invalid: %w", err))
+		}
+	}
+	SMTP = smtpConfig{
+		Addr:     os.Getenv("SMTP_ADDR"),
+		From:     os.Getenv("SMTP_FROM"),
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+	}
+	if SMTP.Addr != "" {
+		var _, _, err = net.SplitHostPort(SMTP.Addr)
+		if err != nil {
+			errList = append(errList, errors.New(`SMTP_ADDR must be a host and port (e.g., "mail.example.org:587")`))
+		}
+		_, err = mail.ParseAddress(SMTP.From)
+		if err != nil {
+			errList = append(errList, errors.New("SMTP_FROM must be set to a valid address when SMTP_ADDR is set"))
+		}
+	}
+	var recipients = os.Getenv("INGEST_REPORT_RECIPIENTS")
+	if recipients != "" {
+		IngestReportRecipients, err = readReportRecipients(recipients)
+		if err != nil {
+			errList = append(errList, fmt.Errorf("INGEST_REPORT_RECIPIENTS is invalid: %w", err))
+		}
+		if SMTP.Addr == "" {
+			errList = append(errList, errors.New("INGEST_REPORT_RECIPIENTS requires SMTP_ADDR"))
+		}
+	}
 
-	var err = os.WriteFile(filename, priv, 0600)
+	WebhookURL = os.Getenv("JOB_WEBHOOK_URL")
+	if WebhookURL != "" {
+		var _, err = parseWebhookURL(WebhookURL)
+		if err != nil {
+			errList = append(errList, fmt.Errorf("JOB_WEBHOOK_URL is invalid: %w", err))
+		}
+	}
+	WebhookSecret = os.Getenv("JOB_WEBHOOK_SECRET")
+	var callbackHosts = os.Getenv("JOB_CALLBACK_HOSTS")
+	if callbackHosts != "" {
+		CallbackHosts = make(map[string]bool)
+		for _, host := range splitList(callbackHosts) {
+			CallbackHosts[strings.ToLower(host)] = true
+		}
+	}
+	var attempts = os.Getenv("JOB_WEBHOOK_ATTEMPTS")
+	if attempts != "" {
+		var n, err = strconv.Atoi(attempts)
+		if err != nil || n < 1 {
+			errList = append(errList, errors.New("JOB_WEBHOOK_ATTEMPTS must be a positive number"))
+		}
+		WebhookAttempts = n
+	}
+
+	ONIURL = os.Getenv("ONI_URL")
+	if ONIURL != "" {
+		var u, err = url.Parse(ONIURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errList = append(errList, errors.New(`ONI_URL must be the ONI site's base URL (e.g., "https://oregonnews.uoregon.edu")`))
+		}
+	}
+	var sample = os.Getenv("SOLR_VERIFY_SAMPLE")
+	if sample != "" {
+		var n, err = strconv.Atoi(sample)
+		if err != nil || n < 1 || n > maxSolrSample {
+			errList = append(errList, fmt.Errorf("SOLR_VERIFY_SAMPLE must be a number of pages from 1 to %d", maxSolrSample))
+		}
+		SolrVerify.Sample = n
+	}
+	var maxErr = os.Getenv("SOLR_VERIFY_MAX_ERROR_PERCENT")
+	if maxErr != "" {
+		var n, err = strconv.ParseFloat(maxErr, 64)
+		if err != nil || n < 0 || n > 100 {
+			errList = append(errList, errors.New("SOLR_VERIFY_MAX_ERROR_PERCENT must be a number from 0 to 100"))
+		}
+		SolrVerify.MaxErrorPercent = n
+	}
+
+	MirrorPeers, err = parseMirrorPeers(os.Getenv("MIRROR_PEERS"))
 	if err != nil {
-		return fmt.Errorf("writing private key to %q: %w", filename, err)
+		errList = append(errList, fmt.Errorf("MIRROR_PEERS is invalid: %w", err))
+	}
+	if len(MirrorPeers) > 0 {
+		MirrorRsync, err = exec.LookPath(MirrorRsync)
+		if err != nil {
+			errList = append(errList, fmt.Errorf("MIRROR_PEERS requires rsync: %w", err))
+		}
 	}
 
-	filename += ".pub"
-	err = os.WriteFile(filename, pub, 0644)
+	PeerAgents, err = parsePeerAgents(os.Getenv("PEER_AGENTS"))
 	if err != nil {
-		return fmt.Errorf("writing public key to %q: %w", filename, err)
+		errList = append(errList, fmt.Errorf("PEER_AGENTS is invalid: %w", err))
+	}
+	if len(PeerAgents) > 0 {
+		PeerTLS = peerTLSConfig{
+			certFile: os.Getenv("PEER_CERT_FILE"),
+			keyFile:  os.Getenv("PEER_KEY_FILE"),
+			caFile:   os.Getenv("PEER_CA_FILE"),
+		}
+		if PeerTLS.certFile == "" || PeerTLS.keyFile == "" || PeerTLS.caFile == "" {
+			errList = append(errList, errors.New("PEER_CERT_FILE, PEER_KEY_FILE, and PEER_CA_FILE must be set when PEER_AGENTS is set"))
+		}
 	}
 
-	return nil
-}
+	TitleSourceDirs, err = parseTitleSourceDirs(os.Getenv("TITLE_SOURCE_DIRS"))
+	if err != nil {
+		errList = append(errList, fmt.Errorf("TITLE_SOURCE_DIRS is invalid: %w", err))
+	}
+	for _, host := range splitList(os.Getenv("TITLE_URL_HOSTS")) {
+		TitleURLHosts[strings.ToLower(host)] = true
+	}
+
+	JobHookDir = os.Getenv("JOB_HOOK_DIR")
+	JobHooksFile = os.Getenv("JOB_HOOKS_FILE")
+	if JobHooksFile != "" {
+		JobHooks, err = readJobHooks(JobHooksFile, JobHookDir)
+		if err != nil {
+			errList = append(errList, fmt.Errorf("JOB_HOOKS_FILE is invalid: %w", err))
+		}
+	}
+
+	WorkDirMinFree = uint64(MaxPayloadBytes)
+	var minFree = os.Getenv("WORK_DIR_MIN_FREE_MB")
+	if minFree != "" {
+		var n, err = strconv.Atoi(minFree)
+		if err != nil || n < 0 {
+			errList = append(errList, errors.New("WORK_DIR_MIN_FREE_MB must be a number of megabytes"))
+		}
+		WorkDirMinFree = uint64(n) << 20
+	}
+	WorkDir = os.Getenv("WORK_DIR")
+	if WorkDir != "" {
+		err = checkWorkDir(WorkDir, WorkDirMinFree)
+		if err != nil {
+			errList = append(errList, fmt.Errorf("WORK_DIR is invalid: %w", err))
+		}
+	}
+
+	StateDir = os.Getenv("STATE_DIR")
+	if StateDir != "" {
+		State, err = state.Open(StateDir)
+		if err != nil {
+			errList = append(errList, fmt.Errorf("STATE_DIR is invalid: %w", err))
+		}
+	}
+
+	for _, u := range splitList(os.Getenv("RESTRICTED_USERS")) {
+		RestrictedUsers[u] = true
+	}
+	for _, u := range splitList(os.Getenv("ADMIN_USERS")) {
+		if RestrictedUsers[u] {
+			errList = append(errList, fmt.Errorf("%q cannot be in both RESTRICTED_USERS and ADMIN_USERS", u))
+		}
+		AdminUsers[u] = true
+	}
+
+	ArtifactDir = os.Getenv("ARTIFACT_DIR")
+	ArtifactS3 = artifact.S3Config{
+		Endpoint:     os.Getenv("ARTIFACT_S3_ENDPOINT"),
+		Region:       os.Getenv("ARTIFACT_S3_REGION"),
+		Bucket:       os.Getenv("ARTIFACT_S3_BUCKET"),
+		Prefix:       os.Getenv("ARTIFACT_S3_PREFIX"),
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	// Anything other than AWS itself is almost certainly going to need
+	// path-style URLs
+	ArtifactS3.PathStyle = ArtifactS3.Endpoint != ""
+
+	switch {
+	case ArtifactDir != "" && ArtifactS3.Bucket != "":
+		errList = append(errList, errors.New("ARTIFACT_DIR and ARTIFACT_S3_BUCKET cannot both be set"))
+	case ArtifactDir != "":
+		Artifacts, err = artifact.NewDir(ArtifactDir)
+		if err != nil {
+			errList = append(errList, fmt.Errorf("ARTIFACT_DIR is invalid: %w", err))
+		}
+	case ArtifactS3.Bucket != "":
+		var s3, err = artifact.NewS3(ArtifactS3)
+		if err != nil {
+			errList = append(errList, fmt.Errorf("artifact object storage is invalid: %w", err))
+		} else {
+			Artifacts = s3
+		}
+	}
+
+	// Archived jobs go wherever artifacts do, so with object storage they're
+	// kept in their own corner of the bucket rather than on local disk
+	JobArchiveDir = os.Getenv("JOB_ARCHIVE_DIR")
+	switch {
+	case JobArchiveDir != "" && ArtifactS3.Bucket != "":
+		errList = append(errList, errors.New("JOB_ARCHIVE_DIR and ARTIFACT_S3_BUCKET cannot both be set"))
+	case JobArchiveDir != "":
+		JobArchive, err = jobarchive.New(JobArchiveDir)
+		if err != nil {
+			errList = append(errList, fmt.Errorf("JOB_ARCHIVE_DIR is invalid: %w", err))
+		}
+	case Artifacts != nil && ArtifactS3.Bucket != "":
+		var c = ArtifactS3
+		c.Prefix += jobArchivePrefix
+		var s3, err = artifact.NewS3(c)
+		if err != nil {
+			errList = append(errList, fmt.Errorf("job archive object storage is invalid: %w", err))
+		} else {
+			JobArchive = jobarchive.NewStore(s3)
+		}
+	}
 
-func generateKey(filename string) (ssh.Signer, error) {
-	var key, err = rsa.GenerateKey(rand.Reader, 2048)
+	FailureDiagnostics, err = parseFailureDiagnostics(os.Getenv("FAILURE_DIAGNOSTICS"))
 	if err != nil {
-		return nil, fmt.Errorf("generating key: %w", err)
+		errList = append(errList, fmt.Errorf("FAILURE_DIAGNOSTICS is invalid: %w", err))
+	}
+	if len(FailureDiagnostics) > 0 && Artifacts == nil {
+		errList = append(errList, errors.New("FAILURE_DIAGNOSTICS requires ARTIFACT_DIR or ARTIFACT_S3_BUCKET"))
 	}
 
-	err = writeKeyFiles(key, filename)
+	PurgeSafeguards, err = parsePurgeSafeguards(os.Getenv("PURGE_SAFEGUARDS"))
 	if err != nil {
-		return nil, fmt.Errorf("writing key files: %w", err)
+		errList = append(errList, fmt.Errorf("PURGE_SAFEGUARDS is invalid: %w", err))
+	}
+	if PurgeSafeguards[safeguardSnapshot] && Artifacts == nil {
+		errList = append(errList, errors.New("the PURGE_SAFEGUARDS snapshot safeguard requires ARTIFACT_DIR or ARTIFACT_S3_BUCKET"))
+	}
+	DarkArchiveDirs = splitList(os.Getenv("DARK_ARCHIVE_DIRS"))
+
+	var logLines = os.Getenv("AGENT_LOG_LINES")
+	if logLines != "" {
+		var n, err = strconv.Atoi(logLines)
+		switch {
+		case err != nil || n < 0 || n > 100000:
+			errList = append(errList, errors.New("AGENT_LOG_LINES must be a number of lines between 0 and 100000"))
+		case n == 0:
+			AgentLog = nil
+		default:
+			AgentLog = newLogTail(n)
+		}
+	}
+	if FailureDiagnostics[diagAgentLog] && AgentLog == nil {
+		errList = append(errList, errors.New("FAILURE_DIAGNOSTICS cannot include agent_log when AGENT_LOG_LINES is 0"))
+	}
+
+	var expiry = os.Getenv("ARTIFACT_URL_EXPIRY_MINUTES")
+	if expiry != "" {
+		var n, err = strconv.Atoi(expiry)
+		if err != nil || n < 1 || n > 7*24*60 {
+			errList = append(errList, errors.New("ARTIFACT_URL_EXPIRY_MINUTES must be a number of minutes between 1 and 10080 (one week)"))
+		}
+		ArtifactURLExpiry = time.Minute * time.Duration(n)
 	}
 
-	return ssh.NewSignerFromKey(key)
+	for class, name := range sourceCIDREnv {
+		var list, err = parseCIDRs(os.Getenv(name))
+		if err != nil {
+			errList = append(errList, fmt.Errorf("%s is invalid: %w", name, err))
+		}
+		if len(list) > 0 {
+			SourceCIDRs[class] = list
+		}
+	}
+
+	if os.Getenv("AGENT_ROLE") != "" {
+		AgentRole = os.Getenv("AGENT_ROLE")
+	}
+	err = checkRole(AgentRole)
+	if err != nil {
+		errList = append(errList, fmt.Errorf("AGENT_ROLE is invalid: %w", err))
+	}
+	if AgentRole == roleVerify && dbPool != nil {
+		dbPool.readOnly = true
+	}
+
+	// Keys are read once the role is known, since they may only permit the
+	// commands it offers
+	AuthorizedKeysFile = os.Getenv("BA_AUTHORIZED_KEYS")
+	if AuthorizedKeysFile != "" {
+		AuthorizedKeys, err = readAuthorizedKeys(AuthorizedKeysFile)
+		if err != nil {
+			errList = append(errList, fmt.Errorf("BA_AUTHORIZED_KEYS is invalid: %w", err))
+		}
+	}
+
+	GRPC.bind = os.Getenv("GRPC_BIND")
+	if GRPC.bind != "" {
+		GRPC.certFile = os.Getenv("GRPC_CERT_FILE")
+		GRPC.keyFile = os.Getenv("GRPC_KEY_FILE")
+		GRPC.caFile = os.Getenv("GRPC_CLIENT_CA_FILE")
+		if GRPC.certFile == "" || GRPC.keyFile == "" || GRPC.caFile == "" {
+			errList = append(errList, errors.New("GRPC_CERT_FILE, GRPC_KEY_FILE, and GRPC_CLIENT_CA_FILE must be set when GRPC_BIND is set"))
+		}
+	}
+
+	if len(errList) > 0 {
+		for _, err := range errList {
+			fmt.Fprintf(os.Stderr, " - %s\n", err)
+		}
+		os.Exit(1)
+	}
+
+	dbPool.SetConnMaxLifetime(0)
+	dbPool.SetMaxIdleConns(3)
+	dbPool.SetMaxOpenConns(3)
+	if dbReplica != nil {
+		dbReplica.SetConnMaxLifetime(0)
+		dbReplica.SetMaxIdleConns(3)
+		dbReplica.SetMaxOpenConns(3)
+	}
 }
 
 func main() {
+	var err error
+	oneShot, err = parseCommandLine(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\nUsage: %s [--once <command> [<args>...]]\n", err, os.Args[0])
+		os.Exit(exitUsage)
+	}
+
 	getEnvironment()
-	JobRunner = queue.New(ONILocation)
+	if AgentLog != nil {
+		log.SetOutput(io.MultiWriter(os.Stderr, AgentLog))
+	}
+
+	ONIDB, err = onidb.Detect(context.Background(), dbPool)
+	if err != nil {
+		slog.Error("Unable to use ONI database", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("Detected ONI database schema", "schema", ONIDB.Name)
+
+	err = migrateState()
+	if err != nil {
+		slog.Error("Unable to migrate STATE_DIR", "error", err)
+		os.Exit(1)
+	}
+	logBatchSource()
+	checkONIEnvironment()
+
+	var runner queue.Runner = oni.NewRunner(ONILocation)
+	if AgentRole == roleVerify {
+		runner = noExecRunner{}
+		slog.Info("Verification-only agent: commands which change anything are disabled", "disabled", applyRole(AgentRole))
+	}
+	JobRunner = queue.New(runner)
+	JobRunner.SetEnvironment(ONIEnvironment.ID())
+	JobRunner.SetHooks(queueHooks())
+	JobRunner.SetCheck(checkLoadUnchanged)
+	subscribeBackground(Events, JobStats)
+	if AgentRole != roleVerify {
+		JobRunner.SetLock(lockONIBatch)
+	}
+	if JobHooks != nil {
+		JobRunner.SetSteps(jobSteps)
+	}
+	if JobRetention > 0 {
+		JobRunner.SetRetention(JobRetention)
+	}
+	if JobArchive != nil {
+		JobRunner.SetArchiver(JobArchive)
+	}
+	if JobTimeout > 0 {
+		JobRunner.SetTimeout(JobTimeout)
+	}
+	if len(BlackoutWindows) > 0 {
+		JobRunner.SetDefer(deferDestructiveJobs)
+	}
+	if Workers > 1 {
+		JobRunner.SetWorkers(Workers)
+		JobRunner.SetClass(jobClass)
+	}
+	JobRunner.SetRedactor(Redactor)
+	restoreQueueState()
+	if oneShot != nil {
+		os.Exit(mainOnce())
+	}
 
 	var srv = &gliderssh.Server{Addr: BABind}
-	srv.AddHostKey(HostKeySigner)
+	for _, k := range HostKeys {
+		srv.AddHostKey(k.signer)
+	}
 	srv.MaxTimeout = time.Duration(5 * time.Minute)
+	if len(AuthorizedKeys) > 0 {
+		srv.PublicKeyHandler = checkPublicKey
+	}
 
-	var sessionID atomic.Int64
 	srv.Handle(func(_s gliderssh.Session) {
 		var s = session{Session: _s, id: sessionID.Add(1)}
 
-		s.logInfo("Connection established", "source", s.RemoteAddr(), "command", s.RawCommand())
+		s.logInfo("Connection established", "source", s.RemoteAddr(), "command", s.RawCommand(), "key", s.keyComment())
 		s.handle()
 		s.logInfo("Session closed", "source", s.RemoteAddr(), "command", s.RawCommand())
 	})
 
+	var grpcSrv *grpc.Server
+	if GRPC.bind != "" {
+		var err error
+		grpcSrv, err = serveGRPC(GRPC)
+		if err != nil {
+			slog.Error("Unable to start gRPC server", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("gRPC server started", "bind", GRPC.bind)
+	}
+
+	// Shutting down stops new jobs and connections first, then gives a running
+	// job its grace period, lets event subscribers catch up on the jobs that
+	// just finished and their webhooks go out, and only then closes the
+	// database. The SSH server returning is what ends main, so main waits for
+	// all of that to finish.
 	var ctx, cancel = context.WithCancel(context.Background())
+	var stopped = make(chan struct{})
 	trapIntTerm(func() {
 		cancel()
 		srv.Close()
+		if grpcSrv != nil {
+			grpcSrv.Stop()
+		}
+		JobRunner.Shutdown(ShutdownGrace)
+		Events.Close()
+		stopWebhooks(webhookShutdownGrace)
 		dbPool.Close()
+		if dbReplica != nil {
+			dbReplica.Close()
+		}
+		close(stopped)
 	})
 	go JobRunner.Wait(ctx)
+	if JobStallThreshold > 0 {
+		go JobRunner.WatchStalls(ctx, JobStallThreshold, time.Minute)
+	}
+	if Pacing.enabled() {
+		go newPacer(Pacing).run(ctx)
+	}
 
 	// This functions as an on-startup sanity check to verify that the agent can
-	// in fact call ONI commands with its current configuration
-	slog.Info("Checking ONI install")
-	var j = JobRunner.NewJob("ONI Check", []string{"check"})
-	j.Run(ctx)
-	switch j.Status() {
-	case queue.StatusSuccessful:
-		slog.Info("ONI check successful")
-	case queue.StatusFailStart, queue.StatusFailed:
-		slog.Error("ONI check failed", "error", strings.Join(j.Stderr(), ", "))
-	default:
-		slog.Error("Unhandled job status for ONI check job, terminating", "status", j.Status())
-		os.Exit(1)
+	// in fact call ONI commands with its current configuration. Verification
+	// agents can't call ONI at all, so there's nothing to check.
+	if AgentRole != roleVerify {
+		checkONI(ctx)
+		detectONICommands(ctx)
 	}
 
 	slog.Info("starting ssh server",
 		"port", BABind,
 		"ONI_LOCATION", ONILocation,
+		"ONI_LOCK_FILE", ONILockFile,
 		"BATCH_SOURCE", BatchSource,
-		"HOST_KEY_FILE", HostKeyFile,
+		"BATCH_PATH_TEMPLATE", BatchPathTemplate,
+		"HOST_KEY_FILES", HostKeyFiles,
+		"BA_AUTHORIZED_KEYS", AuthorizedKeysFile,
+		"JOB_ARCHIVE_DIR", JobArchiveDir,
+		"STATE_DIR", StateDir,
+		"WORK_DIR", WorkDir,
+		"JOB_HOOKS_FILE", JobHooksFile,
+		"RATE_LIMIT_PER_MINUTE", RateLimit,
+		"BA_WORKERS", Workers,
+		"MAX_PAYLOAD_MB", MaxPayloadBytes>>20,
+		"PAYLOAD_TIMEOUT_SECONDS", PayloadIdleTimeout.Seconds(),
+		"PACING_MAX_LOAD", Pacing.MaxLoad,
+		"PACING_URL", Pacing.URL,
+		"BLACKOUT_WINDOWS", os.Getenv("BLACKOUT_WINDOWS"),
+		"ARTIFACT_DIR", ArtifactDir,
+		"SMTP_ADDR", SMTP.Addr,
+		"JOB_WEBHOOK_URL", WebhookURL,
+		"JOB_CALLBACK_HOSTS", sortedKeys(CallbackHosts),
+		"ARTIFACT_S3_BUCKET", ArtifactS3.Bucket,
+		"ARTIFACT_S3_PREFIX", ArtifactS3.Prefix,
 		"version", version.Version,
 	)
-	var err = srv.ListenAndServe()
+	err = srv.ListenAndServe()
 	if err != nil && err != gliderssh.ErrServerClosed {
 		slog.Error("Unable to serve SSH", "error", err)
 	}
+	if done() {
+		<-stopped
+	}
 
 	slog.Info("Closing...")
 }
+
+// mainOnce runs the --once command instead of serving SSH. Interrupting it
+// shuts the queue down just as it would for a running agent, and so does
+// finishing: a job the run stopped following, such as one left waiting out a
+// blackout window, is canceled rather than killed along with the agent.
+func mainOnce() int {
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	trapIntTerm(func() {
+		cancel()
+		JobRunner.Shutdown(ShutdownGrace)
+	})
+	if AgentRole != roleVerify {
+		checkONI(ctx)
+		detectONICommands(ctx)
+	}
+
+	var code = runOnce(ctx, oneShot, os.Stdout)
+	JobRunner.Shutdown(ShutdownGrace)
+	Events.Close()
+	stopWebhooks(webhookShutdownGrace)
+	dbPool.Close()
+	if dbReplica != nil {
+		dbReplica.Close()
+	}
+	return code
+}
+
+// checkONI runs ONI's "check" command, exiting if the job ends up in a state
+// we don't understand
+func checkONI(ctx context.Context) {
+	slog.Info("Checking ONI install")
+	var j = JobRunner.NewJob("ONI Check", []string{"check"})
+	j.Run(ctx)
+	switch j.Status() {
+	case queue.StatusSuccessful:
+		slog.Info("ONI check successful")
+	case queue.StatusFailStart, queue.StatusFailed:
+		slog.Error("ONI check failed", "error", strings.Join(j.Stderr(), ", "))
+	default:
+		slog.Error("Unhandled job status for ONI check job, terminating", "status", j.Status())
+		os.Exit(1)
+	}
+}
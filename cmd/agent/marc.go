@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// marcSubfield is a single coded value within a MARC data field
+type marcSubfield struct {
+	Code  string `xml:"code,attr"`
+	Value string `xml:",chardata"`
+}
+
+// marcDataField is a MARC data field, e.g., 245
+type marcDataField struct {
+	Tag       string         `xml:"tag,attr"`
+	Subfields []marcSubfield `xml:"subfield"`
+}
+
+// marcControlField is a MARC control field, e.g., 008
+type marcControlField struct {
+	Tag   string `xml:"tag,attr"`
+	Value string `xml:",chardata"`
+}
+
+// marcRecord holds the parts of a MARC XML record we need to look at
+type marcRecord struct {
+	ControlFields []marcControlField `xml:"controlfield"`
+	DataFields    []marcDataField    `xml:"datafield"`
+}
+
+// marcDocument can hold either a single-record document or a collection
+type marcDocument struct {
+	XMLName xml.Name
+	marcRecord
+	Records []marcRecord `xml:"record"`
+}
+
+// marcTitle is the title metadata ONI derives from a MARC record which we
+// care about when checking for conflicts with existing titles
+type marcTitle struct {
+	LCCN      string
+	Name      string
+	Place     string
+	StartYear string
+	EndYear   string
+}
+
+// subfield returns the first value found for the given tag and subfield code
+func (r marcRecord) subfield(tag, code string) string {
+	for _, df := range r.DataFields {
+		if df.Tag != tag {
+			continue
+		}
+		for _, sf := range df.Subfields {
+			if sf.Code == code {
+				return strings.TrimSpace(sf.Value)
+			}
+		}
+	}
+	return ""
+}
+
+// control returns the value of the given control field
+func (r marcRecord) control(tag string) string {
+	for _, cf := range r.ControlFields {
+		if cf.Tag == tag {
+			return cf.Value
+		}
+	}
+	return ""
+}
+
+// title pulls the relevant title metadata out of the record, roughly the same
+// way ONI's title loader does
+func (r marcRecord) title() marcTitle {
+	var t = marcTitle{
+		LCCN:  strings.ReplaceAll(r.subfield("010", "a"), " ", ""),
+		Name:  r.subfield("245", "a"),
+		Place: r.subfield("260", "a"),
+	}
+	if t.Place == "" {
+		t.Place = r.subfield("264", "a")
+	}
+
+	var f008 = r.control("008")
+	if len(f008) >= 15 {
+		t.StartYear = strings.TrimSpace(f008[7:11])
+		t.EndYear = strings.TrimSpace(f008[11:15])
+	}
+
+	return t
+}
+
+// parseMARCTitles returns title metadata for each record in the MARC XML,
+// which may be either a single record or a collection of records
+func parseMARCTitles(data []byte) ([]marcTitle, error) {
+	var doc marcDocument
+	var err = xml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("parsing MARC XML: %w", err)
+	}
+
+	var records []marcRecord
+	switch doc.XMLName.Local {
+	case "record":
+		records = []marcRecord{doc.marcRecord}
+	case "collection":
+		records = doc.Records
+	default:
+		return nil, fmt.Errorf("parsing MARC XML: unexpected root element %q", doc.XMLName.Local)
+	}
+
+	var titles []marcTitle
+	for _, r := range records {
+		var t = r.title()
+		if t.LCCN == "" {
+			return nil, errors.New("parsing MARC XML: record has no LCCN (010$a)")
+		}
+		titles = append(titles, t)
+	}
+
+	return titles, nil
+}
+
+// titleLCCNs returns the distinct LCCNs of the given titles, in order
+func titleLCCNs(titles []marcTitle) []string {
+	var lccns []string
+	var seen = make(map[string]bool)
+	for _, t := range titles {
+		if !seen[t.LCCN] {
+			seen[t.LCCN] = true
+			lccns = append(lccns, t.LCCN)
+		}
+	}
+	return lccns
+}
+
+// normalizeMARCValue strips the ISBD punctuation and spacing MARC fields tend
+// to carry so that "Portland, Or. :" and "Portland, Or." compare equal
+func normalizeMARCValue(s string) string {
+	s = strings.TrimSpace(s)
+	s = strings.TrimRight(s, " /:;,=.")
+	return strings.ToLower(strings.Join(strings.Fields(s), " "))
+}
+
+// fieldConflict describes a single title field whose incoming value differs
+// from what's already in ONI
+type fieldConflict struct {
+	Existing string `json:"existing"`
+	Incoming string `json:"incoming"`
+}
+
+// titleConflict lists all differing fields for a single LCCN
+type titleConflict struct {
+	LCCN   string                   `json:"lccn"`
+	Fields map[string]fieldConflict `json:"fields"`
+}
+
+// diffTitles compares an existing title against incoming MARC metadata,
+// returning nil if there are no meaningful differences
+func diffTitles(existing, incoming marcTitle) *titleConflict {
+	var c = &titleConflict{LCCN: incoming.LCCN, Fields: make(map[string]fieldConflict)}
+	var check = func(field, a, b string) {
+		if normalizeMARCValue(a) != normalizeMARCValue(b) {
+			c.Fields[field] = fieldConflict{Existing: a, Incoming: b}
+		}
+	}
+
+	check("name", existing.Name, incoming.Name)
+	check("place_of_publication", existing.Place, incoming.Place)
+	check("start_year", existing.StartYear, incoming.StartYear)
+	check("end_year", existing.EndYear, incoming.EndYear)
+
+	if len(c.Fields) == 0 {
+		return nil
+	}
+	return c
+}
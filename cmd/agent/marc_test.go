@@ -0,0 +1,113 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const testMARCRecord = `<?xml version="1.0" encoding="UTF-8"?>
+<record xmlns="http://www.loc.gov/MARC21/slim">
+  <controlfield tag="008">850503c19029999oru wr ne      0   a0eng  </controlfield>
+  <datafield tag="010" ind1=" " ind2=" "><subfield code="a">sn 96088442 </subfield></datafield>
+  <datafield tag="245" ind1="0" ind2="0"><subfield code="a">The Bohemia Nugget /</subfield></datafield>
+  <datafield tag="260" ind1=" " ind2=" "><subfield code="a">Cottage Grove, Or. :</subfield></datafield>
+</record>`
+
+const testMARCCollection = `<?xml version="1.0" encoding="UTF-8"?>
+<collection xmlns="http://www.loc.gov/MARC21/slim">
+  <record>
+    <controlfield tag="008">850503c19029999oru wr ne      0   a0eng  </controlfield>
+    <datafield tag="010" ind1=" " ind2=" "><subfield code="a">sn96088442</subfield></datafield>
+    <datafield tag="245" ind1="0" ind2="0"><subfield code="a">The Bohemia Nugget</subfield></datafield>
+  </record>
+  <record>
+    <controlfield tag="008">850503d18901901oru wr ne      0   a0eng  </controlfield>
+    <datafield tag="010" ind1=" " ind2=" "><subfield code="a">sn96088441</subfield></datafield>
+    <datafield tag="245" ind1="0" ind2="0"><subfield code="a">Other title</subfield></datafield>
+    <datafield tag="264" ind1=" " ind2="1"><subfield code="a">Eugene, Or.</subfield></datafield>
+  </record>
+</collection>`
+
+func TestParseMARCTitles(t *testing.T) {
+	var tests = map[string]struct {
+		data     string
+		expected []marcTitle
+		hasError bool
+	}{
+		"single record": {
+			data: testMARCRecord,
+			expected: []marcTitle{
+				{LCCN: "sn96088442", Name: "The Bohemia Nugget /", Place: "Cottage Grove, Or. :", StartYear: "1902", EndYear: "9999"},
+			},
+		},
+		"collection": {
+			data: testMARCCollection,
+			expected: []marcTitle{
+				{LCCN: "sn96088442", Name: "The Bohemia Nugget", StartYear: "1902", EndYear: "9999"},
+				{LCCN: "sn96088441", Name: "Other title", Place: "Eugene, Or.", StartYear: "1890", EndYear: "1901"},
+			},
+		},
+		"no LCCN": {
+			data:     `<record><datafield tag="245"><subfield code="a">Foo</subfield></datafield></record>`,
+			hasError: true,
+		},
+		"not MARC": {
+			data:     `<batch name="foo"></batch>`,
+			hasError: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got, err = parseMARCTitles([]byte(tc.data))
+			if tc.hasError {
+				if err == nil {
+					t.Fatalf("expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			var diff = cmp.Diff(tc.expected, got)
+			if diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestDiffTitles(t *testing.T) {
+	var existing = marcTitle{LCCN: "sn96088442", Name: "The Bohemia nugget.", Place: "Cottage Grove, Or.", StartYear: "1902", EndYear: "9999"}
+
+	var same = marcTitle{LCCN: "sn96088442", Name: "The Bohemia Nugget /", Place: "Cottage Grove, Or. :", StartYear: "1902", EndYear: "9999"}
+	if c := diffTitles(existing, same); c != nil {
+		t.Errorf("expected no conflict for punctuation-only differences, got %#v", c)
+	}
+
+	var changed = marcTitle{LCCN: "sn96088442", Name: "The Bohemia Nugget", Place: "Eugene, Or.", StartYear: "1902", EndYear: "1910"}
+	var c = diffTitles(existing, changed)
+	if c == nil {
+		t.Fatal("expected a conflict, got none")
+	}
+	var expected = map[string]fieldConflict{
+		"place_of_publication": {Existing: "Cottage Grove, Or.", Incoming: "Eugene, Or."},
+		"end_year":             {Existing: "9999", Incoming: "1910"},
+	}
+	var diff = cmp.Diff(expected, c.Fields)
+	if diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestTitleLCCNs(t *testing.T) {
+	var titles, err = parseMARCTitles([]byte(testMARCCollection))
+	if err != nil {
+		t.Fatalf("Unable to parse MARC: %s", err)
+	}
+	titles = append(titles, titles[0])
+	if diff := cmp.Diff([]string{"sn96088442", "sn96088441"}, titleLCCNs(titles)); diff != "" {
+		t.Errorf("Unexpected LCCNs: %s", diff)
+	}
+}
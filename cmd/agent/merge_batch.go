@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/open-oni/oni-agent/internal/batchname"
+	"github.com/open-oni/oni-agent/internal/batchxml"
+	"github.com/open-oni/oni-agent/internal/issuekey"
+)
+
+// mergeSource is one of the batches being merged
+type mergeSource struct {
+	name  string
+	path  string
+	batch *batchxml.Batch
+}
+
+// checkMergeNames makes sure the two sources and the new batch are distinct,
+// valid batch names for the same awardee
+func checkMergeNames(a, b, dst string) error {
+	var names = []string{a, b, dst}
+	var awardee string
+	for _, name := range names {
+		var n, err = batchname.Parse(name)
+		if err != nil {
+			return err
+		}
+		if awardee != "" && n.Awardee != awardee {
+			return fmt.Errorf("%q, %q, and %q must all be for the same awardee", a, b, dst)
+		}
+		awardee = n.Awardee
+	}
+	if a == b || a == dst || b == dst {
+		return fmt.Errorf("the two source batches and the new batch must all be different")
+	}
+	return nil
+}
+
+// mergeIssues combines the sources' issue lists, refusing duplicate issues
+// (the same LCCN, date, and edition) or two issues in the same directory,
+// which couldn't both be linked into the merged batch
+func mergeIssues(sources []mergeSource) ([]*batchxml.Issue, error) {
+	var issues []*batchxml.Issue
+	var keys = make(map[string]string)
+	var dirs = make(map[batchxml.RelPath]string)
+	var dupes []string
+	for _, src := range sources {
+		for _, i := range src.batch.Issues {
+			var k, err = issuekey.FromParts(i.LCCN, i.IssueDate, i.EditionOrder)
+			if err != nil {
+				return nil, fmt.Errorf("%s: issue %q has an invalid issue key: %w", src.name, i.Filepath, err)
+			}
+			var rel = i.RelPath().Dir()
+			if rel.Escapes() {
+				return nil, fmt.Errorf("%s: issue %q is outside the batch's data directory", src.name, i.Filepath)
+			}
+			if rel == "." {
+				return nil, fmt.Errorf("%s: issue %q is not in its own directory", src.name, i.Filepath)
+			}
+
+			var key = k.NCA()
+			if other, ok := keys[key]; ok {
+				dupes = append(dupes, fmt.Sprintf("%s (in %s and %s)", key, other, src.name))
+				continue
+			}
+			if other, ok := dirs[rel]; ok && other != src.name {
+				return nil, fmt.Errorf("%s and %s both have an issue directory at %q", other, src.name, rel)
+			}
+			keys[key] = src.name
+			dirs[rel] = src.name
+			issues = append(issues, i)
+		}
+	}
+
+	if len(dupes) > 0 {
+		return nil, fmt.Errorf("duplicate issues: %s", strings.Join(dupes, ", "))
+	}
+	return issues, nil
+}
+
+// buildMergedBatch writes a batch at dst holding every issue from both
+// sources. As with partial batches, issue directories are symlinked rather
+// than copied, so the sources must stay where they are. The number of issues
+// in the new batch is returned.
+func buildMergedBatch(a, b, dst string) (int, error) {
+	var sources = []mergeSource{{name: filepath.Base(a), path: a}, {name: filepath.Base(b), path: b}}
+	for i := range sources {
+		var batch, err = batchxml.Read(sources[i].path)
+		if err != nil {
+			return 0, fmt.Errorf("reading %s: %w", sources[i].name, err)
+		}
+		sources[i].batch = batch
+	}
+	if sources[0].batch.Awardee != sources[1].batch.Awardee {
+		return 0, fmt.Errorf("%s and %s have different awardees (%q and %q)", sources[0].name, sources[1].name, sources[0].batch.Awardee, sources[1].batch.Awardee)
+	}
+
+	var issues, err = mergeIssues(sources)
+	if err != nil {
+		return 0, err
+	}
+
+	// The award year is the earlier of the two, since the merged batch covers
+	// both awards' work
+	var year = sources[0].batch.AwardYear
+	if y := sources[1].batch.AwardYear; y != "" && (year == "" || y < year) {
+		year = y
+	}
+	var merged = &batchxml.Batch{
+		Name:      batchNameRegexp.ReplaceAllString(filepath.Base(dst), "$1"),
+		Awardee:   sources[0].batch.Awardee,
+		AwardYear: year,
+		Issues:    issues,
+	}
+	var data []byte
+	data, err = merged.Marshal()
+	if err != nil {
+		return 0, fmt.Errorf("generating batch XML: %w", err)
+	}
+
+	var l = lineage{Parent: sources[0].name, Kind: derivedMerge, Sources: []string{sources[0].name, sources[1].name}}
+	err = createDerivedDir(dst, l)
+	if err != nil {
+		return 0, err
+	}
+
+	// Once dst is created it's ours, so a failure doesn't leave half a batch
+	// behind in the batch source
+	err = writeMergedBatch(dst, data, sources)
+	if err != nil {
+		os.RemoveAll(dst)
+		return 0, err
+	}
+	return len(issues), nil
+}
+
+// writeMergedBatch fills in a merged batch's directory: its batch XML, and
+// links to every source issue directory
+func writeMergedBatch(dst string, data []byte, sources []mergeSource) error {
+	var dataDir = batchxml.DataDir(dst)
+	var err = os.MkdirAll(dataDir, 0755)
+	if err == nil {
+		err = os.WriteFile(batchxml.XMLPath(dst), data, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("writing merged batch: %w", err)
+	}
+
+	var linked = make(map[string]bool)
+	for _, src := range sources {
+		var srcData = batchxml.DataDir(src.path)
+		for _, i := range src.batch.Issues {
+			var rel = i.RelPath().Dir()
+			var issueDir = rel.Join(srcData)
+			if linked[issueDir] {
+				continue
+			}
+			linked[issueDir] = true
+
+			err = linkIssueDir(dataDir, rel, issueDir)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// mergeBatches combines two unloaded batches into a new one and validates it.
+// The merged batch isn't loaded: that's left to load-batch, once whoever
+// asked for the merge has had a look at it.
+func mergeBatches(a, b, name string) response {
+	var err = checkMergeNames(a, b, name)
+	if err != nil {
+		return respond(StatusError, "Batches cannot be merged", H{"error": err.Error()})
+	}
+
+	for _, n := range []string{a, b, name} {
+		var exists bool
+		exists, err = checkBatch(n)
+		if err != nil {
+			return respond(StatusError, "Batches cannot be merged", H{"error": err.Error()})
+		}
+		if exists {
+			return respond(StatusError, "Batches cannot be merged", H{"error": fmt.Sprintf("%q is already loaded into ONI", n)})
+		}
+	}
+
+	var srcA, srcB string
+	srcA, err = findBatch(a)
+	if err == nil {
+		srcB, err = findBatch(b)
+	}
+	if err != nil {
+		return respond(StatusError, "Batches cannot be merged", H{"error": err.Error()})
+	}
+
+	// The merged batch lives next to the first source, like other derived
+	// batches live next to their parent
+	var dst = filepath.Join(filepath.Dir(srcA), name)
+	var count int
+	count, err = buildMergedBatch(srcA, srcB, dst)
+	if err != nil {
+		return respond(StatusError, fmt.Sprintf("%q cannot be built", name), H{"error": err.Error()})
+	}
+	err = validateBatch(dst)
+	if err != nil {
+		// buildMergedBatch just made dst, so it's the agent's to remove
+		os.RemoveAll(dst)
+		return respond(StatusError, fmt.Sprintf("%q cannot be built", name), H{"error": err.Error()})
+	}
+
+	Changes.add(changeBatch, "merged", name, H{"sources": []string{a, b}})
+	return respond(StatusSuccess, "Batches merged", H{"batch": H{"name": name, "sources": []string{a, b}, "issues": count}})
+}
+
+func init() {
+	register("merge-batch", func(r *request) response {
+		if len(r.args) != 3 {
+			return respond(StatusError, fmt.Sprintf("%q requires two source batch names and the new batch's name", r.command), nil)
+		}
+		return mergeBatches(r.args[0], r.args[1], r.args[2])
+	})
+}
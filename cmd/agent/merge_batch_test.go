@@ -0,0 +1,149 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/open-oni/oni-agent/internal/batchxml"
+)
+
+func TestCheckMergeNames(t *testing.T) {
+	var tests = map[string]struct {
+		a, b, dst   string
+		expectError bool
+	}{
+		"valid":            {a: "batch_oru_a_ver01", b: "batch_oru_b_ver01", dst: "batch_oru_ab_ver01"},
+		"invalid name":     {a: "batch_oru_a_ver01", b: "b", dst: "batch_oru_ab_ver01", expectError: true},
+		"awardee mismatch": {a: "batch_oru_a_ver01", b: "batch_hoo_b_ver01", dst: "batch_oru_ab_ver01", expectError: true},
+		"same source":      {a: "batch_oru_a_ver01", b: "batch_oru_a_ver01", dst: "batch_oru_ab_ver01", expectError: true},
+		"reused source":    {a: "batch_oru_a_ver01", b: "batch_oru_b_ver01", dst: "batch_oru_b_ver01", expectError: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var err = checkMergeNames(tc.a, tc.b, tc.dst)
+			if tc.expectError != (err != nil) {
+				t.Fatalf("Expected error: %v, got %v", tc.expectError, err)
+			}
+		})
+	}
+}
+
+func TestBuildMergedBatch(t *testing.T) {
+	var root = t.TempDir()
+	var a = filepath.Join(root, "batch_oru_a_ver01")
+	var b = filepath.Join(root, "batch_oru_b_ver01")
+	var dst = filepath.Join(root, "batch_oru_ab_ver01")
+	writeBatch(t, a, testBatch{year: "2024", issues: issuesOn("1902-01-01", "1902-02-01")})
+	writeBatch(t, b, testBatch{year: "2023", issues: issuesOn("1902-03-01")})
+
+	var n, err = buildMergedBatch(a, b, dst)
+	if err != nil {
+		t.Fatalf("Unable to merge batches: %s", err)
+	}
+	if n != 3 {
+		t.Fatalf("Expected 3 issues, got %d", n)
+	}
+	err = validateBatch(dst)
+	if err != nil {
+		t.Fatalf("Merged batch is invalid: %s", err)
+	}
+
+	var merged *batchxml.Batch
+	merged, err = batchxml.Read(dst)
+	if err != nil {
+		t.Fatalf("Unable to read merged batch: %s", err)
+	}
+	if merged.Name != "batch_oru_ab" || merged.AwardYear != "2023" || len(merged.Issues) != 3 {
+		t.Fatalf("Unexpected merged batch: %#v", merged)
+	}
+
+	var l *lineage
+	l, err = readLineage(dst)
+	if err != nil || l == nil || l.Kind != derivedMerge || l.Parent != "batch_oru_a_ver01" || len(l.Sources) != 2 {
+		t.Fatalf("Unexpected lineage: %#v, %v", l, err)
+	}
+
+	// An issue in both sources means the merge is refused
+	var c = filepath.Join(root, "batch_oru_c_ver01")
+	writeBatch(t, c, testBatch{year: "2024", issues: issuesOn("1902-02-01")})
+	_, err = buildMergedBatch(a, c, filepath.Join(root, "batch_oru_ac_ver01"))
+	if err == nil || !strings.Contains(err.Error(), "duplicate issues: sn00000001/1902-02-01_01") {
+		t.Fatalf("Expected a duplicate issue error, got %v", err)
+	}
+
+	// A second edition of the same date is a different issue, and a
+	// duplicate second edition is only reported as itself
+	var d = filepath.Join(root, "batch_oru_d_ver01")
+	writeBatch(t, d, testBatch{year: "2024", issues: issuesOn("1902-02-01_02")})
+	var ad = filepath.Join(root, "batch_oru_ad_ver01")
+	n, err = buildMergedBatch(a, d, ad)
+	if err != nil || n != 3 {
+		t.Fatalf("Expected a second edition to merge alongside the first, got %d issues and %v", n, err)
+	}
+	merged, err = batchxml.Read(ad)
+	if err != nil {
+		t.Fatalf("Unable to read merged batch: %s", err)
+	}
+	var editions []string
+	for _, i := range merged.Issues {
+		if i.IssueDate == "1902-02-01" {
+			editions = append(editions, i.EditionOrder)
+		}
+	}
+	if strings.Join(editions, ",") != "01,02" {
+		t.Fatalf("Expected both editions of 1902-02-01, got %v", editions)
+	}
+
+	var e = filepath.Join(root, "batch_oru_e_ver01")
+	writeBatch(t, e, testBatch{year: "2024", issues: issuesOn("1902-02-01_02")})
+	_, err = buildMergedBatch(d, e, filepath.Join(root, "batch_oru_de_ver01"))
+	if err == nil || !strings.Contains(err.Error(), "duplicate issues: sn00000001/1902-02-01_02 ") || strings.Contains(err.Error(), "_01") {
+		t.Fatalf("Expected only the second edition to be a duplicate, got %v", err)
+	}
+}
+
+func TestMergeBatchesCleansUp(t *testing.T) {
+	var origSource, origTemplate = BatchSource, BatchPathTemplate
+	var origTTL, origLookups = LookupCacheTTL, batchLookups
+	defer func() {
+		BatchSource, BatchPathTemplate = origSource, origTemplate
+		LookupCacheTTL, batchLookups = origTTL, origLookups
+	}()
+	BatchSource = t.TempDir()
+	BatchPathTemplate = ""
+	LookupCacheTTL = time.Minute
+	batchLookups = newLookupCache()
+
+	var a, b, dst = "batch_oru_a_ver01", "batch_oru_b_ver01", "batch_oru_ab_ver01"
+	for _, name := range []string{a, b, dst} {
+		batchLookups.set(name, false)
+	}
+	writeBatch(t, filepath.Join(BatchSource, a), testBatch{year: "2024", issues: issuesOn("1902-01-01")})
+	writeBatch(t, filepath.Join(BatchSource, b), testBatch{year: "2024", issues: issuesOn("1902-02-01")})
+
+	// An issue file with a byte order mark fails validation once the merged
+	// batch is built, which mustn't leave the batch behind
+	var mets = filepath.Join(batchxml.DataDir(filepath.Join(BatchSource, b)), "sn00000001", "1902020101", "1902020101.xml")
+	os.WriteFile(mets, []byte("\xef\xbb\xbf<mets/>"), 0644)
+	var resp = mergeBatches(a, b, dst)
+	if resp.status != StatusError {
+		t.Fatalf("Expected an invalid merged batch to be refused, got %#v", resp)
+	}
+	if _, err := os.Stat(filepath.Join(BatchSource, dst)); !os.IsNotExist(err) {
+		t.Fatalf("Expected the invalid merged batch to be removed, got %v", err)
+	}
+
+	// A directory the agent didn't create is left alone
+	os.WriteFile(mets, []byte("<mets/>"), 0644)
+	os.MkdirAll(filepath.Join(BatchSource, dst), 0755)
+	resp = mergeBatches(a, b, dst)
+	if resp.status != StatusError {
+		t.Fatalf("Expected an existing directory to be refused, got %#v", resp)
+	}
+	if _, err := os.Stat(filepath.Join(BatchSource, dst)); err != nil {
+		t.Fatalf("Expected the existing directory to be kept, got %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+// jobCounter counts finished jobs by status, and stalls, since the agent
+// started
+type jobCounter struct {
+	m        sync.Mutex
+	finished map[queue.JobStatus]int64
+	stalled  int64
+}
+
+// JobStats is kept up to date by the event bus's metrics subscriber
+var JobStats = &jobCounter{finished: make(map[queue.JobStatus]int64)}
+
+func (c *jobCounter) observe(topic string, j *queue.Job) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if topic == topicJobStalled {
+		c.stalled++
+		return
+	}
+	c.finished[j.Status()]++
+}
+
+func (c *jobCounter) summary() H {
+	c.m.Lock()
+	defer c.m.Unlock()
+	var finished = make(map[queue.JobStatus]int64, len(c.finished))
+	for st, n := range c.finished {
+		finished[st] = n
+	}
+	return H{"finished": finished, "stalled": c.stalled}
+}
+
+// getMetrics reports latency stats for every command handled and every
+// database query run since the agent started, and how often lookups were
+// answered from the cache instead
+func getMetrics() response {
+	var db = H{
+		"timeout_seconds":   dbPool.timeout.Seconds(),
+		"slow_threshold_ms": dbPool.stats.Threshold().Milliseconds(),
+		"total":             dbPool.stats.Total(),
+		"queries":           dbPool.stats.Summaries(),
+	}
+	if dbReplica != nil {
+		db["replica"] = H{
+			"total":   dbReplica.stats.Total(),
+			"queries": dbReplica.stats.Summaries(),
+		}
+	}
+	db["lookup_cache"] = H{"batches": batchLookups.stats(), "awardees": awardeeLookups.stats()}
+	return respond(StatusSuccess, "", H{"commands": CommandStats.Summaries(), "db": db, "jobs": JobStats.summary(), "events": Events.Stats()})
+}
+
+// getHealth reports whether the agent's dependencies are reachable. The
+// status is an error if anything is unhealthy, so simple monitoring can just
+// check that.
+func getHealth() response {
+	var db, ok = dbHealth(dbPool)
+	db["schema"] = ONIDB.Name
+	if dbReplica != nil {
+		// The replica is only used for reports, so it being down doesn't make
+		// the agent unhealthy; it's reported so monitoring can still see it
+		db["replica"], _ = dbHealth(dbReplica)
+	}
+	var source = checkBatchSource()
+	var data = H{"db": db, "queue": JobRunner.Status(), "batch_source": source, "oni_environment": liveEnvironment()}
+	if !ok {
+		return respond(StatusError, "Database is unreachable", data)
+	}
+	if !source.Readable {
+		return respond(StatusError, "BATCH_SOURCE is unreadable", data)
+	}
+	return respond(StatusSuccess, "", data)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+)
+
+// middleware wraps a handler with behavior every command shares. Since
+// dispatch applies the chain, every transport gets the same checks, logging,
+// and stats without having to know about them.
+type middleware func(next handlerFunc) handlerFunc
+
+// middlewares is the chain dispatch sends each request through, outermost
+// first: refused requests never reach the rate limiter, limited ones are
+// never audited, and only handled commands count toward latency stats
+var middlewares = []middleware{authorize, rateLimit, audit, callback, measure}
+
+// chain wraps h in every middleware
+func chain(h handlerFunc) handlerFunc {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// authorize refuses commands the user, their SSH key, or the address they're
+// connecting from, may not run. A token's command is only checked against
+// the address.
+func authorize(next handlerFunc) handlerFunc {
+	return func(r *request) response {
+		if r.token == "" && !r.allowed() {
+			r.logInfo("Restricted user refused", "command", r.command)
+			return respond(StatusError, fmt.Sprintf("%q is not permitted for this user", r.command), nil)
+		}
+		if r.token == "" && r.keyCommands != nil && !r.keyCommands[r.command] {
+			r.logInfo("Command refused for SSH key", "command", r.command)
+			return respond(StatusError, fmt.Sprintf("%q is not permitted for this key", r.command), nil)
+		}
+		if !r.sourceAllowed() {
+			r.logSourceRefused()
+			return respond(StatusError, fmt.Sprintf("%q is not permitted from this address", r.command), nil)
+		}
+		return next(r)
+	}
+}
+
+// RateLimit is how many commands each client may send per minute, with
+// bursts of up to that many allowed. Zero means no limit.
+var RateLimit int
+
+// rateLimiter is a token bucket per client (see request.rateKey)
+type rateLimiter struct {
+	m       sync.Mutex
+	buckets map[string]*rateBucket
+	swept   time.Time
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var limiter = &rateLimiter{buckets: make(map[string]*rateBucket)}
+
+// take spends one of the client's tokens, returning how long they must wait
+// if they have none left
+func (l *rateLimiter) take(client string, now time.Time) (wait time.Duration, ok bool) {
+	var perSecond = float64(RateLimit) / 60
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	// A bucket which has refilled is no different from a new one, so once a
+	// minute those are dropped rather than kept for every client ever seen
+	if now.Sub(l.swept) >= time.Minute {
+		for c, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*perSecond >= float64(RateLimit) {
+				delete(l.buckets, c)
+			}
+		}
+		l.swept = now
+	}
+
+	var b = l.buckets[client]
+	if b == nil {
+		b = &rateBucket{tokens: float64(RateLimit), last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(float64(RateLimit), b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / perSecond * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// rateKey returns what the request is rate limited by: the key or
+// certificate the client authenticated with, or failing that the address it
+// connected from. The SSH user is only a last resort, since any client can
+// claim any user and so get a fresh limit.
+func (r *request) rateKey() string {
+	switch {
+	case r.client != "":
+		return r.client
+	case r.source.IsValid():
+		return "address:" + r.source.String()
+	}
+	return "user:" + r.user
+}
+
+// rateLimit refuses requests from clients who've sent more than RateLimit
+// commands in the last minute. Requests run on another's behalf, like a
+// redeemed token's command, were paid for by that request; each line of a
+// bulk request is charged like any other command.
+func rateLimit(next handlerFunc) handlerFunc {
+	return func(r *request) response {
+		if RateLimit <= 0 || r.nested {
+			return next(r)
+		}
+		var wait, ok = limiter.take(r.rateKey(), time.Now())
+		if !ok {
+			var secs = int(math.Ceil(wait.Seconds()))
+			r.logInfo("Rate limited", "user", r.user, "command", r.command, "retryAfter", secs)
+			return respond(StatusError, fmt.Sprintf("Too many requests; try again in %d seconds", secs), H{"retry_after_seconds": secs})
+		}
+		return next(r)
+	}
+}
+
+// audit records who ran anything which can change ONI or the agent, and how
+// it went. Read-only commands are far too chatty to be worth it.
+func audit(next handlerFunc) handlerFunc {
+	return func(r *request) response {
+		var class = commandClass(r.command, r.args)
+		if class == classReadOnly {
+			return next(r)
+		}
+		var resp = next(r)
+		slog.Info("Command audited", "audit", true, "sessionID", r.id, "user", r.user, "source", r.source,
+			"command", r.command, "args", r.args, "class", class, "status", resp.status)
+		return resp
+	}
+}
+
+// measure times each command for metrics and the log
+func measure(next handlerFunc) handlerFunc {
+	return func(r *request) response {
+		var start = time.Now()
+		var resp = next(r)
+		var d = time.Since(start)
+		CommandStats.Observe(r.command, d, resp.status == StatusError)
+		r.logInfo("Command handled", "command", r.command, "status", resp.status, "duration", d)
+		return resp
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var origLimit = RateLimit
+	defer func() { RateLimit = origLimit }()
+	RateLimit = 2
+
+	var l = &rateLimiter{buckets: make(map[string]*rateBucket)}
+	var now = time.Now()
+	for i := 0; i < 2; i++ {
+		if _, ok := l.take("nca", now); !ok {
+			t.Fatalf("Expected request %d to be within the burst", i+1)
+		}
+	}
+	var wait, ok = l.take("nca", now)
+	if ok || wait != 30*time.Second {
+		t.Fatalf("Expected a 30s wait, got %v, %v", wait, ok)
+	}
+	if _, ok = l.take("ops", now); !ok {
+		t.Fatalf("Expected each user to get their own limit")
+	}
+	if _, ok = l.take("nca", now.Add(30*time.Second)); !ok {
+		t.Fatalf("Expected a token to have been refilled after 30s")
+	}
+
+	// Buckets which have refilled are dropped
+	if _, ok = l.take("new", now.Add(2*time.Minute)); !ok {
+		t.Fatalf("Expected a new user to be within the burst")
+	}
+	if len(l.buckets) != 1 || l.buckets["new"] == nil {
+		t.Fatalf("Expected only the new user's bucket to be kept, got %v", l.buckets)
+	}
+}
+
+func TestMiddlewareChain(t *testing.T) {
+	var origLimit, origLimiter = RateLimit, limiter
+	defer func() { RateLimit, limiter = origLimit, origLimiter }()
+	RateLimit = 1
+	limiter = &rateLimiter{buckets: make(map[string]*rateBucket)}
+
+	var calls int
+	commands["test-middleware"] = func(_ *request) response {
+		calls++
+		return respond(StatusSuccess, "", nil)
+	}
+	defer delete(commands, "test-middleware")
+
+	var resp = dispatch(&request{command: "test-middleware", user: "nca"})
+	if resp.status != StatusSuccess {
+		t.Fatalf("Expected the first request through, got %q", resp.message)
+	}
+	resp = dispatch(&request{command: "test-middleware", user: "nca"})
+	if resp.status != StatusError || !strings.Contains(resp.message, "Too many requests") {
+		t.Fatalf("Expected the second request to be limited, got %q", resp.message)
+	}
+	resp = dispatch(&request{command: "test-middleware", user: "nca", nested: true})
+	if resp.status != StatusSuccess {
+		t.Fatalf("Expected a nested request to skip the limit, got %q", resp.message)
+	}
+	if calls != 2 {
+		t.Errorf("Expected the handler to run twice, got %d", calls)
+	}
+
+	// Claiming another SSH user from the same address doesn't get a new limit
+	var addr = netip.MustParseAddr("192.0.2.10")
+	resp = dispatch(&request{command: "test-middleware", user: "nca", source: addr})
+	if resp.status != StatusSuccess {
+		t.Fatalf("Expected the first request from the address through, got %q", resp.message)
+	}
+	resp = dispatch(&request{command: "test-middleware", user: "someone-else", source: addr})
+	if resp.status != StatusError {
+		t.Fatalf("Expected a new user from the same address to be limited, got %q", resp.message)
+	}
+
+	// Each command in a batch is charged
+	RateLimit = 2
+	limiter = &rateLimiter{buckets: make(map[string]*rateBucket)}
+	resp = dispatch(&request{
+		ctx:     context.Background(),
+		command: "batch",
+		client:  "key:SHA256:test",
+		payload: func() ([]byte, error) { return []byte("test-middleware\ntest-middleware\n"), nil },
+	})
+	var results, _ = resp.data["results"].([]H)
+	if len(results) != 2 || results[0]["status"] != StatusSuccess || results[1]["status"] != StatusError {
+		t.Fatalf("Expected the batch's second command to be limited, got %#v", resp)
+	}
+}
+
+func TestRateKey(t *testing.T) {
+	var addr = netip.MustParseAddr("192.0.2.10")
+	var tests = map[string]struct {
+		r        *request
+		expected string
+	}{
+		"key":     {r: &request{user: "nca", source: addr, client: "key:SHA256:abc"}, expected: "key:SHA256:abc"},
+		"address": {r: &request{user: "nca", source: addr}, expected: "address:192.0.2.10"},
+		"user":    {r: &request{user: "nca"}, expected: "user:nca"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := tc.r.rateKey(); got != tc.expected {
+				t.Fatalf("Expected rate key %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+// MirrorPeers maps the names of other ONI instances (e.g., "staging") to the
+// rsync source their batches are pulled from, e.g.,
+// "oni@staging.example.org:/mnt/news/production-batches"
+var MirrorPeers = make(map[string]string)
+
+// MirrorRsync is the rsync binary used for mirroring
+var MirrorRsync = "rsync"
+
+// Stages of a mirror pipeline
+const (
+	mirrorTransferring = "transferring"
+	mirrorValidating   = "validating"
+	mirrorLoading      = "loading"
+	mirrorFailed       = "failed"
+)
+
+// mirrorPipeline tracks one mirror-batch request from transfer through load
+type mirrorPipeline struct {
+	Batch   string    `json:"batch"`
+	Peer    string    `json:"peer"`
+	Source  string    `json:"source"`
+	Dest    string    `json:"dest"`
+	Started time.Time `json:"started"`
+	Stage   string    `json:"stage"`
+	Bytes   int64     `json:"bytes"`
+	Percent int       `json:"percent"`
+	Error   string    `json:"error,omitempty"`
+
+	// Load is the load-batch response data once the load has been queued:
+	// the load job and any follow-up reindex or verification jobs
+	Load H `json:"load,omitempty"`
+}
+
+// mirrors holds every pipeline whose mirror job is still in the queue, keyed
+// by the job's id
+var mirrors = struct {
+	sync.Mutex
+	m map[int64]*mirrorPipeline
+}{m: make(map[int64]*mirrorPipeline)}
+
+// update changes a pipeline under the mirrors lock
+func (p *mirrorPipeline) update(fn func(p *mirrorPipeline)) {
+	mirrors.Lock()
+	defer mirrors.Unlock()
+	fn(p)
+}
+
+// pruneMirrors forgets the pipelines of mirror jobs the queue has purged,
+// which mirror-status can no longer report on. The caller must hold the
+// mirrors lock.
+func pruneMirrors() {
+	for id := range mirrors.m {
+		if JobRunner.GetJob(id) == nil {
+			delete(mirrors.m, id)
+		}
+	}
+}
+
+// parseMirrorPeers reads MIRROR_PEERS: a comma-separated list of
+// name=rsync-source pairs
+func parseMirrorPeers(val string) (map[string]string, error) {
+	var peers = make(map[string]string)
+	for _, item := range splitList(val) {
+		var name, src, ok = strings.Cut(item, "=")
+		name, src = strings.TrimSpace(name), strings.TrimSpace(src)
+		if !ok || name == "" || src == "" {
+			return nil, fmt.Errorf("%q must be in the form name=rsync-source", item)
+		}
+		if peers[name] != "" {
+			return nil, fmt.Errorf("peer %q is listed more than once", name)
+		}
+		peers[name] = strings.TrimSuffix(src, "/")
+	}
+	return peers, nil
+}
+
+// parseMirrorArgs reads "<batch> --from <peer>"
+func parseMirrorArgs(args []string) (name, peer string, err error) {
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--from":
+			if i+1 >= len(args) {
+				return "", "", errors.New("--from requires a peer name")
+			}
+			i++
+			peer = args[i]
+		default:
+			if name != "" {
+				return "", "", errors.New("exactly one batch name is required")
+			}
+			name = args[i]
+		}
+	}
+	if name == "" {
+		return "", "", errors.New("exactly one batch name is required")
+	}
+	if peer == "" {
+		return "", "", errors.New("--from is required")
+	}
+	return name, peer, nil
+}
+
+// rsyncProgressRegexp matches rsync's --info=progress2 lines, e.g.,
+// "    123,456,789  45%   10.00MB/s    0:00:10 (xfr#3, to-chk=10/20)"
+var rsyncProgressRegexp = regexp.MustCompile(`^\s*([\d,]+)\s+(\d+)%`)
+
+// parseRsyncProgress returns the bytes transferred and percent complete from
+// a progress line
+func parseRsyncProgress(line string) (n int64, pct int, ok bool) {
+	var m = rsyncProgressRegexp.FindStringSubmatch(line)
+	if m == nil {
+		return 0, 0, false
+	}
+	n, _ = strconv.ParseInt(strings.ReplaceAll(m[1], ",", ""), 10, 64)
+	pct, _ = strconv.Atoi(m[2])
+	return n, pct, true
+}
+
+// scanProgress splits rsync output on carriage returns as well as newlines,
+// since progress lines overwrite each other with "\r"
+func scanProgress(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	var i = bytes.IndexAny(data, "\r\n")
+	if i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// prepareMirrorDir makes sure dst can receive the mirrored batch: either it
+// doesn't exist yet, or it's an earlier, interrupted mirror of the same batch
+func prepareMirrorDir(dst string, l lineage) error {
+	var _, err = os.Stat(dst)
+	if errors.Is(err, os.ErrNotExist) {
+		return createDerivedDir(dst, l)
+	}
+	if err != nil {
+		return err
+	}
+
+	var prev *lineage
+	prev, err = readLineage(dst)
+	if err != nil {
+		return err
+	}
+	if prev == nil || prev.Kind != derivedMirror {
+		return fmt.Errorf("%s already exists and was not mirrored by the agent", dst)
+	}
+	return nil
+}
+
+// transferBatch pulls the batch from the peer with rsync, logging progress
+// every 10%
+func transferBatch(ctx context.Context, j *queue.Job, p *mirrorPipeline) error {
+	var cmd = exec.CommandContext(ctx, MirrorRsync,
+		"--recursive", "--links", "--times", "--partial",
+		"--exclude", derivedMarker,
+		"--info=progress2", "--no-inc-recursive",
+		p.Source+"/", p.Dest+"/",
+	)
+	var stdout, err = cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("starting rsync: %w", err)
+	}
+
+	var logged = -1
+	var s = bufio.NewScanner(stdout)
+	s.Split(scanProgress)
+	for s.Scan() {
+		var n, pct, ok = parseRsyncProgress(s.Text())
+		if !ok {
+			continue
+		}
+		p.update(func(p *mirrorPipeline) { p.Bytes, p.Percent = n, pct })
+		if pct/10 > logged {
+			logged = pct / 10
+			j.Logf("Transferred %d bytes (%d%%)", n, pct)
+		}
+	}
+
+	err = cmd.Wait()
+	if err != nil {
+		var msg = strings.TrimSpace(stderr.String())
+		if msg != "" {
+			j.Warnf("%s", msg)
+		}
+		return fmt.Errorf("rsync failed: %w", err)
+	}
+	p.update(func(p *mirrorPipeline) { p.Percent = 100 })
+	return nil
+}
+
+// runMirror returns the mirror job: transfer, validate, and queue the load.
+// The load goes through the same path as load-batch, so it gets the same
+// follow-up jobs.
+func runMirror(p *mirrorPipeline) queue.RunFunc {
+	return func(ctx context.Context, j *queue.Job) error {
+		var err = mirrorBatch(ctx, j, p)
+		if err != nil {
+			p.update(func(p *mirrorPipeline) { p.Stage, p.Error = mirrorFailed, err.Error() })
+		}
+		return err
+	}
+}
+
+func mirrorBatch(ctx context.Context, j *queue.Job, p *mirrorPipeline) error {
+	j.Logf("Mirroring %s from %s (%s) to %s", p.Batch, p.Peer, p.Source, p.Dest)
+	var err = prepareMirrorDir(p.Dest, lineage{Parent: p.Batch, Kind: derivedMirror, Peer: p.Peer})
+	if err != nil {
+		return err
+	}
+	err = transferBatch(ctx, j, p)
+	if err != nil {
+		return err
+	}
+
+	p.update(func(p *mirrorPipeline) { p.Stage = mirrorValidating })
+	err = checkMirroredFiles(ctx, j, p.Dest)
+	if err != nil {
+		return err
+	}
+	j.Logf("Validating %s", p.Dest)
+	var contents string
+	contents, err = batchContents(p.Dest)
+	if err != nil {
+		return err
+	}
+	err = validateBatch(p.Dest)
+	if err != nil {
+		return fmt.Errorf("mirrored batch is invalid: %w", err)
+	}
+
+	var resp = queueLoadBatch("Load mirrored batch", p.Dest, contents)
+	if resp.status != StatusSuccess {
+		return fmt.Errorf("unable to queue load: %s: %v", resp.message, resp.data["error"])
+	}
+	p.update(func(p *mirrorPipeline) { p.Stage, p.Load = mirrorLoading, resp.data })
+	j.Logf("Load queued as job %d", resp.data["job"].(H)["id"])
+	return nil
+}
+
+// checkMirroredFiles verifies a mirrored batch against the checksum manifest
+// the peer sent with it. If the peer had no manifest, one is written so the
+// copy can be verified from here on.
+func checkMirroredFiles(ctx context.Context, j *queue.Job, dir string) error {
+	var c, err = checkBatchManifest(ctx, dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		var n int
+		n, err = writeBatchManifest(ctx, dir)
+		if err != nil {
+			return err
+		}
+		j.Logf("Peer sent no %s; wrote one for %d files", batchManifestName, n)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("checking %s: %w", batchManifestName, err)
+	}
+	err = logManifestCheck(j, c)
+	if err != nil {
+		return fmt.Errorf("mirrored batch is corrupt: %w", err)
+	}
+	return nil
+}
+
+func queueMirror(name, peer string) response {
+	var src = MirrorPeers[peer]
+	if src == "" {
+		return respond(StatusError, fmt.Sprintf("%q is not a known mirror peer", peer), nil)
+	}
+	if !batchNameRegexp.MatchString(name) {
+		return respond(StatusError, fmt.Sprintf("%q is not a valid batch name", name), nil)
+	}
+
+	var exists, err = checkBatch(name)
+	if err != nil {
+		return respond(StatusError, fmt.Sprintf("%q cannot be mirrored", name), H{"error": err.Error()})
+	}
+	if exists {
+		return respondNoJob()
+	}
+
+	// findBatch gives the path the batch should be at when it isn't found,
+	// which is exactly where we want to put it
+	var dst string
+	dst, err = findBatch(name)
+	if err != nil {
+		return respond(StatusError, fmt.Sprintf("%q cannot be mirrored", name), H{"error": err.Error()})
+	}
+
+	var p = &mirrorPipeline{Batch: name, Peer: peer, Source: src + "/" + name, Dest: dst, Started: time.Now(), Stage: mirrorTransferring}
+	var id = JobRunner.QueueFunc(fmt.Sprintf("Mirror batch %s from %s", name, peer), runMirror(p))
+	mirrors.Lock()
+	pruneMirrors()
+	mirrors.m[id] = p
+	mirrors.Unlock()
+
+	return respond(StatusSuccess, "Job added to queue", H{"job": H{"id": id}})
+}
+
+// getMirrorStatus reports a mirror pipeline's stage and progress, along with
+// the status of the mirror job and, once it's queued, the load job
+func getMirrorStatus(arg string) response {
+	var j, resp, ok = getJob(arg)
+	if !ok {
+		return resp
+	}
+
+	// The response is encoded after we return, so it gets a copy rather than
+	// the pipeline the job is still updating
+	mirrors.Lock()
+	var p, found = mirrors.m[j.ID()]
+	var snapshot mirrorPipeline
+	if found {
+		snapshot = *p
+	}
+	mirrors.Unlock()
+	if !found {
+		return respond(StatusError, "Not a mirror job", H{"job": H{"id": j.ID()}})
+	}
+	p = &snapshot
+
+	var data = H{"mirror": p, "job": H{"id": j.ID(), "status": j.Status()}}
+	if p.Load != nil {
+		var loadID = p.Load["job"].(H)["id"].(int64)
+		if lj := JobRunner.GetJob(loadID); lj != nil {
+			data["load_job"] = H{"id": loadID, "status": lj.Status()}
+		}
+	}
+	return respond(StatusSuccess, "", data)
+}
+
+func init() {
+	register("mirror-batch", func(r *request) response {
+		var name, peer, err = parseMirrorArgs(r.args)
+		if err != nil {
+			return respond(StatusError, fmt.Sprintf("Invalid arguments for %q: %s", r.command, err), nil)
+		}
+		return queueMirror(name, peer)
+	})
+	register("mirror-status", func(r *request) response {
+		if len(r.args) != 1 {
+			return respond(StatusError, fmt.Sprintf("%q requires exactly one job id", r.command), nil)
+		}
+		return getMirrorStatus(r.args[0])
+	})
+}
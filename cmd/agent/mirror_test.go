@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+func TestParseMirrorPeers(t *testing.T) {
+	var peers, err = parseMirrorPeers("staging=oni@staging:/mnt/batches/, qa = qa:/batches")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var diff = cmp.Diff(map[string]string{"staging": "oni@staging:/mnt/batches", "qa": "qa:/batches"}, peers)
+	if diff != "" {
+		t.Fatal(diff)
+	}
+
+	for _, bad := range []string{"staging", "=foo:/bar", "a=x:/y,a=z:/w"} {
+		_, err = parseMirrorPeers(bad)
+		if err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+}
+
+func TestParseMirrorArgs(t *testing.T) {
+	var name, peer, err = parseMirrorArgs([]string{"batch_oru_foo_ver01", "--from", "staging"})
+	if err != nil || name != "batch_oru_foo_ver01" || peer != "staging" {
+		t.Fatalf("Unexpected result: %q, %q, %v", name, peer, err)
+	}
+	for _, args := range [][]string{{"batch_oru_foo_ver01"}, {"--from", "staging"}, {"a", "b", "--from", "staging"}, {"a", "--from"}} {
+		_, _, err = parseMirrorArgs(args)
+		if err == nil {
+			t.Errorf("Expected an error for %q", args)
+		}
+	}
+}
+
+func TestParseRsyncProgress(t *testing.T) {
+	var n, pct, ok = parseRsyncProgress("    123,456,789  45%   10.00MB/s    0:00:10 (xfr#3, to-chk=10/20)")
+	if !ok || n != 123456789 || pct != 45 {
+		t.Fatalf("Unexpected result: %d, %d, %t", n, pct, ok)
+	}
+	_, _, ok = parseRsyncProgress("sending incremental file list")
+	if ok {
+		t.Fatal("Expected a non-progress line not to parse")
+	}
+}
+
+func TestTransferBatch(t *testing.T) {
+	// A stand-in for rsync which reports progress and then copies the source
+	// directory's contents into the destination
+	var bin = filepath.Join(t.TempDir(), "rsync")
+	var script = "#!/bin/sh\nfor last; do :; done\nprintf '  1,000  50%%  1kB/s\\r  2,000 100%%  1kB/s\\n'\neval src=\\${$(($#-1))}\ncp -R \"$src\". \"$last\"\n"
+	os.WriteFile(bin, []byte(script), 0755)
+	var origRsync = MirrorRsync
+	defer func() { MirrorRsync = origRsync }()
+	MirrorRsync = bin
+
+	var dst = filepath.Join(t.TempDir(), "batch_oru_testbatch_ver01")
+	var err = prepareMirrorDir(dst, lineage{Parent: "batch_oru_testbatch_ver01", Kind: derivedMirror, Peer: "staging"})
+	if err != nil {
+		t.Fatalf("Unable to prepare mirror dir: %s", err)
+	}
+
+	var q = queue.New(queue.CommandRunner{})
+	var p = &mirrorPipeline{Batch: "batch_oru_testbatch_ver01", Source: filepath.Join("testdata", "valid"), Dest: dst}
+	var j = q.NewFuncJob("test", func(ctx context.Context, j *queue.Job) error { return transferBatch(ctx, j, p) })
+	err = j.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Transfer failed: %s (%s)", err, j.Stderr())
+	}
+	if p.Bytes != 2000 || p.Percent != 100 {
+		t.Fatalf("Expected progress to be tracked, got %d bytes, %d%%", p.Bytes, p.Percent)
+	}
+	if !strings.Contains(strings.Join(j.StdoutValues(), "\n"), "(50%)") {
+		t.Fatalf("Expected progress to be logged, got %q", j.StdoutValues())
+	}
+	err = validateBatch(dst)
+	if err != nil {
+		t.Fatalf("Expected the mirrored batch to be valid: %s", err)
+	}
+
+	// An interrupted mirror can be resumed, but nothing else gets overwritten
+	err = prepareMirrorDir(dst, lineage{Kind: derivedMirror})
+	if err != nil {
+		t.Fatalf("Expected an earlier mirror to be resumable: %s", err)
+	}
+	err = prepareMirrorDir(t.TempDir(), lineage{Kind: derivedMirror})
+	if err == nil {
+		t.Fatal("Expected an existing non-mirror directory to be refused")
+	}
+}
+
+func TestPruneMirrors(t *testing.T) {
+	JobRunner = queue.New(queue.CommandRunner{Path: "/bin/false"})
+	var live = JobRunner.QueueFunc("mirror", func(context.Context, *queue.Job) error { return nil })
+	var purged = live + 100
+
+	mirrors.Lock()
+	defer mirrors.Unlock()
+	var orig = mirrors.m
+	defer func() { mirrors.m = orig }()
+	mirrors.m = map[int64]*mirrorPipeline{live: {Batch: "live"}, purged: {Batch: "purged"}}
+
+	pruneMirrors()
+	if len(mirrors.m) != 1 || mirrors.m[live] == nil {
+		t.Fatalf("Expected only the live mirror job's pipeline to be kept, got %#v", mirrors.m)
+	}
+}
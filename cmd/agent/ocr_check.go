@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/open-oni/oni-agent/internal/alto"
+	"github.com/open-oni/oni-agent/internal/batchxml"
+	"github.com/spf13/afero"
+)
+
+// maxOCRSample is the largest sample --check-ocr accepts; beyond that, "all"
+// is the better choice anyway
+const maxOCRSample = 10000
+
+// ocrCheck is the result of checking a batch's ALTO files
+type ocrCheck struct {
+	// Files is how many OCR files the batch's issues reference; Checked is
+	// how many were looked at, which is fewer when sampling
+	Files    int          `json:"files"`
+	Checked  int          `json:"checked"`
+	Sampled  bool         `json:"sampled"`
+	Problems []ocrProblem `json:"problems"`
+}
+
+// ocrProblem is a single page whose OCR won't index properly
+type ocrProblem struct {
+	Issue   string `json:"issue"`
+	File    string `json:"file"`
+	Problem string `json:"problem"`
+}
+
+// ocrFile is one ALTO file and the issue which references it
+type ocrFile struct {
+	issue string
+	path  batchxml.RelPath
+	dir   string
+}
+
+// parseOCRSample reads --check-ocr's value: "all", or how many files to
+// sample. Zero means every file.
+func parseOCRSample(val string) (int, error) {
+	if val == "all" {
+		return 0, nil
+	}
+	var n, err = strconv.Atoi(val)
+	if err != nil || n < 1 || n > maxOCRSample {
+		return 0, fmt.Errorf(`--check-ocr must be "all" or a number of files from 1 to %d`, maxOCRSample)
+	}
+	return n, nil
+}
+
+// batchOCRFiles lists every OCR file the batch's issue METS files reference,
+// in batch order. As with export-ocr, an issue's OCR files are the XML files
+// its METS points to.
+func batchOCRFiles(batchPath string, b *batchxml.Batch) ([]ocrFile, error) {
+	var files []ocrFile
+	for _, i := range b.Issues {
+		var f, err = agentFS.Open(i.Path(batchPath))
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", i.Filepath, err)
+		}
+		var m *batchxml.METS
+		m, err = batchxml.ParseMETS(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", i.Filepath, err)
+		}
+		for _, p := range m.Files {
+			if strings.EqualFold(p.Ext(), ".xml") {
+				files = append(files, ocrFile{issue: i.Filepath, path: p, dir: i.Dir(batchPath)})
+			}
+		}
+	}
+	return files, nil
+}
+
+// sampleOCRFiles picks n files spread evenly through the batch, so every
+// part of it is represented. The same batch always gets the same sample.
+func sampleOCRFiles(files []ocrFile, n int) []ocrFile {
+	if n <= 0 || n >= len(files) {
+		return files
+	}
+	var sample = make([]ocrFile, n)
+	for i := range sample {
+		sample[i] = files[i*len(files)/n]
+	}
+	return sample
+}
+
+// checkOCRFile returns what's wrong with an ALTO file, or "" if it's fine:
+// the file must exist, be well-formed XML, and have at least one TextBlock.
+// Zero-byte and truncated files are the usual culprits.
+func checkOCRFile(fname string) string {
+	var info, err = agentFS.Stat(fname)
+	if err != nil {
+		return err.Error()
+	}
+	if info.Size() == 0 {
+		return "file is empty"
+	}
+
+	var f afero.File
+	f, err = agentFS.Open(fname)
+	if err != nil {
+		return err.Error()
+	}
+	defer f.Close()
+
+	_, err = alto.Text(f)
+	if errors.Is(err, alto.ErrNotALTO) {
+		return "no ALTO TextBlock elements found"
+	}
+	if err != nil {
+		return "not well-formed XML: " + err.Error()
+	}
+	return ""
+}
+
+// checkBatchOCR checks the batch's OCR files, or a sample of size n of them
+// if n is nonzero
+func checkBatchOCR(batchPath string, n int) (*ocrCheck, error) {
+	var b, err = readBatchXML(batchPath)
+	if err != nil {
+		return nil, err
+	}
+	var files []ocrFile
+	files, err = batchOCRFiles(batchPath, b)
+	if err != nil {
+		return nil, err
+	}
+
+	var check = &ocrCheck{Files: len(files), Problems: []ocrProblem{}}
+	var toCheck = sampleOCRFiles(files, n)
+	check.Checked, check.Sampled = len(toCheck), len(toCheck) < len(files)
+	for _, f := range toCheck {
+		var problem = checkOCRFile(f.path.Join(f.dir))
+		if problem != "" {
+			check.Problems = append(check.Problems, ocrProblem{Issue: f.issue, File: f.path.String(), Problem: problem})
+		}
+	}
+	return check, nil
+}
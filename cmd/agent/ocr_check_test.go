@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/open-oni/oni-agent/internal/batchxml"
+)
+
+func TestCheckBatchOCR(t *testing.T) {
+	var dir = filepath.Join(t.TempDir(), "batch_oru_ocr_ver01")
+	writeBatch(t, dir, ocrTestBatch)
+
+	var check, err = checkBatchOCR(dir, 0)
+	if err != nil {
+		t.Fatalf("Unable to check OCR: %s", err)
+	}
+	var issue = "sn83025138/1902112201/1902112201.xml"
+	if check.Files != 4 || check.Checked != 4 || check.Sampled || len(check.Problems) != 1 || check.Problems[0].Issue != issue || check.Problems[0].File != "0002.xml" {
+		t.Fatalf("Expected just the missing OCR file to be reported, got %#v", check)
+	}
+
+	// Zero-byte, truncated, and non-ALTO files are all caught
+	var issueDir = filepath.Join(batchxml.DataDir(dir), "sn83025138", "1902112201")
+	var other = filepath.Join(batchxml.DataDir(dir), "sn96088442", "1902112901")
+	for fname, content := range map[string]string{
+		filepath.Join(issueDir, "0001.xml"): "",
+		filepath.Join(issueDir, "0002.xml"): "<alto><Layout><Page><TextBlock><TextLine>",
+		filepath.Join(other, "0002.xml"):    "<html><body>Not OCR</body></html>",
+	} {
+		err = os.WriteFile(fname, []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("Unable to write %s: %s", fname, err)
+		}
+	}
+
+	check, err = checkBatchOCR(dir, 0)
+	if err != nil {
+		t.Fatalf("Unable to check OCR: %s", err)
+	}
+	var problems []string
+	for _, p := range check.Problems {
+		problems = append(problems, p.File+": "+strings.SplitN(p.Problem, ":", 2)[0])
+	}
+	var want = []string{"0001.xml: file is empty", "0002.xml: not well-formed XML", "0002.xml: no ALTO TextBlock elements found"}
+	if diff := cmp.Diff(want, problems); diff != "" {
+		t.Fatalf("Unexpected problems (-want +got):\n%s", diff)
+	}
+
+	check, err = checkBatchOCR(dir, 2)
+	if err != nil {
+		t.Fatalf("Unable to check OCR: %s", err)
+	}
+	if check.Files != 4 || check.Checked != 2 || !check.Sampled {
+		t.Fatalf("Expected a sample of 2 files, got %#v", check)
+	}
+}
+
+func TestSampleOCRFiles(t *testing.T) {
+	var files []ocrFile
+	for i := range 10 {
+		files = append(files, ocrFile{path: batchxml.RelPath(string(rune('a' + i)))})
+	}
+	var got []string
+	for _, f := range sampleOCRFiles(files, 4) {
+		got = append(got, f.path.String())
+	}
+	if diff := cmp.Diff([]string{"a", "c", "f", "h"}, got); diff != "" {
+		t.Errorf("Unexpected sample (-want +got):\n%s", diff)
+	}
+	if len(sampleOCRFiles(files, 20)) != 10 || len(sampleOCRFiles(files, 0)) != 10 {
+		t.Errorf("Expected every file when the sample covers the batch")
+	}
+}
+
+func TestParseValidateArgs(t *testing.T) {
+	var tests = map[string]struct {
+		args     []string
+		expected validateOptions
+		hasError bool
+	}{
+		"plain":        {args: []string{"batch_oru_foo_ver01"}},
+		"revalidate":   {args: []string{"batch_oru_foo_ver01", "--revalidate"}, expected: validateOptions{revalidate: true}},
+		"ocr all":      {args: []string{"--check-ocr", "all", "batch_oru_foo_ver01"}, expected: validateOptions{checkOCR: true}},
+		"ocr sample":   {args: []string{"batch_oru_foo_ver01", "--check-ocr", "50", "--revalidate"}, expected: validateOptions{revalidate: true, checkOCR: true, ocrSample: 50}},
+		"no name":      {args: []string{"--revalidate"}, hasError: true},
+		"two names":    {args: []string{"batch_oru_foo_ver01", "batch_oru_bar_ver01"}, hasError: true},
+		"no ocr value": {args: []string{"batch_oru_foo_ver01", "--check-ocr"}, hasError: true},
+		"bad sample":   {args: []string{"batch_oru_foo_ver01", "--check-ocr", "0"}, hasError: true},
+	}
+	for name, tc := range tests {
+		var _, got, err = parseValidateArgs(tc.args)
+		if tc.hasError {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %#v", name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err)
+			continue
+		}
+		if got != tc.expected {
+			t.Errorf("%s: expected %#v, got %#v", name, tc.expected, got)
+		}
+	}
+}
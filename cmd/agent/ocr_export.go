@@ -0,0 +1,287 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/open-oni/oni-agent/internal/alto"
+	"github.com/open-oni/oni-agent/internal/batchxml"
+	"github.com/open-oni/oni-agent/internal/issuekey"
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+// ocrExportIssue is one issue's entry in an OCR export's manifest
+type ocrExportIssue struct {
+	Key   issuekey.Key `json:"key"`
+	Batch string       `json:"batch"`
+	File  string       `json:"file"`
+	Pages int          `json:"pages"`
+	Bytes int          `json:"bytes"`
+
+	// Missing lists the OCR files which couldn't be read; their pages are
+	// left out of the text
+	Missing []string `json:"missing,omitempty"`
+}
+
+// ocrExportManifest is stored in the export zip as manifest.json, and
+// summarized in the job's logs
+type ocrExportManifest struct {
+	Source    string           `json:"source"`
+	Generated time.Time        `json:"generated"`
+	Batches   []string         `json:"batches"`
+	Issues    []ocrExportIssue `json:"issues"`
+	Pages     int              `json:"pages"`
+	Bytes     int              `json:"bytes"`
+	Missing   int              `json:"missing"`
+}
+
+// ocrExportBatch is a batch to export text from. If lccn is set, only that
+// title's issues are exported.
+type ocrExportBatch struct {
+	name string
+	path string
+	lccn string
+}
+
+func (dbLookups) loadedTitleBatches(ctx context.Context, lccn string) ([]string, error) {
+	var rows, err = reportingDB().QueryContext(ctx, ONIDB.TitleBatches, lccn)
+	if err != nil {
+		return nil, fmt.Errorf("querying database: %w", err)
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, fmt.Errorf("reading batch names from database: %w", err)
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// issueOCRText reads the text of every page of an issue. OCR files are the
+// METS's XML file references, which are in page order. Pages whose OCR can't
+// be read are returned in missing rather than failing the export.
+func issueOCRText(dir string, m *batchxml.METS) (text string, pages int, missing []string) {
+	var out strings.Builder
+	for _, f := range m.Files {
+		if !strings.EqualFold(f.Ext(), ".xml") {
+			continue
+		}
+		var page, err = readOCRFile(f.Join(dir))
+		if err != nil {
+			missing = append(missing, fmt.Sprintf("%s: %s", f, err))
+			continue
+		}
+		pages++
+		fmt.Fprintf(&out, "=== page %d ===\n%s\n", pages, page)
+	}
+	return out.String(), pages, missing
+}
+
+func readOCRFile(fname string) (string, error) {
+	var f, err = os.Open(fname)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return alto.Text(f)
+}
+
+// writeOCRExport writes the zip: one text file per issue, named
+// <lccn>/<date><edition>.txt, and a manifest. The manifest is returned so the
+// job can report on it.
+func writeOCRExport(ctx context.Context, j *queue.Job, w io.Writer, source string, batches []ocrExportBatch) (*ocrExportManifest, error) {
+	var m = &ocrExportManifest{Source: source, Batches: []string{}, Issues: []ocrExportIssue{}}
+	var zw = zip.NewWriter(w)
+	var seen = make(map[string]string)
+
+	for _, b := range batches {
+		var bx, err = batchxml.Read(b.path)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", b.name, err)
+		}
+		m.Batches = append(m.Batches, b.name)
+
+		for _, i := range bx.Issues {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if b.lccn != "" && i.LCCN != b.lccn {
+				continue
+			}
+
+			var key issuekey.Key
+			key, err = issuekey.FromParts(i.LCCN, i.IssueDate, i.EditionOrder)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", b.name, err)
+			}
+			var fname = path.Join(key.LCCN, key.DateEdition()+".txt")
+			if other := seen[fname]; other != "" {
+				j.Warnf("%s: skipping issue %s, already exported from %s", b.name, key, other)
+				continue
+			}
+			seen[fname] = b.name
+
+			var mets *batchxml.METS
+			mets, err = i.ReadMETS(b.path)
+			if err != nil {
+				return nil, fmt.Errorf("%s: reading issue %s: %w", b.name, key, err)
+			}
+			var text, pages, missing = issueOCRText(i.Dir(b.path), mets)
+			for _, msg := range missing {
+				j.Warnf("%s: issue %s: unable to read OCR %s", b.name, key, msg)
+			}
+
+			var zf io.Writer
+			zf, err = zw.Create(fname)
+			if err == nil {
+				_, err = io.WriteString(zf, text)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("writing %s: %w", fname, err)
+			}
+
+			m.Issues = append(m.Issues, ocrExportIssue{Key: key, Batch: b.name, File: fname, Pages: pages, Bytes: len(text), Missing: missing})
+			m.Pages += pages
+			m.Bytes += len(text)
+			m.Missing += len(missing)
+		}
+		j.Logf("Exported %s", b.name)
+	}
+
+	if len(m.Issues) == 0 {
+		return nil, errors.New("no issues found to export")
+	}
+	sort.Slice(m.Issues, func(a, b int) bool { return m.Issues[a].File < m.Issues[b].File })
+	m.Generated = time.Now()
+
+	var data, err = json.MarshalIndent(m, "", "  ")
+	var zf io.Writer
+	if err == nil {
+		zf, err = zw.Create("manifest.json")
+	}
+	if err == nil {
+		_, err = zf.Write(data)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("writing manifest: %w", err)
+	}
+	return m, nil
+}
+
+// runOCRExport is the export-ocr job. The zip is streamed straight into
+// artifact storage so a title's worth of text is never held in memory (on
+// disk-backed stores, anyway).
+func runOCRExport(source string, batches []ocrExportBatch) queue.RunFunc {
+	return func(ctx context.Context, j *queue.Job) error {
+		j.Logf("Exporting OCR text for %s from %d batch(es)", source, len(batches))
+		var artifactName = fmt.Sprintf("ocr-%s-%s.zip", source, time.Now().UTC().Format("20060102T150405"))
+
+		var pr, pw = io.Pipe()
+		var done = make(chan *ocrExportManifest, 1)
+		go func() {
+			var m, err = writeOCRExport(ctx, j, pw, source, batches)
+			pw.CloseWithError(err)
+			done <- m
+		}()
+		var err = Artifacts.Put(artifactName, pr)
+		pr.CloseWithError(err)
+		var m = <-done
+		if err != nil {
+			return fmt.Errorf("storing export: %w", err)
+		}
+
+		j.AddArtifact(artifactName)
+		j.Logf("Exported %d issues, %d pages, %d bytes of text as artifact %q", len(m.Issues), m.Pages, m.Bytes, artifactName)
+		if m.Missing > 0 {
+			j.Warnf("%d OCR files could not be read; see the manifest for details", m.Missing)
+		}
+		return nil
+	}
+}
+
+// ocrExportBatches works out which batches an export covers: just the named
+// batch, or every batch ONI has issues of the title in. Batches which can't be
+// found on disk are returned in missing.
+func ocrExportBatches(ctx context.Context, source string) (batches []ocrExportBatch, missing []string, err error) {
+	if batchNameRegexp.MatchString(source) {
+		var dir string
+		dir, err = findBatch(source)
+		if err == nil {
+			err = validateBatch(dir)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return []ocrExportBatch{{name: source, path: dir}}, nil, nil
+	}
+
+	if !issuekey.ValidLCCN(source) {
+		return nil, nil, fmt.Errorf("%q is neither a batch name nor an LCCN", source)
+	}
+	var names []string
+	names, err = lookups.loadedTitleBatches(ctx, source)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(names) == 0 {
+		return nil, nil, fmt.Errorf("ONI has no issues for %s", source)
+	}
+	for _, name := range names {
+		var dir, err = findBatch(name)
+		if err != nil || !hasBatchXML(dir) {
+			missing = append(missing, name)
+			continue
+		}
+		batches = append(batches, ocrExportBatch{name: name, path: dir, lccn: source})
+	}
+	if len(batches) == 0 {
+		return nil, missing, fmt.Errorf("none of the batches with issues for %s are in BATCH_SOURCE", source)
+	}
+	return batches, missing, nil
+}
+
+func exportOCR(r *request, source string) response {
+	if Artifacts == nil {
+		return respond(StatusError, "Artifact storage is not enabled", nil)
+	}
+
+	var batches, missing, err = ocrExportBatches(r.ctx, source)
+	if err != nil {
+		return respond(StatusError, fmt.Sprintf("Unable to export OCR for %q", source), H{"error": err.Error(), "missing": missing})
+	}
+
+	var data = H{}
+	if len(missing) > 0 {
+		data["warning"] = "Some of the title's batches aren't in BATCH_SOURCE and will be skipped"
+		data["missing"] = missing
+	}
+	var id = JobRunner.QueueFunc("Export OCR for "+source, runOCRExport(source, batches))
+	data["job"] = H{"id": id}
+	return respond(StatusSuccess, "Job added to queue", data)
+}
+
+func init() {
+	register("export-ocr", func(r *request) response {
+		if len(r.args) != 1 {
+			return respond(StatusError, fmt.Sprintf("%q requires exactly one LCCN or batch name", r.command), nil)
+		}
+		return exportOCR(r, r.args[0])
+	})
+}
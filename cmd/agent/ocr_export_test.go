@@ -0,0 +1,165 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/open-oni/oni-agent/internal/artifact"
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+const testALTO = `<alto><Layout><Page><PrintSpace><TextBlock>
+<TextLine><String CONTENT="Page"/><SP/><String CONTENT="%s"/></TextLine>
+</TextBlock></PrintSpace></Page></Layout></alto>`
+
+const testOCRMETS = `<mets xmlns:xlink="http://www.w3.org/1999/xlink">
+<structMap><div TYPE="np:issue"><div TYPE="np:page"/><div TYPE="np:page"/></div></structMap>
+<fileSec>
+<file><FLocat xlink:href="./0001.jp2"/></file>
+<file><FLocat xlink:href="./0001.xml"/></file>
+<file><FLocat xlink:href="./0002.jp2"/></file>
+<file><FLocat xlink:href="./0002.xml"/></file>
+</fileSec>
+</mets>`
+
+// ocrTestBatch has an issue for each of two titles. The second page of the
+// sn83025138 issue has no OCR file.
+var ocrTestBatch = testBatch{issues: []testIssue{
+	{lccn: "sn83025138", date: "1902-11-22", edition: "01", files: map[string]string{
+		"1902112201.xml": testOCRMETS,
+		"0001.xml":       fmt.Sprintf(testALTO, "one"),
+	}},
+	{lccn: "sn96088442", date: "1902-11-29", edition: "01", files: map[string]string{
+		"1902112901.xml": testOCRMETS,
+		"0001.xml":       fmt.Sprintf(testALTO, "one"),
+		"0002.xml":       fmt.Sprintf(testALTO, "two"),
+	}},
+}}
+
+func readTestZip(t *testing.T, name string) map[string]string {
+	var f, err = Artifacts.Get(name)
+	if err != nil {
+		t.Fatalf("Unable to read artifact: %s", err)
+	}
+	defer f.Close()
+	var data []byte
+	data, err = io.ReadAll(f)
+	var zr *zip.Reader
+	if err == nil {
+		zr, err = zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	}
+	if err != nil {
+		t.Fatalf("Unable to read zip: %s", err)
+	}
+
+	var files = make(map[string]string)
+	for _, zf := range zr.File {
+		var r, err = zf.Open()
+		if err == nil {
+			data, err = io.ReadAll(r)
+			r.Close()
+		}
+		if err != nil {
+			t.Fatalf("Unable to read %s from zip: %s", zf.Name, err)
+		}
+		files[zf.Name] = string(data)
+	}
+	return files
+}
+
+func TestExportOCR(t *testing.T) {
+	var origArtifacts, origSource, origTemplate = Artifacts, BatchSource, BatchPathTemplate
+	defer func() { Artifacts, BatchSource, BatchPathTemplate = origArtifacts, origSource, origTemplate }()
+
+	var store, err = artifact.NewDir(t.TempDir())
+	if err != nil {
+		t.Fatalf("Unable to create artifact store: %s", err)
+	}
+	Artifacts = store
+	BatchSource = t.TempDir()
+	BatchPathTemplate = ""
+	writeBatch(t, filepath.Join(BatchSource, "batch_oru_ocr_ver01"), ocrTestBatch)
+	useLookups(t, fakeLookups{titleBatches: func(string) ([]string, error) {
+		return []string{"batch_oru_ocr_ver01", "batch_oru_gone_ver01"}, nil
+	}})
+
+	var tests = map[string]struct {
+		source  string
+		files   map[string]string
+		missing []string
+		pages   int
+	}{
+		"batch": {
+			source: "batch_oru_ocr_ver01",
+			files: map[string]string{
+				"sn83025138/1902112201.txt": "=== page 1 ===\nPage one\n\n",
+				"sn96088442/1902112901.txt": "=== page 1 ===\nPage one\n\n=== page 2 ===\nPage two\n\n",
+			},
+			pages: 3,
+		},
+		"title": {
+			source:  "sn96088442",
+			files:   map[string]string{"sn96088442/1902112901.txt": "=== page 1 ===\nPage one\n\n=== page 2 ===\nPage two\n\n"},
+			missing: []string{"batch_oru_gone_ver01"},
+			pages:   2,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var batches, missing, err = ocrExportBatches(context.Background(), tc.source)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if len(missing) != len(tc.missing) || (len(missing) > 0 && missing[0] != tc.missing[0]) {
+				t.Fatalf("Expected missing batches %v, got %v", tc.missing, missing)
+			}
+
+			var q = queue.New(queue.CommandRunner{Path: "/bin/false"})
+			var j = q.NewFuncJob("export", runOCRExport(tc.source, batches))
+			err = j.Run(context.Background())
+			if err != nil {
+				t.Fatalf("Export failed: %s (%v)", err, j.Record().Stderr)
+			}
+			var names = j.Artifacts()
+			if len(names) != 1 {
+				t.Fatalf("Expected one artifact, got %v", names)
+			}
+
+			var files = readTestZip(t, names[0])
+			for fname, expected := range tc.files {
+				if files[fname] != expected {
+					t.Errorf("Expected %s to be %q, got %q", fname, expected, files[fname])
+				}
+			}
+			if len(files) != len(tc.files)+1 {
+				t.Errorf("Expected %d text files and a manifest, got %d files", len(tc.files), len(files))
+			}
+
+			var m ocrExportManifest
+			err = json.Unmarshal([]byte(files["manifest.json"]), &m)
+			if err != nil {
+				t.Fatalf("Unable to decode manifest: %s", err)
+			}
+			if m.Source != tc.source || m.Pages != tc.pages || len(m.Issues) != len(tc.files) {
+				t.Fatalf("Expected %d issues and %d pages for %s, got %#v", len(tc.files), tc.pages, tc.source, m)
+			}
+			if tc.source == "batch_oru_ocr_ver01" && (m.Missing != 1 || len(m.Issues[0].Missing) != 1) {
+				t.Fatalf("Expected sn83025138's second page to be reported missing, got %#v", m.Issues)
+			}
+		})
+	}
+
+	for _, source := range []string{"not-a-thing", "batch_oru_nope_ver01"} {
+		var _, _, err = ocrExportBatches(context.Background(), source)
+		if err == nil {
+			t.Errorf("Expected %q to fail", source)
+		}
+	}
+}
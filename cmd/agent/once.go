@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"os/user"
+	"time"
+
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+// Exit codes for one-shot runs
+const (
+	exitSuccess   = 0
+	exitError     = 1 // the command was refused or failed
+	exitUsage     = 2 // the agent's own arguments were wrong
+	exitJobFailed = 3 // a job the command queued didn't succeed
+)
+
+// oneShot is the command given with --once, if any. The agent runs it and
+// exits rather than serving SSH.
+var oneShot []string
+
+// onceLogPoll is how often a one-shot run checks its jobs for new output
+var onceLogPoll = time.Second
+
+// parseCommandLine reads the agent's arguments: none to serve as usual, or
+// "--once <command> [args...]" to run a single command
+func parseCommandLine(args []string) ([]string, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+	if args[0] != "--once" {
+		return nil, fmt.Errorf("unknown option %q", args[0])
+	}
+	if len(args) < 2 {
+		return nil, errors.New("--once requires a command")
+	}
+	return args[1:], nil
+}
+
+// localUser is who a one-shot run's command runs as: the OS user running the
+// agent, so ADMIN_USERS and RESTRICTED_USERS apply as they would over SSH
+func localUser() string {
+	var u, err = user.Current()
+	if err != nil {
+		return ""
+	}
+	return u.Username
+}
+
+// runOnce runs a single command exactly as if a client had sent it, writing
+// the response and then the output of any jobs it queued to out. It waits
+// for those jobs, and any they queue in turn, to finish, and returns the exit
+// code for the run.
+func runOnce(ctx context.Context, args []string, out io.Writer) int {
+	var r = &request{
+		id:      sessionID.Add(1),
+		ctx:     ctx,
+		command: args[0],
+		args:    args[1:],
+		user:    localUser(),
+		source:  netip.AddrFrom4([4]byte{127, 0, 0, 1}),
+		payload: func() ([]byte, error) { return readAll(os.Stdin, secretPayloads[args[0]]) },
+	}
+	var resp = dispatch(r)
+	var err error
+	if resp.stream != nil {
+		err = writeStream(out, resp, r.id, false)
+	} else {
+		var b []byte
+		b, err = resp.JSON(r.id)
+		if err == nil {
+			_, err = fmt.Fprintf(out, "%s\n", b)
+		}
+	}
+	if err != nil {
+		slog.Error("Unable to write response", "error", err)
+		return exitError
+	}
+	if resp.status != StatusSuccess {
+		return exitError
+	}
+
+	var id, ok = responseJobID(resp)
+	if !ok || id < 0 {
+		return exitSuccess
+	}
+	if JobRunner.Paused() {
+		slog.Error("The queue is paused, so the job can't run; resume it and try again", "job", id, "reason", JobRunner.Status().Reason)
+		return exitJobFailed
+	}
+
+	go JobRunner.Wait(ctx)
+	var code = exitSuccess
+	var followed, held = runOnceJobs(ctx, id, out)
+	for _, j := range followed {
+		if j != held && j.Status() != queue.StatusSuccessful {
+			slog.Error("Job did not succeed", "job", j.ID(), "name", j.Name(), "status", j.Status())
+			code = exitJobFailed
+		}
+	}
+	if held != nil {
+		slog.Error("The job is held by BLACKOUT_WINDOWS, so it can't run now; try again once the window ends",
+			"job", held.ID(), "name", held.Name(), "until", held.DeferredUntil())
+		return exitJobFailed
+	}
+	if ctx.Err() != nil {
+		return exitJobFailed
+	}
+	return code
+}
+
+// responseJobID returns the ID of the job a command's response says it
+// queued, if any
+func responseJobID(resp response) (int64, bool) {
+	var job, ok = resp.data["job"].(H)
+	if !ok {
+		return 0, false
+	}
+	var id int64
+	id, ok = job["id"].(int64)
+	return id, ok
+}
+
+// runOnceJobs follows the job with the given ID and every job queued after
+// it, oldest first, writing each one's output to out. Follow-up jobs, like a
+// load's reindex, are queued as the jobs before them finish, so the queue is
+// checked again after each one. It returns every job it followed, and stops
+// early, returning the job as held, if one is deferred instead of run: a
+// one-shot run can't wait out a blackout window.
+func runOnceJobs(ctx context.Context, first int64, out io.Writer) (followed []*queue.Job, held *queue.Job) {
+	var seen = make(map[int64]bool)
+	for {
+		var next *queue.Job
+		for _, j := range JobRunner.AllJobs() {
+			if j.ID() >= first && !seen[j.ID()] && (next == nil || j.ID() < next.ID()) {
+				next = j
+			}
+		}
+		if next == nil || ctx.Err() != nil {
+			return followed, nil
+		}
+		seen[next.ID()] = true
+		followed = append(followed, next)
+		if !followJob(ctx, next, out) {
+			return followed, next
+		}
+	}
+}
+
+// followJob writes a job's output to out as it's produced, returning once the
+// job has finished, it's been deferred, or ctx is canceled. It returns false
+// if the job was deferred.
+func followJob(ctx context.Context, j *queue.Job, out io.Writer) bool {
+	fmt.Fprintf(out, "== Job %d: %s\n", j.ID(), j.Name())
+	var nOut, nErr int
+	for {
+		// Check for completion before reading so we never miss the final lines
+		var finished bool
+		select {
+		case <-j.Done():
+			finished = true
+		default:
+		}
+		var lines, errs = j.StdoutSince(nOut), j.StderrSince(nErr)
+		nOut, nErr = nOut+len(lines), nErr+len(errs)
+		for _, line := range append(lines, errs...) {
+			fmt.Fprintln(out, line)
+		}
+		if finished {
+			fmt.Fprintf(out, "== Job %d: %s\n", j.ID(), j.Status())
+			return true
+		}
+		if until := j.DeferredUntil(); !until.IsZero() {
+			fmt.Fprintf(out, "== Job %d: deferred until %s\n", j.ID(), until.Format(time.RFC3339))
+			return false
+		}
+		select {
+		case <-ctx.Done():
+			return true
+		case <-j.Done():
+		case <-time.After(onceLogPoll):
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+func TestParseCommandLine(t *testing.T) {
+	var got, err = parseCommandLine(nil)
+	if err != nil || got != nil {
+		t.Fatalf("Expected no command without arguments, got %q, %v", got, err)
+	}
+	got, err = parseCommandLine([]string{"--once", "load-batch", "batch_oru_foo_ver01"})
+	if err != nil || strings.Join(got, " ") != "load-batch batch_oru_foo_ver01" {
+		t.Fatalf("Expected the command and its args, got %q, %v", got, err)
+	}
+	for _, bad := range [][]string{{"--once"}, {"load-batch"}, {"--serve"}} {
+		_, err = parseCommandLine(bad)
+		if err == nil {
+			t.Errorf("Expected %q to be refused", bad)
+		}
+	}
+}
+
+func TestRunOnce(t *testing.T) {
+	var origRunner, origPoll = JobRunner, onceLogPoll
+	defer func() { JobRunner, onceLogPoll = origRunner, origPoll }()
+	onceLogPoll = time.Millisecond
+
+	// The test command queues a job which succeeds or fails, and a follow-up
+	// once it finishes
+	commands["test-once"] = func(r *request) response {
+		var outcome = r.args[0]
+		var id = JobRunner.QueueFunc("first", func(_ context.Context, j *queue.Job) error {
+			j.Logf("working")
+			return nil
+		})
+		JobRunner.QueueFuncAfter("follow-up", func(_ context.Context, j *queue.Job) error {
+			if outcome == "fail" {
+				j.Warnf("follow-up broke")
+				return context.Canceled
+			}
+			return nil
+		}, id)
+		return respond(StatusSuccess, "Job added to queue", H{"job": H{"id": id}})
+	}
+	defer delete(commands, "test-once")
+
+	var tests = map[string]struct {
+		args     []string
+		deferred bool
+		code     int
+		output   []string
+	}{
+		"no job":       {args: []string{"version"}, code: exitSuccess},
+		"bad command":  {args: []string{"not-a-command"}, code: exitError, output: []string{`"status":"error"`}},
+		"job succeeds": {args: []string{"test-once", "ok"}, code: exitSuccess, output: []string{"== Job 1: first", "working", "== Job 2: successful"}},
+		"job fails":    {args: []string{"test-once", "fail"}, code: exitJobFailed, output: []string{"follow-up broke", "== Job 2: failed"}},
+		"job deferred": {args: []string{"test-once", "ok"}, deferred: true, code: exitJobFailed, output: []string{"== Job 1: first", "== Job 1: deferred until"}},
+	}
+	for name, tc := range tests {
+		JobRunner = queue.New(queue.CommandRunner{Path: "/bin/false"})
+		if tc.deferred {
+			JobRunner.SetDefer(func(_ int64, _ []string, now time.Time) time.Time { return now.Add(time.Hour) })
+		}
+		var ctx, cancel = context.WithCancel(context.Background())
+		var out bytes.Buffer
+		var code = runOnce(ctx, tc.args, &out)
+		cancel()
+		if code != tc.code {
+			t.Errorf("%s: expected exit code %d, got %d; output:\n%s", name, tc.code, code, out.String())
+		}
+		for _, want := range tc.output {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("%s: expected %q in output:\n%s", name, want, out.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// requiredONICommands lists the management commands the agent depends on
+var requiredONICommands = []string{"load_batch", "purge_batch", "load_titles"}
+
+// oniCommands caches the management commands ONI reported at startup. If
+// detection failed, it's nil and we don't block anything: ONI itself will
+// have to tell the user what went wrong.
+var oniCommands struct {
+	sync.RWMutex
+	list map[string]bool
+}
+
+// parseONICommands pulls command names out of "manage.py help --commands"
+// output, which is one command per line
+func parseONICommands(lines []string) map[string]bool {
+	var list = make(map[string]bool)
+	for _, line := range lines {
+		var name = strings.TrimSpace(line)
+		if name != "" && !strings.ContainsAny(name, " \t[]:") {
+			list[name] = true
+		}
+	}
+	return list
+}
+
+// detectONICommands asks ONI which management commands it has, caching the
+// result and warning about anything the agent needs which is missing
+func detectONICommands(ctx context.Context) {
+	var j = JobRunner.NewJob("ONI command list", []string{"help", "--commands"})
+	var err = j.Run(ctx)
+	if err != nil {
+		slog.Error("Unable to list ONI management commands; commands will not be pre-checked", "error", err)
+		return
+	}
+
+	var list = parseONICommands(j.StdoutValues())
+	if len(list) == 0 {
+		slog.Error("ONI reported no management commands; commands will not be pre-checked")
+		return
+	}
+
+	oniCommands.Lock()
+	oniCommands.list = list
+	oniCommands.Unlock()
+
+	for _, name := range requiredONICommands {
+		if !list[name] {
+			slog.Warn("ONI install is missing a management command the agent relies on", "command", name)
+		}
+	}
+	slog.Info("Detected ONI management commands", "count", len(list))
+}
+
+// checkONICommand returns an error if we know ONI doesn't have the named
+// management command
+func checkONICommand(name string) error {
+	oniCommands.RLock()
+	defer oniCommands.RUnlock()
+
+	if oniCommands.list != nil && !oniCommands.list[name] {
+		return fmt.Errorf("management command %q is unsupported by this ONI install", name)
+	}
+	return nil
+}
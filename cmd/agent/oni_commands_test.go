@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseONICommands(t *testing.T) {
+	var lines = []string{"batches", "check", "  load_batch  ", "", "purge_batch", "[auth]", "Type 'manage.py help <subcommand>' for help"}
+	var expected = map[string]bool{"batches": true, "check": true, "load_batch": true, "purge_batch": true}
+	var diff = cmp.Diff(expected, parseONICommands(lines))
+	if diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestCheckONICommand(t *testing.T) {
+	oniCommands.list = nil
+	if err := checkONICommand("anything"); err != nil {
+		t.Fatalf("No commands should be blocked when detection hasn't happened, got %s", err)
+	}
+
+	oniCommands.list = map[string]bool{"load_batch": true}
+	defer func() { oniCommands.list = nil }()
+	if err := checkONICommand("load_batch"); err != nil {
+		t.Fatalf("Unexpected error for known command: %s", err)
+	}
+	if err := checkONICommand("purge_batch"); err == nil {
+		t.Fatal("Expected an error for a missing command")
+	}
+}
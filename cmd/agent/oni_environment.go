@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/open-oni/oni-agent/internal/oni"
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+// oniEnvironmentFile is the state file holding the fingerprint of the ONI
+// install the agent last started against
+const oniEnvironmentFile = "oni_environment.json"
+
+// ONIEnvironment is the fingerprint of the ONI install taken at startup. New
+// jobs are stamped with its ID.
+var ONIEnvironment oni.Fingerprint
+
+// recordedEnvironment is what's persisted in oniEnvironmentFile
+type recordedEnvironment struct {
+	oni.Fingerprint
+	Recorded time.Time `json:"recorded"`
+}
+
+// checkONIEnvironment fingerprints the ONI install and, if there's a state
+// dir, compares it to the fingerprint from the last startup. A changed
+// environment doesn't stop the agent, since ops may well have moved ONI on
+// purpose, but it's logged loudly: any surprises in jobs from before the
+// restart are likely explained by it.
+func checkONIEnvironment() {
+	var err error
+	ONIEnvironment, err = oni.TakeFingerprint(ONILocation)
+	if err != nil {
+		slog.Warn("Unable to fully fingerprint the ONI environment", "error", err)
+	}
+	slog.Info("Fingerprinted ONI environment", "id", ONIEnvironment.ID(), "python", ONIEnvironment.Python, "settings", ONIEnvironment.Settings)
+
+	if State == nil {
+		return
+	}
+
+	var prev recordedEnvironment
+	var found bool
+	found, err = State.Read(oniEnvironmentFile, &prev)
+	if err != nil {
+		slog.Error("Unable to read previous ONI environment", "error", err)
+	}
+	if found && prev.ID() != ONIEnvironment.ID() {
+		var changes = ONIEnvironment.Changes(prev.Fingerprint)
+		slog.Warn("ONI ENVIRONMENT HAS CHANGED since the agent last started: archived jobs from before now ran against a different install",
+			"previous", prev.ID(), "current", ONIEnvironment.ID(), "recorded", prev.Recorded)
+		for _, c := range changes {
+			slog.Warn("ONI environment change", "change", c)
+		}
+	}
+
+	err = State.Write(oniEnvironmentFile, recordedEnvironment{Fingerprint: ONIEnvironment, Recorded: time.Now()})
+	if err != nil {
+		slog.Error("Unable to record ONI environment", "error", err)
+	}
+}
+
+// environmentWarning returns a warning if env, a job's environment ID, isn't
+// the current ONI environment. Jobs without an environment (e.g., archived by
+// older agents) get no warning, since we can't know.
+func environmentWarning(env string) string {
+	if env == "" || env == ONIEnvironment.ID() {
+		return ""
+	}
+	return fmt.Sprintf("job was queued under ONI environment %s, but the current environment is %s: ONI has moved or changed since", env, ONIEnvironment.ID())
+}
+
+// archivedEnvironmentWarning returns a warning if any of the archived jobs ran
+// under a different ONI environment than the current one
+func archivedEnvironmentWarning(list []queue.Record) string {
+	var n int
+	for _, r := range list {
+		if environmentWarning(r.Environment) != "" {
+			n++
+		}
+	}
+	if n == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d of these jobs ran under a different ONI environment than the current one (%s)", n, ONIEnvironment.ID())
+}
+
+// liveEnvironment re-fingerprints ONI for health checks, so a venv rebuilt
+// under a running agent doesn't go unnoticed until the next restart
+func liveEnvironment() H {
+	var fp, err = oni.TakeFingerprint(ONILocation)
+	var out = H{"id": fp.ID(), "started_with": ONIEnvironment.ID()}
+	if err != nil {
+		out["error"] = err.Error()
+	}
+	var changes = fp.Changes(ONIEnvironment)
+	if len(changes) > 0 {
+		slog.Warn("ONI environment has changed since the agent started; restart the agent", "changes", changes)
+		out["changes"] = changes
+	}
+	return out
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/open-oni/oni-agent/internal/state"
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+func TestCheckONIEnvironment(t *testing.T) {
+	var err error
+	State, err = state.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Unable to open state dir: %s", err)
+	}
+	var origLocation, origEnv = ONILocation, ONIEnvironment
+	defer func() { State, ONILocation, ONIEnvironment = nil, origLocation, origEnv }()
+
+	ONILocation = t.TempDir()
+	os.WriteFile(filepath.Join(ONILocation, "manage.py"), []byte("v1"), 0755)
+	checkONIEnvironment()
+	var first = ONIEnvironment.ID()
+
+	var rec recordedEnvironment
+	var found, _ = State.Read(oniEnvironmentFile, &rec)
+	if !found || rec.ID() != first {
+		t.Fatalf("Expected the environment to be recorded, got %#v", rec)
+	}
+	if environmentWarning(first) != "" || environmentWarning("") != "" {
+		t.Fatal("Expected no warning for the current or an unknown environment")
+	}
+
+	os.WriteFile(filepath.Join(ONILocation, "manage.py"), []byte("v2"), 0755)
+	if liveEnvironment()["changes"] == nil {
+		t.Fatal("Expected health to notice manage.py changing under a running agent")
+	}
+	checkONIEnvironment()
+	if ONIEnvironment.ID() == first {
+		t.Fatal("Expected a new fingerprint after manage.py changed")
+	}
+	if environmentWarning(first) == "" {
+		t.Fatal("Expected a warning for a job from the old environment")
+	}
+
+	var list = []queue.Record{{ID: 1, Environment: first}, {ID: 2, Environment: ONIEnvironment.ID()}, {ID: 3}}
+	if archivedEnvironmentWarning(list) == "" {
+		t.Fatal("Expected a warning for archived jobs from the old environment")
+	}
+	if archivedEnvironmentWarning(list[1:]) != "" {
+		t.Fatal("Expected no warning for archived jobs from the current environment")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// defaultONILockName is the lock file used in ONI_LOCATION when ONI_LOCK_FILE
+// isn't set
+const defaultONILockName = ".oni-batch.lock"
+
+// ONILockFile is the file locked around ONI batch commands, so two agents, or
+// an agent and someone running manage.py by hand, never run them at once.
+// Empty means no locking.
+var ONILockFile string
+
+// oniBatchCommands are the management commands which mustn't overlap: ONI
+// misbehaves if two batch operations run at the same time
+var oniBatchCommands = map[string]bool{
+	"load_batch":  true,
+	"purge_batch": true,
+}
+
+// errONILocked is wrapped when a batch command can't start because something
+// else holds the lock
+var errONILocked = errors.New("ONI batch commands are locked")
+
+// lockONIBatch is the queue's LockFunc. It takes an exclusive, non-blocking
+// flock on ONILockFile for batch commands, writing who holds it into the file
+// so anybody who can't get the lock can be told why. The holder is cleared
+// before the lock is released. Anything else, e.g., a person, can take the
+// same lock with flock(1); the file is empty then, and we say so.
+func lockONIBatch(_ context.Context, id int64, args []string) (func(), error) {
+	if ONILockFile == "" || len(args) == 0 || !oniBatchCommands[args[0]] {
+		return nil, nil
+	}
+
+	var f, err = os.OpenFile(ONILockFile, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("opening ONI lock file: %w", err)
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		var holder, _ = io.ReadAll(io.LimitReader(f, 1024))
+		f.Close()
+		var who = strings.TrimSpace(string(holder))
+		if who == "" {
+			who = "another process (not an agent; perhaps manage.py run by hand)"
+		}
+		return nil, fmt.Errorf("%w by %s", errONILocked, who)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("locking ONI lock file: %w", err)
+	}
+
+	var host, _ = os.Hostname()
+	var holder = fmt.Sprintf("oni-agent on %s (pid %d), job %d (%s), since %s\n", host, os.Getpid(), id, strings.Join(args, " "), time.Now().Format(time.RFC3339))
+	err = f.Truncate(0)
+	if err == nil {
+		_, err = f.WriteAt([]byte(holder), 0)
+	}
+	if err != nil {
+		slog.Warn("Unable to record ONI lock holder", "path", ONILockFile, "error", err)
+	}
+
+	return func() {
+		f.Truncate(0)
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestLockONIBatch(t *testing.T) {
+	var origFile = ONILockFile
+	defer func() { ONILockFile = origFile }()
+	ONILockFile = filepath.Join(t.TempDir(), defaultONILockName)
+
+	// Commands which aren't batch commands never lock
+	var release, err = lockONIBatch(context.Background(), 1, []string{"load_titles", "/tmp/marc"})
+	if release != nil || err != nil {
+		t.Fatalf("Expected no lock for load_titles, got %v", err)
+	}
+
+	release, err = lockONIBatch(context.Background(), 2, []string{"load_batch", "/mnt/batches/batch_oru_foo_ver01"})
+	if err != nil || release == nil {
+		t.Fatalf("Unable to lock: %s", err)
+	}
+	_, err = lockONIBatch(context.Background(), 3, []string{"purge_batch", "batch_oru_foo_ver01"})
+	if !errors.Is(err, errONILocked) || !strings.Contains(err.Error(), "job 2 (load_batch /mnt/batches/batch_oru_foo_ver01)") {
+		t.Fatalf("Expected a locked error naming job 2, got %v", err)
+	}
+	release()
+
+	// Someone else holding the lock, e.g., with flock(1), leaves the file empty
+	var f *os.File
+	f, err = os.OpenFile(ONILockFile, os.O_RDWR, 0644)
+	if err == nil {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	}
+	if err != nil {
+		t.Fatalf("Expected the lock to be released: %s", err)
+	}
+	_, err = lockONIBatch(context.Background(), 4, []string{"load_batch", "x"})
+	if !errors.Is(err, errONILocked) || !strings.Contains(err.Error(), "manage.py run by hand") {
+		t.Fatalf("Expected a locked error for an outside holder, got %v", err)
+	}
+	f.Close()
+
+	release, err = lockONIBatch(context.Background(), 5, []string{"load_batch", "x"})
+	if err != nil {
+		t.Fatalf("Unable to lock after the outside holder let go: %s", err)
+	}
+	release()
+
+	ONILockFile = ""
+	release, err = lockONIBatch(context.Background(), 6, []string{"load_batch", "x"})
+	if release != nil || err != nil {
+		t.Fatalf("Expected no lock when locking is disabled, got %v", err)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import "context"
+
+// oniLookups is every read of ONI's database which commands make beyond a
+// simple existence check. Commands go through lookups rather than querying
+// dbPool themselves, so tests can answer for the database by swapping in a
+// fake.
+type oniLookups interface {
+	// loadedBatchAwardee returns the awardee ONI has for a loaded batch, or
+	// an empty string if the batch isn't loaded
+	loadedBatchAwardee(name string) (string, error)
+
+	// loadedFamilyBatches returns the names of every loaded batch starting
+	// with the family name, which includes batches derived from the family's
+	// versions
+	loadedFamilyBatches(ctx context.Context, family string) ([]string, error)
+
+	// loadedTitleBatches returns the batches which have issues for a title
+	loadedTitleBatches(ctx context.Context, lccn string) ([]string, error)
+
+	// titleIssues returns every issue of a title, sorted by date and edition
+	titleIssues(ctx context.Context, lccn string) ([]titleIssue, error)
+
+	// snapshotPages returns the batch's page rows for a purge snapshot
+	snapshotPages(ctx context.Context, name string) ([]snapshotPage, error)
+}
+
+// lookups answers oniLookups from ONI's database
+var lookups oniLookups = dbLookups{}
+
+// dbLookups is the real oniLookups. Its methods live alongside the commands
+// which use them.
+type dbLookups struct{}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/open-oni/oni-agent/internal/oni"
+)
+
+// AdminUsers are the only users who may run adminCommands. If it's empty,
+// nobody can: managing ONI's Django users has to be opted into.
+var AdminUsers = map[string]bool{}
+
+// adminCommands need the admin capability, i.e., the user must be listed in
+// ADMIN_USERS. Unfreezing is here so a frozen batch's protection can't be
+// undone by anybody who could simply purge it. The agent's own logs can show
+// other users' commands, so they're admin-only too, as is moving the agent's
+// state, which includes every issued token. Issuing tokens is admin-only
+// because a token's holder needn't be a user the agent knows at all.
+// migrate-status shows the state dir's layout and history, which is nobody's
+// business but the agent's admins'.
+var adminCommands = map[string]bool{
+	"agent-logs":          true,
+	"create-admin-user":   true,
+	"export-state":        true,
+	"import-state":        true,
+	"issue-token":         true,
+	"migrate-status":      true,
+	"reset-user-password": true,
+	"unfreeze-batch":      true,
+}
+
+// secretPayloads are the commands whose payloads are passwords, so they're
+// never logged
+var secretPayloads = map[string]bool{
+	"create-admin-user":   true,
+	"reset-user-password": true,
+}
+
+// oniUserTimeout is how long a user management command may take
+const oniUserTimeout = time.Minute
+
+// maxPasswordLength is the longest password payload we accept, in bytes
+const maxPasswordLength = 1024
+
+// djangoUsernameRegexp matches what Django's default username validator
+// allows
+var djangoUsernameRegexp = regexp.MustCompile(`^[\w.@+-]{1,150}$`)
+
+// The user management scripts run in ONI's "manage.py shell". The password is
+// read from STDIN so it never shows up in a process list, an environment, or
+// a job log; everything else comes from env vars. Exit code 2 means a problem
+// the client can fix (no such user, password too weak, etc.), and the reason
+// is the last line of STDERR.
+const (
+	createUserScript = `
+import os, sys
+from django.contrib.auth import get_user_model
+from django.contrib.auth.password_validation import validate_password
+from django.core.exceptions import ValidationError
+User = get_user_model()
+name = os.environ["ONI_AGENT_USERNAME"]
+if User.objects.filter(username=name).exists():
+    sys.stderr.write("user %s already exists\n" % name)
+    sys.exit(2)
+password = sys.stdin.read()
+user = User(username=name, email=os.environ["ONI_AGENT_EMAIL"], is_staff=True, is_superuser=True)
+try:
+    validate_password(password, user)
+except ValidationError as e:
+    sys.stderr.write("; ".join(e.messages) + "\n")
+    sys.exit(2)
+user.set_password(password)
+user.save()
+print("created superuser %s" % name)
+`
+	resetPasswordScript = `
+import os, sys
+from django.contrib.auth import get_user_model
+from django.contrib.auth.password_validation import validate_password
+from django.core.exceptions import ValidationError
+User = get_user_model()
+name = os.environ["ONI_AGENT_USERNAME"]
+try:
+    user = User.objects.get(username=name)
+except User.DoesNotExist:
+    sys.stderr.write("user %s does not exist\n" % name)
+    sys.exit(2)
+password = sys.stdin.read()
+try:
+    validate_password(password, user)
+except ValidationError as e:
+    sys.stderr.write("; ".join(e.messages) + "\n")
+    sys.exit(2)
+user.set_password(password)
+user.save()
+print("reset password for %s" % name)
+`
+)
+
+// readPassword gets the new password from the request's payload. A single
+// trailing newline is dropped, since that's what "echo" and friends add.
+func readPassword(r *request) (string, error) {
+	var data, err = r.payload()
+	if err != nil {
+		return "", err
+	}
+	var pw = strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r")
+	if pw == "" {
+		return "", errors.New("a password must be sent as the payload")
+	}
+	if len(pw) > maxPasswordLength {
+		return "", fmt.Errorf("password must be at most %d bytes", maxPasswordLength)
+	}
+	if strings.ContainsAny(pw, "\r\n") {
+		return "", errors.New("password must be a single line")
+	}
+	return pw, nil
+}
+
+// runONIUserScript runs a user management script in ONI's "manage.py shell",
+// handing it the password on STDIN, and returns its trimmed output
+var runONIUserScript = func(ctx context.Context, script, password string, env ...string) (stdout, stderr string, err error) {
+	var ctx2, cancel = context.WithTimeout(ctx, oniUserTimeout)
+	defer cancel()
+
+	var cmd = oni.NewRunner(ONILocation).Command(ctx2, []string{"shell", "-c", script})
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdin = strings.NewReader(password)
+	var out, errOut bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+	err = cmd.Run()
+	return strings.TrimSpace(out.String()), strings.TrimSpace(errOut.String()), err
+}
+
+// manageUser runs one of the user scripts and turns the result into a
+// response. Output is never logged wholesale, just in case ONI echoes
+// anything it shouldn't.
+func manageUser(r *request, action, script, username string, env ...string) response {
+	var err = checkONICommand("shell")
+	if err != nil {
+		return respond(StatusError, fmt.Sprintf("Unable to %s", action), H{"error": err.Error()})
+	}
+
+	var pw string
+	pw, err = readPassword(r)
+	if err != nil {
+		return respond(StatusError, fmt.Sprintf("Unable to %s", action), payloadErrorData(err))
+	}
+
+	var stdout, stderr string
+	env = append(env, "ONI_AGENT_USERNAME="+username)
+	stdout, stderr, err = runONIUserScript(r.ctx, script, pw, env...)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 2 {
+		var lines = strings.Split(stderr, "\n")
+		return respond(StatusError, fmt.Sprintf("Unable to %s", action), H{"error": lines[len(lines)-1]})
+	}
+	if err != nil {
+		r.logError("ONI user management failed", "action", action, "username", username, "error", err)
+		return respond(StatusError, fmt.Sprintf("Unable to %s", action), H{"error": err.Error()})
+	}
+
+	r.logInfo("ONI user management", "action", action, "username", username, "by", r.user)
+	return respond(StatusSuccess, stdout, H{"username": username})
+}
+
+func createAdminUser(r *request, username, email string) response {
+	if !djangoUsernameRegexp.MatchString(username) {
+		return respond(StatusError, fmt.Sprintf("%q is not a valid username", username), nil)
+	}
+	if strings.Count(email, "@") != 1 || strings.ContainsAny(email, " \t\r\n") {
+		return respond(StatusError, fmt.Sprintf("%q is not a valid email address", email), nil)
+	}
+	return manageUser(r, "create admin user", createUserScript, username, "ONI_AGENT_EMAIL="+email)
+}
+
+func resetUserPassword(r *request, username string) response {
+	if !djangoUsernameRegexp.MatchString(username) {
+		return respond(StatusError, fmt.Sprintf("%q is not a valid username", username), nil)
+	}
+	return manageUser(r, "reset password", resetPasswordScript, username)
+}
+
+func init() {
+	register("create-admin-user", func(r *request) response {
+		if len(r.args) != 2 {
+			return respond(StatusError, fmt.Sprintf("%q requires a username and an email address", r.command), nil)
+		}
+		return createAdminUser(r, r.args[0], r.args[1])
+	})
+	register("reset-user-password", func(r *request) response {
+		if len(r.args) != 1 {
+			return respond(StatusError, fmt.Sprintf("%q requires exactly one username", r.command), nil)
+		}
+		return resetUserPassword(r, r.args[0])
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestAdminCommandsAllowed(t *testing.T) {
+	var origAdmins, origRestricted = AdminUsers, RestrictedUsers
+	defer func() { AdminUsers, RestrictedUsers = origAdmins, origRestricted }()
+	AdminUsers = map[string]bool{"ops": true}
+	RestrictedUsers = map[string]bool{"partner": true}
+
+	var tests = map[string]struct {
+		user    string
+		command string
+		allowed bool
+	}{
+		"admin create":      {user: "ops", command: "create-admin-user", allowed: true},
+		"admin reset":       {user: "ops", command: "reset-user-password", allowed: true},
+		"admin load":        {user: "ops", command: "load-batch", allowed: true},
+		"non-admin create":  {user: "nobody", command: "create-admin-user", allowed: false},
+		"non-admin reset":   {user: "nobody", command: "reset-user-password", allowed: false},
+		"restricted create": {user: "partner", command: "create-admin-user", allowed: false},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var r = &request{user: tc.user, command: tc.command}
+			if got := r.allowed(); got != tc.allowed {
+				t.Fatalf("Expected allowed to be %v, got %v", tc.allowed, got)
+			}
+		})
+	}
+}
+
+func TestResetUserPassword(t *testing.T) {
+	var origRun = runONIUserScript
+	defer func() { runONIUserScript = origRun }()
+
+	var gotPassword string
+	var gotEnv []string
+	runONIUserScript = func(_ context.Context, _, password string, env ...string) (string, string, error) {
+		gotPassword, gotEnv = password, env
+		if strings.Contains(strings.Join(env, " "), "ONI_AGENT_USERNAME=ghost") {
+			return "", "Traceback...\nuser ghost does not exist", exec.Command("sh", "-c", "exit 2").Run()
+		}
+		return "reset password for jdoe", "", nil
+	}
+
+	var req = func(username, payload string) *request {
+		return &request{ctx: context.Background(), command: "reset-user-password", args: []string{username}, payload: func() ([]byte, error) { return []byte(payload), nil }}
+	}
+
+	var resp = resetUserPassword(req("jdoe", "correct horse battery staple\n"), "jdoe")
+	if resp.status != StatusSuccess {
+		t.Fatalf("Expected success, got %#v", resp)
+	}
+	if gotPassword != "correct horse battery staple" {
+		t.Fatalf("Expected the trailing newline to be dropped, got %q", gotPassword)
+	}
+	if strings.Contains(strings.Join(gotEnv, " "), gotPassword) {
+		t.Fatal("The password must not be passed in the environment")
+	}
+
+	resp = resetUserPassword(req("ghost", "hunter2hunter2"), "ghost")
+	if resp.status != StatusError || resp.data["error"] != "user ghost does not exist" {
+		t.Fatalf("Expected the script's last error line, got %#v", resp)
+	}
+
+	for name, tc := range map[string]struct{ username, payload string }{
+		"empty password":     {"jdoe", "\n"},
+		"multiline password": {"jdoe", "one\ntwo"},
+		"bad username":       {"j doe", "hunter2hunter2"},
+	} {
+		resp = resetUserPassword(req(tc.username, tc.payload), tc.username)
+		if resp.status != StatusError {
+			t.Errorf("%s: expected an error, got %#v", name, resp)
+		}
+	}
+}
+
+func TestCreateAdminUserValidation(t *testing.T) {
+	var r = &request{ctx: context.Background(), payload: func() ([]byte, error) { return []byte("pw"), nil }}
+	for _, email := range []string{"nope", "a@b@c", "a b@c.org"} {
+		var resp = createAdminUser(r, "jdoe", email)
+		if resp.status != StatusError || !strings.Contains(resp.message, "email") {
+			t.Errorf("Expected %q to be rejected as an email address, got %#v", email, resp)
+		}
+	}
+}
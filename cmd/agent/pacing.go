@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pacingOptions are the PACING_* settings. Pacing is off unless a load
+// average limit or a URL to probe is set.
+type pacingOptions struct {
+	// MaxLoad is the highest one-minute load average at which new jobs may
+	// start
+	MaxLoad float64
+
+	// URL is fetched each interval; if it takes longer than MaxResponse (or
+	// fails), the site is considered under pressure
+	URL         string
+	MaxResponse time.Duration
+
+	Interval time.Duration
+}
+
+// Pacing holds the pacing settings from PACING_MAX_LOAD, PACING_URL,
+// PACING_MAX_RESPONSE_MS, and PACING_INTERVAL_SECONDS
+var Pacing = pacingOptions{MaxResponse: 2 * time.Second, Interval: 30 * time.Second}
+
+func (o pacingOptions) enabled() bool {
+	return o.MaxLoad > 0 || o.URL != ""
+}
+
+// pacingRecoverySamples is how many healthy samples in a row it takes to
+// resume a queue paused for site load, so a brief lull in traffic doesn't
+// start a big load just before the next spike
+const pacingRecoverySamples = 3
+
+// pacingReasonPrefix starts the reason on any pause the pacer makes
+const pacingReasonPrefix = "site under pressure: "
+
+// pacer pauses the queue while the site is under pressure and resumes it once
+// the pressure lets up. It only ever resumes a pause it made: if someone
+// pauses the queue by hand, that pause is left alone.
+type pacer struct {
+	opts    pacingOptions
+	loadAvg func() (float64, error)
+	probe   func(ctx context.Context) (time.Duration, error)
+
+	// reason is the reason given for the pause the pacer made, or empty
+	// if it hasn't paused the queue
+	reason  string
+	healthy int
+
+	// overridden is set when the queue is resumed by hand while the pacer
+	// has it paused
+	overridden bool
+}
+
+func newPacer(opts pacingOptions) *pacer {
+	var p = &pacer{opts: opts, loadAvg: readLoadAverage}
+	p.probe = func(ctx context.Context) (time.Duration, error) { return probeURL(ctx, opts.URL) }
+	return p
+}
+
+// pressure checks each configured signal, describing the first one which
+// shows the site is under pressure, or returning an empty string if none do
+func (p *pacer) pressure(ctx context.Context) string {
+	if p.opts.MaxLoad > 0 {
+		var load, err = p.loadAvg()
+		if err != nil {
+			slog.Warn("Unable to read load average for pacing", "error", err)
+		} else if load > p.opts.MaxLoad {
+			return fmt.Sprintf("load average %.2f is over %.2f", load, p.opts.MaxLoad)
+		}
+	}
+
+	if p.opts.URL != "" {
+		var ctx, cancel = context.WithTimeout(ctx, p.opts.MaxResponse*2)
+		defer cancel()
+		var d, err = p.probe(ctx)
+		if err != nil {
+			return fmt.Sprintf("%s failed: %s", p.opts.URL, err)
+		}
+		if d > p.opts.MaxResponse {
+			return fmt.Sprintf("%s took %dms (limit %dms)", p.opts.URL, d.Milliseconds(), p.opts.MaxResponse.Milliseconds())
+		}
+	}
+	return ""
+}
+
+// step takes one sample and pauses or resumes the queue accordingly
+func (p *pacer) step(ctx context.Context) {
+	var pressure = p.pressure(ctx)
+	var st = JobRunner.Status()
+
+	// If the queue isn't paused the way we left it, someone has paused or
+	// resumed it by hand since, and that's their call. A resume by hand
+	// holds until the pressure has eased at least once.
+	if p.reason != "" && (!st.Paused || st.Reason != p.reason) {
+		slog.Info("Queue paused or resumed by hand; pacing defers to it", "paused", st.Paused, "reason", st.Reason)
+		p.reason, p.healthy = "", 0
+		p.overridden = !st.Paused
+	}
+
+	if pressure == "" {
+		p.overridden = false
+		if p.reason == "" {
+			return
+		}
+		p.healthy++
+		if p.healthy >= pacingRecoverySamples {
+			slog.Info("Resuming queue: site pressure has eased", "samples", p.healthy)
+			JobRunner.Resume()
+			p.reason, p.healthy = "", 0
+		}
+		return
+	}
+
+	p.healthy = 0
+	if p.overridden || (st.Paused && p.reason == "") {
+		return
+	}
+	if p.reason == "" {
+		slog.Warn("Pausing queue: site is under pressure", "pressure", pressure)
+	}
+	p.reason = pacingReasonPrefix + pressure
+	JobRunner.Pause(p.reason)
+}
+
+// run samples every interval until ctx is canceled
+func (p *pacer) run(ctx context.Context) {
+	var t = time.NewTicker(p.opts.Interval)
+	defer t.Stop()
+	for {
+		p.step(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// readLoadAverage returns the one-minute load average from /proc/loadavg
+func readLoadAverage() (float64, error) {
+	var data, err = os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+	var fields = strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, errors.New("/proc/loadavg is empty")
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+// probeURL times a GET of u, treating anything but a 2xx response as a
+// failure
+func probeURL(ctx context.Context, u string) (time.Duration, error) {
+	var req, err = http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	var start = time.Now()
+	var resp *http.Response
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return 0, errors.New(resp.Status)
+	}
+	return time.Since(start), nil
+}
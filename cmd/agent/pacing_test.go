@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+func TestPacer(t *testing.T) {
+	var origRunner = JobRunner
+	defer func() { JobRunner = origRunner }()
+	JobRunner = queue.New(queue.CommandRunner{Path: "/bin/false"})
+
+	var load float64
+	var p = newPacer(pacingOptions{MaxLoad: 4})
+	p.loadAvg = func() (float64, error) { return load, nil }
+
+	var sample = func(l float64, wantPaused bool) {
+		t.Helper()
+		load = l
+		p.step(context.Background())
+		if JobRunner.Paused() != wantPaused {
+			t.Fatalf("Load %.1f: expected paused: %v, got %#v", l, wantPaused, JobRunner.Status())
+		}
+	}
+
+	sample(2, false)
+	sample(6, true)
+	if !strings.HasPrefix(JobRunner.Status().Reason, pacingReasonPrefix+"load average 6.00") {
+		t.Fatalf("Expected the pause reason to explain the pressure, got %q", JobRunner.Status().Reason)
+	}
+
+	// It takes a few healthy samples in a row to resume
+	sample(1, true)
+	sample(1, true)
+	sample(7, true)
+	sample(1, true)
+	sample(1, true)
+	sample(1, false)
+
+	// A resume by hand holds until the pressure eases, after which pacing
+	// takes over again
+	sample(8, true)
+	JobRunner.Resume()
+	sample(8, false)
+	sample(8, false)
+	sample(1, false)
+	sample(8, true)
+
+	// A pause by hand is never resumed by the pacer, even if it replaces a
+	// pacing pause
+	JobRunner.Pause("ONI maintenance")
+	for range pacingRecoverySamples + 1 {
+		sample(1, true)
+	}
+	sample(8, true)
+	if JobRunner.Status().Reason != "ONI maintenance" {
+		t.Fatalf("Expected the pause by hand to be left alone, got %q", JobRunner.Status().Reason)
+	}
+	JobRunner.Resume()
+
+	// A broken load average reading doesn't count as pressure
+	p.loadAvg = func() (float64, error) { return 0, errors.New("no /proc") }
+	sample(0, false)
+}
+
+func TestPacerProbe(t *testing.T) {
+	var origRunner = JobRunner
+	defer func() { JobRunner = origRunner }()
+	JobRunner = queue.New(queue.CommandRunner{Path: "/bin/false"})
+
+	var status = http.StatusOK
+	var srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	var p = newPacer(pacingOptions{URL: srv.URL, MaxResponse: time.Second})
+	p.step(context.Background())
+	if JobRunner.Paused() {
+		t.Fatalf("Expected a quick response not to pause the queue, got %#v", JobRunner.Status())
+	}
+
+	status = http.StatusServiceUnavailable
+	p.step(context.Background())
+	if !JobRunner.Paused() || !strings.Contains(JobRunner.Status().Reason, "503") {
+		t.Fatalf("Expected a failing probe to pause the queue, got %#v", JobRunner.Status())
+	}
+
+	p.probe = func(context.Context) (time.Duration, error) { return 3 * time.Second, nil }
+	var got = p.pressure(context.Background())
+	if got != srv.URL+" took 3000ms (limit 1000ms)" {
+		t.Fatalf("Expected a slow response to be pressure, got %q", got)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/open-oni/oni-agent/internal/batchxml"
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+// issueDateFormat is how issue dates are written in batch XML
+const issueDateFormat = "2006-01-02"
+
+// dateRange is an inclusive range of issue dates. A zero value on either end
+// leaves that end open.
+type dateRange struct {
+	from time.Time
+	to   time.Time
+}
+
+func (dr dateRange) contains(t time.Time) bool {
+	return (dr.from.IsZero() || !t.Before(dr.from)) && (dr.to.IsZero() || !t.After(dr.to))
+}
+
+// parseLoadBatchArgs reads the batch name and optional --from/--to issue dates
+// given to load-batch
+func parseLoadBatchArgs(args []string) (name string, dr dateRange, err error) {
+	for i := 0; i < len(args); i++ {
+		var arg = args[i]
+		switch arg {
+		case "--from", "--to":
+			if i+1 >= len(args) {
+				return "", dr, fmt.Errorf("%s requires a date (YYYY-MM-DD)", arg)
+			}
+			i++
+			var t, err = time.Parse(issueDateFormat, args[i])
+			if err != nil {
+				return "", dr, fmt.Errorf("%q is not a valid date for %s (expected YYYY-MM-DD)", args[i], arg)
+			}
+			if arg == "--from" {
+				dr.from = t
+			} else {
+				dr.to = t
+			}
+
+		default:
+			if name != "" {
+				return "", dr, errors.New("exactly one batch name is required")
+			}
+			name = arg
+		}
+	}
+
+	if name == "" {
+		return "", dr, errors.New("exactly one batch name is required")
+	}
+	if !dr.from.IsZero() && !dr.to.IsZero() && dr.to.Before(dr.from) {
+		return "", dr, errors.New("--to must not be before --from")
+	}
+	return name, dr, nil
+}
+
+var batchNameRegexp = regexp.MustCompile(`^(batch_\w+?)_(ver\d\d)$`)
+
+// partialBatchName derives the name of the filtered batch, e.g.,
+// "batch_oru_foo_ver01" loaded from 1902-01-01 onward becomes
+// "batch_oru_foo_partial_19020101_end_ver01". The name still matches ONI's
+// batch name rules, and it's obvious at a glance what it is.
+func partialBatchName(name string, dr dateRange) (string, error) {
+	var m = batchNameRegexp.FindStringSubmatch(name)
+	if m == nil {
+		return "", fmt.Errorf("%q is not a valid batch name (expected batch_<awardee>_<name>_verNN)", name)
+	}
+
+	var from, to = "start", "end"
+	if !dr.from.IsZero() {
+		from = dr.from.Format("20060102")
+	}
+	if !dr.to.IsZero() {
+		to = dr.to.Format("20060102")
+	}
+	return fmt.Sprintf("%s_partial_%s_%s_%s", m[1], from, to, m[2]), nil
+}
+
+// buildPartialBatch writes a batch at dst containing only the issues from src
+// within the date range. Issue directories are symlinked rather than copied,
+// so this is cheap even for very large batches. The number of issues in the
+// new batch is returned.
+func buildPartialBatch(src, dst string, dr dateRange) (int, error) {
+	var data, err = os.ReadFile(batchxml.XMLPath(src))
+	if err != nil {
+		return 0, fmt.Errorf("reading file: %w", err)
+	}
+
+	var issues []*batchxml.Issue
+	var filterErr error
+	data, err = batchxml.FilterIssues(data, func(i *batchxml.Issue) bool {
+		var t, err = time.Parse(issueDateFormat, i.IssueDate)
+		if err != nil {
+			filterErr = fmt.Errorf("issue %q has an invalid date %q", i.Filepath, i.IssueDate)
+			return false
+		}
+		if !dr.contains(t) {
+			return false
+		}
+		issues = append(issues, i)
+		return true
+	})
+	if err == nil {
+		err = filterErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("processing xml: %w", err)
+	}
+	if len(issues) == 0 {
+		return 0, errors.New("no issues fall within the requested date range")
+	}
+
+	var l = lineage{Parent: filepath.Base(src), Kind: derivedPartial}
+	if !dr.from.IsZero() {
+		l.From = dr.from.Format(issueDateFormat)
+	}
+	if !dr.to.IsZero() {
+		l.To = dr.to.Format(issueDateFormat)
+	}
+	err = createDerivedDir(dst, l)
+	if err != nil {
+		return 0, err
+	}
+	err = writePartialBatch(src, dst, data, issues)
+	if err != nil {
+		os.RemoveAll(dst)
+		return 0, err
+	}
+	return len(issues), nil
+}
+
+// writePartialBatch fills in the derived batch at dst: its batch XML, and a
+// link to each of the issues' directories in src
+func writePartialBatch(src, dst string, data []byte, issues []*batchxml.Issue) error {
+	var dataDir = batchxml.DataDir(dst)
+	var err = os.MkdirAll(dataDir, 0755)
+	if err == nil {
+		err = os.WriteFile(batchxml.XMLPath(dst), data, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("writing partial batch: %w", err)
+	}
+
+	var linked = make(map[string]bool)
+	var srcData = batchxml.DataDir(src)
+	for _, i := range issues {
+		var rel = i.RelPath().Dir()
+		if rel.Escapes() {
+			return fmt.Errorf("issue %q is outside the batch's data directory", i.Filepath)
+		}
+		if rel == "." {
+			return fmt.Errorf("issue %q is not in its own directory", i.Filepath)
+		}
+		var issueDir = rel.Join(srcData)
+		if linked[issueDir] {
+			continue
+		}
+		linked[issueDir] = true
+
+		err = linkIssueDir(dataDir, rel, issueDir)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadPartialBatch builds a derived batch holding just the issues in the
+// given date range and queues a job to load it
+func loadPartialBatch(name string, dr dateRange) response {
+	var derived, err = partialBatchName(name, dr)
+	if err != nil {
+		return respond(StatusError, fmt.Sprintf("%q cannot be loaded", name), H{"error": err.Error()})
+	}
+
+	var exists bool
+	exists, err = checkBatch(derived)
+	if err != nil {
+		return respond(StatusError, fmt.Sprintf("%q cannot be loaded", derived), H{"error": err.Error()})
+	}
+	if exists {
+		return respondNoJob()
+	}
+
+	var src string
+	src, err = findBatch(name)
+	if err != nil {
+		return respond(StatusError, fmt.Sprintf("%q cannot be loaded", derived), H{"error": err.Error()})
+	}
+
+	// Derived batches live next to their parent, which keeps them where
+	// BATCH_PATH_TEMPLATE expects them
+	var dst = filepath.Join(filepath.Dir(src), derived)
+	var count int
+	count, err = buildPartialBatch(src, dst, dr)
+	if err != nil {
+		return respond(StatusError, fmt.Sprintf("%q cannot be loaded", derived), H{"error": err.Error()})
+	}
+
+	var contents string
+	var b *batchxml.Batch
+	contents, err = batchContents(dst)
+	if err == nil {
+		b, err = validateBatchIssues(dst)
+	}
+	if err != nil {
+		removePartialBatch(dst)
+		return respond(StatusError, fmt.Sprintf("%q cannot be loaded", derived), H{"error": err.Error()})
+	}
+
+	var resp = queueLoadBatch(fmt.Sprintf("Load partial batch %s", derived), dst, contents)
+	if resp.status != StatusSuccess {
+		removePartialBatch(dst)
+		return resp
+	}
+	resp.data["batch"] = H{"name": derived, "source": name, "issues": count, "awardee": b.Awardee, "award_year": b.AwardYear}
+	return resp
+}
+
+// removePartialBatch removes dir if it's a partial batch the agent built.
+// Anything else is left alone, as is a partial batch ONI may still need.
+func removePartialBatch(dir string) {
+	var l, err = readLineage(dir)
+	if err != nil || l == nil || l.Kind != derivedPartial {
+		return
+	}
+	err = os.RemoveAll(dir)
+	if err != nil {
+		slog.Error("Unable to remove partial batch", "path", dir, "error", err)
+		return
+	}
+	slog.Info("Removed partial batch", "path", dir)
+}
+
+// cleanUpPartialBatch is the partial_batches subscriber's handler for
+// finished jobs. A partial batch is removed once its load fails, since ONI
+// never took it, or once it's purged, since ONI no longer serves it.
+func cleanUpPartialBatch(j *queue.Job) {
+	var args = j.Args()
+	if path, ok := isLoadBatch(args); ok && j.Status() != queue.StatusSuccessful {
+		removePartialBatch(path)
+		return
+	}
+	if len(args) == 2 && args[0] == "purge_batch" && j.Status() == queue.StatusSuccessful {
+		var dir, err = findBatch(args[1])
+		if err == nil {
+			removePartialBatch(dir)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/open-oni/oni-agent/internal/batchxml"
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+func date(s string) time.Time {
+	var t, err = time.Parse(issueDateFormat, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestParseLoadBatchArgs(t *testing.T) {
+	var tests = map[string]struct {
+		args        []string
+		name        string
+		dr          dateRange
+		expectError bool
+	}{
+		"name only":      {args: []string{"batch_oru_foo_ver01"}, name: "batch_oru_foo_ver01"},
+		"full range":     {args: []string{"batch_oru_foo_ver01", "--from", "1902-01-01", "--to", "1902-02-01"}, name: "batch_oru_foo_ver01", dr: dateRange{date("1902-01-01"), date("1902-02-01")}},
+		"flags first":    {args: []string{"--to", "1902-02-01", "batch_oru_foo_ver01"}, name: "batch_oru_foo_ver01", dr: dateRange{to: date("1902-02-01")}},
+		"no name":        {args: []string{"--from", "1902-01-01"}, expectError: true},
+		"two names":      {args: []string{"a", "b"}, expectError: true},
+		"missing date":   {args: []string{"batch_oru_foo_ver01", "--from"}, expectError: true},
+		"bad date":       {args: []string{"batch_oru_foo_ver01", "--from", "01/01/1902"}, expectError: true},
+		"backward range": {args: []string{"batch_oru_foo_ver01", "--from", "1902-02-01", "--to", "1902-01-01"}, expectError: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var n, dr, err = parseLoadBatchArgs(tc.args)
+			if tc.expectError {
+				if err == nil {
+					t.Fatalf("Expected an error, got name %q and range %v", n, dr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if n != tc.name || dr != tc.dr {
+				t.Fatalf("Expected %q / %v, got %q / %v", tc.name, tc.dr, n, dr)
+			}
+		})
+	}
+}
+
+func TestPartialBatchName(t *testing.T) {
+	var got, err = partialBatchName("batch_oru_foo_ver02", dateRange{from: date("1902-01-01")})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var expected = "batch_oru_foo_partial_19020101_end_ver02"
+	if got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+
+	_, err = partialBatchName("foo", dateRange{})
+	if err == nil {
+		t.Errorf("Expected an error for an invalid batch name")
+	}
+}
+
+func TestBuildPartialBatch(t *testing.T) {
+	var src = filepath.Join("testdata", "dated")
+	var dst = filepath.Join(t.TempDir(), "batch_oru_dated_partial_19020115_end_ver01")
+	var dr = dateRange{from: date("1902-01-15")}
+
+	// Build twice: the second build should replace the first
+	for range 2 {
+		var n, err = buildPartialBatch(src, dst, dr)
+		if err != nil {
+			t.Fatalf("Unable to build partial batch: %s", err)
+		}
+		if n != 2 {
+			t.Fatalf("Expected 2 issues, got %d", n)
+		}
+	}
+
+	var err = validateBatch(dst)
+	if err != nil {
+		t.Fatalf("Partial batch doesn't validate: %s", err)
+	}
+	var b *batchxml.Batch
+	b, err = batchxml.Read(dst)
+	if err != nil {
+		t.Fatalf("Unable to read partial batch: %s", err)
+	}
+	if len(b.Issues) != 2 || b.Issues[0].IssueDate != "1902-02-01" {
+		t.Fatalf("Unexpected issues in partial batch: %#v", b.Issues)
+	}
+
+	var l *lineage
+	l, err = readLineage(dst)
+	if err != nil || l == nil {
+		t.Fatalf("Unable to read lineage (%v): %s", l, err)
+	}
+	if l.Parent != "dated" || l.Kind != derivedPartial || l.From != "1902-01-15" || l.To != "" {
+		t.Errorf("Unexpected lineage: %#v", l)
+	}
+
+	// A directory we didn't create must never be replaced
+	os.Remove(filepath.Join(dst, derivedMarker))
+	_, err = buildPartialBatch(src, dst, dr)
+	if err == nil {
+		t.Fatalf("Expected an error overwriting a directory without the marker file")
+	}
+
+	_, err = buildPartialBatch(src, dst+"2", dateRange{from: date("1903-01-01")})
+	if err == nil {
+		t.Fatalf("Expected an error when no issues are in range")
+	}
+}
+
+func TestBuildPartialBatchCleansUp(t *testing.T) {
+	var src = filepath.Join(t.TempDir(), "batch_oru_flat_ver01")
+	var b = writeBatch(t, src, testBatch{issues: issuesOn("1902-01-01")})
+
+	// An issue which isn't in its own directory can't be linked, which
+	// mustn't leave the half-built batch behind
+	b.Issues[0].Filepath = "1902010101.xml"
+	var data, err = b.Marshal()
+	if err == nil {
+		err = os.WriteFile(batchxml.XMLPath(src), data, 0644)
+	}
+	if err != nil {
+		t.Fatalf("Unable to rewrite batch XML: %s", err)
+	}
+
+	var dst = filepath.Join(t.TempDir(), "batch_oru_flat_partial_start_end_ver01")
+	_, err = buildPartialBatch(src, dst, dateRange{})
+	if err == nil {
+		t.Fatalf("Expected an error for an issue outside its own directory")
+	}
+	if _, err = os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("Expected the partial batch to be removed, got %v", err)
+	}
+}
+
+func TestCleanUpPartialBatch(t *testing.T) {
+	var origSource, origTemplate = BatchSource, BatchPathTemplate
+	t.Cleanup(func() { BatchSource, BatchPathTemplate = origSource, origTemplate })
+	BatchSource, BatchPathTemplate = t.TempDir(), ""
+	useLookups(t, fakeLookups{})
+
+	var src = filepath.Join("testdata", "dated")
+	var build = func(name string) string {
+		var dst = filepath.Join(BatchSource, name)
+		var _, err = buildPartialBatch(src, dst, dateRange{from: date("1902-01-15")})
+		if err != nil {
+			t.Fatalf("Unable to build partial batch: %s", err)
+		}
+		return dst
+	}
+	var run = func(ok bool, args ...string) *queue.Job {
+		var path = "/bin/false"
+		if ok {
+			path = "/bin/true"
+		}
+		var j = queue.New(queue.CommandRunner{Path: path}).NewJob("test", args)
+		_ = j.Run(context.Background())
+		return j
+	}
+	var exists = func(dir string) bool {
+		var _, err = os.Stat(dir)
+		return err == nil
+	}
+
+	// A loaded partial batch stays until it's purged
+	const name = "batch_oru_dated_partial_19020115_end_ver01"
+	var dst = build(name)
+	cleanUpPartialBatch(run(true, "load_batch", dst))
+	if !exists(dst) {
+		t.Fatalf("Expected a loaded partial batch to be kept")
+	}
+	cleanUpPartialBatch(run(false, "purge_batch", name))
+	if !exists(dst) {
+		t.Fatalf("Expected a failed purge to keep the partial batch")
+	}
+	cleanUpPartialBatch(run(true, "purge_batch", name))
+	if exists(dst) {
+		t.Fatalf("Expected a purged partial batch to be removed")
+	}
+
+	// A failed load removes it right away
+	dst = build(name)
+	cleanUpPartialBatch(run(false, "load_batch", dst))
+	if exists(dst) {
+		t.Fatalf("Expected a failed load's partial batch to be removed")
+	}
+
+	// Batches the agent didn't derive are never touched
+	var plain = filepath.Join(BatchSource, "batch_oru_plain_ver01")
+	writeBatch(t, plain, testBatch{})
+	cleanUpPartialBatch(run(false, "load_batch", plain))
+	cleanUpPartialBatch(run(true, "purge_batch", "batch_oru_plain_ver01"))
+	if !exists(plain) {
+		t.Fatalf("Expected a batch the agent didn't build to be left alone")
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Safeguards purge-batch can run before queueing a purge
+const (
+	safeguardCopy     = "copy"
+	safeguardSnapshot = "snapshot"
+)
+
+var purgeSafeguardNames = []string{safeguardCopy, safeguardSnapshot}
+
+// purgeForceFlag has purge-batch skip its safeguards
+const purgeForceFlag = "--force"
+
+// PurgeSafeguards lists the checks purge-batch makes before it queues a
+// purge. It's empty (disabled) unless PURGE_SAFEGUARDS is set.
+var PurgeSafeguards = map[string]bool{}
+
+// DarkArchiveDirs are extra places a batch's files may be kept once they're
+// gone from BATCH_SOURCE, each holding batches in directories named for them
+var DarkArchiveDirs []string
+
+// purgeSnapshot is the record of a batch's database rows taken before it's
+// purged, enough to see exactly what the purge removed
+type purgeSnapshot struct {
+	Batch   string         `json:"batch"`
+	Awardee string         `json:"awardee"`
+	Taken   time.Time      `json:"taken"`
+	Copy    string         `json:"copy,omitempty"`
+	Pages   []snapshotPage `json:"pages"`
+}
+
+// purgeChecks is what the safeguards found, reported in purge-batch's
+// response
+type purgeChecks struct {
+	Skipped  bool   `json:"skipped,omitempty"`
+	Copy     string `json:"copy,omitempty"`
+	Snapshot string `json:"snapshot,omitempty"`
+}
+
+// snapshotPage is one page row in a purge snapshot
+type snapshotPage struct {
+	LCCN     string `json:"lccn"`
+	Date     string `json:"date"`
+	Edition  int    `json:"edition"`
+	Sequence int    `json:"sequence"`
+}
+
+// parsePurgeSafeguards reads the PURGE_SAFEGUARDS setting: "all", or a
+// comma-separated list of safeguards
+func parsePurgeSafeguards(val string) (map[string]bool, error) {
+	var safeguards = map[string]bool{}
+	for _, s := range splitList(val) {
+		if s == "all" {
+			for _, s := range purgeSafeguardNames {
+				safeguards[s] = true
+			}
+			continue
+		}
+		var valid bool
+		for _, known := range purgeSafeguardNames {
+			valid = valid || s == known
+		}
+		if !valid {
+			return nil, fmt.Errorf("unknown safeguard %q (use all, or any of %s)", s, strings.Join(purgeSafeguardNames, ", "))
+		}
+		safeguards[s] = true
+	}
+	return safeguards, nil
+}
+
+// batchCopy returns the directory holding a copy of the named batch: its
+// usual place under BATCH_SOURCE, or failing that a dark archive. An empty
+// string means no copy could be found.
+func batchCopy(name string) (string, error) {
+	var dir, err = findBatch(name)
+	if err != nil {
+		return "", err
+	}
+	if hasBatchXML(dir) {
+		return dir, nil
+	}
+	for _, archive := range DarkArchiveDirs {
+		dir = filepath.Join(archive, name)
+		if hasBatchXML(dir) {
+			return dir, nil
+		}
+	}
+	return "", nil
+}
+
+func (dbLookups) snapshotPages(ctx context.Context, name string) ([]snapshotPage, error) {
+	var pages, err = batchPages(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var list = make([]snapshotPage, len(pages))
+	for i, p := range pages {
+		list[i] = snapshotPage{LCCN: p.LCCN, Date: p.Date, Edition: p.Edition, Sequence: p.Sequence}
+	}
+	return list, nil
+}
+
+// saveSnapshot stores a snapshot of the batch's database rows as an artifact,
+// returning the artifact's name
+func saveSnapshot(ctx context.Context, name, copyDir string) (string, error) {
+	var s = purgeSnapshot{Batch: name, Taken: time.Now(), Copy: copyDir}
+	var err error
+	s.Awardee, err = lookups.loadedBatchAwardee(name)
+	if err != nil {
+		return "", err
+	}
+	s.Pages, err = lookups.snapshotPages(ctx, name)
+	if err != nil {
+		return "", err
+	}
+
+	var data []byte
+	data, err = json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("encoding snapshot: %w", err)
+	}
+	var artifactName = fmt.Sprintf("purge-snapshot-%s-%s.json", name, s.Taken.Format("20060102T150405"))
+	err = Artifacts.Put(artifactName, bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("storing snapshot: %w", err)
+	}
+	return artifactName, nil
+}
+
+// checkPurgeSafeguards runs the configured safeguards for a batch about to be
+// purged, returning what they found, or nil if there are none. Safeguards are
+// skipped if force is set, which requires the admin capability and is
+// audit-logged.
+func checkPurgeSafeguards(r *request, name string, force bool) (checks *purgeChecks, resp response, ok bool) {
+	if len(PurgeSafeguards) == 0 {
+		return nil, resp, true
+	}
+	if force {
+		if !AdminUsers[r.user] {
+			return nil, respond(StatusError, fmt.Sprintf("%s requires the admin capability", purgeForceFlag), nil), false
+		}
+		slog.Warn("Purge safeguards skipped", "audit", true, "sessionID", r.id, "user", r.user, "command", r.command, "batch", name)
+		return &purgeChecks{Skipped: true}, resp, true
+	}
+
+	checks = &purgeChecks{}
+	if PurgeSafeguards[safeguardCopy] {
+		var dir, err = batchCopy(name)
+		if err != nil {
+			return nil, respond(StatusError, fmt.Sprintf("%q cannot be purged", name), H{"error": err.Error()}), false
+		}
+		if dir == "" {
+			return nil, respond(StatusError, fmt.Sprintf("No copy of %q could be found; pass %s to purge it anyway", name, purgeForceFlag), nil), false
+		}
+		checks.Copy = dir
+	}
+	if PurgeSafeguards[safeguardSnapshot] {
+		var artifactName, err = saveSnapshot(r.ctx, name, checks.Copy)
+		if err != nil {
+			return nil, respond(StatusError, fmt.Sprintf("Unable to snapshot %q; pass %s to purge it anyway", name, purgeForceFlag), H{"error": err.Error()}), false
+		}
+		checks.Snapshot = artifactName
+	}
+	return checks, resp, true
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/open-oni/oni-agent/internal/artifact"
+)
+
+func TestParsePurgeSafeguards(t *testing.T) {
+	var got, err = parsePurgeSafeguards("all")
+	if err != nil || len(got) != len(purgeSafeguardNames) {
+		t.Fatalf("Expected every safeguard for %q, got %v, %v", "all", got, err)
+	}
+	got, err = parsePurgeSafeguards("copy")
+	if err != nil || len(got) != 1 || !got[safeguardCopy] {
+		t.Fatalf("Expected just copy, got %v, %v", got, err)
+	}
+	_, err = parsePurgeSafeguards("copy,backup")
+	if err == nil {
+		t.Fatal("Expected an unknown safeguard to be rejected")
+	}
+}
+
+func TestCheckPurgeSafeguards(t *testing.T) {
+	var origSafeguards, origDark, origSource, origTemplate = PurgeSafeguards, DarkArchiveDirs, BatchSource, BatchPathTemplate
+	var origArtifacts, origAdmins = Artifacts, AdminUsers
+	defer func() {
+		PurgeSafeguards, DarkArchiveDirs, BatchSource, BatchPathTemplate = origSafeguards, origDark, origSource, origTemplate
+		Artifacts, AdminUsers = origArtifacts, origAdmins
+	}()
+
+	var store, err = artifact.NewDir(t.TempDir())
+	if err != nil {
+		t.Fatalf("Unable to create artifact store: %s", err)
+	}
+	Artifacts = store
+	BatchSource, BatchPathTemplate = t.TempDir(), ""
+	var dark = t.TempDir()
+	DarkArchiveDirs = []string{t.TempDir(), dark}
+	AdminUsers = map[string]bool{"ops": true}
+	var pages = []snapshotPage{{LCCN: "sn83025138", Date: "1902-11-22", Edition: 1, Sequence: 1}}
+	useLookups(t, fakeLookups{
+		batchAwardee: func(string) (string, error) { return "oru", nil },
+		pages:        func(string) ([]snapshotPage, error) { return pages, nil },
+	})
+
+	const name = "batch_oru_gone_ver01"
+	var r = &request{ctx: context.Background(), command: "purge-batch", user: "nca"}
+
+	PurgeSafeguards = map[string]bool{}
+	var checks, _, ok = checkPurgeSafeguards(r, name, false)
+	if !ok || checks != nil {
+		t.Fatalf("Expected no safeguards to run, got %#v", checks)
+	}
+
+	PurgeSafeguards = map[string]bool{safeguardCopy: true, safeguardSnapshot: true}
+	var resp response
+	_, resp, ok = checkPurgeSafeguards(r, name, false)
+	if ok || !strings.Contains(resp.message, "No copy") {
+		t.Fatalf("Expected a batch with no copy to be refused, got %#v", resp)
+	}
+	_, resp, ok = checkPurgeSafeguards(r, name, true)
+	if ok || !strings.Contains(resp.message, "admin") {
+		t.Fatalf("Expected a non-admin --force to be refused, got %#v", resp)
+	}
+	checks, _, ok = checkPurgeSafeguards(&request{command: "purge-batch", user: "ops"}, name, true)
+	if !ok || !checks.Skipped {
+		t.Fatalf("Expected an admin to be able to skip the safeguards, got %#v", checks)
+	}
+
+	writeBatch(t, filepath.Join(dark, name), testBatch{})
+	checks, resp, ok = checkPurgeSafeguards(r, name, false)
+	if !ok {
+		t.Fatalf("Expected the dark archive copy to satisfy the safeguards, got %#v", resp)
+	}
+	if checks.Copy != filepath.Join(dark, name) || !strings.HasPrefix(checks.Snapshot, "purge-snapshot-"+name+"-") {
+		t.Fatalf("Unexpected checks: %#v", checks)
+	}
+
+	var rc io.ReadCloser
+	rc, err = Artifacts.Get(checks.Snapshot)
+	if err != nil {
+		t.Fatalf("Unable to read snapshot: %s", err)
+	}
+	defer rc.Close()
+	var snap purgeSnapshot
+	err = json.NewDecoder(rc).Decode(&snap)
+	if err != nil {
+		t.Fatalf("Unable to decode snapshot: %s", err)
+	}
+	if snap.Batch != name || snap.Awardee != "oru" || snap.Copy != checks.Copy {
+		t.Errorf("Unexpected snapshot: %#v", snap)
+	}
+	if diff := cmp.Diff(pages, snap.Pages); diff != "" {
+		t.Errorf("Unexpected snapshot pages (-want +got):\n%s", diff)
+	}
+
+	// The batch's own directory is preferred to the archive
+	writeBatch(t, filepath.Join(BatchSource, name), testBatch{})
+	PurgeSafeguards = map[string]bool{safeguardCopy: true}
+	checks, _, ok = checkPurgeSafeguards(r, name, false)
+	if !ok || checks.Copy != filepath.Join(BatchSource, name) || checks.Snapshot != "" {
+		t.Fatalf("Expected the BATCH_SOURCE copy without a snapshot, got %#v", checks)
+	}
+
+	err = checkResponse("purge-batch", respond(StatusSuccess, "", H{"job": H{"id": 1}, "safeguards": checks}))
+	if err != nil {
+		t.Errorf("Response doesn't match its schema: %s", err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// queueStateFile is the state file holding the queue's pause status
+const queueStateFile = "queue.json"
+
+// queueState is what we persist so a paused queue stays paused across
+// restarts
+type queueState struct {
+	Paused   bool      `json:"paused"`
+	PausedAt time.Time `json:"paused_at"`
+	Reason   string    `json:"reason"`
+}
+
+// restoreQueueState pauses the queue on startup if it was paused when the
+// agent last stopped
+func restoreQueueState() {
+	if State == nil {
+		return
+	}
+
+	var qs queueState
+	var _, err = State.Read(queueStateFile, &qs)
+	if err != nil {
+		slog.Error("Unable to read queue state; queue will run normally", "error", err)
+		return
+	}
+	if qs.Paused {
+		slog.Warn("Queue was paused before restart and remains paused", "paused_at", qs.PausedAt, "reason", qs.Reason)
+		JobRunner.Pause(qs.Reason)
+	}
+}
+
+// saveQueueState persists the queue's current pause status, if there's a
+// state dir to persist it to
+func saveQueueState() error {
+	if State == nil {
+		return nil
+	}
+	var st = JobRunner.Status()
+	return State.Write(queueStateFile, queueState{Paused: st.Paused, PausedAt: st.PausedAt, Reason: st.Reason})
+}
+
+func pauseQueue(r *request, reason string) response {
+	JobRunner.Pause(reason)
+	r.logInfo("Queue paused", "reason", reason)
+	return respondQueueChange(r, "Queue paused: jobs may still be queued, but none will start until the queue is resumed")
+}
+
+func resumeQueue(r *request) response {
+	JobRunner.Resume()
+	r.logInfo("Queue resumed")
+	return respondQueueChange(r, "Queue resumed")
+}
+
+func respondQueueChange(r *request, msg string) response {
+	var data = H{"queue": JobRunner.Status()}
+	var err = saveQueueState()
+	if err != nil {
+		r.logError("Unable to persist queue state", "error", err)
+		data["warning"] = "unable to persist queue state; it will be lost on restart: " + err.Error()
+	}
+	if State == nil {
+		data["warning"] = "STATE_DIR is not configured; queue state will be lost on restart"
+	}
+	return respond(StatusSuccess, msg, data)
+}
+
+func getQueueStatus() response {
+	return respond(StatusSuccess, "", H{"queue": JobRunner.Status()})
+}
+
+func init() {
+	register("queue-pause", func(r *request) response {
+		return pauseQueue(r, strings.Join(r.args, " "))
+	})
+	register("queue-resume", func(r *request) response {
+		return resumeQueue(r)
+	})
+	register("queue-status", func(_ *request) response {
+		return getQueueStatus()
+	})
+}
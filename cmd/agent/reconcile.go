@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/open-oni/oni-agent/internal/batchxml"
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+// batchCounts holds the number of issues and pages in a batch
+type batchCounts struct {
+	Issues int `json:"issues"`
+	Pages  int `json:"pages"`
+}
+
+// batchDiscrepancy describes a loaded batch whose on-disk contents don't
+// match what ONI has in its database
+type batchDiscrepancy struct {
+	Name   string       `json:"name"`
+	Loaded batchCounts  `json:"loaded"`
+	OnDisk *batchCounts `json:"on_disk,omitempty"`
+	Error  string       `json:"error,omitempty"`
+}
+
+// reconcileReport is the site-wide report artifact the reconcile job produces
+type reconcileReport struct {
+	Generated     time.Time          `json:"generated"`
+	BatchSource   string             `json:"batch_source"`
+	Batches       int                `json:"batches"`
+	Matched       int                `json:"matched"`
+	Discrepancies []batchDiscrepancy `json:"discrepancies"`
+}
+
+// loadedBatchCounts returns the issue and page counts ONI has for every
+// loaded batch, keyed by batch name
+func loadedBatchCounts(ctx context.Context) (map[string]batchCounts, error) {
+	var rows, err = reportingDB().ReportQueryContext(ctx, ONIDB.BatchCounts)
+	if err != nil {
+		return nil, fmt.Errorf("querying database: %w", err)
+	}
+	defer rows.Close()
+
+	var counts = make(map[string]batchCounts)
+	for rows.Next() {
+		var name string
+		var c batchCounts
+		err = rows.Scan(&name, &c.Issues, &c.Pages)
+		if err != nil {
+			return nil, fmt.Errorf("reading batch counts from database: %w", err)
+		}
+		counts[name] = c
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("reading batch counts from database: %w", err)
+	}
+	return counts, nil
+}
+
+// diskBatchCounts counts the issues and pages described by a batch's XML
+func diskBatchCounts(batchPath string) (batchCounts, error) {
+	var c batchCounts
+	var b, err = batchxml.Read(batchPath)
+	if err != nil {
+		return c, err
+	}
+
+	for _, i := range b.Issues {
+		var n, err = i.CountIssuePages(batchPath)
+		if err != nil {
+			return c, fmt.Errorf("counting pages in %s: %w", i.Filepath, err)
+		}
+		c.Issues++
+		c.Pages += n
+	}
+	return c, nil
+}
+
+// reconcileBatches compares each loaded batch against its on-disk counts,
+// returning a report of all batches that don't match
+func reconcileBatches(loaded map[string]batchCounts, onDisk func(name string) (batchCounts, error)) reconcileReport {
+	var names []string
+	for name := range loaded {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var report = reconcileReport{Batches: len(names), Discrepancies: []batchDiscrepancy{}}
+	for _, name := range names {
+		var d = batchDiscrepancy{Name: name, Loaded: loaded[name]}
+		var c, err = onDisk(name)
+		if err != nil {
+			d.Error = err.Error()
+			report.Discrepancies = append(report.Discrepancies, d)
+			continue
+		}
+		if c == d.Loaded {
+			report.Matched++
+			continue
+		}
+		d.OnDisk = &c
+		report.Discrepancies = append(report.Discrepancies, d)
+	}
+
+	return report
+}
+
+// runReconcile is the reconcile job: it compares every loaded batch against
+// BATCH_SOURCE, logs any discrepancies, and stores the full report as an
+// artifact
+func runReconcile(ctx context.Context, j *queue.Job) error {
+	var loaded, err = loadedBatchCounts(ctx)
+	if err != nil {
+		return err
+	}
+	j.Logf("Reconciling %d loaded batches against %s", len(loaded), BatchSource)
+
+	var report = reconcileBatches(loaded, func(name string) (batchCounts, error) {
+		var dir, err = findBatch(name)
+		if err != nil {
+			return batchCounts{}, err
+		}
+		return diskBatchCounts(dir)
+	})
+	report.Generated = time.Now()
+	report.BatchSource = BatchSource
+
+	for _, d := range report.Discrepancies {
+		switch {
+		case d.Error != "":
+			j.Warnf("%s: unable to read batch from disk: %s", d.Name, d.Error)
+		default:
+			j.Warnf("%s: loaded %d issues / %d pages, on disk %d issues / %d pages",
+				d.Name, d.Loaded.Issues, d.Loaded.Pages, d.OnDisk.Issues, d.OnDisk.Pages)
+		}
+	}
+	j.Logf("%d of %d batches match", report.Matched, report.Batches)
+
+	var data []byte
+	data, err = json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding report: %w", err)
+	}
+
+	var name = fmt.Sprintf("reconcile-%s.json", report.Generated.UTC().Format("20060102T150405"))
+	err = Artifacts.Put(name, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("storing report: %w", err)
+	}
+	j.AddArtifact(name)
+	j.Logf("Report stored as artifact %q", name)
+
+	return nil
+}
+
+func reconcile() response {
+	if Artifacts == nil {
+		return respond(StatusError, "Artifact storage is not enabled", nil)
+	}
+
+	var id = JobRunner.QueueFunc("Reconcile batches", runReconcile)
+	return respond(StatusSuccess, "Job added to queue", H{"job": H{"id": id}})
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReconcileBatches(t *testing.T) {
+	var loaded = map[string]batchCounts{
+		"batch_a_ver01": {Issues: 2, Pages: 8},
+		"batch_b_ver01": {Issues: 3, Pages: 12},
+		"batch_c_ver01": {Issues: 1, Pages: 4},
+	}
+	var disk = map[string]batchCounts{
+		"batch_a_ver01": {Issues: 2, Pages: 8},
+		"batch_b_ver01": {Issues: 3, Pages: 10},
+	}
+	var report = reconcileBatches(loaded, func(name string) (batchCounts, error) {
+		var c, ok = disk[name]
+		if !ok {
+			return c, errors.New("reading file: no such file or directory")
+		}
+		return c, nil
+	})
+
+	var expected = reconcileReport{
+		Batches: 3,
+		Matched: 1,
+		Discrepancies: []batchDiscrepancy{
+			{Name: "batch_b_ver01", Loaded: batchCounts{3, 12}, OnDisk: &batchCounts{3, 10}},
+			{Name: "batch_c_ver01", Loaded: batchCounts{1, 4}, Error: "reading file: no such file or directory"},
+		},
+	}
+	var diff = cmp.Diff(expected, report)
+	if diff != "" {
+		t.Errorf("Unexpected report: %s", diff)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/open-oni/oni-agent/pkg/logstream"
+)
+
+// readRedactPatterns reads one regular expression per line from the given
+// file. Blank lines and lines starting with "#" are ignored.
+func readRedactPatterns(fname string) ([]*regexp.Regexp, error) {
+	var f, err = os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []*regexp.Regexp
+	var scanner = bufio.NewScanner(f)
+	var lineNum int
+	for scanner.Scan() {
+		lineNum++
+		var line = strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var re, err = regexp.Compile(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		patterns = append(patterns, re)
+	}
+
+	return patterns, scanner.Err()
+}
+
+// buildRedactor combines the configured patterns with one for the database
+// password, which we always scrub since ONI has been known to print it
+func buildRedactor(patterns []*regexp.Regexp, dsn string) *logstream.Redactor {
+	var cfg, err = mysql.ParseDSN(dsn)
+	if err == nil && cfg.Passwd != "" {
+		patterns = append(patterns, regexp.MustCompile(regexp.QuoteMeta(cfg.Passwd)))
+	}
+	if len(patterns) == 0 {
+		return nil
+	}
+	return logstream.NewRedactor(patterns...)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRedactPatterns(t *testing.T) {
+	var fname = filepath.Join(t.TempDir(), "patterns")
+	var data = "# API keys\nkey=[A-Za-z0-9]+\n\n  token:\\s*\\S+  \n"
+	var err = os.WriteFile(fname, []byte(data), 0600)
+	if err != nil {
+		t.Fatalf("Unable to write patterns file: %s", err)
+	}
+
+	var patterns, _ = readRedactPatterns(fname)
+	if len(patterns) != 2 {
+		t.Fatalf("Expected 2 patterns, got %d", len(patterns))
+	}
+
+	var r = buildRedactor(patterns, "oni:s3cr3t+pw@tcp(127.0.0.1:3306)/oni")
+	var got, n = r.Redact("key=abc123 token: xyz dsn=oni:s3cr3t+pw@tcp")
+	var expected = "[REDACTED] [REDACTED] dsn=oni:[REDACTED]@tcp"
+	if got != expected || n != 3 {
+		t.Fatalf("Expected %q with 3 redactions, got %q with %d", expected, got, n)
+	}
+
+	err = os.WriteFile(fname, []byte("ok\n(unclosed\n"), 0600)
+	if err != nil {
+		t.Fatalf("Unable to write patterns file: %s", err)
+	}
+	_, err = readRedactPatterns(fname)
+	if err == nil {
+		t.Fatal("Expected an error for an invalid pattern")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sort"
+)
+
+// Agent roles, set via AGENT_ROLE
+const (
+	roleFull   = "full"
+	roleVerify = "verify"
+)
+
+// AgentRole is what this agent is allowed to do. A "verify" agent is for
+// monitoring deployments which must never change anything: it only offers
+// verifyCommands, can't run ONI or any other program, and refuses database
+// writes.
+var AgentRole = roleFull
+
+// verifyCommands are the commands a verification-only agent offers. They
+// report on the agent, its jobs, or ONI's data without changing any of it,
+// and never run external programs. Report jobs (reconcile, verify-solr, etc.)
+// are in-process and only write artifacts.
+var verifyCommands = map[string]bool{
+	"archived-job":            true,
+	"archived-jobs":           true,
+	"batch":                   true,
+	"batch-lineage":           true,
+	"changes":                 true,
+	"check-jp2":               true,
+	"compare-environments":    true,
+	"export-ocr":              true,
+	"frozen-batches":          true,
+	"get-artifact":            true,
+	"health":                  true,
+	"host-key-info":           true,
+	"issue-files":             true,
+	"issue-key":               true,
+	"job-logs":                true,
+	"job-status":              true,
+	"list-artifacts":          true,
+	"list-batches":            true,
+	"list-jobs":               true,
+	"metrics":                 true,
+	"migrate-status":          true,
+	"mirror-status":           true,
+	"queue-status":            true,
+	"reconcile":               true,
+	"report-duplicate-titles": true,
+	"schema":                  true,
+	"simulate-queue":          true,
+	"title-calendar":          true,
+	"validate-batch":          true,
+	"verify-batch":            true,
+	"verify-solr":             true,
+	"version":                 true,
+}
+
+// errExecDisabled is why jobs can't start on a verification-only agent
+var errExecDisabled = errors.New("this agent is verification-only and cannot run commands")
+
+// errReadOnlyDB is returned for database writes on a verification-only agent
+var errReadOnlyDB = errors.New("this agent is verification-only and cannot write to the database")
+
+// noExecRunner is the job runner for verification-only agents: every command
+// it builds fails to start
+type noExecRunner struct{}
+
+// Command implements queue.Runner
+func (noExecRunner) Command(context.Context, []string) *exec.Cmd {
+	return &exec.Cmd{Err: errExecDisabled}
+}
+
+// checkRole validates AGENT_ROLE against the rest of the configuration,
+// since a verification-only agent can't have anything which runs programs
+func checkRole(role string) error {
+	switch role {
+	case roleFull:
+		return nil
+	case roleVerify:
+	default:
+		return fmt.Errorf("must be %q or %q", roleFull, roleVerify)
+	}
+
+	for name, val := range map[string]string{
+		"JOB_HOOKS_FILE": JobHooksFile,
+		"JP2_VALIDATOR":  JP2Validator,
+	} {
+		if val != "" {
+			return fmt.Errorf("%s cannot be set for a verification-only agent", name)
+		}
+	}
+	if len(MirrorPeers) > 0 {
+		return errors.New("MIRROR_PEERS cannot be set for a verification-only agent")
+	}
+	return nil
+}
+
+// roleOffers returns true if an agent with the given role keeps the command
+// when applyRole strips the registry
+func roleOffers(role, name string) bool {
+	return role != roleVerify || verifyCommands[name]
+}
+
+// applyRole strips the command registry down to what the role allows. It runs
+// once at startup, so disabled commands don't exist at all rather than being
+// refused, and can't be reached via tokens or "batch" either. The removed
+// commands are returned, sorted.
+func applyRole(role string) []string {
+	if role != roleVerify {
+		return nil
+	}
+
+	var removed []string
+	for name := range commands {
+		if !roleOffers(role, name) {
+			delete(commands, name)
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(removed)
+	return removed
+}
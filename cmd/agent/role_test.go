@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"testing"
+
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+func TestApplyRole(t *testing.T) {
+	var orig = maps.Clone(commands)
+	defer func() { commands = orig }()
+
+	if removed := applyRole(roleFull); removed != nil || len(commands) != len(orig) {
+		t.Fatalf("Expected a full agent to keep every command, removed %v", removed)
+	}
+
+	var removed = applyRole(roleVerify)
+	if len(removed) == 0 {
+		t.Fatal("Expected commands to be removed")
+	}
+	for _, name := range []string{"load-batch", "purge-batch", "ensure-awardee", "issue-token", "create-admin-user"} {
+		if commands[name] != nil {
+			t.Errorf("Expected %q to be disabled", name)
+		}
+	}
+	for name := range verifyCommands {
+		if orig[name] == nil {
+			t.Errorf("%q is listed as a verify command but doesn't exist", name)
+		}
+		if commands[name] == nil {
+			t.Errorf("Expected %q to remain", name)
+		}
+	}
+
+	// Disabled commands are unknown, even from within a bulk request
+	var resp = runBulk(&request{ctx: context.Background(), command: "batch", payload: func() ([]byte, error) {
+		return []byte("load-batch batch_oru_foo_ver01\n"), nil
+	}}, false)
+	var results = resp.data["results"].([]H)
+	if len(results) != 1 || results[0]["status"] != StatusError {
+		t.Fatalf("Expected load-batch to be refused, got %#v", resp)
+	}
+}
+
+func TestVerifyRoleCannotExecOrWrite(t *testing.T) {
+	var q = queue.New(noExecRunner{})
+	var j = q.NewJob("load", []string{"load_batch", "/mnt/batch"})
+	var err = j.Run(context.Background())
+	if !errors.Is(err, errExecDisabled) || j.Status() != queue.StatusFailStart {
+		t.Fatalf("Expected the job to fail to start, got %v (%s)", err, j.Status())
+	}
+
+	var db = &timedDB{readOnly: true}
+	_, err = db.Exec("DELETE FROM core_batch")
+	if !errors.Is(err, errReadOnlyDB) {
+		t.Fatalf("Expected a read-only error from Exec, got %v", err)
+	}
+	_, err = db.Begin()
+	if !errors.Is(err, errReadOnlyDB) {
+		t.Fatalf("Expected a read-only error from Begin, got %v", err)
+	}
+}
+
+func TestCheckRole(t *testing.T) {
+	var origHooks, origPeers = JobHooksFile, MirrorPeers
+	defer func() { JobHooksFile, MirrorPeers = origHooks, origPeers }()
+	JobHooksFile, MirrorPeers = "", nil
+
+	if checkRole(roleFull) != nil || checkRole(roleVerify) != nil {
+		t.Fatal("Expected both roles to be valid")
+	}
+	if checkRole("readonly") == nil {
+		t.Fatal("Expected an unknown role to be rejected")
+	}
+	JobHooksFile = "/etc/oni-agent/hooks.json"
+	if checkRole(roleVerify) == nil {
+		t.Fatal("Expected job hooks to be rejected for a verify agent")
+	}
+	if checkRole(roleFull) != nil {
+		t.Fatal("Expected job hooks to be fine for a full agent")
+	}
+}
@@ -0,0 +1,25 @@
+//go:build schemacheck
+
+package main
+
+import "fmt"
+
+// Building with the schemacheck tag (e.g., "go test -tags schemacheck ./...")
+// checks every dispatched command's response against its schema, so a change
+// to a response's shape can't slip by unnoticed
+func init() {
+	middlewares = append(middlewares, checkSchema)
+}
+
+// checkSchema panics if a response doesn't match its schema: it's only used
+// in test builds, where a mismatch is a bug to fix, not something to survive
+func checkSchema(next handlerFunc) handlerFunc {
+	return func(r *request) response {
+		var resp = next(r)
+		var err = checkResponse(r.command, resp)
+		if err != nil {
+			panic(fmt.Sprintf("response schema mismatch: %s", err))
+		}
+		return resp
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/open-oni/oni-agent/internal/jsonschema"
+)
+
+// schemaFiles are the JSON Schemas describing responses: envelope.json for
+// the keys every response has, and one file per command describing what it
+// sends on success
+//
+//go:embed schemas/*.json
+var schemaFiles embed.FS
+
+// envelopeSchemaName is the schema every response must match
+const envelopeSchemaName = "envelope"
+
+// responseSchemas holds each parsed schema, keyed by command name (or
+// envelopeSchemaName), along with its original JSON for the schema command
+var responseSchemas = loadResponseSchemas()
+
+type responseSchema struct {
+	raw    json.RawMessage
+	schema *jsonschema.Schema
+}
+
+// loadResponseSchemas parses every embedded schema, panicking if one's
+// invalid since that's always a programming error
+func loadResponseSchemas() map[string]responseSchema {
+	var entries, err = schemaFiles.ReadDir("schemas")
+	if err != nil {
+		panic(fmt.Sprintf("reading embedded schemas: %s", err))
+	}
+
+	var m = make(map[string]responseSchema)
+	for _, e := range entries {
+		var data, err = schemaFiles.ReadFile(path.Join("schemas", e.Name()))
+		if err != nil {
+			panic(fmt.Sprintf("reading schema %s: %s", e.Name(), err))
+		}
+		var s *jsonschema.Schema
+		s, err = jsonschema.Parse(data)
+		if err != nil {
+			panic(fmt.Sprintf("schema %s: %s", e.Name(), err))
+		}
+		m[strings.TrimSuffix(e.Name(), ".json")] = responseSchema{raw: data, schema: s}
+	}
+	return m
+}
+
+// checkResponse validates a command's response against the envelope schema
+// and, if it succeeded, the command's own schema. Error responses may carry
+// whatever data helps explain the problem, so only their envelope is
+// checked. Streamed responses can only be read once, so they're skipped, as
+// are commands without a schema, which only tests register.
+func checkResponse(command string, resp response) error {
+	if resp.stream != nil {
+		return nil
+	}
+	var data, err = resp.JSON(0)
+	if err != nil {
+		return fmt.Errorf("encoding response: %w", err)
+	}
+
+	err = responseSchemas[envelopeSchemaName].schema.ValidateJSON(data)
+	if err != nil {
+		return fmt.Errorf("response envelope: %w", err)
+	}
+	if resp.status != StatusSuccess {
+		return nil
+	}
+
+	var s, ok = responseSchemas[command]
+	if !ok {
+		return nil
+	}
+	err = s.schema.ValidateJSON(data)
+	if err != nil {
+		return fmt.Errorf("%q response: %w", command, err)
+	}
+	return nil
+}
+
+func getSchema(name string) response {
+	if commands[name] == nil {
+		return respond(StatusError, fmt.Sprintf("%q is not a valid command name", name), nil)
+	}
+	var s, ok = responseSchemas[name]
+	if !ok {
+		return respond(StatusError, fmt.Sprintf("%q has no response schema", name), nil)
+	}
+	return respond(StatusSuccess, "", H{"command": name, "schema": s.raw, "envelope": responseSchemas[envelopeSchemaName].raw})
+}
+
+func init() {
+	register("schema", func(r *request) response {
+		if len(r.args) != 1 {
+			return respond(StatusError, fmt.Sprintf("%q requires exactly one command name", r.command), nil)
+		}
+		return getSchema(r.args[0])
+	})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/open-oni/oni-agent/internal/state"
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+func TestEveryCommandHasASchema(t *testing.T) {
+	for _, name := range commandNames() {
+		if _, ok := responseSchemas[name]; !ok {
+			t.Errorf("%q has no schema in schemas/", name)
+		}
+	}
+	for name := range responseSchemas {
+		if name != envelopeSchemaName && commands[name] == nil {
+			t.Errorf("schemas/%s.json doesn't describe a registered command", name)
+		}
+	}
+}
+
+func TestResponsesMatchSchemas(t *testing.T) {
+	var origRunner, origState = JobRunner, State
+	defer func() { JobRunner, State = origRunner, origState }()
+	JobRunner = queue.New(queue.CommandRunner{Path: "/bin/false"})
+	State, _ = state.Open(t.TempDir())
+
+	// list-jobs must send an empty list, not null, before there are any jobs
+	var requests = [][]string{{"list-jobs"}, {"queue-status"}, {"frozen-batches"}, {"list-tokens"}}
+	var j = JobRunner.NewJob("load", []string{"load_batch", "/mnt/batches/batch_oru_foo_ver01"})
+	j.SetLabel("lccn", "sn83025138")
+	j.Run(context.Background())
+	requests = append(requests, [][]string{
+		{"version"},
+		{"list-jobs"},
+		{"job-status", "1"},
+		{"job-logs", "1"},
+		{"annotate-job", "1", "checked"},
+		{"issue-key", "sn83025138/1902-11-22_01"},
+		{"migrate-status"},
+		{"host-key-info"},
+		{"schema", "job-status"},
+	}...)
+
+	for _, args := range requests {
+		var resp = commands[args[0]](&request{ctx: context.Background(), command: args[0], args: args[1:], user: "ops"})
+		if resp.status != StatusSuccess {
+			t.Errorf("%v: expected success, got %q %v", args, resp.message, resp.data)
+			continue
+		}
+		var err = checkResponse(args[0], resp)
+		if err != nil {
+			t.Errorf("%v: %s", args, err)
+		}
+	}
+
+	// A response which has drifted from its schema is caught
+	var err = checkResponse("job-status", respond(StatusSuccess, "", H{"job": H{"id": "1"}}))
+	if err == nil || !strings.Contains(err.Error(), "/job/id: expected integer, got string") {
+		t.Errorf("Expected a mismatched job-status to be caught, got %v", err)
+	}
+	err = checkResponse("job-status", respond(StatusError, "Job not found", H{"anything": true}))
+	if err != nil {
+		t.Errorf("Expected an error response to only need a valid envelope, got %s", err)
+	}
+}
@@ -1,41 +1,28 @@
 package main
 
 import (
-	"context"
-	"database/sql"
-	"encoding/json"
-	"encoding/xml"
+	"bytes"
+	"compress/gzip"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
-	"os"
-	"path/filepath"
-	"strconv"
-	"sync/atomic"
+	"strings"
+	"time"
 
 	"github.com/gliderlabs/ssh"
-	"github.com/open-oni/oni-agent/internal/queue"
-	"github.com/open-oni/oni-agent/internal/version"
-	"github.com/uoregon-libraries/gopkg/xmlnode"
 )
 
-var sessionID atomic.Int64
-
 type session struct {
 	ssh.Session
 	id int64
-}
 
-// Status is a string type the handler's "status" JSON may return
-type Status string
-
-// All possible statuses
-const (
-	StatusError   Status = "error"
-	StatusSuccess Status = "success"
-)
+	// gzip is set when the client asks for a gzipped response
+	gzip bool
 
-// H is a simple type alias for more easily building JSON responses
-type H map[string]any
+	// callback is the URL the client asked to have its job's outcome sent to
+	callback string
+}
 
 func (s session) logInfo(msg string, args ...any) {
 	var combined = append([]any{"sessionID", s.id}, args...)
@@ -47,340 +34,215 @@ func (s session) logError(msg string, args ...any) {
 	slog.Error(msg, combined...)
 }
 
-func (s session) respond(st Status, msg string, data H) {
-	if data == nil {
-		data = H{}
-	}
-	data["status"] = st
-	data["session"] = H{"id": s.id}
-	if msg != "" {
-		data["message"] = msg
-	}
-	var b, err = json.Marshal(data)
-	if err != nil {
-		s.logError("Cannot marshal response", "error", err, "data", data)
-		return
-	}
-
-	s.Write(b)
-	s.close()
-}
-
-func (s session) handle() {
-	var parts = s.Command()
-	if len(parts) == 0 {
-		s.respond(StatusError, "no command specified", nil)
-		return
-	}
-
-	var command, args = parts[0], parts[1:]
-	switch command {
-	case "load-title":
-		s.loadTitle()
-
-	case "version":
-		s.respond(StatusSuccess, "", H{"version": version.Version})
-
-	case "list-jobs":
-		var list = JobRunner.AllJobs()
-		var jobs []H
-		for _, j := range list {
-			jobs = append(jobs, H{"id": j.ID(), "name": j.Name(), "queued": j.QueuedAt(), "status": j.Status()})
-		}
-		s.respond(StatusSuccess, "", H{"jobs": jobs})
-
-	case "job-status":
-		if len(args) != 1 {
-			s.respond(StatusError, "You must supply a job ID", nil)
-			return
-		}
-		s.getJobStatus(args[0])
-
-	case "job-logs":
-		if len(args) != 1 {
-			s.respond(StatusError, "You must supply a job ID", nil)
-			return
-		}
-		s.getJobLogs(args[0])
-
-	case "load-batch":
-		if len(args) != 1 {
-			s.respond(StatusError, fmt.Sprintf("%q requires exactly one batch name", command), nil)
-			return
-		}
-		s.loadBatch(args[0])
-
-	case "purge-batch":
-		if len(args) != 1 {
-			s.respond(StatusError, fmt.Sprintf("%q requires exactly one batch name", command), nil)
-			return
-		}
-		s.purgeBatch(args[0])
-
-	case "ensure-awardee":
-		if len(args) < 1 || len(args) > 2 {
-			s.respond(StatusError, fmt.Sprintf("%q requires one or two args: MARC org code and awardee name. Name is required if the awardee is to be auto-created.", command), nil)
-			return
-		}
-
-		if len(args) == 1 {
-			args = []string{args[0], ""}
-		}
-		s.ensureAwardee(args[0], args[1])
-
-	default:
-		s.respond(StatusError, fmt.Sprintf("%q is not a valid command name", command), nil)
-		return
-	}
-}
-
-func (s session) loadTitle() {
-	// Create a ~100k data-receiving buffer
-	var data = make([]byte, 100_000)
-
-	var marcData []byte
-	for {
-		var n, err = s.Read(data)
+func (s session) respond(resp response) {
+	if resp.stream != nil {
+		var err = writeStream(s, resp, s.id, s.gzip)
 		if err != nil {
-			slog.Error("Unable to read from client", "error", err)
-			s.respond(StatusError, "Read error, connection terminating", H{"error": err.Error()})
-			return
-		}
-		var got = data[:n]
-		var reported string
-		if n > 1200 {
-			reported = string(data[:1000]) + "..." + string(data[n-190:n])
-		} else {
-			reported = string(got)
+			s.logError("Cannot write response", "error", err)
 		}
-		slog.Info("Got data", "size", n, "data", reported)
-
-		marcData = append(marcData, got...)
-		var l = len(marcData)
-		if l > 6 && string(marcData[l-6:]) == "\n\nEND\n" {
-			marcData = marcData[:l-6]
-			break
-		}
-	}
-
-	// Parse the data to ensure it's valid
-	var node = &xmlnode.Node{}
-	var err = xml.Unmarshal(marcData, node)
-	if err != nil {
-		slog.Error("Invalid XML", "error", err)
-		s.respond(StatusError, "Invalid data", H{"error": err.Error()})
+		s.close()
 		return
 	}
 
-	// Create a self-deleting temp dir
-	var dir string
-	dir, err = os.MkdirTemp("", "*-oni-marc")
+	var b, err = resp.JSON(s.id)
 	if err != nil {
-		slog.Error("Unable to create temp dir", "error", err)
-		s.respond(StatusError, "Internal error, unable to ingest MARC", H{"error": err.Error()})
+		s.logError("Cannot marshal response", "error", err, "data", resp.data)
 		return
 	}
-	defer os.Remove(dir)
 
-	// Write the MARC record out and tell ONI to ingest it
-	var fpath = filepath.Join(dir, "marc.xml")
-	err = os.WriteFile(fpath, marcData, 0600)
+	err = writeResponse(s, b, s.gzip)
 	if err != nil {
-		slog.Error("Unable to write MARC XML", "path", fpath, "error", err)
-		s.respond(StatusError, "Internal error, unable to ingest MARC", H{"error": err.Error()})
-		return
+		s.logError("Cannot write response", "error", err)
 	}
-
-	var j = JobRunner.NewJob("Load title from MARC XML", []string{"load_titles", dir})
-	err = j.Run(context.Background())
-	if err != nil {
-		slog.Error("Error ingesting MARC XML", "path", fpath, "error", err)
-		s.respond(StatusError, "Internal error, unable to ingest MARC", H{"error": err.Error()})
-		return
-	}
-
-	// We only remove the file if there were no load errors. This leaves a mess
-	// but also allows debugging.
-	os.Remove(fpath)
-
-	slog.Info("Received data", "marc", string(marcData))
-	s.respond(StatusSuccess, "MARC XML Received", nil)
+	s.close()
 }
 
-func (s session) loadBatch(name string) {
-	// ONI currently succeeds if a batch is already loaded and we try to load it
-	// again, but this could change, so we explicitly ensure success here
-	var exists, err = checkBatch(name)
-	if err != nil {
-		s.respond(StatusError, fmt.Sprintf("%q cannot be loaded", name), H{"error": err.Error()})
-		return
+// writeResponse writes the JSON response to w, gzipping it if requested
+func writeResponse(w io.Writer, b []byte, gz bool) error {
+	if !gz {
+		var _, err = w.Write(b)
+		return err
 	}
-	if exists {
-		s.respondNoJob()
-		return
+
+	var zw = gzip.NewWriter(w)
+	var _, err = zw.Write(b)
+	if err == nil {
+		err = zw.Close()
 	}
+	return err
+}
 
-	var batchPath = filepath.Join(BatchSource, name)
-	err = validateBatch(batchPath)
-	if err != nil {
-		s.respond(StatusError, fmt.Sprintf("%q cannot be loaded", name), H{"error": err.Error()})
-		return
+// parseSessionOptions strips any leading session options, which come before
+// the command name, e.g., "--gzip job-logs 42"
+func (s *session) parseSessionOptions(parts []string) ([]string, error) {
+	for len(parts) > 0 && strings.HasPrefix(parts[0], "--") {
+		switch parts[0] {
+		case "--gzip":
+			s.gzip = true
+		case "--callback":
+			if len(parts) < 2 {
+				return nil, errors.New("--callback requires a URL")
+			}
+			var err = validateCallback(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("--callback: %w", err)
+			}
+			s.callback = parts[1]
+			parts = parts[1:]
+		default:
+			return nil, fmt.Errorf("%q is not a valid session option", parts[0])
+		}
+		parts = parts[1:]
 	}
-	s.queueJob("Load batch", "load_batch", []string{batchPath})
+	return parts, nil
 }
 
-func (s session) purgeBatch(name string) {
-	// ONI will fail if you try to purge a batch which doesn't exist, but we want
-	// to return success for idempotence of NCA jobs
-	var exists, err = checkBatch(name)
+func (s session) handle() {
+	var parts, err = s.parseSessionOptions(s.Command())
 	if err != nil {
-		s.respond(StatusError, fmt.Sprintf("%q cannot be purged", name), H{"error": err.Error()})
+		s.respond(respond(StatusError, err.Error(), nil))
 		return
 	}
-	if !exists {
-		s.respondNoJob()
+	if len(parts) == 0 {
+		s.respond(respond(StatusError, "no command specified", nil))
 		return
 	}
-	s.queueJob("Purge batch", "purge_batch", []string{name})
-}
 
-func (s session) getJob(arg string) (job *queue.Job, found bool) {
-	var id, _ = strconv.ParseInt(arg, 10, 64)
-	if id == 0 {
-		s.respond(StatusError, fmt.Sprintf("%q is not a valid job id", arg), nil)
-		return nil, false
+	var r = &request{
+		id:          s.id,
+		ctx:         s.Context(),
+		command:     parts[0],
+		args:        parts[1:],
+		user:        s.User(),
+		source:      sourceAddr(s.RemoteAddr()),
+		client:      keyClient(s.keyFingerprint()),
+		payload:     func() ([]byte, error) { return readAll(s, secretPayloads[parts[0]]) },
+		keyCommands: keyCommands(s.keyFingerprint()),
+		callback:    s.callback,
 	}
-
-	// Allow fake jobs to get a response instead of an error so that automations
-	// that haven't accounted for "no job needed" responses don't fail
-	var noop = queue.NoOpJob()
-	if id == noop.ID() {
-		return noop, true
-	}
-
-	var j = JobRunner.GetJob(id)
-	if j == nil {
-		s.respond(StatusError, "Job not found", H{"job": H{"id": id}})
-		return nil, false
-	}
-
-	return j, true
+	s.respond(dispatch(r))
 }
 
-func (s session) getJobStatus(arg string) {
-	var j, found = s.getJob(arg)
-	if !found {
-		return
-	}
+// payloadTerminator is what clients send to signal the end of a payload
+const payloadTerminator = "\n\nEND\n"
 
-	var jobdata = H{"id": j.ID(), "name": j.Name(), "queued": j.QueuedAt(), "status": j.Status()}
-	var status = StatusSuccess
-	var message string
+// MaxPayloadBytes is the largest payload a client may send, not counting the
+// terminator
+var MaxPayloadBytes = 64 << 20
 
-	switch j.Status() {
-	case queue.StatusPending:
-		message = "Pending: this job is in the queue but hasn't been started yet."
-	case queue.StatusStarted:
-		message = "Started: this job is currently running."
-	case queue.StatusFailStart:
-		jobdata["error"] = j.Error()
-		message = "Invalid: this job was not able to start."
-	case queue.StatusSuccessful:
-		message = "Success: this job is complete."
-	case queue.StatusFailed:
-		jobdata["error"] = j.Error()
-		message = "Failed: this job started but returned a non-zero exit code."
-	default:
-		s.logError("Invalid job status", "jobID", j.ID(), "jobStatus", j.Status())
-		status = StatusError
-		message = "Internal error: unknown job status"
-	}
+// PayloadIdleTimeout is how long a payload read waits for more data before
+// giving up, so a client which never sends the terminator doesn't tie up a
+// session forever. Zero means no limit.
+var PayloadIdleTimeout = time.Minute
 
-	s.respond(status, message, H{"job": jobdata})
-}
+// Payload errors, which handlers report under "payload_error" so clients can
+// tell them apart from other problems without parsing messages
+var (
+	errPayloadTooLarge = errors.New("payload too large")
+	errPayloadTimedOut = errors.New("payload timed out")
+)
 
-func (s session) getJobLogs(arg string) {
-	var j, found = s.getJob(arg)
-	if !found {
-		return
+// payloadErrorData returns the data for an error response about a payload:
+// the error itself, plus "too_large" or "timed_out" under "payload_error" if
+// readAll refused the payload
+func payloadErrorData(err error) H {
+	var data = H{"error": err.Error()}
+	switch {
+	case errors.Is(err, errPayloadTooLarge):
+		data["payload_error"] = "too_large"
+		data["max_bytes"] = MaxPayloadBytes
+	case errors.Is(err, errPayloadTimedOut):
+		data["payload_error"] = "timed_out"
+		data["timeout_seconds"] = PayloadIdleTimeout.Seconds()
 	}
-
-	var out = H{"job": H{
-		"id":     j.ID(),
-		"name":   j.Name(),
-		"queued": j.QueuedAt(),
-		"status": j.Status(),
-		"stdout": j.Stdout(),
-		"stderr": j.Stderr(),
-	}}
-	s.respond(StatusSuccess, "", out)
-}
-
-func (s session) respondNoJob() {
-	s.respond(StatusSuccess, "No-op: job is redundant or already completed", H{"job": H{"id": queue.NoOpJob().ID()}})
+	return data
 }
 
-func (s session) queueJob(name, command string, args []string) {
-	var combined = append([]string{command}, args...)
-	var id = JobRunner.QueueJob(name, combined)
-
-	s.respond(StatusSuccess, "Job added to queue", H{"job": H{"id": id}})
+// payloadChunk is a single read from the client
+type payloadChunk struct {
+	data []byte
+	err  error
 }
 
-func (s session) ensureAwardee(code string, name string) {
-	var rows, err = dbPool.Query("SELECT COUNT(*) FROM core_awardee WHERE org_code = ?", code)
-	if err != nil {
-		s.respond(StatusError, "Unable to query database", H{"error": err.Error()})
-		return
-	}
-	defer rows.Close()
-
-	// What does it mean if there's no error reported, but no count returned?
-	if !rows.Next() {
-		s.respond(StatusError, "Unable to count awardees in database", H{"error": "no rows returned by SQL COUNT()"})
-		return
+// readAll reads from r until the payload terminator is seen, returning
+// everything prior to the terminator. It gives up if the payload grows past
+// MaxPayloadBytes, or nothing arrives for PayloadIdleTimeout. Each read is
+// logged, but only its size if the payload is secret.
+func readAll(r io.Reader, secret bool) ([]byte, error) {
+	// Reads can't be interrupted, so they happen in the background, and are
+	// handed over until we stop wanting them; the reader finishes once the
+	// session closes
+	var chunks = make(chan payloadChunk)
+	var done = make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			// Create a ~100k data-receiving buffer
+			var data = make([]byte, 100_000)
+			var n, err = r.Read(data)
+			select {
+			case chunks <- payloadChunk{data: data[:n], err: err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var idle *time.Timer
+	var timeout <-chan time.Time
+	if PayloadIdleTimeout > 0 {
+		idle = time.NewTimer(PayloadIdleTimeout)
+		defer idle.Stop()
+		timeout = idle.C
 	}
 
-	var count int
-	err = rows.Scan(&count)
-	if err != nil {
-		s.respond(StatusError, "Unable to count awardees in database", H{"error": err.Error()})
-		return
-	}
+	var payload []byte
+	var limit = MaxPayloadBytes + len(payloadTerminator)
+	for {
+		var c payloadChunk
+		select {
+		case c = <-chunks:
+		case <-timeout:
+			return nil, fmt.Errorf("%w: no data received for %s", errPayloadTimedOut, PayloadIdleTimeout)
+		}
+		if idle != nil {
+			if !idle.Stop() {
+				select {
+				case <-idle.C:
+				default:
+				}
+			}
+			idle.Reset(PayloadIdleTimeout)
+		}
 
-	// We really only care that there's at least one row. If there are dupes,
-	// that's out of scope to deal with, and technically not an error in terms of
-	// what we need.
-	if count > 0 {
-		s.respond(StatusSuccess, "Awardee already exists", nil)
-		return
-	}
+		var n = len(c.data)
+		if n > 0 && secret {
+			slog.Info("Got data", "size", n)
+		} else if n > 0 {
+			var reported string
+			if n > 1200 {
+				reported = string(c.data[:1000]) + "..." + string(c.data[n-190:n])
+			} else {
+				reported = string(c.data)
+			}
+			slog.Info("Got data", "size", n, "data", reported)
+		}
 
-	// No rows, no error: if a name was given, create the awardee, otherwise abort
-	if name == "" {
-		s.respond(StatusError, "Unable to create awardee", H{"error": "awardee name must be given to auto-create awardees", "org_code": code, "name": name})
-		return
-	}
+		payload = append(payload, c.data...)
+		if bytes.HasSuffix(payload, []byte(payloadTerminator)) {
+			return payload[:len(payload)-len(payloadTerminator)], nil
+		}
+		if len(payload) > limit {
+			return nil, fmt.Errorf("%w: payloads may be at most %d bytes", errPayloadTooLarge, MaxPayloadBytes)
+		}
 
-	var result sql.Result
-	result, err = dbPool.Exec("INSERT INTO core_awardee (`org_code`, `name`, `created`) VALUES(?, ?, NOW())", code, name)
-	if err != nil {
-		s.respond(StatusError, "Unable to create awardee", H{"error": err.Error(), "org_code": code, "name": name})
-		return
-	}
-	var n int64
-	n, err = result.RowsAffected()
-	if err != nil {
-		s.respond(StatusError, "Unable to read result of INSERT", H{"error": err.Error(), "org_code": code, "name": name})
-		return
-	}
-	if n != 1 {
-		s.respond(StatusError, "Unable to create awardee", H{"error": "No rows created", "org_code": code, "name": name})
-		return
+		if c.err != nil {
+			return nil, fmt.Errorf("reading payload: %w", c.err)
+		}
 	}
-
-	s.respond(StatusSuccess, "Awardee created", nil)
-	return
 }
 
 // close terminates the session, always with a status of 0: Go ssh clients
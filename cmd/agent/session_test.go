@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestReadAll(t *testing.T) {
+	var tests = map[string]struct {
+		input    string
+		expected string
+		hasError bool
+	}{
+		"simple":             {input: "<xml/>\n\nEND\n", expected: "<xml/>"},
+		"missing terminator": {input: "<xml/>", hasError: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			// OneByteReader ensures we handle a terminator split across reads
+			var got, err = readAll(iotest.OneByteReader(strings.NewReader(tc.input)), false)
+			if tc.hasError {
+				if err == nil {
+					t.Fatalf("expected an error, got payload %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if string(got) != tc.expected {
+				t.Fatalf("expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestReadAllLimits(t *testing.T) {
+	var origMax, origTimeout = MaxPayloadBytes, PayloadIdleTimeout
+	defer func() { MaxPayloadBytes, PayloadIdleTimeout = origMax, origTimeout }()
+	MaxPayloadBytes = 10
+	PayloadIdleTimeout = 10 * time.Millisecond
+
+	// Exactly the limit is fine; a byte more isn't, terminator or not
+	var got, err = readAll(strings.NewReader("0123456789\n\nEND\n"), false)
+	if err != nil || string(got) != "0123456789" {
+		t.Fatalf("Expected a payload at the limit to be read, got %q (%v)", got, err)
+	}
+	_, err = readAll(iotest.OneByteReader(strings.NewReader("0123456789abcdefg\n\nEND\n")), false)
+	if !errors.Is(err, errPayloadTooLarge) {
+		t.Fatalf("Expected a too-large error, got %v", err)
+	}
+	if payloadErrorData(err)["payload_error"] != "too_large" {
+		t.Errorf("Expected a too_large payload_error, got %v", payloadErrorData(err))
+	}
+
+	// A client which sends part of a payload and then nothing more times out
+	var pr, pw = io.Pipe()
+	defer pw.Close()
+	go pw.Write([]byte("<xml"))
+	_, err = readAll(pr, false)
+	if !errors.Is(err, errPayloadTimedOut) {
+		t.Fatalf("Expected a timeout, got %v", err)
+	}
+	if payloadErrorData(err)["payload_error"] != "timed_out" {
+		t.Errorf("Expected a timed_out payload_error, got %v", payloadErrorData(err))
+	}
+}
+
+func TestReadAllSecret(t *testing.T) {
+	var logs bytes.Buffer
+	var oldLogger = slog.Default()
+	defer slog.SetDefault(oldLogger)
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	var password = "correct horse battery staple"
+	var got, err = readAll(strings.NewReader(password+payloadTerminator), secretPayloads["reset-user-password"])
+	if err != nil || string(got) != password {
+		t.Fatalf("Expected the password to be read, got %q (%v)", got, err)
+	}
+	if strings.Contains(logs.String(), "horse") {
+		t.Errorf("Password was logged: %s", logs.String())
+	}
+	if !strings.Contains(logs.String(), "size=") {
+		t.Errorf("Expected the payload's size to be logged, got %q", logs.String())
+	}
+}
+
+func TestParseSessionOptions(t *testing.T) {
+	var s session
+	var parts, err = s.parseSessionOptions([]string{"--gzip", "job-logs", "42"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !s.gzip || strings.Join(parts, " ") != "job-logs 42" {
+		t.Fatalf("Expected gzip and the remaining command, got %v and %q", s.gzip, parts)
+	}
+
+	s = session{}
+	parts, _ = s.parseSessionOptions([]string{"job-logs", "--gzip"})
+	if s.gzip || len(parts) != 2 {
+		t.Fatalf("Options after the command name must be left alone, got %v and %q", s.gzip, parts)
+	}
+
+	_, err = s.parseSessionOptions([]string{"--bogus", "version"})
+	if err == nil {
+		t.Fatalf("Expected an error for an unknown option")
+	}
+}
+
+func TestParseSessionCallback(t *testing.T) {
+	var oldHosts = CallbackHosts
+	defer func() { CallbackHosts = oldHosts }()
+	CallbackHosts = map[string]bool{"nca.example.org": true}
+
+	var s session
+	var parts, err = s.parseSessionOptions([]string{"--callback", "https://nca.example.org/hook", "--gzip", "load-batch", "x"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if s.callback != "https://nca.example.org/hook" || !s.gzip || strings.Join(parts, " ") != "load-batch x" {
+		t.Fatalf("Expected callback, gzip, and the remaining command, got %q, %v, and %q", s.callback, s.gzip, parts)
+	}
+
+	for _, bad := range [][]string{{"--callback"}, {"--callback", "https://evil.example.org/", "version"}} {
+		s = session{}
+		_, err = s.parseSessionOptions(bad)
+		if err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+}
+
+func TestWriteResponseGzip(t *testing.T) {
+	var buf bytes.Buffer
+	var err = writeResponse(&buf, []byte(`{"status":"success"}`), true)
+	if err != nil {
+		t.Fatalf("Unable to write response: %s", err)
+	}
+
+	var zr *gzip.Reader
+	zr, err = gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("Response isn't gzipped: %s", err)
+	}
+	var got, _ = io.ReadAll(zr)
+	if string(got) != `{"status":"success"}` {
+		t.Fatalf("Unexpected response %q", got)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/open-oni/oni-agent/internal/schedsim"
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+// simulateOptions are the simulate-queue command's flags
+type simulateOptions struct {
+	since    time.Time
+	workers  int
+	priority []string
+}
+
+// parseSimulateArgs reads "simulate-queue [--since <time>] [--workers <n>]
+// [--priority <type,type...>]"
+func parseSimulateArgs(args []string) (simulateOptions, error) {
+	var opts simulateOptions
+	for i := 0; i < len(args); i++ {
+		var flag = args[i]
+		i++
+		if i == len(args) {
+			return simulateOptions{}, fmt.Errorf("unexpected argument %q", flag)
+		}
+		var val = args[i]
+
+		switch flag {
+		case "--since":
+			var err error
+			opts.since, err = time.Parse(time.RFC3339, val)
+			if err != nil {
+				return simulateOptions{}, fmt.Errorf("%q is not a valid RFC 3339 timestamp", val)
+			}
+		case "--workers":
+			var n, err = strconv.Atoi(val)
+			if err != nil || n < 1 {
+				return simulateOptions{}, fmt.Errorf("--workers must be a positive number")
+			}
+			opts.workers = n
+		case "--priority":
+			opts.priority = splitList(val)
+			if len(opts.priority) == 0 {
+				return simulateOptions{}, fmt.Errorf("--priority requires at least one job type")
+			}
+		default:
+			return simulateOptions{}, fmt.Errorf("unexpected argument %q", flag)
+		}
+	}
+	return opts, nil
+}
+
+// recordedWorkload returns every job which ran to completion, from the job
+// archive (if there is one) and from memory, as a workload to replay. Jobs
+// which never started say nothing about how long a job takes, so they're
+// skipped and counted.
+func recordedWorkload(since time.Time) (jobs []schedsim.Job, skipped int, err error) {
+	var records []queue.Record
+	if JobArchive != nil {
+		records, err = JobArchive.List(since)
+		if err != nil {
+			return nil, 0, fmt.Errorf("reading job archive: %w", err)
+		}
+	}
+	for _, j := range JobRunner.AllJobs() {
+		var rec = j.Record()
+		if !rec.QueuedAt.Before(since) {
+			records = append(records, rec)
+		}
+	}
+
+	for _, rec := range records {
+		if rec.QueuedAt.IsZero() || rec.StartedAt.IsZero() || rec.CompletedAt.IsZero() {
+			skipped++
+			continue
+		}
+		jobs = append(jobs, schedsim.Job{Type: jobType(rec), Submitted: rec.QueuedAt, Duration: rec.CompletedAt.Sub(rec.StartedAt), Class: jobClass(rec.ID, rec.Args)})
+	}
+	return jobs, skipped, nil
+}
+
+// jobType is how a recorded job is grouped and prioritized in a simulation:
+// the ONI command a job ran (e.g., "load_batch"), or for in-process jobs, its
+// name without the batch or source it was for ("Verify Solr for batch_foo"
+// is just "Verify Solr")
+func jobType(rec queue.Record) string {
+	if len(rec.Args) > 0 {
+		return rec.Args[0]
+	}
+	for _, sep := range []string{" for ", " batch "} {
+		var before, _, found = strings.Cut(rec.Name, sep)
+		if found {
+			return before
+		}
+	}
+	return rec.Name
+}
+
+func simulateQueue(r *request) response {
+	var opts, err = parseSimulateArgs(r.args)
+	if err != nil {
+		return respond(StatusError, fmt.Sprintf("Invalid arguments for %q: %s", r.command, err), nil)
+	}
+
+	var jobs []schedsim.Job
+	var skipped int
+	jobs, skipped, err = recordedWorkload(opts.since)
+	if err != nil {
+		r.logError("Unable to read recorded jobs", "error", err)
+		return respond(StatusError, "Unable to read recorded jobs", H{"error": err.Error()})
+	}
+	if len(jobs) == 0 {
+		return respond(StatusError, "No completed jobs to replay", H{"skipped": skipped})
+	}
+
+	// The current policy is always reported, so there's a baseline to
+	// compare against. It's the queue as configured: BA_WORKERS workers,
+	// sharing them only between jobs in different classes.
+	var current = schedsim.Policy{Name: "current", Workers: Workers, Classes: true}
+	var reports = []schedsim.Report{schedsim.Simulate(jobs, current)}
+	if opts.workers > 0 || len(opts.priority) > 0 {
+		var p = current
+		p.Name, p.Priority = "proposed", opts.priority
+		if opts.workers > 0 {
+			p.Workers = opts.workers
+		}
+		reports = append(reports, schedsim.Simulate(jobs, p))
+	}
+
+	var data = H{"jobs": len(jobs), "skipped": skipped, "reports": reports}
+	if JobArchive == nil {
+		data["warning"] = "Job archiving is not enabled; only jobs still in memory were replayed"
+	}
+	return respond(StatusSuccess, "", data)
+}
+
+func init() {
+	register("simulate-queue", simulateQueue)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/open-oni/oni-agent/internal/jobarchive"
+	"github.com/open-oni/oni-agent/internal/schedsim"
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+func TestParseSimulateArgs(t *testing.T) {
+	var tests = map[string]struct {
+		args    []string
+		want    simulateOptions
+		wantErr bool
+	}{
+		"none":        {},
+		"all":         {args: []string{"--since", "2024-06-01T00:00:00Z", "--workers", "3", "--priority", "load_titles, load_batch"}, want: simulateOptions{since: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), workers: 3, priority: []string{"load_titles", "load_batch"}}},
+		"bad since":   {args: []string{"--since", "yesterday"}, wantErr: true},
+		"no workers":  {args: []string{"--workers", "0"}, wantErr: true},
+		"no priority": {args: []string{"--priority", ","}, wantErr: true},
+		"no value":    {args: []string{"--workers"}, wantErr: true},
+		"unknown":     {args: []string{"--policy", "lifo"}, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got, err = parseSimulateArgs(tc.args)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Expected an error, got %#v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			var diff = cmp.Diff(tc.want, got, cmp.AllowUnexported(simulateOptions{}))
+			if diff != "" {
+				t.Fatalf("parseSimulateArgs: %s", diff)
+			}
+		})
+	}
+}
+
+func TestJobType(t *testing.T) {
+	var tests = map[string]queue.Record{
+		"load_batch":              {Name: "Load batch batch_oru_foo_ver01", Args: []string{"load_batch", "/mnt/batches/batch_oru_foo_ver01"}},
+		"Verify Solr":             {Name: "Verify Solr for batch_oru_foo_ver01"},
+		"Mirror":                  {Name: "Mirror batch batch_oru_foo_ver01 from staging"},
+		"Reconcile batches":       {Name: "Reconcile batches"},
+		"Export OCR":              {Name: "Export OCR for sn83025138"},
+		"Report duplicate titles": {Name: "Report duplicate titles"},
+	}
+	for want, rec := range tests {
+		var got = jobType(rec)
+		if got != want {
+			t.Errorf("jobType(%q): expected %q, got %q", rec.Name, want, got)
+		}
+	}
+}
+
+func TestSimulateQueue(t *testing.T) {
+	var origRunner, origArchive = JobRunner, JobArchive
+	defer func() { JobRunner, JobArchive = origRunner, origArchive }()
+	JobRunner = queue.New(queue.CommandRunner{Path: "/bin/false"})
+	JobArchive, _ = jobarchive.New(t.TempDir())
+
+	// Two archived loads of different batches, the second queued while the
+	// first ran, plus a job which never started
+	var t0 = time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC)
+	var rec = func(id int64, batch string, queuedMin, startMin, endMin int) queue.Record {
+		var r = queue.Record{ID: id, Name: "Load batch", Args: []string{"load_batch", batch}, Status: queue.StatusSuccessful}
+		r.QueuedAt = t0.Add(time.Duration(queuedMin) * time.Minute)
+		if startMin >= 0 {
+			r.StartedAt = t0.Add(time.Duration(startMin) * time.Minute)
+			r.CompletedAt = t0.Add(time.Duration(endMin) * time.Minute)
+		}
+		return r
+	}
+	var err = JobArchive.Write([]queue.Record{rec(1, "x", 0, 0, 10), rec(2, "y", 5, 10, 20), rec(3, "x", 6, -1, -1)})
+	if err != nil {
+		t.Fatalf("Unable to write archive: %s", err)
+	}
+
+	// A job run directly, outside the queue, isn't part of the workload
+	var j = JobRunner.NewJob("ONI Check", []string{"check"})
+	j.Run(context.Background())
+
+	var resp = simulateQueue(&request{ctx: context.Background(), command: "simulate-queue", args: []string{"--workers", "2"}})
+	if resp.status != StatusSuccess {
+		t.Fatalf("Expected success, got %q %v", resp.message, resp.data)
+	}
+	err = checkResponse("simulate-queue", resp)
+	if err != nil {
+		t.Fatalf("Response doesn't match its schema: %s", err)
+	}
+
+	var reports = resp.data["reports"].([]schedsim.Report)
+	if resp.data["jobs"] != 2 || resp.data["skipped"] != 2 || len(reports) != 2 {
+		t.Fatalf("Expected 2 jobs replayed, 2 skipped, and 2 reports; got %v", resp.data)
+	}
+	if reports[0].Overall.MaxSeconds != 300 || reports[1].Overall.MaxSeconds != 0 {
+		t.Fatalf("Expected the second load to wait 5 minutes in the current queue and not at all with two workers, got %#v", reports)
+	}
+
+	// Loads of the same batch can't run side by side, however many workers
+	// there are
+	err = JobArchive.Write([]queue.Record{rec(4, "x", 30, 30, 40), rec(5, "x", 35, 40, 50)})
+	if err != nil {
+		t.Fatalf("Unable to write archive: %s", err)
+	}
+	resp = simulateQueue(&request{ctx: context.Background(), command: "simulate-queue", args: []string{"--since", "2024-06-01T09:30:00Z", "--workers", "2"}})
+	reports = resp.data["reports"].([]schedsim.Report)
+	if resp.status != StatusSuccess || len(reports) != 2 || reports[1].Overall.MaxSeconds != 300 {
+		t.Fatalf("Expected the second load of a batch to wait 5 minutes even with two workers, got %q %#v", resp.message, resp.data)
+	}
+
+	resp = simulateQueue(&request{ctx: context.Background(), command: "simulate-queue", args: []string{"--since", "2030-01-01T00:00:00Z"}})
+	if resp.status != StatusError {
+		t.Fatalf("Expected an error with nothing to replay, got %q %v", resp.message, resp.data)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/open-oni/oni-agent/internal/solr"
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+// Solr is the client for ONI's Solr core if SOLR_URL is set. When it is,
+// every batch load is followed by a sampled verification job.
+var Solr *solr.Client
+
+// ONIURL is the optional base URL of the ONI web site, used to check that
+// sampled pages have word coordinates. ONI serves coordinates itself rather
+// than storing them in Solr.
+var ONIURL string
+
+// solrVerifyOptions controls how many pages a verify-solr job samples and
+// how many of them may fail before the job does
+type solrVerifyOptions struct {
+	Sample          int     `json:"sample"`
+	MaxErrorPercent float64 `json:"max_error_percent"`
+}
+
+// SolrVerify holds the defaults from SOLR_VERIFY_SAMPLE and
+// SOLR_VERIFY_MAX_ERROR_PERCENT, used for post-load verification and
+// whenever verify-solr isn't told otherwise
+var SolrVerify = solrVerifyOptions{Sample: 20, MaxErrorPercent: 5}
+
+// oniClient fetches word coordinates from ONIURL. The request carries the
+// job's context, so canceling the job stops it; the timeout keeps one hung
+// page from stalling the whole verification.
+var oniClient = &http.Client{Timeout: time.Second * 30}
+
+// maxSolrSample caps the sample size so a verification job can't turn into
+// a full reindex-sized crawl
+const maxSolrSample = 1000
+
+// solrPage identifies a page the way ONI's Solr documents (and URLs) do
+type solrPage struct {
+	LCCN     string
+	Date     string
+	Edition  int
+	Sequence int
+}
+
+// id returns the page's Solr document id, which is also its ONI URL path
+func (p solrPage) id() string {
+	return fmt.Sprintf("/lccn/%s/%s/ed-%d/seq-%d/", p.LCCN, p.Date, p.Edition, p.Sequence)
+}
+
+// solrPageResult is the verification result for one sampled page
+type solrPageResult struct {
+	Page        string   `json:"page"`
+	Indexed     bool     `json:"indexed"`
+	OCR         bool     `json:"ocr"`
+	Coordinates *bool    `json:"coordinates,omitempty"`
+	Problems    []string `json:"problems,omitempty"`
+}
+
+// solrReport is the artifact a verify-solr job produces
+type solrReport struct {
+	Batch     string            `json:"batch"`
+	Generated time.Time         `json:"generated"`
+	Options   solrVerifyOptions `json:"options"`
+	Pages     int               `json:"pages"`
+	Sampled   int               `json:"sampled"`
+	Failed    int               `json:"failed"`
+	ErrorRate float64           `json:"error_percent"`
+	Results   []solrPageResult  `json:"results"`
+}
+
+// parseVerifySolrArgs reads "<batch> [--sample N] [--max-error-percent P]"
+func parseVerifySolrArgs(args []string) (name string, o solrVerifyOptions, err error) {
+	o = SolrVerify
+	for i := 0; i < len(args); i++ {
+		var arg = args[i]
+		switch arg {
+		case "--sample", "--max-error-percent":
+			if i+1 >= len(args) {
+				return "", o, fmt.Errorf("%s requires a number", arg)
+			}
+			i++
+			if arg == "--sample" {
+				o.Sample, err = strconv.Atoi(args[i])
+				if err != nil || o.Sample < 1 || o.Sample > maxSolrSample {
+					return "", o, fmt.Errorf("--sample must be a number of pages from 1 to %d", maxSolrSample)
+				}
+			} else {
+				o.MaxErrorPercent, err = strconv.ParseFloat(args[i], 64)
+				if err != nil || o.MaxErrorPercent < 0 || o.MaxErrorPercent > 100 {
+					return "", o, errors.New("--max-error-percent must be a number from 0 to 100")
+				}
+			}
+
+		default:
+			if name != "" {
+				return "", o, errors.New("exactly one batch name is required")
+			}
+			name = arg
+		}
+	}
+
+	if name == "" {
+		return "", o, errors.New("exactly one batch name is required")
+	}
+	return name, o, nil
+}
+
+// batchPages returns every page ONI has for the batch. This has to use the
+// primary, since verification runs right after a load a replica may not
+// have caught up with yet.
+func batchPages(ctx context.Context, name string) ([]solrPage, error) {
+	var rows, err = dbPool.QueryContext(ctx, ONIDB.BatchPages, name)
+	if err != nil {
+		return nil, fmt.Errorf("querying database: %w", err)
+	}
+	defer rows.Close()
+
+	var pages []solrPage
+	for rows.Next() {
+		var p solrPage
+		err = rows.Scan(&p.LCCN, &p.Date, &p.Edition, &p.Sequence)
+		if err != nil {
+			return nil, fmt.Errorf("reading pages from database: %w", err)
+		}
+		pages = append(pages, p)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("reading pages from database: %w", err)
+	}
+	return pages, nil
+}
+
+// samplePages returns n pages chosen at random, or all of them if there
+// aren't more than n
+func samplePages(pages []solrPage, n int) []solrPage {
+	if len(pages) <= n {
+		return pages
+	}
+	var sample = make([]solrPage, n)
+	for i, idx := range rand.Perm(len(pages))[:n] {
+		sample[i] = pages[idx]
+	}
+	return sample
+}
+
+// checkSolrPage verifies that a page's Solr document exists and has OCR
+// text, and, if ONIURL is set, that ONI has word coordinates for it
+func checkSolrPage(ctx context.Context, p solrPage) solrPageResult {
+	var r = solrPageResult{Page: p.id()}
+	var doc, err = Solr.Get(ctx, r.Page, "id", "ocr*")
+	switch {
+	case err != nil:
+		r.Problems = append(r.Problems, err.Error())
+	case doc == nil:
+		r.Problems = append(r.Problems, "not in solr")
+	default:
+		r.Indexed = true
+		r.OCR = len(doc.Text("ocr*")) > 0
+		if !r.OCR {
+			r.Problems = append(r.Problems, "solr document has no OCR text")
+		}
+	}
+
+	if ONIURL != "" {
+		var ok bool
+		ok, err = hasCoordinates(ctx, r.Page)
+		r.Coordinates = &ok
+		if err != nil {
+			r.Problems = append(r.Problems, fmt.Sprintf("word coordinates: %s", err))
+		} else if !ok {
+			r.Problems = append(r.Problems, "no word coordinates")
+		}
+	}
+	return r
+}
+
+// hasCoordinates asks ONI for a page's word coordinates, returning true if
+// there's at least one word
+func hasCoordinates(ctx context.Context, pageURL string) (bool, error) {
+	var req, err = http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(ONIURL, "/")+pageURL+"coordinates/", nil)
+	if err != nil {
+		return false, err
+	}
+	var resp *http.Response
+	resp, err = oniClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return false, errors.New(resp.Status)
+	}
+
+	var coords struct {
+		Coords map[string]json.RawMessage `json:"coords"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&coords)
+	if err != nil {
+		return false, fmt.Errorf("decoding coordinates: %w", err)
+	}
+	return len(coords.Coords) > 0, nil
+}
+
+// runSolrVerify returns the verify-solr job for the given batch
+func runSolrVerify(name string, o solrVerifyOptions) queue.RunFunc {
+	return func(ctx context.Context, j *queue.Job) error {
+		var pages, err = batchPages(ctx, name)
+		if err != nil {
+			return err
+		}
+		if len(pages) == 0 {
+			return fmt.Errorf("ONI has no pages for %s", name)
+		}
+
+		var sample = samplePages(pages, o.Sample)
+		var report = solrReport{Batch: name, Options: o, Pages: len(pages), Sampled: len(sample), Results: []solrPageResult{}}
+		j.Logf("Verifying %d of %d pages in %s", len(sample), len(pages), name)
+		if ONIURL == "" {
+			j.Logf("ONI_URL is not set; word coordinates will not be checked")
+		}
+		for _, p := range sample {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			var r = checkSolrPage(ctx, p)
+			if len(r.Problems) > 0 {
+				report.Failed++
+				j.Warnf("%s: %s", r.Page, strings.Join(r.Problems, "; "))
+			}
+			report.Results = append(report.Results, r)
+		}
+		report.Generated = time.Now()
+		report.ErrorRate = float64(report.Failed) * 100 / float64(report.Sampled)
+		j.Logf("%d of %d sampled pages failed verification (%.1f%%; limit %.1f%%)", report.Failed, report.Sampled, report.ErrorRate, o.MaxErrorPercent)
+
+		if Artifacts != nil {
+			var data []byte
+			data, err = json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				return fmt.Errorf("encoding report: %w", err)
+			}
+			var artifactName = fmt.Sprintf("solr-%s-%s.json", name, report.Generated.UTC().Format("20060102T150405"))
+			err = Artifacts.Put(artifactName, bytes.NewReader(data))
+			if err != nil {
+				return fmt.Errorf("storing report: %w", err)
+			}
+			j.AddArtifact(artifactName)
+			j.Logf("Report stored as artifact %q", artifactName)
+		}
+
+		if report.ErrorRate > o.MaxErrorPercent {
+			return fmt.Errorf("%.1f%% of sampled pages failed verification, more than the %.1f%% allowed", report.ErrorRate, o.MaxErrorPercent)
+		}
+		return nil
+	}
+}
+
+func verifySolr(name string, o solrVerifyOptions) response {
+	if Solr == nil {
+		return respond(StatusError, "Solr verification is not enabled (SOLR_URL is not set)", nil)
+	}
+	if !batchNameRegexp.MatchString(name) {
+		return respond(StatusError, fmt.Sprintf("%q is not a valid batch name", name), nil)
+	}
+	var exists, err = checkBatch(name)
+	if err != nil {
+		return respond(StatusError, fmt.Sprintf("%q cannot be verified", name), H{"error": err.Error()})
+	}
+	if !exists {
+		return respond(StatusError, fmt.Sprintf("%q is not loaded", name), nil)
+	}
+
+	var id = JobRunner.QueueFunc("Verify Solr for "+name, runSolrVerify(name, o))
+	return respond(StatusSuccess, "Job added to queue", H{"job": H{"id": id}})
+}
+
+func init() {
+	register("verify-solr", func(r *request) response {
+		var name, o, err = parseVerifySolrArgs(r.args)
+		if err != nil {
+			return respond(StatusError, fmt.Sprintf("Invalid arguments for %q: %s", r.command, err), nil)
+		}
+		return verifySolr(name, o)
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/open-oni/oni-agent/internal/solr"
+)
+
+func TestParseVerifySolrArgs(t *testing.T) {
+	var tests = map[string]struct {
+		args    []string
+		sample  int
+		errText string
+	}{
+		"defaults":     {args: []string{"batch_oru_foo_ver01"}, sample: SolrVerify.Sample},
+		"sample":       {args: []string{"batch_oru_foo_ver01", "--sample", "50"}, sample: 50},
+		"huge sample":  {args: []string{"batch_oru_foo_ver01", "--sample", "5000"}, errText: "--sample"},
+		"bad percent":  {args: []string{"--max-error-percent", "150", "batch_oru_foo_ver01"}, errText: "--max-error-percent"},
+		"missing name": {args: []string{"--sample", "5"}, errText: "batch name"},
+		"two names":    {args: []string{"a", "b"}, errText: "batch name"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var _, o, err = parseVerifySolrArgs(tc.args)
+			if tc.errText != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.errText) {
+					t.Fatalf("Expected error containing %q, got %v", tc.errText, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if o.Sample != tc.sample {
+				t.Fatalf("Expected sample of %d, got %d", tc.sample, o.Sample)
+			}
+		})
+	}
+}
+
+func TestSamplePages(t *testing.T) {
+	var pages []solrPage
+	for i := 1; i <= 100; i++ {
+		pages = append(pages, solrPage{LCCN: "sn123", Date: "1900-01-01", Edition: 1, Sequence: i})
+	}
+
+	var sample = samplePages(pages, 10)
+	var seen = make(map[int]bool)
+	for _, p := range sample {
+		seen[p.Sequence] = true
+	}
+	if len(sample) != 10 || len(seen) != 10 {
+		t.Fatalf("Expected 10 distinct pages, got %#v", sample)
+	}
+	if len(samplePages(pages[:5], 10)) != 5 {
+		t.Fatal("Expected every page when there are fewer than the sample size")
+	}
+}
+
+func TestCheckSolrPage(t *testing.T) {
+	var solrSrv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("q") {
+		case `id:"/lccn/sn123/1900-01-01/ed-1/seq-1/"`:
+			w.Write([]byte(`{"response": {"docs": [{"id": "x", "ocr_eng": "Extra! Extra!"}]}}`))
+		case `id:"/lccn/sn123/1900-01-01/ed-1/seq-2/"`:
+			w.Write([]byte(`{"response": {"docs": [{"id": "x", "ocr_eng": ""}]}}`))
+		default:
+			w.Write([]byte(`{"response": {"docs": []}}`))
+		}
+	}))
+	defer solrSrv.Close()
+	var oniSrv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/lccn/sn123/1900-01-01/ed-1/seq-1/coordinates/" {
+			w.Write([]byte(`{"coords": {"Extra": [[1, 2, 3, 4]]}}`))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer oniSrv.Close()
+
+	var origSolr, origURL = Solr, ONIURL
+	defer func() { Solr, ONIURL = origSolr, origURL }()
+	Solr, _ = solr.New(solrSrv.URL)
+	ONIURL = oniSrv.URL
+
+	var tests = map[int]string{
+		1: "",
+		2: "no OCR text",
+		3: "not in solr",
+	}
+	for seq, problem := range tests {
+		var r = checkSolrPage(context.Background(), solrPage{LCCN: "sn123", Date: "1900-01-01", Edition: 1, Sequence: seq})
+		var got = strings.Join(r.Problems, "; ")
+		if problem == "" && got != "" {
+			t.Errorf("seq %d: expected no problems, got %q", seq, got)
+		}
+		if problem != "" && !strings.Contains(got, problem) {
+			t.Errorf("seq %d: expected problems to include %q, got %q", seq, problem, got)
+		}
+		if seq > 1 && !strings.Contains(got, "no word coordinates") {
+			t.Errorf("seq %d: expected missing coordinates to be reported, got %q", seq, got)
+		}
+	}
+}
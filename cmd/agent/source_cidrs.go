@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// Command classes, for restricting which addresses may run what
+const (
+	classReadOnly    = "read-only"
+	classWrite       = "write"
+	classDestructive = "destructive"
+)
+
+// destructiveCommands remove things from ONI, or, for import-state, replace
+// the agent's own state wholesale
+var destructiveCommands = map[string]bool{
+	"purge-batch":    true,
+	"delete-awardee": true,
+	"import-state":   true,
+}
+
+// destructiveFlags make an otherwise harmless command destructive, e.g.,
+// reconcile-titles only reports unless it's told to delete Solr's orphans
+var destructiveFlags = map[string]string{
+	"reconcile-titles": "--repair",
+}
+
+// commandClass returns the class a command belongs to, given its args.
+// Read-only commands are the ones a verification-only agent offers; anything
+// which is neither read-only nor destructive is a write.
+func commandClass(name string, args []string) string {
+	switch {
+	case destructiveCommands[name]:
+		return classDestructive
+	case destructiveFlags[name] != "" && slices.Contains(args, destructiveFlags[name]):
+		return classDestructive
+	case verifyCommands[name]:
+		return classReadOnly
+	}
+	return classWrite
+}
+
+// SourceCIDRs maps command classes to the networks allowed to run them. A
+// class with no networks is unrestricted.
+var SourceCIDRs = map[string][]netip.Prefix{}
+
+// sourceCIDREnv maps each class to the env var configuring it
+var sourceCIDREnv = map[string]string{
+	classReadOnly:    "ALLOW_CIDRS_READ_ONLY",
+	classWrite:       "ALLOW_CIDRS_WRITE",
+	classDestructive: "ALLOW_CIDRS_DESTRUCTIVE",
+}
+
+// parseCIDRs reads a comma-separated list of CIDRs. A bare address means just
+// that host.
+func parseCIDRs(val string) ([]netip.Prefix, error) {
+	var list []netip.Prefix
+	for _, item := range splitList(val) {
+		if !strings.Contains(item, "/") {
+			var a, err = netip.ParseAddr(item)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not a valid address or CIDR", item)
+			}
+			a = a.Unmap()
+			list = append(list, netip.PrefixFrom(a, a.BitLen()))
+			continue
+		}
+		var p, err = netip.ParsePrefix(item)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a valid address or CIDR", item)
+		}
+		list = append(list, p.Masked())
+	}
+	return list, nil
+}
+
+// sourceAddr returns the IP address of a client's network address, or the
+// zero Addr if it can't be determined
+func sourceAddr(a net.Addr) netip.Addr {
+	if a == nil {
+		return netip.Addr{}
+	}
+	if tcp, ok := a.(*net.TCPAddr); ok {
+		return tcp.AddrPort().Addr().Unmap()
+	}
+	var ap, err = netip.ParseAddrPort(a.String())
+	if err != nil {
+		return netip.Addr{}
+	}
+	return ap.Addr().Unmap()
+}
+
+// sourceAllowed returns true if the request's source address may run its
+// command. When a class is restricted, requests whose source is unknown are
+// refused.
+func (r *request) sourceAllowed() bool {
+	var list = SourceCIDRs[commandClass(r.command, r.args)]
+	if len(list) == 0 {
+		return true
+	}
+	if !r.source.IsValid() {
+		return false
+	}
+	for _, p := range list {
+		if p.Contains(r.source) {
+			return true
+		}
+	}
+	return false
+}
+
+// logSourceRefused records a refusal in the audit trail
+func (r *request) logSourceRefused() {
+	slog.Warn("Command refused for source address", "audit", true, "sessionID", r.id,
+		"user", r.user, "source", r.source, "command", r.command, "args", r.args, "class", commandClass(r.command, r.args))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	var list, err = parseCIDRs("10.1.2.3, 192.168.7.9/24,2001:db8::/32")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var expected = []string{"10.1.2.3/32", "192.168.7.0/24", "2001:db8::/32"}
+	if len(list) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, list)
+	}
+	for i, p := range list {
+		if p.String() != expected[i] {
+			t.Errorf("Expected %q, got %q", expected[i], p)
+		}
+	}
+
+	for _, bad := range []string{"10.1.2.300", "10.0.0.0/33", "nca"} {
+		if _, err := parseCIDRs(bad); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestSourceAllowed(t *testing.T) {
+	var orig = SourceCIDRs
+	defer func() { SourceCIDRs = orig }()
+	var nca, _ = parseCIDRs("192.0.2.10")
+	var office, _ = parseCIDRs("10.1.0.0/16")
+	SourceCIDRs = map[string][]netip.Prefix{classDestructive: nca, classWrite: office}
+
+	var ncaAddr = sourceAddr(&net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.10"), Port: 2222})
+	var officeAddr = netip.MustParseAddr("10.1.9.9")
+	var outside = netip.MustParseAddr("172.16.0.1")
+
+	var tests = map[string]struct {
+		command string
+		args    []string
+		source  netip.Addr
+		allowed bool
+	}{
+		"nca purge":        {command: "purge-batch", source: ncaAddr, allowed: true},
+		"office purge":     {command: "purge-batch", source: officeAddr, allowed: false},
+		"unknown purge":    {command: "purge-batch", allowed: false},
+		"office load":      {command: "load-batch", source: officeAddr, allowed: true},
+		"outside load":     {command: "load-batch", source: outside, allowed: false},
+		"outside status":   {command: "job-status", source: outside, allowed: true},
+		"unknown status":   {command: "health", allowed: true},
+		"outside delete":   {command: "delete-awardee", source: outside, allowed: false},
+		"nca create admin": {command: "create-admin-user", source: ncaAddr, allowed: false},
+		"office import":    {command: "import-state", args: []string{"agent-state.tar.gz"}, source: officeAddr, allowed: false},
+		"office reconcile": {command: "reconcile-titles", source: officeAddr, allowed: true},
+		"office repair":    {command: "reconcile-titles", args: []string{"--repair"}, source: officeAddr, allowed: false},
+		"nca repair":       {command: "reconcile-titles", args: []string{"--repair"}, source: ncaAddr, allowed: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var r = &request{command: tc.command, args: tc.args, source: tc.source}
+			if got := r.sourceAllowed(); got != tc.allowed {
+				t.Fatalf("Expected allowed to be %v, got %v", tc.allowed, got)
+			}
+		})
+	}
+
+	var resp = dispatch(&request{command: "purge-batch", args: []string{"batch_oru_foo_ver01"}, source: outside})
+	if resp.status != StatusError || resp.message != `"purge-batch" is not permitted from this address` {
+		t.Fatalf("Expected dispatch to refuse the purge, got %#v", resp)
+	}
+}
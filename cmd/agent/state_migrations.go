@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log/slog"
+
+	"github.com/open-oni/oni-agent/internal/state"
+)
+
+// stateMigrations are every change ever made to the layout of STATE_DIR's
+// files, in order. Never edit or remove a migration once it's released: add a
+// new one instead. Migrations run at startup, before anything reads state.
+var stateMigrations = []state.Migration{
+	{
+		Version:     1,
+		Description: "Baseline: queue.json and tokens.json",
+		Up:          func(*state.Dir) error { return nil },
+	},
+}
+
+// migrateState brings STATE_DIR up to date, returning any error so the agent
+// can refuse to start rather than misread its own state
+func migrateState() error {
+	if State == nil {
+		return nil
+	}
+
+	var applied, err = State.Migrate(stateMigrations)
+	for _, m := range applied {
+		slog.Info("Applied state migration", "version", m.Version, "description", m.Description)
+	}
+	return err
+}
+
+func getMigrateStatus() response {
+	if State == nil {
+		return respond(StatusError, "STATE_DIR is not configured", nil)
+	}
+
+	var st, err = State.Status(stateMigrations)
+	if err != nil {
+		return respond(StatusError, "Unable to read state schema", H{"error": err.Error()})
+	}
+	return respond(StatusSuccess, "", H{"migrations": st})
+}
+
+func init() {
+	register("migrate-status", func(_ *request) response {
+		return getMigrateStatus()
+	})
+}
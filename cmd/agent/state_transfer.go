@@ -0,0 +1,488 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/open-oni/oni-agent/internal/jobarchive"
+	"github.com/open-oni/oni-agent/internal/state"
+	"github.com/open-oni/oni-agent/internal/version"
+)
+
+// stateExportFormat is the version of the export-state archive layout. Bump
+// it when the layout changes in a way older agents can't import.
+const stateExportFormat = 1
+
+// stateManifestName is the first file in every export-state archive
+const stateManifestName = "manifest.json"
+
+// Parts of the agent's state an archive holds, and the directories they're
+// stored in within it
+const (
+	statePartState = "state"
+	statePartJobs  = "jobs"
+)
+
+// stateManifest describes an export-state archive, so an import can check
+// it's whole and came from an agent it understands
+type stateManifest struct {
+	Format       int               `json:"format"`
+	Created      time.Time         `json:"created"`
+	Agent        string            `json:"agent_version"`
+	Host         string            `json:"host"`
+	StateVersion int               `json:"state_version"`
+	Files        []stateExportFile `json:"files"`
+}
+
+// stateExportFile is a single file in an export-state archive
+type stateExportFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// part returns which part of the state the file belongs to, and its name
+// within that part
+func (f stateExportFile) part() (part, name string) {
+	part, name, _ = strings.Cut(f.Path, "/")
+	return part, name
+}
+
+// validStateFileName returns true if name is safe to write into STATE_DIR
+func validStateFileName(name string) bool {
+	return path.Base(name) == name && path.Ext(name) == ".json" && !strings.HasPrefix(name, ".")
+}
+
+// exportState writes STATE_DIR's files and the job archive, if they're
+// configured, into a tar.gz artifact. The agent's in-memory jobs aren't
+// included: only what would survive a restart can be moved to a new host.
+func exportState(r *request) response {
+	if Artifacts == nil {
+		return respond(StatusError, "Artifact storage is not enabled", nil)
+	}
+	if State == nil && JobArchive == nil {
+		return respond(StatusError, "Neither STATE_DIR nor JOB_ARCHIVE_DIR is configured: there's no state to export", nil)
+	}
+
+	var host, _ = os.Hostname()
+	var m = stateManifest{Format: stateExportFormat, Created: time.Now().UTC(), Agent: version.Version, Host: host, Files: []stateExportFile{}}
+	var stateFiles = make(map[string][]byte)
+	var err error
+
+	if State != nil {
+		var s state.Schema
+		s, err = State.Schema()
+		if err != nil {
+			return respond(StatusError, "Unable to read state schema", H{"error": err.Error()})
+		}
+		m.StateVersion = s.Version
+
+		var names []string
+		names, err = State.Names()
+		if err != nil {
+			return respond(StatusError, "Unable to list state files", H{"error": err.Error()})
+		}
+		for _, name := range names {
+			var raw json.RawMessage
+			_, err = State.Read(name, &raw)
+			if err != nil {
+				return respond(StatusError, "Unable to read state file", H{"file": name, "error": err.Error()})
+			}
+			var p = path.Join(statePartState, name)
+			stateFiles[p] = raw
+			m.Files = append(m.Files, stateExportFile{Path: p, Size: int64(len(raw)), SHA256: sha256Sum(raw)})
+		}
+	}
+
+	if JobArchive != nil {
+		var names []string
+		names, err = JobArchive.Names()
+		if err != nil {
+			return respond(StatusError, "Unable to list job archive files", H{"error": err.Error()})
+		}
+		for _, name := range names {
+			var f stateExportFile
+			f, err = hashArchiveFile(name)
+			if err != nil {
+				return respond(StatusError, "Unable to read job archive file", H{"file": name, "error": err.Error()})
+			}
+			m.Files = append(m.Files, f)
+		}
+	}
+
+	var pr, pw = io.Pipe()
+	go func() {
+		pw.CloseWithError(writeStateArchive(pw, m, stateFiles))
+	}()
+	var artifactName = fmt.Sprintf("agent-state-%s.tar.gz", m.Created.Format("20060102T150405"))
+	err = Artifacts.Put(artifactName, pr)
+	pr.Close()
+	if err != nil {
+		r.logError("Unable to store state export", "error", err)
+		return respond(StatusError, "Unable to store state export", H{"error": err.Error()})
+	}
+
+	r.logInfo("Exported agent state", "artifact", artifactName, "files", len(m.Files))
+	var data = H{"name": artifactName}
+	artifactURL(r, data, artifactName)
+	return respond(StatusSuccess, "", H{"artifact": data, "manifest": m})
+}
+
+func sha256Sum(data []byte) string {
+	var sum = sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hashArchiveFile describes a job archive file for the manifest
+func hashArchiveFile(name string) (stateExportFile, error) {
+	var f, err = JobArchive.Open(name)
+	if err != nil {
+		return stateExportFile{}, err
+	}
+	defer f.Close()
+
+	var h = sha256.New()
+	var n int64
+	n, err = io.Copy(h, f)
+	if err != nil {
+		return stateExportFile{}, err
+	}
+	return stateExportFile{Path: path.Join(statePartJobs, name), Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// writeStateArchive writes the manifest, then every file it lists
+func writeStateArchive(w io.Writer, m stateManifest, stateFiles map[string][]byte) error {
+	var gz = gzip.NewWriter(w)
+	var tw = tar.NewWriter(gz)
+
+	var add = func(name string, size int64, r io.Reader) error {
+		var err = tw.WriteHeader(&tar.Header{Name: name, Mode: 0640, Size: size, ModTime: m.Created})
+		if err == nil {
+			_, err = io.Copy(tw, r)
+		}
+		if err != nil {
+			return fmt.Errorf("writing %s: %w", name, err)
+		}
+		return nil
+	}
+
+	var data, err = json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding manifest: %w", err)
+	}
+	err = add(stateManifestName, int64(len(data)), bytes.NewReader(data))
+
+	for _, f := range m.Files {
+		if err != nil {
+			break
+		}
+		var part, name = f.part()
+		if part == statePartState {
+			err = add(f.Path, f.Size, bytes.NewReader(stateFiles[f.Path]))
+			continue
+		}
+
+		var rc io.ReadCloser
+		rc, err = JobArchive.Open(name)
+		if err == nil {
+			// Archive files are never changed once written, so the size can't
+			// have changed since it was hashed
+			err = add(f.Path, f.Size, rc)
+			rc.Close()
+		}
+	}
+
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	return err
+}
+
+// importOptions control what import-state does with an archive
+type importOptions struct {
+	// only, if set, is the one part of the archive to import
+	only string
+
+	// overwrite replaces files the agent already has instead of skipping them
+	overwrite bool
+
+	// dryRun checks the archive and reports what would happen, but changes
+	// nothing
+	dryRun bool
+}
+
+func parseImportStateArgs(args []string) (name string, opts importOptions, err error) {
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--overwrite":
+			opts.overwrite = true
+		case "--dry-run":
+			opts.dryRun = true
+		case "--only":
+			i++
+			if i == len(args) || (args[i] != statePartState && args[i] != statePartJobs) {
+				return "", importOptions{}, fmt.Errorf("--only requires %q or %q", statePartState, statePartJobs)
+			}
+			opts.only = args[i]
+		default:
+			if name != "" || strings.HasPrefix(args[i], "-") {
+				return "", importOptions{}, fmt.Errorf("unexpected argument %q", args[i])
+			}
+			name = args[i]
+		}
+	}
+	if name == "" {
+		return "", importOptions{}, errors.New("an artifact name is required")
+	}
+	return name, opts, nil
+}
+
+// readStateArchive reads an export-state artifact, checking every file
+// against the manifest before handing it to fn. fn may be nil to just verify
+// the archive.
+func readStateArchive(name string, fn func(f stateExportFile, data io.Reader) error) (stateManifest, error) {
+	var m stateManifest
+	var rc, err = Artifacts.Get(name)
+	if err != nil {
+		return m, err
+	}
+	defer rc.Close()
+
+	var gz *gzip.Reader
+	gz, err = gzip.NewReader(rc)
+	if err != nil {
+		return m, fmt.Errorf("not a state export: %w", err)
+	}
+	var tr = tar.NewReader(gz)
+
+	var hdr *tar.Header
+	hdr, err = tr.Next()
+	if err == nil && hdr.Name != stateManifestName {
+		err = fmt.Errorf("first file is %q, not %s", hdr.Name, stateManifestName)
+	}
+	if err == nil {
+		err = json.NewDecoder(tr).Decode(&m)
+	}
+	if err != nil {
+		return m, fmt.Errorf("reading manifest: %w", err)
+	}
+	if m.Format != stateExportFormat {
+		return m, fmt.Errorf("archive format %d is not supported (this agent reads format %d)", m.Format, stateExportFormat)
+	}
+	if m.StateVersion > len(stateMigrations) {
+		return m, fmt.Errorf("archive's state is at version %d, but this agent only knows up to version %d", m.StateVersion, len(stateMigrations))
+	}
+
+	var expected = make(map[string]stateExportFile)
+	for _, f := range m.Files {
+		var part, fname = f.part()
+		var ok = (part == statePartState && validStateFileName(fname)) || (part == statePartJobs && jobarchive.ValidName(fname))
+		if !ok {
+			return m, fmt.Errorf("manifest lists an invalid file: %q", f.Path)
+		}
+		expected[f.Path] = f
+	}
+
+	for {
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return m, fmt.Errorf("reading archive: %w", err)
+		}
+		var f, ok = expected[hdr.Name]
+		if !ok {
+			return m, fmt.Errorf("%q isn't in the manifest, or appears twice", hdr.Name)
+		}
+		delete(expected, hdr.Name)
+
+		var h = sha256.New()
+		var data = io.TeeReader(io.LimitReader(tr, f.Size+1), h)
+		if fn == nil {
+			_, err = io.Copy(io.Discard, data)
+		} else {
+			// fn only gets a file once it's been read in full and checked, so
+			// nothing corrupt is ever written
+			var buf bytes.Buffer
+			_, err = io.Copy(&buf, data)
+			data = &buf
+		}
+		if err != nil {
+			return m, fmt.Errorf("reading %s: %w", f.Path, err)
+		}
+		var sum = hex.EncodeToString(h.Sum(nil))
+		if hdr.Size != f.Size || sum != f.SHA256 {
+			return m, fmt.Errorf("%s doesn't match the manifest's size and checksum", f.Path)
+		}
+		if fn != nil {
+			err = fn(f, data)
+			if err != nil {
+				return m, err
+			}
+		}
+	}
+
+	if len(expected) > 0 {
+		var missing []string
+		for p := range expected {
+			missing = append(missing, p)
+		}
+		return m, fmt.Errorf("archive is missing files listed in its manifest: %s", strings.Join(missing, ", "))
+	}
+	return m, nil
+}
+
+// importState verifies an export-state artifact, then copies its files into
+// STATE_DIR and the job archive. Files the agent already has are skipped
+// unless opts.overwrite is set. Nothing is written until the whole archive
+// has been verified.
+func importState(r *request, name string, opts importOptions) response {
+	if Artifacts == nil {
+		return respond(StatusError, "Artifact storage is not enabled", nil)
+	}
+	var m, err = readStateArchive(name, nil)
+	if errors.Is(err, os.ErrNotExist) {
+		return respond(StatusError, "Artifact not found", H{"artifact": H{"name": name}})
+	}
+	if err != nil {
+		return respond(StatusError, "Invalid state export", H{"artifact": H{"name": name}, "error": err.Error()})
+	}
+
+	var wantState = opts.only != statePartJobs && hasPart(m, statePartState)
+	var wantJobs = opts.only != statePartState && hasPart(m, statePartJobs)
+	if wantState && State == nil {
+		return respond(StatusError, "The archive has state files, but STATE_DIR is not configured; use --only jobs to skip them", nil)
+	}
+	if wantJobs && JobArchive == nil {
+		return respond(StatusError, "The archive has archived jobs, but JOB_ARCHIVE_DIR is not configured; use --only state to skip them", nil)
+	}
+
+	// Mixing state files from two schema versions could leave files which
+	// no migration knows how to fix
+	if wantState && !opts.overwrite {
+		var s state.Schema
+		s, err = State.Schema()
+		if err != nil {
+			return respond(StatusError, "Unable to read state schema", H{"error": err.Error()})
+		}
+		if s.Version != m.StateVersion {
+			return respond(StatusError, fmt.Sprintf("The archive's state is at version %d and this agent's at version %d; use --overwrite to replace this agent's state", m.StateVersion, s.Version), nil)
+		}
+	}
+
+	var imported, skipped = []string{}, []string{}
+	var apply = func(f stateExportFile, data io.Reader) error {
+		var part, fname = f.part()
+		if (part == statePartState && !wantState) || (part == statePartJobs && !wantJobs) {
+			return nil
+		}
+
+		var exists, err = importedFileExists(part, fname)
+		if err != nil {
+			return err
+		}
+		if exists && !opts.overwrite {
+			skipped = append(skipped, f.Path)
+			return nil
+		}
+		imported = append(imported, f.Path)
+		if opts.dryRun {
+			return nil
+		}
+
+		if part == statePartJobs {
+			return JobArchive.Import(fname, data)
+		}
+		var raw json.RawMessage
+		err = json.NewDecoder(data).Decode(&raw)
+		if err == nil {
+			err = State.Write(fname, raw)
+		}
+		if err != nil {
+			return fmt.Errorf("importing %s: %w", f.Path, err)
+		}
+		return nil
+	}
+
+	_, err = readStateArchive(name, apply)
+	if err != nil {
+		r.logError("State import failed", "artifact", name, "imported", imported, "error", err)
+		return respond(StatusError, "Unable to import state", H{"imported": imported, "skipped": skipped, "error": err.Error()})
+	}
+
+	var data = H{"manifest": H{"created": m.Created, "agent_version": m.Agent, "host": m.Host, "state_version": m.StateVersion, "files": len(m.Files)}, "imported": imported, "skipped": skipped}
+	if opts.dryRun {
+		data["dry_run"] = true
+		return respond(StatusSuccess, "Archive verified; nothing was changed", data)
+	}
+
+	slog.Info("Imported agent state", "audit", true, "sessionID", r.id, "user", r.user, "artifact", name, "host", m.Host, "imported", len(imported), "skipped", len(skipped))
+	if wantState {
+		err = migrateState()
+		if err != nil {
+			return respond(StatusError, "State was imported, but couldn't be migrated", H{"imported": imported, "skipped": skipped, "error": err.Error()})
+		}
+	}
+	return respond(StatusSuccess, "State imported; restart the agent so everything picks it up", data)
+}
+
+// hasPart returns true if the manifest lists any files in the given part
+func hasPart(m stateManifest, part string) bool {
+	for _, f := range m.Files {
+		if p, _ := f.part(); p == part {
+			return true
+		}
+	}
+	return false
+}
+
+// importedFileExists reports whether the agent already has a file an import
+// would write
+func importedFileExists(part, name string) (bool, error) {
+	if part == statePartState {
+		var raw json.RawMessage
+		return State.Read(name, &raw)
+	}
+	var f, err = JobArchive.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	f.Close()
+	return true, nil
+}
+
+func init() {
+	register("export-state", func(r *request) response {
+		if len(r.args) != 0 {
+			return respond(StatusError, fmt.Sprintf("%q takes no arguments", r.command), nil)
+		}
+		return exportState(r)
+	})
+
+	register("import-state", func(r *request) response {
+		var name, opts, err = parseImportStateArgs(r.args)
+		if err != nil {
+			return respond(StatusError, fmt.Sprintf("Invalid arguments for %q: %s", r.command, err), nil)
+		}
+		return importState(r, name, opts)
+	})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/open-oni/oni-agent/internal/artifact"
+	"github.com/open-oni/oni-agent/internal/jobarchive"
+	"github.com/open-oni/oni-agent/internal/state"
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+func TestExportImportState(t *testing.T) {
+	var origArtifacts, origState, origArchive = Artifacts, State, JobArchive
+	defer func() { Artifacts, State, JobArchive = origArtifacts, origState, origArchive }()
+
+	var artifactDir = t.TempDir()
+	Artifacts, _ = artifact.NewDir(artifactDir)
+	var open = func() {
+		State, _ = state.Open(t.TempDir())
+		JobArchive, _ = jobarchive.New(t.TempDir())
+		if err := migrateState(); err != nil {
+			t.Fatalf("Unable to migrate state: %s", err)
+		}
+	}
+
+	// The old host has a frozen batch and an archived job
+	open()
+	State.Write(frozenStateFile, map[string]string{"batch_oru_foo_ver01": "court order"})
+	JobArchive.Write([]queue.Record{{ID: 3, Name: "old job", QueuedAt: time.Now()}})
+	var r = &request{user: "admin"}
+	var resp = exportState(r)
+	if resp.status != StatusSuccess {
+		t.Fatalf("Unable to export state: %s %v", resp.message, resp.data)
+	}
+	var name = resp.data["artifact"].(H)["name"].(string)
+
+	// The new host has its own schema file, at the same version, which is
+	// skipped; a dry run changes nothing
+	open()
+	resp = importState(r, name, importOptions{dryRun: true})
+	if resp.status != StatusSuccess || len(resp.data["imported"].([]string)) != 2 {
+		t.Fatalf("Expected a dry run to report two files, got %s %v", resp.message, resp.data)
+	}
+	if names, _ := JobArchive.Names(); len(names) != 0 {
+		t.Fatalf("Expected a dry run not to import anything, got %v", names)
+	}
+
+	resp = importState(r, name, importOptions{})
+	if resp.status != StatusSuccess {
+		t.Fatalf("Unable to import state: %s %v", resp.message, resp.data)
+	}
+	var skipped = resp.data["skipped"].([]string)
+	if len(skipped) != 1 || skipped[0] != "state/"+state.SchemaFile {
+		t.Errorf("Expected only the schema file to be skipped, got %v", skipped)
+	}
+	var frozen map[string]string
+	State.Read(frozenStateFile, &frozen)
+	if frozen["batch_oru_foo_ver01"] != "court order" {
+		t.Errorf("Expected the frozen batch to be imported, got %v", frozen)
+	}
+	var found, _ = JobArchive.Find(3)
+	if len(found) != 1 || found[0].Name != "old job" {
+		t.Errorf("Expected the archived job to be imported, got %v", found)
+	}
+
+	// Only the chosen part is imported
+	open()
+	resp = importState(r, name, importOptions{only: statePartJobs})
+	if resp.status != StatusSuccess || len(resp.data["imported"].([]string)) != 1 {
+		t.Fatalf("Expected just the job archive to be imported, got %s %v", resp.message, resp.data)
+	}
+
+	// A damaged archive is refused before anything is written
+	var data, _ = os.ReadFile(filepath.Join(artifactDir, name))
+	var broken = strings.Replace(name, "agent-state", "broken-state", 1)
+	Artifacts.Put(broken, io.LimitReader(bytes.NewReader(data), int64(len(data)-100)))
+	open()
+	resp = importState(r, broken, importOptions{})
+	if resp.status != StatusError || resp.message != "Invalid state export" {
+		t.Fatalf("Expected a damaged archive to be refused, got %s %v", resp.message, resp.data)
+	}
+	if names, _ := State.Names(); len(names) != 1 {
+		t.Errorf("Expected nothing to be written from a damaged archive, got %v", names)
+	}
+}
+
+func TestParseImportStateArgs(t *testing.T) {
+	var tests = map[string]struct {
+		args []string
+		name string
+		opts importOptions
+		ok   bool
+	}{
+		"plain":     {args: []string{"a.tar.gz"}, name: "a.tar.gz", ok: true},
+		"all flags": {args: []string{"--dry-run", "a.tar.gz", "--only", "jobs", "--overwrite"}, name: "a.tar.gz", opts: importOptions{only: "jobs", overwrite: true, dryRun: true}, ok: true},
+		"no name":   {args: []string{"--overwrite"}},
+		"bad only":  {args: []string{"a.tar.gz", "--only", "tokens"}},
+		"two names": {args: []string{"a.tar.gz", "b.tar.gz"}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got, opts, err = parseImportStateArgs(tc.args)
+			if (err == nil) != tc.ok || got != tc.name || opts != tc.opts {
+				t.Errorf("Expected %q %#v (ok %v), got %q %#v (%v)", tc.name, tc.opts, tc.ok, got, opts, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+)
+
+// streamBody is a list of results which can be sent incrementally rather
+// than built up into one huge JSON document. Transports which can't stream
+// put the items under key in the response data instead; see collect.
+type streamBody struct {
+	key  string
+	each func(emit func(item any) error) error
+}
+
+// respondStream builds a response whose list items come from each. The items
+// are produced when the response is sent, not when it's built.
+func respondStream(st Status, msg string, data H, key string, each func(emit func(item any) error) error) response {
+	var r = respond(st, msg, data)
+	r.stream = &streamBody{key: key, each: each}
+	return r
+}
+
+// collect returns the response with any stream gathered up into its data,
+// for transports (and callers, like batch) which need a single document
+func (r response) collect() response {
+	if r.stream == nil {
+		return r
+	}
+
+	var items = []any{}
+	var err = r.stream.each(func(item any) error {
+		items = append(items, item)
+		return nil
+	})
+	if err != nil {
+		return respond(StatusError, "Unable to produce results", H{"error": err.Error()})
+	}
+
+	var data = H{}
+	for k, v := range r.data {
+		data[k] = v
+	}
+	data[r.stream.key] = items
+	return respond(r.status, r.message, data)
+}
+
+// writeStream sends a streaming response as NDJSON: one line per item, then
+// a final line holding the usual response envelope (status, session, etc.)
+// and the number of items sent. Clients know they have everything once they
+// see a line with a "status" key. If producing items fails partway through,
+// the final line is an error saying how far we got.
+func writeStream(w io.Writer, r response, sessionID int64, gz bool) error {
+	var zw *gzip.Writer
+	if gz {
+		zw = gzip.NewWriter(w)
+		w = zw
+	}
+
+	var enc = json.NewEncoder(w)
+	var count int
+	var err = r.stream.each(func(item any) error {
+		count++
+		return enc.Encode(item)
+	})
+
+	var data = H{}
+	for k, v := range r.data {
+		data[k] = v
+	}
+	data["count"] = count
+	var final = respond(r.status, r.message, data)
+	if err != nil {
+		data["error"] = err.Error()
+		final = respond(StatusError, "Unable to produce results", data)
+	}
+
+	var b []byte
+	b, err = final.JSON(sessionID)
+	if err == nil {
+		_, err = w.Write(append(b, '\n'))
+	}
+	if err == nil && zw != nil {
+		err = zw.Close()
+	}
+	return err
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func countTo(n int, fail error) func(emit func(any) error) error {
+	return func(emit func(any) error) error {
+		for i := 1; i <= n; i++ {
+			var err = emit(H{"n": i})
+			if err != nil {
+				return err
+			}
+		}
+		return fail
+	}
+}
+
+func TestWriteStream(t *testing.T) {
+	var tests = map[string]struct {
+		fail   error
+		gzip   bool
+		status string
+	}{
+		"plain":   {status: "success"},
+		"gzipped": {gzip: true, status: "success"},
+		"failed":  {fail: errors.New("database went away"), status: "error"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			var resp = respondStream(StatusSuccess, "", H{"total": 3}, "items", countTo(3, tc.fail))
+			var err = writeStream(&buf, resp, 7, tc.gzip)
+			if err != nil {
+				t.Fatalf("Unable to write stream: %s", err)
+			}
+
+			var r io.Reader = &buf
+			if tc.gzip {
+				r, err = gzip.NewReader(&buf)
+				if err != nil {
+					t.Fatalf("Response isn't gzipped: %s", err)
+				}
+			}
+			var out, _ = io.ReadAll(r)
+			var lines = strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+			if len(lines) != 4 {
+				t.Fatalf("Expected 3 items and an envelope, got %q", out)
+			}
+			if lines[0] != `{"n":1}` || lines[2] != `{"n":3}` {
+				t.Fatalf("Unexpected items %q", lines[:3])
+			}
+
+			var final map[string]any
+			err = json.Unmarshal([]byte(lines[3]), &final)
+			if err != nil {
+				t.Fatalf("Final line isn't JSON: %s", err)
+			}
+			if final["status"] != tc.status || final["count"] != float64(3) || final["total"] != float64(3) || final["session"].(map[string]any)["id"] != float64(7) {
+				t.Fatalf("Unexpected envelope %#v", final)
+			}
+			if tc.fail != nil && final["error"] != tc.fail.Error() {
+				t.Fatalf("Expected the stream's error in the envelope, got %#v", final)
+			}
+		})
+	}
+}
+
+func TestCollect(t *testing.T) {
+	var resp = respondStream(StatusSuccess, "hi", H{"total": 2}, "items", countTo(2, nil)).collect()
+	if resp.stream != nil || resp.message != "hi" || resp.data["total"] != 2 || len(resp.data["items"].([]any)) != 2 {
+		t.Fatalf("Expected a collected response, got %#v", resp)
+	}
+
+	resp = respondStream(StatusSuccess, "", nil, "items", countTo(2, errors.New("nope"))).collect()
+	if resp.status != StatusError || resp.data["error"] != "nope" {
+		t.Fatalf("Expected an error response, got %#v", resp)
+	}
+
+	// An empty stream is still a list, not null
+	resp = respondStream(StatusSuccess, "", nil, "items", countTo(0, nil)).collect()
+	var b, _ = resp.JSON(1)
+	if !strings.Contains(string(b), `"items":[]`) {
+		t.Fatalf("Expected an empty list, got %s", b)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/open-oni/oni-agent/internal/issuekey"
+)
+
+// titleIssue is one issue's date and edition, as stored in ONI
+type titleIssue struct {
+	date    time.Time
+	edition int
+}
+
+func (dbLookups) titleIssues(ctx context.Context, lccn string) ([]titleIssue, error) {
+	var rows, err = reportingDB().QueryContext(ctx, ONIDB.TitleIssues, lccn)
+	if err != nil {
+		return nil, fmt.Errorf("querying database: %w", err)
+	}
+	defer rows.Close()
+
+	var list []titleIssue
+	for rows.Next() {
+		var date string
+		var i titleIssue
+		err = rows.Scan(&date, &i.edition)
+		if err == nil {
+			i.date, err = time.Parse(issueDateFormat, date)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading issues from database: %w", err)
+		}
+		list = append(list, i)
+	}
+	return list, rows.Err()
+}
+
+// weekdayNames maps the names --schedule accepts to weekdays
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseSchedule reads a publication schedule: "daily", "weekdays", or a
+// comma-separated list of three-letter day names
+func parseSchedule(val string) (map[time.Weekday]bool, error) {
+	var days = make(map[time.Weekday]bool)
+	switch val {
+	case "daily":
+		for _, d := range weekdayNames {
+			days[d] = true
+		}
+		return days, nil
+	case "weekdays":
+		for d := time.Monday; d <= time.Friday; d++ {
+			days[d] = true
+		}
+		return days, nil
+	}
+
+	for _, name := range splitList(strings.ToLower(val)) {
+		var d, ok = weekdayNames[name]
+		if !ok {
+			return nil, fmt.Errorf("%q is not a day (use daily, weekdays, or a list such as mon,thu)", name)
+		}
+		days[d] = true
+	}
+	if len(days) == 0 {
+		return nil, fmt.Errorf("a schedule needs at least one day")
+	}
+	return days, nil
+}
+
+// calendarDay lists the editions published on a day
+type calendarDay struct {
+	Day      int   `json:"day"`
+	Editions []int `json:"editions"`
+}
+
+// calendarMonth is one month of a title's calendar. Missing and Unexpected
+// are only filled in when there's a schedule to compare against.
+type calendarMonth struct {
+	Month      int           `json:"month"`
+	Days       []calendarDay `json:"days"`
+	Missing    []int         `json:"missing,omitempty"`
+	Unexpected []int         `json:"unexpected,omitempty"`
+}
+
+// calendarYear is one year of a title's calendar
+type calendarYear struct {
+	Year   int             `json:"year"`
+	Months []calendarMonth `json:"months"`
+}
+
+// titleCalendar is the title-calendar response: every month from the first
+// issue to the last, whether or not it has any issues, so gaps are obvious
+type titleCalendar struct {
+	LCCN       string         `json:"lccn"`
+	First      string         `json:"first"`
+	Last       string         `json:"last"`
+	Issues     int            `json:"issues"`
+	Missing    int            `json:"missing,omitempty"`
+	Unexpected int            `json:"unexpected,omitempty"`
+	Years      []calendarYear `json:"years"`
+}
+
+// buildCalendar arranges issues (which must be sorted) into a calendar. With
+// a schedule, days it says should have an issue but don't are listed as
+// missing, and issues on other days as unexpected.
+func buildCalendar(lccn string, issues []titleIssue, schedule map[time.Weekday]bool) *titleCalendar {
+	var first, last = issues[0].date, issues[len(issues)-1].date
+	var cal = &titleCalendar{LCCN: lccn, First: first.Format(issueDateFormat), Last: last.Format(issueDateFormat), Issues: len(issues)}
+
+	var byDate = make(map[time.Time][]int)
+	for _, i := range issues {
+		byDate[i.date] = append(byDate[i.date], i.edition)
+	}
+
+	var year *calendarYear
+	var month *calendarMonth
+	for d := first; !d.After(last); d = d.AddDate(0, 0, 1) {
+		if year == nil || year.Year != d.Year() {
+			cal.Years = append(cal.Years, calendarYear{Year: d.Year()})
+			year = &cal.Years[len(cal.Years)-1]
+			month = nil
+		}
+		if month == nil || month.Month != int(d.Month()) {
+			year.Months = append(year.Months, calendarMonth{Month: int(d.Month()), Days: []calendarDay{}})
+			month = &year.Months[len(year.Months)-1]
+		}
+
+		var editions = byDate[d]
+		if len(editions) > 0 {
+			month.Days = append(month.Days, calendarDay{Day: d.Day(), Editions: editions})
+		}
+		if schedule == nil {
+			continue
+		}
+		switch {
+		case schedule[d.Weekday()] && len(editions) == 0:
+			month.Missing = append(month.Missing, d.Day())
+			cal.Missing++
+		case !schedule[d.Weekday()] && len(editions) > 0:
+			month.Unexpected = append(month.Unexpected, d.Day())
+			cal.Unexpected++
+		}
+	}
+	return cal
+}
+
+func getTitleCalendar(r *request, lccn string, schedule map[time.Weekday]bool) response {
+	if !issuekey.ValidLCCN(lccn) {
+		return respond(StatusError, fmt.Sprintf("%q is not a valid LCCN", lccn), nil)
+	}
+	var issues, err = lookups.titleIssues(r.ctx, lccn)
+	if err != nil {
+		r.logError("Unable to read title issues", "lccn", lccn, "error", err)
+		return respond(StatusError, fmt.Sprintf("Unable to build a calendar for %q", lccn), H{"error": err.Error()})
+	}
+	if len(issues) == 0 {
+		return respond(StatusError, fmt.Sprintf("ONI has no issues for %q", lccn), nil)
+	}
+	return respond(StatusSuccess, "", H{"calendar": buildCalendar(lccn, issues, schedule)})
+}
+
+func init() {
+	register("title-calendar", func(r *request) response {
+		var schedule map[time.Weekday]bool
+		var args = r.args
+		if len(args) == 3 && args[1] == "--schedule" {
+			var err error
+			schedule, err = parseSchedule(args[2])
+			if err != nil {
+				return respond(StatusError, fmt.Sprintf("Invalid %q arguments", r.command), H{"error": err.Error()})
+			}
+			args = args[:1]
+		}
+		if len(args) != 1 {
+			return respond(StatusError, fmt.Sprintf("%q requires exactly one LCCN, optionally followed by --schedule <days>", r.command), nil)
+		}
+		return getTitleCalendar(r, args[0], schedule)
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseSchedule(t *testing.T) {
+	var tests = map[string]struct {
+		val         string
+		days        int
+		expectError bool
+	}{
+		"daily":    {val: "daily", days: 7},
+		"weekdays": {val: "weekdays", days: 5},
+		"list":     {val: "Mon, thu", days: 2},
+		"bad day":  {val: "mon,funday", expectError: true},
+		"empty":    {val: ",", expectError: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got, err = parseSchedule(tc.val)
+			if tc.expectError {
+				if err == nil {
+					t.Fatalf("Expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil || len(got) != tc.days {
+				t.Fatalf("Expected %d days, got %v, %v", tc.days, got, err)
+			}
+		})
+	}
+}
+
+func TestTitleCalendar(t *testing.T) {
+	// A weekly (Saturday) title with one skipped week, a second edition, and
+	// an extra Tuesday issue, running into the next year
+	useLookups(t, fakeLookups{issues: func(lccn string) ([]titleIssue, error) {
+		if lccn != "sn96088442" {
+			return nil, nil
+		}
+		return []titleIssue{
+			{date("1902-12-13"), 1},
+			{date("1902-12-20"), 1},
+			{date("1902-12-20"), 2},
+			{date("1902-12-30"), 1},
+			{date("1903-01-03"), 1},
+		}, nil
+	}})
+
+	var resp = getTitleCalendar(&request{}, "sn96088442", nil)
+	if resp.status != StatusSuccess {
+		t.Fatalf("Unexpected error: %#v", resp)
+	}
+	var cal = resp.data["calendar"].(*titleCalendar)
+	if cal.First != "1902-12-13" || cal.Last != "1903-01-03" || cal.Issues != 5 || len(cal.Years) != 2 {
+		t.Fatalf("Unexpected calendar summary: %#v", cal)
+	}
+	var expected = calendarMonth{Month: 12, Days: []calendarDay{{13, []int{1}}, {20, []int{1, 2}}, {30, []int{1}}}}
+	if diff := cmp.Diff(expected, cal.Years[0].Months[0]); diff != "" {
+		t.Fatalf("Expected December's issues with no schedule diff (-want +got):\n%s", diff)
+	}
+
+	var sat, _ = parseSchedule("sat")
+	resp = getTitleCalendar(&request{}, "sn96088442", sat)
+	cal = resp.data["calendar"].(*titleCalendar)
+	expected.Missing, expected.Unexpected = []int{27}, []int{30}
+	if diff := cmp.Diff(expected, cal.Years[0].Months[0]); diff != "" {
+		t.Fatalf("Expected the 27th missing and the 30th unexpected (-want +got):\n%s", diff)
+	}
+	if cal.Missing != 1 || cal.Unexpected != 1 {
+		t.Fatalf("Expected one missing and one unexpected issue, got %#v", cal)
+	}
+	if jan := cal.Years[1].Months[0]; jan.Month != 1 || len(jan.Days) != 1 || jan.Missing != nil {
+		t.Fatalf("Unexpected January: %#v", jan)
+	}
+
+	for _, lccn := range []string{"sn00000000", "not an lccn"} {
+		resp = getTitleCalendar(&request{}, lccn, nil)
+		if resp.status != StatusError {
+			t.Errorf("Expected %q to fail, got %#v", lccn, resp)
+		}
+	}
+}
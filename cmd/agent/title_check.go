@@ -0,0 +1,45 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// findTitle looks up the title metadata ONI currently has for the given LCCN
+func findTitle(lccn string) (t marcTitle, found bool, err error) {
+	var row = dbPool.QueryRow(ONIDB.FindTitle, lccn)
+	var place sql.NullString
+	err = row.Scan(&t.LCCN, &t.Name, &place, &t.StartYear, &t.EndYear)
+	if errors.Is(err, sql.ErrNoRows) {
+		return t, false, nil
+	}
+	if err != nil {
+		return t, false, fmt.Errorf("querying database: %w", err)
+	}
+
+	t.Place = place.String
+	return t, true, nil
+}
+
+// checkTitleConflicts compares each incoming title against ONI's existing
+// data, returning a list of conflicts. New LCCNs never conflict.
+func checkTitleConflicts(titles []marcTitle) ([]*titleConflict, error) {
+	var conflicts []*titleConflict
+	for _, incoming := range titles {
+		var existing, found, err = findTitle(incoming.LCCN)
+		if err != nil {
+			return nil, fmt.Errorf("looking up title %q: %w", incoming.LCCN, err)
+		}
+		if !found {
+			continue
+		}
+
+		var c = diffTitles(existing, incoming)
+		if c != nil {
+			conflicts = append(conflicts, c)
+		}
+	}
+
+	return conflicts, nil
+}
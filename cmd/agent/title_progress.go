@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+// titleProgressPoll is how often a running title load's output is checked for
+// newly loaded records
+var titleProgressPoll = time.Second
+
+// titleActionRegexp finds what ONI did with a record in a line of load_titles
+// output, e.g., "created title sn96088442" or "Updating title: sn96088442"
+var titleActionRegexp = regexp.MustCompile(`(?i)\b(creat|updat)(ed|ing)\b`)
+
+// titleProgress turns load_titles output into one progress event per record
+type titleProgress struct {
+	pending map[string]bool
+	total   int
+	done    int
+}
+
+func newTitleProgress(lccns []string) *titleProgress {
+	var p = &titleProgress{pending: make(map[string]bool), total: len(lccns)}
+	for _, lccn := range lccns {
+		p.pending[lccn] = true
+	}
+	return p
+}
+
+// scan returns the progress event for a line of output saying a record was
+// created or updated. Lines which don't name one of the load's LCCNs, or
+// name one already seen, are ignored, so ONI's summary lines and repeated
+// messages don't throw off the count.
+func (p *titleProgress) scan(line string) (e queue.ProgressEvent, ok bool) {
+	var m = titleActionRegexp.FindStringSubmatch(line)
+	if m == nil {
+		return e, false
+	}
+	var action = "updated"
+	if strings.EqualFold(m[1], "creat") {
+		action = "created"
+	}
+
+	var fields = strings.FieldsFunc(line, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, f := range fields {
+		if !p.pending[f] {
+			continue
+		}
+		delete(p.pending, f)
+		p.done++
+		return queue.ProgressEvent{
+			Done:    p.done,
+			Total:   p.total,
+			Message: fmt.Sprintf("Record %d of %d: %s %s", p.done, p.total, f, action),
+			Detail:  map[string]string{"lccn": f, "action": action},
+		}, true
+	}
+	return e, false
+}
+
+// watchTitleProgress follows a title load's output, recording a progress
+// event for each record ONI creates or updates. The returned channel is
+// closed once the job has finished and all its output has been read.
+func watchTitleProgress(j *queue.Job, lccns []string) <-chan struct{} {
+	var done = make(chan struct{})
+	go func() {
+		defer close(done)
+		var p = newTitleProgress(lccns)
+		var nOut, nErr int
+		for {
+			// Check for completion before reading so we never miss the final lines
+			var finished bool
+			select {
+			case <-j.Done():
+				finished = true
+			default:
+			}
+			var out, errs = j.StdoutSince(nOut), j.StderrSince(nErr)
+			nOut, nErr = nOut+len(out), nErr+len(errs)
+			for _, line := range append(out, errs...) {
+				if e, ok := p.scan(line); ok {
+					j.AddProgress(e)
+				}
+			}
+			if finished {
+				return
+			}
+			select {
+			case <-j.Done():
+			case <-time.After(titleProgressPoll):
+			}
+		}
+	}()
+	return done
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+func TestTitleProgressScan(t *testing.T) {
+	var p = newTitleProgress([]string{"sn96088442", "sn83025138", "2004260215"})
+	var lines = []string{
+		"INFO:core.title_loader:loading marc titles from /tmp/123-oni-marc/marc.xml",
+		"INFO:core.title_loader:created title: sn96088442",
+		"INFO:core.title_loader:Updating title sn83025138 (The Morning Oregonian)",
+		"INFO:core.title_loader:updated title: sn83025138",
+		"INFO:core.title_loader:updated title: sn00000000",
+		"INFO:core.title_loader:created title: 2004260215",
+		"INFO:core.management.commands.load_titles:titles created: 2, updated: 1",
+	}
+	var got []string
+	for _, line := range lines {
+		if e, ok := p.scan(line); ok {
+			got = append(got, e.Message)
+		}
+	}
+	var want = []string{
+		"Record 1 of 3: sn96088442 created",
+		"Record 2 of 3: sn83025138 updated",
+		"Record 3 of 3: 2004260215 created",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Unexpected events (-want +got):\n%s", diff)
+	}
+}
+
+func TestWatchTitleProgress(t *testing.T) {
+	var origPoll = titleProgressPoll
+	defer func() { titleProgressPoll = origPoll }()
+	titleProgressPoll = time.Millisecond
+
+	var q = queue.New(queue.CommandRunner{Path: "/bin/false"})
+	var seen int
+	q.SetHooks(queue.Hooks{Progress: func(*queue.Job, queue.ProgressEvent) { seen++ }})
+	var j = q.NewFuncJob("Load title from MARC XML", func(_ context.Context, j *queue.Job) error {
+		j.Warnf("INFO:core.title_loader:created title: sn96088442")
+		time.Sleep(5 * time.Millisecond)
+		j.Warnf("INFO:core.title_loader:updated title: sn83025138")
+		return nil
+	})
+	var watching = watchTitleProgress(j, []string{"sn96088442", "sn83025138"})
+	j.Run(context.Background())
+	<-watching
+
+	var progress = j.Progress()
+	if len(progress) != 2 || seen != 2 {
+		t.Fatalf("Expected two progress events, got %#v (%d seen by the hook)", progress, seen)
+	}
+	var last = progress[1]
+	if last.Done != 2 || last.Total != 2 || last.Detail["lccn"] != "sn83025138" || last.Detail["action"] != "updated" {
+		t.Errorf("Unexpected final event: %#v", last)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+// solrTitlePageSize is how many title documents are read from Solr per
+// request while reconciling
+const solrTitlePageSize = 1000
+
+// solrTitle is the part of a Solr title document reconcile-titles needs
+type solrTitle struct {
+	ID   string `json:"id"`
+	LCCN string `json:"lccn"`
+}
+
+// titleReconcileReport is the artifact a reconcile-titles job produces
+type titleReconcileReport struct {
+	Generated time.Time    `json:"generated"`
+	Titles    int          `json:"titles"`
+	Indexed   int          `json:"indexed"`
+	Matched   int          `json:"matched"`
+	NotInSolr []string     `json:"not_in_solr"`
+	OnlySolr  []solrTitle  `json:"only_in_solr"`
+	Repair    *titleRepair `json:"repair,omitempty"`
+}
+
+// titleRepair records what a reconcile-titles --repair job changed
+type titleRepair struct {
+	Deleted    []string `json:"deleted,omitempty"`
+	ReindexJob int64    `json:"reindex_job,omitempty"`
+	Warning    string   `json:"warning,omitempty"`
+}
+
+// dbTitleLCCNs returns the LCCN of every title in db
+func dbTitleLCCNs(ctx context.Context, db *timedDB) ([]string, error) {
+	var rows, err = db.QueryContext(ctx, ONIDB.TitleLCCNs)
+	if err != nil {
+		return nil, fmt.Errorf("querying database: %w", err)
+	}
+	defer rows.Close()
+
+	var lccns []string
+	for rows.Next() {
+		var lccn string
+		err = rows.Scan(&lccn)
+		if err != nil {
+			return nil, fmt.Errorf("reading titles from database: %w", err)
+		}
+		lccns = append(lccns, lccn)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("reading titles from database: %w", err)
+	}
+	return lccns, nil
+}
+
+// solrTitles returns every title document in Solr, paged in id order so no
+// title is missed or seen twice
+func solrTitles(ctx context.Context) ([]solrTitle, error) {
+	var titles []solrTitle
+	for {
+		var docs, total, err = Solr.SelectSorted(ctx, "type:title", "id asc", len(titles), solrTitlePageSize, "id", "lccn")
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range docs {
+			var t solrTitle
+			t.ID, _ = doc["id"].(string)
+			t.LCCN, _ = doc["lccn"].(string)
+			titles = append(titles, t)
+		}
+		if len(docs) == 0 || len(titles) >= total {
+			return titles, nil
+		}
+	}
+}
+
+// reconcileTitles compares the database's LCCNs against Solr's title
+// documents, returning a report of titles missing from either side
+func reconcileTitles(lccns []string, indexed []solrTitle) titleReconcileReport {
+	var report = titleReconcileReport{
+		Titles:    len(lccns),
+		Indexed:   len(indexed),
+		NotInSolr: []string{},
+		OnlySolr:  []solrTitle{},
+	}
+
+	var inDB = make(map[string]bool, len(lccns))
+	for _, lccn := range lccns {
+		inDB[lccn] = true
+	}
+	var inSolr = make(map[string]bool, len(indexed))
+	for _, t := range indexed {
+		inSolr[t.LCCN] = true
+		if !inDB[t.LCCN] {
+			report.OnlySolr = append(report.OnlySolr, t)
+		}
+	}
+	for _, lccn := range lccns {
+		if inSolr[lccn] {
+			report.Matched++
+			continue
+		}
+		report.NotInSolr = append(report.NotInSolr, lccn)
+	}
+
+	sort.Strings(report.NotInSolr)
+	sort.Slice(report.OnlySolr, func(i, k int) bool { return report.OnlySolr[i].ID < report.OnlySolr[k].ID })
+	return report
+}
+
+// repairTitles deletes Solr's orphaned title documents and queues a reindex
+// of the titles Solr is missing, recording what was done in the report
+func repairTitles(ctx context.Context, j *queue.Job, report *titleReconcileReport) error {
+	var repair = &titleRepair{}
+	report.Repair = repair
+
+	if len(report.OnlySolr) > 0 {
+		var ids []string
+		for _, t := range report.OnlySolr {
+			ids = append(ids, t.ID)
+		}
+		var err = Solr.Delete(ctx, ids...)
+		if err != nil {
+			return fmt.Errorf("deleting orphaned title documents: %w", err)
+		}
+		repair.Deleted = ids
+		j.Logf("Deleted %d orphaned title documents from Solr", len(ids))
+	}
+
+	if len(report.NotInSolr) > 0 {
+		var err = checkONICommand(reindexTitlesCommand)
+		if err != nil {
+			repair.Warning = fmt.Sprintf("Missing titles will not be reindexed: %s", err)
+			j.Warnf("%s", repair.Warning)
+			return nil
+		}
+		var args = append([]string{reindexTitlesCommand}, report.NotInSolr...)
+		repair.ReindexJob = JobRunner.QueueJobAfter("Reindex titles missing from Solr", args, j.ID())
+		j.Logf("Queued job %d to reindex %d titles", repair.ReindexJob, len(report.NotInSolr))
+	}
+	return nil
+}
+
+// runReconcileTitles returns the reconcile-titles job: it compares ONI's
+// titles against Solr, logs the differences, optionally repairs them, and
+// stores the full report as an artifact
+func runReconcileTitles(repair bool) queue.RunFunc {
+	return func(ctx context.Context, j *queue.Job) error {
+		// A repair acts on the differences, so they must come from the primary
+		// rather than a replica which may be behind it
+		var db = reportingDB()
+		if repair {
+			db = dbPool
+		}
+		var lccns, err = dbTitleLCCNs(ctx, db)
+		if err != nil {
+			return err
+		}
+		var indexed []solrTitle
+		indexed, err = solrTitles(ctx)
+		if err != nil {
+			return err
+		}
+		j.Logf("Reconciling %d titles against %d Solr title documents", len(lccns), len(indexed))
+
+		var report = reconcileTitles(lccns, indexed)
+		report.Generated = time.Now()
+		for _, lccn := range report.NotInSolr {
+			j.Warnf("%s: in the database but not in Solr", lccn)
+		}
+		for _, t := range report.OnlySolr {
+			j.Warnf("%s: in Solr (%s) but not in the database", t.LCCN, t.ID)
+		}
+		j.Logf("%d of %d titles match", report.Matched, report.Titles)
+
+		if repair {
+			err = repairTitles(ctx, j, &report)
+			if err != nil {
+				return err
+			}
+		}
+
+		var data []byte
+		data, err = json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return fmt.Errorf("encoding report: %w", err)
+		}
+
+		var name = fmt.Sprintf("reconcile-titles-%s.json", report.Generated.UTC().Format("20060102T150405"))
+		err = Artifacts.Put(name, bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("storing report: %w", err)
+		}
+		j.AddArtifact(name)
+		j.Logf("Report stored as artifact %q", name)
+
+		return nil
+	}
+}
+
+func reconcileTitlesCommand(args []string) response {
+	var repair bool
+	for _, arg := range args {
+		if arg != "--repair" {
+			return respond(StatusError, fmt.Sprintf("%q is not a valid option for %q", arg, "reconcile-titles"), nil)
+		}
+		repair = true
+	}
+	if Solr == nil {
+		return respond(StatusError, "Title reconciliation is not enabled (SOLR_URL is not set)", nil)
+	}
+	if Artifacts == nil {
+		return respond(StatusError, "Artifact storage is not enabled", nil)
+	}
+
+	var id = JobRunner.QueueFunc("Reconcile titles", runReconcileTitles(repair))
+	return respond(StatusSuccess, "Job added to queue", H{"job": H{"id": id}})
+}
+
+func init() {
+	register("reconcile-titles", func(r *request) response {
+		return reconcileTitlesCommand(r.args)
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/open-oni/oni-agent/internal/solr"
+)
+
+func TestReconcileTitles(t *testing.T) {
+	var lccns = []string{"sn1", "sn2", "sn3"}
+	var indexed = []solrTitle{
+		{ID: "/lccn/sn9/", LCCN: "sn9"},
+		{ID: "/lccn/sn1/", LCCN: "sn1"},
+		{ID: "/lccn/sn3/", LCCN: "sn3"},
+	}
+
+	var expected = titleReconcileReport{
+		Titles:    3,
+		Indexed:   3,
+		Matched:   2,
+		NotInSolr: []string{"sn2"},
+		OnlySolr:  []solrTitle{{ID: "/lccn/sn9/", LCCN: "sn9"}},
+	}
+	var diff = cmp.Diff(expected, reconcileTitles(lccns, indexed))
+	if diff != "" {
+		t.Errorf("Unexpected report: %s", diff)
+	}
+}
+
+func TestSolrTitles(t *testing.T) {
+	var srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("q") != "type:title" || r.URL.Query().Get("sort") != "id asc" {
+			t.Errorf("Unexpected query %q sorted by %q", r.URL.Query().Get("q"), r.URL.Query().Get("sort"))
+		}
+		var start, _ = strconv.Atoi(r.URL.Query().Get("start"))
+		var docs = `{"id": "/lccn/sn1/", "lccn": "sn1"}, {"id": "/lccn/sn2/", "lccn": "sn2"}`
+		if start > 0 {
+			docs = `{"id": "/lccn/sn3/", "lccn": "sn3"}`
+		}
+		fmt.Fprintf(w, `{"response": {"numFound": 3, "docs": [%s]}}`, docs)
+	}))
+	defer srv.Close()
+
+	var origSolr = Solr
+	defer func() { Solr = origSolr }()
+	Solr, _ = solr.New(srv.URL)
+
+	var titles, err = solrTitles(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var expected = []solrTitle{
+		{ID: "/lccn/sn1/", LCCN: "sn1"},
+		{ID: "/lccn/sn2/", LCCN: "sn2"},
+		{ID: "/lccn/sn3/", LCCN: "sn3"},
+	}
+	var diff = cmp.Diff(expected, titles)
+	if diff != "" {
+		t.Errorf("Unexpected titles: %s", diff)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/open-oni/oni-agent/internal/batchxml"
+)
+
+// reindexTitlesCommand is the ONI management command used to refresh the
+// Solr documents for specific titles
+const reindexTitlesCommand = "index_titles"
+
+// batchLCCNs returns the distinct LCCNs referenced by a batch's issues, sorted
+func batchLCCNs(b *batchxml.Batch) []string {
+	var seen = make(map[string]bool)
+	var list []string
+	for _, i := range b.Issues {
+		if !seen[i.LCCN] {
+			seen[i.LCCN] = true
+			list = append(list, i.LCCN)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// newLCCNs returns the LCCNs from the list which don't have any issues in ONI
+// yet, i.e., titles a batch load will be adding content to for the first time
+func newLCCNs(lccns []string) ([]string, error) {
+	if len(lccns) == 0 {
+		return nil, nil
+	}
+
+	var args []any
+	for _, lccn := range lccns {
+		args = append(args, lccn)
+	}
+	var rows, err = dbPool.Query(ONIDB.TitlesWithIssuesQuery(len(lccns)), args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying database: %w", err)
+	}
+	defer rows.Close()
+
+	var existing = make(map[string]bool)
+	for rows.Next() {
+		var lccn string
+		err = rows.Scan(&lccn)
+		if err != nil {
+			return nil, fmt.Errorf("reading titles from database: %w", err)
+		}
+		existing[lccn] = true
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("reading titles from database: %w", err)
+	}
+
+	var list []string
+	for _, lccn := range lccns {
+		if !existing[lccn] {
+			list = append(list, lccn)
+		}
+	}
+	return list, nil
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/open-oni/oni-agent/internal/batchxml"
+)
+
+func TestBatchLCCNs(t *testing.T) {
+	var b = &batchxml.Batch{Issues: []*batchxml.Issue{
+		{LCCN: "sn96088442"}, {LCCN: "sn83025138"}, {LCCN: "sn96088442"},
+	}}
+	var diff = cmp.Diff([]string{"sn83025138", "sn96088442"}, batchLCCNs(b))
+	if diff != "" {
+		t.Errorf("Unexpected LCCNs: %s", diff)
+	}
+}
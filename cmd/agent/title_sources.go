@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maxTitleSourceBytes is the most MARC XML load-title will read from a file or
+// URL. Even a very full title set is a few megabytes.
+const maxTitleSourceBytes = 64 << 20
+
+// titleFetchTimeout is how long fetching MARC XML from a URL may take
+var titleFetchTimeout = time.Minute
+
+// TitleSourceDirs are the only directories (symlinks resolved) load-title
+// --from-file may read from. If it's empty, --from-file is disabled.
+var TitleSourceDirs []string
+
+// TitleURLHosts are the only hosts load-title --from-url may fetch from. If
+// it's empty, --from-url is disabled.
+var TitleURLHosts = map[string]bool{}
+
+// titleHTTPClient fetches --from-url MARC. Every redirect is held to the same
+// rules as the URL the client gave, and the timeout covers reading the body,
+// not just getting a response.
+var titleHTTPClient = &http.Client{Timeout: titleFetchTimeout, CheckRedirect: checkTitleRedirect}
+
+// parseTitleSourceDirs reads TITLE_SOURCE_DIRS, resolving each directory so
+// later containment checks compare real paths
+func parseTitleSourceDirs(val string) ([]string, error) {
+	var dirs []string
+	for _, dir := range splitList(val) {
+		var real, err = filepath.EvalSymlinks(dir)
+		if err == nil {
+			real, err = filepath.Abs(real)
+		}
+		var info os.FileInfo
+		if err == nil {
+			info, err = os.Stat(real)
+		}
+		if err == nil && !info.IsDir() {
+			err = errors.New("not a directory")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", dir, err)
+		}
+		dirs = append(dirs, real)
+	}
+	return dirs, nil
+}
+
+// loadTitleArgs are load-title's options. At most one of fromFile and fromURL
+// is set; if neither is, the MARC comes from the request's payload.
+type loadTitleArgs struct {
+	force    bool
+	fromFile string
+	fromURL  string
+}
+
+func parseLoadTitleArgs(args []string) (loadTitleArgs, error) {
+	var a loadTitleArgs
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--force":
+			a.force = true
+		case "--from-file", "--from-url":
+			if i+1 >= len(args) {
+				return a, fmt.Errorf("%s requires a value", args[i])
+			}
+			if a.fromFile != "" || a.fromURL != "" {
+				return a, errors.New("only one of --from-file and --from-url may be given")
+			}
+			i++
+			if args[i-1] == "--from-file" {
+				a.fromFile = args[i]
+			} else {
+				a.fromURL = args[i]
+			}
+		default:
+			return a, fmt.Errorf("%q is not a valid option", args[i])
+		}
+	}
+	return a, nil
+}
+
+// readTitleFile reads MARC XML from a file, which must be inside one of
+// TitleSourceDirs once symlinks are resolved
+func readTitleFile(fname string) ([]byte, error) {
+	if len(TitleSourceDirs) == 0 {
+		return nil, errors.New("--from-file is disabled (TITLE_SOURCE_DIRS is not set)")
+	}
+	var real, err = filepath.EvalSymlinks(fname)
+	if err == nil {
+		real, err = filepath.Abs(real)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var allowed bool
+	for _, dir := range TitleSourceDirs {
+		var rel, err = filepath.Rel(dir, real)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return nil, fmt.Errorf("%q is not in any of TITLE_SOURCE_DIRS", fname)
+	}
+
+	var f *os.File
+	f, err = os.Open(real)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readTitleSource(f)
+}
+
+// checkTitleURL returns an error unless u is an https URL on TitleURLHosts
+func checkTitleURL(u *url.URL) error {
+	if u.Scheme != "https" {
+		return fmt.Errorf("%q is not an https URL", u.Redacted())
+	}
+	if !TitleURLHosts[strings.ToLower(u.Hostname())] {
+		return fmt.Errorf("%q is not in TITLE_URL_HOSTS", u.Hostname())
+	}
+	return nil
+}
+
+// checkTitleRedirect is titleHTTPClient's CheckRedirect: a redirect is only
+// followed if its target would have been allowed as the original URL
+func checkTitleRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	var err = checkTitleURL(req.URL)
+	if err != nil {
+		return fmt.Errorf("refusing redirect: %w", err)
+	}
+	return nil
+}
+
+// fetchTitleURL downloads MARC XML. Only https URLs on TitleURLHosts are
+// allowed, so the agent can't be used to probe arbitrary hosts.
+func fetchTitleURL(ctx context.Context, rawURL string) ([]byte, error) {
+	if len(TitleURLHosts) == 0 {
+		return nil, errors.New("--from-url is disabled (TITLE_URL_HOSTS is not set)")
+	}
+	var u, err = url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %w", err)
+	}
+	err = checkTitleURL(u)
+	if err != nil {
+		return nil, err
+	}
+
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithTimeout(ctx, titleFetchTimeout)
+	defer cancel()
+	var req *http.Request
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	var resp *http.Response
+	resp, err = titleHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", u.Redacted(), resp.Status)
+	}
+	return readTitleSource(resp.Body)
+}
+
+// readTitleSource reads all of r, refusing anything over maxTitleSourceBytes
+func readTitleSource(r io.Reader) ([]byte, error) {
+	var data, err = io.ReadAll(io.LimitReader(r, maxTitleSourceBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxTitleSourceBytes {
+		return nil, fmt.Errorf("MARC XML is larger than %d bytes", maxTitleSourceBytes)
+	}
+	return data, nil
+}
+
+// titleSource returns the function load-title reads its MARC XML with
+func titleSource(r *request, a loadTitleArgs) func() ([]byte, error) {
+	switch {
+	case a.fromFile != "":
+		return func() ([]byte, error) { return readTitleFile(a.fromFile) }
+	case a.fromURL != "":
+		return func() ([]byte, error) { return fetchTitleURL(r.ctx, a.fromURL) }
+	}
+	return r.payload
+}
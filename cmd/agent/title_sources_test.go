@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseLoadTitleArgs(t *testing.T) {
+	var tests = map[string]struct {
+		args        []string
+		expected    loadTitleArgs
+		expectError bool
+	}{
+		"none":       {},
+		"force":      {args: []string{"--force"}, expected: loadTitleArgs{force: true}},
+		"file":       {args: []string{"--from-file", "/data/marc.xml", "--force"}, expected: loadTitleArgs{force: true, fromFile: "/data/marc.xml"}},
+		"url":        {args: []string{"--from-url", "https://example.org/marc.xml"}, expected: loadTitleArgs{fromURL: "https://example.org/marc.xml"}},
+		"both":       {args: []string{"--from-file", "a", "--from-url", "b"}, expectError: true},
+		"no value":   {args: []string{"--from-file"}, expectError: true},
+		"bad option": {args: []string{"--from-stdin"}, expectError: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got, err = parseLoadTitleArgs(tc.args)
+			if tc.expectError {
+				if err == nil {
+					t.Fatalf("Expected an error, got %#v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if got != tc.expected {
+				t.Fatalf("Expected %#v, got %#v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestReadTitleFile(t *testing.T) {
+	var origDirs = TitleSourceDirs
+	defer func() { TitleSourceDirs = origDirs }()
+
+	var root = t.TempDir()
+	var allowed, other = filepath.Join(root, "marc"), filepath.Join(root, "other")
+	for _, dir := range []string{allowed, other} {
+		var err = os.Mkdir(dir, 0755)
+		if err == nil {
+			err = os.WriteFile(filepath.Join(dir, "title.xml"), []byte("<record/>"), 0644)
+		}
+		if err != nil {
+			t.Fatalf("Unable to set up test dirs: %s", err)
+		}
+	}
+	var escape = filepath.Join(allowed, "escape.xml")
+	var err = os.Symlink(filepath.Join(other, "title.xml"), escape)
+	if err != nil {
+		t.Fatalf("Unable to create symlink: %s", err)
+	}
+
+	TitleSourceDirs = nil
+	_, err = readTitleFile(filepath.Join(allowed, "title.xml"))
+	if err == nil {
+		t.Fatal("Expected --from-file to be disabled without TITLE_SOURCE_DIRS")
+	}
+
+	TitleSourceDirs, err = parseTitleSourceDirs(allowed)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var data []byte
+	data, err = readTitleFile(filepath.Join(allowed, "title.xml"))
+	if err != nil || string(data) != "<record/>" {
+		t.Fatalf("Expected the allowed file's contents, got %q, %v", data, err)
+	}
+	for _, fname := range []string{filepath.Join(other, "title.xml"), filepath.Join(allowed, "..", "other", "title.xml"), escape} {
+		_, err = readTitleFile(fname)
+		if err == nil {
+			t.Errorf("Expected %q to be refused", fname)
+		}
+	}
+
+	_, err = parseTitleSourceDirs(filepath.Join(allowed, "title.xml"))
+	if err == nil {
+		t.Fatal("Expected a file to be rejected as a source dir")
+	}
+}
+
+func TestFetchTitleURL(t *testing.T) {
+	var origHosts, origClient = TitleURLHosts, titleHTTPClient
+	defer func() { TitleURLHosts, titleHTTPClient = origHosts, origClient }()
+
+	var srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/marc.xml":
+			w.Write([]byte("<record/>"))
+		case "/moved.xml":
+			http.Redirect(w, req, "/marc.xml", http.StatusFound)
+		case "/elsewhere.xml":
+			http.Redirect(w, req, "https://example.org/marc.xml", http.StatusFound)
+		case "/downgrade.xml":
+			http.Redirect(w, req, "http://"+req.Host+"/marc.xml", http.StatusFound)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer srv.Close()
+	var client = *titleHTTPClient
+	client.Transport = srv.Client().Transport
+	titleHTTPClient = &client
+	var u, _ = url.Parse(srv.URL)
+
+	TitleURLHosts = map[string]bool{}
+	var _, err = fetchTitleURL(context.Background(), srv.URL+"/marc.xml")
+	if err == nil {
+		t.Fatal("Expected --from-url to be disabled without TITLE_URL_HOSTS")
+	}
+
+	TitleURLHosts = map[string]bool{u.Hostname(): true}
+	var data []byte
+	for _, path := range []string{"/marc.xml", "/moved.xml"} {
+		data, err = fetchTitleURL(context.Background(), srv.URL+path)
+		if err != nil || string(data) != "<record/>" {
+			t.Fatalf("Expected %s to serve the MARC, got %q, %v", path, data, err)
+		}
+	}
+
+	for _, path := range []string{"/elsewhere.xml", "/downgrade.xml"} {
+		_, err = fetchTitleURL(context.Background(), srv.URL+path)
+		if err == nil || !strings.Contains(err.Error(), "refusing redirect") {
+			t.Errorf("Expected %s's redirect to be refused, got %v", path, err)
+		}
+	}
+
+	for _, bad := range []string{srv.URL + "/missing.xml", "http://" + u.Host + "/marc.xml", "https://example.org/marc.xml"} {
+		_, err = fetchTitleURL(context.Background(), bad)
+		if err == nil {
+			t.Errorf("Expected %q to fail", bad)
+		}
+	}
+}
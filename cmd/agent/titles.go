@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/xml"
+	"log/slog"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+	"github.com/uoregon-libraries/gopkg/xmlnode"
+)
+
+func loadTitle(r *request, a loadTitleArgs) response {
+	var err = checkONICommand("load_titles")
+	if err != nil {
+		return respond(StatusError, "Unable to load title", H{"error": err.Error()})
+	}
+
+	var marcData []byte
+	marcData, err = titleSource(r, a)()
+	if err != nil && a.fromFile == "" && a.fromURL == "" {
+		slog.Error("Unable to read from client", "error", err)
+		return respond(StatusError, "Read error, connection terminating", payloadErrorData(err))
+	}
+	if err != nil {
+		r.logError("Unable to read MARC XML", "file", a.fromFile, "url", a.fromURL, "error", err)
+		return respond(StatusError, "Unable to read MARC XML", H{"error": err.Error()})
+	}
+
+	// Parse the data to ensure it's valid
+	var node = &xmlnode.Node{}
+	err = xml.Unmarshal(marcData, node)
+	if err != nil {
+		slog.Error("Invalid XML", "error", err)
+		return respond(StatusError, "Invalid data", H{"error": err.Error()})
+	}
+
+	// Make sure we aren't about to silently clobber existing title metadata
+	var titles []marcTitle
+	titles, err = parseMARCTitles(marcData)
+	if err != nil {
+		slog.Error("Invalid MARC", "error", err)
+		return respond(StatusError, "Invalid data", H{"error": err.Error()})
+	}
+	var conflicts []*titleConflict
+	conflicts, err = checkTitleConflicts(titles)
+	if err != nil {
+		return respond(StatusError, "Unable to check existing titles", H{"error": err.Error()})
+	}
+	if len(conflicts) > 0 {
+		if !a.force {
+			return respond(StatusError, "Incoming MARC conflicts with existing title metadata; use --force to overwrite", H{"conflicts": conflicts})
+		}
+		slog.Warn("Overwriting conflicting title metadata", "conflicts", conflicts)
+	}
+
+	// Create a self-deleting temp dir
+	var dir string
+	dir, err = makeWorkDir("*-oni-marc")
+	if err != nil {
+		slog.Error("Unable to create temp dir", "error", err)
+		return respond(StatusError, "Internal error, unable to ingest MARC", H{"error": err.Error()})
+	}
+	defer agentFS.Remove(dir)
+
+	// Write the MARC record out and tell ONI to ingest it
+	var fpath = filepath.Join(dir, "marc.xml")
+	err = afero.WriteFile(agentFS, fpath, marcData, 0600)
+	if err != nil {
+		slog.Error("Unable to write MARC XML", "path", fpath, "error", err)
+		return respond(StatusError, "Internal error, unable to ingest MARC", H{"error": err.Error()})
+	}
+
+	// The LCCNs go on the job so it can be matched up with the titles it
+	// loaded without anybody reading its logs
+	var lccns = titleLCCNs(titles)
+	var j = JobRunner.NewJob("Load title from MARC XML", []string{"load_titles", dir})
+	j.SetLabel("lccn", lccns...)
+	var watching = watchTitleProgress(j, lccns)
+	err = j.Run(JobRunner.Context())
+	<-watching
+	if err != nil {
+		slog.Error("Error ingesting MARC XML", "path", fpath, "lccns", lccns, "error", err)
+		return respond(StatusError, "Internal error, unable to ingest MARC", H{"error": err.Error(), "job": H{"id": j.ID()}, "lccns": lccns})
+	}
+
+	// We only remove the file if there were no load errors. This leaves a mess
+	// but also allows debugging.
+	agentFS.Remove(fpath)
+
+	slog.Info("Received data", "marc", string(marcData))
+	return respond(StatusSuccess, "MARC XML Received", H{"job": H{"id": j.ID()}, "lccns": lccns})
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenStateFile is the state file holding every issued token
+const tokenStateFile = "tokens.json"
+
+// Default and maximum lifetimes for tokens
+const (
+	defaultTokenTTL = time.Hour * 24
+	maxTokenTTL     = time.Hour * 24 * 30
+)
+
+// delegableCommands are the only commands a token may be issued for
+var delegableCommands = map[string]bool{
+	"load-batch":  true,
+	"purge-batch": true,
+	"load-issue":  true,
+}
+
+// tokenRecord is everything we know about an issued token. The token itself
+// is never stored, just its hash, so the state file can't be used to redeem
+// anything.
+type tokenRecord struct {
+	ID       string    `json:"id"`
+	Command  string    `json:"command"`
+	Args     []string  `json:"args"`
+	IssuedBy string    `json:"issued_by"`
+	Issued   time.Time `json:"issued"`
+	Expires  time.Time `json:"expires"`
+
+	// Audit trail: every redemption attempt is counted, and the successful
+	// one is recorded in full
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+	UsedBy    string    `json:"used_by,omitempty"`
+	Used      time.Time `json:"used,omitempty"`
+	JobID     int64     `json:"job_id,omitempty"`
+}
+
+// tokenMu serializes all token reads and writes, including the whole of a
+// redemption, so a token can't be redeemed twice by racing requests
+var tokenMu sync.Mutex
+
+func hashToken(token string) string {
+	var sum = sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// readTokens returns all issued tokens keyed by their hash
+func readTokens() (map[string]*tokenRecord, error) {
+	var tokens = make(map[string]*tokenRecord)
+	var _, err = State.Read(tokenStateFile, &tokens)
+	return tokens, err
+}
+
+// parseIssueTokenArgs splits issue-token's args into the delegated command,
+// its args, and the token lifetime
+func parseIssueTokenArgs(args []string) (cmd string, cmdArgs []string, ttl time.Duration, err error) {
+	ttl = defaultTokenTTL
+	var n = len(args)
+	if n >= 2 && args[n-2] == "--ttl" {
+		ttl, err = time.ParseDuration(args[n-1])
+		if err != nil || ttl <= 0 || ttl > maxTokenTTL {
+			return "", nil, 0, fmt.Errorf("--ttl must be a duration, e.g., 24h, no longer than %s", maxTokenTTL)
+		}
+		args = args[:n-2]
+	}
+	if len(args) == 0 {
+		return "", nil, 0, fmt.Errorf("a command to delegate is required")
+	}
+	if !delegableCommands[args[0]] {
+		return "", nil, 0, fmt.Errorf("%q cannot be delegated; tokens may only be issued for %s", args[0], strings.Join(sortedKeys(delegableCommands), ", "))
+	}
+	return args[0], args[1:], ttl, nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func issueToken(r *request) response {
+	if State == nil {
+		return respond(StatusError, "Tokens require STATE_DIR to be configured", nil)
+	}
+
+	var cmd, args, ttl, err = parseIssueTokenArgs(r.args)
+	if err == nil {
+		err = r.mayDelegate(cmd)
+	}
+	if err != nil {
+		return respond(StatusError, "Unable to issue token", H{"error": err.Error()})
+	}
+
+	var raw = make([]byte, 32)
+	_, err = rand.Read(raw)
+	if err != nil {
+		return respond(StatusError, "Unable to issue token", H{"error": err.Error()})
+	}
+	var token = hex.EncodeToString(raw)
+	var now = time.Now()
+	var rec = &tokenRecord{
+		ID:       hashToken(token)[:12],
+		Command:  cmd,
+		Args:     args,
+		IssuedBy: r.user,
+		Issued:   now,
+		Expires:  now.Add(ttl),
+	}
+
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+	var tokens map[string]*tokenRecord
+	tokens, err = readTokens()
+	if err == nil {
+		tokens[hashToken(token)] = rec
+		err = State.Write(tokenStateFile, tokens)
+	}
+	if err != nil {
+		r.logError("Unable to store token", "error", err)
+		return respond(StatusError, "Unable to issue token", H{"error": err.Error()})
+	}
+
+	r.logInfo("Token issued", "tokenID", rec.ID, "command", cmd, "args", args, "expires", rec.Expires, "issuedBy", r.user)
+	return respond(StatusSuccess, "Token issued: it can be redeemed once with redeem-token", H{"token": token, "details": rec})
+}
+
+// mayDelegate returns an error unless the request's user and key could run
+// cmd themselves: a token can't grant more than its issuer has
+func (r *request) mayDelegate(cmd string) error {
+	if _, ok := commands[cmd]; !ok {
+		return fmt.Errorf("%q is not available on this agent", cmd)
+	}
+	var probe = &request{command: cmd, user: r.user}
+	if !probe.allowed() || (r.keyCommands != nil && !r.keyCommands[cmd]) {
+		r.logInfo("Token refused for a command the issuer may not run", "command", cmd)
+		return fmt.Errorf("%q is not permitted for this user or key", cmd)
+	}
+	return nil
+}
+
+// redeemToken runs the token's delegated command, exactly once. A command
+// which returns an error doesn't use up the token, so a partner can retry
+// once the problem (say, a batch that isn't fully copied yet) is fixed.
+func redeemToken(r *request, token string) response {
+	if State == nil {
+		return respond(StatusError, "Tokens require STATE_DIR to be configured", nil)
+	}
+
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+
+	var tokens, err = readTokens()
+	if err != nil {
+		r.logError("Unable to read tokens", "error", err)
+		return respond(StatusError, "Unable to read tokens", H{"error": err.Error()})
+	}
+	var rec = tokens[hashToken(token)]
+	if rec == nil {
+		r.logInfo("Invalid token redemption attempted", "user", r.user)
+		return respond(StatusError, "Invalid token", nil)
+	}
+
+	var logger = func(msg string, args ...any) {
+		r.logInfo(msg, append([]any{"tokenID", rec.ID, "user", r.user}, args...)...)
+	}
+	switch {
+	case !rec.Used.IsZero():
+		logger("Used token redemption attempted")
+		return respond(StatusError, "Token has already been used", H{"details": rec})
+	case time.Now().After(rec.Expires):
+		logger("Expired token redemption attempted")
+		return respond(StatusError, "Token has expired", H{"details": rec})
+	}
+
+	// The command goes through the middleware like any other, though the
+	// token stands in for the user's permission (but not for where the
+	// command may be run from), and redeem-token already paid its rate limit
+	var h, ok = commands[rec.Command]
+	if !ok {
+		logger("Token redemption attempted for an unavailable command", "command", rec.Command)
+		return respond(StatusError, fmt.Sprintf("%q is not available on this agent", rec.Command), H{"details": rec})
+	}
+	var sub = &request{
+		id:          r.id,
+		ctx:         r.ctx,
+		command:     rec.Command,
+		args:        rec.Args,
+		user:        r.user,
+		source:      r.source,
+		client:      r.client,
+		keyCommands: r.keyCommands,
+		payload:     r.payload,
+		nested:      true,
+		token:       rec.ID,
+	}
+	var resp = chain(h)(sub)
+
+	rec.Attempts++
+	if resp.status == StatusSuccess {
+		rec.Used = time.Now()
+		rec.UsedBy = r.user
+		rec.LastError = ""
+		if job, ok := resp.data["job"].(H); ok {
+			rec.JobID, _ = job["id"].(int64)
+		}
+		logger("Token redeemed", "command", rec.Command, "args", rec.Args, "jobID", rec.JobID)
+	} else {
+		rec.LastError = resp.message
+		logger("Token redemption failed", "command", rec.Command, "args", rec.Args, "error", resp.message)
+	}
+
+	err = State.Write(tokenStateFile, tokens)
+	if err != nil {
+		r.logError("Unable to record token use", "tokenID", rec.ID, "error", err)
+		if resp.data == nil {
+			resp.data = H{}
+		}
+		resp.data["warning"] = "unable to record token use: " + err.Error()
+	}
+	return resp
+}
+
+func listTokens() response {
+	if State == nil {
+		return respond(StatusError, "Tokens require STATE_DIR to be configured", nil)
+	}
+
+	tokenMu.Lock()
+	var tokens, err = readTokens()
+	tokenMu.Unlock()
+	if err != nil {
+		return respond(StatusError, "Unable to read tokens", H{"error": err.Error()})
+	}
+
+	var list = []*tokenRecord{}
+	for _, rec := range tokens {
+		list = append(list, rec)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Issued.Before(list[j].Issued) })
+	return respond(StatusSuccess, "", H{"tokens": list})
+}
+
+// RestrictedUsers may only redeem tokens and check on the jobs they start;
+// every other command is refused
+var RestrictedUsers = map[string]bool{}
+
+// restrictedCommands are the commands RestrictedUsers may run
+var restrictedCommands = map[string]bool{
+	"redeem-token": true,
+	"job-status":   true,
+	"version":      true,
+}
+
+// allowed returns false if the request's user is restricted and the command
+// isn't one they may run, or if the command needs the admin capability and
+// the user doesn't have it
+func (r *request) allowed() bool {
+	if adminCommands[r.command] && !AdminUsers[r.user] {
+		return false
+	}
+	return !RestrictedUsers[r.user] || restrictedCommands[r.command]
+}
+
+func init() {
+	register("issue-token", func(r *request) response {
+		if len(r.args) == 0 {
+			return respond(StatusError, fmt.Sprintf("%q requires a command and its arguments, optionally followed by --ttl <duration>", r.command), nil)
+		}
+		return issueToken(r)
+	})
+
+	register("redeem-token", func(r *request) response {
+		if len(r.args) != 1 {
+			return respond(StatusError, "You must supply a token", nil)
+		}
+		return redeemToken(r, r.args[0])
+	})
+
+	register("list-tokens", func(_ *request) response {
+		return listTokens()
+	})
+}
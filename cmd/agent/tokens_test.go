@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/open-oni/oni-agent/internal/state"
+)
+
+func TestTokens(t *testing.T) {
+	var err error
+	State, err = state.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Unable to open state dir: %s", err)
+	}
+	defer func() { State = nil }()
+
+	// A fake delegable command which fails until told otherwise
+	var ok bool
+	var calls []string
+	commands["test-delegate"] = func(r *request) response {
+		calls = append(calls, r.args[0])
+		if !ok {
+			return respond(StatusError, "not ready", nil)
+		}
+		return respond(StatusSuccess, "done", H{"job": H{"id": int64(42)}})
+	}
+	delegableCommands["test-delegate"] = true
+	defer func() {
+		delete(commands, "test-delegate")
+		delete(delegableCommands, "test-delegate")
+	}()
+
+	var issuer = &request{ctx: context.Background(), command: "issue-token", user: "admin"}
+	issuer.args = []string{"version"}
+	if resp := issueToken(issuer); resp.status != StatusError {
+		t.Fatalf("Expected non-delegable command to be refused, got %#v", resp)
+	}
+	issuer.args = []string{"test-delegate", "batch_foo_ver01", "--ttl", "1000h"}
+	if resp := issueToken(issuer); resp.status != StatusError {
+		t.Fatalf("Expected overlong TTL to be refused, got %#v", resp)
+	}
+
+	issuer.args = []string{"test-delegate", "batch_foo_ver01", "--ttl", "1h"}
+	var resp = issueToken(issuer)
+	if resp.status != StatusSuccess {
+		t.Fatalf("Unable to issue token: %#v", resp)
+	}
+	var token = resp.data["token"].(string)
+
+	var r = &request{ctx: context.Background(), command: "redeem-token", user: "partner"}
+	if resp = redeemToken(r, "bogus"); resp.status != StatusError {
+		t.Fatalf("Expected bogus token to be refused, got %#v", resp)
+	}
+
+	// A failed command doesn't use up the token
+	if resp = redeemToken(r, token); resp.status != StatusError {
+		t.Fatalf("Expected failure from delegated command, got %#v", resp)
+	}
+	ok = true
+	if resp = redeemToken(r, token); resp.status != StatusSuccess {
+		t.Fatalf("Expected token to be redeemed, got %#v", resp)
+	}
+	if resp = redeemToken(r, token); resp.status != StatusError || resp.message != "Token has already been used" {
+		t.Fatalf("Expected used token to be refused, got %#v", resp)
+	}
+	if len(calls) != 2 || calls[0] != "batch_foo_ver01" {
+		t.Fatalf("Expected two calls with the token's args, got %q", calls)
+	}
+
+	resp = listTokens()
+	var list = resp.data["tokens"].([]*tokenRecord)
+	if len(list) != 1 {
+		t.Fatalf("Expected one token, got %d", len(list))
+	}
+	var rec = list[0]
+	if rec.Attempts != 2 || rec.UsedBy != "partner" || rec.IssuedBy != "admin" || rec.JobID != 42 || rec.Used.IsZero() {
+		t.Fatalf("Unexpected audit record %#v", rec)
+	}
+}
+
+func TestRestrictedUsers(t *testing.T) {
+	RestrictedUsers["partner"] = true
+	AdminUsers["admin"] = true
+	defer delete(RestrictedUsers, "partner")
+	defer delete(AdminUsers, "admin")
+
+	var tests = map[string]struct {
+		user    string
+		command string
+		allowed bool
+	}{
+		"restricted redeem":    {user: "partner", command: "redeem-token", allowed: true},
+		"restricted status":    {user: "partner", command: "job-status", allowed: true},
+		"restricted load":      {user: "partner", command: "load-batch", allowed: false},
+		"restricted issue":     {user: "partner", command: "issue-token", allowed: false},
+		"unrestricted load":    {user: "admin", command: "load-batch", allowed: true},
+		"unrestricted issue":   {user: "admin", command: "issue-token", allowed: true},
+		"non-admin issue":      {user: "operator", command: "issue-token", allowed: false},
+		"admin migrations":     {user: "admin", command: "migrate-status", allowed: true},
+		"non-admin migrations": {user: "operator", command: "migrate-status", allowed: false},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var r = &request{user: tc.user, command: tc.command}
+			if got := r.allowed(); got != tc.allowed {
+				t.Fatalf("Expected allowed to be %v, got %v", tc.allowed, got)
+			}
+		})
+	}
+}
+
+func TestTokenDelegation(t *testing.T) {
+	var err error
+	State, err = state.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Unable to open state dir: %s", err)
+	}
+	defer func() { State = nil }()
+
+	var calls int
+	commands["test-delegate"] = func(*request) response {
+		calls++
+		return respond(StatusSuccess, "done", nil)
+	}
+	delegableCommands["test-delegate"] = true
+	RestrictedUsers["partner"] = true
+	SourceCIDRs[classWrite] = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	defer func() {
+		delete(commands, "test-delegate")
+		delete(delegableCommands, "test-delegate")
+		delete(RestrictedUsers, "partner")
+		delete(SourceCIDRs, classWrite)
+	}()
+
+	// Nobody can issue a token for a command they couldn't run themselves
+	var tokenCommands = map[string]bool{"issue-token": true, "redeem-token": true}
+	var issuer = &request{ctx: context.Background(), command: "issue-token", user: "admin", args: []string{"test-delegate", "x"}}
+	issuer.keyCommands = tokenCommands
+	if resp := issueToken(issuer); resp.status != StatusError {
+		t.Fatalf("Expected a key without the command to be refused a token, got %#v", resp)
+	}
+	issuer.keyCommands = nil
+	issuer.user = "partner"
+	if resp := issueToken(issuer); resp.status != StatusError {
+		t.Fatalf("Expected a restricted user to be refused a token, got %#v", resp)
+	}
+	issuer.user = "admin"
+	var resp = issueToken(issuer)
+	if resp.status != StatusSuccess {
+		t.Fatalf("Unable to issue token: %#v", resp)
+	}
+	var token = resp.data["token"].(string)
+
+	// Redemption runs the command through the middleware: the address is
+	// still checked, and the command is audited, but a restricted user with
+	// a key which may only redeem tokens can run it
+	var logs bytes.Buffer
+	var oldLogger = slog.Default()
+	defer slog.SetDefault(oldLogger)
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	var r = &request{ctx: context.Background(), command: "redeem-token", user: "partner", keyCommands: tokenCommands}
+	r.source = netip.MustParseAddr("192.168.1.1")
+	if resp = redeemToken(r, token); resp.status != StatusError || calls != 0 {
+		t.Fatalf("Expected the token's command to be refused from this address, got %#v", resp)
+	}
+	r.source = netip.MustParseAddr("10.1.2.3")
+	if resp = redeemToken(r, token); resp.status != StatusSuccess || calls != 1 {
+		t.Fatalf("Expected the token to be redeemed, got %#v", resp)
+	}
+	if !strings.Contains(logs.String(), `msg="Command audited"`) || !strings.Contains(logs.String(), "command=test-delegate") {
+		t.Errorf("Expected the token's command to be audited, got %s", logs.String())
+	}
+}
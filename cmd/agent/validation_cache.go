@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/open-oni/oni-agent/internal/batchxml"
+)
+
+// ValidationCacheTTL is how long a batch's successful validation is trusted
+// while its fingerprint is unchanged; zero disables the cache
+var ValidationCacheTTL = time.Hour
+
+// batchValidation is the result of validating a batch
+type batchValidation struct {
+	Path        string         `json:"path"`
+	Issues      int            `json:"issues"`
+	Validated   time.Time      `json:"validated"`
+	Fingerprint string         `json:"fingerprint"`
+	Contents    string         `json:"contents"`
+	Cached      bool           `json:"cached"`
+	Batch       *batchMetadata `json:"batch,omitempty"`
+
+	// OCR is only set when an OCR check was asked for. It's never cached.
+	OCR *ocrCheck `json:"ocr,omitempty"`
+}
+
+// batchMetadata is what batch.xml says about a batch, so NCA can cross-check
+// awardee codes without parsing the XML itself
+type batchMetadata struct {
+	Name      string `json:"name"`
+	Awardee   string `json:"awardee"`
+	AwardYear string `json:"award_year"`
+	Issues    int    `json:"issues"`
+}
+
+func newBatchMetadata(b *batchxml.Batch) *batchMetadata {
+	return &batchMetadata{Name: b.Name, Awardee: b.Awardee, AwardYear: b.AwardYear, Issues: len(b.Issues)}
+}
+
+// validationCache holds successful validations keyed by batch path. Failures
+// aren't cached: a failed batch is usually fixed and retried straight away.
+var validationCache = struct {
+	sync.Mutex
+	m map[string]batchValidation
+}{m: make(map[string]batchValidation)}
+
+// batchFingerprint summarizes what validation depends on: batch.xml's size
+// and modification time, and those of the batch and data directories, which
+// change when issue directories are added, removed, or renamed. Changes deep
+// inside an issue directory aren't seen, which is what --revalidate is for.
+func batchFingerprint(batchPath string) (string, error) {
+	var fp string
+	for _, p := range []string{batchPath, batchxml.DataDir(batchPath), batchxml.XMLPath(batchPath)} {
+		var info, err = agentFS.Stat(p)
+		if err != nil {
+			return "", err
+		}
+		fp += fmt.Sprintf("%d:%d;", info.Size(), info.ModTime().UnixNano())
+	}
+	return fp, nil
+}
+
+// validateBatchCached validates a batch unless it passed validation within
+// ValidationCacheTTL and hasn't changed since. revalidate forces a fresh
+// check.
+func validateBatchCached(batchPath string, revalidate bool) (batchValidation, error) {
+	var key = filepath.Clean(batchPath)
+	var fp, err = batchFingerprint(key)
+	if err != nil {
+		return batchValidation{Path: key}, fmt.Errorf("checking batch: %w", err)
+	}
+
+	validationCache.Lock()
+	var v, ok = validationCache.m[key]
+	validationCache.Unlock()
+	if ok && !revalidate && v.Fingerprint == fp && time.Since(v.Validated) < ValidationCacheTTL {
+		v.Cached = true
+		return v, nil
+	}
+
+	// The contents are read before validating, so anything which changes
+	// while validation runs is caught when the batch is loaded
+	v = batchValidation{Path: key, Fingerprint: fp}
+	v.Contents, err = batchContents(key)
+	if err != nil {
+		return v, fmt.Errorf("checking batch: %w", err)
+	}
+	var b *batchxml.Batch
+	b, err = validateBatchIssues(key)
+	if b != nil {
+		v.Issues, v.Batch = len(b.Issues), newBatchMetadata(b)
+	}
+	v.Validated = time.Now()
+	validationCache.Lock()
+	defer validationCache.Unlock()
+	if err != nil {
+		delete(validationCache.m, key)
+		return v, err
+	}
+	if ValidationCacheTTL > 0 {
+		validationCache.m[key] = v
+	}
+	return v, nil
+}
+
+// validateOptions are validate-batch's flags
+type validateOptions struct {
+	revalidate bool
+
+	// checkOCR turns on the ALTO check; ocrSample is how many files it looks
+	// at, or zero for all of them
+	checkOCR  bool
+	ocrSample int
+}
+
+func parseValidateArgs(args []string) (name string, opts validateOptions, err error) {
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--revalidate":
+			opts.revalidate = true
+		case "--check-ocr":
+			if i+1 >= len(args) {
+				return "", opts, errors.New(`--check-ocr requires "all" or a number of files to sample`)
+			}
+			i++
+			opts.ocrSample, err = parseOCRSample(args[i])
+			if err != nil {
+				return "", opts, err
+			}
+			opts.checkOCR = true
+		default:
+			if name != "" {
+				return "", opts, errors.New("exactly one batch name is required")
+			}
+			name = args[i]
+		}
+	}
+	if name == "" {
+		return "", opts, errors.New("exactly one batch name is required")
+	}
+	return name, opts, nil
+}
+
+func validateBatchCommand(name string, opts validateOptions) response {
+	if !batchNameRegexp.MatchString(name) {
+		return respond(StatusError, fmt.Sprintf("%q is not a valid batch name", name), nil)
+	}
+	var batchPath, err = findBatch(name)
+	if err != nil {
+		return respond(StatusError, fmt.Sprintf("%q cannot be validated", name), H{"error": err.Error()})
+	}
+
+	var v batchValidation
+	v, err = validateBatchCached(batchPath, opts.revalidate)
+	if err != nil {
+		return respond(StatusError, fmt.Sprintf("%q is not valid", name), H{"error": err.Error(), "validation": v})
+	}
+	var msg = "Batch is valid"
+	if v.Cached {
+		msg = "Batch is valid (cached result; use --revalidate to check again)"
+	}
+
+	if opts.checkOCR {
+		v.OCR, err = checkBatchOCR(v.Path, opts.ocrSample)
+		if err != nil {
+			return respond(StatusError, fmt.Sprintf("%q's OCR cannot be checked", name), H{"error": err.Error(), "validation": v})
+		}
+		if len(v.OCR.Problems) > 0 {
+			return respond(StatusError, fmt.Sprintf("%q has %d OCR files which won't index properly", name, len(v.OCR.Problems)), H{"validation": v})
+		}
+	}
+	return respond(StatusSuccess, msg, H{"validation": v})
+}
+
+func init() {
+	register("validate-batch", func(r *request) response {
+		var name, opts, err = parseValidateArgs(r.args)
+		if err != nil {
+			return respond(StatusError, fmt.Sprintf("Invalid arguments for %q: %s", r.command, err), nil)
+		}
+		return validateBatchCommand(name, opts)
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/open-oni/oni-agent/internal/batchxml"
+)
+
+func TestValidateBatchCached(t *testing.T) {
+	var origTTL = ValidationCacheTTL
+	defer func() { ValidationCacheTTL = origTTL }()
+	ValidationCacheTTL = time.Hour
+
+	var dir = filepath.Join(t.TempDir(), "batch_oru_cache_ver01")
+	var b = &batchxml.Batch{Name: "batch_oru_cache_ver01", Awardee: "oru", AwardYear: "2019", Issues: []*batchxml.Issue{
+		{LCCN: "sn83025138", IssueDate: "1902-11-22", EditionOrder: "01", Filepath: "sn83025138/1902112201.xml"},
+	}}
+	var data, err = b.Marshal()
+	if err == nil {
+		err = os.MkdirAll(batchxml.DataDir(dir), 0755)
+	}
+	if err == nil {
+		err = os.WriteFile(batchxml.XMLPath(dir), data, 0644)
+	}
+	var issueFile = filepath.Join(batchxml.DataDir(dir), "sn83025138", "1902112201.xml")
+	if err == nil {
+		err = os.Mkdir(filepath.Dir(issueFile), 0755)
+	}
+	if err == nil {
+		err = os.WriteFile(issueFile, []byte("<mets/>"), 0644)
+	}
+	if err != nil {
+		t.Fatalf("Unable to write test batch: %s", err)
+	}
+
+	var check = func(revalidate, expectCached, expectError bool) {
+		t.Helper()
+		var v, err = validateBatchCached(dir, revalidate)
+		if expectError != (err != nil) {
+			t.Fatalf("Expected error: %v, got %v", expectError, err)
+		}
+		if v.Cached != expectCached {
+			t.Fatalf("Expected cached: %v, got %#v", expectCached, v)
+		}
+	}
+
+	check(false, false, false)
+	check(false, true, false)
+	check(true, false, false)
+
+	// The batch's metadata is reported, including from the cache
+	var v, _ = validateBatchCached(dir, false)
+	var want = batchMetadata{Name: "batch_oru_cache_ver01", Awardee: "oru", AwardYear: "2019", Issues: 1}
+	if v.Batch == nil || *v.Batch != want {
+		t.Fatalf("Expected batch metadata %#v, got %#v", want, v.Batch)
+	}
+
+	// Removing an issue file isn't seen by the fingerprint, but forcing a
+	// fresh check finds it and drops the cached success
+	err = os.Remove(issueFile)
+	if err != nil {
+		t.Fatalf("Unable to remove issue file: %s", err)
+	}
+	check(false, true, false)
+	check(true, false, true)
+	check(false, false, true)
+
+	// Fixing the batch and touching batch.xml changes the fingerprint
+	os.WriteFile(issueFile, []byte("<mets/>"), 0644)
+	check(false, false, false)
+	var later = time.Now().Add(time.Minute)
+	os.Chtimes(batchxml.XMLPath(dir), later, later)
+	check(false, false, false)
+	check(false, true, false)
+
+	ValidationCacheTTL = 0
+	check(false, false, false)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/open-oni/oni-agent/internal/version"
+)
+
+// transports returns the list of enabled client transports
+func transports() []string {
+	var list = []string{"ssh"}
+	if GRPC.bind != "" {
+		list = append(list, "grpc")
+	}
+	return list
+}
+
+// features returns the list of optional agent features which are enabled
+func features() []string {
+	var list = []string{}
+	if JobArchive != nil {
+		list = append(list, "job-archive")
+	}
+	if Redactor != nil {
+		list = append(list, "log-redaction")
+	}
+	if Artifacts != nil {
+		list = append(list, "artifacts")
+	}
+	if State != nil {
+		list = append(list, "persistent-state")
+	}
+	if Solr != nil {
+		list = append(list, "solr-verification")
+	}
+	return list
+}
+
+// getVersion reports the agent version along with enough build and
+// configuration detail to be useful in support tickets. The top-level
+// "version" string is kept for older clients.
+func getVersion() response {
+	return respond(StatusSuccess, "", H{
+		"version":    version.Version,
+		"build":      version.Info(),
+		"role":       AgentRole,
+		"transports": transports(),
+		"features":   features(),
+		"oni_path":   ONILocation,
+		"oni_env":    ONIEnvironment,
+		"commands":   commandNames(),
+	})
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+// WebhookURL, if set, is sent every job's outcome when it finishes
+var WebhookURL string
+
+// WebhookSecret, if set, signs webhook bodies so receivers can tell they came
+// from the agent
+var WebhookSecret string
+
+// CallbackHosts are the only hosts clients may ask to have a job's outcome
+// sent to. When it's empty, clients can't request callbacks at all.
+var CallbackHosts map[string]bool
+
+// WebhookAttempts is how many times delivery is tried before giving up
+var WebhookAttempts = 6
+
+// webhookBackoff is how long to wait after the first failed delivery; each
+// later wait is twice the one before, so the default six attempts span about
+// a minute
+var webhookBackoff = 2 * time.Second
+
+// webhookShutdownGrace is how long deliveries still in progress get to
+// finish once the agent has shut its queue down: long enough for one attempt
+// to time out
+const webhookShutdownGrace = 10 * time.Second
+
+// webhookCtx is what deliveries run under. It's separate from the queue's
+// context so that jobs finished by a shutdown still have their outcome sent;
+// stopWebhooks cancels it.
+var webhookCtx, cancelWebhooks = context.WithCancel(context.Background())
+
+// webhookDeliveries tracks deliveries in progress for stopWebhooks
+var webhookDeliveries sync.WaitGroup
+
+// webhookLogLines is how many of the last stdout and stderr lines are sent
+const webhookLogLines = 20
+
+// webhookSignatureHeader carries the body's HMAC-SHA256 when WebhookSecret
+// is set
+const webhookSignatureHeader = "X-ONI-Agent-Signature"
+
+// webhookClient delivers webhooks and callbacks. Redirects can't take a
+// delivery to a host clients couldn't have named themselves.
+var webhookClient = &http.Client{Timeout: 10 * time.Second, CheckRedirect: checkWebhookRedirect}
+
+// parseWebhookURL checks that rawURL is an absolute http or https URL
+func parseWebhookURL(rawURL string) (*url.URL, error) {
+	var u, err = url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%q is not an http or https URL", rawURL)
+	}
+	return u, nil
+}
+
+// validateCallback checks a client's callback URL against CallbackHosts
+func validateCallback(rawURL string) error {
+	if len(CallbackHosts) == 0 {
+		return errors.New("callbacks are not enabled (JOB_CALLBACK_HOSTS is not set)")
+	}
+	var u, err = parseWebhookURL(rawURL)
+	if err != nil {
+		return err
+	}
+	if !CallbackHosts[strings.ToLower(u.Hostname())] {
+		return fmt.Errorf("callbacks may not be sent to %q", u.Hostname())
+	}
+	return nil
+}
+
+// checkWebhookRedirect is webhookClient's CheckRedirect: a redirect is only
+// followed to the host the delivery was first sent to or one in
+// CallbackHosts, so a receiver can't bounce a job's outcome (and its
+// signature) somewhere else
+func checkWebhookRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	var host = strings.ToLower(req.URL.Hostname())
+	if host != strings.ToLower(via[0].URL.Hostname()) && !CallbackHosts[host] {
+		return fmt.Errorf("refusing redirect to %q, which is not in JOB_CALLBACK_HOSTS", req.URL.Hostname())
+	}
+	return nil
+}
+
+// callbackRegistry holds the callback URLs clients asked for, by job ID,
+// until the job finishes
+type callbackRegistry struct {
+	m    sync.Mutex
+	urls map[int64][]string
+}
+
+var callbacks = &callbackRegistry{urls: make(map[int64][]string)}
+
+func (c *callbackRegistry) add(id int64, rawURL string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.urls[id] = append(c.urls[id], rawURL)
+}
+
+// take removes and returns a job's callback URLs, so each is only sent once
+func (c *callbackRegistry) take(id int64) []string {
+	c.m.Lock()
+	defer c.m.Unlock()
+	var list = c.urls[id]
+	delete(c.urls, id)
+	return list
+}
+
+// watchJob registers a callback for the job. A quick job may already have
+// finished, in which case the callback is sent right away.
+func watchJob(id int64, rawURL string) {
+	var j = JobRunner.GetJob(id)
+	if j == nil {
+		return
+	}
+	callbacks.add(id, rawURL)
+	if isFinished(j) {
+		sendWebhooks(j, callbacks.take(id))
+	}
+}
+
+// isFinished returns true if the job's Done channel has been closed, which
+// happens before its job.finished event is published
+func isFinished(j *queue.Job) bool {
+	select {
+	case <-j.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// callback registers the request's callback URL, if it has one, for the job
+// its command queued. The response is untouched: a command which didn't
+// queue anything has nothing to call back about.
+func callback(next handlerFunc) handlerFunc {
+	return func(r *request) response {
+		var resp = next(r)
+		if r.callback == "" || resp.status != StatusSuccess {
+			return resp
+		}
+		var job, _ = resp.data["job"].(H)
+		var id, _ = job["id"].(int64)
+		if id <= 0 {
+			r.logInfo("Callback ignored: command did not queue a job", "command", r.command)
+			return resp
+		}
+		watchJob(id, r.callback)
+		return resp
+	}
+}
+
+// webhookPayload is the body POSTed when a job finishes
+func webhookPayload(j *queue.Job) H {
+	var job = jobSummary(j)
+	addJobError(job, j)
+	return H{
+		"job":    job,
+		"stdout": lastLines(j.Stdout(), webhookLogLines),
+		"stderr": lastLines(j.Stderr(), webhookLogLines),
+	}
+}
+
+func lastLines(lines []string, n int) []string {
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	if lines == nil {
+		lines = []string{}
+	}
+	return lines
+}
+
+// notifyJobFinished is the webhooks subscriber's handler for finished jobs,
+// and sends the job's outcome to WebhookURL and any callbacks clients asked
+// for
+func notifyJobFinished(j *queue.Job) {
+	var urls = callbacks.take(j.ID())
+	if WebhookURL != "" {
+		urls = append([]string{WebhookURL}, urls...)
+	}
+	sendWebhooks(j, urls)
+}
+
+// sendWebhooks delivers the job's outcome to each URL in the background, so
+// one slow receiver doesn't hold up the rest
+func sendWebhooks(j *queue.Job, urls []string) {
+	if len(urls) == 0 {
+		return
+	}
+	var body, err = json.Marshal(webhookPayload(j))
+	if err != nil {
+		slog.Error("Cannot encode webhook", "job", j.ID(), "error", err)
+		return
+	}
+	for _, u := range urls {
+		webhookDeliveries.Add(1)
+		go func() {
+			defer webhookDeliveries.Done()
+			deliverWebhook(webhookCtx, j.ID(), u, body)
+		}()
+	}
+}
+
+// stopWebhooks gives deliveries still in progress up to grace to finish, then
+// abandons the rest. It's part of shutting down, after the event bus has been
+// closed so every finished job's deliveries have already been started.
+func stopWebhooks(grace time.Duration) {
+	var done = make(chan struct{})
+	go func() {
+		webhookDeliveries.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(grace):
+		cancelWebhooks()
+		<-done
+	}
+}
+
+// deliverWebhook POSTs body to rawURL, retrying with backoff until it's
+// accepted, WebhookAttempts run out, or ctx ends
+func deliverWebhook(ctx context.Context, id int64, rawURL string, body []byte) error {
+	var wait = webhookBackoff
+	var err error
+	for attempt := 1; attempt <= WebhookAttempts; attempt++ {
+		err = postWebhook(ctx, rawURL, body)
+		if err == nil {
+			slog.Info("Webhook delivered", "job", id, "url", rawURL, "attempt", attempt)
+			return nil
+		}
+		if attempt == WebhookAttempts {
+			break
+		}
+		slog.Warn("Webhook delivery failed; will retry", "job", id, "url", rawURL, "attempt", attempt, "retryIn", wait, "error", err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			err = ctx.Err()
+			slog.Error("Webhook abandoned", "job", id, "url", rawURL, "error", err)
+			return err
+		}
+		wait *= 2
+	}
+	slog.Error("Webhook delivery failed; giving up", "job", id, "url", rawURL, "attempts", WebhookAttempts, "error", err)
+	return err
+}
+
+// postWebhook makes a single delivery attempt. Any 2xx response counts as
+// delivered.
+func postWebhook(ctx context.Context, rawURL string, body []byte) error {
+	var req, err = http.NewRequestWithContext(ctx, http.MethodPost, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if WebhookSecret != "" {
+		req.Header.Set(webhookSignatureHeader, signWebhook(body, WebhookSecret))
+	}
+
+	var resp *http.Response
+	resp, err = webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response %q", resp.Status)
+	}
+	return nil
+}
+
+// signWebhook returns the signature header value for body
+func signWebhook(body []byte, secret string) string {
+	var mac = hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
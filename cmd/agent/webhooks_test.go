@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+func TestValidateCallback(t *testing.T) {
+	var oldHosts = CallbackHosts
+	defer func() { CallbackHosts = oldHosts }()
+
+	CallbackHosts = nil
+	if validateCallback("https://nca.example.org/hook") == nil {
+		t.Fatalf("Expected callbacks to be refused when no hosts are allowed")
+	}
+
+	CallbackHosts = map[string]bool{"nca.example.org": true}
+	var tests = map[string]struct {
+		url   string
+		valid bool
+	}{
+		"allowed":        {url: "https://nca.example.org/hook", valid: true},
+		"host case":      {url: "http://NCA.example.org:8080/hook", valid: true},
+		"other host":     {url: "https://evil.example.org/hook", valid: false},
+		"not http":       {url: "ftp://nca.example.org/hook", valid: false},
+		"relative":       {url: "/hook", valid: false},
+		"userinfo trick": {url: "https://nca.example.org@evil.example.org/", valid: false},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var err = validateCallback(tc.url)
+			if tc.valid && err != nil {
+				t.Errorf("Expected %q to be allowed, got %s", tc.url, err)
+			}
+			if !tc.valid && err == nil {
+				t.Errorf("Expected %q to be refused", tc.url)
+			}
+		})
+	}
+}
+
+// webhookReceiver records what it's sent, failing the first few deliveries
+type webhookReceiver struct {
+	m         sync.Mutex
+	failFirst int
+	attempts  int
+	bodies    chan []byte
+	signature string
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	wr.m.Lock()
+	defer wr.m.Unlock()
+	wr.attempts++
+	if wr.attempts <= wr.failFirst {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var body, _ = io.ReadAll(req.Body)
+	wr.signature = req.Header.Get(webhookSignatureHeader)
+	wr.bodies <- body
+}
+
+func (wr *webhookReceiver) count() int {
+	wr.m.Lock()
+	defer wr.m.Unlock()
+	return wr.attempts
+}
+
+func TestDeliverWebhookRetries(t *testing.T) {
+	var oldBackoff, oldSecret = webhookBackoff, WebhookSecret
+	defer func() { webhookBackoff, WebhookSecret = oldBackoff, oldSecret }()
+	webhookBackoff = time.Millisecond
+	WebhookSecret = "s3kr1t"
+
+	var wr = &webhookReceiver{failFirst: 2, bodies: make(chan []byte, 1)}
+	var srv = httptest.NewServer(wr)
+	defer srv.Close()
+
+	var body = []byte(`{"job":{"id":1}}`)
+	var err = deliverWebhook(context.Background(), 1, srv.URL, body)
+	if err != nil {
+		t.Fatalf("Expected delivery to succeed after retries, got %s", err)
+	}
+	if wr.count() != 3 {
+		t.Errorf("Expected 3 attempts, got %d", wr.count())
+	}
+	wr.m.Lock()
+	defer wr.m.Unlock()
+	if wr.signature != signWebhook(body, "s3kr1t") {
+		t.Errorf("Expected body to be signed, got signature %q", wr.signature)
+	}
+}
+
+func TestDeliverWebhookGivesUp(t *testing.T) {
+	var oldBackoff = webhookBackoff
+	defer func() { webhookBackoff = oldBackoff }()
+	webhookBackoff = time.Millisecond
+
+	var wr = &webhookReceiver{failFirst: 100, bodies: make(chan []byte, 1)}
+	var srv = httptest.NewServer(wr)
+	defer srv.Close()
+	var err = deliverWebhook(context.Background(), 1, srv.URL, []byte("{}"))
+	if err == nil {
+		t.Fatalf("Expected delivery to fail")
+	}
+	if wr.count() != WebhookAttempts {
+		t.Errorf("Expected %d attempts, got %d", WebhookAttempts, wr.count())
+	}
+}
+
+func TestStopWebhooks(t *testing.T) {
+	var oldCtx, oldCancel, oldBackoff = webhookCtx, cancelWebhooks, webhookBackoff
+	defer func() { webhookCtx, cancelWebhooks, webhookBackoff = oldCtx, oldCancel, oldBackoff }()
+	webhookCtx, cancelWebhooks = context.WithCancel(context.Background())
+	webhookBackoff = 10 * time.Second
+
+	// One delivery is accepted right away; the other keeps failing and would
+	// back off for most of a minute
+	var ok = &webhookReceiver{bodies: make(chan []byte, 1)}
+	var okSrv = httptest.NewServer(ok)
+	defer okSrv.Close()
+	var failing = &webhookReceiver{failFirst: 100, bodies: make(chan []byte, 1)}
+	var failSrv = httptest.NewServer(failing)
+	defer failSrv.Close()
+
+	var j = queue.New(queue.CommandRunner{Path: "/bin/false"}).NewJob("load", []string{"load_batch", "x"})
+	sendWebhooks(j, []string{okSrv.URL, failSrv.URL})
+
+	var start = time.Now()
+	stopWebhooks(500 * time.Millisecond)
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("Expected the failing delivery to be abandoned after the grace period")
+	}
+	if ok.count() != 1 || failing.count() != 1 {
+		t.Errorf("Expected one attempt at each receiver, got %d and %d", ok.count(), failing.count())
+	}
+}
+
+func TestPostWebhookRedirects(t *testing.T) {
+	var oldHosts = CallbackHosts
+	defer func() { CallbackHosts = oldHosts }()
+
+	var wr = &webhookReceiver{bodies: make(chan []byte, 10)}
+	var receiver = httptest.NewServer(wr)
+	defer receiver.Close()
+	var port = receiver.Listener.Addr().(*net.TCPAddr).Port
+
+	var tests = map[string]struct {
+		target  string
+		hosts   map[string]bool
+		wantErr bool
+	}{
+		"same host":     {target: fmt.Sprintf("http://127.0.0.1:%d/", port)},
+		"elsewhere":     {target: fmt.Sprintf("http://localhost:%d/", port), wantErr: true},
+		"callback host": {target: fmt.Sprintf("http://localhost:%d/", port), hosts: map[string]bool{"localhost": true}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			CallbackHosts = tc.hosts
+			var srv = httptest.NewServer(http.RedirectHandler(tc.target, http.StatusTemporaryRedirect))
+			defer srv.Close()
+
+			var err = postWebhook(context.Background(), srv.URL, []byte("{}"))
+			if tc.wantErr && err == nil {
+				t.Fatalf("Expected the redirect to be refused")
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatalf("Expected the redirect to be followed, got %s", err)
+			}
+		})
+	}
+}
+
+func TestCallbackOnJobFinished(t *testing.T) {
+	var oldHosts, oldURL = CallbackHosts, WebhookURL
+	defer func() { CallbackHosts, WebhookURL = oldHosts, oldURL }()
+	WebhookURL = ""
+
+	var wr = &webhookReceiver{bodies: make(chan []byte, 2)}
+	var srv = httptest.NewServer(wr)
+	defer srv.Close()
+
+	JobRunner = queue.New(queue.CommandRunner{Path: "/bin/false"})
+	JobRunner.SetHooks(queue.Hooks{Finished: notifyJobFinished})
+	var release = make(chan struct{})
+	var j = JobRunner.NewFuncJob("load", func(_ context.Context, j *queue.Job) error {
+		j.Logf("loading")
+		<-release
+		return errors.New("bad batch")
+	})
+
+	// The callback middleware registers the URL for the job the command
+	// queued
+	var handler = callback(func(*request) response {
+		return respond(StatusSuccess, "Job added to queue", H{"job": H{"id": j.ID()}})
+	})
+	handler(&request{command: "load-batch", callback: srv.URL + "/hook"})
+
+	var err = j.Start(context.Background())
+	if err != nil {
+		t.Fatalf("Unable to start job: %s", err)
+	}
+	close(release)
+	_ = j.Wait()
+
+	var payload struct {
+		Job struct {
+			ID     int64  `json:"id"`
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		} `json:"job"`
+		Stdout []string `json:"stdout"`
+	}
+	select {
+	case body := <-wr.bodies:
+		err = json.Unmarshal(body, &payload)
+		if err != nil {
+			t.Fatalf("Invalid payload %q: %s", body, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Callback was never delivered")
+	}
+	if payload.Job.ID != j.ID() || payload.Job.Status != string(queue.StatusFailed) || payload.Job.Error != "bad batch" {
+		t.Errorf("Unexpected job in payload: %#v", payload.Job)
+	}
+	if len(payload.Stdout) == 0 {
+		t.Errorf("Expected the job's log in the payload")
+	}
+
+	// Registering after the job finished still sends it, exactly once
+	watchJob(j.ID(), srv.URL+"/late")
+	select {
+	case <-wr.bodies:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Late callback was never delivered")
+	}
+	if got := callbacks.take(j.ID()); len(got) != 0 {
+		t.Errorf("Expected no callbacks left for the job, got %v", got)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/afero"
+)
+
+// WorkDir is where the agent puts its scratch space, such as the MARC it
+// writes out for ONI to load. Empty means the OS temp dir.
+var WorkDir string
+
+// WorkDirMinFree is how much free space WorkDir must have at startup, in
+// bytes. It defaults to MaxPayloadBytes, since a client's payload is the
+// largest thing the agent writes there.
+var WorkDirMinFree uint64
+
+// checkWorkDir makes sure dir is a directory the agent can write to, on a
+// filesystem with at least minFree bytes available
+func checkWorkDir(dir string, minFree uint64) error {
+	var info, err = os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New("not a directory")
+	}
+
+	var f *os.File
+	f, err = os.CreateTemp(dir, ".oni-agent-probe-*")
+	if err != nil {
+		return fmt.Errorf("not writable: %w", err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	var du = getDiskUsage(dir)
+	if du.Error != "" {
+		return fmt.Errorf("unable to check free space: %s", du.Error)
+	}
+	if du.FreeBytes < minFree {
+		return fmt.Errorf("only %d MB free, need at least %d MB", du.FreeBytes>>20, minFree>>20)
+	}
+	return nil
+}
+
+// makeWorkDir creates a new, empty scratch directory in WorkDir. The caller
+// is responsible for removing it.
+func makeWorkDir(pattern string) (string, error) {
+	return afero.TempDir(agentFS, WorkDir, pattern)
+}
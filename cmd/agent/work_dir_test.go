@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckWorkDir(t *testing.T) {
+	var dir = t.TempDir()
+	var file = filepath.Join(dir, "file")
+	os.WriteFile(file, nil, 0644)
+	var readOnly = filepath.Join(dir, "ro")
+	os.Mkdir(readOnly, 0555)
+
+	var tests = map[string]struct {
+		dir     string
+		minFree uint64
+		err     string
+	}{
+		"ok":            {dir: dir, minFree: 1},
+		"missing":       {dir: filepath.Join(dir, "nope"), err: "no such file"},
+		"not a dir":     {dir: file, err: "not a directory"},
+		"too full":      {dir: dir, minFree: 1 << 62, err: "MB free"},
+		"not writeable": {dir: readOnly, err: "not writable"},
+	}
+	for name, tc := range tests {
+		if name == "not writeable" && os.Geteuid() == 0 {
+			continue
+		}
+		var err = checkWorkDir(tc.dir, tc.minFree)
+		if tc.err == "" && err != nil {
+			t.Errorf("%s: expected no error, got %s", name, err)
+		}
+		if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%s: expected an error containing %q, got %v", name, tc.err, err)
+		}
+	}
+
+	var entries, _ = os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Errorf("Expected the write probe to be cleaned up, got %d entries", len(entries))
+	}
+}
+
+func TestMakeWorkDir(t *testing.T) {
+	var orig = WorkDir
+	defer func() { WorkDir = orig }()
+	WorkDir = t.TempDir()
+
+	var dir, err = makeWorkDir("*-oni-marc")
+	if err != nil {
+		t.Fatalf("Unable to make work dir: %s", err)
+	}
+	if filepath.Dir(dir) != WorkDir {
+		t.Errorf("Expected a scratch dir in %s, got %s", WorkDir, dir)
+	}
+}
@@ -0,0 +1,86 @@
+// Command batchstat prints a quick summary of an NDNP batch directory: issues
+// per LCCN, pages per issue, file size totals, and any files the batch
+// references which don't exist
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+)
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-json] <batch directory>\n\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	var asJSON = flag.Bool("json", false, "emit statistics as JSON instead of a text report")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var s, err = collect(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read batch: %s\n", err)
+		os.Exit(1)
+	}
+
+	if *asJSON {
+		var enc = json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(s)
+	} else {
+		err = report(os.Stdout, s)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write statistics: %s\n", err)
+		os.Exit(1)
+	}
+
+	// Make it easy for scripts to tell a batch has problems
+	if s.Missing > 0 || s.Errors > 0 {
+		os.Exit(3)
+	}
+}
+
+// report writes a human-friendly summary of the batch statistics
+func report(w io.Writer, s *batchStats) error {
+	var tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Batch:\t%s (awardee %s, %s)\n", s.Name, s.Awardee, s.AwardYear)
+	fmt.Fprintf(tw, "Issues:\t%d\n", s.Issues)
+	fmt.Fprintf(tw, "Pages:\t%d\n", s.Pages)
+	fmt.Fprintf(tw, "Files:\t%d (%d bytes)\n", s.Files, s.Bytes)
+	fmt.Fprintf(tw, "Missing files:\t%d\n", s.Missing)
+	fmt.Fprintf(tw, "Unreadable issues:\t%d\n", s.Errors)
+
+	fmt.Fprintf(tw, "\nLCCN\tIssues\n")
+	for _, lccn := range s.LCCNs() {
+		fmt.Fprintf(tw, "%s\t%d\n", lccn, s.IssuesByLCCN[lccn])
+	}
+
+	fmt.Fprintf(tw, "\nLCCN\tDate\tEdition\tPages\tFiles\tBytes\n")
+	for _, is := range s.IssueList {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%d\n", is.LCCN, is.IssueDate, is.EditionOrder, is.Pages, is.Files, is.Bytes)
+	}
+	var err = tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	for _, is := range s.IssueList {
+		if is.Error != "" {
+			fmt.Fprintf(w, "ERROR: %s: %s\n", is.Path, is.Error)
+		}
+		for _, m := range is.Missing {
+			fmt.Fprintf(w, "MISSING: %s\n", m)
+		}
+	}
+	return nil
+}
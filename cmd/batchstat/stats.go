@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/open-oni/oni-agent/internal/batchxml"
+)
+
+// issueStats describes a single issue in the batch
+type issueStats struct {
+	LCCN         string   `json:"lccn"`
+	IssueDate    string   `json:"issue_date"`
+	EditionOrder string   `json:"edition_order"`
+	Path         string   `json:"path"`
+	Pages        int      `json:"pages"`
+	Files        int      `json:"files"`
+	Bytes        int64    `json:"bytes"`
+	Missing      []string `json:"missing,omitempty"`
+	Error        string   `json:"error,omitempty"`
+}
+
+// batchStats is everything batchstat reports about a batch
+type batchStats struct {
+	Name         string         `json:"name"`
+	Awardee      string         `json:"awardee"`
+	AwardYear    string         `json:"award_year"`
+	Issues       int            `json:"issues"`
+	Pages        int            `json:"pages"`
+	Files        int            `json:"files"`
+	Bytes        int64          `json:"bytes"`
+	Missing      int            `json:"missing"`
+	Errors       int            `json:"errors"`
+	IssuesByLCCN map[string]int `json:"issues_by_lccn"`
+	IssueList    []*issueStats  `json:"issue_list"`
+}
+
+// LCCNs returns the batch's LCCNs in sorted order
+func (s *batchStats) LCCNs() []string {
+	var list []string
+	for lccn := range s.IssuesByLCCN {
+		list = append(list, lccn)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// collect gathers statistics for the batch at batchPath. Problems with
+// individual issues (missing files, unreadable METS) are recorded in the
+// stats rather than returned, since finding those is the whole point.
+func collect(batchPath string) (*batchStats, error) {
+	var b, err = batchxml.Read(batchPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var s = &batchStats{
+		Name:         b.Name,
+		Awardee:      b.Awardee,
+		AwardYear:    b.AwardYear,
+		IssuesByLCCN: make(map[string]int),
+	}
+	for _, i := range b.Issues {
+		var is = collectIssue(batchPath, i)
+		s.IssueList = append(s.IssueList, is)
+		s.Issues++
+		s.IssuesByLCCN[i.LCCN]++
+		s.Pages += is.Pages
+		s.Files += is.Files
+		s.Bytes += is.Bytes
+		s.Missing += len(is.Missing)
+		if is.Error != "" {
+			s.Errors++
+		}
+	}
+
+	return s, nil
+}
+
+func collectIssue(batchPath string, i *batchxml.Issue) *issueStats {
+	var is = &issueStats{LCCN: i.LCCN, IssueDate: i.IssueDate, EditionOrder: i.EditionOrder, Path: i.Filepath}
+
+	// The issue XML counts as one of the issue's files
+	var files = []string{i.Path(batchPath)}
+	var m, err = i.ReadMETS(batchPath)
+	if err == nil {
+		is.Pages = m.Pages
+		for _, f := range m.Files {
+			files = append(files, f.Join(i.Dir(batchPath)))
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		is.Error = fmt.Sprintf("reading METS: %s", err)
+	}
+
+	for _, fname := range files {
+		var info, err = os.Stat(fname)
+		if err != nil {
+			var rel, _ = filepath.Rel(batchxml.DataDir(batchPath), fname)
+			is.Missing = append(is.Missing, filepath.ToSlash(rel))
+			continue
+		}
+		is.Files++
+		is.Bytes += info.Size()
+	}
+
+	return is
+}
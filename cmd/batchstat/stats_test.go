@@ -0,0 +1,34 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCollect(t *testing.T) {
+	var batchPath = filepath.Join("..", "..", "internal", "batchxml", "testdata", "batch_oru_testbatch_ver01")
+	var s, err = collect(batchPath)
+	if err != nil {
+		t.Fatalf("Unable to collect stats: %s", err)
+	}
+
+	if s.Name != "batch_oru_testbatch" || s.Issues != 2 || s.Pages != 6 {
+		t.Errorf("Unexpected batch totals: %#v", s)
+	}
+	if diff := cmp.Diff(map[string]int{"sn96088442": 2}, s.IssuesByLCCN); diff != "" {
+		t.Errorf("Unexpected issues by LCCN: %s", diff)
+	}
+
+	// The second issue's METS references a TIFF which isn't there
+	if diff := cmp.Diff([]string{"sn96088442/print/1902112902/0002.tif"}, s.IssueList[1].Missing); diff != "" {
+		t.Errorf("Unexpected missing files: %s", diff)
+	}
+	if s.Missing != 1 || s.Errors != 0 {
+		t.Errorf("Expected 1 missing file and no errors, got %d and %d", s.Missing, s.Errors)
+	}
+	if s.IssueList[0].Files != 9 || s.IssueList[1].Files != 4 {
+		t.Errorf("Unexpected file counts: %d and %d", s.IssueList[0].Files, s.IssueList[1].Files)
+	}
+}
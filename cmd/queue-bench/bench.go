@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+// benchConfig describes the synthetic load to put on the queue
+type benchConfig struct {
+	Jobs    int           `json:"jobs"`
+	Sleep   time.Duration `json:"sleep_ns"`
+	Command string        `json:"command,omitempty"`
+}
+
+// percentiles summarizes a set of durations, in milliseconds
+type percentiles struct {
+	P50 float64 `json:"p50_ms"`
+	P90 float64 `json:"p90_ms"`
+	P99 float64 `json:"p99_ms"`
+	Max float64 `json:"max_ms"`
+}
+
+// memory reports the heap before and after the run, and how much was
+// allocated along the way
+type memory struct {
+	HeapBefore uint64 `json:"heap_before_bytes"`
+	HeapAfter  uint64 `json:"heap_after_bytes"`
+	TotalAlloc uint64 `json:"total_alloc_bytes"`
+	NumGC      uint32 `json:"num_gc"`
+}
+
+// benchResult is everything measured in a single run
+type benchResult struct {
+	Config     benchConfig `json:"config"`
+	Elapsed    float64     `json:"elapsed_seconds"`
+	Throughput float64     `json:"jobs_per_second"`
+	Failed     int         `json:"failed"`
+	Unfinished int         `json:"unfinished"`
+
+	// Wait is how long jobs sat in the queue before starting, Run is how long
+	// they took once started, and Total is queued-to-finished
+	Wait  percentiles `json:"wait"`
+	Run   percentiles `json:"run"`
+	Total percentiles `json:"total"`
+
+	Memory memory `json:"memory"`
+}
+
+// summarize computes percentiles for the given durations, which are sorted
+// in place
+func summarize(list []time.Duration) percentiles {
+	if len(list) == 0 {
+		return percentiles{}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+
+	var at = func(p float64) float64 {
+		var idx = int(p*float64(len(list))+0.5) - 1
+		if idx < 0 {
+			idx = 0
+		}
+		if idx >= len(list) {
+			idx = len(list) - 1
+		}
+		return float64(list[idx].Microseconds()) / 1000
+	}
+	return percentiles{P50: at(0.50), P90: at(0.90), P99: at(0.99), Max: float64(list[len(list)-1].Microseconds()) / 1000}
+}
+
+// run enqueues the configured jobs all at once, waits for every one to
+// finish, and reports how the queue handled them
+func run(ctx context.Context, c benchConfig) benchResult {
+	var q = queue.New(queue.CommandRunner{Path: c.Command})
+
+	var ms runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&ms)
+	var result = benchResult{Config: c, Memory: memory{HeapBefore: ms.HeapAlloc}}
+	var allocBefore, gcBefore = ms.TotalAlloc, ms.NumGC
+
+	var ctxRun, cancel = context.WithCancel(ctx)
+	defer cancel()
+	go q.Wait(ctxRun)
+
+	var sleep = func(ctx context.Context, _ *queue.Job) error {
+		if c.Sleep <= 0 {
+			return nil
+		}
+		select {
+		case <-time.After(c.Sleep):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	var start = time.Now()
+	var ids = make([]int64, c.Jobs)
+	for i := range ids {
+		if c.Command != "" {
+			ids[i] = q.QueueJob("bench", nil)
+		} else {
+			ids[i] = q.QueueFunc("bench", sleep)
+		}
+	}
+
+	var wait, runTimes, total []time.Duration
+collect:
+	for _, id := range ids {
+		var j = q.GetJob(id)
+		select {
+		case <-j.Done():
+		case <-ctx.Done():
+			break collect
+		}
+
+		var r = j.Record()
+		if r.Status != queue.StatusSuccessful {
+			result.Failed++
+			continue
+		}
+		wait = append(wait, r.StartedAt.Sub(r.QueuedAt))
+		runTimes = append(runTimes, r.CompletedAt.Sub(r.StartedAt))
+		total = append(total, r.CompletedAt.Sub(r.QueuedAt))
+	}
+	var elapsed = time.Since(start)
+
+	runtime.ReadMemStats(&ms)
+	result.Memory.HeapAfter = ms.HeapAlloc
+	result.Memory.TotalAlloc = ms.TotalAlloc - allocBefore
+	result.Memory.NumGC = ms.NumGC - gcBefore
+
+	result.Unfinished = c.Jobs - result.Failed - len(total)
+	result.Elapsed = elapsed.Seconds()
+	if elapsed > 0 {
+		result.Throughput = float64(c.Jobs-result.Unfinished) / elapsed.Seconds()
+	}
+	result.Wait = summarize(wait)
+	result.Run = summarize(runTimes)
+	result.Total = summarize(total)
+	return result
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSummarize(t *testing.T) {
+	var list []time.Duration
+	for i := 100; i >= 1; i-- {
+		list = append(list, time.Duration(i)*time.Millisecond)
+	}
+
+	var got = summarize(list)
+	var expected = percentiles{P50: 50, P90: 90, P99: 99, Max: 100}
+	if got != expected {
+		t.Fatalf("Expected %#v, got %#v", expected, got)
+	}
+
+	if summarize(nil) != (percentiles{}) {
+		t.Fatalf("Expected zero percentiles for an empty list")
+	}
+}
+
+func TestRun(t *testing.T) {
+	var r = run(context.Background(), benchConfig{Jobs: 20})
+	if r.Failed != 0 || r.Unfinished != 0 {
+		t.Fatalf("Expected every job to succeed, got %d failed and %d unfinished", r.Failed, r.Unfinished)
+	}
+	if r.Throughput <= 0 || r.Total.Max < r.Total.P50 {
+		t.Fatalf("Unexpected results: %#v", r)
+	}
+}
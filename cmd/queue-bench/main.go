@@ -0,0 +1,87 @@
+// Command queue-bench puts synthetic load on the agent's job queue and
+// reports throughput, queue wait and run latency percentiles, and memory use,
+// so changes to the queue can be measured before they're deployed
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"text/tabwriter"
+)
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-jobs N] [-sleep DURATION] [-command PATH] [-json] [-v]\n\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	var c benchConfig
+	flag.IntVar(&c.Jobs, "jobs", 1000, "number of jobs to queue")
+	flag.DurationVar(&c.Sleep, "sleep", 0, "how long each in-process job sleeps (0 makes them no-ops)")
+	flag.StringVar(&c.Command, "command", "", "run this program for every job instead of an in-process job, e.g., /bin/true")
+	var asJSON = flag.Bool("json", false, "emit results as JSON instead of a text report")
+	var verbose = flag.Bool("v", false, "show the queue's own logging")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 0 || c.Jobs < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// The queue logs every job start and finish, which would swamp the report
+	// and skew the numbers
+	if !*verbose {
+		slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}
+
+	var ctx, cancel = signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	var result = run(ctx, c)
+
+	var err error
+	if *asJSON {
+		var enc = json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(result)
+	} else {
+		err = report(os.Stdout, result)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write results: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// report writes a human-friendly summary of the benchmark results
+func report(w io.Writer, r benchResult) error {
+	var tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	var kind = "in-process, sleep " + r.Config.Sleep.String()
+	if r.Config.Command != "" {
+		kind = "command " + r.Config.Command
+	}
+	fmt.Fprintf(tw, "Jobs:\t%d (%s)\n", r.Config.Jobs, kind)
+	fmt.Fprintf(tw, "Failed:\t%d\n", r.Failed)
+	fmt.Fprintf(tw, "Unfinished:\t%d\n", r.Unfinished)
+	fmt.Fprintf(tw, "Elapsed:\t%.3fs\n", r.Elapsed)
+	fmt.Fprintf(tw, "Throughput:\t%.1f jobs/s\n", r.Throughput)
+
+	fmt.Fprintf(tw, "\nLatency (ms)\tp50\tp90\tp99\tmax\n")
+	for _, row := range []struct {
+		name string
+		p    percentiles
+	}{{"Wait", r.Wait}, {"Run", r.Run}, {"Total", r.Total}} {
+		fmt.Fprintf(tw, "%s\t%.3f\t%.3f\t%.3f\t%.3f\n", row.name, row.p.P50, row.p.P90, row.p.P99, row.p.Max)
+	}
+
+	fmt.Fprintf(tw, "\nHeap before:\t%d bytes\n", r.Memory.HeapBefore)
+	fmt.Fprintf(tw, "Heap after:\t%d bytes\n", r.Memory.HeapAfter)
+	fmt.Fprintf(tw, "Allocated:\t%d bytes\n", r.Memory.TotalAlloc)
+	fmt.Fprintf(tw, "GC cycles:\t%d\n", r.Memory.NumGC)
+	return tw.Flush()
+}
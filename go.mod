@@ -3,15 +3,21 @@ module github.com/open-oni/oni-agent
 go 1.22.5
 
 require (
-	github.com/gliderlabs/ssh v0.3.7
+	github.com/anmitsu/go-shlex v0.0.0-20200514113438-38f4b401e2be
+	github.com/gliderlabs/ssh v0.3.8
 	github.com/go-sql-driver/mysql v1.8.1
 	github.com/google/go-cmp v0.6.0
+	github.com/spf13/afero v1.11.0
 	github.com/uoregon-libraries/gopkg v0.30.2
-	golang.org/x/crypto v0.27.0
+	golang.org/x/crypto v0.31.0
+	google.golang.org/grpc v1.67.1
+	google.golang.org/protobuf v1.34.2
 )
 
 require (
 	filippo.io/edwards25519 v1.1.0 // indirect
-	github.com/anmitsu/go-shlex v0.0.0-20200514113438-38f4b401e2be // indirect
-	golang.org/x/sys v0.25.0 // indirect
+	golang.org/x/net v0.28.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240814211410-ddb44dafa142 // indirect
 )
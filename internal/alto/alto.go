@@ -0,0 +1,65 @@
+// Package alto pulls plain text out of ALTO OCR XML, the per-page OCR format
+// NDNP batches use
+package alto
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+)
+
+// ErrNotALTO is returned when a file has no ALTO text structure at all
+var ErrNotALTO = errors.New("no ALTO TextBlock elements found")
+
+// Text returns a page's OCR text: words are separated by spaces, lines by
+// newlines, and blocks by a blank line. Hyphenation markers (HYP elements)
+// are dropped, as ONI does when indexing.
+func Text(r io.Reader) (string, error) {
+	var dec = xml.NewDecoder(r)
+	var out strings.Builder
+	var blocks int
+	var lineHasText bool
+
+	for {
+		var tok, err = dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		switch el := tok.(type) {
+		case xml.StartElement:
+			switch el.Name.Local {
+			case "TextBlock":
+				if blocks > 0 {
+					out.WriteString("\n")
+				}
+				blocks++
+			case "TextLine":
+				lineHasText = false
+			case "String":
+				for _, attr := range el.Attr {
+					if attr.Name.Local == "CONTENT" && attr.Value != "" {
+						if lineHasText {
+							out.WriteByte(' ')
+						}
+						out.WriteString(attr.Value)
+						lineHasText = true
+					}
+				}
+			}
+		case xml.EndElement:
+			if el.Name.Local == "TextLine" && lineHasText {
+				out.WriteByte('\n')
+			}
+		}
+	}
+
+	if blocks == 0 {
+		return "", ErrNotALTO
+	}
+	return out.String(), nil
+}
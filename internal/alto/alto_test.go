@@ -0,0 +1,41 @@
+package alto
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const page = `<?xml version="1.0" encoding="UTF-8"?>
+<alto xmlns="http://schema.ccs-gmbh.com/ALTO">
+  <Layout><Page><PrintSpace>
+    <TextBlock ID="TB1">
+      <TextLine><String CONTENT="THE"/><SP/><String CONTENT="MORNING"/><SP/><String CONTENT="OREGONIAN"/></TextLine>
+    </TextBlock>
+    <TextBlock ID="TB2">
+      <TextLine><String CONTENT="Local"/><SP/><String CONTENT="news"/><SP/><String CONTENT="and"/><SP/><String CONTENT="hap"/><HYP CONTENT="-"/></TextLine>
+      <TextLine><String CONTENT="penings"/><String CONTENT="today"/></TextLine>
+      <TextLine></TextLine>
+    </TextBlock>
+  </PrintSpace></Page></Layout>
+</alto>`
+
+func TestText(t *testing.T) {
+	var got, err = Text(strings.NewReader(page))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var expected = "THE MORNING OREGONIAN\n\nLocal news and hap\npenings today\n"
+	if got != expected {
+		t.Fatalf("Expected %q, got %q", expected, got)
+	}
+
+	_, err = Text(strings.NewReader(`<mets><dmdSec/></mets>`))
+	if !errors.Is(err, ErrNotALTO) {
+		t.Fatalf("Expected ErrNotALTO, got %v", err)
+	}
+	_, err = Text(strings.NewReader(`<alto><TextBlock>`))
+	if err == nil {
+		t.Fatal("Expected truncated XML to fail")
+	}
+}
@@ -0,0 +1,127 @@
+// Package artifact stores files produced by agent jobs, such as reports, so
+// clients can retrieve them after the job finishes
+package artifact
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrInvalidName is returned for artifact names which could escape the
+// artifact directory or otherwise aren't allowed
+var ErrInvalidName = errors.New("invalid artifact name")
+
+// Info describes a stored artifact
+type Info struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// Store is anything which can store and retrieve artifacts
+type Store interface {
+	Put(name string, r io.Reader) error
+	Get(name string) (io.ReadCloser, error)
+	List() ([]Info, error)
+
+	// URL returns a link clients can use to fetch the artifact directly, valid
+	// for at least the given duration, or an empty string if the store can't
+	// provide one
+	URL(name string, expires time.Duration) (string, error)
+}
+
+// Dir stores artifacts as plain files in a single directory
+type Dir struct {
+	path string
+}
+
+// NewDir returns a Dir rooted at path, creating the directory if needed
+func NewDir(path string) (*Dir, error) {
+	var err = os.MkdirAll(path, 0750)
+	if err != nil {
+		return nil, fmt.Errorf("creating artifact dir %q: %w", path, err)
+	}
+	return &Dir{path: path}, nil
+}
+
+// ValidName returns true if name is a plain file name: no path separators,
+// no leading dots, nothing that'd let a client read arbitrary files
+func ValidName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, `/\`) && !strings.HasSuffix(name, ".tmp")
+}
+
+// Put stores the data read from r under the given name, replacing any
+// existing artifact with the same name
+func (d *Dir) Put(name string, r io.Reader) error {
+	if !ValidName(name) {
+		return ErrInvalidName
+	}
+
+	var final = filepath.Join(d.path, name)
+	var tmp = final + ".tmp"
+	var f, err = os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("creating artifact: %w", err)
+	}
+
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp, final)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("writing artifact %q: %w", name, err)
+	}
+	return nil
+}
+
+// Get opens the named artifact for reading
+func (d *Dir) Get(name string) (io.ReadCloser, error) {
+	if !ValidName(name) {
+		return nil, ErrInvalidName
+	}
+	return os.Open(filepath.Join(d.path, name))
+}
+
+// List returns info about all artifacts, sorted by name
+func (d *Dir) List() ([]Info, error) {
+	var entries, err = os.ReadDir(d.path)
+	if err != nil {
+		return nil, fmt.Errorf("reading artifact dir: %w", err)
+	}
+
+	var list = []Info{}
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !ValidName(e.Name()) {
+			continue
+		}
+		var fi, err = e.Info()
+		if err != nil {
+			return nil, fmt.Errorf("reading artifact info: %w", err)
+		}
+		list = append(list, Info{Name: e.Name(), Size: fi.Size(), Modified: fi.ModTime()})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list, nil
+}
+
+// URL implements Store. Local artifacts aren't reachable by URL, so this
+// always returns an empty string.
+func (d *Dir) URL(name string, _ time.Duration) (string, error) {
+	if !ValidName(name) {
+		return "", ErrInvalidName
+	}
+	return "", nil
+}
@@ -0,0 +1,54 @@
+package artifact
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestPutGetList(t *testing.T) {
+	var d, err = NewDir(t.TempDir())
+	if err != nil {
+		t.Fatalf("Unable to create artifact dir: %s", err)
+	}
+
+	for _, name := range []string{"b.json", "a.zip"} {
+		err = d.Put(name, strings.NewReader("data for "+name))
+		if err != nil {
+			t.Fatalf("Unable to store %q: %s", name, err)
+		}
+	}
+
+	var list []Info
+	list, err = d.List()
+	if err != nil {
+		t.Fatalf("Unable to list artifacts: %s", err)
+	}
+	if len(list) != 2 || list[0].Name != "a.zip" || list[1].Name != "b.json" || list[1].Size != 15 {
+		t.Fatalf("Unexpected listing: %#v", list)
+	}
+
+	var r io.ReadCloser
+	r, err = d.Get("b.json")
+	if err != nil {
+		t.Fatalf("Unable to read artifact: %s", err)
+	}
+	defer r.Close()
+	var data, _ = io.ReadAll(r)
+	if string(data) != "data for b.json" {
+		t.Fatalf("Unexpected artifact content %q", data)
+	}
+}
+
+func TestInvalidNames(t *testing.T) {
+	var d, _ = NewDir(t.TempDir())
+	for _, name := range []string{"", "../etc/passwd", ".hidden", "a/b", `a\b`, "x.tmp"} {
+		if err := d.Put(name, strings.NewReader("x")); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("Put(%q): expected ErrInvalidName, got %v", name, err)
+		}
+		if _, err := d.Get(name); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("Get(%q): expected ErrInvalidName, got %v", name, err)
+		}
+	}
+}
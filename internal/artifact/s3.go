@@ -0,0 +1,359 @@
+package artifact
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config holds everything needed to talk to an S3-compatible object store
+type S3Config struct {
+	// Endpoint is the store's base URL. If empty, the AWS endpoint for Region
+	// is used.
+	Endpoint string
+
+	// Region defaults to "us-east-1", which is also what most S3-compatible
+	// stores expect
+	Region string
+
+	Bucket string
+
+	// Prefix is prepended to every artifact name, e.g., "oni-agent/prod/"
+	Prefix string
+
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+
+	// PathStyle puts the bucket in the URL path rather than the hostname. Most
+	// S3-compatible stores (e.g., MinIO) need this.
+	PathStyle bool
+}
+
+// S3 stores artifacts in an S3-compatible object store. It implements just
+// enough of the S3 API (and AWS Signature Version 4) for artifacts, so we
+// don't need an entire SDK.
+type S3 struct {
+	c      S3Config
+	base   *url.URL
+	client *http.Client
+
+	// now is only replaced in tests, which need a fixed signing time
+	now func() time.Time
+}
+
+// NewS3 returns an S3 artifact store using the given configuration
+func NewS3(c S3Config) (*S3, error) {
+	if c.Bucket == "" {
+		return nil, errors.New("no bucket specified")
+	}
+	if c.AccessKey == "" || c.SecretKey == "" {
+		return nil, errors.New("access key and secret key are required")
+	}
+	if c.Region == "" {
+		c.Region = "us-east-1"
+	}
+	if c.Endpoint == "" {
+		c.Endpoint = "https://s3." + c.Region + ".amazonaws.com"
+	}
+
+	var base, err = url.Parse(strings.TrimRight(c.Endpoint, "/"))
+	if err != nil || base.Host == "" || (base.Scheme != "http" && base.Scheme != "https") {
+		return nil, fmt.Errorf("invalid endpoint %q", c.Endpoint)
+	}
+
+	return &S3{c: c, base: base, client: &http.Client{Timeout: time.Minute * 5}, now: time.Now}, nil
+}
+
+// objectURL returns the URL for the given object key (or the bucket itself if
+// key is empty)
+func (s *S3) objectURL(key string) *url.URL {
+	var u = *s.base
+	if s.c.PathStyle {
+		u.Path = "/" + s.c.Bucket + "/" + key
+	} else {
+		u.Host = s.c.Bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	return &u
+}
+
+// Put implements Store. The whole artifact is read into memory so it can be
+// hashed for signing; artifacts are reports and exports, not batches.
+func (s *S3) Put(name string, r io.Reader) error {
+	if !ValidName(name) {
+		return ErrInvalidName
+	}
+
+	var data, err = io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("reading artifact %q: %w", name, err)
+	}
+
+	var req *http.Request
+	req, err = http.NewRequest(http.MethodPut, s.objectURL(s.c.Prefix+name).String(), bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("storing artifact %q: %w", name, err)
+	}
+
+	var resp *http.Response
+	resp, err = s.do(req, data)
+	if err != nil {
+		return fmt.Errorf("storing artifact %q: %w", name, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Get implements Store. A missing artifact returns an error wrapping
+// os.ErrNotExist, just like Dir.
+func (s *S3) Get(name string) (io.ReadCloser, error) {
+	if !ValidName(name) {
+		return nil, ErrInvalidName
+	}
+
+	var req, err = http.NewRequest(http.MethodGet, s.objectURL(s.c.Prefix+name).String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("reading artifact %q: %w", name, err)
+	}
+
+	var resp *http.Response
+	resp, err = s.do(req, nil)
+	if err != nil {
+		return nil, fmt.Errorf("reading artifact %q: %w", name, err)
+	}
+	return resp.Body, nil
+}
+
+// listResult is the part of a ListObjectsV2 response we use
+type listResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List implements Store, returning every artifact under the configured
+// prefix, sorted by name
+func (s *S3) List() ([]Info, error) {
+	var list = []Info{}
+	var token string
+	for {
+		var q = url.Values{"list-type": {"2"}, "prefix": {s.c.Prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		var u = s.objectURL("")
+		u.RawQuery = q.Encode()
+
+		var req, err = http.NewRequest(http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, fmt.Errorf("listing artifacts: %w", err)
+		}
+		var resp *http.Response
+		resp, err = s.do(req, nil)
+		if err != nil {
+			return nil, fmt.Errorf("listing artifacts: %w", err)
+		}
+
+		var result listResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("listing artifacts: reading response: %w", err)
+		}
+
+		for _, obj := range result.Contents {
+			var name = strings.TrimPrefix(obj.Key, s.c.Prefix)
+			if ValidName(name) {
+				list = append(list, Info{Name: name, Size: obj.Size, Modified: obj.LastModified})
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// URL implements Store, returning a presigned GET URL
+func (s *S3) URL(name string, expires time.Duration) (string, error) {
+	if !ValidName(name) {
+		return "", ErrInvalidName
+	}
+	return s.presign(s.objectURL(s.c.Prefix+name), expires), nil
+}
+
+// do signs and sends the request, turning non-2xx responses into errors
+func (s *S3) do(req *http.Request, body []byte) (*http.Response, error) {
+	s.sign(req, body)
+	var resp, err = s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+
+	var msg, _ = io.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s", os.ErrNotExist, resp.Status)
+	}
+	return nil, fmt.Errorf("unexpected response %s: %s", resp.Status, bytes.TrimSpace(msg))
+}
+
+const (
+	sigAlgorithm    = "AWS4-HMAC-SHA256"
+	amzDateFormat   = "20060102T150405Z"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+func sha256Hex(data []byte) string {
+	var sum = sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	var h = hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// uriEncode escapes a string the way SigV4 requires: everything but
+// unreserved characters is percent-encoded, and slashes are kept only if
+// encodeSlash is false
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery returns the query string sorted and encoded per SigV4
+func canonicalQuery(q url.Values) string {
+	var keys []string
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		var vals = append([]string(nil), q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// scope returns the credential scope for the given signing time
+func (s *S3) scope(t time.Time) string {
+	return t.Format("20060102") + "/" + s.c.Region + "/s3/aws4_request"
+}
+
+// signature computes the SigV4 signature for a canonical request
+func (s *S3) signature(t time.Time, canonicalRequest string) string {
+	var toSign = strings.Join([]string{sigAlgorithm, t.Format(amzDateFormat), s.scope(t), sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	var key = hmacSHA256([]byte("AWS4"+s.c.SecretKey), t.Format("20060102"))
+	key = hmacSHA256(key, s.c.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+// sign adds SigV4 authentication headers to the request
+func (s *S3) sign(req *http.Request, body []byte) {
+	var t = s.now().UTC()
+	var payloadHash = sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", t.Format(amzDateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	var headers = []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	var values = map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           t.Format(amzDateFormat),
+	}
+	if s.c.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.c.SessionToken)
+		headers = append(headers, "x-amz-security-token")
+		values["x-amz-security-token"] = s.c.SessionToken
+	}
+
+	var canonicalHeaders strings.Builder
+	for _, h := range headers {
+		canonicalHeaders.WriteString(h + ":" + values[h] + "\n")
+	}
+	var signedHeaders = strings.Join(headers, ";")
+
+	var canonicalRequest = strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigAlgorithm, s.c.AccessKey, s.scope(t), signedHeaders, s.signature(t, canonicalRequest)))
+}
+
+// presign returns a URL for a GET of u which is valid for the given duration
+// without any other credentials
+func (s *S3) presign(u *url.URL, expires time.Duration) string {
+	var t = s.now().UTC()
+	var q = url.Values{
+		"X-Amz-Algorithm":     {sigAlgorithm},
+		"X-Amz-Credential":    {s.c.AccessKey + "/" + s.scope(t)},
+		"X-Amz-Date":          {t.Format(amzDateFormat)},
+		"X-Amz-Expires":       {strconv.Itoa(int(expires.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	if s.c.SessionToken != "" {
+		q.Set("X-Amz-Security-Token", s.c.SessionToken)
+	}
+
+	var canonicalRequest = strings.Join([]string{
+		http.MethodGet,
+		uriEncode(u.Path, false),
+		canonicalQuery(q),
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+
+	var signed = *u
+	signed.RawQuery = canonicalQuery(q) + "&X-Amz-Signature=" + s.signature(t, canonicalRequest)
+	return signed.String()
+}
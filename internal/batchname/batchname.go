@@ -0,0 +1,87 @@
+// Package batchname parses NDNP-style batch names, which encode the awardee
+// and version along with a free-form label: "batch_oru_bravo_ver01" is version
+// 1 of the "bravo" batch from awardee "oru". All the versions of a batch share
+// a family name, "batch_oru_bravo".
+package batchname
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalid is wrapped by every parse error
+var ErrInvalid = errors.New("invalid batch name")
+
+// Name is a parsed batch name. A Version of 0 means the name refers to the
+// whole family rather than one version.
+type Name struct {
+	Awardee string
+	Label   string
+	Version int
+}
+
+var (
+	nameRegexp   = regexp.MustCompile(`^batch_([[:alnum:]]+)_(\w+)_ver(\d\d)$`)
+	familyRegexp = regexp.MustCompile(`^batch_([[:alnum:]]+)_(\w+)$`)
+
+	// versionSuffix catches a version where a family's label should be, so
+	// "batch_oru_ver01" isn't read as the family with the label "ver01"
+	versionSuffix = regexp.MustCompile(`(?:^|_)ver\d+$`)
+)
+
+// Parse reads a full batch name, e.g., "batch_oru_bravo_ver01"
+func Parse(s string) (Name, error) {
+	var m = nameRegexp.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return Name{}, fmt.Errorf("%w: %q must look like batch_<awardee>_<name>_verNN", ErrInvalid, s)
+	}
+	var v, _ = strconv.Atoi(m[3])
+	if v == 0 {
+		return Name{}, fmt.Errorf("%w: %q has no version 00", ErrInvalid, s)
+	}
+	return Name{Awardee: m[1], Label: m[2], Version: v}, nil
+}
+
+// ParseFamily reads a family name ("batch_oru_bravo"). A full batch name is
+// accepted too, and its version dropped.
+func ParseFamily(s string) (Name, error) {
+	var n, err = Parse(s)
+	if err == nil {
+		n.Version = 0
+		return n, nil
+	}
+
+	var m = familyRegexp.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil || versionSuffix.MatchString(m[2]) {
+		return Name{}, fmt.Errorf("%w: %q must look like batch_<awardee>_<name> or batch_<awardee>_<name>_verNN", ErrInvalid, s)
+	}
+	return Name{Awardee: m[1], Label: m[2]}, nil
+}
+
+// Family returns the name shared by every version of the batch, e.g.,
+// "batch_oru_bravo"
+func (n Name) Family() string {
+	return fmt.Sprintf("batch_%s_%s", n.Awardee, n.Label)
+}
+
+// WithVersion returns a copy of n for the given version
+func (n Name) WithVersion(v int) Name {
+	n.Version = v
+	return n
+}
+
+// IsFamily returns true if n refers to a family rather than one version
+func (n Name) IsFamily() bool {
+	return n.Version == 0
+}
+
+// String returns the full batch name, or just the family if n has no version
+func (n Name) String() string {
+	if n.IsFamily() {
+		return n.Family()
+	}
+	return fmt.Sprintf("%s_ver%02d", n.Family(), n.Version)
+}
@@ -0,0 +1,67 @@
+package batchname
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	var tests = map[string]struct {
+		input    string
+		expected Name
+		hasError bool
+	}{
+		"simple":        {input: "batch_oru_bravo_ver01", expected: Name{Awardee: "oru", Label: "bravo", Version: 1}},
+		"label with _":  {input: "batch_oru_foo_partial_19020101_end_ver02", expected: Name{Awardee: "oru", Label: "foo_partial_19020101_end", Version: 2}},
+		"no version":    {input: "batch_oru_bravo", hasError: true},
+		"no label":      {input: "batch_oru_ver01", hasError: true},
+		"version 00":    {input: "batch_oru_bravo_ver00", hasError: true},
+		"one digit":     {input: "batch_oru_bravo_ver1", hasError: true},
+		"not a batch":   {input: "oru_bravo_ver01", hasError: true},
+		"bad awardee":   {input: "batch_o-ru_bravo_ver01", hasError: true},
+		"trailing junk": {input: "batch_oru_bravo_ver01x", hasError: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got, err = Parse(tc.input)
+			if tc.hasError {
+				if !errors.Is(err, ErrInvalid) {
+					t.Fatalf("Expected ErrInvalid, got %#v, %v", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if got != tc.expected {
+				t.Fatalf("Expected %#v, got %#v", tc.expected, got)
+			}
+			if got.String() != tc.input {
+				t.Fatalf("Expected %q to round-trip, got %q", tc.input, got.String())
+			}
+		})
+	}
+}
+
+func TestParseFamily(t *testing.T) {
+	for _, input := range []string{"batch_oru_bravo", "batch_oru_bravo_ver03"} {
+		var got, err = ParseFamily(input)
+		if err != nil {
+			t.Fatalf("Unexpected error parsing %q: %s", input, err)
+		}
+		if !got.IsFamily() || got.String() != "batch_oru_bravo" {
+			t.Fatalf("Expected family batch_oru_bravo from %q, got %#v", input, got)
+		}
+		if got.WithVersion(12).String() != "batch_oru_bravo_ver12" {
+			t.Fatalf("Unexpected versioned name %q", got.WithVersion(12))
+		}
+	}
+
+	for _, input := range []string{"batch_oru", "batch_oru_ver01", "batch_oru_bravo_ver1"} {
+		var _, err = ParseFamily(input)
+		if !errors.Is(err, ErrInvalid) {
+			t.Fatalf("Expected ErrInvalid for %q, got %v", input, err)
+		}
+	}
+}
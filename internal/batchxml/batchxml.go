@@ -0,0 +1,296 @@
+// Package batchxml parses the NDNP batch and issue XML files found in a
+// batch directory
+package batchxml
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Issue describes a single "issue" element in a batch XML file
+type Issue struct {
+	LCCN         string `xml:"lccn,attr"`
+	IssueDate    string `xml:"issueDate,attr"`
+	EditionOrder string `xml:"editionOrder,attr"`
+	Filepath     string `xml:",innerxml"`
+}
+
+// Batch describes the data we care about which lives in a batch.xml file
+type Batch struct {
+	Name      string   `xml:"name,attr"`
+	Awardee   string   `xml:"awardee,attr"`
+	AwardYear string   `xml:"awardYear,attr"`
+	Issues    []*Issue `xml:"issue"`
+}
+
+// DataDir returns the path to a batch's "data" directory, where batch.xml
+// and all issue directories live
+func DataDir(batchPath string) string {
+	return filepath.Join(batchPath, "data")
+}
+
+// XMLPath returns the path to a batch's batch.xml file. Note that we only
+// care about batch.xml, not batch_1.xml: NCA doesn't do the DVV stuff chronam
+// batches had, and validated XML doesn't give us anything that isn't in the
+// main file anyway.
+func XMLPath(batchPath string) string {
+	return filepath.Join(DataDir(batchPath), "batch.xml")
+}
+
+// Parse decodes batch XML
+func Parse(data []byte) (*Batch, error) {
+	var b = &Batch{}
+	var err = xml.Unmarshal(data, b)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range b.Issues {
+		i.Filepath = strings.TrimSpace(i.Filepath)
+	}
+	return b, nil
+}
+
+// Read parses the batch.xml file for the batch at batchPath
+func Read(batchPath string) (*Batch, error) {
+	var data, err = os.ReadFile(XMLPath(batchPath))
+	if err != nil {
+		return nil, fmt.Errorf("reading file: %w", err)
+	}
+
+	var b *Batch
+	b, err = Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("processing xml: %w", err)
+	}
+	return b, nil
+}
+
+// RelPath returns the issue's XML file path, relative to the batch's data
+// directory
+func (i *Issue) RelPath() RelPath {
+	return NewRelPath(i.Filepath)
+}
+
+// Path returns the full path to the issue's XML file
+func (i *Issue) Path(batchPath string) string {
+	return i.RelPath().Join(DataDir(batchPath))
+}
+
+// Dir returns the full path to the issue's directory
+func (i *Issue) Dir(batchPath string) string {
+	return filepath.Dir(i.Path(batchPath))
+}
+
+// ErrNotIssueXML is returned when an issue file has no page structure at all
+var ErrNotIssueXML = errors.New("no np:page divs found in issue METS")
+
+// METS holds the parts of an issue's METS XML we care about
+type METS struct {
+	// Pages is the number of "np:page" divs in the structMap
+	Pages int
+
+	// Files lists every file the METS references, relative to the issue's
+	// directory, in document order
+	Files []RelPath
+
+	// Details holds what the METS says about each file in Files: its use
+	// (e.g., "service" for a JP2, "ocr" for ALTO) and checksum, if there is one
+	Details map[RelPath]FileDetail
+
+	// LCCN, IssueDate, and EditionOrder come from the issue's MODS. Issue METS
+	// puts the issue's MODS before any page's, so we use the first value
+	// we find for each.
+	LCCN         string
+	IssueDate    string
+	EditionOrder string
+}
+
+// FileDetail describes one file from an issue METS's fileSec
+type FileDetail struct {
+	Use          string
+	Checksum     string
+	ChecksumType string
+}
+
+// ParseMETS reads an issue's METS XML
+func ParseMETS(r io.Reader) (*METS, error) {
+	var dec = xml.NewDecoder(r)
+	var m = &METS{Details: make(map[RelPath]FileDetail)}
+
+	// file is the fileSec entry we're in, for the FLocat inside it
+	var file FileDetail
+
+	// capture points at the field the next chunk of text belongs to, if any
+	var capture *string
+	var inEdition bool
+	for {
+		var tok, err = dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch el := tok.(type) {
+		case xml.CharData:
+			if capture != nil && *capture == "" {
+				*capture = strings.TrimSpace(string(el))
+			}
+			capture = nil
+
+		case xml.EndElement:
+			capture = nil
+			switch el.Name.Local {
+			case "detail":
+				inEdition = false
+			case "file":
+				file = FileDetail{}
+			}
+
+		case xml.StartElement:
+			switch el.Name.Local {
+			case "identifier":
+				if attrValue(el, "type") == "lccn" {
+					capture = &m.LCCN
+				}
+			case "dateIssued":
+				capture = &m.IssueDate
+			case "detail":
+				inEdition = attrValue(el, "type") == "edition"
+			case "number":
+				if inEdition {
+					capture = &m.EditionOrder
+				}
+			case "div":
+				if attrValue(el, "TYPE") == "np:page" {
+					m.Pages++
+				}
+			case "file":
+				file = FileDetail{Use: attrValue(el, "USE"), Checksum: attrValue(el, "CHECKSUM"), ChecksumType: attrValue(el, "CHECKSUMTYPE")}
+			case "FLocat":
+				var href = attrValue(el, "href")
+				if href != "" {
+					var p = NewRelPath(href)
+					m.Files = append(m.Files, p)
+					m.Details[p] = file
+				}
+			}
+		}
+	}
+
+	if m.Pages == 0 {
+		return nil, ErrNotIssueXML
+	}
+	return m, nil
+}
+
+func attrValue(el xml.StartElement, name string) string {
+	for _, attr := range el.Attr {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// CountPages returns the number of pages described in an issue's METS XML,
+// which is the number of "np:page" divs in its structMap
+func CountPages(r io.Reader) (int, error) {
+	var m, err = ParseMETS(r)
+	if err != nil {
+		return 0, err
+	}
+	return m.Pages, nil
+}
+
+// ReadMETS opens the issue's XML file and parses it
+func (i *Issue) ReadMETS(batchPath string) (*METS, error) {
+	var f, err = os.Open(i.Path(batchPath))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseMETS(f)
+}
+
+// CountIssuePages opens the issue's XML file and counts its pages
+func (i *Issue) CountIssuePages(batchPath string) (int, error) {
+	var m, err = i.ReadMETS(batchPath)
+	if err != nil {
+		return 0, err
+	}
+	return m.Pages, nil
+}
+
+// issueElement matches a single issue element in batch XML
+var issueElement = regexp.MustCompile(`(?s)[ \t]*<issue\b[^>]*>.*?</issue>[ \t]*\r?\n?`)
+
+// FilterIssues returns a copy of the batch XML with every issue element for
+// which keep returns false removed. Everything else, including namespaces
+// and formatting, is left exactly as it was, which we couldn't guarantee by
+// round-tripping the XML through encoding/xml.
+func FilterIssues(data []byte, keep func(i *Issue) bool) ([]byte, error) {
+	var err error
+	var out = issueElement.ReplaceAllFunc(data, func(el []byte) []byte {
+		if err != nil {
+			return el
+		}
+
+		var i Issue
+		err = xml.Unmarshal(bytes.TrimSpace(el), &i)
+		if err != nil {
+			err = fmt.Errorf("processing issue element: %w", err)
+			return el
+		}
+		i.Filepath = strings.TrimSpace(i.Filepath)
+		if keep(&i) {
+			return el
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// batchOut and issueOut are only used for writing batch XML: they carry the
+// NDNP namespace, which we don't want to require when reading
+type batchOut struct {
+	XMLName   xml.Name   `xml:"http://www.loc.gov/ndnp batch"`
+	Name      string     `xml:"name,attr"`
+	Awardee   string     `xml:"awardee,attr"`
+	AwardYear string     `xml:"awardYear,attr"`
+	Issues    []issueOut `xml:"issue"`
+}
+
+type issueOut struct {
+	LCCN         string `xml:"lccn,attr"`
+	IssueDate    string `xml:"issueDate,attr"`
+	EditionOrder string `xml:"editionOrder,attr"`
+	Filepath     string `xml:",chardata"`
+}
+
+// Marshal returns the batch as batch XML
+func (b *Batch) Marshal() ([]byte, error) {
+	var out = batchOut{Name: b.Name, Awardee: b.Awardee, AwardYear: b.AwardYear}
+	for _, i := range b.Issues {
+		out.Issues = append(out.Issues, issueOut{LCCN: i.LCCN, IssueDate: i.IssueDate, EditionOrder: i.EditionOrder, Filepath: i.Filepath})
+	}
+
+	var data, err = xml.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(data, '\n')...), nil
+}
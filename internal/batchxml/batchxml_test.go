@@ -0,0 +1,146 @@
+package batchxml
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var testBatch = filepath.Join("testdata", "batch_oru_testbatch_ver01")
+
+func TestRead(t *testing.T) {
+	var b, err = Read(testBatch)
+	if err != nil {
+		t.Fatalf("Unable to read batch: %s", err)
+	}
+
+	if b.Name != "batch_oru_testbatch" || b.Awardee != "oru" || b.AwardYear != "2024" {
+		t.Errorf("Unexpected batch metadata: %#v", b)
+	}
+	if len(b.Issues) != 2 {
+		t.Fatalf("Expected 2 issues, got %d", len(b.Issues))
+	}
+
+	// Whitespace around the path should be ignored
+	var expected = filepath.Join(testBatch, "data", "sn96088442", "print", "1902112902", "1902112902.xml")
+	if got := b.Issues[1].Path(testBatch); got != expected {
+		t.Errorf("Expected issue path %q, got %q", expected, got)
+	}
+
+	for i, expected := range []int{4, 2} {
+		var n, err = b.Issues[i].CountIssuePages(testBatch)
+		if err != nil {
+			t.Fatalf("Unable to count pages for issue %d: %s", i, err)
+		}
+		if n != expected {
+			t.Errorf("Expected %d pages for issue %d, got %d", expected, i, n)
+		}
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	var _, err = Read(filepath.Join("testdata", "nope"))
+	if err == nil || !strings.HasPrefix(err.Error(), "reading file:") {
+		t.Errorf("Expected a read error, got %v", err)
+	}
+
+	_, err = Parse([]byte("<batch><issue"))
+	if err == nil {
+		t.Error("Expected an error parsing busted XML")
+	}
+}
+
+func TestCountPagesNotMETS(t *testing.T) {
+	var _, err = CountPages(strings.NewReader(`<batch name="foo"/>`))
+	if !errors.Is(err, ErrNotIssueXML) {
+		t.Errorf("Expected ErrNotIssueXML, got %v", err)
+	}
+}
+
+func TestFilterIssues(t *testing.T) {
+	var data, err = os.ReadFile(XMLPath(testBatch))
+	if err != nil {
+		t.Fatalf("Unable to read test batch XML: %s", err)
+	}
+
+	var filtered []byte
+	filtered, err = FilterIssues(data, func(i *Issue) bool { return i.EditionOrder == "02" })
+	if err != nil {
+		t.Fatalf("Unable to filter issues: %s", err)
+	}
+
+	var b *Batch
+	b, err = Parse(filtered)
+	if err != nil {
+		t.Fatalf("Filtered XML is invalid: %s", err)
+	}
+	if b.Name != "batch_oru_testbatch" || len(b.Issues) != 1 || b.Issues[0].EditionOrder != "02" {
+		t.Fatalf("Unexpected filtered batch: %#v", b)
+	}
+	if !strings.Contains(string(filtered), `xmlns="http://www.loc.gov/ndnp"`) {
+		t.Errorf("Filtering should preserve the rest of the document, got %s", filtered)
+	}
+}
+
+func TestReadMETS(t *testing.T) {
+	var b, err = Read(testBatch)
+	if err != nil {
+		t.Fatalf("Unable to read batch: %s", err)
+	}
+
+	var m *METS
+	m, err = b.Issues[1].ReadMETS(testBatch)
+	if err != nil {
+		t.Fatalf("Unable to read METS: %s", err)
+	}
+	var expected = []RelPath{"0001.tif", "0001.xml", "0002.tif", "0002.xml"}
+	if m.Pages != 2 || !slices.Equal(m.Files, expected) {
+		t.Errorf("Unexpected METS data: %#v", m)
+	}
+
+	var master = FileDetail{Use: "master", Checksum: "9e107d9d372bb6826bd81d3542a419d6", ChecksumType: "MD5"}
+	if m.Details["0001.tif"] != master || m.Details["0002.xml"] != (FileDetail{Use: "ocr"}) {
+		t.Errorf("Unexpected file details: %#v", m.Details)
+	}
+}
+
+func TestReadMETSMODS(t *testing.T) {
+	var b, err = Read(testBatch)
+	if err != nil {
+		t.Fatalf("Unable to read batch: %s", err)
+	}
+
+	var m *METS
+	m, err = b.Issues[0].ReadMETS(testBatch)
+	if err != nil {
+		t.Fatalf("Unable to read METS: %s", err)
+	}
+	if m.LCCN != "sn96088442" || m.IssueDate != "1902-11-29" || m.EditionOrder != "1" {
+		t.Errorf("Unexpected MODS data: lccn %q, date %q, edition %q", m.LCCN, m.IssueDate, m.EditionOrder)
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	var b = &Batch{Name: "batch_oru_foo", Awardee: "oru", AwardYear: "2024", Issues: []*Issue{
+		{LCCN: "sn96088442", IssueDate: "1902-11-29", EditionOrder: "01", Filepath: "./sn96088442/1902112901/1902112901.xml"},
+	}}
+	var data, err = b.Marshal()
+	if err != nil {
+		t.Fatalf("Unable to marshal batch: %s", err)
+	}
+
+	var got *Batch
+	got, err = Parse(data)
+	if err != nil {
+		t.Fatalf("Unable to parse marshaled batch %s: %s", data, err)
+	}
+	if got.Name != b.Name || len(got.Issues) != 1 || *got.Issues[0] != *b.Issues[0] {
+		t.Errorf("Round trip failed: %s", data)
+	}
+	if !strings.Contains(string(data), `<batch xmlns="http://www.loc.gov/ndnp"`) {
+		t.Errorf("Expected the NDNP namespace, got %s", data)
+	}
+}
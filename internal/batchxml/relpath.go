@@ -0,0 +1,61 @@
+package batchxml
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// RelPath is a relative path as batch and METS XML write it: always with
+// forward slashes, whatever OS the agent runs on. Issue paths are relative to
+// the batch's data directory, and METS file references to the issue's
+// directory.
+//
+// Mixing XML paths with OS paths is how subtle bugs creep in (path.Split on
+// an OS path, filepath.Join on an XML path, etc.), so RelPath stays
+// slash-separated everywhere and is only converted at the filesystem
+// boundary, by Join.
+type RelPath string
+
+// NewRelPath cleans a path taken from XML, e.g., "./sn123//0001.jp2" becomes
+// "sn123/0001.jp2"
+func NewRelPath(p string) RelPath {
+	return RelPath(path.Clean(strings.TrimSpace(p)))
+}
+
+// Join returns the OS path of p relative to dir
+func (p RelPath) Join(dir string) string {
+	return filepath.Join(dir, filepath.FromSlash(string(p)))
+}
+
+// Child returns the path to name inside p
+func (p RelPath) Child(name string) RelPath {
+	return RelPath(path.Join(string(p), name))
+}
+
+// Dir returns everything but the last element of p
+func (p RelPath) Dir() RelPath {
+	return RelPath(path.Dir(string(p)))
+}
+
+// Base returns the last element of p
+func (p RelPath) Base() string {
+	return path.Base(string(p))
+}
+
+// Ext returns p's file extension, including the dot
+func (p RelPath) Ext() string {
+	return path.Ext(string(p))
+}
+
+// Escapes returns true if p is absolute or climbs out of the directory it's
+// relative to. Nothing in a valid batch should.
+func (p RelPath) Escapes() bool {
+	var s = string(p)
+	return path.IsAbs(s) || s == ".." || strings.HasPrefix(s, "../")
+}
+
+// String returns the slash-separated path
+func (p RelPath) String() string {
+	return string(p)
+}
@@ -0,0 +1,38 @@
+package batchxml
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestRelPath(t *testing.T) {
+	var p = NewRelPath("  ./sn96088442//print/1902112902/0001.jp2 ")
+	if p != "sn96088442/print/1902112902/0001.jp2" {
+		t.Fatalf("Expected a cleaned, slash-separated path, got %q", p)
+	}
+	if p.Dir() != "sn96088442/print/1902112902" || p.Base() != "0001.jp2" || p.Ext() != ".jp2" {
+		t.Errorf("Unexpected path parts: %q, %q, %q", p.Dir(), p.Base(), p.Ext())
+	}
+	if p.Dir().Child("0002.jp2") != "sn96088442/print/1902112902/0002.jp2" {
+		t.Errorf("Unexpected child path %q", p.Dir().Child("0002.jp2"))
+	}
+
+	// Only Join produces an OS path, so it's the only place separators change
+	var expected = filepath.Join("batch", "data", "sn96088442", "print", "1902112902", "0001.jp2")
+	if got := p.Join(filepath.Join("batch", "data")); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+
+	for path, escapes := range map[string]bool{
+		"./sn123/0001.xml":     false,
+		"sn123/../sn456/a.xml": false,
+		"../sn123/0001.xml":    true,
+		"sn123/../../a.xml":    true,
+		"/etc/passwd":          true,
+		"..":                   true,
+	} {
+		if got := NewRelPath(path).Escapes(); got != escapes {
+			t.Errorf("Expected Escapes() for %q to be %t", path, escapes)
+		}
+	}
+}
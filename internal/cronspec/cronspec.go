@@ -0,0 +1,132 @@
+// Package cronspec parses the five-field schedules crontab uses (minute,
+// hour, day of month, month, and day of week) and matches times against them.
+// Fields may be "*", a number, a range ("1-5"), a step ("*/15" or "8-18/2"),
+// or a comma-separated list of those. Month and day names aren't supported.
+package cronspec
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Spec is a parsed schedule
+type Spec struct {
+	minute, hour, dom, month, dow uint64
+
+	// domStar and dowStar record whether the day fields were "*": as in cron,
+	// if both are restricted, a day matches if either does
+	domStar, dowStar bool
+}
+
+type field struct {
+	name     string
+	min, max int
+}
+
+var fields = []field{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// Parse reads a five-field schedule, e.g., "0 8 * * 1-5" for 8am on weekdays
+func Parse(s string) (*Spec, error) {
+	var parts = strings.Fields(s)
+	if len(parts) != len(fields) {
+		return nil, fmt.Errorf("%q must have %d fields, not %d", s, len(fields), len(parts))
+	}
+
+	var bits [5]uint64
+	for i, f := range fields {
+		var b, err = f.parse(parts[i])
+		if err != nil {
+			return nil, fmt.Errorf("%q: %s: %w", s, f.name, err)
+		}
+		bits[i] = b
+	}
+
+	// Sunday is both 0 and 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	return &Spec{
+		minute: bits[0], hour: bits[1], dom: bits[2], month: bits[3], dow: bits[4],
+		domStar: parts[2] == "*", dowStar: parts[4] == "*",
+	}, nil
+}
+
+// parse turns one field into a bit set of the values it allows
+func (f field) parse(s string) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(s, ",") {
+		var rng, stepStr, hasStep = strings.Cut(item, "/")
+		var step = 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepStr)
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+		}
+
+		var lo, hi = f.min, f.max
+		switch {
+		case rng == "*":
+		case strings.Contains(rng, "-"):
+			var a, b, _ = strings.Cut(rng, "-")
+			var err error
+			lo, err = f.value(a)
+			if err != nil {
+				return 0, err
+			}
+			hi, err = f.value(b)
+			if err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("range %q runs backward", rng)
+			}
+		default:
+			var err error
+			lo, err = f.value(rng)
+			if err != nil {
+				return 0, err
+			}
+			if !hasStep {
+				hi = lo
+			}
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func (f field) value(s string) (int, error) {
+	var n, err = strconv.Atoi(s)
+	if err != nil || n < f.min || n > f.max {
+		return 0, fmt.Errorf("%q is not a number from %d to %d", s, f.min, f.max)
+	}
+	return n, nil
+}
+
+// Match returns true if t, to the minute, is one of the schedule's times. t
+// is matched in its own location.
+func (s *Spec) Match(t time.Time) bool {
+	if s.minute&(1<<t.Minute()) == 0 || s.hour&(1<<t.Hour()) == 0 || s.month&(1<<int(t.Month())) == 0 {
+		return false
+	}
+
+	var domOK = s.dom&(1<<t.Day()) != 0
+	var dowOK = s.dow&(1<<int(t.Weekday())) != 0
+	if !s.domStar && !s.dowStar {
+		return domOK || dowOK
+	}
+	return domOK && dowOK
+}
@@ -0,0 +1,71 @@
+package cronspec
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMatch(t *testing.T) {
+	// June 3, 2024 was a Monday
+	var at = func(day, hour, minute int) time.Time {
+		return time.Date(2024, 6, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	var tests = []struct {
+		spec string
+		t    time.Time
+		want bool
+	}{
+		{"* * * * *", at(3, 12, 34), true},
+		{"0 8 * * 1-5", at(3, 8, 0), true},
+		{"0 8 * * 1-5", at(3, 8, 1), false},
+		{"0 8 * * 1-5", at(8, 8, 0), false},
+		{"*/15 * * * *", at(3, 9, 45), true},
+		{"*/15 * * * *", at(3, 9, 50), false},
+		{"5/20 * * * *", at(3, 9, 45), true},
+		{"0 8-18/2 * * *", at(3, 14, 0), true},
+		{"0 8-18/2 * * *", at(3, 15, 0), false},
+		{"30 9 1,15 6 *", at(15, 9, 30), true},
+		{"30 9 1,15 7 *", at(15, 9, 30), false},
+
+		// Sunday is 0 or 7
+		{"0 0 * * 7", at(9, 0, 0), true},
+		{"0 0 * * 0", at(9, 0, 0), true},
+
+		// With both day fields restricted, either one matching is enough
+		{"0 0 1 * 1", at(3, 0, 0), true},
+		{"0 0 1 * 1", at(1, 0, 0), true},
+		{"0 0 1 * 1", at(4, 0, 0), false},
+	}
+
+	for _, tc := range tests {
+		var s, err = Parse(tc.spec)
+		if err != nil {
+			t.Fatalf("Parse(%q): %s", tc.spec, err)
+		}
+		var got = s.Match(tc.t)
+		if got != tc.want {
+			t.Errorf("%q matching %s: expected %v, got %v", tc.spec, tc.t.Format(time.RFC3339), tc.want, got)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, spec := range []string{
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"* * * * mon",
+		"*/0 * * * *",
+		"10-5 * * * *",
+		"1,,2 * * * *",
+	} {
+		var _, err = Parse(spec)
+		if err == nil {
+			t.Errorf("Expected %q to be refused", spec)
+		}
+	}
+}
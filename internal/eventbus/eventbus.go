@@ -0,0 +1,192 @@
+// Package eventbus is a small in-process publish/subscribe bus, so things
+// which need to know what the agent is doing (the change journal, failure
+// diagnostics, metrics) don't have to be wired into whatever does it
+package eventbus
+
+import (
+	"sync"
+	"time"
+)
+
+// Event is a single thing that happened. Data is whatever the publisher
+// attaches, e.g., the job which changed state.
+type Event struct {
+	Topic string
+	Time  time.Time
+	Data  any
+}
+
+// Stats describes how a subscriber is keeping up
+type Stats struct {
+	Delivered int64 `json:"delivered"`
+	Pending   int   `json:"pending"`
+}
+
+// Subscription is one subscriber's registration with a bus
+type Subscription struct {
+	name   string
+	topics map[string]bool
+	fn     func(Event)
+	sync   bool
+	done   chan struct{}
+
+	m         sync.Mutex
+	ready     *sync.Cond
+	queue     []Event
+	closed    bool
+	delivered int64
+}
+
+// wants returns true if the subscriber receives events on the topic
+func (s *Subscription) wants(topic string) bool {
+	return len(s.topics) == 0 || s.topics[topic]
+}
+
+// deliver hands the event to the subscriber. Synchronous subscribers are
+// called directly; others get the event queued, however far behind they are,
+// so a slow subscriber never holds up a publisher and never misses an event.
+func (s *Subscription) deliver(e Event) {
+	if s.sync {
+		s.fn(e)
+		s.count()
+		return
+	}
+	s.m.Lock()
+	s.queue = append(s.queue, e)
+	s.m.Unlock()
+	s.ready.Signal()
+}
+
+func (s *Subscription) count() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.delivered++
+}
+
+// run hands queued events to the subscriber one at a time until it's closed
+// and has nothing left to handle
+func (s *Subscription) run() {
+	defer close(s.done)
+	for {
+		s.m.Lock()
+		for len(s.queue) == 0 && !s.closed {
+			s.ready.Wait()
+		}
+		if len(s.queue) == 0 {
+			s.m.Unlock()
+			return
+		}
+		var e = s.queue[0]
+		s.queue = s.queue[1:]
+		s.m.Unlock()
+
+		s.fn(e)
+		s.count()
+	}
+}
+
+// close stops the subscriber once it has handled everything queued for it,
+// and waits for that
+func (s *Subscription) close() {
+	s.m.Lock()
+	s.closed = true
+	s.m.Unlock()
+	s.ready.Signal()
+	<-s.done
+}
+
+// Stats returns how many events the subscriber has handled, and how many are
+// waiting for it
+func (s *Subscription) Stats() Stats {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return Stats{Delivered: s.delivered, Pending: len(s.queue)}
+}
+
+// Bus delivers published events to every interested subscriber. It's safe
+// for concurrent use.
+type Bus struct {
+	m      sync.RWMutex
+	subs   []*Subscription
+	closed bool
+}
+
+// New returns an empty bus
+func New() *Bus {
+	return &Bus{}
+}
+
+func (b *Bus) add(s *Subscription, topics []string) *Subscription {
+	s.topics = make(map[string]bool)
+	for _, t := range topics {
+		s.topics[t] = true
+	}
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.subs = append(b.subs, s)
+	return s
+}
+
+// Subscribe registers fn to receive events on the given topics, or on every
+// topic if none are given. fn runs in its own goroutine, one event at a time.
+// Events wait in an unbounded queue until fn gets to them, so fn has to keep
+// up on the whole, but it can fall behind for a while without losing any.
+func (b *Bus) Subscribe(name string, fn func(Event), topics ...string) *Subscription {
+	var s = &Subscription{name: name, fn: fn, done: make(chan struct{})}
+	s.ready = sync.NewCond(&s.m)
+	go s.run()
+	return b.add(s, topics)
+}
+
+// SubscribeSync registers fn to be called directly by Publish. It's for
+// subscribers which must see an event before the publisher carries on, and
+// fn must be fast and must not publish.
+func (b *Bus) SubscribeSync(name string, fn func(Event), topics ...string) *Subscription {
+	return b.add(&Subscription{name: name, fn: fn, sync: true}, topics)
+}
+
+// Publish sends an event to every subscriber of its topic. Events published
+// after the bus is closed are discarded.
+func (b *Bus) Publish(topic string, data any) {
+	var e = Event{Topic: topic, Time: time.Now(), Data: data}
+	b.m.RLock()
+	defer b.m.RUnlock()
+	if b.closed {
+		return
+	}
+	for _, s := range b.subs {
+		if s.wants(topic) {
+			s.deliver(e)
+		}
+	}
+}
+
+// Stats returns every subscriber's stats, keyed by subscriber name
+func (b *Bus) Stats() map[string]Stats {
+	b.m.RLock()
+	defer b.m.RUnlock()
+	var stats = make(map[string]Stats, len(b.subs))
+	for _, s := range b.subs {
+		stats[s.name] = s.Stats()
+	}
+	return stats
+}
+
+// Close stops the bus from accepting events and waits for subscribers to
+// handle the ones already queued for them
+func (b *Bus) Close() {
+	b.m.Lock()
+	if b.closed {
+		b.m.Unlock()
+		return
+	}
+	b.closed = true
+	var subs = b.subs
+	b.m.Unlock()
+
+	for _, s := range subs {
+		if !s.sync {
+			s.close()
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package eventbus
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestPublish(t *testing.T) {
+	var b = New()
+	var m sync.Mutex
+	var all, finished []string
+	var inline []string
+	b.Subscribe("all", func(e Event) {
+		m.Lock()
+		all = append(all, e.Topic+" "+e.Data.(string))
+		m.Unlock()
+	})
+	b.Subscribe("finished", func(e Event) {
+		m.Lock()
+		finished = append(finished, e.Data.(string))
+		m.Unlock()
+	}, "job.finished")
+	b.SubscribeSync("inline", func(e Event) { inline = append(inline, e.Data.(string)) }, "job.queued")
+
+	b.Publish("job.queued", "one")
+	if len(inline) != 1 {
+		t.Fatalf("Expected a synchronous subscriber to see the event before Publish returns, got %q", inline)
+	}
+	b.Publish("job.finished", "one")
+	b.Publish("job.queued", "two")
+	b.Close()
+	b.Publish("job.finished", "two")
+
+	if len(all) != 3 || all[0] != "job.queued one" || all[2] != "job.queued two" {
+		t.Errorf("Expected every event in order, got %q", all)
+	}
+	if len(finished) != 1 || finished[0] != "one" {
+		t.Errorf("Expected just the finished event, got %q", finished)
+	}
+	if len(inline) != 2 {
+		t.Errorf("Expected both queued events inline, got %q", inline)
+	}
+	if s := b.Stats()["all"]; s.Delivered != 3 || s.Pending != 0 {
+		t.Errorf("Unexpected stats: %#v", s)
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	var b = New()
+	var release = make(chan struct{})
+	var handled int
+	b.Subscribe("slow", func(Event) {
+		<-release
+		handled++
+	})
+
+	// The first event blocks the handler, and the rest queue up behind it
+	// without blocking the publisher
+	for range 10 {
+		b.Publish("job.finished", nil)
+	}
+	if s := b.Stats()["slow"]; s.Delivered != 0 || s.Pending < 9 {
+		t.Errorf("Expected the events to wait for the handler, got %#v", s)
+	}
+	close(release)
+	b.Close()
+
+	var s = b.Stats()["slow"]
+	if handled != 10 || s.Delivered != 10 || s.Pending != 0 {
+		t.Errorf("Expected every event to be handled, got %#v (%d handled)", s, handled)
+	}
+}
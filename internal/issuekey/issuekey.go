@@ -0,0 +1,154 @@
+// Package issuekey converts between the two ways issues are identified:
+// NCA-style keys ("sn96088442/1902-11-29_01") and ONI/chronam-style keys
+// ("sn96088442/1902112901"). They look similar enough to be confused
+// constantly, so everything that accepts or reports an issue key should go
+// through a Key rather than passing strings around.
+package issuekey
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalid is wrapped by every parse error
+var ErrInvalid = errors.New("invalid issue key")
+
+// Key identifies a single issue: a title's LCCN, the issue date, and the
+// edition (1 for the first or only edition on that date)
+type Key struct {
+	LCCN    string
+	Date    time.Time
+	Edition int
+}
+
+var (
+	lccnRegexp    = regexp.MustCompile(`^[a-z]{0,3}[0-9]+$`)
+	ncaRegexp     = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})_(\d{1,2})$`)
+	chronamRegexp = regexp.MustCompile(`^(\d{8})(\d{2})$`)
+
+	// Common mistakes, so errors can say what's wrong
+	ncaNoEdition     = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
+	chronamNoEdition = regexp.MustCompile(`^\d{8}$`)
+	chronamShortEd   = regexp.MustCompile(`^\d{9}$`)
+	mixedForms       = regexp.MustCompile(`^(?:\d{8}_\d+|\d{4}-\d{2}-\d{2}\d+)$`)
+)
+
+const (
+	ncaDateFormat     = "2006-01-02"
+	chronamDateFormat = "20060102"
+)
+
+// ValidLCCN returns true if s looks like a normalized LCCN, e.g., "sn96088442"
+func ValidLCCN(s string) bool {
+	return lccnRegexp.MatchString(s)
+}
+
+// New returns a Key after validating its parts
+func New(lccn string, date time.Time, edition int) (Key, error) {
+	if !lccnRegexp.MatchString(lccn) {
+		return Key{}, fmt.Errorf("%w: %q is not a valid LCCN", ErrInvalid, lccn)
+	}
+	if edition < 1 || edition > 99 {
+		return Key{}, fmt.Errorf("%w: edition %d must be from 1 to 99", ErrInvalid, edition)
+	}
+	var y, m, d = date.Date()
+	return Key{LCCN: lccn, Date: time.Date(y, m, d, 0, 0, 0, 0, time.UTC), Edition: edition}, nil
+}
+
+// FromParts builds a Key from the values found in batch and issue XML: an
+// LCCN, a YYYY-MM-DD date, and an edition order. An empty edition means 1.
+func FromParts(lccn, date, edition string) (Key, error) {
+	var t, err = time.Parse(ncaDateFormat, date)
+	if err != nil {
+		return Key{}, fmt.Errorf("%w: %q is not a valid YYYY-MM-DD issue date", ErrInvalid, date)
+	}
+	var ed = 1
+	if edition != "" {
+		ed, err = strconv.Atoi(edition)
+		if err != nil {
+			return Key{}, fmt.Errorf("%w: %q is not a valid edition", ErrInvalid, edition)
+		}
+	}
+	return New(lccn, t, ed)
+}
+
+// Parse reads a key in either NCA form (lccn/YYYY-MM-DD_ed) or chronam form
+// (lccn/YYYYMMDDee). Anything that could be read more than one way, such as
+// a key with no edition, is an error rather than a guess.
+func Parse(s string) (Key, error) {
+	var lccn, rest, ok = strings.Cut(strings.TrimSpace(s), "/")
+	if !ok || strings.Contains(rest, "/") {
+		return Key{}, fmt.Errorf("%w: %q must be <lccn>/<date and edition>", ErrInvalid, s)
+	}
+
+	var dateStr, edStr, layout string
+	if m := ncaRegexp.FindStringSubmatch(rest); m != nil {
+		dateStr, edStr, layout = m[1], m[2], ncaDateFormat
+	} else if m := chronamRegexp.FindStringSubmatch(rest); m != nil {
+		dateStr, edStr, layout = m[1], m[2], chronamDateFormat
+	} else {
+		return Key{}, fmt.Errorf("%w: %q %s", ErrInvalid, s, describe(rest))
+	}
+
+	var date, err = time.Parse(layout, dateStr)
+	if err != nil {
+		return Key{}, fmt.Errorf("%w: %q has an impossible date", ErrInvalid, s)
+	}
+	var ed, _ = strconv.Atoi(edStr)
+	return New(lccn, date, ed)
+}
+
+// describe explains why the date/edition part of a key couldn't be parsed,
+// calling out the common mix-ups
+func describe(rest string) string {
+	switch {
+	case ncaNoEdition.MatchString(rest):
+		return "is missing its edition; NCA keys look like lccn/YYYY-MM-DD_01"
+	case chronamNoEdition.MatchString(rest):
+		return "is missing its edition; chronam keys look like lccn/YYYYMMDD01"
+	case chronamShortEd.MatchString(rest):
+		return "is ambiguous: chronam keys must have a two-digit edition (lccn/YYYYMMDD01)"
+	case mixedForms.MatchString(rest):
+		return "mixes NCA and chronam forms; use lccn/YYYY-MM-DD_01 or lccn/YYYYMMDD01"
+	}
+	return "is neither an NCA key (lccn/YYYY-MM-DD_01) nor a chronam key (lccn/YYYYMMDD01)"
+}
+
+// NCA returns the key in NCA form, e.g., "sn96088442/1902-11-29_01"
+func (k Key) NCA() string {
+	return fmt.Sprintf("%s/%s_%02d", k.LCCN, k.Date.Format(ncaDateFormat), k.Edition)
+}
+
+// Chronam returns the key in ONI/chronam form, e.g., "sn96088442/1902112901"
+func (k Key) Chronam() string {
+	return k.LCCN + "/" + k.DateEdition()
+}
+
+// DateEdition returns the chronam date and edition without the LCCN, e.g.,
+// "1902112901", as used in issue directory and batch names
+func (k Key) DateEdition() string {
+	return fmt.Sprintf("%s%02d", k.Date.Format(chronamDateFormat), k.Edition)
+}
+
+// IssueDate returns the key's date as YYYY-MM-DD
+func (k Key) IssueDate() string {
+	return k.Date.Format(ncaDateFormat)
+}
+
+// String returns the chronam form, since that's what ONI uses
+func (k Key) String() string {
+	return k.Chronam()
+}
+
+// MarshalJSON writes both forms so clients never have to convert
+func (k Key) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ONI string `json:"oni"`
+		NCA string `json:"nca"`
+	}{k.Chronam(), k.NCA()})
+}
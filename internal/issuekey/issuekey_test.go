@@ -0,0 +1,70 @@
+package issuekey
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	var tests = map[string]struct {
+		input   string
+		chronam string
+		nca     string
+		errText string
+	}{
+		"nca":               {input: "sn96088442/1902-11-29_01", chronam: "sn96088442/1902112901", nca: "sn96088442/1902-11-29_01"},
+		"nca single digit":  {input: "sn96088442/1902-11-29_2", chronam: "sn96088442/1902112902", nca: "sn96088442/1902-11-29_02"},
+		"chronam":           {input: "sn96088442/1902112901", chronam: "sn96088442/1902112901", nca: "sn96088442/1902-11-29_01"},
+		"nca no edition":    {input: "sn96088442/1902-11-29", errText: "missing its edition"},
+		"chronam no ed":     {input: "sn96088442/19021129", errText: "missing its edition"},
+		"chronam short ed":  {input: "sn96088442/190211291", errText: "ambiguous"},
+		"mixed":             {input: "sn96088442/19021129_01", errText: "mixes NCA and chronam"},
+		"impossible date":   {input: "sn96088442/1902-02-30_01", errText: "impossible date"},
+		"no lccn separator": {input: "sn960884421902112901", errText: "must be <lccn>"},
+		"bad lccn":          {input: "SN96088442/1902112901", errText: "not a valid LCCN"},
+		"edition zero":      {input: "sn96088442/1902112900", errText: "edition 0"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var k, err = Parse(tc.input)
+			if tc.errText != "" {
+				if err == nil || !errors.Is(err, ErrInvalid) || !strings.Contains(err.Error(), tc.errText) {
+					t.Fatalf("Expected error containing %q, got %v (key %#v)", tc.errText, err, k)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if k.Chronam() != tc.chronam || k.NCA() != tc.nca {
+				t.Fatalf("Expected %q / %q, got %q / %q", tc.chronam, tc.nca, k.Chronam(), k.NCA())
+			}
+		})
+	}
+}
+
+func TestFromParts(t *testing.T) {
+	var k, err = FromParts("sn96088442", "1902-11-29", "")
+	if err != nil || k.DateEdition() != "1902112901" || k.IssueDate() != "1902-11-29" {
+		t.Fatalf("Expected edition 1 by default, got %#v (%v)", k, err)
+	}
+	_, err = FromParts("sn96088442", "11/29/1902", "01")
+	if err == nil {
+		t.Fatal("Expected an error for a non-ISO date")
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	var k, _ = Parse("sn96088442/1902-11-29_01")
+	var data, err = json.Marshal(k)
+	if err != nil {
+		t.Fatalf("Unable to marshal: %s", err)
+	}
+	var expected = `{"oni":"sn96088442/1902112901","nca":"sn96088442/1902-11-29_01"}`
+	if string(data) != expected {
+		t.Fatalf("Expected %s, got %s", expected, data)
+	}
+}
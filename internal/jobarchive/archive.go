@@ -0,0 +1,205 @@
+// Package jobarchive stores purged jobs as gzipped JSONL files so job history
+// can be kept around without growing the agent's in-memory store forever
+package jobarchive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/open-oni/oni-agent/internal/artifact"
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+const prefix = "jobs-"
+const suffix = ".jsonl.gz"
+
+// Archive reads and writes job archive files in an artifact store, which is
+// usually just a local directory
+type Archive struct {
+	store artifact.Store
+}
+
+// New returns an Archive rooted at dir, creating the directory if needed
+func New(dir string) (*Archive, error) {
+	var d, err = artifact.NewDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("creating archive dir %q: %w", dir, err)
+	}
+	return &Archive{store: d}, nil
+}
+
+// NewStore returns an Archive which keeps its files in s, e.g., an S3 bucket.
+// The archive expects to have s to itself, or at least that nothing else in s
+// is named like an archive file.
+func NewStore(s artifact.Store) *Archive {
+	return &Archive{store: s}
+}
+
+// Write implements queue.Archiver, storing the records in a new archive file.
+// The store never exposes a partially written file, so readers never see a
+// partial archive.
+func (a *Archive) Write(records []queue.Record) error {
+	var name = prefix + time.Now().UTC().Format("20060102T150405.000000000") + suffix
+
+	var pr, pw = io.Pipe()
+	go func() {
+		var gz = gzip.NewWriter(pw)
+		var enc = json.NewEncoder(gz)
+		var err error
+		for _, r := range records {
+			err = enc.Encode(r)
+			if err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = gz.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	var err = a.store.Put(name, pr)
+	pr.CloseWithError(err)
+	if err != nil {
+		return fmt.Errorf("writing archive file: %w", err)
+	}
+	return nil
+}
+
+// files returns the archive files' names, newest first
+func (a *Archive) files() ([]string, error) {
+	var infos, err = a.store.List()
+	if err != nil {
+		return nil, fmt.Errorf("reading archive: %w", err)
+	}
+
+	var list []string
+	for _, info := range infos {
+		if ValidName(info.Name) {
+			list = append(list, info.Name)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(list)))
+	return list, nil
+}
+
+// ValidName returns true if name could be one of an archive's files
+func ValidName(name string) bool {
+	return strings.HasPrefix(name, prefix) && strings.HasSuffix(name, suffix) && filepath.Base(name) == name
+}
+
+// Names returns the archive files' names, oldest first
+func (a *Archive) Names() ([]string, error) {
+	var list, err = a.files()
+	if err != nil {
+		return nil, err
+	}
+	var names = make([]string, len(list))
+	for i, name := range list {
+		names[len(list)-1-i] = name
+	}
+	return names, nil
+}
+
+// Open returns the raw (gzipped) contents of the named archive file
+func (a *Archive) Open(name string) (io.ReadCloser, error) {
+	if !ValidName(name) {
+		return nil, fmt.Errorf("%q is not a valid archive file name", name)
+	}
+	return a.store.Get(name)
+}
+
+// Import stores an archive file copied from another agent's archive under
+// its original name, which sorts it among this archive's files by when it
+// was first written. Like Write, it never leaves a partial file behind.
+func (a *Archive) Import(name string, r io.Reader) error {
+	if !ValidName(name) {
+		return fmt.Errorf("%q is not a valid archive file name", name)
+	}
+
+	var err = a.store.Put(name, r)
+	if err != nil {
+		return fmt.Errorf("importing archive file %q: %w", name, err)
+	}
+	return nil
+}
+
+// each calls fn for every archived record, newest archive file first
+func (a *Archive) each(fn func(r queue.Record)) error {
+	var list, err = a.files()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range list {
+		err = a.readFile(name, fn)
+		if err != nil {
+			return fmt.Errorf("reading %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (a *Archive) readFile(name string, fn func(r queue.Record)) error {
+	var f, err = a.store.Get(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var gz *gzip.Reader
+	gz, err = gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	var scanner = bufio.NewScanner(gz)
+	scanner.Buffer(nil, 1<<30)
+	for scanner.Scan() {
+		var r queue.Record
+		err = json.Unmarshal(scanner.Bytes(), &r)
+		if err != nil {
+			return err
+		}
+		fn(r)
+	}
+	return scanner.Err()
+}
+
+// Find returns all archived records with the given job id. Job ids restart
+// whenever the agent does, so there may be more than one.
+func (a *Archive) Find(id int64) ([]queue.Record, error) {
+	var found []queue.Record
+	var err = a.each(func(r queue.Record) {
+		if r.ID == id {
+			found = append(found, r)
+		}
+	})
+	return found, err
+}
+
+// List returns all archived records queued at or after since, minus their
+// logs, sorted by when they were queued
+func (a *Archive) List(since time.Time) ([]queue.Record, error) {
+	var list []queue.Record
+	var err = a.each(func(r queue.Record) {
+		if r.QueuedAt.Before(since) {
+			return
+		}
+		r.Stdout, r.Stderr = nil, nil
+		list = append(list, r)
+	})
+
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].QueuedAt.Before(list[j].QueuedAt)
+	})
+	return list, err
+}
@@ -0,0 +1,165 @@
+package jobarchive
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/open-oni/oni-agent/internal/artifact"
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+func TestWriteFindList(t *testing.T) {
+	var a, err = New(t.TempDir())
+	if err != nil {
+		t.Fatalf("Unable to create archive: %s", err)
+	}
+
+	var now = time.Now().UTC()
+	var first = []queue.Record{
+		{ID: 1, Name: "one", Status: queue.StatusSuccessful, QueuedAt: now.Add(-time.Hour * 48), Stdout: []string{"out"}},
+		{ID: 2, Name: "two", Status: queue.StatusFailed, QueuedAt: now.Add(-time.Hour * 24), Error: "exit status 1"},
+	}
+	var second = []queue.Record{
+		{ID: 1, Name: "one again", Status: queue.StatusSuccessful, QueuedAt: now.Add(-time.Hour)},
+	}
+	for _, recs := range [][]queue.Record{first, second} {
+		err = a.Write(recs)
+		if err != nil {
+			t.Fatalf("Unable to write archive: %s", err)
+		}
+		// File names are timestamped to the nanosecond, but let's not tempt fate
+		time.Sleep(time.Millisecond)
+	}
+
+	var found []queue.Record
+	found, err = a.Find(1)
+	if err != nil {
+		t.Fatalf("Unable to search archive: %s", err)
+	}
+	if len(found) != 2 {
+		t.Fatalf("expected 2 records for id 1, got %d", len(found))
+	}
+	if found[0].Name != "one again" {
+		t.Errorf("expected newest archive first, got %q", found[0].Name)
+	}
+	if found[1].Stdout[0] != "out" {
+		t.Errorf("expected logs to be archived, got %#v", found[1].Stdout)
+	}
+
+	var list []queue.Record
+	list, err = a.List(now.Add(-time.Hour * 30))
+	if err != nil {
+		t.Fatalf("Unable to list archive: %s", err)
+	}
+	if len(list) != 2 || list[0].ID != 2 || list[1].ID != 1 {
+		t.Fatalf("unexpected listing: %#v", list)
+	}
+}
+
+func TestWriteIgnoresStrayFiles(t *testing.T) {
+	var dir = t.TempDir()
+	var a, _ = New(dir)
+	var err = os.WriteFile(dir+"/jobs-partial.jsonl.gz.tmp", []byte("garbage"), 0600)
+	if err != nil {
+		t.Fatalf("Unable to write test file: %s", err)
+	}
+
+	var list []queue.Record
+	list, err = a.List(time.Time{})
+	if err != nil {
+		t.Fatalf("temp files should be ignored, got error: %s", err)
+	}
+	if len(list) != 0 {
+		t.Fatalf("expected no records, got %d", len(list))
+	}
+}
+
+func TestImport(t *testing.T) {
+	var src, _ = New(t.TempDir())
+	var dst, _ = New(t.TempDir())
+	var err = src.Write([]queue.Record{{ID: 7, Name: "moved", QueuedAt: time.Now()}})
+	if err != nil {
+		t.Fatalf("Unable to write archive: %s", err)
+	}
+
+	var names []string
+	names, err = src.Names()
+	if err != nil || len(names) != 1 {
+		t.Fatalf("Expected one archive file, got %v (%v)", names, err)
+	}
+	var f, _ = src.Open(names[0])
+	err = dst.Import(names[0], f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Unable to import archive file: %s", err)
+	}
+
+	var found []queue.Record
+	found, err = dst.Find(7)
+	if err != nil || len(found) != 1 || found[0].Name != "moved" {
+		t.Fatalf("Expected the imported job to be found, got %#v (%v)", found, err)
+	}
+
+	for _, name := range []string{"../jobs-x.jsonl.gz", "queue.json"} {
+		if dst.Import(name, strings.NewReader("")) == nil {
+			t.Errorf("Expected %q to be refused", name)
+		}
+	}
+}
+
+// memStore is an artifact store that just keeps everything in memory
+type memStore map[string][]byte
+
+func (m memStore) Put(name string, r io.Reader) error {
+	var data, err = io.ReadAll(r)
+	if err == nil {
+		m[name] = data
+	}
+	return err
+}
+
+func (m memStore) Get(name string) (io.ReadCloser, error) {
+	var data, ok = m[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m memStore) List() ([]artifact.Info, error) {
+	var list []artifact.Info
+	for name, data := range m {
+		list = append(list, artifact.Info{Name: name, Size: int64(len(data))})
+	}
+	return list, nil
+}
+
+func (m memStore) URL(string, time.Duration) (string, error) { return "", nil }
+
+func TestStore(t *testing.T) {
+	var store = memStore{"report.json": []byte("{}")}
+	var a = NewStore(store)
+	var err = a.Write([]queue.Record{{ID: 4, Name: "stored", QueuedAt: time.Now(), Stdout: []string{"out"}}})
+	if err != nil {
+		t.Fatalf("Unable to write archive: %s", err)
+	}
+	if len(store) != 2 {
+		t.Fatalf("Expected one archive file beside the other artifact, got %d files", len(store))
+	}
+
+	var found []queue.Record
+	found, err = a.Find(4)
+	if err != nil || len(found) != 1 || found[0].Stdout[0] != "out" {
+		t.Fatalf("Expected the stored job and its logs to be found, got %#v (%v)", found, err)
+	}
+
+	var names []string
+	names, err = a.Names()
+	if err != nil || len(names) != 1 || !ValidName(names[0]) {
+		t.Fatalf("Expected only the archive file to be named, got %v (%v)", names, err)
+	}
+}
@@ -0,0 +1,333 @@
+// Package jp2 reads just enough of a JPEG 2000 (JP2) file's headers to check
+// it against a profile, such as the one NDNP requires for newspaper page
+// images. Image data is never decoded, so checks are fast even on large
+// files.
+package jp2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrNotJP2 is returned for files which don't start with the JP2 signature
+var ErrNotJP2 = errors.New("not a JP2 file")
+
+// Progression orders, as numbered in the COD marker
+var progressionOrders = []string{"LRCP", "RLCP", "RPCL", "PCRL", "CPRL"}
+
+// Info is the header data relevant to profile checks
+type Info struct {
+	Brand            string `json:"brand"`
+	Width            uint32 `json:"width"`
+	Height           uint32 `json:"height"`
+	Components       uint16 `json:"components"`
+	BitsPerComponent uint8  `json:"bits_per_component"`
+	Colorspace       uint32 `json:"colorspace"`
+
+	// Tiled is true if the codestream's tile size is smaller than the image
+	Tiled bool `json:"tiled"`
+
+	Progression      string `json:"progression"`
+	Layers           uint16 `json:"layers"`
+	Levels           uint8  `json:"levels"`
+	CodeBlockWidth   int    `json:"code_block_width"`
+	CodeBlockHeight  int    `json:"code_block_height"`
+	Irreversible     bool   `json:"irreversible"`
+	MultiComponentTx bool   `json:"multi_component_transform"`
+}
+
+// Colorspaces from the colr box's enumerated method
+const (
+	ColorspaceSRGB      = 16
+	ColorspaceGreyscale = 17
+)
+
+// box is a JP2 box header
+type box struct {
+	typ    string
+	length int64 // of the contents, or -1 for "to end of file"
+}
+
+// readBox reads the next box header from r
+func readBox(r io.Reader) (box, error) {
+	var hdr [8]byte
+	var _, err = io.ReadFull(r, hdr[:])
+	if err != nil {
+		return box{}, err
+	}
+
+	var b = box{typ: string(hdr[4:])}
+	var l = int64(binary.BigEndian.Uint32(hdr[:4]))
+	switch l {
+	case 0:
+		b.length = -1
+	case 1:
+		var xl [8]byte
+		_, err = io.ReadFull(r, xl[:])
+		if err != nil {
+			return box{}, err
+		}
+		b.length = int64(binary.BigEndian.Uint64(xl[:])) - 16
+	default:
+		b.length = l - 8
+	}
+	if b.length < -1 {
+		return box{}, fmt.Errorf("invalid length for %q box", b.typ)
+	}
+	return b, nil
+}
+
+// Read parses the JP2 headers from r: the signature, file type, image
+// header, color specification, and the codestream's SIZ and COD markers.
+// Boxes which don't matter are skipped.
+func Read(r io.ReadSeeker) (*Info, error) {
+	var b, err = readBox(r)
+	if err != nil || b.typ != "jP  " || b.length != 4 {
+		return nil, ErrNotJP2
+	}
+	var sig [4]byte
+	_, err = io.ReadFull(r, sig[:])
+	if err != nil || binary.BigEndian.Uint32(sig[:]) != 0x0D0A870A {
+		return nil, ErrNotJP2
+	}
+
+	var info = &Info{}
+	var sawHeader bool
+	for {
+		b, err = readBox(r)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading box: %w", err)
+		}
+
+		switch b.typ {
+		case "ftyp":
+			var data []byte
+			data, err = readContents(r, b, 1024)
+			if err == nil && len(data) < 4 {
+				err = errors.New("too short")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("reading file type box: %w", err)
+			}
+			info.Brand = string(data[:4])
+
+		case "jp2h":
+			// jp2h is a superbox: its children follow directly, so we just keep
+			// reading boxes
+			sawHeader = true
+			continue
+
+		case "ihdr":
+			var data []byte
+			data, err = readContents(r, b, 14)
+			if err == nil && len(data) != 14 {
+				err = errors.New("wrong length")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("reading image header: %w", err)
+			}
+			info.Height = binary.BigEndian.Uint32(data[0:4])
+			info.Width = binary.BigEndian.Uint32(data[4:8])
+			info.Components = binary.BigEndian.Uint16(data[8:10])
+			info.BitsPerComponent = data[10] + 1
+
+		case "colr":
+			var data []byte
+			data, err = readContents(r, b, 1<<20)
+			if err != nil {
+				return nil, fmt.Errorf("reading color specification: %w", err)
+			}
+			if len(data) >= 7 && data[0] == 1 {
+				info.Colorspace = binary.BigEndian.Uint32(data[3:7])
+			}
+
+		case "jp2c":
+			if !sawHeader {
+				return nil, errors.New("codestream found before JP2 header")
+			}
+			err = readCodestream(r, info)
+			if err != nil {
+				return nil, fmt.Errorf("reading codestream: %w", err)
+			}
+			return info, nil
+
+		default:
+			if b.length < 0 {
+				break
+			}
+			_, err = r.Seek(b.length, io.SeekCurrent)
+			if err != nil {
+				return nil, fmt.Errorf("skipping %q box: %w", b.typ, err)
+			}
+		}
+	}
+
+	return nil, errors.New("no codestream found")
+}
+
+// readContents reads a box's contents, refusing anything over max bytes
+func readContents(r io.Reader, b box, max int64) ([]byte, error) {
+	if b.length < 0 || b.length > max {
+		return nil, fmt.Errorf("unexpected length %d", b.length)
+	}
+	var data = make([]byte, b.length)
+	var _, err = io.ReadFull(r, data)
+	return data, err
+}
+
+// Codestream markers
+const (
+	markerSOC = 0xFF4F
+	markerSIZ = 0xFF51
+	markerCOD = 0xFF52
+	markerSOT = 0xFF90
+)
+
+// readCodestream reads the codestream's main header up to the first tile,
+// filling in the SIZ and COD data
+func readCodestream(r io.Reader, info *Info) error {
+	var soc uint16
+	var err = binary.Read(r, binary.BigEndian, &soc)
+	if err != nil || soc != markerSOC {
+		return errors.New("missing start of codestream marker")
+	}
+
+	var sawSIZ, sawCOD bool
+	for !sawSIZ || !sawCOD {
+		var marker, length uint16
+		err = binary.Read(r, binary.BigEndian, &marker)
+		if err == nil && marker != markerSOT {
+			err = binary.Read(r, binary.BigEndian, &length)
+		}
+		if err != nil {
+			return err
+		}
+		if marker == markerSOT {
+			break
+		}
+		if length < 2 {
+			return fmt.Errorf("invalid marker segment length %d", length)
+		}
+
+		var seg = make([]byte, length-2)
+		_, err = io.ReadFull(r, seg)
+		if err != nil {
+			return err
+		}
+
+		switch marker {
+		case markerSIZ:
+			if len(seg) < 36 {
+				return errors.New("SIZ marker too short")
+			}
+			var xsiz, ysiz = binary.BigEndian.Uint32(seg[2:6]), binary.BigEndian.Uint32(seg[6:10])
+			var xosiz, yosiz = binary.BigEndian.Uint32(seg[10:14]), binary.BigEndian.Uint32(seg[14:18])
+			var xtsiz, ytsiz = binary.BigEndian.Uint32(seg[18:22]), binary.BigEndian.Uint32(seg[22:26])
+			info.Tiled = xtsiz < xsiz-xosiz || ytsiz < ysiz-yosiz
+			sawSIZ = true
+
+		case markerCOD:
+			if len(seg) < 10 {
+				return errors.New("COD marker too short")
+			}
+			if int(seg[1]) < len(progressionOrders) {
+				info.Progression = progressionOrders[seg[1]]
+			} else {
+				info.Progression = fmt.Sprintf("unknown (%d)", seg[1])
+			}
+			info.Layers = binary.BigEndian.Uint16(seg[2:4])
+			info.MultiComponentTx = seg[4] != 0
+			info.Levels = seg[5]
+			info.CodeBlockWidth = 1 << (seg[6] + 2)
+			info.CodeBlockHeight = 1 << (seg[7] + 2)
+			info.Irreversible = seg[9] == 0
+			sawCOD = true
+		}
+	}
+
+	if !sawSIZ || !sawCOD {
+		return errors.New("main header is missing SIZ or COD marker")
+	}
+	return nil
+}
+
+// Profile lists the header values a JP2 must have to comply. Zero values
+// aren't checked.
+type Profile struct {
+	Name             string
+	Progression      string
+	Layers           uint16
+	Levels           uint8
+	CodeBlockSize    int
+	Irreversible     bool
+	BitsPerComponent uint8
+
+	// Components lists the allowed numbers of components, e.g., 1 for
+	// greyscale and 3 for color
+	Components []uint16
+
+	// Untiled requires the image to be a single tile
+	Untiled bool
+}
+
+// NDNP is the JP2 profile from the NDNP technical guidelines for page images
+var NDNP = Profile{
+	Name:             "NDNP",
+	Progression:      "RLCP",
+	Layers:           25,
+	Levels:           6,
+	CodeBlockSize:    64,
+	Irreversible:     true,
+	BitsPerComponent: 8,
+	Components:       []uint16{1, 3},
+}
+
+// Check returns a description of every way info violates the profile, or
+// nil if it complies
+func (p Profile) Check(info *Info) []string {
+	var problems []string
+	var fail = func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if info.Brand != "jp2 " {
+		fail("brand is %q, not \"jp2 \"", info.Brand)
+	}
+	if p.Progression != "" && info.Progression != p.Progression {
+		fail("progression order is %s, not %s", info.Progression, p.Progression)
+	}
+	if p.Layers != 0 && info.Layers != p.Layers {
+		fail("%d quality layers, not %d", info.Layers, p.Layers)
+	}
+	if p.Levels != 0 && info.Levels != p.Levels {
+		fail("%d decomposition levels, not %d", info.Levels, p.Levels)
+	}
+	if p.CodeBlockSize != 0 && (info.CodeBlockWidth != p.CodeBlockSize || info.CodeBlockHeight != p.CodeBlockSize) {
+		fail("code blocks are %dx%d, not %dx%d", info.CodeBlockWidth, info.CodeBlockHeight, p.CodeBlockSize, p.CodeBlockSize)
+	}
+	if p.Irreversible && !info.Irreversible {
+		fail("uses the reversible 5-3 wavelet, not the irreversible 9-7 wavelet")
+	}
+	if p.BitsPerComponent != 0 && info.BitsPerComponent != p.BitsPerComponent {
+		fail("%d bits per component, not %d", info.BitsPerComponent, p.BitsPerComponent)
+	}
+	if len(p.Components) > 0 {
+		var ok bool
+		for _, n := range p.Components {
+			ok = ok || info.Components == n
+		}
+		if !ok {
+			fail("%d components, expected one of %v", info.Components, p.Components)
+		}
+	}
+	if p.Untiled && info.Tiled {
+		fail("image is tiled")
+	}
+
+	return problems
+}
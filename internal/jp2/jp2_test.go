@@ -0,0 +1,111 @@
+package jp2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testImage describes the header values to write into a synthetic JP2
+type testImage struct {
+	progression byte
+	layers      uint16
+	levels      byte
+	components  uint16
+	reversible  bool
+	tile        uint32
+}
+
+func mkbox(typ string, contents ...[]byte) []byte {
+	var data = bytes.Join(contents, nil)
+	var out = binary.BigEndian.AppendUint32(nil, uint32(len(data)+8))
+	out = append(out, typ...)
+	return append(out, data...)
+}
+
+func be16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func be32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+
+// build returns a JP2 file with a minimal set of boxes and a codestream main
+// header; there's no actual image data
+func (ti testImage) build() []byte {
+	var ihdr = bytes.Join([][]byte{be32(2000), be32(1500), be16(ti.components), {7, 7, 0, 0}}, nil)
+	var colr = append([]byte{1, 0, 0}, be32(ColorspaceGreyscale)...)
+
+	var siz = bytes.Join([][]byte{
+		be16(0), be32(1500), be32(2000), be32(0), be32(0), be32(ti.tile), be32(ti.tile), be32(0), be32(0),
+		be16(ti.components),
+	}, nil)
+	for range ti.components {
+		siz = append(siz, 7, 1, 1)
+	}
+	var transform byte
+	if ti.reversible {
+		transform = 1
+	}
+	var cod = bytes.Join([][]byte{{0, ti.progression}, be16(ti.layers), {0, ti.levels, 4, 4, 0, transform}}, nil)
+	var codestream = bytes.Join([][]byte{
+		be16(markerSOC),
+		be16(markerSIZ), be16(uint16(len(siz) + 2)), siz,
+		be16(markerCOD), be16(uint16(len(cod) + 2)), cod,
+		be16(markerSOT), make([]byte, 16),
+	}, nil)
+
+	return bytes.Join([][]byte{
+		mkbox("jP  ", be32(0x0D0A870A)),
+		mkbox("ftyp", []byte("jp2 "), be32(0), []byte("jp2 ")),
+		mkbox("xml ", []byte("<skipped/>")),
+		mkbox("jp2h", mkbox("ihdr", ihdr), mkbox("colr", colr)),
+		mkbox("jp2c", codestream),
+	}, nil)
+}
+
+// ndnpImage is a synthetic image which complies with the NDNP profile
+var ndnpImage = testImage{progression: 1, layers: 25, levels: 6, components: 1, tile: 2000}
+
+func TestRead(t *testing.T) {
+	var info, err = Read(bytes.NewReader(ndnpImage.build()))
+	if err != nil {
+		t.Fatalf("Unable to read JP2: %s", err)
+	}
+
+	var expected = Info{
+		Brand: "jp2 ", Width: 1500, Height: 2000, Components: 1, BitsPerComponent: 8,
+		Colorspace: ColorspaceGreyscale, Progression: "RLCP", Layers: 25, Levels: 6,
+		CodeBlockWidth: 64, CodeBlockHeight: 64, Irreversible: true,
+	}
+	if *info != expected {
+		t.Fatalf("Expected %#v, got %#v", expected, *info)
+	}
+	if problems := NDNP.Check(info); problems != nil {
+		t.Fatalf("Expected NDNP compliance, got %q", problems)
+	}
+}
+
+func TestCheckViolations(t *testing.T) {
+	var img = ndnpImage
+	img.progression = 0
+	img.layers = 1
+	img.reversible = true
+	img.components = 4
+
+	var info, err = Read(bytes.NewReader(img.build()))
+	if err != nil {
+		t.Fatalf("Unable to read JP2: %s", err)
+	}
+	var problems = strings.Join(NDNP.Check(info), "; ")
+	for _, want := range []string{"progression order is LRCP", "1 quality layers", "reversible", "4 components"} {
+		if !strings.Contains(problems, want) {
+			t.Errorf("Expected problems to include %q, got %q", want, problems)
+		}
+	}
+}
+
+func TestReadNotJP2(t *testing.T) {
+	var _, err = Read(bytes.NewReader([]byte("II*\x00 this is a TIFF")))
+	if !errors.Is(err, ErrNotJP2) {
+		t.Fatalf("Expected ErrNotJP2, got %v", err)
+	}
+}
@@ -0,0 +1,241 @@
+// Package jsonschema validates decoded JSON against the small subset of JSON
+// Schema the agent uses to describe its responses: type, enum, properties,
+// required, items, and additionalProperties. Anything else in a schema is an
+// error when it's parsed, so a schema can't quietly promise more than is
+// checked.
+package jsonschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Schema is a single JSON Schema, or a subschema of one
+type Schema struct {
+	Schema      string `json:"$schema,omitempty"`
+	ID          string `json:"$id,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+
+	Type                 Types              `json:"type,omitempty"`
+	Enum                 []any              `json:"enum,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+}
+
+// Types is a schema's "type": a single type name or a list of them
+type Types []string
+
+// UnmarshalJSON accepts either form of "type"
+func (t *Types) UnmarshalJSON(data []byte) error {
+	var one string
+	if json.Unmarshal(data, &one) == nil {
+		*t = Types{one}
+		return nil
+	}
+	var list []string
+	var err = json.Unmarshal(data, &list)
+	if err != nil {
+		return fmt.Errorf("type must be a string or a list of strings")
+	}
+	*t = list
+	return nil
+}
+
+// MarshalJSON writes a single type as a plain string
+func (t Types) MarshalJSON() ([]byte, error) {
+	if len(t) == 1 {
+		return json.Marshal(t[0])
+	}
+	return json.Marshal([]string(t))
+}
+
+var knownTypes = map[string]bool{
+	"object": true, "array": true, "string": true, "integer": true,
+	"number": true, "boolean": true, "null": true,
+}
+
+// Parse decodes a schema, refusing keywords this package doesn't check and
+// type names JSON Schema doesn't have
+func Parse(data []byte) (*Schema, error) {
+	var dec = json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var s Schema
+	var err = dec.Decode(&s)
+	if err != nil {
+		return nil, fmt.Errorf("parsing schema: %w", err)
+	}
+	err = s.check("")
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// check makes sure every type name in s and its subschemas is valid
+func (s *Schema) check(path string) error {
+	for _, t := range s.Type {
+		if !knownTypes[t] {
+			return fmt.Errorf("parsing schema: %s: unknown type %q", pointer(path), t)
+		}
+	}
+	for name, sub := range s.Properties {
+		var err = sub.check(path + "/properties/" + name)
+		if err != nil {
+			return err
+		}
+	}
+	for _, sub := range []*Schema{s.Items, s.AdditionalProperties} {
+		if sub == nil {
+			continue
+		}
+		var err = sub.check(path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidationError lists everything about a value which doesn't match its
+// schema, each problem prefixed with a JSON pointer to where it is
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid value: " + strings.Join(e.Problems, "; ")
+}
+
+// Validate checks v, which must be what encoding/json decodes into an any
+// (map[string]any, []any, string, float64 or json.Number, bool, or nil),
+// returning a *ValidationError if it doesn't match the schema
+func (s *Schema) Validate(v any) error {
+	var problems []string
+	s.validate("", v, &problems)
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// ValidateJSON decodes data and validates it
+func (s *Schema) ValidateJSON(data []byte) error {
+	var dec = json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	var err = dec.Decode(&v)
+	if err != nil {
+		return fmt.Errorf("decoding value: %w", err)
+	}
+	return s.Validate(v)
+}
+
+func pointer(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+func (s *Schema) validate(path string, v any, problems *[]string) {
+	var fail = func(format string, args ...any) {
+		*problems = append(*problems, pointer(path)+": "+fmt.Sprintf(format, args...))
+	}
+
+	if len(s.Type) > 0 && !s.Type.match(v) {
+		fail("expected %s, got %s", strings.Join(s.Type, " or "), typeName(v))
+		return
+	}
+	if len(s.Enum) > 0 && !inEnum(s.Enum, v) {
+		fail("%v is not one of %v", v, s.Enum)
+	}
+
+	switch val := v.(type) {
+	case map[string]any:
+		for _, name := range s.Required {
+			if _, ok := val[name]; !ok {
+				fail("missing required property %q", name)
+			}
+		}
+		var names = make([]string, 0, len(val))
+		for name := range val {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			var sub = s.Properties[name]
+			if sub == nil {
+				sub = s.AdditionalProperties
+			}
+			if sub != nil {
+				sub.validate(path+"/"+name, val[name], problems)
+			}
+		}
+	case []any:
+		if s.Items != nil {
+			for i, item := range val {
+				s.Items.validate(fmt.Sprintf("%s/%d", path, i), item, problems)
+			}
+		}
+	}
+}
+
+// match returns true if v is one of the types
+func (t Types) match(v any) bool {
+	var name = typeName(v)
+	for _, want := range t {
+		if want == name || (want == "number" && name == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// typeName returns the JSON Schema type of a decoded value. Whole numbers
+// are integers; any other number is just a number.
+func typeName(v any) string {
+	switch val := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	case float64:
+		if val == math.Trunc(val) {
+			return "integer"
+		}
+		return "number"
+	case json.Number:
+		if _, err := val.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// inEnum returns true if v equals one of the enum's values. Numbers are
+// compared by value, whichever way they were decoded.
+func inEnum(enum []any, v any) bool {
+	if n, ok := v.(json.Number); ok {
+		v, _ = n.Float64()
+	}
+	for _, e := range enum {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
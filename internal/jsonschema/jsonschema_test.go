@@ -0,0 +1,79 @@
+package jsonschema
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const testSchema = `{
+	"type": "object",
+	"required": ["status", "jobs"],
+	"properties": {
+		"status": {"type": "string", "enum": ["success", "error"]},
+		"count": {"type": "integer"},
+		"jobs": {
+			"type": ["array", "null"],
+			"items": {
+				"type": "object",
+				"required": ["id"],
+				"properties": {"id": {"type": "integer"}, "seconds": {"type": "number"}}
+			}
+		},
+		"labels": {"type": "object", "additionalProperties": {"type": "array", "items": {"type": "string"}}}
+	}
+}`
+
+func TestValidate(t *testing.T) {
+	var s, err = Parse([]byte(testSchema))
+	if err != nil {
+		t.Fatalf("Unable to parse schema: %s", err)
+	}
+
+	var tests = map[string]struct {
+		json     string
+		problems []string
+	}{
+		"valid":         {json: `{"status": "success", "count": 2, "jobs": [{"id": 1, "seconds": 1.5}, {"id": 2, "seconds": 3}], "extra": true}`},
+		"null jobs":     {json: `{"status": "error", "jobs": null}`},
+		"labels":        {json: `{"status": "success", "jobs": [], "labels": {"lccn": ["sn1", "sn2"]}}`},
+		"not an object": {json: `[]`, problems: []string{"/: expected object, got array"}},
+		"missing":       {json: `{"status": "success"}`, problems: []string{`/: missing required property "jobs"`}},
+		"bad enum":      {json: `{"status": "ok", "jobs": []}`, problems: []string{"/status: ok is not one of [success error]"}},
+		"fraction":      {json: `{"status": "success", "count": 1.5, "jobs": []}`, problems: []string{"/count: expected integer, got number"}},
+		"nested":        {json: `{"status": "success", "jobs": [{"id": 1}, {"seconds": "no"}]}`, problems: []string{`/jobs/1: missing required property "id"`, "/jobs/1/seconds: expected number, got string"}},
+		"bad label":     {json: `{"status": "success", "jobs": [], "labels": {"lccn": [7]}}`, problems: []string{"/labels/lccn/0: expected string, got integer"}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var err = s.ValidateJSON([]byte(tc.json))
+			if len(tc.problems) == 0 {
+				if err != nil {
+					t.Fatalf("Expected no error, got %s", err)
+				}
+				return
+			}
+			var verr *ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("Expected a validation error, got %v", err)
+			}
+			if strings.Join(verr.Problems, "\n") != strings.Join(tc.problems, "\n") {
+				t.Fatalf("Expected problems %q, got %q", tc.problems, verr.Problems)
+			}
+		})
+	}
+}
+
+func TestParseRefusesUnsupported(t *testing.T) {
+	for _, schema := range []string{
+		`{"type": "object", "minProperties": 1}`,
+		`{"type": "text"}`,
+		`{"properties": {"a": {"type": ["string", "date"]}}}`,
+	} {
+		var _, err = Parse([]byte(schema))
+		if err == nil {
+			t.Errorf("Expected %s to be refused", schema)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Package latency keeps simple aggregate timing statistics, e.g., for how long
+// commands and database queries take
+package latency
+
+import (
+	"sync"
+	"time"
+)
+
+// Summary is a point-in-time snapshot of one operation's timing statistics.
+// Durations are reported in milliseconds so they're easy to read in JSON.
+type Summary struct {
+	Count  int64   `json:"count"`
+	Errors int64   `json:"errors"`
+	Slow   int64   `json:"slow"`
+	AvgMS  float64 `json:"avg_ms"`
+	MaxMS  float64 `json:"max_ms"`
+	LastMS float64 `json:"last_ms"`
+}
+
+type stats struct {
+	count  int64
+	errors int64
+	slow   int64
+	total  time.Duration
+	max    time.Duration
+	last   time.Duration
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// Tracker aggregates timings by operation name. It's safe for concurrent use.
+type Tracker struct {
+	m         sync.Mutex
+	threshold time.Duration
+	ops       map[string]*stats
+}
+
+// NewTracker returns a Tracker which counts any operation taking longer than
+// threshold as slow. A zero threshold means nothing is ever considered slow.
+func NewTracker(threshold time.Duration) *Tracker {
+	return &Tracker{threshold: threshold, ops: make(map[string]*stats)}
+}
+
+// Threshold returns the tracker's slow-operation threshold
+func (t *Tracker) Threshold() time.Duration {
+	return t.threshold
+}
+
+// Observe records a single operation's duration and whether it failed,
+// returning true if the operation was slow
+func (t *Tracker) Observe(name string, d time.Duration, failed bool) (slow bool) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	var s = t.ops[name]
+	if s == nil {
+		s = &stats{}
+		t.ops[name] = s
+	}
+
+	slow = t.threshold > 0 && d > t.threshold
+	s.count++
+	s.total += d
+	s.last = d
+	if d > s.max {
+		s.max = d
+	}
+	if failed {
+		s.errors++
+	}
+	if slow {
+		s.slow++
+	}
+	return slow
+}
+
+// Summaries returns a snapshot of every operation's statistics
+func (t *Tracker) Summaries() map[string]Summary {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	var out = make(map[string]Summary, len(t.ops))
+	for name, s := range t.ops {
+		out[name] = s.summary()
+	}
+	return out
+}
+
+// Total returns statistics aggregated across all operations. LastMS is
+// always zero since there's no single "last" operation across names.
+func (t *Tracker) Total() Summary {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	var all stats
+	for _, s := range t.ops {
+		all.count += s.count
+		all.errors += s.errors
+		all.slow += s.slow
+		all.total += s.total
+		if s.max > all.max {
+			all.max = s.max
+		}
+	}
+	return all.summary()
+}
+
+func (s *stats) summary() Summary {
+	var sum = Summary{Count: s.count, Errors: s.errors, Slow: s.slow, MaxMS: ms(s.max), LastMS: ms(s.last)}
+	if s.count > 0 {
+		sum.AvgMS = ms(s.total / time.Duration(s.count))
+	}
+	return sum
+}
@@ -0,0 +1,38 @@
+package latency
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTracker(t *testing.T) {
+	var tr = NewTracker(time.Millisecond * 100)
+	tr.Observe("fast", time.Millisecond*10, false)
+	tr.Observe("fast", time.Millisecond*30, true)
+	if !tr.Observe("slow", time.Millisecond*500, false) {
+		t.Errorf("Expected 500ms to be reported as slow")
+	}
+
+	var expected = map[string]Summary{
+		"fast": {Count: 2, Errors: 1, AvgMS: 20, MaxMS: 30, LastMS: 30},
+		"slow": {Count: 1, Slow: 1, AvgMS: 500, MaxMS: 500, LastMS: 500},
+	}
+	var diff = cmp.Diff(expected, tr.Summaries())
+	if diff != "" {
+		t.Errorf("Unexpected summaries: %s", diff)
+	}
+
+	diff = cmp.Diff(Summary{Count: 3, Errors: 1, Slow: 1, AvgMS: 180, MaxMS: 500}, tr.Total())
+	if diff != "" {
+		t.Errorf("Unexpected total: %s", diff)
+	}
+}
+
+func TestNoThreshold(t *testing.T) {
+	var tr = NewTracker(0)
+	if tr.Observe("x", time.Hour, false) {
+		t.Errorf("Nothing should be slow without a threshold")
+	}
+}
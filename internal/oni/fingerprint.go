@@ -0,0 +1,117 @@
+package oni
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Fingerprint identifies the ONI install the agent runs commands against.
+// When ops moves ONI or rebuilds its virtual environment, the fingerprint
+// changes, which lets the agent point out that jobs queued (or archived)
+// earlier ran against something else.
+type Fingerprint struct {
+	// Path is the ONI_LOCATION the fingerprint was taken from
+	Path string `json:"path"`
+
+	// ManagePy is the SHA-256 of manage.py
+	ManagePy string `json:"manage_py"`
+
+	// Python is the virtual environment's Python version
+	Python string `json:"python"`
+
+	// Settings is the Django settings module manage.py uses
+	Settings string `json:"settings"`
+}
+
+var settingsRegexp = regexp.MustCompile(`DJANGO_SETTINGS_MODULE["']\s*,\s*["']([^"']+)["']`)
+
+// TakeFingerprint inspects the ONI install at oniPath. Anything which can't be
+// determined is left empty and reported in the returned error, but the
+// fingerprint is still usable: an unreadable manage.py is itself something
+// worth noticing when comparing against a previous fingerprint.
+func TakeFingerprint(oniPath string) (Fingerprint, error) {
+	var fp = Fingerprint{Path: oniPath}
+	var errs []error
+
+	var data, err = os.ReadFile(filepath.Join(oniPath, "manage.py"))
+	if err != nil {
+		errs = append(errs, fmt.Errorf("reading manage.py: %w", err))
+	} else {
+		var sum = sha256.Sum256(data)
+		fp.ManagePy = hex.EncodeToString(sum[:])
+		var m = settingsRegexp.FindSubmatch(data)
+		if m != nil {
+			fp.Settings = string(m[1])
+		}
+	}
+
+	fp.Python, err = pythonVersion(filepath.Join(oniPath, "ENV"))
+	if err != nil {
+		errs = append(errs, fmt.Errorf("reading Python version: %w", err))
+	}
+
+	return fp, errors.Join(errs...)
+}
+
+// pythonVersion reads the version out of a virtual environment's pyvenv.cfg
+func pythonVersion(envPath string) (string, error) {
+	var f, err = os.Open(filepath.Join(envPath, "pyvenv.cfg"))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var version string
+	var s = bufio.NewScanner(f)
+	for s.Scan() {
+		var key, val, ok = strings.Cut(s.Text(), "=")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		// Older virtualenvs write version, newer ones version_info; the stdlib
+		// venv module writes version. If both exist they agree.
+		case "version", "version_info":
+			version = strings.TrimSpace(val)
+		}
+	}
+	if s.Err() != nil {
+		return "", s.Err()
+	}
+	if version == "" {
+		return "", errors.New("no version in pyvenv.cfg")
+	}
+	return version, nil
+}
+
+// ID returns a short identifier for the fingerprint, suitable for stamping on
+// jobs
+func (fp Fingerprint) ID() string {
+	var sum = sha256.Sum256([]byte(strings.Join([]string{fp.Path, fp.ManagePy, fp.Python, fp.Settings}, "\x00")))
+	return hex.EncodeToString(sum[:6])
+}
+
+// Changes describes how fp differs from an earlier fingerprint, returning
+// nothing if they're the same
+func (fp Fingerprint) Changes(old Fingerprint) []string {
+	var changes []string
+	var check = func(what, before, after string) {
+		if before != after {
+			changes = append(changes, fmt.Sprintf("%s changed from %q to %q", what, before, after))
+		}
+	}
+	check("ONI location", old.Path, fp.Path)
+	if old.ManagePy != fp.ManagePy {
+		changes = append(changes, "manage.py changed")
+	}
+	check("Python version", old.Python, fp.Python)
+	check("settings module", old.Settings, fp.Settings)
+	return changes
+}
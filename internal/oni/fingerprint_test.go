@@ -0,0 +1,60 @@
+package oni
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeONI(t *testing.T, dir, manage, pyvenv string) {
+	os.MkdirAll(filepath.Join(dir, "ENV"), 0755)
+	var err = os.WriteFile(filepath.Join(dir, "manage.py"), []byte(manage), 0755)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, "ENV", "pyvenv.cfg"), []byte(pyvenv), 0644)
+	}
+	if err != nil {
+		t.Fatalf("Unable to write test ONI install: %s", err)
+	}
+}
+
+func TestTakeFingerprint(t *testing.T) {
+	var dir = t.TempDir()
+	var manage = "#!/usr/bin/env python\nimport os\nos.environ.setdefault(\"DJANGO_SETTINGS_MODULE\", \"onisite.settings\")\n"
+	writeONI(t, dir, manage, "home = /usr/bin\nversion = 3.12.3\n")
+
+	var fp, err = TakeFingerprint(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if fp.Python != "3.12.3" || fp.Settings != "onisite.settings" || fp.ManagePy == "" {
+		t.Fatalf("Unexpected fingerprint: %#v", fp)
+	}
+
+	var same, _ = TakeFingerprint(dir)
+	if same.ID() != fp.ID() || len(same.Changes(fp)) != 0 {
+		t.Fatalf("Expected an unchanged install to have the same fingerprint")
+	}
+
+	writeONI(t, dir, strings.Replace(manage, "onisite", "mysite", 1), "version_info = 3.13.0.final.0\n")
+	var changed, _ = TakeFingerprint(dir)
+	if changed.ID() == fp.ID() {
+		t.Fatal("Expected a changed install to have a different fingerprint ID")
+	}
+	var changes = strings.Join(changed.Changes(fp), "; ")
+	for _, want := range []string{"manage.py changed", `Python version changed from "3.12.3" to "3.13.0.final.0"`, "settings module"} {
+		if !strings.Contains(changes, want) {
+			t.Errorf("Expected changes to include %q, got %q", want, changes)
+		}
+	}
+}
+
+func TestTakeFingerprintMissing(t *testing.T) {
+	var fp, err = TakeFingerprint(t.TempDir())
+	if err == nil {
+		t.Fatal("Expected an error for an empty ONI location")
+	}
+	if fp.Path == "" || fp.ID() == "" {
+		t.Fatalf("Expected a usable fingerprint anyway, got %#v", fp)
+	}
+}
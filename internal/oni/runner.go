@@ -0,0 +1,50 @@
+// Package oni holds what the agent needs to know about running Open ONI's
+// management commands
+package oni
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+// NewRunner returns a queue.Runner which calls ONI's manage.py, in ONI's
+// Python virtual environment, with each job's args
+func NewRunner(oniPath string) queue.CommandRunner {
+	// We store the env vars needed to emulate Python's virtual environment,
+	// which essentially operates by setting three env vars. There's other stuff
+	// for changing the prompt, storing info for deactivation, etc., but this is
+	// the only part that matters for executing the "manage.py" script:
+	//
+	//   - export VIRTUAL_ENV=/opt/openoni/ENV
+	//   - export PATH="$VIRTUAL_ENV/bin:$PATH"
+	//   - unset PYTHONHOME
+	//
+	// The last item is "free" because we just don't set anything to begin with
+
+	var eVars = os.Environ()
+	var path []string
+	var pathListSeparator = string(os.PathListSeparator)
+	for _, val := range eVars {
+		var parts = strings.SplitN(val, "=", 2)
+		if len(parts) < 2 {
+			continue
+		}
+		if parts[0] == "PATH" {
+			path = strings.Split(parts[1], pathListSeparator)
+		}
+	}
+	var envPath = filepath.Join(oniPath, "ENV")
+	var binPath = filepath.Join(envPath, "bin")
+	path = append([]string{binPath}, path...)
+
+	return queue.CommandRunner{
+		Path: filepath.Join(oniPath, "manage.py"),
+		Env: []string{
+			"VIRTUAL_ENV=" + envPath,
+			"PATH=" + strings.Join(path, pathListSeparator),
+		},
+	}
+}
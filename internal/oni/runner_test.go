@@ -0,0 +1,46 @@
+package oni
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewRunner(t *testing.T) {
+	var testdir = "/opt/openoni"
+	var r = NewRunner(testdir)
+	if r.Path != filepath.Join(testdir, "manage.py") {
+		t.Errorf("Invalid manage.py path: %q", r.Path)
+	}
+
+	var hasVirtualEnv, hasPath bool
+	for _, env := range r.Env {
+		var parts = strings.Split(env, "=")
+		if len(parts) != 2 {
+			t.Errorf("Unexpected ENV setting: %q", env)
+		}
+
+		var envdir = filepath.Join(testdir, "ENV")
+		switch parts[0] {
+		case "VIRTUAL_ENV":
+			hasVirtualEnv = true
+			if parts[1] != envdir {
+				t.Errorf("Invalid VIRTUAL_ENV setting: expected %q but got %q", envdir, parts[1])
+			}
+		case "PATH":
+			hasPath = true
+			var bindir = filepath.Join(envdir, "bin")
+			if !strings.Contains(parts[1], bindir) {
+				t.Errorf("Invalid PATH setting: bin path %q to be included, but got %q", bindir, parts[1])
+			}
+		}
+
+	}
+
+	if !hasVirtualEnv {
+		t.Error("VIRTUAL_ENV not set")
+	}
+	if !hasPath {
+		t.Error("PATH not set")
+	}
+}
@@ -0,0 +1,243 @@
+// Package onidb holds all the SQL the agent runs against ONI's database.
+// Forks of ONI (and older releases) don't all share the same core_* tables,
+// so queries are grouped into per-schema sets, and the right set is chosen at
+// startup by looking at which tables and columns actually exist.
+package onidb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrUnknownSchema is returned by Detect when the database doesn't match any
+// known schema
+var ErrUnknownSchema = errors.New("unrecognized ONI database schema")
+
+// Queries is the full set of SQL the agent needs. Every query in a set must
+// take the same arguments and return the same columns as the standard ONI
+// set, so callers don't care which schema they're talking to.
+type Queries struct {
+	// BatchExists returns a count of batches with the given name
+	BatchExists string
+
+	// BatchAwardee returns the awardee org code of the batch with the given
+	// name
+	BatchAwardee string
+
+	// AwardeeExists returns a count of awardees with the given org code
+	AwardeeExists string
+
+	// AwardeeName returns the name of the awardee with the given org code
+	AwardeeName string
+
+	// CreateAwardee inserts an awardee given its org code and name
+	CreateAwardee string
+
+	// DeleteAwardee deletes the awardee with the given org code
+	DeleteAwardee string
+
+	// RenameAwardee sets the name of the awardee with the given org code; it
+	// takes the new name first, then the org code
+	RenameAwardee string
+
+	// AwardeeNames returns the org code and name of every awardee
+	AwardeeNames string
+
+	// AwardeeBatches returns the names of all batches for an awardee's org
+	// code, sorted by name
+	AwardeeBatches string
+
+	// BatchesLike returns the names of all batches matching a LIKE pattern,
+	// sorted by name
+	BatchesLike string
+
+	// TitleBatches returns the names of every batch with at least one issue of
+	// the title with the given LCCN, sorted by name
+	TitleBatches string
+
+	// TitleIssues returns the issue date (YYYY-MM-DD) and edition of every
+	// issue of the title with the given LCCN, sorted by date and edition
+	TitleIssues string
+
+	// FindTitle returns the LCCN, name, place of publication, start year, and
+	// end year for a title by LCCN
+	FindTitle string
+
+	// BatchCounts returns every batch's name, issue count, and page count
+	BatchCounts string
+
+	// BatchList returns every batch's name, creation time (as
+	// "YYYY-MM-DD HH:MM:SS", in the database's time zone), issue count, and
+	// page count, sorted by name
+	BatchList string
+
+	// TitleSummaries returns every title's LCCN, name, ISSN, place of
+	// publication, start year, end year, and issue count. Nullable columns
+	// come back as empty strings.
+	TitleSummaries string
+
+	// TitleLCCNs returns every title's LCCN, sorted
+	TitleLCCNs string
+
+	// BatchPages returns the LCCN, issue date (YYYY-MM-DD), edition, and
+	// sequence of every page in the batch with the given name
+	BatchPages string
+
+	// TitlesWithIssues returns the distinct LCCNs, out of a list, which have
+	// at least one issue. The "%s" is replaced with one placeholder per LCCN;
+	// use TitlesWithIssuesQuery rather than formatting it by hand.
+	TitlesWithIssues string
+}
+
+// TitlesWithIssuesQuery returns the TitlesWithIssues query for n LCCNs
+func (q *Queries) TitlesWithIssuesQuery(n int) string {
+	return fmt.Sprintf(q.TitlesWithIssues, strings.TrimSuffix(strings.Repeat("?,", n), ","))
+}
+
+// Schema is a known ONI database layout and the queries which work with it
+type Schema struct {
+	Name string
+
+	// Requires lists, for each table, the columns which must exist for this
+	// schema to match
+	Requires map[string][]string
+
+	Queries
+}
+
+// ONI is the schema used by ONI itself
+var ONI = &Schema{
+	Name: "oni",
+	Requires: map[string][]string{
+		"core_awardee": {"org_code", "name", "created"},
+		"core_batch":   {"name", "awardee_id", "created"},
+		"core_issue":   {"id", "batch_id", "title_id", "date_issued", "edition"},
+		"core_page":    {"id", "issue_id", "sequence"},
+		"core_title":   {"lccn", "name", "issn", "place_of_publication", "start_year", "end_year"},
+	},
+	Queries: Queries{
+		BatchExists:    "SELECT COUNT(*) FROM core_batch WHERE name = ?",
+		BatchAwardee:   "SELECT awardee_id FROM core_batch WHERE name = ?",
+		AwardeeExists:  "SELECT COUNT(*) FROM core_awardee WHERE org_code = ?",
+		AwardeeName:    "SELECT name FROM core_awardee WHERE org_code = ?",
+		CreateAwardee:  "INSERT INTO core_awardee (`org_code`, `name`, `created`) VALUES(?, ?, NOW())",
+		DeleteAwardee:  "DELETE FROM core_awardee WHERE org_code = ?",
+		RenameAwardee:  "UPDATE core_awardee SET name = ? WHERE org_code = ?",
+		AwardeeNames:   "SELECT org_code, name FROM core_awardee",
+		AwardeeBatches: "SELECT name FROM core_batch WHERE awardee_id = ? ORDER BY name",
+		BatchesLike:    "SELECT name FROM core_batch WHERE name LIKE ? ORDER BY name",
+		TitleBatches:   "SELECT DISTINCT batch_id FROM core_issue WHERE title_id = ? ORDER BY batch_id",
+		TitleIssues:    "SELECT DATE_FORMAT(date_issued, '%Y-%m-%d'), edition FROM core_issue WHERE title_id = ? ORDER BY date_issued, edition",
+		FindTitle:      "SELECT lccn, name, place_of_publication, start_year, end_year FROM core_title WHERE lccn = ?",
+		BatchCounts: `
+			SELECT b.name, COUNT(DISTINCT i.id), COUNT(p.id)
+			FROM core_batch b
+			LEFT JOIN core_issue i ON i.batch_id = b.name
+			LEFT JOIN core_page p ON p.issue_id = i.id
+			GROUP BY b.name
+		`,
+		BatchList: `
+			SELECT b.name, DATE_FORMAT(b.created, '%Y-%m-%d %H:%i:%s'), COUNT(DISTINCT i.id), COUNT(p.id)
+			FROM core_batch b
+			LEFT JOIN core_issue i ON i.batch_id = b.name
+			LEFT JOIN core_page p ON p.issue_id = i.id
+			GROUP BY b.name, b.created
+			ORDER BY b.name
+		`,
+		TitleSummaries: `
+			SELECT t.lccn, t.name, COALESCE(t.issn, ''), COALESCE(t.place_of_publication, ''),
+				COALESCE(t.start_year, ''), COALESCE(t.end_year, ''), COUNT(i.id)
+			FROM core_title t
+			LEFT JOIN core_issue i ON i.title_id = t.lccn
+			GROUP BY t.lccn, t.name, t.issn, t.place_of_publication, t.start_year, t.end_year
+		`,
+		TitleLCCNs: "SELECT lccn FROM core_title ORDER BY lccn",
+		BatchPages: `
+			SELECT i.title_id, DATE_FORMAT(i.date_issued, '%Y-%m-%d'), i.edition, p.sequence
+			FROM core_page p
+			JOIN core_issue i ON p.issue_id = i.id
+			WHERE i.batch_id = ?
+		`,
+		TitlesWithIssues: "SELECT DISTINCT title_id FROM core_issue WHERE title_id IN (%s)",
+	},
+}
+
+// Schemas lists every known schema in the order they're tried. Forks which
+// need different SQL add their own Schema here, ahead of any schema they'd
+// otherwise also match.
+var Schemas = []*Schema{ONI}
+
+// Querier is the part of a database handle Detect needs
+type Querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// columnsQuery lists the columns of every core_* table in the current
+// database
+const columnsQuery = `
+	SELECT table_name, column_name
+	FROM information_schema.columns
+	WHERE table_schema = DATABASE() AND table_name LIKE 'core\_%'
+`
+
+// Detect reads the database's core_* tables and returns the first schema
+// they satisfy. If none match, the error wraps ErrUnknownSchema and says
+// what's missing.
+func Detect(ctx context.Context, db Querier) (*Schema, error) {
+	var rows, err = db.QueryContext(ctx, columnsQuery)
+	if err != nil {
+		return nil, fmt.Errorf("reading database schema: %w", err)
+	}
+	defer rows.Close()
+
+	var columns = make(map[string]map[string]bool)
+	for rows.Next() {
+		var table, column string
+		err = rows.Scan(&table, &column)
+		if err != nil {
+			return nil, fmt.Errorf("reading database schema: %w", err)
+		}
+		if columns[table] == nil {
+			columns[table] = make(map[string]bool)
+		}
+		columns[table][column] = true
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("reading database schema: %w", err)
+	}
+
+	return match(columns)
+}
+
+// match returns the first schema whose requirements are all present in
+// columns, a map of table name to a set of column names
+func match(columns map[string]map[string]bool) (*Schema, error) {
+	var errs []string
+	for _, s := range Schemas {
+		var missing = s.missing(columns)
+		if len(missing) == 0 {
+			return s, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: missing %s", s.Name, strings.Join(missing, ", ")))
+	}
+	return nil, fmt.Errorf("%w (%s)", ErrUnknownSchema, strings.Join(errs, "; "))
+}
+
+// missing returns the required "table.column" names which aren't in columns
+func (s *Schema) missing(columns map[string]map[string]bool) []string {
+	var list []string
+	for table, cols := range s.Requires {
+		for _, col := range cols {
+			if !columns[table][col] {
+				list = append(list, table+"."+col)
+			}
+		}
+	}
+	sort.Strings(list)
+	return list
+}
@@ -0,0 +1,58 @@
+package onidb
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// columnSet builds the columns map match expects from the schema's own
+// requirements, so tests start from a database ONI would accept
+func columnSet(s *Schema) map[string]map[string]bool {
+	var columns = make(map[string]map[string]bool)
+	for table, cols := range s.Requires {
+		columns[table] = make(map[string]bool)
+		for _, col := range cols {
+			columns[table][col] = true
+		}
+	}
+	return columns
+}
+
+func TestMatch(t *testing.T) {
+	var columns = columnSet(ONI)
+	columns["core_batch"]["extra_fork_column"] = true
+	columns["core_fork_table"] = map[string]bool{"id": true}
+
+	var s, err = match(columns)
+	if err != nil {
+		t.Fatalf("Expected ONI schema to match, got %s", err)
+	}
+	if s != ONI {
+		t.Fatalf("Expected ONI schema, got %q", s.Name)
+	}
+}
+
+func TestMatchUnknown(t *testing.T) {
+	var columns = columnSet(ONI)
+	delete(columns["core_issue"], "batch_id")
+	delete(columns, "core_page")
+
+	var _, err = match(columns)
+	if !errors.Is(err, ErrUnknownSchema) {
+		t.Fatalf("Expected unknown schema error, got %v", err)
+	}
+	for _, want := range []string{"core_issue.batch_id", "core_page.id", "core_page.issue_id"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error to mention %q, got %q", want, err)
+		}
+	}
+}
+
+func TestTitlesWithIssuesQuery(t *testing.T) {
+	var got = ONI.TitlesWithIssuesQuery(3)
+	var expected = "SELECT DISTINCT title_id FROM core_issue WHERE title_id IN (?,?,?)"
+	if got != expected {
+		t.Fatalf("Expected %q, got %q", expected, got)
+	}
+}
@@ -0,0 +1,210 @@
+// Package schedsim replays a recorded workload through a job scheduling
+// policy, projecting how long each job would have waited to start. It lets us
+// judge queue policies (more workers, or letting some kinds of jobs jump the
+// line) against real history before the queue offers them.
+package schedsim
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Job is one job from a recorded workload
+type Job struct {
+	Type      string
+	Submitted time.Time
+	Duration  time.Duration
+
+	// Class is the job's concurrency class, as the queue's ClassFunc would
+	// give it. It only matters to policies with Classes set.
+	Class string
+}
+
+// Policy describes how a simulated queue picks which job runs next
+type Policy struct {
+	Name string
+
+	// Workers is how many jobs may run at once. Less than one means one.
+	Workers int
+
+	// Priority lists job types which start ahead of any others, highest
+	// first. Types which aren't listed share the lowest priority, and jobs
+	// with the same priority start in the order they were submitted.
+	Priority []string
+
+	// Classes keeps jobs in the same class from running side by side, and
+	// runs a job with no class alone, the way the queue does with more than
+	// one worker. A job which has to wait holds back the later jobs in its
+	// class, and one with no class holds back everything behind it. Without
+	// Classes, any jobs may share the workers.
+	Classes bool
+}
+
+// FIFO runs one job at a time, in the order they were submitted: the agent's
+// queue with its default single worker
+var FIFO = Policy{Name: "fifo", Workers: 1}
+
+// WaitStats summarizes how long a set of jobs waited between being submitted
+// and starting
+type WaitStats struct {
+	Jobs       int     `json:"jobs"`
+	AvgSeconds float64 `json:"avg_wait_seconds"`
+	P95Seconds float64 `json:"p95_wait_seconds"`
+	MaxSeconds float64 `json:"max_wait_seconds"`
+}
+
+// Report is the outcome of replaying a workload through a policy
+type Report struct {
+	Policy   string               `json:"policy"`
+	Workers  int                  `json:"workers"`
+	Priority []string             `json:"priority,omitempty"`
+	Overall  WaitStats            `json:"overall"`
+	ByType   map[string]WaitStats `json:"by_type"`
+
+	// MakespanSeconds is the time from the first job's submission until the
+	// last one would finish
+	MakespanSeconds float64 `json:"makespan_seconds"`
+}
+
+// Simulate runs jobs through p. Jobs are taken as submitted at their recorded
+// time and as running exactly as long as they did, so the projection ignores
+// contention between jobs sharing a host: it's an estimate of queueing delay,
+// not of how long jobs themselves take.
+func Simulate(jobs []Job, p Policy) Report {
+	var sorted = make([]Job, len(jobs))
+	copy(sorted, jobs)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Submitted.Before(sorted[j].Submitted) })
+
+	var workers = max(p.Workers, 1)
+	var rank = make(map[string]int, len(p.Priority))
+	for i, t := range p.Priority {
+		if _, ok := rank[t]; !ok {
+			rank[t] = i
+		}
+	}
+	var priority = func(j Job) int {
+		if r, ok := rank[j.Type]; ok {
+			return r
+		}
+		return len(p.Priority)
+	}
+
+	var r = Report{Policy: p.Name, Workers: workers, Priority: p.Priority, ByType: make(map[string]WaitStats)}
+	if len(sorted) == 0 {
+		return r
+	}
+
+	var waits = make(map[string][]time.Duration)
+	var all []time.Duration
+	var running []slot
+	var pending []Job
+	var next int
+	var now, end = sorted[0].Submitted, sorted[0].Submitted
+	for next < len(sorted) || len(pending) > 0 {
+		var still = running[:0]
+		for _, s := range running {
+			if s.end.After(now) {
+				still = append(still, s)
+			}
+		}
+		running = still
+		for next < len(sorted) && !sorted[next].Submitted.After(now) {
+			pending = append(pending, sorted[next])
+			next++
+		}
+
+		// pending stays in submission order, so a stable sort by priority
+		// puts the jobs in the order they'd be considered
+		sort.SliceStable(pending, func(i, j int) bool { return priority(pending[i]) < priority(pending[j]) })
+		var waiting = make(map[string]bool)
+		var keep []Job
+		for _, j := range pending {
+			if p.Classes && (waiting[""] || waiting[j.Class]) || !canStart(running, workers, p.Classes, j.Class) {
+				waiting[j.Class] = true
+				keep = append(keep, j)
+				continue
+			}
+
+			var wait = now.Sub(j.Submitted)
+			waits[j.Type] = append(waits[j.Type], wait)
+			all = append(all, wait)
+			running = append(running, slot{end: now.Add(j.Duration), class: j.Class})
+			if running[len(running)-1].end.After(end) {
+				end = running[len(running)-1].end
+			}
+		}
+		pending = keep
+
+		// Nothing changes until a running job finishes or another is
+		// submitted
+		var at time.Time
+		for _, s := range running {
+			if at.IsZero() || s.end.Before(at) {
+				at = s.end
+			}
+		}
+		if next < len(sorted) && (at.IsZero() || sorted[next].Submitted.Before(at)) {
+			at = sorted[next].Submitted
+		}
+		if !at.IsZero() {
+			now = at
+		}
+	}
+
+	r.Overall = summarize(all)
+	for t, list := range waits {
+		r.ByType[t] = summarize(list)
+	}
+	r.MakespanSeconds = seconds(end.Sub(sorted[0].Submitted))
+	return r
+}
+
+// slot is a job holding one of the simulated workers
+type slot struct {
+	end   time.Time
+	class string
+}
+
+// canStart returns true if a job in the given class can start alongside the
+// running jobs
+func canStart(running []slot, workers int, classes bool, class string) bool {
+	if len(running) >= workers {
+		return false
+	}
+	if !classes {
+		return true
+	}
+	if class == "" {
+		return len(running) == 0
+	}
+	for _, s := range running {
+		if s.class == "" || s.class == class {
+			return false
+		}
+	}
+	return true
+}
+
+// summarize computes wait statistics, using the nearest-rank 95th percentile
+func summarize(waits []time.Duration) WaitStats {
+	var s = WaitStats{Jobs: len(waits)}
+	if len(waits) == 0 {
+		return s
+	}
+
+	sort.Slice(waits, func(i, j int) bool { return waits[i] < waits[j] })
+	var total time.Duration
+	for _, w := range waits {
+		total += w
+	}
+	s.AvgSeconds = seconds(total / time.Duration(len(waits)))
+	s.P95Seconds = seconds(waits[int(math.Ceil(0.95*float64(len(waits))))-1])
+	s.MaxSeconds = seconds(waits[len(waits)-1])
+	return s
+}
+
+// seconds converts d to seconds, rounded to the millisecond
+func seconds(d time.Duration) float64 {
+	return float64(d.Milliseconds()) / 1000
+}
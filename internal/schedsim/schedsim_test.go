@@ -0,0 +1,128 @@
+package schedsim
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var start = time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC)
+
+func job(typ string, submitMin, durationMin int) Job {
+	return Job{Type: typ, Submitted: start.Add(time.Duration(submitMin) * time.Minute), Duration: time.Duration(durationMin) * time.Minute}
+}
+
+// workload is two long batch loads with quick title loads queued up behind
+// them, and a load submitted well after everything else has finished
+var workload = []Job{
+	job("load-title", 2, 1),
+	job("load", 0, 10),
+	job("load", 1, 10),
+	job("load-title", 3, 1),
+	job("load", 60, 5),
+}
+
+func TestSimulate(t *testing.T) {
+	var tests = map[string]struct {
+		policy Policy
+		want   Report
+	}{
+		"fifo": {
+			policy: FIFO,
+			want: Report{
+				Policy: "fifo", Workers: 1,
+				// The second load waits 9 minutes, then each title load 18
+				Overall: WaitStats{Jobs: 5, AvgSeconds: 540, P95Seconds: 1080, MaxSeconds: 1080},
+				ByType: map[string]WaitStats{
+					"load":       {Jobs: 3, AvgSeconds: 180, P95Seconds: 540, MaxSeconds: 540},
+					"load-title": {Jobs: 2, AvgSeconds: 1080, P95Seconds: 1080, MaxSeconds: 1080},
+				},
+				MakespanSeconds: 3900,
+			},
+		},
+		"two workers": {
+			policy: Policy{Name: "two", Workers: 2},
+			want: Report{
+				Policy: "two", Workers: 2,
+				// Both loads start right away, so the title loads only wait
+				// for the first of them to finish
+				Overall: WaitStats{Jobs: 5, AvgSeconds: 192, P95Seconds: 480, MaxSeconds: 480},
+				ByType: map[string]WaitStats{
+					"load":       {Jobs: 3},
+					"load-title": {Jobs: 2, AvgSeconds: 480, P95Seconds: 480, MaxSeconds: 480},
+				},
+				MakespanSeconds: 3900,
+			},
+		},
+		"titles first": {
+			policy: Policy{Name: "titles", Workers: 1, Priority: []string{"load-title"}},
+			want: Report{
+				Policy: "titles", Workers: 1, Priority: []string{"load-title"},
+				// The title loads jump ahead of the second load, which now
+				// waits 11 minutes
+				Overall: WaitStats{Jobs: 5, AvgSeconds: 324, P95Seconds: 660, MaxSeconds: 660},
+				ByType: map[string]WaitStats{
+					"load":       {Jobs: 3, AvgSeconds: 220, P95Seconds: 660, MaxSeconds: 660},
+					"load-title": {Jobs: 2, AvgSeconds: 480, P95Seconds: 480, MaxSeconds: 480},
+				},
+				MakespanSeconds: 3900,
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got = Simulate(workload, tc.policy)
+			var diff = cmp.Diff(tc.want, got)
+			if diff != "" {
+				t.Fatalf("Simulate: %s", diff)
+			}
+		})
+	}
+}
+
+func TestSimulateEmpty(t *testing.T) {
+	var got = Simulate(nil, Policy{Name: "none"})
+	var want = Report{Policy: "none", Workers: 1, ByType: map[string]WaitStats{}}
+	var diff = cmp.Diff(want, got)
+	if diff != "" {
+		t.Fatalf("Simulate: %s", diff)
+	}
+}
+
+func TestSimulateClasses(t *testing.T) {
+	var classed = func(typ, class string, submitMin, durationMin int) Job {
+		var j = job(typ, submitMin, durationMin)
+		j.Class = class
+		return j
+	}
+
+	// Two loads in the same class, a title load which can run beside them,
+	// and a job with no class which has to run alone, holding back the title
+	// load queued after it
+	var jobs = []Job{
+		classed("load", "batch", 0, 10),
+		classed("load", "batch", 1, 10),
+		classed("load-title", "load_titles", 2, 1),
+		classed("reconcile", "", 3, 1),
+		classed("load-title", "load_titles", 4, 1),
+	}
+	var got = Simulate(jobs, Policy{Name: "current", Workers: 2, Classes: true})
+	var want = Report{
+		Policy: "current", Workers: 2,
+		// The second load waits 9 minutes for the first; the reconcile waits
+		// 17 for both, and the last title load waits 17 behind it
+		Overall: WaitStats{Jobs: 5, AvgSeconds: 516, P95Seconds: 1020, MaxSeconds: 1020},
+		ByType: map[string]WaitStats{
+			"load":       {Jobs: 2, AvgSeconds: 270, P95Seconds: 540, MaxSeconds: 540},
+			"load-title": {Jobs: 2, AvgSeconds: 510, P95Seconds: 1020, MaxSeconds: 1020},
+			"reconcile":  {Jobs: 1, AvgSeconds: 1020, P95Seconds: 1020, MaxSeconds: 1020},
+		},
+		MakespanSeconds: 1320,
+	}
+	var diff = cmp.Diff(want, got)
+	if diff != "" {
+		t.Fatalf("Simulate: %s", diff)
+	}
+}
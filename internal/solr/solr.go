@@ -0,0 +1,169 @@
+// Package solr is a minimal client for looking up documents in ONI's Solr
+// index. It only does what the agent needs to verify that pages and titles
+// were indexed, plus deleting documents ONI no longer has; searching is
+// ONI's job.
+package solr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Doc is a single Solr document: field name to value
+type Doc map[string]any
+
+// Client talks to one Solr core (or collection)
+type Client struct {
+	base   *url.URL
+	client *http.Client
+}
+
+// New returns a client for the core at coreURL, e.g.,
+// "http://localhost:8983/solr/openoni"
+func New(coreURL string) (*Client, error) {
+	var base, err = url.Parse(strings.TrimSuffix(coreURL, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("%q is not an http(s) URL", coreURL)
+	}
+	return &Client{base: base, client: &http.Client{Timeout: time.Second * 30}}, nil
+}
+
+// quote escapes a value for use as a quoted term in a Solr query
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// Get returns the document with the given id, or nil if there isn't one. If
+// fields are given, only those are returned (Solr's "fl"; wildcards like
+// "ocr_*" work).
+func (c *Client) Get(ctx context.Context, id string, fields ...string) (Doc, error) {
+	var docs, _, err = c.Select(ctx, "id:"+quote(id), 0, 1, fields...)
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 {
+		return nil, nil
+	}
+	return docs[0], nil
+}
+
+// Select runs a query, returning up to rows documents starting at start, and
+// the total number of documents which match. Fields work as they do in Get.
+func (c *Client) Select(ctx context.Context, query string, start, rows int, fields ...string) ([]Doc, int, error) {
+	return c.SelectSorted(ctx, query, "", start, rows, fields...)
+}
+
+// SelectSorted is Select with the results in the given order, e.g., "id asc".
+// Anything paging through a query needs a sort on a unique field: Solr's
+// default order isn't stable between requests, so pages can overlap or skip
+// documents.
+func (c *Client) SelectSorted(ctx context.Context, query, sort string, start, rows int, fields ...string) ([]Doc, int, error) {
+	var q = url.Values{}
+	q.Set("q", query)
+	if sort != "" {
+		q.Set("sort", sort)
+	}
+	q.Set("start", strconv.Itoa(start))
+	q.Set("rows", strconv.Itoa(rows))
+	q.Set("wt", "json")
+	if len(fields) > 0 {
+		q.Set("fl", strings.Join(fields, ","))
+	}
+
+	var u = c.base.JoinPath("select")
+	u.RawQuery = q.Encode()
+	var req, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var resp *http.Response
+	resp, err = c.client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("querying solr: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var body, _ = io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, 0, fmt.Errorf("querying solr: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var result struct {
+		Response struct {
+			NumFound int   `json:"numFound"`
+			Docs     []Doc `json:"docs"`
+		} `json:"response"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, 0, fmt.Errorf("decoding solr response: %w", err)
+	}
+	return result.Response.Docs, result.Response.NumFound, nil
+}
+
+// Delete removes the documents with the given ids and commits the change
+func (c *Client) Delete(ctx context.Context, ids ...string) error {
+	var body, err = json.Marshal(map[string][]string{"delete": ids})
+	if err != nil {
+		return err
+	}
+
+	var u = c.base.JoinPath("update")
+	u.RawQuery = url.Values{"commit": {"true"}, "wt": {"json"}}.Encode()
+	var req *http.Request
+	req, err = http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var resp *http.Response
+	resp, err = c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("updating solr: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var msg, _ = io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("updating solr: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// Text returns the non-blank string content of every field matching the
+// given name or prefix (a trailing "*"), e.g., "ocr_*". Multi-valued fields
+// contribute each value.
+func (d Doc) Text(field string) []string {
+	var prefix, wild = strings.CutSuffix(field, "*")
+	var list []string
+	for name, val := range d {
+		if name != field && !(wild && strings.HasPrefix(name, prefix)) {
+			continue
+		}
+		var vals []any
+		switch v := val.(type) {
+		case []any:
+			vals = v
+		default:
+			vals = []any{v}
+		}
+		for _, v := range vals {
+			if s, ok := v.(string); ok && strings.TrimSpace(s) != "" {
+				list = append(list, s)
+			}
+		}
+	}
+	return list
+}
@@ -0,0 +1,102 @@
+package solr
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	var srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/solr/openoni/select" {
+			http.Error(w, "bad path "+r.URL.Path, http.StatusNotFound)
+			return
+		}
+		switch r.URL.Query().Get("q") {
+		case `id:"/lccn/sn123/1900-01-01/ed-1/seq-1/"`:
+			w.Write([]byte(`{"response": {"numFound": 1, "docs": [{"id": "/lccn/sn123/1900-01-01/ed-1/seq-1/", "ocr": " ", "ocr_eng": ["The news", ""]}]}}`))
+		case `id:"broken"`:
+			http.Error(w, "kaboom", http.StatusInternalServerError)
+		default:
+			w.Write([]byte(`{"response": {"numFound": 0, "docs": []}}`))
+		}
+	}))
+	defer srv.Close()
+
+	var c, err = New(srv.URL + "/solr/openoni/")
+	if err != nil {
+		t.Fatalf("Unable to create client: %s", err)
+	}
+
+	var doc Doc
+	doc, err = c.Get(context.Background(), "/lccn/sn123/1900-01-01/ed-1/seq-1/", "id", "ocr*")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var text = doc.Text("ocr*")
+	if len(text) != 1 || text[0] != "The news" {
+		t.Fatalf("Expected only non-blank OCR text, got %#v", text)
+	}
+	if len(doc.Text("ocr")) != 0 {
+		t.Fatalf("Expected an exact field name not to match ocr_eng")
+	}
+
+	doc, err = c.Get(context.Background(), "/lccn/sn123/1900-01-01/ed-1/seq-2/")
+	if err != nil || doc != nil {
+		t.Fatalf("Expected no doc and no error for a missing page, got %#v, %v", doc, err)
+	}
+
+	_, err = c.Get(context.Background(), "broken")
+	if err == nil {
+		t.Fatal("Expected an error from a failing solr")
+	}
+
+	_, err = New("localhost:8983/solr")
+	if err == nil {
+		t.Fatal("Expected an error for a non-http URL")
+	}
+}
+
+func TestSelectAndDelete(t *testing.T) {
+	var deleted string
+	var srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/solr/openoni/select":
+			if r.URL.Query().Get("q") != "type:title" || r.URL.Query().Get("start") != "1" || r.URL.Query().Get("rows") != "1" {
+				http.Error(w, "unexpected query "+r.URL.RawQuery, http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{"response": {"numFound": 2, "docs": [{"id": "/lccn/sn2/", "lccn": "sn2"}]}}`))
+		case "/solr/openoni/update":
+			if r.Method != http.MethodPost || r.URL.Query().Get("commit") != "true" {
+				http.Error(w, "unexpected update", http.StatusBadRequest)
+				return
+			}
+			var body, _ = io.ReadAll(r.Body)
+			deleted = string(body)
+			w.Write([]byte(`{"responseHeader": {"status": 0}}`))
+		default:
+			http.Error(w, "bad path "+r.URL.Path, http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	var c, _ = New(srv.URL + "/solr/openoni")
+	var docs, total, err = c.Select(context.Background(), "type:title", 1, 1, "id", "lccn")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if total != 2 || len(docs) != 1 || docs[0]["lccn"] != "sn2" {
+		t.Fatalf("Expected the second of two title docs, got %d / %#v", total, docs)
+	}
+
+	err = c.Delete(context.Background(), "/lccn/sn2/", "/lccn/sn3/")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if deleted != `{"delete":["/lccn/sn2/","/lccn/sn3/"]}` {
+		t.Fatalf("Unexpected delete request: %s", deleted)
+	}
+}
@@ -0,0 +1,124 @@
+package state
+
+import (
+	"fmt"
+	"time"
+)
+
+// SchemaFile is the state file recording which migrations have been applied
+const SchemaFile = "schema.json"
+
+// Migration is a single versioned change to the layout of the state files,
+// e.g., renaming a file or converting its structure. Versions start at 1 and
+// must increase by exactly one per migration so there's never any question of
+// the order they run in.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(d *Dir) error
+}
+
+// AppliedMigration records when a migration was run
+type AppliedMigration struct {
+	Version     int       `json:"version"`
+	Description string    `json:"description"`
+	Applied     time.Time `json:"applied"`
+}
+
+// Schema is the contents of the schema file
+type Schema struct {
+	Version int                `json:"version"`
+	History []AppliedMigration `json:"history"`
+}
+
+// MigrationStatus describes where the state dir stands against a set of
+// migrations
+type MigrationStatus struct {
+	Current int                `json:"current"`
+	Latest  int                `json:"latest"`
+	Applied []AppliedMigration `json:"applied"`
+	Pending []AppliedMigration `json:"pending"`
+}
+
+// validate makes sure migrations are numbered 1, 2, 3, ... in order
+func validate(migrations []Migration) error {
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return fmt.Errorf("migration %q has version %d; expected %d", m.Description, m.Version, i+1)
+		}
+		if m.Up == nil {
+			return fmt.Errorf("migration %d has no Up function", m.Version)
+		}
+	}
+	return nil
+}
+
+// Schema returns the state dir's schema file, or an empty (version 0) schema
+// if no migrations have ever been applied
+func (d *Dir) Schema() (Schema, error) {
+	var s Schema
+	var _, err = d.Read(SchemaFile, &s)
+	return s, err
+}
+
+// Status reports which of the given migrations have been applied, and which
+// are pending
+func (d *Dir) Status(migrations []Migration) (MigrationStatus, error) {
+	var err = validate(migrations)
+	if err != nil {
+		return MigrationStatus{}, err
+	}
+
+	var s Schema
+	s, err = d.Schema()
+	if err != nil {
+		return MigrationStatus{}, err
+	}
+
+	var st = MigrationStatus{Current: s.Version, Latest: len(migrations), Applied: s.History, Pending: []AppliedMigration{}}
+	if st.Applied == nil {
+		st.Applied = []AppliedMigration{}
+	}
+	for _, m := range migrations[min(s.Version, len(migrations)):] {
+		st.Pending = append(st.Pending, AppliedMigration{Version: m.Version, Description: m.Description})
+	}
+	return st, nil
+}
+
+// Migrate applies every migration newer than the state dir's current version,
+// in order, recording each one as soon as it succeeds. If a migration fails,
+// the ones before it stay applied and the error is returned. A state dir
+// whose version is newer than the latest migration was written by a newer
+// agent, and is an error rather than something to guess about.
+func (d *Dir) Migrate(migrations []Migration) (applied []AppliedMigration, err error) {
+	err = validate(migrations)
+	if err != nil {
+		return nil, err
+	}
+
+	var s Schema
+	s, err = d.Schema()
+	if err != nil {
+		return nil, err
+	}
+	if s.Version > len(migrations) {
+		return nil, fmt.Errorf("state dir is at version %d, but this agent only knows up to version %d", s.Version, len(migrations))
+	}
+
+	for _, m := range migrations[s.Version:] {
+		err = m.Up(d)
+		if err != nil {
+			return applied, fmt.Errorf("applying state migration %d (%s): %w", m.Version, m.Description, err)
+		}
+
+		var a = AppliedMigration{Version: m.Version, Description: m.Description, Applied: time.Now()}
+		s.Version = m.Version
+		s.History = append(s.History, a)
+		err = d.Write(SchemaFile, s)
+		if err != nil {
+			return applied, fmt.Errorf("recording state migration %d: %w", m.Version, err)
+		}
+		applied = append(applied, a)
+	}
+	return applied, nil
+}
@@ -0,0 +1,84 @@
+package state
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	var d, err = Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Unable to open state dir: %s", err)
+	}
+
+	var ran []int
+	var step = func(v int) func(*Dir) error {
+		return func(d *Dir) error {
+			ran = append(ran, v)
+			return d.Write("test.json", testData{Count: v})
+		}
+	}
+	var migrations = []Migration{
+		{Version: 1, Description: "one", Up: step(1)},
+		{Version: 2, Description: "two", Up: step(2)},
+	}
+
+	var st MigrationStatus
+	st, err = d.Status(migrations)
+	if err != nil || st.Current != 0 || st.Latest != 2 || len(st.Pending) != 2 {
+		t.Fatalf("Expected two pending migrations, got %#v (%v)", st, err)
+	}
+
+	var applied []AppliedMigration
+	applied, err = d.Migrate(migrations)
+	if err != nil || len(applied) != 2 {
+		t.Fatalf("Expected two migrations applied, got %#v (%v)", applied, err)
+	}
+
+	// Running again is a no-op; adding a migration runs just the new one
+	migrations = append(migrations, Migration{Version: 3, Description: "three", Up: step(3)})
+	applied, err = d.Migrate(migrations)
+	if err != nil || len(applied) != 1 || applied[0].Version != 3 {
+		t.Fatalf("Expected only migration 3 applied, got %#v (%v)", applied, err)
+	}
+	if len(ran) != 3 {
+		t.Fatalf("Expected each migration to run once, got %v", ran)
+	}
+
+	st, _ = d.Status(migrations)
+	if st.Current != 3 || len(st.Applied) != 3 || len(st.Pending) != 0 {
+		t.Fatalf("Expected everything applied, got %#v", st)
+	}
+
+	// An agent which knows fewer migrations than were applied must refuse
+	_, err = d.Migrate(migrations[:2])
+	if err == nil {
+		t.Fatal("Expected an error migrating a state dir from a newer agent")
+	}
+}
+
+func TestMigrateFailure(t *testing.T) {
+	var d, _ = Open(t.TempDir())
+	var boom = errors.New("boom")
+	var migrations = []Migration{
+		{Version: 1, Description: "ok", Up: func(*Dir) error { return nil }},
+		{Version: 2, Description: "fails", Up: func(*Dir) error { return boom }},
+	}
+
+	var applied, err = d.Migrate(migrations)
+	if !errors.Is(err, boom) || len(applied) != 1 {
+		t.Fatalf("Expected migration 1 applied and migration 2's error, got %#v (%v)", applied, err)
+	}
+	var s, _ = d.Schema()
+	if s.Version != 1 {
+		t.Fatalf("Expected version 1 after failure, got %d", s.Version)
+	}
+}
+
+func TestMigrateInvalid(t *testing.T) {
+	var d, _ = Open(t.TempDir())
+	var _, err = d.Migrate([]Migration{{Version: 2, Description: "skips one", Up: func(*Dir) error { return nil }}})
+	if err == nil {
+		t.Fatal("Expected an error for misnumbered migrations")
+	}
+}
@@ -0,0 +1,97 @@
+// Package state stores the agent's own small bits of persistent data (queue
+// pause state, etc.) as JSON files in a single directory
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Dir is a directory holding the agent's state files
+type Dir struct {
+	m    sync.Mutex
+	path string
+}
+
+// Open returns a Dir rooted at path, creating the directory if needed
+func Open(path string) (*Dir, error) {
+	var err = os.MkdirAll(path, 0750)
+	if err != nil {
+		return nil, fmt.Errorf("creating state dir %q: %w", path, err)
+	}
+	return &Dir{path: path}, nil
+}
+
+// Path returns the directory's location on disk
+func (d *Dir) Path() string {
+	return d.path
+}
+
+// Read decodes the named state file into v. If the file doesn't exist, v is
+// left alone and found is false.
+func (d *Dir) Read(name string, v any) (found bool, err error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	var data []byte
+	data, err = os.ReadFile(filepath.Join(d.path, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("reading state file %q: %w", name, err)
+	}
+
+	err = json.Unmarshal(data, v)
+	if err != nil {
+		return false, fmt.Errorf("decoding state file %q: %w", name, err)
+	}
+	return true, nil
+}
+
+// Write encodes v as JSON into the named state file. The data is written to
+// a temp file first and renamed so a crash never leaves a partial file.
+func (d *Dir) Write(name string, v any) error {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	var data, err = json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding state file %q: %w", name, err)
+	}
+
+	var final = filepath.Join(d.path, name)
+	var tmp = final + ".tmp"
+	err = os.WriteFile(tmp, data, 0640)
+	if err == nil {
+		err = os.Rename(tmp, final)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("writing state file %q: %w", name, err)
+	}
+	return nil
+}
+
+// Names returns the name of every state file, sorted
+func (d *Dir) Names() ([]string, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	var entries, err = os.ReadDir(d.path)
+	if err != nil {
+		return nil, fmt.Errorf("reading state dir: %w", err)
+	}
+	var names []string
+	for _, e := range entries {
+		var n = e.Name()
+		if e.Type().IsRegular() && filepath.Ext(n) == ".json" {
+			names = append(names, n)
+		}
+	}
+	return names, nil
+}
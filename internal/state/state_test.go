@@ -0,0 +1,50 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testData struct {
+	Name  string
+	Count int
+}
+
+func TestReadWrite(t *testing.T) {
+	var d, err = Open(filepath.Join(t.TempDir(), "nested", "state"))
+	if err != nil {
+		t.Fatalf("Unable to open state dir: %s", err)
+	}
+
+	var got testData
+	var found bool
+	found, err = d.Read("test.json", &got)
+	if err != nil || found {
+		t.Fatalf("Expected missing file to be not found without error, got %v, %v", found, err)
+	}
+
+	var expected = testData{Name: "foo", Count: 3}
+	err = d.Write("test.json", expected)
+	if err != nil {
+		t.Fatalf("Unable to write state: %s", err)
+	}
+
+	found, err = d.Read("test.json", &got)
+	if err != nil || !found {
+		t.Fatalf("Expected file to be found without error, got %v, %v", found, err)
+	}
+	if got != expected {
+		t.Fatalf("Expected %#v, got %#v", expected, got)
+	}
+
+	var entries, _ = os.ReadDir(d.Path())
+	if len(entries) != 1 {
+		t.Fatalf("Expected exactly one file in state dir, got %d", len(entries))
+	}
+
+	var names, _ = d.Names()
+	if len(names) != 1 || names[0] != "test.json" {
+		t.Fatalf("Expected names to be [test.json], got %v", names)
+	}
+}
@@ -2,6 +2,65 @@
 // is meant to be replaced at compile time with git metadata
 package version
 
+import (
+	"runtime"
+	"runtime/debug"
+)
+
 // Version holds the app version data. Do not change this, as it's meant to be
 // replaced (see the Makefile)
 var Version = "in-dev"
+
+// Commit is the full git commit hash the binary was built from. Like Version,
+// it's set at compile time, but if it's empty we fall back to whatever VCS
+// data the Go toolchain embedded.
+var Commit string
+
+// BuildDate is the UTC build timestamp, set at compile time
+var BuildDate string
+
+// ProtocolVersion is incremented whenever the shape of the agent's commands
+// or responses changes in a way clients may need to account for
+const ProtocolVersion = 1
+
+// BuildInfo describes the running binary
+type BuildInfo struct {
+	Version         string `json:"version"`
+	Commit          string `json:"commit"`
+	Modified        bool   `json:"modified,omitempty"`
+	BuildDate       string `json:"build_date"`
+	GoVersion       string `json:"go_version"`
+	ProtocolVersion int    `json:"protocol_version"`
+}
+
+// Info returns the build information for the running binary
+func Info() BuildInfo {
+	var bi = BuildInfo{
+		Version:         Version,
+		Commit:          Commit,
+		BuildDate:       BuildDate,
+		GoVersion:       runtime.Version(),
+		ProtocolVersion: ProtocolVersion,
+	}
+
+	var info, ok = debug.ReadBuildInfo()
+	if !ok {
+		return bi
+	}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if bi.Commit == "" {
+				bi.Commit = setting.Value
+			}
+		case "vcs.time":
+			if bi.BuildDate == "" {
+				bi.BuildDate = setting.Value
+			}
+		case "vcs.modified":
+			bi.Modified = setting.Value == "true"
+		}
+	}
+
+	return bi
+}
@@ -2,6 +2,8 @@
 
 if [[ $1 == "check" ]]; then
     echo "DONE"
+elif [[ $1 == "help" && $2 == "--commands" ]]; then
+    printf "%s\n" batches check help index_titles load_batch load_titles purge_batch
 else
     echo "BEGIN"
     echo "this is output"
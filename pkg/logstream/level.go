@@ -0,0 +1,146 @@
+package logstream
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Level is a heuristic severity for a log line. ONI's output is a mix of
+// Django logging, Python warnings, tracebacks, and plain prints, so levels
+// are guessed from what the lines look like rather than parsed from any one
+// format.
+type Level int
+
+// All levels, from least to most severe
+const (
+	LevelInfo Level = iota
+	LevelWarning
+	LevelError
+)
+
+var levelNames = []string{"info", "warning", "error"}
+
+// String returns the level's lowercase name
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the Level with the given name
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("%q is not a valid level; must be one of %s", name, strings.Join(levelNames, ", "))
+}
+
+var (
+	// A level keyword within the first few words, e.g., "ERROR ...",
+	// "[WARNING] ...", or "2024-10-01 12:00:00,123 ERROR ..."
+	errorPrefix   = regexp.MustCompile(`^(?:\S+\s+){0,3}?\[?(?:ERROR|CRITICAL|FATAL)\]?(?::|\s|$)`)
+	warningPrefix = regexp.MustCompile(`^(?:\S+\s+){0,3}?\[?(?:WARNING|WARN)\]?(?::|\s|$)`)
+
+	// Python exception and warning lines, e.g., "ValueError: ...",
+	// "django.db.utils.OperationalError: ...", or "/x/y.py:12: UserWarning: ..."
+	exceptionLine = regexp.MustCompile(`^[\w.]*(?:Error|Exception)(?::|$)`)
+	pyWarningLine = regexp.MustCompile(`^(?:\S+:\d+: )?\w*Warning: `)
+)
+
+// tracebackStart begins a Python traceback
+const tracebackStart = "Traceback (most recent call last):"
+
+// Classify returns the level of each line. It's stateful across lines so
+// that a whole Python traceback is tagged as an error: the "Traceback" line,
+// every indented frame after it, and the exception line that ends it.
+func Classify(lines []string) []Level {
+	var levels = make([]Level, len(lines))
+	var inTraceback bool
+	for i, line := range lines {
+		switch {
+		case strings.HasPrefix(line, tracebackStart):
+			inTraceback = true
+			levels[i] = LevelError
+		case inTraceback:
+			levels[i] = LevelError
+			if line != "" && line[0] != ' ' && line[0] != '\t' {
+				inTraceback = false
+			}
+		case errorPrefix.MatchString(line), exceptionLine.MatchString(line):
+			levels[i] = LevelError
+		case warningPrefix.MatchString(line), pyWarningLine.MatchString(line):
+			levels[i] = LevelWarning
+		}
+	}
+	return levels
+}
+
+// Leveled is a timestamped log line tagged with its Level and its position
+// in the stream. The Log it came from is kept for its time, source, and
+// sequence number.
+type Leveled struct {
+	Log
+	Index int
+	Level Level
+	Line  string
+}
+
+// Leveled returns every line, including any trailing partial line, with its
+// timestamp and level
+func (s *Stream) Leveled() []Leveled {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var logs = s.Logs
+	if s.unprocessed != "" {
+		logs = append(logs[:len(logs):len(logs)], s.partialLog())
+	}
+
+	var values = make([]string, len(logs))
+	for i, log := range logs {
+		values[i] = log.Value
+	}
+
+	var out = make([]Leveled, len(logs))
+	for i, lvl := range Classify(values) {
+		out[i] = Leveled{Log: logs[i], Index: i, Level: max(lvl, logs[i].Level), Line: logs[i].String()}
+	}
+	return out
+}
+
+// AtLeast returns the lines whose level is min or higher
+func AtLeast(logs []Leveled, min Level) []Leveled {
+	var out []Leveled
+	for _, l := range logs {
+		if l.Level >= min {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// ErrorContext returns the error lines plus up to n lines before and after
+// each one, in their original order, without duplicates
+func ErrorContext(logs []Leveled, n int) []Leveled {
+	var keep = make([]bool, len(logs))
+	for i, l := range logs {
+		if l.Level != LevelError {
+			continue
+		}
+		for j := max(0, i-n); j <= min(len(logs)-1, i+n); j++ {
+			keep[j] = true
+		}
+	}
+
+	var out []Leveled
+	for i, l := range logs {
+		if keep[i] {
+			out = append(out, l)
+		}
+	}
+	return out
+}
@@ -0,0 +1,82 @@
+package logstream
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestClassify(t *testing.T) {
+	var lines = []string{
+		"Loading batch batch_foo_ver01",
+		"WARNING 2024-10-01 12:00:00 issue missing page",
+		"2024-10-01 12:00:00,123 ERROR core.batch_loader unable to load",
+		"[WARNING] something odd",
+		"/opt/openoni/core/models.py:12: RuntimeWarning: naive datetime",
+		"Traceback (most recent call last):",
+		`  File "/opt/openoni/manage.py", line 10, in <module>`,
+		"    main()",
+		"django.db.utils.OperationalError: (2006, 'MySQL server has gone away')",
+		"Errors found: 0",
+		"ValueError: bad value",
+		"done",
+	}
+	var expected = []Level{
+		LevelInfo, LevelWarning, LevelError, LevelWarning, LevelWarning,
+		LevelError, LevelError, LevelError, LevelError,
+		LevelInfo, LevelError, LevelInfo,
+	}
+
+	var diff = cmp.Diff(expected, Classify(lines))
+	if diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestFilters(t *testing.T) {
+	timeNow = gettf(1)
+	var s = New()
+	s.Write([]byte("a\nb\nWARNING c\nd\nERROR e\nf\ng\nh\nERROR i"))
+
+	var indices = func(logs []Leveled) []int {
+		var out []int
+		for _, l := range logs {
+			out = append(out, l.Index)
+		}
+		return out
+	}
+
+	var all = s.Leveled()
+	if len(all) != 9 || all[8].Level != LevelError {
+		t.Fatalf("Expected nine lines with the partial line as an error, got %#v", all)
+	}
+
+	var tests = map[string]struct {
+		got      []Leveled
+		expected []int
+	}{
+		"warnings and up": {got: AtLeast(all, LevelWarning), expected: []int{2, 4, 8}},
+		"errors only":     {got: AtLeast(all, LevelError), expected: []int{4, 8}},
+		"context 1":       {got: ErrorContext(all, 1), expected: []int{3, 4, 5, 7, 8}},
+		"context 0":       {got: ErrorContext(all, 0), expected: []int{4, 8}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var diff = cmp.Diff(tc.expected, indices(tc.got))
+			if diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	var l, err = ParseLevel("Warning")
+	if err != nil || l != LevelWarning {
+		t.Fatalf("Expected warning, got %v (%v)", l, err)
+	}
+	_, err = ParseLevel("debug")
+	if err == nil {
+		t.Fatal("Expected an error for an unknown level")
+	}
+}
@@ -0,0 +1,36 @@
+package logstream
+
+import (
+	"regexp"
+)
+
+// RedactedText replaces anything a Redactor matches
+const RedactedText = "[REDACTED]"
+
+// Redactor scrubs sensitive values out of log lines before they're stored
+type Redactor struct {
+	patterns []*regexp.Regexp
+}
+
+// NewRedactor returns a Redactor which will replace all matches of the given
+// patterns
+func NewRedactor(patterns ...*regexp.Regexp) *Redactor {
+	return &Redactor{patterns: patterns}
+}
+
+// Redact returns the line with all matches replaced, and how many matches
+// were replaced
+func (r *Redactor) Redact(line string) (string, int) {
+	if r == nil {
+		return line, 0
+	}
+
+	var count int
+	for _, re := range r.patterns {
+		line = re.ReplaceAllStringFunc(line, func(string) string {
+			count++
+			return RedactedText
+		})
+	}
+	return line, count
+}
@@ -0,0 +1,265 @@
+// Package logstream provides an io.Writer which records a timestamp for when
+// data was written so that raw output coming from a command-line app can be
+// given more meaning
+package logstream
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Log holds a single log entry and records the time it was captured
+type Log struct {
+	Timestamp time.Time
+	Value     string
+
+	// Source names what produced the line, e.g., the command or script a job
+	// was running; it's empty if the stream was never told
+	Source string
+
+	// Seq is the line's position in its Sequence, which may be shared with
+	// other streams so their lines can be put back in order
+	Seq int64
+
+	// Level is the least severe the line can be, for writers who know
+	// better than the heuristics; see Classify
+	Level Level
+}
+
+// String returns the entry with a prepended timestamp
+func (l Log) String() string {
+	// Custom format so we can force our nanosecond timestamp in with exactly
+	// nine effing digits
+	var tfmt = "2006-01-02T15:04:05||Z07:00"
+	var log = fmt.Sprintf("[%s] %s", l.Timestamp.Format(tfmt), l.Value)
+	var nanos = fmt.Sprintf(".%09d", l.Timestamp.Nanosecond())
+	log = strings.Replace(log, "||", nanos, 1)
+	return log
+}
+
+// Sequence numbers log lines. It's safe for concurrent use, so one Sequence
+// can number the lines of several streams, such as a command's STDOUT and
+// STDERR. The zero value is ready to use, and the first number is 1.
+type Sequence struct {
+	n atomic.Int64
+}
+
+func (q *Sequence) next() int64 {
+	return q.n.Add(1)
+}
+
+// Stream holds a list of Logs captured from some output stream. It's safe to
+// read from a Stream while it's being written to.
+type Stream struct {
+	m           sync.Mutex
+	Logs        []Log
+	lastWrite   time.Time
+	unprocessed string
+	redactor    *Redactor
+	redactions  int
+	seq         *Sequence
+	source      string
+
+	// partialSeq and partialSource are for the unprocessed line: it's
+	// numbered when it's first written, so a line which takes a while to be
+	// finished still sorts where it began
+	partialSeq    int64
+	partialSource string
+}
+
+// New instantiates a new Stream ready for use as an io.Writer
+func New() *Stream {
+	return &Stream{}
+}
+
+// SetRedactor tells the stream to scrub every line with r before storing it
+func (s *Stream) SetRedactor(r *Redactor) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.redactor = r
+}
+
+// SetSequence tells the stream to number its lines from seq, e.g., one shared
+// with other streams. Without it, the stream numbers its lines on its own.
+func (s *Stream) SetSequence(seq *Sequence) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.seq = seq
+}
+
+// SetSource says what's producing the lines written from now on. A partial
+// line which hasn't been finished belongs to the old source, so it's stored
+// as a line of its own.
+func (s *Stream) SetSource(name string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.unprocessed != "" && name != s.source {
+		s.store(s.unprocessed, s.partialSource, s.partialSeq, LevelInfo)
+		s.unprocessed = ""
+	}
+	s.source = name
+}
+
+// nextSeq returns the stream's next sequence number
+func (s *Stream) nextSeq() int64 {
+	if s.seq == nil {
+		s.seq = &Sequence{}
+	}
+	return s.seq.next()
+}
+
+// store redacts and appends a complete line. The caller must hold the lock.
+func (s *Stream) store(line, source string, seq int64, level Level) {
+	var n int
+	line, n = s.redactor.Redact(line)
+	s.redactions += n
+	s.Logs = append(s.Logs, Log{Timestamp: s.lastWrite, Value: line, Source: source, Seq: seq, Level: level})
+	s.lastWrite = s.lastWrite.Add(time.Nanosecond)
+}
+
+// Append stores text as complete lines from the given source, with level as
+// their minimum severity. Unlike Write, it doesn't change the stream's
+// source, and doesn't touch a partial line being written by somebody else.
+func (s *Stream) Append(source string, level Level, text string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.lastWrite = timeNow()
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		s.store(line, source, s.nextSeq(), level)
+	}
+}
+
+// Redactions returns how many values have been redacted from stored lines
+func (s *Stream) Redactions() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.redactions
+}
+
+// partial returns the redacted unprocessed data. It isn't stored redacted
+// because a secret may be split across writes, so we have to redact it every
+// time it's read.
+func (s *Stream) partial() string {
+	var line, _ = s.redactor.Redact(s.unprocessed)
+	return line
+}
+
+// partialLog returns the unprocessed data as a Log
+func (s *Stream) partialLog() Log {
+	return Log{Timestamp: s.lastWrite, Value: s.partial(), Source: s.partialSource, Seq: s.partialSeq}
+}
+
+type timeFunc func() time.Time
+
+// timeNow gives us a way to mock time for testing; it is simply set to
+// time.Now by default
+var timeNow timeFunc = time.Now
+
+// Write implements io.Writer's Write method, splitting up the written data by
+// the OS line split character(s)
+func (s *Stream) Write(data []byte) (n int, err error) {
+	n = len(data)
+
+	// This shouldn't happen, but who knows what crazy things might call a writer
+	if n == 0 {
+		return n, nil
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var str = string(data)
+	var lines = strings.Split(str, "\n")
+	if s.unprocessed == "" {
+		s.partialSeq, s.partialSource = 0, s.source
+	}
+	lines[0] = s.unprocessed + lines[0]
+
+	// Grab anything after the final newline in the string. This works for all cases!
+	//
+	//   - If there are newlines and a partial line, it should be obvious why
+	//     this works.
+	//   - If there are no newlines, lines[0] is the only thing present, and it
+	//     goes into the unprocessed list, leaving lines empty
+	//   - If there isn't anything after the newline (the last character is a
+	//     newline), the last "line" will actually be an empty string because of
+	//     how strings.Split works.
+	var end = len(lines) - 1
+	lines, s.unprocessed = lines[:end], lines[end]
+
+	s.lastWrite = timeNow()
+	for i, line := range lines {
+		var seq = s.partialSeq
+		if i > 0 || seq == 0 {
+			seq = s.nextSeq()
+		}
+		s.store(line, s.partialSource, seq, LevelInfo)
+		s.partialSeq, s.partialSource = 0, s.source
+	}
+	if s.unprocessed != "" && s.partialSeq == 0 {
+		s.partialSeq = s.nextSeq()
+	}
+
+	return n, nil
+}
+
+// LastWrite returns when data was last written to the stream, or the zero
+// time if nothing has been written
+func (s *Stream) LastWrite() time.Time {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.lastWrite
+}
+
+// Timestamped returns the captured output, prefixed with an RFC 3339-formatted
+// timestamp per line. The final value, if present, is given the timestamp of
+// when it was last written to.
+func (s *Stream) Timestamped() []string {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var out []string
+	for _, log := range s.Logs {
+		out = append(out, log.String())
+	}
+	if s.unprocessed != "" {
+		out = append(out, s.partialLog().String())
+	}
+
+	return out
+}
+
+// Since returns the timestamped complete lines starting at index n, for
+// callers following a stream as it's written. A trailing partial line is not
+// included, as it may still grow; use Timestamped once writing is finished to
+// get it.
+func (s *Stream) Since(n int) []string {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var out []string
+	for i := n; i < len(s.Logs); i++ {
+		out = append(out, s.Logs[i].String())
+	}
+	return out
+}
+
+// Values returns the raw captured lines without timestamps, including any
+// trailing partial line
+func (s *Stream) Values() []string {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var out []string
+	for _, log := range s.Logs {
+		out = append(out, log.Value)
+	}
+	if s.unprocessed != "" {
+		out = append(out, s.partial())
+	}
+	return out
+}
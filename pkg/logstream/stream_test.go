@@ -1,6 +1,7 @@
 package logstream
 
 import (
+	"regexp"
 	"testing"
 	"time"
 
@@ -81,3 +82,72 @@ type tcase struct {
 		})
 	}
 }
+
+func TestRedaction(t *testing.T) {
+	timeNow = gettf(1)
+	var s = New()
+	s.SetRedactor(NewRedactor(regexp.MustCompile(`hunter2`), regexp.MustCompile(`key=\w+`)))
+
+	// The secret is split across writes to make sure partial lines are handled
+	s.Write([]byte("connecting with hun"))
+	if got := s.Values(); got[0] != "connecting with hun" {
+		t.Fatalf("unexpected partial value %q", got[0])
+	}
+	s.Write([]byte("ter2\nkey=abc and key=def\npassword: hunter2"))
+
+	var expected = []string{
+		"connecting with [REDACTED]",
+		"[REDACTED] and [REDACTED]",
+		"password: [REDACTED]",
+	}
+	var diff = cmp.Diff(expected, s.Values())
+	if diff != "" {
+		t.Fatal(diff)
+	}
+
+	// Only stored lines are counted: the partial line is redacted on read, so
+	// it'll be counted once it's complete
+	if s.Redactions() != 3 {
+		t.Fatalf("expected 3 redactions, got %d", s.Redactions())
+	}
+}
+
+func TestSourcesAndSequence(t *testing.T) {
+	timeNow = gettf(1)
+	var seq Sequence
+	var out, errs = New(), New()
+	out.SetSequence(&seq)
+	errs.SetSequence(&seq)
+
+	out.SetSource("load_batch")
+	errs.SetSource("load_batch")
+	out.Write([]byte("loading\npartial"))
+	errs.Write([]byte("WARNING odd\n"))
+	out.Append("agent", LevelWarning, "from the agent")
+
+	// A partial line is finished off when the source changes
+	out.SetSource("purge_batch")
+	out.Write([]byte("purging\n"))
+
+	type entry struct {
+		Source string
+		Seq    int64
+		Level  Level
+		Value  string
+	}
+	var got []entry
+	for _, l := range append(out.Leveled(), errs.Leveled()...) {
+		got = append(got, entry{l.Source, l.Seq, l.Level, l.Value})
+	}
+	var expected = []entry{
+		{"load_batch", 1, LevelInfo, "loading"},
+		{"agent", 4, LevelWarning, "from the agent"},
+		{"load_batch", 2, LevelInfo, "partial"},
+		{"purge_batch", 5, LevelInfo, "purging"},
+		{"load_batch", 3, LevelWarning, "WARNING odd"},
+	}
+	var diff = cmp.Diff(expected, got)
+	if diff != "" {
+		t.Fatal(diff)
+	}
+}
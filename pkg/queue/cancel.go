@@ -0,0 +1,172 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Reasons a job's context is canceled. A job which fails because of one has
+// it wrapped into its error.
+var (
+	ErrCanceled = errors.New("job canceled")
+	ErrTimedOut = errors.New("job timed out")
+	ErrShutdown = errors.New("queue shut down")
+)
+
+// SetTimeout limits how long each job may run. A job still running when its
+// time is up has its context canceled, which kills its command. Jobs created
+// before this is called are unaffected. Zero, the default, means no limit.
+func (q *Queue) SetTimeout(d time.Duration) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	q.timeout = d
+}
+
+// Context returns the queue's root context, which every job's context is
+// derived from. It's canceled by Shutdown, so work done on the queue's behalf
+// outside of a job can use it to stop along with the jobs.
+func (q *Queue) Context() context.Context {
+	return q.root
+}
+
+// jobContext derives the context the job runs under from ctx. The job owns
+// it: it's canceled by Cancel, by the job's timeout, by ctx ending (e.g., the
+// queue shutting down), and in any case once the job finishes. An error is
+// returned if the job was canceled before it could start.
+func (j *Job) jobContext(ctx context.Context) (context.Context, error) {
+	j.ctxMu.Lock()
+	defer j.ctxMu.Unlock()
+	if j.canceled != nil {
+		return nil, j.canceled
+	}
+
+	var cancel context.CancelCauseFunc
+	ctx, cancel = context.WithCancelCause(ctx)
+	j.cancel = cancel
+	if j.timeout > 0 {
+		var stop context.CancelFunc
+		ctx, stop = context.WithTimeoutCause(ctx, j.timeout, fmt.Errorf("%w after %s", ErrTimedOut, j.timeout))
+		j.cancel = func(err error) {
+			cancel(err)
+			stop()
+		}
+	}
+	j.ctx = ctx
+	return ctx, nil
+}
+
+// releaseContext frees the job's context once it's finished
+func (j *Job) releaseContext() {
+	j.ctxMu.Lock()
+	defer j.ctxMu.Unlock()
+	if j.cancel != nil {
+		j.cancel(nil)
+	}
+}
+
+// cause returns why the job's context ended early, if it did
+func (j *Job) cause() error {
+	j.ctxMu.Lock()
+	defer j.ctxMu.Unlock()
+	if j.ctx == nil {
+		return nil
+	}
+	var err = context.Cause(j.ctx)
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
+
+// Cancel stops the job: a running job has its context canceled, which kills
+// its command, and a job which hasn't started is finished right away, with
+// StatusCanceled, rather than when the queue reaches it. Cancel returns false
+// if the job has already finished.
+func (j *Job) Cancel(reason string) bool {
+	if j.Finished() {
+		return false
+	}
+
+	j.ctxMu.Lock()
+	if j.canceled == nil {
+		j.canceled = ErrCanceled
+		if reason != "" {
+			j.canceled = fmt.Errorf("%w: %s", ErrCanceled, reason)
+		}
+	}
+	if j.cancel != nil {
+		j.cancel(j.canceled)
+		j.ctxMu.Unlock()
+		return true
+	}
+
+	// The job hasn't been given a context, so it hasn't started and now never
+	// will: jobContext refuses once canceled is set, and Start leaves a
+	// dropped job for us to finish
+	var drop = !j.dropped
+	j.dropped = true
+	j.ctxMu.Unlock()
+	if drop {
+		slog.Info("Canceled job before it started", "id", j.id, "name", j.name, "reason", j.canceled)
+		j.finish(StatusCanceled, j.canceled, time.Hour*24)
+	}
+	return true
+}
+
+// wasDropped returns true if Cancel finished the job before it started
+func (j *Job) wasDropped() bool {
+	j.ctxMu.Lock()
+	defer j.ctxMu.Unlock()
+	return j.dropped
+}
+
+// Shutdown drains the queue: running jobs, including any a worker is still
+// starting, get up to grace to finish, after which the queue's root context
+// is canceled so they're killed. Call it once whatever is running Wait has
+// been stopped, so no new jobs start. Shutdown returns once every job that
+// was running has finished, or grace has passed a second time (a RunFunc
+// which ignores its context can't be forced to stop). It returns the ids of
+// jobs which were still running when grace ran out.
+func (q *Queue) Shutdown(grace time.Duration) []int64 {
+	var running []*Job
+	q.m.RLock()
+	for _, j := range q.lookup {
+		if j.active() {
+			running = append(running, j)
+		}
+	}
+	q.m.RUnlock()
+
+	var timer = time.NewTimer(grace)
+	defer timer.Stop()
+	var waitAll = func() bool {
+		for _, j := range running {
+			select {
+			case <-j.Done():
+			case <-timer.C:
+				return false
+			}
+		}
+		return true
+	}
+
+	if waitAll() {
+		q.stop(ErrShutdown)
+		return nil
+	}
+
+	var killed []int64
+	for _, j := range running {
+		if !j.Finished() {
+			killed = append(killed, j.id)
+		}
+	}
+	slog.Warn("Jobs still running at shutdown; canceling them", "ids", killed, "grace", grace)
+	q.stop(ErrShutdown)
+	timer.Reset(grace)
+	waitAll()
+	return killed
+}
@@ -0,0 +1,23 @@
+package queue
+
+// CheckFunc decides whether a job may still start, e.g., to make sure the
+// files a command is about to read haven't changed since it was queued. It's
+// given the job's id and args (nil for in-process jobs) when the job starts.
+// If it returns an error, the job fails to start with that error.
+type CheckFunc func(id int64, args []string) error
+
+// SetCheck tells the queue how to check jobs before they start. Jobs created
+// before this is called are unaffected.
+func (q *Queue) SetCheck(fn CheckFunc) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	q.check = fn
+}
+
+// runCheck calls the job's CheckFunc, if any
+func (j *Job) runCheck() error {
+	if j.check == nil {
+		return nil
+	}
+	return j.check(j.id, j.args)
+}
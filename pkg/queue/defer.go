@@ -0,0 +1,81 @@
+package queue
+
+import (
+	"log/slog"
+	"time"
+)
+
+// DeferFunc decides whether a job may start yet, e.g., to keep destructive
+// jobs out of business hours. It's given the job's id and args (nil for
+// in-process jobs) when the queue reaches the job, and returns when the job
+// may start: a time which isn't after now lets it start right away. A
+// deferred job stays pending, and DeferFunc is asked again once its time
+// comes, so back-to-back windows can hold a job as long as they need to.
+type DeferFunc func(id int64, args []string, now time.Time) (until time.Time)
+
+// SetDefer tells the queue how to decide whether jobs must wait. Jobs created
+// before this is called are unaffected.
+func (q *Queue) SetDefer(fn DeferFunc) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	q.deferFn = fn
+}
+
+// DeferredUntil returns when a deferred job will be reconsidered, or the zero
+// time if the job isn't deferred
+func (j *Job) DeferredUntil() time.Time {
+	j.deferMu.Lock()
+	defer j.deferMu.Unlock()
+	return j.deferredUntil
+}
+
+func (j *Job) setDeferredUntil(t time.Time) {
+	j.deferMu.Lock()
+	defer j.deferMu.Unlock()
+	j.deferredUntil = t
+}
+
+// hold defers j if its DeferFunc says it can't start yet, returning true if
+// it did. A canceled job is never held, so it finishes right away rather than
+// waiting out its window.
+func (q *Queue) hold(j *Job, now time.Time) bool {
+	if j.deferFn == nil || j.isCanceled() {
+		j.setDeferredUntil(time.Time{})
+		return false
+	}
+	var until = j.deferFn(j.id, j.args, now)
+	if !until.After(now) {
+		j.setDeferredUntil(time.Time{})
+		return false
+	}
+
+	if j.DeferredUntil().IsZero() {
+		slog.Info("Deferring job", "id", j.id, "name", j.name, "until", until)
+	}
+	j.setDeferredUntil(until)
+	q.m.Lock()
+	q.deferred = append(q.deferred, j)
+	q.m.Unlock()
+	return true
+}
+
+// due removes and returns the first deferred job whose time has come (or
+// which was canceled while it waited), or nil if none are ready
+func (q *Queue) due(now time.Time) *Job {
+	q.m.Lock()
+	defer q.m.Unlock()
+	for i, j := range q.deferred {
+		if !j.DeferredUntil().After(now) || j.isCanceled() {
+			q.deferred = append(q.deferred[:i], q.deferred[i+1:]...)
+			return j
+		}
+	}
+	return nil
+}
+
+// isCanceled returns true if Cancel has been called on the job
+func (j *Job) isCanceled() bool {
+	j.ctxMu.Lock()
+	defer j.ctxMu.Unlock()
+	return j.canceled != nil
+}
@@ -0,0 +1,25 @@
+package queue_test
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/open-oni/oni-agent/pkg/queue"
+)
+
+func Example() {
+	var q = queue.New(queue.CommandRunner{Path: "echo"})
+	q.SetHooks(queue.Hooks{
+		Finished: func(j *queue.Job) { fmt.Printf("%s: %s\n", j.Name(), j.Status()) },
+	})
+
+	// Normally you'd run q.Wait in a goroutine and just queue jobs; here we
+	// run a job directly so the example is deterministic
+	var j = q.NewJob("greeting", []string{"hello", "world"})
+	var _ = j.Run(context.Background())
+	fmt.Println(j.StdoutValues())
+
+	// Output:
+	// greeting: successful
+	// [hello world]
+}
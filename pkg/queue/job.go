@@ -0,0 +1,611 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/open-oni/oni-agent/pkg/logstream"
+)
+
+// JobStatus is a way to tell callers what's going on with any job in the queue
+type JobStatus string
+
+// All valid job statuses
+const (
+	StatusPending    JobStatus = "pending"
+	StatusStarted    JobStatus = "started"
+	StatusFailStart  JobStatus = "couldn't start"
+	StatusSuccessful JobStatus = "successful"
+	StatusFailed     JobStatus = "failed"
+	StatusCanceled   JobStatus = "canceled"
+)
+
+// RunFunc is in-process work a job can run instead of an external command.
+// It can log via the job's Logf and Warnf methods, which are captured just
+// like a command's STDOUT and STDERR. ctx is the job's own: it's canceled if
+// the job is canceled, times out, or the queue shuts down.
+type RunFunc func(ctx context.Context, j *Job) error
+
+// Note is a timestamped annotation an operator attached to a job, e.g., to
+// record why it failed or which job replaced it
+type Note struct {
+	Time   time.Time `json:"time"`
+	Author string    `json:"author"`
+	Text   string    `json:"text"`
+}
+
+// ProgressEvent is one step of a job's progress, e.g., a single record of a
+// multi-record load. Total is zero if it isn't known.
+type ProgressEvent struct {
+	Time    time.Time         `json:"time"`
+	Done    int               `json:"done"`
+	Total   int               `json:"total,omitempty"`
+	Message string            `json:"message"`
+	Detail  map[string]string `json:"detail,omitempty"`
+}
+
+// Job represents a single command (or RunFunc) to be run
+type Job struct {
+	id            int64
+	stateMu       sync.RWMutex
+	status        JobStatus
+	starting      bool
+	cmd           *exec.Cmd
+	fn            RunFunc
+	done          chan error
+	finished      chan struct{}
+	afterID       int64
+	after         *Job
+	artifactsMu   sync.Mutex
+	artifacts     []string
+	notesMu       sync.Mutex
+	notes         []Note
+	labelsMu      sync.Mutex
+	labels        map[string][]string
+	progressMu    sync.Mutex
+	progress      []ProgressEvent
+	stallSeen     time.Time
+	deferMu       sync.Mutex
+	deferredUntil time.Time
+	ctxMu         sync.Mutex
+	ctx           context.Context
+	cancel        context.CancelCauseFunc
+	canceled      error
+	dropped       bool
+	timeout       time.Duration
+	name          string
+	runner        Runner
+	hooks         Hooks
+	steps         StepFunc
+	lock          LockFunc
+	check         CheckFunc
+	unlock        func()
+	deferFn       DeferFunc
+	classFn       ClassFunc
+	cls           string
+	classified    bool
+	env           string
+	args          []string
+	queuedAt      time.Time
+	startedAt     time.Time
+	completedAt   time.Time
+	purgeAt       time.Time
+	retention     time.Duration
+	err           error
+	stdout        logstream.Stream
+	stderr        logstream.Stream
+	logSeq        logstream.Sequence
+	pid           int
+}
+
+// AgentSource is the log source of lines the agent itself writes with Logf
+// and Warnf, as opposed to output from the commands a job runs
+const AgentSource = "agent"
+
+// NoOpJob returns a job that does nothing and has a success status
+func NoOpJob() *Job {
+	var finished = make(chan struct{})
+	close(finished)
+	return &Job{
+		id:          -1,
+		name:        "No-op job",
+		status:      StatusSuccessful,
+		cmd:         nil,
+		args:        nil,
+		queuedAt:    time.Now(),
+		startedAt:   time.Now(),
+		completedAt: time.Now(),
+		err:         nil,
+		stdout:      logstream.Stream{},
+		stderr:      logstream.Stream{},
+		pid:         -1,
+		finished:    finished,
+	}
+}
+
+// Start creates the command with a context derived from the given one,
+// starting the command and storing its pid and start time. After calling
+// start, wait must then be called to let the command finish and release
+// resources.
+func (j *Job) Start(ctx context.Context) error {
+	var err = j.checkPrerequisite()
+	if err == nil {
+		err = j.runCheck()
+	}
+	if err == nil {
+		ctx, err = j.jobContext(ctx)
+	}
+	if err == nil {
+		err = j.takeLock(ctx)
+	}
+	if err != nil && j.wasDropped() {
+		return err
+	}
+	if err != nil {
+		slog.Warn("Not starting job", "id", j.id, "name", j.name, "error", err)
+		j.finish(failureStatus(err, StatusFailStart), err, time.Hour*24)
+		return err
+	}
+
+	if j.fn == nil && j.steps != nil {
+		var pre, post = j.steps(j.id, j.args)
+		if len(pre)+len(post) > 0 {
+			j.fn = j.withSteps(pre, post)
+		}
+	}
+	if j.fn != nil {
+		return j.startFunc(ctx)
+	}
+
+	j.cmd = j.runner.Command(ctx, j.args)
+	j.setSource(commandSource(j.args))
+	j.cmd.Stdout = &j.stdout
+	j.cmd.Stderr = &j.stderr
+	var logger = slog.With("id", j.id, "command", j.args)
+
+	logger.Info("Starting job", "id", j.id, "command", j.args)
+	err = j.cmd.Start()
+	if err != nil {
+		logger.Error("Unable to start job", "error", err)
+		j.finish(StatusFailStart, err, time.Hour*24)
+		return err
+	}
+	logger.Info("Job started successfully", "id", j.id, "command", j.args)
+
+	j.started(j.cmd.Process.Pid)
+	return nil
+}
+
+// checkPrerequisite returns an error if the job depends on another job which
+// hasn't finished successfully
+func (j *Job) checkPrerequisite() error {
+	if j.afterID == 0 {
+		return nil
+	}
+	if j.after == nil {
+		return fmt.Errorf("prerequisite job %d not found", j.afterID)
+	}
+	select {
+	case <-j.after.Done():
+	default:
+		return fmt.Errorf("prerequisite job %d has not finished", j.after.id)
+	}
+	if j.after.Status() != StatusSuccessful {
+		return fmt.Errorf("prerequisite job %d did not succeed", j.after.id)
+	}
+	return nil
+}
+
+// startFunc runs the job's RunFunc in the background. A panic is turned into
+// an error rather than taking down the whole agent.
+func (j *Job) startFunc(ctx context.Context) error {
+	slog.Info("Starting agent job", "id", j.id, "name", j.name)
+	j.done = make(chan error, 1)
+	j.started(-1)
+	go func() {
+		defer func() {
+			var r = recover()
+			if r != nil {
+				j.done <- fmt.Errorf("job panicked: %v", r)
+			}
+		}()
+		j.done <- j.fn(ctx, j)
+	}()
+
+	return nil
+}
+
+// Logf writes a formatted line to the job's STDOUT log
+func (j *Job) Logf(format string, args ...any) {
+	j.stdout.Append(AgentSource, logstream.LevelInfo, fmt.Sprintf(format, args...))
+}
+
+// Warnf writes a formatted line to the job's STDERR log. Its level is at
+// least a warning, however the line looks.
+func (j *Job) Warnf(format string, args ...any) {
+	j.stderr.Append(AgentSource, logstream.LevelWarning, fmt.Sprintf(format, args...))
+}
+
+// setSource says which program's output the job's logs are capturing
+func (j *Job) setSource(name string) {
+	j.stdout.SetSource(name)
+	j.stderr.SetSource(name)
+}
+
+// commandSource is the log source for a command's output: its first arg,
+// which for ONI is the management command, e.g., "load_batch"
+func commandSource(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	return args[0]
+}
+
+// AddArtifact records the name of an artifact the job produced. Like notes,
+// artifacts may be added after the job finishes.
+func (j *Job) AddArtifact(name string) {
+	j.artifactsMu.Lock()
+	j.artifacts = append(j.artifacts, name)
+	j.artifactsMu.Unlock()
+}
+
+// Artifacts returns the names of all artifacts the job produced
+func (j *Job) Artifacts() []string {
+	j.artifactsMu.Lock()
+	defer j.artifactsMu.Unlock()
+	return append([]string(nil), j.artifacts...)
+}
+
+// AddNote attaches a note to the job, returning it. Notes may be added at any
+// point in the job's life, including after it finishes.
+func (j *Job) AddNote(author, text string) Note {
+	var n = Note{Time: time.Now(), Author: author, Text: text}
+	j.notesMu.Lock()
+	j.notes = append(j.notes, n)
+	j.notesMu.Unlock()
+	return n
+}
+
+// Notes returns all notes attached to the job, oldest first
+func (j *Job) Notes() []Note {
+	j.notesMu.Lock()
+	defer j.notesMu.Unlock()
+	return append([]Note(nil), j.notes...)
+}
+
+// SetLabel attaches metadata to the job, e.g., the LCCNs a title load
+// affects, so clients can find the job without reading its logs. Setting a
+// label again replaces its values.
+func (j *Job) SetLabel(key string, values ...string) {
+	j.labelsMu.Lock()
+	defer j.labelsMu.Unlock()
+	if j.labels == nil {
+		j.labels = make(map[string][]string)
+	}
+	j.labels[key] = append([]string(nil), values...)
+}
+
+// Labels returns a copy of the job's labels, or nil if it has none
+func (j *Job) Labels() map[string][]string {
+	j.labelsMu.Lock()
+	defer j.labelsMu.Unlock()
+	if len(j.labels) == 0 {
+		return nil
+	}
+	var labels = make(map[string][]string, len(j.labels))
+	for k, v := range j.labels {
+		labels[k] = append([]string(nil), v...)
+	}
+	return labels
+}
+
+// Wait wraps exec.Cmd.Wait, waiting for the command to exit and various stream
+// copying to complete, setting the completed time if successful.
+func (j *Job) Wait() error {
+	var logger = slog.With("id", j.id, "command", j.args)
+
+	var err = j.Error()
+	if err != nil {
+		logger.Error("Invalid job state in Job.Wait: job already has an error from a previous operation", "error", err)
+		return fmt.Errorf("waiting for job completion: cannot start due to previous error: %w", err)
+	}
+	if j.StartedAt().IsZero() {
+		logger.Error("Invalid job state in Job.Wait: job has not been started")
+		return fmt.Errorf("waiting for job completion: Start must first be called")
+	}
+
+	if j.fn != nil {
+		err = <-j.done
+	} else {
+		err = j.cmd.Wait()
+	}
+	if err != nil {
+		var cause = j.cause()
+		if cause != nil && !errors.Is(err, cause) {
+			err = fmt.Errorf("%w: %w", cause, err)
+		}
+		logger.Error("Job failed", "error", err)
+		j.finish(failureStatus(err, StatusFailed), err, time.Hour*24)
+		return err
+	}
+
+	logger.Info("Job complete")
+	j.finish(StatusSuccessful, nil, time.Hour*24*7)
+	return nil
+}
+
+// failureStatus returns StatusCanceled if err is because the job was
+// canceled, and otherwise status
+func failureStatus(err error, status JobStatus) JobStatus {
+	if errors.Is(err, ErrCanceled) {
+		return StatusCanceled
+	}
+	return status
+}
+
+// finish records the job's terminal state, keeping it for the given time by
+// default, and signals anybody waiting on Done. It must only be called once.
+func (j *Job) finish(status JobStatus, err error, keep time.Duration) {
+	j.stateMu.Lock()
+	j.status = status
+	j.starting = false
+	j.err = err
+	j.completedAt = time.Now()
+	j.purgeAt = j.completedAt.Add(j.keep(keep))
+	j.stateMu.Unlock()
+
+	j.releaseLock()
+	j.releaseContext()
+	if j.finished != nil {
+		close(j.finished)
+	}
+	if j.hooks.Finished != nil {
+		j.hooks.Finished(j)
+	}
+}
+
+// started marks the job as running under the given pid (-1 for in-process
+// jobs) and calls the Started hook, if any
+func (j *Job) started(pid int) {
+	j.stateMu.Lock()
+	j.status = StatusStarted
+	j.starting = false
+	j.startedAt = time.Now()
+	j.pid = pid
+	j.stateMu.Unlock()
+
+	if j.hooks.Started != nil {
+		j.hooks.Started(j)
+	}
+}
+
+// Done returns a channel which is closed once the job has reached a terminal
+// state, for callers who want to block until the job is finished
+func (j *Job) Done() <-chan struct{} {
+	return j.finished
+}
+
+// keep returns how long the job should be kept after it finishes: the
+// queue's configured retention if there is one, otherwise the given default
+func (j *Job) keep(def time.Duration) time.Duration {
+	if j.retention > 0 {
+		return j.retention
+	}
+	return def
+}
+
+// Run starts the job and waits for it to complete
+func (j *Job) Run(ctx context.Context) error {
+	var err = j.Start(ctx)
+	if err == nil {
+		err = j.Wait()
+	}
+
+	return err
+}
+
+// LastOutput returns when the job last wrote to STDOUT or STDERR, or when it
+// started if it hasn't written anything yet. It's the zero time for jobs
+// which haven't started.
+func (j *Job) LastOutput() time.Time {
+	var last = j.StartedAt()
+	for _, t := range []time.Time{j.stdout.LastWrite(), j.stderr.LastWrite()} {
+		if t.After(last) {
+			last = t
+		}
+	}
+	return last
+}
+
+// Stalled returns true if the job is running but hasn't produced any output
+// for longer than threshold. This is purely informational: the job's status
+// doesn't change, since a quiet job may just be doing something slow.
+func (j *Job) Stalled(threshold time.Duration) bool {
+	return threshold > 0 && j.Status() == StatusStarted && time.Since(j.LastOutput()) > threshold
+}
+
+// ID returns the job's assigned ID number
+func (j *Job) ID() int64 {
+	return j.id
+}
+
+// Name returns the human-friendly name of the job
+func (j *Job) Name() string {
+	return j.name
+}
+
+// Args returns a copy of the args the job's command is run with; for
+// in-process jobs, it's empty
+func (j *Job) Args() []string {
+	return append([]string(nil), j.args...)
+}
+
+// QueuedAt returns when the job was created (sent to the job queue)
+func (j *Job) QueuedAt() time.Time {
+	j.stateMu.RLock()
+	defer j.stateMu.RUnlock()
+	return j.queuedAt
+}
+
+// StartedAt returns when the job started running, or the zero time if it
+// hasn't (or couldn't)
+func (j *Job) StartedAt() time.Time {
+	j.stateMu.RLock()
+	defer j.stateMu.RUnlock()
+	return j.startedAt
+}
+
+// CompletedAt returns when the job reached a terminal state, successful or
+// not, or the zero time if it hasn't yet
+func (j *Job) CompletedAt() time.Time {
+	j.stateMu.RLock()
+	defer j.stateMu.RUnlock()
+	return j.completedAt
+}
+
+// Environment returns the identifier of the environment the job was queued
+// in; see Queue.SetEnvironment
+func (j *Job) Environment() string {
+	return j.env
+}
+
+// Status returns the job's status value
+func (j *Job) Status() JobStatus {
+	j.stateMu.RLock()
+	defer j.stateMu.RUnlock()
+	return j.status
+}
+
+// Error returns the first error which occurred when queueing, starting, or
+// running the job
+func (j *Job) Error() error {
+	j.stateMu.RLock()
+	defer j.stateMu.RUnlock()
+	return j.err
+}
+
+// Stdout returns the captured output to STDOUT
+func (j *Job) Stdout() []string {
+	return j.stdout.Timestamped()
+}
+
+// StdoutLeveled returns the captured STDOUT lines, timestamped and tagged
+// with their heuristic log levels
+func (j *Job) StdoutLeveled() []logstream.Leveled {
+	return j.stdout.Leveled()
+}
+
+// StderrLeveled returns the captured STDERR lines, timestamped and tagged
+// with their heuristic log levels
+func (j *Job) StderrLeveled() []logstream.Leveled {
+	return j.stderr.Leveled()
+}
+
+// Redactions returns the number of values redacted from the job's logs
+func (j *Job) Redactions() int {
+	return j.stdout.Redactions() + j.stderr.Redactions()
+}
+
+// StdoutValues returns the captured output to STDOUT without timestamps
+func (j *Job) StdoutValues() []string {
+	return j.stdout.Values()
+}
+
+// StdoutSince returns complete STDOUT lines starting at index n
+func (j *Job) StdoutSince(n int) []string {
+	return j.stdout.Since(n)
+}
+
+// StderrSince returns complete STDERR lines starting at index n
+func (j *Job) StderrSince(n int) []string {
+	return j.stderr.Since(n)
+}
+
+// Finished returns true if the job has reached a terminal state
+func (j *Job) Finished() bool {
+	switch j.Status() {
+	case StatusFailStart, StatusSuccessful, StatusFailed, StatusCanceled:
+		return true
+	}
+	return false
+}
+
+// Stderr returns the captured output to STDERR
+func (j *Job) Stderr() []string {
+	return j.stderr.Timestamped()
+}
+
+// AddProgress records a progress event and passes it to the Progress hook.
+// The event's time is set to now if it's zero.
+func (j *Job) AddProgress(e ProgressEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	j.progressMu.Lock()
+	j.progress = append(j.progress, e)
+	j.progressMu.Unlock()
+	if j.hooks.Progress != nil {
+		j.hooks.Progress(j, e)
+	}
+}
+
+// Progress returns the job's progress events, oldest first
+func (j *Job) Progress() []ProgressEvent {
+	j.progressMu.Lock()
+	defer j.progressMu.Unlock()
+	return append([]ProgressEvent(nil), j.progress...)
+}
+
+// Record is a serializable snapshot of a job, used for archiving jobs once
+// they're purged from the in-memory queue
+type Record struct {
+	ID          int64               `json:"id"`
+	Name        string              `json:"name"`
+	Status      JobStatus           `json:"status"`
+	Args        []string            `json:"args"`
+	Environment string              `json:"environment,omitempty"`
+	QueuedAt    time.Time           `json:"queued"`
+	StartedAt   time.Time           `json:"started"`
+	CompletedAt time.Time           `json:"completed"`
+	Error       string              `json:"error,omitempty"`
+	Redactions  int                 `json:"redactions"`
+	Artifacts   []string            `json:"artifacts,omitempty"`
+	Notes       []Note              `json:"notes,omitempty"`
+	Labels      map[string][]string `json:"labels,omitempty"`
+	Progress    []ProgressEvent     `json:"progress,omitempty"`
+	Stdout      []string            `json:"stdout"`
+	Stderr      []string            `json:"stderr"`
+}
+
+// Record returns a snapshot of the job's current state and logs
+func (j *Job) Record() Record {
+	j.stateMu.RLock()
+	var r = Record{
+		ID:          j.id,
+		Name:        j.name,
+		Status:      j.status,
+		Args:        j.args,
+		Environment: j.env,
+		QueuedAt:    j.queuedAt,
+		StartedAt:   j.startedAt,
+		CompletedAt: j.completedAt,
+	}
+	if j.err != nil {
+		r.Error = j.err.Error()
+	}
+	j.stateMu.RUnlock()
+
+	r.Redactions = j.Redactions()
+	r.Artifacts = j.Artifacts()
+	r.Notes = j.Notes()
+	r.Labels = j.Labels()
+	r.Progress = j.Progress()
+	r.Stdout = j.Stdout()
+	r.Stderr = j.Stderr()
+	return r
+}
@@ -0,0 +1,46 @@
+package queue
+
+import (
+	"context"
+	"log/slog"
+)
+
+// LockFunc takes whatever lock a job needs before it starts, e.g., so two
+// programs which must never run at the same time don't, even when one of
+// them isn't run by this queue. It's given the job's id and args (nil for
+// in-process jobs) when the job starts. If it returns an error, the job fails
+// to start with that error; otherwise release is called once the job
+// finishes, however it finishes. A nil release is fine for jobs which don't
+// need a lock.
+type LockFunc func(ctx context.Context, id int64, args []string) (release func(), err error)
+
+// SetLock tells the queue how to lock jobs. Jobs created before this is
+// called are unaffected.
+func (q *Queue) SetLock(fn LockFunc) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	q.lock = fn
+}
+
+// takeLock calls the job's LockFunc, if any, holding onto the release func
+func (j *Job) takeLock(ctx context.Context) error {
+	if j.lock == nil {
+		return nil
+	}
+	var release, err = j.lock(ctx, j.id, j.args)
+	if err != nil {
+		return err
+	}
+	j.unlock = release
+	return nil
+}
+
+// releaseLock releases the job's lock, if it took one
+func (j *Job) releaseLock() {
+	if j.unlock == nil {
+		return
+	}
+	slog.Debug("Releasing job lock", "id", j.id)
+	j.unlock()
+	j.unlock = nil
+}
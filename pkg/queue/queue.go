@@ -0,0 +1,450 @@
+// Package queue manages a simple in-memory job queue for spawning, running,
+// and storing logs from commands.
+//
+// Jobs run one at a time, in the order they were queued, though a DeferFunc
+// can hold a job back until later without holding up the jobs behind it. A
+// queue given more workers runs jobs side by side, as far as the concurrency
+// classes its ClassFunc puts them in allow.
+// What a job runs is decided by the queue's Runner (or by a RunFunc for
+// in-process work), so nothing here is specific to ONI. Callers can observe
+// jobs via Hooks, and plug in an Archiver to persist jobs once they're purged
+// from memory.
+//
+// This package is meant for reuse by other Open ONI tooling: its exported API
+// follows semantic versioning along with this module.
+package queue
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/open-oni/oni-agent/pkg/logstream"
+)
+
+// Archiver is anything which can durably store jobs that are being purged
+// from the queue's in-memory store
+type Archiver interface {
+	Write(records []Record) error
+}
+
+// Queue holds the list of jobs we need to run
+type Queue struct {
+	m         sync.RWMutex
+	seq       int64
+	lookup    map[int64]*Job
+	runner    Runner
+	hooks     Hooks
+	steps     StepFunc
+	lock      LockFunc
+	check     CheckFunc
+	deferFn   DeferFunc
+	classFn   ClassFunc
+	workers   int
+	queue     chan *Job
+	deferred  []*Job
+	retention time.Duration
+	archiver  Archiver
+	redactor  *logstream.Redactor
+	env       string
+	paused    bool
+	pausedAt  time.Time
+	reason    string
+	timeout   time.Duration
+	root      context.Context
+	stop      context.CancelCauseFunc
+}
+
+// Status summarizes the queue's current state
+type Status struct {
+	Paused   bool      `json:"paused"`
+	PausedAt time.Time `json:"paused_at,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	Pending  int       `json:"pending"`
+	Deferred int       `json:"deferred"`
+	Running  []int64   `json:"running"`
+}
+
+// New provides a new job queue which uses r to build each job's command
+func New(r Runner) *Queue {
+	var root, stop = context.WithCancelCause(context.Background())
+	return &Queue{lookup: make(map[int64]*Job), queue: make(chan *Job, 1000), runner: r, root: root, stop: stop}
+}
+
+// SetHooks registers callbacks for job lifecycle events. They apply to jobs
+// created after the call.
+func (q *Queue) SetHooks(h Hooks) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	q.hooks = h
+}
+
+// SetRetention overrides how long finished jobs are kept in memory. By
+// default successful jobs are kept for a week and failed jobs for a day.
+func (q *Queue) SetRetention(d time.Duration) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	q.retention = d
+}
+
+// SetArchiver tells the queue to send jobs to the given archiver when they're
+// purged rather than simply discarding them
+func (q *Queue) SetArchiver(a Archiver) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	q.archiver = a
+}
+
+// SetRedactor sets up all new jobs' log streams to be scrubbed by r
+func (q *Queue) SetRedactor(r *logstream.Redactor) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	q.redactor = r
+}
+
+// SetEnvironment sets an opaque identifier for the environment jobs run in
+// (e.g., a fingerprint of the program the Runner calls). Jobs created after
+// the call are stamped with it, so callers can tell when a job was queued
+// under a different environment than the current one.
+func (q *Queue) SetEnvironment(env string) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	q.env = env
+}
+
+// Pause stops the queue from starting new jobs. Jobs can still be queued, and
+// a job that's already running is left alone.
+func (q *Queue) Pause(reason string) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	if !q.paused {
+		q.pausedAt = time.Now()
+	}
+	q.paused = true
+	q.reason = reason
+}
+
+// Resume lets the queue start jobs again
+func (q *Queue) Resume() {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	q.paused = false
+	q.pausedAt = time.Time{}
+	q.reason = ""
+}
+
+// Paused returns true if the queue isn't starting new jobs
+func (q *Queue) Paused() bool {
+	q.m.RLock()
+	defer q.m.RUnlock()
+	return q.paused
+}
+
+// Status returns a summary of the queue's state
+func (q *Queue) Status() Status {
+	q.m.RLock()
+	defer q.m.RUnlock()
+
+	var st = Status{Paused: q.paused, PausedAt: q.pausedAt, Reason: q.reason, Running: []int64{}}
+	for _, j := range q.lookup {
+		switch j.Status() {
+		case StatusPending:
+			if !j.QueuedAt().IsZero() {
+				st.Pending++
+			}
+			if !j.DeferredUntil().IsZero() {
+				st.Deferred++
+			}
+		case StatusStarted:
+			st.Running = append(st.Running, j.id)
+		}
+	}
+	sort.Slice(st.Running, func(i, j int) bool { return st.Running[i] < st.Running[j] })
+
+	return st
+}
+
+// NewJob returns a Job set up to call the queue's Runner with the given args
+func (q *Queue) NewJob(name string, args []string) *Job {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	// Since we don't know when a job will run, we give new jobs a wide berth for
+	// purging: if the purge isn't set elsewhere for some odd reason, they'll
+	// still get cleaned up after a month.
+	var purgeTime = time.Now().Add(time.Hour * 24 * 30)
+	q.seq++
+	var j = &Job{
+		name:      name,
+		runner:    q.runner,
+		hooks:     q.hooks,
+		steps:     q.steps,
+		lock:      q.lock,
+		check:     q.check,
+		deferFn:   q.deferFn,
+		classFn:   q.classFn,
+		env:       q.env,
+		args:      args,
+		id:        q.seq,
+		status:    StatusPending,
+		purgeAt:   purgeTime,
+		retention: q.retention,
+		timeout:   q.timeout,
+		finished:  make(chan struct{}),
+	}
+	j.stdout.SetRedactor(q.redactor)
+	j.stderr.SetRedactor(q.redactor)
+	j.stdout.SetSequence(&j.logSeq)
+	j.stderr.SetSequence(&j.logSeq)
+	q.lookup[j.id] = j
+
+	return j
+}
+
+// NewFuncJob returns a Job set up to run in-process work rather than a
+// command
+func (q *Queue) NewFuncJob(name string, fn RunFunc) *Job {
+	var j = q.NewJob(name, nil)
+	j.fn = fn
+	return j
+}
+
+// QueueFunc queues up in-process work, returning the queued job's id
+func (q *Queue) QueueFunc(name string, fn RunFunc) int64 {
+	var j = q.NewFuncJob(name, fn)
+	q.enqueue(j)
+
+	return j.id
+}
+
+// QueueJob queues up a new command from the given args, and returns the
+// queued job's id
+func (q *Queue) QueueJob(name string, args []string) int64 {
+	var j = q.NewJob(name, args)
+	q.enqueue(j)
+
+	return j.id
+}
+
+// QueueJobAfter queues up a new command which only runs if the job with the
+// given id (which must already be queued) succeeds. If it doesn't, this job
+// fails to start. The queued job's id is returned.
+func (q *Queue) QueueJobAfter(name string, args []string, after int64) int64 {
+	var j = q.NewJob(name, args)
+	j.afterID = after
+	j.after = q.GetJob(after)
+	q.enqueue(j)
+
+	return j.id
+}
+
+// QueueFuncAfter queues up in-process work which only runs if the job with
+// the given id (which must already be queued) succeeds, like QueueJobAfter.
+// The queued job's id is returned.
+func (q *Queue) QueueFuncAfter(name string, fn RunFunc, after int64) int64 {
+	var j = q.NewFuncJob(name, fn)
+	j.afterID = after
+	j.after = q.GetJob(after)
+	q.enqueue(j)
+
+	return j.id
+}
+
+// enqueue stamps the job's queue time and sends it to the queue
+func (q *Queue) enqueue(j *Job) {
+	j.stateMu.Lock()
+	j.queuedAt = time.Now()
+	j.stateMu.Unlock()
+	if j.hooks.Queued != nil {
+		j.hooks.Queued(j)
+	}
+	q.queue <- j
+}
+
+// GetJob returns a job by its id
+func (q *Queue) GetJob(id int64) *Job {
+	q.m.RLock()
+	defer q.m.RUnlock()
+
+	return q.lookup[id]
+}
+
+// AllJobs returns all jobs currently stored in memory
+func (q *Queue) AllJobs() []*Job {
+	q.m.RLock()
+	defer q.m.RUnlock()
+
+	var list []*Job
+	for _, j := range q.lookup {
+		list = append(list, j)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].QueuedAt().Before(list[j].QueuedAt())
+	})
+
+	return list
+}
+
+func (q *Queue) purgeOldJobs() {
+	q.purgeJobs(nil)
+}
+
+// purgeJobs purges expired jobs other than those in running, which a worker
+// may still be writing to. Purges only happen on the dispatch loop, so the
+// queue needn't stay locked while the jobs are archived.
+func (q *Queue) purgeJobs(running map[*Job]string) {
+	var expired = q.expiredJobs(running)
+	if len(expired) == 0 {
+		return
+	}
+
+	// If archiving fails we hang onto the jobs so the next purge can try again
+	if q.archiver != nil {
+		var records []Record
+		for _, j := range expired {
+			records = append(records, j.Record())
+		}
+		var err = q.archiver.Write(records)
+		if err != nil {
+			slog.Error("Unable to archive jobs; they will remain in memory", "count", len(records), "error", err)
+			return
+		}
+	}
+
+	q.m.Lock()
+	defer q.m.Unlock()
+	for _, j := range expired {
+		delete(q.lookup, j.id)
+	}
+}
+
+// expiredJobs returns the jobs due to be purged, skipping those in running
+func (q *Queue) expiredJobs(running map[*Job]string) []*Job {
+	q.m.RLock()
+	defer q.m.RUnlock()
+
+	var now = time.Now()
+	var expired []*Job
+	for _, j := range q.lookup {
+		if _, ok := running[j]; ok {
+			continue
+		}
+		if j.expired(now) {
+			expired = append(expired, j)
+		}
+	}
+	return expired
+}
+
+// WatchStalls checks running jobs every interval until ctx is canceled,
+// logging a warning (and calling the Stalled hook, if any) for each job which
+// has produced no output for longer than threshold
+func (q *Queue) WatchStalls(ctx context.Context, threshold, interval time.Duration) {
+	var t = time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			q.checkStalls(threshold)
+		}
+	}
+}
+
+// checkStalls reports newly stalled jobs
+func (q *Queue) checkStalls(threshold time.Duration) {
+	for _, j := range q.AllJobs() {
+		if !j.Stalled(threshold) {
+			continue
+		}
+
+		// A stall is identified by the last output time: until the job writes
+		// something new, it's the same stall and we've already reported it
+		var last = j.LastOutput()
+		if !j.newStall(last) {
+			continue
+		}
+
+		slog.Warn("Job appears to be stalled", "id", j.id, "name", j.name, "last_output", last, "quiet_for", time.Since(last).Round(time.Second))
+		if j.hooks.Stalled != nil {
+			j.hooks.Stalled(j)
+		}
+	}
+}
+
+// expired returns true if the job's time in memory is up
+func (j *Job) expired(now time.Time) bool {
+	j.stateMu.RLock()
+	defer j.stateMu.RUnlock()
+	return now.After(j.purgeAt)
+}
+
+// newStall records last as the output time of the job's current stall,
+// returning false if that stall was already recorded
+func (j *Job) newStall(last time.Time) bool {
+	j.stateMu.Lock()
+	defer j.stateMu.Unlock()
+	if j.stallSeen.Equal(last) {
+		return false
+	}
+	j.stallSeen = last
+	return true
+}
+
+// Wait runs until ctx is canceled, watching for new jobs that need to be
+// queued up. Jobs run under the queue's root context rather than ctx, so
+// canceling ctx stops new jobs from starting but lets a running job finish;
+// see Shutdown.
+func (q *Queue) Wait(ctx context.Context) {
+	q.m.RLock()
+	var workers = q.workers
+	q.m.RUnlock()
+	if workers > 1 {
+		q.waitPool(ctx, workers)
+		return
+	}
+
+	var lastPurgeCheck time.Time
+	for {
+		if q.Paused() {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		// Deferred jobs whose time has come go ahead of anything queued after
+		// them
+		if j := q.due(time.Now()); j != nil {
+			if !q.hold(j, time.Now()) {
+				_ = j.Run(q.root)
+			}
+			continue
+		}
+
+		select {
+		case j := <-q.queue:
+			// We ignore errors here, as they're already logged by the job itself,
+			// and nothing can be done about them anyway
+			if !q.hold(j, time.Now()) {
+				_ = j.Run(q.root)
+			}
+		case <-ctx.Done():
+			return
+		default:
+			if time.Since(lastPurgeCheck) > time.Hour {
+				q.purgeOldJobs()
+				lastPurgeCheck = time.Now()
+			}
+			time.Sleep(time.Second)
+		}
+	}
+}
@@ -0,0 +1,952 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/open-oni/oni-agent/pkg/logstream"
+)
+
+var wd, testdir string
+
+func getQ(t *testing.T) *Queue {
+	var err error
+	wd, err = os.Getwd()
+	if err != nil {
+		t.Fatalf("Unable to get working dir: %s", err)
+	}
+	testdir = filepath.Join(wd, "testdata")
+	return New(CommandRunner{Path: filepath.Join(testdir, "manage.py")})
+}
+
+func TestJobLifecycle(t *testing.T) {
+	var q = getQ(t)
+	var j = q.NewJob("test job", []string{"arg1", "arg2"})
+
+	if j.Status() != StatusPending {
+		t.Errorf("expected status %s, got %s", StatusPending, j.Status())
+	}
+
+	if j.ID() <= 0 {
+		t.Error("expected positive job ID")
+	}
+
+	if j.Name() != "test job" {
+		t.Errorf("expected name %s, got %s", "test job", j.Name())
+	}
+
+	var fetchedJob = q.GetJob(j.ID())
+	if fetchedJob != j {
+		t.Error("GetJob returned wrong job")
+	}
+}
+
+func TestQueueJob(t *testing.T) {
+	var q = getQ(t)
+	var jobID = q.QueueJob("test job", []string{"arg1"})
+
+	var j = q.GetJob(jobID)
+	if j == nil {
+		t.Fatal("queued job not found")
+	}
+
+	if j.queuedAt.IsZero() {
+		t.Error("queuedAt not set")
+	}
+}
+
+func TestJobExecution_Success(t *testing.T) {
+	var q = getQ(t)
+	var j = q.NewJob("Test success", []string{"succeed"})
+	var err = j.Run(context.Background())
+
+	if err != nil {
+		t.Errorf("job execution failed: %v", err)
+	}
+
+	if j.Status() != StatusSuccessful {
+		t.Errorf("expected status %s, got %s", StatusSuccessful, j.Status())
+	}
+
+	var stdout = j.Stdout()
+	if len(stdout) != 1 || !strings.Contains(stdout[0], "Yes!") {
+		t.Error("unexpected stdout content")
+	}
+}
+
+func TestJobExecution_Fail(t *testing.T) {
+	var q = getQ(t)
+	var j = q.NewJob("Test failure", []string{"fail"})
+	var err = j.Run(context.Background())
+
+	if err == nil {
+		t.Error("expected error from failing job")
+	}
+
+	if j.Status() != StatusFailed {
+		t.Errorf("expected status %s, got %s", StatusFailed, j.Status())
+	}
+}
+
+func TestPurgeOldJobs(t *testing.T) {
+	var q = New(CommandRunner{Path: "/opt/openoni/manage.py"})
+	var j = q.NewJob("test purge", []string{"arg1"})
+
+	var id = j.ID()
+	if q.GetJob(id) != j {
+		t.Error("job should be in the queue, but wasn't found")
+	}
+
+	q.purgeOldJobs()
+	if q.GetJob(id) != j {
+		t.Error("job shouldn't have been purged yet")
+	}
+
+	j.purgeAt = time.Now().Add(-time.Hour)
+	q.purgeOldJobs()
+
+	if q.GetJob(id) != nil {
+		t.Error("job not purged")
+	}
+}
+
+func TestAllJobs(t *testing.T) {
+	var q = New(CommandRunner{Path: "/opt/openoni/manage.py"})
+	var j1 = q.NewJob("job1", []string{"arg1"})
+	j1.queuedAt = time.Now()
+	var j2 = q.NewJob("job2", []string{"arg2"})
+	j2.queuedAt = j1.queuedAt.Add(-1 * time.Hour)
+
+	var jobs = q.AllJobs()
+
+	if len(jobs) != 2 {
+		t.Errorf("expected 2 jobs, got %d", len(jobs))
+	}
+
+	if jobs[0] != j2 || jobs[1] != j1 {
+		t.Error("jobs not returned in correct order")
+	}
+}
+
+func TestWaitInvalidState(t *testing.T) {
+	var j = &Job{status: StatusPending}
+
+	var err = j.Wait()
+	if err == nil {
+		t.Error("expected error when waiting without starting")
+	}
+}
+
+type fakeArchiver struct {
+	records []Record
+	err     error
+}
+
+func (a *fakeArchiver) Write(records []Record) error {
+	if a.err != nil {
+		return a.err
+	}
+	a.records = append(a.records, records...)
+	return nil
+}
+
+func TestPurgeArchivesJobs(t *testing.T) {
+	var q = New(CommandRunner{Path: "/opt/openoni/manage.py"})
+	var a = &fakeArchiver{err: errors.New("disk full")}
+	q.SetArchiver(a)
+	var j = q.NewJob("test archive", []string{"arg1"})
+	j.purgeAt = time.Now().Add(-time.Hour)
+
+	q.purgeOldJobs()
+	if q.GetJob(j.ID()) != j {
+		t.Fatal("job should not be purged when archiving fails")
+	}
+
+	a.err = nil
+	q.purgeOldJobs()
+	if q.GetJob(j.ID()) != nil {
+		t.Error("job not purged")
+	}
+	if len(a.records) != 1 || a.records[0].ID != j.ID() {
+		t.Errorf("job not archived: %#v", a.records)
+	}
+}
+
+// queueingArchiver adds a job to its queue while archiving
+type queueingArchiver struct {
+	q     *Queue
+	added *Job
+}
+
+func (a *queueingArchiver) Write([]Record) error {
+	a.added = a.q.NewJob("added during archive", []string{"arg1"})
+	return nil
+}
+
+func TestPurgeArchivesUnlocked(t *testing.T) {
+	var q = New(CommandRunner{Path: "/opt/openoni/manage.py"})
+	var a = &queueingArchiver{q: q}
+	q.SetArchiver(a)
+	var j = q.NewJob("test archive", []string{"arg1"})
+	j.purgeAt = time.Now().Add(-time.Hour)
+
+	var done = make(chan struct{})
+	go func() {
+		q.purgeOldJobs()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("queue was locked while jobs were archived")
+	}
+	if q.GetJob(j.ID()) != nil || q.GetJob(a.added.ID()) != a.added {
+		t.Errorf("expected only the expired job to be purged")
+	}
+}
+
+func TestRetention(t *testing.T) {
+	var q = getQ(t)
+	q.SetRetention(time.Hour * 24 * 90)
+	var j = q.NewJob("Test failure", []string{"fail"})
+	_ = j.Run(context.Background())
+
+	if j.purgeAt.Before(time.Now().Add(time.Hour * 24 * 89)) {
+		t.Errorf("expected configured retention to apply to failed job, purge time is %s", j.purgeAt)
+	}
+}
+
+func TestEnvironment(t *testing.T) {
+	var q = getQ(t)
+	var before = q.NewJob("before", []string{"arg1"})
+	q.SetEnvironment("abc123")
+	var after = q.NewJob("after", []string{"arg1"})
+
+	if before.Environment() != "" {
+		t.Errorf("expected job created before SetEnvironment to have no environment, got %q", before.Environment())
+	}
+	if after.Environment() != "abc123" || after.Record().Environment != "abc123" {
+		t.Errorf("expected job and record to have environment %q, got %q / %q", "abc123", after.Environment(), after.Record().Environment)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	var q = getQ(t)
+	q.Pause("maintenance")
+
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go q.Wait(ctx)
+
+	var id = q.QueueJob("Test success", []string{"succeed"})
+	time.Sleep(time.Millisecond * 1500)
+
+	var st = q.Status()
+	if !st.Paused || st.Reason != "maintenance" || st.PausedAt.IsZero() {
+		t.Fatalf("Expected paused status with reason, got %#v", st)
+	}
+	if st.Pending != 1 {
+		t.Fatalf("Expected 1 pending job, got %d", st.Pending)
+	}
+	if q.GetJob(id).Status() != StatusPending {
+		t.Fatalf("Job should not run while the queue is paused, but its status is %q", q.GetJob(id).Status())
+	}
+
+	q.Resume()
+	var deadline = time.Now().Add(time.Second * 5)
+	for q.GetJob(id).Status() != StatusSuccessful {
+		if time.Now().After(deadline) {
+			t.Fatalf("Job never completed after resume; status is %q", q.GetJob(id).Status())
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	if q.Status().Paused {
+		t.Fatal("Queue should not be paused after resume")
+	}
+}
+
+func TestFuncJob(t *testing.T) {
+	var q = getQ(t)
+	var j = q.NewFuncJob("func job", func(_ context.Context, j *Job) error {
+		j.Logf("processed %d items", 3)
+		j.Warnf("item %d was weird", 2)
+		j.AddArtifact("report.json")
+		return nil
+	})
+
+	var err = j.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if j.Status() != StatusSuccessful {
+		t.Fatalf("expected status %s, got %s", StatusSuccessful, j.Status())
+	}
+	if v := j.StdoutValues(); len(v) != 1 || v[0] != "processed 3 items" {
+		t.Errorf("unexpected stdout: %#v", v)
+	}
+	if v := j.Stderr(); len(v) != 1 || !strings.HasSuffix(v[0], "item 2 was weird") {
+		t.Errorf("unexpected stderr: %#v", v)
+	}
+	if a := j.Artifacts(); len(a) != 1 || a[0] != "report.json" {
+		t.Errorf("unexpected artifacts: %#v", a)
+	}
+}
+
+func TestFuncJobFailure(t *testing.T) {
+	var q = getQ(t)
+	var failing = q.NewFuncJob("failing", func(context.Context, *Job) error { return errors.New("nope") })
+	var panicky = q.NewFuncJob("panicky", func(context.Context, *Job) error { panic("oh no") })
+
+	for _, j := range []*Job{failing, panicky} {
+		var err = j.Run(context.Background())
+		if err == nil {
+			t.Errorf("%s: expected an error", j.Name())
+		}
+		if j.Status() != StatusFailed {
+			t.Errorf("%s: expected status %s, got %s", j.Name(), StatusFailed, j.Status())
+		}
+	}
+}
+
+func TestDone(t *testing.T) {
+	var q = getQ(t)
+	var release = make(chan struct{})
+	var j = q.NewFuncJob("blocker", func(context.Context, *Job) error {
+		<-release
+		return nil
+	})
+
+	var err = j.Start(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	select {
+	case <-j.Done():
+		t.Fatalf("Done should not be closed while the job is running")
+	default:
+	}
+
+	close(release)
+	err = j.Wait()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	select {
+	case <-j.Done():
+	default:
+		t.Fatalf("Done should be closed once the job finishes")
+	}
+
+	select {
+	case <-NoOpJob().Done():
+	default:
+		t.Fatalf("Done should always be closed for no-op jobs")
+	}
+}
+
+func TestQueueJobAfter(t *testing.T) {
+	var q = getQ(t)
+	var first = q.QueueFunc("fails", func(context.Context, *Job) error { return errors.New("nope") })
+	var second = q.QueueJobAfter("follow-up", []string{"check"}, first)
+	var orphan = q.QueueJobAfter("orphan", []string{"check"}, 12345)
+
+	for range 3 {
+		var j = <-q.queue
+		j.Run(context.Background())
+	}
+
+	for _, id := range []int64{second, orphan} {
+		var j = q.GetJob(id)
+		if j.Status() != StatusFailStart {
+			t.Errorf("%s: expected status %s, got %s", j.Name(), StatusFailStart, j.Status())
+		}
+		if j.Error() == nil {
+			t.Errorf("%s: expected a prerequisite error", j.Name())
+		}
+	}
+
+	var ok = q.QueueFunc("succeeds", func(context.Context, *Job) error { return nil })
+	var third = q.QueueJobAfter("follow-up", []string{"succeed"}, ok)
+	for range 2 {
+		var j = <-q.queue
+		j.Run(context.Background())
+	}
+	if j := q.GetJob(third); j.Status() != StatusSuccessful {
+		t.Errorf("expected follow-up job to succeed, got %s (%v)", j.Status(), j.Error())
+	}
+}
+
+func TestHooks(t *testing.T) {
+	var q = getQ(t)
+	var events []string
+	var record = func(event string) func(*Job) {
+		return func(j *Job) { events = append(events, event+" "+j.Name()) }
+	}
+	q.SetHooks(Hooks{Queued: record("queued"), Started: record("started"), Finished: record("finished")})
+
+	q.QueueJob("ok", []string{"succeed"})
+	q.QueueJob("bad", []string{"fail"})
+	for range 2 {
+		var j = <-q.queue
+		j.Run(context.Background())
+	}
+
+	var expected = []string{"queued ok", "queued bad", "started ok", "finished ok", "started bad", "finished bad"}
+	if strings.Join(events, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("Expected events %q, got %q", expected, events)
+	}
+}
+
+func TestNotes(t *testing.T) {
+	var q = getQ(t)
+	var id = q.QueueJob("ok", []string{"succeed"})
+	var j = q.GetJob(id)
+	j.AddNote("alice", "failed due to full disk")
+	j.Run(context.Background())
+	j.AddNote("bob", "re-ran as job 99")
+
+	var notes = j.Record().Notes
+	if len(notes) != 2 || notes[0].Author != "alice" || notes[1].Text != "re-ran as job 99" {
+		t.Fatalf("Unexpected notes: %#v", notes)
+	}
+	if notes[1].Time.Before(notes[0].Time) {
+		t.Errorf("Expected notes in the order they were added")
+	}
+}
+
+func TestLabels(t *testing.T) {
+	var q = getQ(t)
+	var j = q.NewJob("labeled", []string{"succeed"})
+	if j.Labels() != nil {
+		t.Fatalf("Expected no labels on a new job")
+	}
+
+	var lccns = []string{"sn96088442", "sn96088441"}
+	j.SetLabel("lccn", lccns...)
+	lccns[0] = "changed"
+	j.SetLabel("batch", "batch_oru_foo_ver01")
+	j.SetLabel("batch", "batch_oru_foo_ver02")
+
+	var labels = j.Record().Labels
+	if len(labels) != 2 || labels["lccn"][0] != "sn96088442" || len(labels["batch"]) != 1 || labels["batch"][0] != "batch_oru_foo_ver02" {
+		t.Fatalf("Unexpected labels: %#v", labels)
+	}
+	labels["lccn"][0] = "changed"
+	if j.Labels()["lccn"][0] != "sn96088442" {
+		t.Errorf("Changing the returned labels shouldn't change the job's")
+	}
+}
+
+func TestProgress(t *testing.T) {
+	var q = getQ(t)
+	var seen []ProgressEvent
+	q.SetHooks(Hooks{Progress: func(_ *Job, e ProgressEvent) { seen = append(seen, e) }})
+
+	var j = q.NewFuncJob("loader", func(_ context.Context, j *Job) error {
+		j.AddProgress(ProgressEvent{Done: 1, Total: 2, Message: "record 1 of 2"})
+		j.AddProgress(ProgressEvent{Done: 2, Total: 2, Message: "record 2 of 2", Detail: map[string]string{"lccn": "sn96088442"}})
+		return nil
+	})
+	j.Run(context.Background())
+
+	var progress = j.Record().Progress
+	if len(progress) != 2 || progress[1].Done != 2 || progress[1].Detail["lccn"] != "sn96088442" || progress[0].Time.IsZero() {
+		t.Fatalf("Unexpected progress: %#v", progress)
+	}
+	if len(seen) != 2 || seen[0].Message != "record 1 of 2" {
+		t.Errorf("Expected the hook to see every event, got %#v", seen)
+	}
+}
+
+func TestStalls(t *testing.T) {
+	var q = getQ(t)
+	var stalls int
+	q.SetHooks(Hooks{Stalled: func(*Job) { stalls++ }})
+
+	var release = make(chan struct{})
+	var j = q.NewFuncJob("quiet", func(context.Context, *Job) error {
+		<-release
+		return nil
+	})
+	var err = j.Start(context.Background())
+	if err != nil {
+		t.Fatalf("Unable to start job: %s", err)
+	}
+	defer func() {
+		close(release)
+		j.Wait()
+	}()
+
+	var threshold = time.Millisecond * 20
+	if j.Stalled(threshold) {
+		t.Fatalf("Job shouldn't be stalled as soon as it starts")
+	}
+
+	time.Sleep(threshold * 2)
+	q.checkStalls(threshold)
+	q.checkStalls(threshold)
+	if !j.Stalled(threshold) || stalls != 1 {
+		t.Fatalf("Expected one stall reported, got %d (stalled: %v)", stalls, j.Stalled(threshold))
+	}
+
+	// Output clears the stall, but a new stall is reported once it's quiet
+	// again
+	j.Logf("still alive")
+	if j.Stalled(threshold) {
+		t.Fatalf("Job shouldn't be stalled right after output")
+	}
+	time.Sleep(threshold * 2)
+	q.checkStalls(threshold)
+	if stalls != 2 {
+		t.Fatalf("Expected a second stall to be reported, got %d", stalls)
+	}
+}
+
+// benchmarkQueue queues b.N jobs made by the given function while the queue
+// is running, then waits for all of them to finish. See cmd/queue-bench for
+// latency percentiles and memory use under heavier load.
+func benchmarkQueue(b *testing.B, queueJob func(q *Queue) int64) {
+	var q = New(CommandRunner{Path: "/bin/true"})
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go q.Wait(ctx)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	var ids = make([]int64, b.N)
+	for i := range ids {
+		ids[i] = queueJob(q)
+	}
+	for _, id := range ids {
+		<-q.GetJob(id).Done()
+	}
+}
+
+func BenchmarkQueueFunc(b *testing.B) {
+	var noop = func(context.Context, *Job) error { return nil }
+	benchmarkQueue(b, func(q *Queue) int64 { return q.QueueFunc("bench", noop) })
+}
+
+func BenchmarkQueueJob(b *testing.B) {
+	benchmarkQueue(b, func(q *Queue) int64 { return q.QueueJob("bench", nil) })
+}
+
+func TestSteps(t *testing.T) {
+	var q = getQ(t)
+	var post = "/bin/echo"
+	q.SetSteps(func(id int64, args []string) (pre, after []Step) {
+		if args[0] == "plain" {
+			return nil, nil
+		}
+		return []Step{{Path: "/bin/echo", Args: []string{"pre", args[0]}}}, []Step{{Path: post, Args: []string{"post"}}}
+	})
+
+	var j = q.NewJob("hooked", []string{"succeed"})
+	var err = j.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var got = strings.Join(j.StdoutValues(), "|")
+	var expected = "Running pre-job step: /bin/echo pre succeed|pre succeed|Yes!|Running post-job step: /bin/echo post|post"
+	if got != expected {
+		t.Fatalf("Expected stdout %q, got %q", expected, got)
+	}
+
+	// A failed command skips post steps
+	j = q.NewJob("hooked failure", []string{"fail"})
+	j.Run(context.Background())
+	if j.Status() != StatusFailed || strings.Contains(strings.Join(j.StdoutValues(), "|"), "post") {
+		t.Fatalf("Expected a failed job without post steps, got %s: %q", j.Status(), j.StdoutValues())
+	}
+
+	// A failed post step is only a warning
+	post = "/bin/false"
+	j = q.NewJob("post failure", []string{"succeed"})
+	err = j.Run(context.Background())
+	if err != nil || len(j.Stderr()) != 1 {
+		t.Fatalf("Expected success with a warning, got %v and %q", err, j.Stderr())
+	}
+
+	// A failed pre step stops the job
+	q.SetSteps(func(int64, []string) ([]Step, []Step) { return []Step{{Path: "/bin/false"}}, nil })
+	j = q.NewJob("pre failure", []string{"succeed"})
+	err = j.Run(context.Background())
+	if err == nil || strings.Contains(strings.Join(j.StdoutValues(), "|"), "Yes!") {
+		t.Fatalf("Expected the pre step to stop the job, got %v and %q", err, j.StdoutValues())
+	}
+}
+
+func TestLogSources(t *testing.T) {
+	var q = getQ(t)
+	q.SetSteps(func(int64, []string) ([]Step, []Step) {
+		return []Step{{Path: "/bin/echo", Args: []string{"pre"}}}, nil
+	})
+	var j = q.NewJob("sourced", []string{"succeed"})
+	var err = j.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	j.Warnf("done")
+
+	type entry struct {
+		Source string
+		Seq    int64
+		Level  logstream.Level
+	}
+	var got []entry
+	for _, l := range append(j.StdoutLeveled(), j.StderrLeveled()...) {
+		got = append(got, entry{l.Source, l.Seq, l.Level})
+	}
+	var expected = []entry{
+		{AgentSource, 1, logstream.LevelInfo},
+		{"echo", 2, logstream.LevelInfo},
+		{"succeed", 3, logstream.LevelInfo},
+		{AgentSource, 4, logstream.LevelWarning},
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %d lines, got %#v", len(expected), got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("Line %d: expected %#v, got %#v", i, expected[i], got[i])
+		}
+	}
+}
+
+func TestLock(t *testing.T) {
+	var q = getQ(t)
+	var held, released int
+	q.SetLock(func(_ context.Context, id int64, args []string) (func(), error) {
+		if args[0] == "blocked" {
+			return nil, errors.New("locked by someone else")
+		}
+		held++
+		return func() { released++ }, nil
+	})
+
+	var j = q.NewJob("locked", []string{"succeed"})
+	var err = j.Run(context.Background())
+	if err != nil || held != 1 || released != 1 {
+		t.Fatalf("Expected a successful job which took and released the lock, got %v (held %d, released %d)", err, held, released)
+	}
+
+	// The lock is released even if the job fails
+	j = q.NewJob("locked failure", []string{"fail"})
+	j.Run(context.Background())
+	if j.Status() != StatusFailed || released != 2 {
+		t.Fatalf("Expected a failed job which released the lock, got %s (released %d)", j.Status(), released)
+	}
+
+	j = q.NewJob("blocked", []string{"blocked"})
+	err = j.Run(context.Background())
+	if j.Status() != StatusFailStart || err == nil || !strings.Contains(err.Error(), "locked by someone else") {
+		t.Fatalf("Expected the lock error to stop the job, got %s / %v", j.Status(), err)
+	}
+	if held != 2 || released != 2 {
+		t.Fatalf("A job which couldn't lock shouldn't release anything (held %d, released %d)", held, released)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	var q = getQ(t)
+	var checked []int64
+	q.SetCheck(func(id int64, args []string) error {
+		checked = append(checked, id)
+		if len(args) > 0 && args[0] == "stale" {
+			return errors.New("input changed")
+		}
+		return nil
+	})
+
+	var j = q.NewJob("fresh", []string{"succeed"})
+	var err = j.Run(context.Background())
+	if err != nil || j.Status() != StatusSuccessful {
+		t.Fatalf("Expected a job which passed its check to run, got %s / %v", j.Status(), err)
+	}
+
+	j = q.NewJob("stale", []string{"stale"})
+	err = j.Run(context.Background())
+	if j.Status() != StatusFailStart || err == nil || !strings.Contains(err.Error(), "input changed") {
+		t.Fatalf("Expected the check error to stop the job, got %s / %v", j.Status(), err)
+	}
+	if len(j.StdoutValues()) != 0 {
+		t.Fatalf("Expected the command not to run, got output %q", j.StdoutValues())
+	}
+	if len(checked) != 2 {
+		t.Fatalf("Expected both jobs to be checked, got %v", checked)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	var q = New(CommandRunner{Path: "/bin/sleep"})
+	var running = q.NewJob("sleeper", []string{"10"})
+	var err = running.Start(context.Background())
+	if err != nil {
+		t.Fatalf("Unable to start job: %s", err)
+	}
+	if !running.Cancel("operator request") {
+		t.Fatalf("Expected a running job to be cancelable")
+	}
+	err = running.Wait()
+	if !errors.Is(err, ErrCanceled) || !strings.Contains(err.Error(), "operator request") || running.Status() != StatusCanceled {
+		t.Fatalf("Expected the job to end as canceled, got %s / %v", running.Status(), err)
+	}
+	if running.Cancel("again") {
+		t.Fatalf("A finished job shouldn't be cancelable")
+	}
+
+	var pending = q.NewFuncJob("never", func(context.Context, *Job) error {
+		t.Error("A canceled job shouldn't run")
+		return nil
+	})
+	pending.Cancel("")
+	if pending.Status() != StatusCanceled || !pending.Finished() {
+		t.Fatalf("Expected a job canceled before it started to finish right away, got %s", pending.Status())
+	}
+	err = pending.Run(context.Background())
+	if !errors.Is(err, ErrCanceled) || pending.Status() != StatusCanceled {
+		t.Fatalf("Expected a canceled job to refuse to run, got %s / %v", pending.Status(), err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	var q = getQ(t)
+	q.SetTimeout(time.Millisecond * 20)
+	var j = q.NewFuncJob("slow", func(ctx context.Context, _ *Job) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	var err = j.Run(context.Background())
+	if !errors.Is(err, ErrTimedOut) {
+		t.Fatalf("Expected the job to time out, got %v", err)
+	}
+
+	// Finishing releases the job's context, but that's not a cancellation
+	q.SetTimeout(0)
+	j = q.NewFuncJob("quick", func(context.Context, *Job) error { return nil })
+	err = j.Run(context.Background())
+	if err != nil || j.cause() != nil {
+		t.Fatalf("Expected a clean run, got %v (cause %v)", err, j.cause())
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	var q = getQ(t)
+	var ctx, cancel = context.WithCancel(context.Background())
+	go q.Wait(ctx)
+
+	var release = make(chan struct{})
+	var quick = q.QueueFunc("quick", func(context.Context, *Job) error {
+		<-release
+		return nil
+	})
+	for q.GetJob(quick).Status() != StatusStarted {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Canceling Wait's context doesn't touch the running job, and the job
+	// finishing within the grace period means nothing is killed
+	cancel()
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		close(release)
+	}()
+	var killed = q.Shutdown(time.Second)
+	if len(killed) != 0 || q.GetJob(quick).Status() != StatusSuccessful {
+		t.Fatalf("Expected the running job to drain, got killed %v, status %s", killed, q.GetJob(quick).Status())
+	}
+	if q.Context().Err() == nil {
+		t.Fatalf("Expected the root context to be canceled after shutdown")
+	}
+
+	// Anything started after that is canceled straight away
+	var j = q.NewFuncJob("late", func(ctx context.Context, _ *Job) error {
+		<-ctx.Done()
+		return context.Cause(ctx)
+	})
+	var err = j.Run(q.Context())
+	if !errors.Is(err, ErrShutdown) {
+		t.Fatalf("Expected a job run after shutdown to be canceled, got %v", err)
+	}
+}
+
+func TestShutdownGraceExpires(t *testing.T) {
+	var q = getQ(t)
+	var j = q.NewFuncJob("stubborn", func(ctx context.Context, _ *Job) error {
+		<-ctx.Done()
+		return context.Cause(ctx)
+	})
+	var err = j.Start(q.Context())
+	if err != nil {
+		t.Fatalf("Unable to start job: %s", err)
+	}
+	var result = make(chan error, 1)
+	go func() { result <- j.Wait() }()
+
+	var killed = q.Shutdown(time.Millisecond * 20)
+	if len(killed) != 1 || killed[0] != j.ID() {
+		t.Fatalf("Expected job %d to be killed, got %v", j.ID(), killed)
+	}
+	err = <-result
+	if !errors.Is(err, ErrShutdown) {
+		t.Fatalf("Expected the job to fail with ErrShutdown, got %v", err)
+	}
+}
+
+func TestDefer(t *testing.T) {
+	var q = getQ(t)
+	var m sync.Mutex
+	var held = make(map[int64]time.Time)
+	q.SetDefer(func(id int64, _ []string, _ time.Time) time.Time {
+		m.Lock()
+		defer m.Unlock()
+		return held[id]
+	})
+
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	var until = time.Now().Add(time.Millisecond * 1500)
+	var deferred = q.NewJob("deferred", []string{"succeed"})
+	var canceled = q.NewJob("canceled", []string{"succeed"})
+	m.Lock()
+	held[deferred.ID()] = until
+	held[canceled.ID()] = until.Add(time.Hour)
+	m.Unlock()
+	q.enqueue(deferred)
+	q.enqueue(canceled)
+	var next = q.QueueJob("next", []string{"succeed"})
+	go q.Wait(ctx)
+
+	var waitFor = func(j *Job, status JobStatus) {
+		t.Helper()
+		var deadline = time.Now().Add(time.Second * 5)
+		for j.Status() != status {
+			if time.Now().After(deadline) {
+				t.Fatalf("Job %q never reached %q; status is %q", j.Name(), status, j.Status())
+			}
+			time.Sleep(time.Millisecond * 50)
+		}
+	}
+
+	// A deferred job doesn't hold up the jobs behind it
+	waitFor(q.GetJob(next), StatusSuccessful)
+	if deferred.Status() != StatusPending || !deferred.DeferredUntil().Equal(until) {
+		t.Fatalf("Expected the job to be deferred until %s, got %q / %s", until, deferred.Status(), deferred.DeferredUntil())
+	}
+	var st = q.Status()
+	if st.Deferred != 2 || st.Pending != 2 {
+		t.Fatalf("Expected 2 deferred jobs, both pending, got %#v", st)
+	}
+
+	// Canceling a deferred job ends it without waiting out its window
+	canceled.Cancel("not today")
+	waitFor(canceled, StatusCanceled)
+
+	waitFor(deferred, StatusSuccessful)
+	if !deferred.DeferredUntil().IsZero() || deferred.StartedAt().Before(until) {
+		t.Fatalf("Expected the job to start once its deferral ended, got started %s, deferred until %s", deferred.StartedAt(), deferred.DeferredUntil())
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	var q = New(CommandRunner{Path: "/bin/sh"})
+	q.SetWorkers(3)
+	q.SetClass(func(_ int64, args []string) string {
+		if args == nil {
+			return ""
+		}
+		return args[2]
+	})
+
+	var sleep = func(class string) []string {
+		return []string{"-c", "sleep 0.3", class}
+	}
+	var a1 = q.GetJob(q.QueueJob("a1", sleep("a")))
+	var a2 = q.GetJob(q.QueueJob("a2", sleep("a")))
+	var b = q.GetJob(q.QueueJob("b", sleep("b")))
+	var after = q.GetJob(q.QueueJobAfter("after a2", sleep("c"), a2.ID()))
+	var excl = q.GetJob(q.QueueFunc("exclusive", func(_ context.Context, _ *Job) error { return nil }))
+	var d = q.GetJob(q.QueueJob("d", sleep("d")))
+
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go q.Wait(ctx)
+
+	select {
+	case <-d.Done():
+	case <-time.After(time.Second * 10):
+		t.Fatal("Jobs never finished")
+	}
+
+	for _, j := range []*Job{a1, a2, b, after, excl, d} {
+		if j.Status() != StatusSuccessful {
+			t.Fatalf("Expected job %q to succeed, got %q", j.Name(), j.Status())
+		}
+	}
+	if !b.StartedAt().Before(a1.CompletedAt()) {
+		t.Errorf("Expected jobs in different classes to run side by side")
+	}
+	if a2.StartedAt().Before(a1.CompletedAt()) {
+		t.Errorf("Jobs in the same class must not overlap")
+	}
+	if after.StartedAt().Before(a2.CompletedAt()) {
+		t.Errorf("A job must not start before its prerequisite finishes")
+	}
+	for _, j := range []*Job{a1, a2, b, after} {
+		if excl.StartedAt().Before(j.CompletedAt()) {
+			t.Errorf("Exclusive job started before %q finished", j.Name())
+		}
+	}
+	if d.StartedAt().Before(excl.CompletedAt()) {
+		t.Errorf("A job queued behind an exclusive job must wait for it")
+	}
+}
+
+func TestWorkersSlowCheck(t *testing.T) {
+	var q = New(CommandRunner{Path: "/bin/sh"})
+	q.SetWorkers(2)
+	q.SetClass(func(_ int64, args []string) string { return args[2] })
+	var checking = make(chan struct{})
+	var release = make(chan struct{})
+	q.SetCheck(func(_ int64, args []string) error {
+		if args[2] == "slow" {
+			close(checking)
+			<-release
+		}
+		return nil
+	})
+
+	var slow = q.GetJob(q.QueueJob("slow", []string{"-c", "true", "slow"}))
+	var fast = q.GetJob(q.QueueJob("fast", []string{"-c", "true", "fast"}))
+	var ctx, cancel = context.WithCancel(context.Background())
+	go q.Wait(ctx)
+
+	// The slow job's check doesn't hold up jobs in other classes
+	<-checking
+	select {
+	case <-fast.Done():
+	case <-time.After(time.Second * 5):
+		t.Fatal("A slow check held up another class's job")
+	}
+	if slow.Status() != StatusPending {
+		t.Fatalf("Expected the slow job to still be starting, got %q", slow.Status())
+	}
+
+	// Shutdown waits for a job which is still starting
+	cancel()
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		close(release)
+	}()
+	var killed = q.Shutdown(time.Second * 5)
+	if len(killed) != 0 || slow.Status() != StatusSuccessful {
+		t.Fatalf("Expected the starting job to drain, got killed %v, status %q", killed, slow.Status())
+	}
+}
@@ -0,0 +1,53 @@
+package queue
+
+import (
+	"context"
+	"os/exec"
+)
+
+// Runner builds the command a job runs. The queue only knows about each job's
+// args; what program runs them, and in what environment, is up to the Runner.
+type Runner interface {
+	Command(ctx context.Context, args []string) *exec.Cmd
+}
+
+// CommandRunner is a Runner which runs a single program, passing each job's
+// args to it
+type CommandRunner struct {
+	// Path is the program to run
+	Path string
+
+	// Env is the environment the program runs in. If nil, the program gets
+	// the current process's environment.
+	Env []string
+}
+
+// Command implements Runner
+func (r CommandRunner) Command(ctx context.Context, args []string) *exec.Cmd {
+	var cmd = exec.CommandContext(ctx, r.Path, args...)
+	cmd.Env = r.Env
+	return cmd
+}
+
+// Hooks are optional callbacks for job lifecycle events, e.g., for
+// notifications or metrics. They're called synchronously, so they should be
+// quick, and they must not call back into the queue.
+type Hooks struct {
+	// Queued is called when a job is added to the queue
+	Queued func(j *Job)
+
+	// Started is called when a job starts running
+	Started func(j *Job)
+
+	// Finished is called when a job reaches a terminal state, whether it
+	// succeeded, failed, or couldn't start
+	Finished func(j *Job)
+
+	// Stalled is called by WatchStalls when a running job has produced no
+	// output for longer than the stall threshold. It's called once per stall:
+	// if the job produces output and then goes quiet again, it's called again.
+	Stalled func(j *Job)
+
+	// Progress is called whenever a job records a progress event
+	Progress func(j *Job, e ProgressEvent)
+}
@@ -0,0 +1,77 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Step is an extra program a command job runs before or after its main
+// command, e.g., a script to snapshot a database before a purge. A step's
+// output goes into the job's logs like the main command's does.
+type Step struct {
+	Path string
+	Args []string
+
+	// Env is the step's environment. If nil, the step gets the current
+	// process's environment.
+	Env []string
+}
+
+// StepFunc returns the steps to run before and after a command job with the
+// given id and args. It's called when the job starts.
+type StepFunc func(id int64, args []string) (pre, post []Step)
+
+// SetSteps tells the queue how to find extra steps for command jobs. Jobs
+// created before this is called are unaffected.
+func (q *Queue) SetSteps(fn StepFunc) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	q.steps = fn
+}
+
+// withSteps returns a RunFunc which runs the pre steps, the job's command,
+// and then the post steps. Any pre step failing stops the job before its
+// command runs. Post steps only run if the command succeeds, and their
+// failures are logged rather than failing the job, since by then the job's
+// real work is done.
+func (j *Job) withSteps(pre, post []Step) RunFunc {
+	return func(ctx context.Context, j *Job) error {
+		for _, s := range pre {
+			var err = j.runStep(ctx, "pre", s)
+			if err != nil {
+				return fmt.Errorf("pre-job step %s failed: %w", s.Path, err)
+			}
+		}
+
+		var cmd = j.runner.Command(ctx, j.args)
+		j.setSource(commandSource(j.args))
+		cmd.Stdout = &j.stdout
+		cmd.Stderr = &j.stderr
+		var err = cmd.Run()
+		if err != nil {
+			return err
+		}
+
+		for _, s := range post {
+			err = j.runStep(ctx, "post", s)
+			if err != nil {
+				j.Warnf("Post-job step %s failed: %s", s.Path, err)
+			}
+		}
+		return nil
+	}
+}
+
+// runStep runs a single step, capturing its output in the job's logs
+func (j *Job) runStep(ctx context.Context, kind string, s Step) error {
+	j.Logf("Running %s-job step: %s %s", kind, s.Path, strings.Join(s.Args, " "))
+	var cmd = exec.CommandContext(ctx, s.Path, s.Args...)
+	cmd.Env = s.Env
+	j.setSource(filepath.Base(s.Path))
+	cmd.Stdout = &j.stdout
+	cmd.Stderr = &j.stderr
+	return cmd.Run()
+}
@@ -0,0 +1,177 @@
+package queue
+
+import (
+	"context"
+	"time"
+)
+
+// ClassFunc returns a job's concurrency class when the queue has more than
+// one worker. It's given the job's id and args (nil for in-process jobs) when
+// the queue first reaches the job. Jobs in the same class never run at the
+// same time, and start in the order they were queued; jobs in different
+// classes may run side by side. The empty class is exclusive: a job in it
+// waits for everything running to finish, and nothing else starts until it's
+// done.
+type ClassFunc func(id int64, args []string) string
+
+// SetWorkers lets up to n jobs run at once. One, the default, runs jobs
+// strictly one at a time. Call it before Wait.
+func (q *Queue) SetWorkers(n int) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	q.workers = n
+}
+
+// SetClass tells the queue how to decide which jobs may run side by side.
+// Without it every job is exclusive, so extra workers never run anything
+// concurrently. Jobs created before this is called are unaffected.
+func (q *Queue) SetClass(fn ClassFunc) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	q.classFn = fn
+}
+
+// class returns the job's concurrency class, asking its ClassFunc the first
+// time
+func (j *Job) class() string {
+	if j.classFn == nil {
+		return ""
+	}
+	if !j.classified {
+		j.cls = j.classFn(j.id, j.args)
+		j.classified = true
+	}
+	return j.cls
+}
+
+// pool runs jobs on up to size workers for Wait
+type pool struct {
+	q       *Queue
+	size    int
+	backlog []*Job
+	running map[*Job]string
+	done    chan *Job
+}
+
+// waitPool is Wait for a queue with more than one worker
+func (q *Queue) waitPool(ctx context.Context, size int) {
+	var p = &pool{q: q, size: size, running: make(map[*Job]string), done: make(chan *Job, size)}
+	var lastPurgeCheck time.Time
+	var tick = time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	for {
+		if !q.Paused() {
+			// Deferred jobs whose time has come go ahead of anything queued after
+			// them
+			var due []*Job
+			for j := q.due(time.Now()); j != nil; j = q.due(time.Now()) {
+				due = append(due, j)
+			}
+			p.backlog = append(due, p.backlog...)
+			p.dispatch(time.Now())
+		}
+
+		select {
+		case j := <-q.queue:
+			p.backlog = append(p.backlog, j)
+		case j := <-p.done:
+			delete(p.running, j)
+		case <-tick.C:
+			if time.Since(lastPurgeCheck) > time.Hour {
+				q.purgeJobs(p.running)
+				lastPurgeCheck = time.Now()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// dispatch starts every job in the backlog which can start now. A job which
+// has to wait holds back the later jobs in its class, and an exclusive job
+// which has to wait holds back everything behind it.
+func (p *pool) dispatch(now time.Time) {
+	var waiting = make(map[string]bool)
+	var keep []*Job
+	for _, j := range p.backlog {
+		// Canceled jobs finish on their own without being started
+		if isDone(j) {
+			continue
+		}
+
+		var class = j.class()
+		if waiting[""] || waiting[class] || !p.canStart(j, class) {
+			waiting[class] = true
+			keep = append(keep, j)
+			continue
+		}
+		if p.q.hold(j, now) {
+			continue
+		}
+		p.start(j, class)
+	}
+	p.backlog = keep
+}
+
+// canStart returns true if there's a free worker for j, nothing running
+// conflicts with its class, and its prerequisite, if any, has finished
+func (p *pool) canStart(j *Job, class string) bool {
+	if len(p.running) >= p.size {
+		return false
+	}
+	if j.after != nil && !isDone(j.after) {
+		return false
+	}
+	if class == "" {
+		return len(p.running) == 0
+	}
+	for _, c := range p.running {
+		if c == "" || c == class {
+			return false
+		}
+	}
+	return true
+}
+
+// start runs j in the background. Its Start happens there too, since its
+// CheckFunc or LockFunc may be slow, but j is marked as starting first so
+// it's never both out of the backlog and not yet running, which Shutdown
+// relies on. It holds its worker from here until it's finished.
+func (p *pool) start(j *Job, class string) {
+	p.running[j] = class
+	j.setStarting()
+	go func() {
+		// We ignore errors here, as they're already logged by the job itself,
+		// and a job which couldn't start has already finished
+		if j.Start(p.q.root) == nil {
+			_ = j.Wait()
+		}
+		p.done <- j
+	}()
+}
+
+// setStarting marks a job that a worker has taken but not yet started
+func (j *Job) setStarting() {
+	j.stateMu.Lock()
+	defer j.stateMu.Unlock()
+	j.starting = true
+}
+
+// active returns true if the job is running or a worker is starting it
+func (j *Job) active() bool {
+	j.stateMu.RLock()
+	defer j.stateMu.RUnlock()
+	return j.status == StatusStarted || j.starting
+}
+
+// isDone returns true if j has finished. Unlike Finished, it's safe to call
+// while another goroutine may be finishing the job.
+func isDone(j *Job) bool {
+	select {
+	case <-j.Done():
+		return true
+	default:
+		return false
+	}
+}